@@ -0,0 +1,130 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/ForIAM/ForIAM/backend/internal/authz"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+)
+
+// AccessHandler explains the access of users: which permissions they hold,
+// and through which groups and roles.
+type AccessHandler struct {
+	db         *sql.DB
+	authorizer *authz.Authorizer
+}
+
+func NewAccessHandler(db *sql.DB, authorizer *authz.Authorizer) *AccessHandler {
+	return &AccessHandler{db: db, authorizer: authorizer}
+}
+
+// EffectivePermission is a permission a user holds, with every path by
+// which it is granted.
+type EffectivePermission struct {
+	Permission string         `json:"permission"`
+	Paths      [][]authz.Node `json:"paths"`
+}
+
+// AccessExplanation tells whether a user is allowed a permission, and why:
+// the paths granting it or system.admin.
+type AccessExplanation struct {
+	UserID     string         `json:"user_id"`
+	Permission string         `json:"permission"`
+	IsActive   bool           `json:"is_active"`
+	Allowed    bool           `json:"allowed"`
+	Paths      [][]authz.Node `json:"paths"`
+}
+
+// grants returns the grant paths of the user the path names and whether it
+// is active, answering the request when the user is not in the tenant.
+func (h *AccessHandler) grants(c *gin.Context) (string, bool, []authz.Grant, bool) {
+	userID, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return "", false, nil, false
+	}
+	tenantID := c.GetString("tenant_id")
+
+	var isActive bool
+	err = h.db.QueryRow(`
+		SELECT is_active FROM users
+		WHERE id = $1 AND tenant_id = $2 AND principal_type = 'user'
+	`, userID.String(), tenantID).Scan(&isActive)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return "", false, nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return "", false, nil, false
+	}
+
+	grants, err := h.authorizer.Grants(c.Request.Context(), tenantID, userID.String())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return "", false, nil, false
+	}
+	return userID.String(), isActive, grants, true
+}
+
+// GetEffectivePermissions lists the permissions of a user with their grant
+// paths. Inactive users hold nothing; their paths are still shown by
+// ExplainAccess.
+func (h *AccessHandler) GetEffectivePermissions(c *gin.Context) {
+	userID, isActive, grants, ok := h.grants(c)
+	if !ok {
+		return
+	}
+
+	permissions := []EffectivePermission{}
+	if isActive {
+		for _, grant := range grants {
+			if n := len(permissions); n > 0 && permissions[n-1].Permission == grant.Permission {
+				permissions[n-1].Paths = append(permissions[n-1].Paths, grant.Path)
+				continue
+			}
+			permissions = append(permissions, EffectivePermission{Permission: grant.Permission, Paths: [][]authz.Node{grant.Path}})
+		}
+	}
+	c.JSON(http.StatusOK, gin.H{"user_id": userID, "is_active": isActive, "permissions": permissions})
+}
+
+// ExplainAccess answers whether a user is allowed the permission named by
+// the query, listing the paths that grant it or system.admin.
+func (h *AccessHandler) ExplainAccess(c *gin.Context) {
+	permission := c.Query("permission")
+	if permission == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "permission is required"})
+		return
+	}
+	if _, err := uuid.Parse(c.Param("id")); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	var exists bool
+	err := h.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM permissions WHERE name = $1)`, permission).Scan(&exists)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Permission not found"})
+		return
+	}
+
+	userID, isActive, grants, ok := h.grants(c)
+	if !ok {
+		return
+	}
+	explanation := AccessExplanation{UserID: userID, Permission: permission, IsActive: isActive, Paths: [][]authz.Node{}}
+	for _, grant := range grants {
+		if grant.Permission == permission || grant.Permission == authz.PermissionSystemAdmin {
+			explanation.Paths = append(explanation.Paths, grant.Path)
+		}
+	}
+	explanation.Allowed = isActive && len(explanation.Paths) > 0
+	c.JSON(http.StatusOK, explanation)
+}
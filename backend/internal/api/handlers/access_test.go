@@ -0,0 +1,166 @@
+package handlers
+
+import (
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/ForIAM/ForIAM/backend/internal/authz"
+	"github.com/ForIAM/ForIAM/backend/internal/dbtest"
+)
+
+const accessUser = "5f0c3c52-8f6e-4d7a-9d2b-3c1e0a9b7f41"
+
+// grantRow is a row of the grant query: a path to permission through the
+// groups and roles named, outermost first.
+func grantRow(permission, groups, roles string) []driver.Value {
+	return []driver.Value{accessUser, "alice@corp.example", "{" + groups + "}", "{" + groups + "}",
+		"{" + roles + "}", "{" + roles + "}", "perm-" + permission, permission}
+}
+
+// scriptAccess scripts accessUser, active or not, holding user.read
+// directly through the role readers and through the group staff, and
+// user.write through engineering nested in staff and the child role
+// writers of editors.
+func scriptAccess(s *dbtest.Script, active bool, extra ...[]driver.Value) {
+	s.On("SELECT is_active FROM users", nil, []driver.Value{active})
+	rows := append([][]driver.Value{
+		grantRow("user.read", "", "readers"),
+		grantRow("user.read", "staff", "readers"),
+		grantRow("user.write", "engineering,staff", "editors,writers"),
+	}, extra...)
+	s.On("WITH RECURSIVE member_of", nil, rows...)
+}
+
+// pathNames returns the names along path.
+func pathNames(path []authz.Node) []string {
+	var names []string
+	for _, node := range path {
+		names = append(names, node.Type+":"+node.Name)
+	}
+	return names
+}
+
+func TestAccessHandler_EffectivePermissions(t *testing.T) {
+	db, script := dbtest.Open(t)
+	scriptAccess(script, true)
+
+	h := &AccessHandler{db: db, authorizer: authz.New(db)}
+	w := serve(h.GetEffectivePermissions, "GET", "/users/:id/effective-permissions", "/users/"+accessUser+"/effective-permissions", "")
+	expectStatus(t, "active user", w, http.StatusOK)
+
+	var body struct {
+		Permissions []EffectivePermission `json:"permissions"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("Failed to parse response: %v", err)
+	}
+	if len(body.Permissions) != 2 || body.Permissions[0].Permission != "user.read" || body.Permissions[1].Permission != "user.write" {
+		t.Fatalf("Expected user.read and user.write once each, got %+v", body.Permissions)
+	}
+	if len(body.Permissions[0].Paths) != 2 {
+		t.Errorf("Expected both paths to user.read, got %v", body.Permissions[0].Paths)
+	}
+	want := []string{"user:alice@corp.example", "group:engineering", "group:staff", "role:editors", "role:writers", "permission:user.write"}
+	if got := pathNames(body.Permissions[1].Paths[0]); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected the path through nested groups and child roles %v, got %v", want, got)
+	}
+}
+
+func TestAccessHandler_EffectivePermissionsOfInactiveUser(t *testing.T) {
+	db, script := dbtest.Open(t)
+	scriptAccess(script, false)
+
+	h := &AccessHandler{db: db, authorizer: authz.New(db)}
+	w := serve(h.GetEffectivePermissions, "GET", "/users/:id/effective-permissions", "/users/"+accessUser+"/effective-permissions", "")
+	expectStatus(t, "inactive user", w, http.StatusOK)
+
+	var body struct {
+		Permissions []EffectivePermission `json:"permissions"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil || len(body.Permissions) != 0 {
+		t.Errorf("Expected an inactive user to hold nothing, got %s", w.Body.String())
+	}
+}
+
+func TestAccessHandler_EffectivePermissionsOfMalformedUser(t *testing.T) {
+	db, _ := dbtest.Open(t)
+
+	h := &AccessHandler{db: db, authorizer: authz.New(db)}
+	w := serve(h.GetEffectivePermissions, "GET", "/users/:id/effective-permissions", "/users/alice/effective-permissions", "")
+	expectStatus(t, "malformed user ID", w, http.StatusNotFound)
+}
+
+func TestAccessHandler_ExplainAccess(t *testing.T) {
+	tests := []struct {
+		name       string
+		permission string
+		active     bool
+		admin      bool
+		allowed    bool
+		paths      int
+	}{
+		{"permission held through two paths", "user.read", true, false, true, 2},
+		{"permission not held", "role.delete", true, false, false, 0},
+		{"permission allowed by system.admin", "role.delete", true, true, true, 1},
+		{"permission of an inactive user", "user.read", false, false, false, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, script := dbtest.Open(t)
+			script.On("SELECT EXISTS (SELECT 1 FROM permissions WHERE name = $1)", nil, []driver.Value{true})
+			var extra [][]driver.Value
+			if tt.admin {
+				extra = append(extra, grantRow(authz.PermissionSystemAdmin, "", "admins"))
+			}
+			scriptAccess(script, tt.active, extra...)
+
+			h := &AccessHandler{db: db, authorizer: authz.New(db)}
+			w := serve(h.ExplainAccess, "GET", "/users/:id/access-explain", "/users/"+accessUser+"/access-explain?permission="+tt.permission, "")
+			expectStatus(t, tt.name, w, http.StatusOK)
+
+			var explanation AccessExplanation
+			if err := json.Unmarshal(w.Body.Bytes(), &explanation); err != nil {
+				t.Fatalf("Failed to parse response: %v", err)
+			}
+			if explanation.Allowed != tt.allowed || len(explanation.Paths) != tt.paths {
+				t.Errorf("Expected allowed %v with %d paths, got %+v", tt.allowed, tt.paths, explanation)
+			}
+		})
+	}
+}
+
+func TestAccessHandler_ExplainRefused(t *testing.T) {
+	tests := []struct {
+		name       string
+		path       string
+		permission bool
+		user       bool
+		status     int
+	}{
+		{"no permission asked for", "/users/" + accessUser + "/access-explain", true, true, http.StatusBadRequest},
+		{"malformed user ID", "/users/alice/access-explain?permission=user.read", true, true, http.StatusNotFound},
+		{"unknown permission", "/users/" + accessUser + "/access-explain?permission=user.read", false, true, http.StatusNotFound},
+		{"user outside the tenant", "/users/" + accessUser + "/access-explain?permission=user.read", true, false, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, script := dbtest.Open(t)
+			script.On("SELECT EXISTS (SELECT 1 FROM permissions WHERE name = $1)", nil, []driver.Value{tt.permission})
+			var user [][]driver.Value
+			if tt.user {
+				user = append(user, []driver.Value{true})
+			}
+			script.On("SELECT is_active FROM users", nil, user...)
+
+			h := &AccessHandler{db: db, authorizer: authz.New(db)}
+			w := serve(h.ExplainAccess, "GET", "/users/:id/access-explain", tt.path, "")
+			expectStatus(t, tt.name, w, tt.status)
+			if script.Ran("WITH RECURSIVE member_of") {
+				t.Error("Expected no grants to be looked up")
+			}
+		})
+	}
+}
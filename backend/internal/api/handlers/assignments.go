@@ -0,0 +1,1298 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+
+	"github.com/ForIAM/ForIAM/backend/internal/api/middleware"
+	"github.com/ForIAM/ForIAM/backend/internal/authz"
+	"github.com/ForIAM/ForIAM/backend/internal/provisioning"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// AssignmentHandler manages who holds what: the members of groups
+// (user_groups), the roles of groups (group_roles) and of users
+// (user_roles), the permissions of roles (role_permissions), and the child
+// roles and groups of roles (role_hierarchy) and groups (group_hierarchy).
+// Both sides of an assignment must belong to the caller's tenant;
+// permissions are global and named. As with SCIM, nobody can hand out more
+// than they hold: new assignments need every permission they grant.
+type AssignmentHandler struct {
+	db           *sql.DB
+	resolver     middleware.PermissionResolver
+	provisioning *provisioning.Queue
+}
+
+func NewAssignmentHandler(db *sql.DB, resolver middleware.PermissionResolver) *AssignmentHandler {
+	return &AssignmentHandler{db: db, resolver: resolver, provisioning: provisioning.NewQueue(db)}
+}
+
+// Permission is an entry of the global permission catalogue.
+type Permission struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// AssignmentRequest replaces the assignments of a group, user or role, or
+// adds permissions to a role. Only the list of the kind the path names is
+// read, and it must be present: an empty list removes every assignment.
+type AssignmentRequest struct {
+	UserIDs     []string `json:"user_ids"`
+	GroupIDs    []string `json:"group_ids"`
+	RoleIDs     []string `json:"role_ids"`
+	Permissions []string `json:"permissions"`
+}
+
+// AssignmentChange lists the IDs of what a request assigned and unassigned.
+// Assignments that already were as requested are left out.
+type AssignmentChange struct {
+	Added   []string `json:"added"`
+	Removed []string `json:"removed"`
+}
+
+// Queries selecting which of the IDs $1 belong to the tenant $2. Service
+// accounts are left to their own API.
+const (
+	tenantUsers  = `SELECT id FROM users WHERE id = ANY($1::uuid[]) AND tenant_id = $2 AND principal_type = 'user'`
+	tenantGroups = `SELECT id FROM groups WHERE id = ANY($1::uuid[]) AND tenant_id = $2`
+	tenantRoles  = `SELECT id FROM roles WHERE id = ANY($1::uuid[]) AND tenant_id = $2`
+)
+
+// errUnknown is returned for IDs that are malformed or not of the tenant.
+var errUnknown = errors.New("unknown ID")
+
+// inTenant returns ids, without duplicates, when query finds all of them in
+// the tenant, and errUnknown otherwise.
+func (h *AssignmentHandler) inTenant(c *gin.Context, query string, ids []string) ([]string, error) {
+	keys := make([]string, 0, len(ids))
+	for _, id := range ids {
+		parsed, err := uuid.Parse(id)
+		if err != nil {
+			return nil, errUnknown
+		}
+		keys = append(keys, parsed.String())
+	}
+	keys = dedupe(keys)
+	if len(keys) == 0 {
+		return keys, nil
+	}
+
+	rows, err := h.db.Query(query, pq.Array(keys), c.GetString("tenant_id"))
+	if err != nil {
+		return nil, err
+	}
+	found, err := scanIDs(rows)
+	if err != nil {
+		return nil, err
+	}
+	if len(found) != len(keys) {
+		return nil, errUnknown
+	}
+	return found, nil
+}
+
+// find returns the ID of the row query finds for id, answering the request
+// with 404 and notFound when there is none.
+func (h *AssignmentHandler) find(c *gin.Context, query, id, notFound string) (string, bool) {
+	ids, err := h.inTenant(c, query, []string{id})
+	if err == errUnknown {
+		c.JSON(http.StatusNotFound, gin.H{"error": notFound})
+		return "", false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return "", false
+	}
+	return ids[0], true
+}
+
+// resolve returns the IDs of the rows query finds for ids, answering the
+// request with 400 unless all of them are found.
+func (h *AssignmentHandler) resolve(c *gin.Context, query string, ids []string, kind string) ([]string, bool) {
+	found, err := h.inTenant(c, query, ids)
+	if err == errUnknown {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown " + kind + "; all must belong to the tenant"})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return nil, false
+	}
+	return found, true
+}
+
+// resolvePermissions returns the IDs of the permissions named names,
+// answering the request with 400 unless all of them exist.
+func (h *AssignmentHandler) resolvePermissions(c *gin.Context, names []string) ([]string, bool) {
+	names = dedupe(names)
+	if len(names) == 0 {
+		return names, true
+	}
+	rows, err := h.db.Query(`SELECT id FROM permissions WHERE name = ANY($1)`, pq.Array(names))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return nil, false
+	}
+	ids, err := scanIDs(rows)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return nil, false
+	}
+	if len(ids) != len(names) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown permission; permissions must be permission names"})
+		return nil, false
+	}
+	return ids, true
+}
+
+// assigned returns the IDs query selects, answering the request when that
+// fails.
+func (h *AssignmentHandler) assigned(c *gin.Context, query string, args ...interface{}) ([]string, bool) {
+	rows, err := h.db.Query(query, args...)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return nil, false
+	}
+	ids, err := scanIDs(rows)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return nil, false
+	}
+	return ids, true
+}
+
+// exists reports whether query selects a row, answering the request with
+// 404 when it does not.
+func (h *AssignmentHandler) exists(c *gin.Context, query string, args ...interface{}) bool {
+	var exists bool
+	if err := h.db.QueryRow(query, args...).Scan(&exists); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return false
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Assignment not found"})
+	}
+	return exists
+}
+
+// grantable makes sure the caller holds every one of permissions, loaded
+// with err, answering the request when they do not.
+func (h *AssignmentHandler) grantable(c *gin.Context, permissions []string, err error) bool {
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return false
+	}
+	return checkGrantable(c, h.db, h.resolver, permissions)
+}
+
+// applyChange runs remove, which deletes the children $2 of the parent $1,
+// and add, which inserts them, both returning the child IDs they changed.
+func applyChange(tx *sql.Tx, remove, add, parentID string, removeIDs, addIDs []string) ([]string, []string, error) {
+	rows, err := tx.Query(remove, parentID, pq.Array(removeIDs))
+	if err != nil {
+		return nil, nil, err
+	}
+	removed, err := scanIDs(rows)
+	if err != nil {
+		return nil, nil, err
+	}
+	rows, err = tx.Query(add, parentID, pq.Array(addIDs))
+	if err != nil {
+		return nil, nil, err
+	}
+	added, err := scanIDs(rows)
+	if err != nil {
+		return nil, nil, err
+	}
+	return added, removed, nil
+}
+
+// changed audits what a request assigned and unassigned and answers with it.
+func (h *AssignmentHandler) changed(c *gin.Context, resource, id, target, addAction, removeAction string, added, removed []string) {
+	tenantID, actor := c.GetString("tenant_id"), c.GetString("user_id")
+	ip, userAgent := c.ClientIP(), c.GetHeader("User-Agent")
+	for _, targetID := range added {
+		writeAuditTarget(h.db, tenantID, actor, addAction, resource, id, target, targetID, "success", ip, userAgent)
+	}
+	for _, targetID := range removed {
+		writeAuditTarget(h.db, tenantID, actor, removeAction, resource, id, target, targetID, "success", ip, userAgent)
+	}
+	c.JSON(http.StatusOK, AssignmentChange{Added: nonNil(added), Removed: nonNil(removed)})
+}
+
+// Queries reporting whether making the children $2 children of $1 would
+// close a loop: whether $1 can be reached from any of $2.
+const (
+	roleCycle = `
+		WITH RECURSIVE reachable(id) AS (
+			SELECT unnest($2::uuid[])
+			UNION
+			SELECT rh.child_role_id FROM role_hierarchy rh
+			JOIN reachable ON rh.parent_role_id = reachable.id
+		)
+		SELECT EXISTS (SELECT 1 FROM reachable WHERE id = $1)`
+	groupCycle = `
+		WITH RECURSIVE reachable(id) AS (
+			SELECT unnest($2::uuid[])
+			UNION
+			SELECT gh.child_group_id FROM group_hierarchy gh
+			JOIN reachable ON gh.parent_group_id = reachable.id
+		)
+		SELECT EXISTS (SELECT 1 FROM reachable WHERE id = $1)`
+)
+
+// closesCycle reports whether assigning add to parentID would close a loop
+// in graph, as told by query. The graph is locked until tx ends, so
+// concurrent changes cannot close one together.
+func closesCycle(tx *sql.Tx, graph, query, parentID string, add []string) (bool, error) {
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext($1))`, graph); err != nil {
+		return false, err
+	}
+	var cycle bool
+	err := tx.QueryRow(query, parentID, pq.Array(add)).Scan(&cycle)
+	return cycle, err
+}
+
+func (h *AssignmentHandler) answerUsers(c *gin.Context, rows *sql.Rows, err error) {
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	users := []User{}
+	for rows.Next() {
+		var user User
+		if err := rows.Scan(&user.ID, &user.TenantID, &user.Email, &user.IsActive, &user.CreatedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	c.JSON(http.StatusOK, users)
+}
+
+func (h *AssignmentHandler) answerGroups(c *gin.Context, rows *sql.Rows, err error) {
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	groups := []Group{}
+	for rows.Next() {
+		var group Group
+		if err := rows.Scan(&group.ID, &group.TenantID, &group.Name, &group.Description, &group.CreatedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		groups = append(groups, group)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	c.JSON(http.StatusOK, groups)
+}
+
+func (h *AssignmentHandler) answerRoles(c *gin.Context, rows *sql.Rows, err error) {
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	roles := []Role{}
+	for rows.Next() {
+		var role Role
+		if err := rows.Scan(&role.ID, &role.TenantID, &role.Name, &role.Description, &role.CreatedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		roles = append(roles, role)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	c.JSON(http.StatusOK, roles)
+}
+
+// Group members
+
+// GetGroupMembers lists the users in a group, or with transitive=true also
+// those in the groups nested in it.
+func (h *AssignmentHandler) GetGroupMembers(c *gin.Context) {
+	groupID, ok := h.find(c, tenantGroups, c.Param("id"), "Group not found")
+	if !ok {
+		return
+	}
+	if c.Query("transitive") == "true" {
+		rows, err := h.db.Query(`
+			WITH RECURSIVE nested(id) AS (
+				SELECT $1::uuid
+				UNION
+				SELECT gh.child_group_id FROM group_hierarchy gh
+				JOIN nested ON gh.parent_group_id = nested.id
+			)
+			SELECT u.id, u.tenant_id, u.email, u.is_active, u.created_at FROM users u
+			WHERE u.id IN (SELECT ug.user_id FROM user_groups ug WHERE ug.group_id IN (SELECT id FROM nested))
+				AND u.tenant_id = $2 AND u.principal_type = 'user'
+			ORDER BY u.email
+		`, groupID, c.GetString("tenant_id"))
+		h.answerUsers(c, rows, err)
+		return
+	}
+	rows, err := h.db.Query(`
+		SELECT u.id, u.tenant_id, u.email, u.is_active, u.created_at FROM users u
+		JOIN user_groups ug ON ug.user_id = u.id
+		WHERE ug.group_id = $1 AND u.tenant_id = $2 AND u.principal_type = 'user'
+		ORDER BY u.email
+	`, groupID, c.GetString("tenant_id"))
+	h.answerUsers(c, rows, err)
+}
+
+// GetUserGroups lists the groups a user is in, or with transitive=true also
+// the groups those are nested in.
+func (h *AssignmentHandler) GetUserGroups(c *gin.Context) {
+	userID, ok := h.find(c, tenantUsers, c.Param("id"), "User not found")
+	if !ok {
+		return
+	}
+	if c.Query("transitive") == "true" {
+		rows, err := h.db.Query(`
+			WITH RECURSIVE nested(id) AS (
+				SELECT ug.group_id FROM user_groups ug WHERE ug.user_id = $1::uuid
+				UNION
+				SELECT gh.parent_group_id FROM group_hierarchy gh
+				JOIN nested ON gh.child_group_id = nested.id
+			)
+			SELECT g.id, g.tenant_id, g.name, COALESCE(g.description, ''), g.created_at FROM groups g
+			WHERE g.id IN (SELECT id FROM nested) AND g.tenant_id = $2
+			ORDER BY g.name
+		`, userID, c.GetString("tenant_id"))
+		h.answerGroups(c, rows, err)
+		return
+	}
+	rows, err := h.db.Query(`
+		SELECT g.id, g.tenant_id, g.name, COALESCE(g.description, ''), g.created_at FROM groups g
+		JOIN user_groups ug ON ug.group_id = g.id
+		WHERE ug.user_id = $1 AND g.tenant_id = $2
+		ORDER BY g.name
+	`, userID, c.GetString("tenant_id"))
+	h.answerGroups(c, rows, err)
+}
+
+// AddGroupMember adds the user in the path to a group.
+func (h *AssignmentHandler) AddGroupMember(c *gin.Context) {
+	groupID, ok := h.find(c, tenantGroups, c.Param("id"), "Group not found")
+	if !ok {
+		return
+	}
+	userID, ok := h.find(c, tenantUsers, c.Param("user_id"), "User not found")
+	if !ok {
+		return
+	}
+	current, ok := h.assigned(c, `SELECT user_id FROM user_groups WHERE group_id = $1 AND user_id = $2`, groupID, userID)
+	if !ok {
+		return
+	}
+	h.changeGroupMembers(c, groupID, without([]string{userID}, current), nil)
+}
+
+// RemoveGroupMember removes the user in the path from a group.
+func (h *AssignmentHandler) RemoveGroupMember(c *gin.Context) {
+	groupID, ok := h.find(c, tenantGroups, c.Param("id"), "Group not found")
+	if !ok {
+		return
+	}
+	userID, ok := h.find(c, tenantUsers, c.Param("user_id"), "User not found")
+	if !ok {
+		return
+	}
+	if !h.exists(c, `SELECT EXISTS (SELECT 1 FROM user_groups WHERE group_id = $1 AND user_id = $2)`, groupID, userID) {
+		return
+	}
+	h.changeGroupMembers(c, groupID, nil, []string{userID})
+}
+
+// ReplaceGroupMembers sets the users in a group.
+func (h *AssignmentHandler) ReplaceGroupMembers(c *gin.Context) {
+	var req AssignmentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.UserIDs == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "user_ids is required"})
+		return
+	}
+
+	groupID, ok := h.find(c, tenantGroups, c.Param("id"), "Group not found")
+	if !ok {
+		return
+	}
+	userIDs, ok := h.resolve(c, tenantUsers, req.UserIDs, "user")
+	if !ok {
+		return
+	}
+	current, ok := h.assigned(c, `
+		SELECT ug.user_id FROM user_groups ug
+		JOIN users u ON u.id = ug.user_id
+		WHERE ug.group_id = $1 AND u.principal_type = 'user'
+	`, groupID)
+	if !ok {
+		return
+	}
+	h.changeGroupMembers(c, groupID, without(userIDs, current), without(current, userIDs))
+}
+
+// changeGroupMembers adds add to and removes remove from a group. New
+// members gain the permissions of the group, and the members of dynamic
+// groups follow their rule rather than hand edits.
+func (h *AssignmentHandler) changeGroupMembers(c *gin.Context, groupID string, add, remove []string) {
+	var dynamic bool
+	if err := h.db.QueryRow(`SELECT rule IS NOT NULL FROM groups WHERE id = $1`, groupID).Scan(&dynamic); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if dynamic {
+		c.JSON(http.StatusConflict, gin.H{"error": "The members of a dynamic group follow its rule"})
+		return
+	}
+	if len(add) > 0 {
+		permissions, err := authz.GroupPermissions(c.Request.Context(), h.db, []string{groupID})
+		if !h.grantable(c, permissions, err) {
+			return
+		}
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	added, removed, err := applyChange(tx, `
+		DELETE FROM user_groups WHERE group_id = $1 AND user_id = ANY($2)
+		RETURNING user_id
+	`, `
+		INSERT INTO user_groups (group_id, user_id)
+		SELECT $1, unnest($2::uuid[])
+		ON CONFLICT DO NOTHING
+		RETURNING user_id
+	`, groupID, remove, add)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to change members"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	// Connectors push groups with their members
+	if len(added)+len(removed) > 0 {
+		queueProvisioning(h.provisioning, c.GetString("tenant_id"), provisioning.ResourceGroup, groupID, provisioning.OperationUpsert)
+	}
+	h.changed(c, "group", groupID, "user", "group.member_add", "group.member_remove", added, removed)
+}
+
+// Group roles
+
+// GetGroupRoles lists the roles of a group.
+func (h *AssignmentHandler) GetGroupRoles(c *gin.Context) {
+	groupID, ok := h.find(c, tenantGroups, c.Param("id"), "Group not found")
+	if !ok {
+		return
+	}
+	rows, err := h.db.Query(`
+		SELECT r.id, r.tenant_id, r.name, COALESCE(r.description, ''), r.created_at FROM roles r
+		JOIN group_roles gr ON gr.role_id = r.id
+		WHERE gr.group_id = $1 AND r.tenant_id = $2
+		ORDER BY r.name
+	`, groupID, c.GetString("tenant_id"))
+	h.answerRoles(c, rows, err)
+}
+
+// GetRoleGroups lists the groups holding a role.
+func (h *AssignmentHandler) GetRoleGroups(c *gin.Context) {
+	roleID, ok := h.find(c, tenantRoles, c.Param("id"), "Role not found")
+	if !ok {
+		return
+	}
+	rows, err := h.db.Query(`
+		SELECT g.id, g.tenant_id, g.name, COALESCE(g.description, ''), g.created_at FROM groups g
+		JOIN group_roles gr ON gr.group_id = g.id
+		WHERE gr.role_id = $1 AND g.tenant_id = $2
+		ORDER BY g.name
+	`, roleID, c.GetString("tenant_id"))
+	h.answerGroups(c, rows, err)
+}
+
+// AddGroupRole gives a group the role in the path.
+func (h *AssignmentHandler) AddGroupRole(c *gin.Context) {
+	groupID, ok := h.find(c, tenantGroups, c.Param("id"), "Group not found")
+	if !ok {
+		return
+	}
+	roleID, ok := h.find(c, tenantRoles, c.Param("role_id"), "Role not found")
+	if !ok {
+		return
+	}
+	current, ok := h.assigned(c, `SELECT role_id FROM group_roles WHERE group_id = $1 AND role_id = $2`, groupID, roleID)
+	if !ok {
+		return
+	}
+	h.changeGroupRoles(c, groupID, without([]string{roleID}, current), nil)
+}
+
+// RemoveGroupRole takes the role in the path from a group.
+func (h *AssignmentHandler) RemoveGroupRole(c *gin.Context) {
+	groupID, ok := h.find(c, tenantGroups, c.Param("id"), "Group not found")
+	if !ok {
+		return
+	}
+	roleID, ok := h.find(c, tenantRoles, c.Param("role_id"), "Role not found")
+	if !ok {
+		return
+	}
+	if !h.exists(c, `SELECT EXISTS (SELECT 1 FROM group_roles WHERE group_id = $1 AND role_id = $2)`, groupID, roleID) {
+		return
+	}
+	h.changeGroupRoles(c, groupID, nil, []string{roleID})
+}
+
+// ReplaceGroupRoles sets the roles of a group.
+func (h *AssignmentHandler) ReplaceGroupRoles(c *gin.Context) {
+	var req AssignmentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.RoleIDs == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role_ids is required"})
+		return
+	}
+
+	groupID, ok := h.find(c, tenantGroups, c.Param("id"), "Group not found")
+	if !ok {
+		return
+	}
+	roleIDs, ok := h.resolve(c, tenantRoles, req.RoleIDs, "role")
+	if !ok {
+		return
+	}
+	current, ok := h.assigned(c, `SELECT role_id FROM group_roles WHERE group_id = $1`, groupID)
+	if !ok {
+		return
+	}
+	h.changeGroupRoles(c, groupID, without(roleIDs, current), without(current, roleIDs))
+}
+
+// changeGroupRoles gives a group the roles add and takes remove from it.
+func (h *AssignmentHandler) changeGroupRoles(c *gin.Context, groupID string, add, remove []string) {
+	if len(add) > 0 {
+		permissions, err := authz.RolePermissions(c.Request.Context(), h.db, add)
+		if !h.grantable(c, permissions, err) {
+			return
+		}
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	added, removed, err := applyChange(tx, `
+		DELETE FROM group_roles WHERE group_id = $1 AND role_id = ANY($2)
+		RETURNING role_id
+	`, `
+		INSERT INTO group_roles (group_id, role_id)
+		SELECT $1, unnest($2::uuid[])
+		ON CONFLICT DO NOTHING
+		RETURNING role_id
+	`, groupID, remove, add)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to change roles"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	h.changed(c, "group", groupID, "role", "group.role_add", "group.role_remove", added, removed)
+}
+
+// User roles
+
+// GetUserRoles lists the roles assigned to a user directly.
+func (h *AssignmentHandler) GetUserRoles(c *gin.Context) {
+	userID, ok := h.find(c, tenantUsers, c.Param("id"), "User not found")
+	if !ok {
+		return
+	}
+	rows, err := h.db.Query(`
+		SELECT r.id, r.tenant_id, r.name, COALESCE(r.description, ''), r.created_at FROM roles r
+		JOIN user_roles ur ON ur.role_id = r.id
+		WHERE ur.user_id = $1 AND r.tenant_id = $2
+		ORDER BY r.name
+	`, userID, c.GetString("tenant_id"))
+	h.answerRoles(c, rows, err)
+}
+
+// GetRoleUsers lists the users a role is assigned to directly.
+func (h *AssignmentHandler) GetRoleUsers(c *gin.Context) {
+	roleID, ok := h.find(c, tenantRoles, c.Param("id"), "Role not found")
+	if !ok {
+		return
+	}
+	rows, err := h.db.Query(`
+		SELECT u.id, u.tenant_id, u.email, u.is_active, u.created_at FROM users u
+		JOIN user_roles ur ON ur.user_id = u.id
+		WHERE ur.role_id = $1 AND u.tenant_id = $2 AND u.principal_type = 'user'
+		ORDER BY u.email
+	`, roleID, c.GetString("tenant_id"))
+	h.answerUsers(c, rows, err)
+}
+
+// AddUserRole gives a user the role in the path.
+func (h *AssignmentHandler) AddUserRole(c *gin.Context) {
+	userID, ok := h.find(c, tenantUsers, c.Param("id"), "User not found")
+	if !ok {
+		return
+	}
+	roleID, ok := h.find(c, tenantRoles, c.Param("role_id"), "Role not found")
+	if !ok {
+		return
+	}
+	current, ok := h.assigned(c, `SELECT role_id FROM user_roles WHERE user_id = $1 AND role_id = $2`, userID, roleID)
+	if !ok {
+		return
+	}
+	h.changeUserRoles(c, userID, without([]string{roleID}, current), nil)
+}
+
+// RemoveUserRole takes the role in the path from a user.
+func (h *AssignmentHandler) RemoveUserRole(c *gin.Context) {
+	userID, ok := h.find(c, tenantUsers, c.Param("id"), "User not found")
+	if !ok {
+		return
+	}
+	roleID, ok := h.find(c, tenantRoles, c.Param("role_id"), "Role not found")
+	if !ok {
+		return
+	}
+	if !h.exists(c, `SELECT EXISTS (SELECT 1 FROM user_roles WHERE user_id = $1 AND role_id = $2)`, userID, roleID) {
+		return
+	}
+	h.changeUserRoles(c, userID, nil, []string{roleID})
+}
+
+// ReplaceUserRoles sets the roles assigned to a user directly.
+func (h *AssignmentHandler) ReplaceUserRoles(c *gin.Context) {
+	var req AssignmentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.RoleIDs == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role_ids is required"})
+		return
+	}
+
+	userID, ok := h.find(c, tenantUsers, c.Param("id"), "User not found")
+	if !ok {
+		return
+	}
+	roleIDs, ok := h.resolve(c, tenantRoles, req.RoleIDs, "role")
+	if !ok {
+		return
+	}
+	current, ok := h.assigned(c, `SELECT role_id FROM user_roles WHERE user_id = $1`, userID)
+	if !ok {
+		return
+	}
+	h.changeUserRoles(c, userID, without(roleIDs, current), without(current, roleIDs))
+}
+
+// changeUserRoles gives a user the roles add and takes remove from them.
+func (h *AssignmentHandler) changeUserRoles(c *gin.Context, userID string, add, remove []string) {
+	if len(add) > 0 {
+		permissions, err := authz.RolePermissions(c.Request.Context(), h.db, add)
+		if !h.grantable(c, permissions, err) {
+			return
+		}
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	added, removed, err := applyChange(tx, `
+		DELETE FROM user_roles WHERE user_id = $1 AND role_id = ANY($2)
+		RETURNING role_id
+	`, `
+		INSERT INTO user_roles (user_id, role_id)
+		SELECT $1, unnest($2::uuid[])
+		ON CONFLICT DO NOTHING
+		RETURNING role_id
+	`, userID, remove, add)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to change roles"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	h.changed(c, "user", userID, "role", "user.role_add", "user.role_remove", added, removed)
+}
+
+// Role permissions
+
+// GetRolePermissions lists the permissions of a role.
+func (h *AssignmentHandler) GetRolePermissions(c *gin.Context) {
+	roleID, ok := h.find(c, tenantRoles, c.Param("id"), "Role not found")
+	if !ok {
+		return
+	}
+	rows, err := h.db.Query(`
+		SELECT p.id, p.name, COALESCE(p.description, '') FROM permissions p
+		JOIN role_permissions rp ON rp.permission_id = p.id
+		WHERE rp.role_id = $1
+		ORDER BY p.name
+	`, roleID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	permissions := []Permission{}
+	for rows.Next() {
+		var permission Permission
+		if err := rows.Scan(&permission.ID, &permission.Name, &permission.Description); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		permissions = append(permissions, permission)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	c.JSON(http.StatusOK, permissions)
+}
+
+// AddRolePermissions adds the permissions in the request body to a role.
+func (h *AssignmentHandler) AddRolePermissions(c *gin.Context) {
+	var req AssignmentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Permissions == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "permissions is required"})
+		return
+	}
+
+	roleID, ok := h.find(c, tenantRoles, c.Param("id"), "Role not found")
+	if !ok {
+		return
+	}
+	permissionIDs, ok := h.resolvePermissions(c, req.Permissions)
+	if !ok {
+		return
+	}
+	current, ok := h.assigned(c, `SELECT permission_id FROM role_permissions WHERE role_id = $1`, roleID)
+	if !ok {
+		return
+	}
+	h.changeRolePermissions(c, roleID, without(permissionIDs, current), nil)
+}
+
+// RemoveRolePermission takes the permission in the path from a role.
+func (h *AssignmentHandler) RemoveRolePermission(c *gin.Context) {
+	roleID, ok := h.find(c, tenantRoles, c.Param("id"), "Role not found")
+	if !ok {
+		return
+	}
+	var permissionID string
+	err := h.db.QueryRow(`SELECT id FROM permissions WHERE name = $1`, c.Param("permission")).Scan(&permissionID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Permission not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if !h.exists(c, `SELECT EXISTS (SELECT 1 FROM role_permissions WHERE role_id = $1 AND permission_id = $2)`, roleID, permissionID) {
+		return
+	}
+	h.changeRolePermissions(c, roleID, nil, []string{permissionID})
+}
+
+// ReplaceRolePermissions sets the permissions of a role.
+func (h *AssignmentHandler) ReplaceRolePermissions(c *gin.Context) {
+	var req AssignmentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Permissions == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "permissions is required"})
+		return
+	}
+
+	roleID, ok := h.find(c, tenantRoles, c.Param("id"), "Role not found")
+	if !ok {
+		return
+	}
+	permissionIDs, ok := h.resolvePermissions(c, req.Permissions)
+	if !ok {
+		return
+	}
+	current, ok := h.assigned(c, `SELECT permission_id FROM role_permissions WHERE role_id = $1`, roleID)
+	if !ok {
+		return
+	}
+	h.changeRolePermissions(c, roleID, without(permissionIDs, current), without(current, permissionIDs))
+}
+
+// changeRolePermissions adds the permissions add to a role and takes remove
+// from it.
+func (h *AssignmentHandler) changeRolePermissions(c *gin.Context, roleID string, add, remove []string) {
+	if len(add) > 0 {
+		permissions, ok := h.assigned(c, `SELECT name FROM permissions WHERE id = ANY($1)`, pq.Array(add))
+		if !ok || !checkGrantable(c, h.db, h.resolver, permissions) {
+			return
+		}
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	added, removed, err := applyChange(tx, `
+		DELETE FROM role_permissions WHERE role_id = $1 AND permission_id = ANY($2)
+		RETURNING permission_id
+	`, `
+		INSERT INTO role_permissions (role_id, permission_id)
+		SELECT $1, unnest($2::uuid[])
+		ON CONFLICT DO NOTHING
+		RETURNING permission_id
+	`, roleID, remove, add)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to change permissions"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	h.changed(c, "role", roleID, "permission", "role.permission_add", "role.permission_remove", added, removed)
+}
+
+// Group hierarchy
+
+// GetGroupChildren lists the groups nested in a group.
+func (h *AssignmentHandler) GetGroupChildren(c *gin.Context) {
+	groupID, ok := h.find(c, tenantGroups, c.Param("id"), "Group not found")
+	if !ok {
+		return
+	}
+	rows, err := h.db.Query(`
+		SELECT g.id, g.tenant_id, g.name, COALESCE(g.description, ''), g.created_at FROM groups g
+		JOIN group_hierarchy gh ON gh.child_group_id = g.id
+		WHERE gh.parent_group_id = $1 AND g.tenant_id = $2
+		ORDER BY g.name
+	`, groupID, c.GetString("tenant_id"))
+	h.answerGroups(c, rows, err)
+}
+
+// GetGroupParents lists the groups a group is nested in.
+func (h *AssignmentHandler) GetGroupParents(c *gin.Context) {
+	groupID, ok := h.find(c, tenantGroups, c.Param("id"), "Group not found")
+	if !ok {
+		return
+	}
+	rows, err := h.db.Query(`
+		SELECT g.id, g.tenant_id, g.name, COALESCE(g.description, ''), g.created_at FROM groups g
+		JOIN group_hierarchy gh ON gh.parent_group_id = g.id
+		WHERE gh.child_group_id = $1 AND g.tenant_id = $2
+		ORDER BY g.name
+	`, groupID, c.GetString("tenant_id"))
+	h.answerGroups(c, rows, err)
+}
+
+// AddGroupChild nests the group in the path in a group.
+func (h *AssignmentHandler) AddGroupChild(c *gin.Context) {
+	groupID, ok := h.find(c, tenantGroups, c.Param("id"), "Group not found")
+	if !ok {
+		return
+	}
+	childID, ok := h.find(c, tenantGroups, c.Param("group_id"), "Group not found")
+	if !ok {
+		return
+	}
+	current, ok := h.assigned(c, `
+		SELECT child_group_id FROM group_hierarchy WHERE parent_group_id = $1 AND child_group_id = $2
+	`, groupID, childID)
+	if !ok {
+		return
+	}
+	h.changeGroupChildren(c, groupID, without([]string{childID}, current), nil)
+}
+
+// RemoveGroupChild takes the nested group in the path out of a group.
+func (h *AssignmentHandler) RemoveGroupChild(c *gin.Context) {
+	groupID, ok := h.find(c, tenantGroups, c.Param("id"), "Group not found")
+	if !ok {
+		return
+	}
+	childID, ok := h.find(c, tenantGroups, c.Param("group_id"), "Group not found")
+	if !ok {
+		return
+	}
+	if !h.exists(c, `
+		SELECT EXISTS (SELECT 1 FROM group_hierarchy WHERE parent_group_id = $1 AND child_group_id = $2)
+	`, groupID, childID) {
+		return
+	}
+	h.changeGroupChildren(c, groupID, nil, []string{childID})
+}
+
+// ReplaceGroupChildren sets the groups nested in a group.
+func (h *AssignmentHandler) ReplaceGroupChildren(c *gin.Context) {
+	var req AssignmentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.GroupIDs == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "group_ids is required"})
+		return
+	}
+
+	groupID, ok := h.find(c, tenantGroups, c.Param("id"), "Group not found")
+	if !ok {
+		return
+	}
+	childIDs, ok := h.resolve(c, tenantGroups, req.GroupIDs, "group")
+	if !ok {
+		return
+	}
+	current, ok := h.assigned(c, `SELECT child_group_id FROM group_hierarchy WHERE parent_group_id = $1`, groupID)
+	if !ok {
+		return
+	}
+	h.changeGroupChildren(c, groupID, without(childIDs, current), without(current, childIDs))
+}
+
+// changeGroupChildren nests the groups add in a group and takes remove out
+// of it. The members of nested groups gain the permissions of the group.
+func (h *AssignmentHandler) changeGroupChildren(c *gin.Context, groupID string, add, remove []string) {
+	if len(add) > 0 {
+		permissions, err := authz.GroupPermissions(c.Request.Context(), h.db, []string{groupID})
+		if !h.grantable(c, permissions, err) {
+			return
+		}
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	if len(add) > 0 {
+		cycle, err := closesCycle(tx, "group_hierarchy", groupCycle, groupID, add)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if cycle {
+			c.JSON(http.StatusConflict, gin.H{"error": "Assignment would create a cycle"})
+			return
+		}
+	}
+
+	added, removed, err := applyChange(tx, `
+		DELETE FROM group_hierarchy WHERE parent_group_id = $1 AND child_group_id = ANY($2)
+		RETURNING child_group_id
+	`, `
+		INSERT INTO group_hierarchy (parent_group_id, child_group_id)
+		SELECT $1, unnest($2::uuid[])
+		ON CONFLICT DO NOTHING
+		RETURNING child_group_id
+	`, groupID, remove, add)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to change nested groups"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	h.changed(c, "group", groupID, "group", "group.child_add", "group.child_remove", added, removed)
+}
+
+// Role hierarchy
+
+// GetRoleChildren lists the roles a role holds the permissions of.
+func (h *AssignmentHandler) GetRoleChildren(c *gin.Context) {
+	roleID, ok := h.find(c, tenantRoles, c.Param("id"), "Role not found")
+	if !ok {
+		return
+	}
+	rows, err := h.db.Query(`
+		SELECT r.id, r.tenant_id, r.name, COALESCE(r.description, ''), r.created_at FROM roles r
+		JOIN role_hierarchy rh ON rh.child_role_id = r.id
+		WHERE rh.parent_role_id = $1 AND r.tenant_id = $2
+		ORDER BY r.name
+	`, roleID, c.GetString("tenant_id"))
+	h.answerRoles(c, rows, err)
+}
+
+// GetRoleParents lists the roles a role is a child of.
+func (h *AssignmentHandler) GetRoleParents(c *gin.Context) {
+	roleID, ok := h.find(c, tenantRoles, c.Param("id"), "Role not found")
+	if !ok {
+		return
+	}
+	rows, err := h.db.Query(`
+		SELECT r.id, r.tenant_id, r.name, COALESCE(r.description, ''), r.created_at FROM roles r
+		JOIN role_hierarchy rh ON rh.parent_role_id = r.id
+		WHERE rh.child_role_id = $1 AND r.tenant_id = $2
+		ORDER BY r.name
+	`, roleID, c.GetString("tenant_id"))
+	h.answerRoles(c, rows, err)
+}
+
+// AddRoleChild makes the role in the path a child of a role.
+func (h *AssignmentHandler) AddRoleChild(c *gin.Context) {
+	roleID, ok := h.find(c, tenantRoles, c.Param("id"), "Role not found")
+	if !ok {
+		return
+	}
+	childID, ok := h.find(c, tenantRoles, c.Param("role_id"), "Role not found")
+	if !ok {
+		return
+	}
+	current, ok := h.assigned(c, `
+		SELECT child_role_id FROM role_hierarchy WHERE parent_role_id = $1 AND child_role_id = $2
+	`, roleID, childID)
+	if !ok {
+		return
+	}
+	h.changeRoleChildren(c, roleID, without([]string{childID}, current), nil)
+}
+
+// RemoveRoleChild takes the child role in the path from a role.
+func (h *AssignmentHandler) RemoveRoleChild(c *gin.Context) {
+	roleID, ok := h.find(c, tenantRoles, c.Param("id"), "Role not found")
+	if !ok {
+		return
+	}
+	childID, ok := h.find(c, tenantRoles, c.Param("role_id"), "Role not found")
+	if !ok {
+		return
+	}
+	if !h.exists(c, `
+		SELECT EXISTS (SELECT 1 FROM role_hierarchy WHERE parent_role_id = $1 AND child_role_id = $2)
+	`, roleID, childID) {
+		return
+	}
+	h.changeRoleChildren(c, roleID, nil, []string{childID})
+}
+
+// ReplaceRoleChildren sets the child roles of a role.
+func (h *AssignmentHandler) ReplaceRoleChildren(c *gin.Context) {
+	var req AssignmentRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.RoleIDs == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role_ids is required"})
+		return
+	}
+
+	roleID, ok := h.find(c, tenantRoles, c.Param("id"), "Role not found")
+	if !ok {
+		return
+	}
+	childIDs, ok := h.resolve(c, tenantRoles, req.RoleIDs, "role")
+	if !ok {
+		return
+	}
+	current, ok := h.assigned(c, `SELECT child_role_id FROM role_hierarchy WHERE parent_role_id = $1`, roleID)
+	if !ok {
+		return
+	}
+	h.changeRoleChildren(c, roleID, without(childIDs, current), without(current, childIDs))
+}
+
+// changeRoleChildren makes the roles add children of a role and takes
+// remove from it. The role gains the permissions of its new children.
+func (h *AssignmentHandler) changeRoleChildren(c *gin.Context, roleID string, add, remove []string) {
+	if len(add) > 0 {
+		permissions, err := authz.RolePermissions(c.Request.Context(), h.db, add)
+		if !h.grantable(c, permissions, err) {
+			return
+		}
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer tx.Rollback()
+
+	if len(add) > 0 {
+		cycle, err := closesCycle(tx, "role_hierarchy", roleCycle, roleID, add)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if cycle {
+			c.JSON(http.StatusConflict, gin.H{"error": "Assignment would create a cycle"})
+			return
+		}
+	}
+
+	added, removed, err := applyChange(tx, `
+		DELETE FROM role_hierarchy WHERE parent_role_id = $1 AND child_role_id = ANY($2)
+		RETURNING child_role_id
+	`, `
+		INSERT INTO role_hierarchy (parent_role_id, child_role_id)
+		SELECT $1, unnest($2::uuid[])
+		ON CONFLICT DO NOTHING
+		RETURNING child_role_id
+	`, roleID, remove, add)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to change child roles"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	h.changed(c, "role", roleID, "role", "role.child_add", "role.child_remove", added, removed)
+}
+
+// RoleEdge makes one role the parent of another.
+type RoleEdge struct {
+	ParentID string `json:"parent_id"`
+	ChildID  string `json:"child_id"`
+}
+
+// RoleGraph is the role hierarchy of a tenant.
+type RoleGraph struct {
+	Roles []Role     `json:"roles"`
+	Edges []RoleEdge `json:"edges"`
+}
+
+// GetRoleGraph answers with every role of the tenant and the edges between
+// them.
+func (h *AssignmentHandler) GetRoleGraph(c *gin.Context) {
+	tenantID := c.GetString("tenant_id")
+	graph := RoleGraph{Roles: []Role{}, Edges: []RoleEdge{}}
+
+	rows, err := h.db.Query(`
+		SELECT id, tenant_id, name, COALESCE(description, ''), created_at FROM roles
+		WHERE tenant_id = $1
+		ORDER BY name
+	`, tenantID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var role Role
+		if err := rows.Scan(&role.ID, &role.TenantID, &role.Name, &role.Description, &role.CreatedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		graph.Roles = append(graph.Roles, role)
+	}
+	if err := rows.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	edges, err := h.db.Query(`
+		SELECT rh.parent_role_id, rh.child_role_id
+		FROM role_hierarchy rh
+		JOIN roles r ON r.id = rh.parent_role_id AND r.tenant_id = $1
+		ORDER BY rh.parent_role_id, rh.child_role_id
+	`, tenantID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer edges.Close()
+	for edges.Next() {
+		var edge RoleEdge
+		if err := edges.Scan(&edge.ParentID, &edge.ChildID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		graph.Edges = append(graph.Edges, edge)
+	}
+	if err := edges.Err(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	c.JSON(http.StatusOK, graph)
+}
+
+// without returns the IDs of ids not in exclude.
+func without(ids, exclude []string) []string {
+	excluded := map[string]bool{}
+	for _, id := range exclude {
+		excluded[id] = true
+	}
+	var rest []string
+	for _, id := range ids {
+		if !excluded[id] {
+			rest = append(rest, id)
+		}
+	}
+	return rest
+}
+
+func scanIDs(rows *sql.Rows) ([]string, error) {
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
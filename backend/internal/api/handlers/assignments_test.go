@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestAssignmentHandler_Validation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	h := &AssignmentHandler{}
+	router := gin.New()
+	router.GET("/groups/:id/users", h.GetGroupMembers)
+	router.PUT("/groups/:id/users", h.ReplaceGroupMembers)
+	router.POST("/groups/:id/users/:user_id", h.AddGroupMember)
+	router.DELETE("/groups/:id/roles/:role_id", h.RemoveGroupRole)
+	router.GET("/users/:id/groups", h.GetUserGroups)
+	router.PUT("/users/:id/roles", h.ReplaceUserRoles)
+	router.POST("/roles/:id/permissions", h.AddRolePermissions)
+	router.PUT("/roles/:id/permissions", h.ReplaceRolePermissions)
+	router.GET("/groups/:id/parents", h.GetGroupParents)
+	router.PUT("/groups/:id/children", h.ReplaceGroupChildren)
+	router.DELETE("/groups/:id/children/:group_id", h.RemoveGroupChild)
+	router.GET("/roles/:id/parents", h.GetRoleParents)
+	router.PUT("/roles/:id/children", h.ReplaceRoleChildren)
+	router.POST("/roles/:id/children/:role_id", h.AddRoleChild)
+
+	group := "/groups/3f6c2a9e-0b1d-4c57-9a3e-5d2f8b7c1e40"
+	tests := []struct {
+		name   string
+		method string
+		path   string
+		body   string
+		status int
+	}{
+		{"members of a malformed group", "GET", "/groups/sales/users", "", http.StatusNotFound},
+		{"groups of a malformed user", "GET", "/users/alice/groups", "", http.StatusNotFound},
+		{"member of a malformed group", "POST", "/groups/sales/users/3f6c2a9e-0b1d-4c57-9a3e-5d2f8b7c1e41", "", http.StatusNotFound},
+		{"role of a malformed group", "DELETE", "/groups/sales/roles/3f6c2a9e-0b1d-4c57-9a3e-5d2f8b7c1e42", "", http.StatusNotFound},
+		{"members without user_ids", "PUT", group + "/users", `{"role_ids": []}`, http.StatusBadRequest},
+		{"members of the wrong type", "PUT", group + "/users", `{"user_ids": "alice"}`, http.StatusBadRequest},
+		{"roles without role_ids", "PUT", "/users/3f6c2a9e-0b1d-4c57-9a3e-5d2f8b7c1e41/roles", `{}`, http.StatusBadRequest},
+		{"permissions without permissions", "POST", "/roles/3f6c2a9e-0b1d-4c57-9a3e-5d2f8b7c1e42/permissions", `{"permission": "user.read"}`, http.StatusBadRequest},
+		{"permissions of a malformed role", "PUT", "/roles/admin/permissions", `{"permissions": []}`, http.StatusNotFound},
+		{"transitive members of a malformed group", "GET", "/groups/sales/users?transitive=true", "", http.StatusNotFound},
+		{"parents of a malformed group", "GET", "/groups/sales/parents", "", http.StatusNotFound},
+		{"subgroup of a malformed group", "DELETE", "/groups/sales/children/3f6c2a9e-0b1d-4c57-9a3e-5d2f8b7c1e41", "", http.StatusNotFound},
+		{"subgroups without group_ids", "PUT", group + "/children", `{"user_ids": []}`, http.StatusBadRequest},
+		{"parents of a malformed role", "GET", "/roles/admin/parents", "", http.StatusNotFound},
+		{"child of a malformed role", "POST", "/roles/admin/children/3f6c2a9e-0b1d-4c57-9a3e-5d2f8b7c1e42", "", http.StatusNotFound},
+		{"children without role_ids", "PUT", "/roles/3f6c2a9e-0b1d-4c57-9a3e-5d2f8b7c1e42/children", `{"user_ids": []}`, http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(tt.method, tt.path, bytes.NewBufferString(tt.body))
+		req.Header.Set("Content-Type", "application/json")
+		router.ServeHTTP(w, req)
+		if w.Code != tt.status {
+			t.Errorf("%s: expected %d, got %d %s", tt.name, tt.status, w.Code, w.Body.String())
+		}
+	}
+}
+
+func TestWithout(t *testing.T) {
+	tests := []struct {
+		ids, exclude, expected []string
+	}{
+		{[]string{"a", "b", "c"}, []string{"b"}, []string{"a", "c"}},
+		{[]string{"a"}, []string{"a"}, nil},
+		{[]string{"a", "b"}, nil, []string{"a", "b"}},
+		{nil, []string{"a"}, nil},
+	}
+	for _, tt := range tests {
+		if got := without(tt.ids, tt.exclude); !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("without(%v, %v): expected %v, got %v", tt.ids, tt.exclude, tt.expected, got)
+		}
+	}
+}
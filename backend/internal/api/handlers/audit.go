@@ -21,12 +21,16 @@ type AuditLog struct {
 	ID         string    `json:"id"`
 	TenantID   string    `json:"tenant_id"`
 	UserID     *string   `json:"user_id"`
+	ActorType  *string   `json:"actor_type"`
 	Action     string    `json:"action"`
 	Resource   *string   `json:"resource"`
 	ResourceID *string   `json:"resource_id"`
+	Target     *string   `json:"target"`
+	TargetID   *string   `json:"target_id"`
 	IPAddress  *string   `json:"ip_address"`
 	UserAgent  *string   `json:"user_agent"`
 	Status     string    `json:"status"`
+	Reason     *string   `json:"reason"`
 	CreatedAt  time.Time `json:"created_at"`
 }
 
@@ -57,8 +61,8 @@ func (h *AuditHandler) GetAuditLogs(c *gin.Context) {
 
 	// Build query
 	query := `
-		SELECT id, tenant_id, user_id, action, resource, resource_id, 
-		       ip_address, user_agent, status, created_at 
+		SELECT id, tenant_id, user_id, actor_type, action, resource, resource_id, target, target_id,
+		       ip_address, user_agent, status, reason, created_at 
 		FROM audit_logs 
 		WHERE tenant_id = $1
 	`
@@ -117,9 +121,9 @@ func (h *AuditHandler) GetAuditLogs(c *gin.Context) {
 	for rows.Next() {
 		var log AuditLog
 		if err := rows.Scan(
-			&log.ID, &log.TenantID, &log.UserID, &log.Action,
-			&log.Resource, &log.ResourceID, &log.IPAddress,
-			&log.UserAgent, &log.Status, &log.CreatedAt,
+			&log.ID, &log.TenantID, &log.UserID, &log.ActorType, &log.Action,
+			&log.Resource, &log.ResourceID, &log.Target, &log.TargetID, &log.IPAddress,
+			&log.UserAgent, &log.Status, &log.Reason, &log.CreatedAt,
 		); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan audit log"})
 			return
@@ -135,4 +139,38 @@ func (h *AuditHandler) GetAuditLogs(c *gin.Context) {
 	}
 
 	c.JSON(http.StatusOK, response)
-}
\ No newline at end of file
+}
+
+// writeAudit records an audit event. Empty IDs are stored as NULL so events
+// without a known user or resource can still be logged.
+func writeAudit(db *sql.DB, tenantID, userID, action, resource, resourceID, status, ip, userAgent string) {
+	writeAuditReason(db, tenantID, userID, action, resource, resourceID, status, "", ip, userAgent)
+}
+
+// writeAuditReason is writeAudit with a reason explaining the status, such as
+// why a login failed. The actor type tells events of users and service
+// accounts apart.
+func writeAuditReason(db *sql.DB, tenantID, userID, action, resource, resourceID, status, reason, ip, userAgent string) {
+	insertAudit(db, tenantID, userID, action, resource, resourceID, "", "", status, reason, ip, userAgent)
+}
+
+// writeAuditTarget is writeAudit for events between two resources, such as a
+// user added to a group: target and targetID name the second one.
+func writeAuditTarget(db *sql.DB, tenantID, userID, action, resource, resourceID, target, targetID, status, ip, userAgent string) {
+	insertAudit(db, tenantID, userID, action, resource, resourceID, target, targetID, status, "", ip, userAgent)
+}
+
+func insertAudit(db *sql.DB, tenantID, userID, action, resource, resourceID, target, targetID, status, reason, ip, userAgent string) {
+	_, err := db.Exec(`
+		INSERT INTO audit_logs (tenant_id, user_id, actor_type, action, resource, resource_id, target, target_id,
+		                        status, reason, ip_address, user_agent)
+		VALUES (NULLIF($1, '')::uuid, NULLIF($2, '')::uuid,
+		        (SELECT principal_type FROM users WHERE id = NULLIF($2, '')::uuid),
+		        $3, NULLIF($4, ''), NULLIF($5, '')::uuid, NULLIF($6, ''), NULLIF($7, '')::uuid,
+		        $8, NULLIF($9, ''), $10, $11)
+	`, tenantID, userID, action, resource, resourceID, target, targetID, status, reason, ip, userAgent)
+	if err != nil {
+		// Log error but don't fail the request
+		println("Failed to log audit:", err.Error())
+	}
+}
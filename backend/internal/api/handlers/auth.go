@@ -6,18 +6,59 @@ import (
 	"time"
 
 	"github.com/ForIAM/ForIAM/backend/internal/config"
+	"github.com/ForIAM/ForIAM/backend/internal/dynamicgroup"
+	"github.com/ForIAM/ForIAM/backend/internal/federation"
+	"github.com/ForIAM/ForIAM/backend/internal/ldap"
+	"github.com/ForIAM/ForIAM/backend/internal/lockout"
+	"github.com/ForIAM/ForIAM/backend/internal/mfa"
+	"github.com/ForIAM/ForIAM/backend/internal/passkey"
+	"github.com/ForIAM/ForIAM/backend/internal/provisioning"
+	"github.com/ForIAM/ForIAM/backend/internal/signing"
+	"github.com/ForIAM/ForIAM/backend/internal/token"
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/google/uuid"
 )
 
 type AuthHandler struct {
-	db  *sql.DB
-	cfg *config.Config
+	db            *sql.DB
+	cfg           *config.Config
+	refreshTokens *token.RefreshStore
+	revocations   token.RevocationStore
+	keys          *signing.Manager
+	validator     *token.Validator
+	passkeys      *passkey.Store
+	attempts      *lockout.Store
+	federation    *federation.Store
+	directories   *ldap.Store
+	provisioning  *provisioning.Queue
+	groups        *dynamicgroup.Reconciler
+	totpSecrets   *mfa.SecretBox
 }
 
-func NewAuthHandler(db *sql.DB, cfg *config.Config) *AuthHandler {
-	return &AuthHandler{db: db, cfg: cfg}
+func NewAuthHandler(db *sql.DB, cfg *config.Config, revocations token.RevocationStore, keys *signing.Manager, validator *token.Validator) *AuthHandler {
+	return &AuthHandler{
+		db:            db,
+		cfg:           cfg,
+		refreshTokens: token.NewRefreshStore(db, cfg.RefreshTokenTTL),
+		revocations:   revocations,
+		keys:          keys,
+		validator:     validator,
+		passkeys:      passkey.NewStore(db),
+		attempts: lockout.NewStore(db, lockout.Policy{
+			MaxFailures:      cfg.LoginMaxFailures,
+			MaxFailuresPerIP: cfg.LoginMaxFailuresPerIP,
+			Window:           cfg.LoginFailureWindow,
+			LockoutDuration:  cfg.LoginLockoutDuration,
+			BaseDelay:        cfg.LoginBaseDelay,
+			MaxDelay:         cfg.LoginMaxDelay,
+		}),
+		federation:   federation.NewStore(db, cfg.EncryptionKey),
+		directories:  ldap.NewStore(db, cfg.EncryptionKey),
+		provisioning: provisioning.NewQueue(db),
+		groups:       dynamicgroup.NewReconciler(db),
+		totpSecrets:  mfa.NewSecretBox(cfg.EncryptionKey),
+	}
 }
 
 type LoginRequest struct {
@@ -26,9 +67,18 @@ type LoginRequest struct {
 }
 
 type LoginResponse struct {
-	AccessToken string `json:"access_token"`
-	TokenType   string `json:"token_type"`
-	ExpiresIn   int    `json:"expires_in"`
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh_token" binding:"required"`
+}
+
+type LogoutRequest struct {
+	RefreshToken string `json:"refresh_token"`
 }
 
 type User struct {
@@ -37,6 +87,8 @@ type User struct {
 	Email     string    `json:"email"`
 	IsActive  bool      `json:"is_active"`
 	CreatedAt time.Time `json:"created_at"`
+	// Attributes are free-form fields dynamic group rules can test
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
 }
 
 func (h *AuthHandler) Login(c *gin.Context) {
@@ -46,60 +98,254 @@ func (h *AuthHandler) Login(c *gin.Context) {
 		return
 	}
 
-	// Get user from database
+	// Get user from database, matching the email as the lockout counters do
+	email := normalizeEmail(req.Email)
 	var user User
 	var passwordHash string
 	err := h.db.QueryRow(`
-		SELECT id, tenant_id, email, password_hash, is_active, created_at 
+		SELECT id, tenant_id, email, COALESCE(password_hash, ''), is_active, created_at 
 		FROM users 
-		WHERE email = $1 AND is_active = true
-	`, req.Email).Scan(&user.ID, &user.TenantID, &user.Email, &passwordHash, &user.IsActive, &user.CreatedAt)
+		WHERE lower(email) = $1 AND principal_type = 'user'
+	`, email).Scan(&user.ID, &user.TenantID, &user.Email, &passwordHash, &user.IsActive, &user.CreatedAt)
+
+	if err != nil && err != sql.ErrNoRows {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	// Refuse attempts while the account or IP is throttled or locked out
+	if !h.checkLoginAllowed(c, user, email) {
+		return
+	}
 
 	if err == sql.ErrNoRows {
+		h.loginFailed(c, user, email, lockout.ReasonUnknownUser)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+		return
+	}
+	if !user.IsActive {
+		h.loginFailed(c, user, email, lockout.ReasonAccountDisabled)
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
 		return
 	}
+
+	// Verify password, against the tenant's LDAP directory if it has one
+	if !h.verifyPassword(c, user, passwordHash, req.Password) {
+		return
+	}
+
+	// Users of a provider that disables password login must sign in there
+	disabled, err := h.federation.PasswordLoginDisabled(user.ID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 		return
 	}
-
-	// Verify password
-	if err := bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(req.Password)); err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+	if disabled {
+		writeAuditReason(h.db, user.TenantID, user.ID, "auth.login", "", "", "failure", "password_login_disabled", c.ClientIP(), c.GetHeader("User-Agent"))
+		c.JSON(http.StatusForbidden, gin.H{"error": "Password login is disabled for this account"})
 		return
 	}
 
-	// Generate JWT token
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{
-		"user_id":   user.ID,
-		"tenant_id": user.TenantID,
-		"email":     user.Email,
-		"exp":       time.Now().Add(time.Hour * 24).Unix(),
-		"iat":       time.Now().Unix(),
-	})
+	// Users with a second factor, or in a tenant that requires one, only get
+	// a challenge token at this point
+	challenge, err := h.mfaChallengeFor(user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+	if challenge != nil {
+		h.logAudit(user.TenantID, user.ID, "auth.login", "", "mfa_required", c.ClientIP(), c.GetHeader("User-Agent"))
+		c.JSON(http.StatusOK, challenge)
+		return
+	}
 
-	tokenString, err := token.SignedString([]byte(h.cfg.JWTSecret))
+	response, err := h.startSession(user)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
 		return
 	}
 
 	// Log successful login
+	h.loginSucceeded(c, user)
 	h.logAudit(user.TenantID, user.ID, "auth.login", "", "success", c.ClientIP(), c.GetHeader("User-Agent"))
 
-	c.JSON(http.StatusOK, LoginResponse{
-		AccessToken: tokenString,
-		TokenType:   "Bearer",
-		ExpiresIn:   86400, // 24 hours
+	c.JSON(http.StatusOK, response)
+}
+
+// RefreshToken rotates a refresh token and issues a new access token. Replaying
+// a token that was already rotated revokes every token in its family.
+func (h *AuthHandler) RefreshToken(c *gin.Context) {
+	var req RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	refreshToken, rt, err := h.refreshTokens.Rotate(req.RefreshToken)
+	if err == token.ErrRefreshTokenReused {
+		h.logAudit(rt.TenantID, rt.UserID, "auth.refresh_reuse", "", "failure", c.ClientIP(), c.GetHeader("User-Agent"))
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Refresh token reuse detected"})
+		return
+	}
+	if err == token.ErrRefreshTokenInvalid || err == token.ErrRefreshTokenExpired {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to refresh token"})
+		return
+	}
+
+	var user User
+	err = h.db.QueryRow(`
+		SELECT id, tenant_id, email, is_active, created_at 
+		FROM users 
+		WHERE id = $1 AND is_active = true
+	`, rt.UserID).Scan(&user.ID, &user.TenantID, &user.Email, &user.IsActive, &user.CreatedAt)
+
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid refresh token"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	response, err := h.issueAccessToken(user, refreshToken)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	h.logAudit(user.TenantID, user.ID, "auth.refresh", "", "success", c.ClientIP(), c.GetHeader("User-Agent"))
+
+	c.JSON(http.StatusOK, response)
+}
+
+// startSession issues a new refresh token family and access token for user.
+func (h *AuthHandler) startSession(user User) (*LoginResponse, error) {
+	refreshToken, err := h.refreshTokens.Issue(user.TenantID, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	return h.issueAccessToken(user, refreshToken)
+}
+
+// issueAccessToken signs a short-lived access token for user and pairs it
+// with the given refresh token.
+func (h *AuthHandler) issueAccessToken(user User, refreshToken string) (*LoginResponse, error) {
+	now := time.Now()
+	tokenString, err := h.keys.Sign(jwt.MapClaims{
+		"iss":       h.cfg.TokenIssuer,
+		"aud":       h.cfg.TokenAudience,
+		"user_id":   user.ID,
+		"tenant_id": user.TenantID,
+		"email":     user.Email,
+		"jti":       uuid.NewString(),
+		"typ":       token.TypeAccess,
+		"exp":       now.Add(h.cfg.AccessTokenTTL).Unix(),
+		"iat":       now.Unix(),
 	})
+	if err != nil {
+		return nil, err
+	}
+
+	return &LoginResponse{
+		AccessToken:  tokenString,
+		RefreshToken: refreshToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(h.cfg.AccessTokenTTL.Seconds()),
+	}, nil
 }
 
+// Logout revokes the access token used for the request and, when the body
+// carries one, the refresh token family it was issued with.
 func (h *AuthHandler) Logout(c *gin.Context) {
-	// In a real implementation, you might want to blacklist the token
+	var req LogoutRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	tenantID := c.GetString("tenant_id")
+	userID := c.GetString("user_id")
+
+	if err := h.revocations.Revoke(c.Request.Context(), c.GetString("jti"), time.Until(c.GetTime("token_expires_at"))); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke token"})
+		return
+	}
+
+	if req.RefreshToken != "" {
+		if err := h.refreshTokens.RevokeFamily(req.RefreshToken); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke refresh token"})
+			return
+		}
+	}
+
+	h.logAudit(tenantID, userID, "auth.logout", "", "success", c.ClientIP(), c.GetHeader("User-Agent"))
+
 	c.JSON(http.StatusOK, gin.H{"message": "Logged out successfully"})
 }
 
+// LogoutAll revokes every access and refresh token of the calling user.
+func (h *AuthHandler) LogoutAll(c *gin.Context) {
+	tenantID := c.GetString("tenant_id")
+	userID := c.GetString("user_id")
+
+	if err := h.revokeSessions(c, userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke sessions"})
+		return
+	}
+
+	h.logAudit(tenantID, userID, "auth.logout_all", "", "success", c.ClientIP(), c.GetHeader("User-Agent"))
+
+	c.JSON(http.StatusOK, gin.H{"message": "All sessions revoked successfully"})
+}
+
+// RevokeUserSessions lets an administrator force a user of the same tenant
+// out of every session.
+func (h *AuthHandler) RevokeUserSessions(c *gin.Context) {
+	parsed, err := uuid.Parse(c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+	targetID := parsed.String()
+	tenantID := c.GetString("tenant_id")
+
+	var exists bool
+	err = h.db.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM users WHERE id = $1 AND tenant_id = $2)
+	`, targetID, tenantID).Scan(&exists)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	if err := h.revokeSessions(c, targetID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke sessions"})
+		return
+	}
+
+	writeAudit(h.db, tenantID, c.GetString("user_id"), "user.sessions_revoke", "user", targetID, "success", c.ClientIP(), c.GetHeader("User-Agent"))
+
+	c.JSON(http.StatusOK, gin.H{"message": "User sessions revoked successfully"})
+}
+
+func (h *AuthHandler) revokeSessions(c *gin.Context, userID string) error {
+	if err := h.revocations.RevokeUser(c.Request.Context(), userID, h.cfg.AccessTokenTTL); err != nil {
+		return err
+	}
+	return h.refreshTokens.RevokeUser(userID)
+}
+
 func (h *AuthHandler) GetProfile(c *gin.Context) {
 	userID, exists := c.Get("user_id")
 	if !exists {
@@ -127,12 +373,5 @@ func (h *AuthHandler) GetProfile(c *gin.Context) {
 }
 
 func (h *AuthHandler) logAudit(tenantID, userID, action, resource, status, ip, userAgent string) {
-	_, err := h.db.Exec(`
-		INSERT INTO audit_logs (tenant_id, user_id, action, resource, status, ip_address, user_agent)
-		VALUES ($1, $2, $3, $4, $5, $6, $7)
-	`, tenantID, userID, action, resource, status, ip, userAgent)
-	if err != nil {
-		// Log error but don't fail the request
-		println("Failed to log audit:", err.Error())
-	}
-}
\ No newline at end of file
+	writeAudit(h.db, tenantID, userID, action, resource, "", status, ip, userAgent)
+}
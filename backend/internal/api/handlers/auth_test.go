@@ -93,4 +93,31 @@ func TestLoginRequest_Validation(t *testing.T) {
 			}
 		})
 	}
-}
\ No newline at end of file
+}
+func TestRevokeUserSessions_MalformedID(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	router.POST("/users/:id/sessions/revoke", (&AuthHandler{}).RevokeUserSessions)
+
+	req, _ := http.NewRequest("POST", "/users/not-a-uuid/sessions/revoke", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Errorf("Expected status %d, got %d", http.StatusNotFound, w.Code)
+	}
+}
+
+func TestNormalizeEmail(t *testing.T) {
+	tests := map[string]string{
+		"user@example.com":      "user@example.com",
+		"User@Example.COM":      "user@example.com",
+		"  user@example.com \t": "user@example.com",
+	}
+	for in, want := range tests {
+		if got := normalizeEmail(in); got != want {
+			t.Errorf("normalizeEmail(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
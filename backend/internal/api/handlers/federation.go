@@ -0,0 +1,599 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/ForIAM/ForIAM/backend/internal/api/middleware"
+	"github.com/ForIAM/ForIAM/backend/internal/authz"
+	"github.com/ForIAM/ForIAM/backend/internal/config"
+	"github.com/ForIAM/ForIAM/backend/internal/federation"
+	"github.com/ForIAM/ForIAM/backend/internal/provisioning"
+	"github.com/ForIAM/ForIAM/backend/internal/saml"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// FederationHandler manages the external identity providers of a tenant
+// and the identities linked to its users. Signing in through a provider is
+// part of AuthHandler.
+type FederationHandler struct {
+	db       *sql.DB
+	cfg      *config.Config
+	store    *federation.Store
+	resolver middleware.PermissionResolver
+}
+
+func NewFederationHandler(db *sql.DB, cfg *config.Config, resolver middleware.PermissionResolver) *FederationHandler {
+	return &FederationHandler{db: db, cfg: cfg, store: federation.NewStore(db, cfg.EncryptionKey), resolver: resolver}
+}
+
+// ProviderRequest configures or replaces an external identity provider.
+// client_secret is write only; left out on update, the current one stays.
+// A claim mapping left out selects the default one of the type; is_active
+// defaults to true.
+type ProviderRequest struct {
+	Name                 string            `json:"name" binding:"required"`
+	Type                 string            `json:"type" binding:"required,oneof=oidc saml"`
+	Issuer               string            `json:"issuer"`
+	ClientID             string            `json:"client_id"`
+	ClientSecret         string            `json:"client_secret"`
+	Scopes               []string          `json:"scopes"`
+	EntityID             string            `json:"entity_id"`
+	SSOURL               string            `json:"sso_url"`
+	Certificate          string            `json:"certificate"`
+	ClaimMapping         map[string]string `json:"claim_mapping"`
+	GroupsClaim          string            `json:"groups_claim"`
+	GroupMapping         map[string]string `json:"group_mapping"`
+	JITProvisioning      bool              `json:"jit_provisioning"`
+	DisablePasswordLogin bool              `json:"disable_password_login"`
+	TrustEmail           bool              `json:"trust_email"`
+	PerformsMFA          bool              `json:"performs_mfa"`
+	IsActive             *bool             `json:"is_active"`
+}
+
+func (req ProviderRequest) apply(p *federation.Provider) {
+	p.Name = req.Name
+	p.Type = req.Type
+	p.Issuer = req.Issuer
+	p.ClientID = req.ClientID
+	p.ClientSecret = req.ClientSecret
+	p.Scopes = req.Scopes
+	p.EntityID = req.EntityID
+	p.SSOURL = req.SSOURL
+	p.Certificate = req.Certificate
+	p.ClaimMapping = req.ClaimMapping
+	p.GroupsClaim = req.GroupsClaim
+	p.GroupMapping = req.GroupMapping
+	p.JITProvisioning = req.JITProvisioning
+	p.DisablePasswordLogin = req.DisablePasswordLogin
+	p.TrustEmail = req.TrustEmail
+	p.PerformsMFA = req.PerformsMFA
+	if req.IsActive != nil {
+		p.IsActive = *req.IsActive
+	}
+}
+
+// ProviderResponse is a provider with the endpoints to register ForIAM
+// under at the provider: the redirect URI for OpenID Connect, the ACS URL
+// and entity ID for SAML.
+type ProviderResponse struct {
+	*federation.Provider
+	RedirectURI string `json:"redirect_uri,omitempty"`
+	ACSURL      string `json:"acs_url,omitempty"`
+	SPEntityID  string `json:"sp_entity_id,omitempty"`
+}
+
+func (h *FederationHandler) response(p *federation.Provider) ProviderResponse {
+	response := ProviderResponse{Provider: p}
+	if p.Type == federation.TypeOIDC {
+		response.RedirectURI = federation.RedirectURI(h.cfg.TokenIssuer, p.ID)
+	} else {
+		response.ACSURL = federation.ACSURL(h.cfg.TokenIssuer, p.ID)
+		response.SPEntityID = federation.EntityID(h.cfg.TokenIssuer, p.ID)
+	}
+	return response
+}
+
+// LoginProvider is a provider as offered on the login page.
+type LoginProvider struct {
+	ID       string `json:"id"`
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+	LoginURL string `json:"login_url"`
+}
+
+// FederatedTokenRequest redeems the code a federated login returned to
+// FEDERATION_LOGIN_URL.
+type FederatedTokenRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+func providerError(c *gin.Context, err error) {
+	var pqErr *pq.Error
+	switch {
+	case errors.Is(err, federation.ErrInvalidProvider):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.As(err, &pqErr) && pqErr.Code == "23505":
+		c.JSON(http.StatusConflict, gin.H{"error": "An identity provider with this name already exists"})
+	case err == federation.ErrNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Identity provider not found"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+	}
+}
+
+func (h *FederationHandler) GetProviders(c *gin.Context) {
+	providers, err := h.store.List(c.GetString("tenant_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	responses := make([]ProviderResponse, 0, len(providers))
+	for _, p := range providers {
+		responses = append(responses, h.response(p))
+	}
+	c.JSON(http.StatusOK, responses)
+}
+
+func (h *FederationHandler) CreateProvider(c *gin.Context) {
+	var req ProviderRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	p := &federation.Provider{TenantID: c.GetString("tenant_id"), IsActive: true}
+	req.apply(p)
+	if !checkMappingGrantable(c, h.db, h.resolver, p.GroupMapping) {
+		return
+	}
+	if err := h.store.Create(p); err != nil {
+		providerError(c, err)
+		return
+	}
+
+	writeAudit(h.db, p.TenantID, c.GetString("user_id"), "federation.provider_create", "federation_provider", p.ID, "success", c.ClientIP(), c.GetHeader("User-Agent"))
+
+	c.JSON(http.StatusCreated, h.response(p))
+}
+
+func (h *FederationHandler) GetProvider(c *gin.Context) {
+	p, ok := h.findProvider(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, h.response(p))
+}
+
+func (h *FederationHandler) UpdateProvider(c *gin.Context) {
+	var req ProviderRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	p, ok := h.findProvider(c)
+	if !ok {
+		return
+	}
+
+	req.apply(p)
+	if !checkMappingGrantable(c, h.db, h.resolver, p.GroupMapping) {
+		return
+	}
+	if err := h.store.Update(p); err != nil {
+		providerError(c, err)
+		return
+	}
+
+	writeAudit(h.db, p.TenantID, c.GetString("user_id"), "federation.provider_update", "federation_provider", p.ID, "success", c.ClientIP(), c.GetHeader("User-Agent"))
+
+	c.JSON(http.StatusOK, h.response(p))
+}
+
+func (h *FederationHandler) DeleteProvider(c *gin.Context) {
+	tenantID := c.GetString("tenant_id")
+	if err := h.store.Delete(tenantID, c.Param("id")); err != nil {
+		providerError(c, err)
+		return
+	}
+
+	writeAudit(h.db, tenantID, c.GetString("user_id"), "federation.provider_delete", "federation_provider", c.Param("id"), "success", c.ClientIP(), c.GetHeader("User-Agent"))
+
+	c.JSON(http.StatusOK, gin.H{"message": "Identity provider deleted successfully"})
+}
+
+// checkMappingGrantable makes sure the caller holds every permission the
+// groups of mapping grant, answering the request when they do not. Users
+// join the mapped groups whenever they sign in, so setting up a mapping
+// hands out those permissions as surely as adding members does. IDs that
+// are malformed or not groups of the tenant are left for the store to
+// reject.
+func checkMappingGrantable(c *gin.Context, db *sql.DB, resolver middleware.PermissionResolver, mapping map[string]string) bool {
+	ids := []string{}
+	for _, groupID := range mapping {
+		if parsed, err := uuid.Parse(groupID); err == nil {
+			ids = append(ids, parsed.String())
+		}
+	}
+	if len(ids) == 0 {
+		return true
+	}
+
+	rows, err := db.Query(tenantGroups, pq.Array(dedupe(ids)), c.GetString("tenant_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return false
+	}
+	groupIDs, err := scanIDs(rows)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return false
+	}
+	if len(groupIDs) == 0 {
+		return true
+	}
+	permissions, err := authz.GroupPermissions(c.Request.Context(), db, groupIDs)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return false
+	}
+	return checkGrantable(c, db, resolver, permissions)
+}
+
+func (h *FederationHandler) findProvider(c *gin.Context) (*federation.Provider, bool) {
+	p, err := h.store.Get(c.GetString("tenant_id"), c.Param("id"))
+	if err != nil {
+		providerError(c, err)
+		return nil, false
+	}
+	return p, true
+}
+
+// GetUserIdentities lists the external identities linked to a user.
+func (h *FederationHandler) GetUserIdentities(c *gin.Context) {
+	identities, err := h.store.Identities(c.GetString("tenant_id"), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	c.JSON(http.StatusOK, identities)
+}
+
+// DeleteUserIdentity unlinks an external identity from a user. Signing in
+// with it again links it anew, by email address.
+func (h *FederationHandler) DeleteUserIdentity(c *gin.Context) {
+	tenantID := c.GetString("tenant_id")
+	userID := c.Param("id")
+	identityID := c.Param("identity_id")
+	err := h.store.DeleteIdentity(tenantID, userID, identityID)
+	if err == federation.ErrIdentityNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Identity not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	writeAudit(h.db, tenantID, c.GetString("user_id"), "federation.unlink", "user", userID, "success", c.ClientIP(), c.GetHeader("User-Agent"))
+
+	c.JSON(http.StatusOK, gin.H{"message": "Identity unlinked successfully"})
+}
+
+// GetFederationProviders lists the providers users of a tenant, given by
+// name, can sign in with.
+func (h *AuthHandler) GetFederationProviders(c *gin.Context) {
+	tenant := c.Query("tenant")
+	if tenant == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "tenant is required"})
+		return
+	}
+	providers, err := h.federation.ListActive(tenant)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	logins := make([]LoginProvider, 0, len(providers))
+	for _, p := range providers {
+		logins = append(logins, LoginProvider{
+			ID:       p.ID,
+			Name:     p.Name,
+			Type:     p.Type,
+			LoginURL: h.cfg.TokenIssuer + "/auth/federation/" + p.ID + "/login",
+		})
+	}
+	c.JSON(http.StatusOK, logins)
+}
+
+// activeProvider loads the active provider of the request, answering the
+// request when that fails.
+func (h *AuthHandler) activeProvider(c *gin.Context) (*federation.Provider, bool) {
+	if _, err := uuid.Parse(c.Param("id")); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Identity provider not found"})
+		return nil, false
+	}
+	p, err := h.federation.GetActive(c.Param("id"))
+	if err == federation.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Identity provider not found"})
+		return nil, false
+	}
+	if err != nil {
+		log.Println("Failed to load identity provider:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return nil, false
+	}
+	return p, true
+}
+
+// BeginFederatedLogin sends the browser to the provider to sign in.
+func (h *AuthHandler) BeginFederatedLogin(c *gin.Context) {
+	p, ok := h.activeProvider(c)
+	if !ok {
+		return
+	}
+	if location, ok := h.startFederatedLogin(c, p, ""); ok {
+		c.Redirect(http.StatusFound, location)
+	}
+}
+
+// LinkFederatedIdentity starts a sign-in at a provider of the tenant that
+// links the identity to the signed in user. It answers with the location
+// to send the browser to.
+func (h *AuthHandler) LinkFederatedIdentity(c *gin.Context) {
+	p, ok := h.activeProvider(c)
+	if !ok {
+		return
+	}
+	if p.TenantID != c.GetString("tenant_id") {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Identity provider not found"})
+		return
+	}
+	if location, ok := h.startFederatedLogin(c, p, c.GetString("user_id")); ok {
+		c.JSON(http.StatusOK, gin.H{"location": location})
+	}
+}
+
+// startFederatedLogin starts a sign-in at p, linking to linkUserID when
+// set, and returns where to send the browser. The request is answered when
+// that fails.
+func (h *AuthHandler) startFederatedLogin(c *gin.Context, p *federation.Provider, linkUserID string) (string, bool) {
+	var location string
+	switch p.Type {
+	case federation.TypeOIDC:
+		login, err := h.federation.StartLogin(p, "", linkUserID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start login"})
+			return "", false
+		}
+		client := federation.NewOIDCClient(p, federation.RedirectURI(h.cfg.TokenIssuer, p.ID), nil)
+		if location, err = client.AuthCodeURL(c.Request.Context(), login); err != nil {
+			log.Println("Failed to start federated login:", err)
+			c.JSON(http.StatusBadGateway, gin.H{"error": "The identity provider is not available"})
+			return "", false
+		}
+	case federation.TypeSAML:
+		client := federation.NewSAMLClient(p, h.cfg.TokenIssuer)
+		requestID, request := client.AuthnRequest(time.Now())
+		login, err := h.federation.StartLogin(p, requestID, linkUserID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start login"})
+			return "", false
+		}
+		if location, err = client.RedirectURL(request, login.State); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encode request"})
+			return "", false
+		}
+	}
+	return location, true
+}
+
+// FederatedCallback receives the authorization response of an OpenID
+// provider.
+func (h *AuthHandler) FederatedCallback(c *gin.Context) {
+	p, ok := h.activeProvider(c)
+	if !ok {
+		return
+	}
+	if p.Type != federation.TypeOIDC {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Identity provider not found"})
+		return
+	}
+
+	login, err := h.federation.TakeLogin(p.ID, c.Query("state"))
+	if err != nil {
+		h.federatedLoginFailed(c, p, err)
+		return
+	}
+	switch errorCode := c.Query("error"); errorCode {
+	case "":
+	case "access_denied":
+		h.federatedLoginFailed(c, p, federation.ErrAccessDenied)
+		return
+	default:
+		h.federatedLoginFailed(c, p, fmt.Errorf("%w: %s", federation.ErrUpstream, errorCode))
+		return
+	}
+
+	client := federation.NewOIDCClient(p, federation.RedirectURI(h.cfg.TokenIssuer, p.ID), nil)
+	profile, err := client.Exchange(c.Request.Context(), login, c.Query("code"))
+	if err != nil {
+		h.federatedLoginFailed(c, p, err)
+		return
+	}
+	h.completeFederatedLogin(c, p, login, profile)
+}
+
+// FederatedACS receives the response of a SAML IdP over the HTTP-POST
+// binding. Responses must answer an AuthnRequest of ForIAM; unsolicited
+// ones are refused.
+func (h *AuthHandler) FederatedACS(c *gin.Context) {
+	p, ok := h.activeProvider(c)
+	if !ok {
+		return
+	}
+	if p.Type != federation.TypeSAML {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Identity provider not found"})
+		return
+	}
+
+	m, err := saml.ReadMessage(c.Request, "SAMLResponse")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	login, err := h.federation.TakeLogin(p.ID, m.RelayState)
+	if err != nil {
+		h.federatedLoginFailed(c, p, err)
+		return
+	}
+
+	profile, err := federation.NewSAMLClient(p, h.cfg.TokenIssuer).ParseResponse(login, m.XML, time.Now())
+	if err != nil {
+		h.federatedLoginFailed(c, p, err)
+		return
+	}
+	h.completeFederatedLogin(c, p, login, profile)
+}
+
+// completeFederatedLogin links profile to a user and sends the browser to
+// the frontend with the code to redeem for tokens.
+func (h *AuthHandler) completeFederatedLogin(c *gin.Context, p *federation.Provider, login *federation.Login, profile *federation.Profile) {
+	result, err := h.federation.Resolve(p, profile, login.LinkUserID)
+	if err != nil {
+		h.federatedLoginFailed(c, p, err)
+		return
+	}
+
+	ip, userAgent := c.ClientIP(), c.GetHeader("User-Agent")
+	if result.Created {
+		writeAudit(h.db, p.TenantID, result.UserID, "federation.provision", "user", result.UserID, "success", ip, userAgent)
+	}
+	if result.Linked {
+		writeAudit(h.db, p.TenantID, result.UserID, "federation.link", "federation_provider", p.ID, "success", ip, userAgent)
+	}
+	if result.Created || result.Updated {
+		queueProvisioning(h.provisioning, p.TenantID, provisioning.ResourceUser, result.UserID, provisioning.OperationUpsert)
+		reconcileUser(h.groups, p.TenantID, result.UserID, result.UserID)
+	}
+	for _, groupID := range result.GroupsAdded {
+		writeAuditTarget(h.db, p.TenantID, result.UserID, "group.member_add", "group", groupID, "user", result.UserID, "success", ip, userAgent)
+		queueProvisioning(h.provisioning, p.TenantID, provisioning.ResourceGroup, groupID, provisioning.OperationUpsert)
+	}
+	for _, groupID := range result.GroupsRemoved {
+		writeAuditTarget(h.db, p.TenantID, result.UserID, "group.member_remove", "group", groupID, "user", result.UserID, "success", ip, userAgent)
+		queueProvisioning(h.provisioning, p.TenantID, provisioning.ResourceGroup, groupID, provisioning.OperationUpsert)
+	}
+
+	code, err := h.federation.CompleteLogin(login, result.UserID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to complete login"})
+		return
+	}
+	c.Redirect(http.StatusFound, h.cfg.FederationLoginURL+"?"+url.Values{"code": {code}}.Encode())
+}
+
+// federatedLoginFailed audits a failed sign-in at p and sends the browser
+// to the frontend with an error code.
+func (h *AuthHandler) federatedLoginFailed(c *gin.Context, p *federation.Provider, err error) {
+	var reason string
+	switch {
+	case err == federation.ErrLoginNotFound:
+		reason = "login_expired"
+	case errors.Is(err, federation.ErrUpstream):
+		reason = "provider_error"
+	case errors.Is(err, federation.ErrInvalidProfile), errors.Is(err, federation.ErrInvalidProvider):
+		reason = "invalid_identity"
+	case err == federation.ErrAccountNotFound:
+		reason = "account_not_found"
+	case err == federation.ErrAccountDisabled:
+		reason = "account_disabled"
+	case err == federation.ErrEmailConflict:
+		reason = "email_conflict"
+	case err == federation.ErrEmailNotVerified:
+		reason = "email_not_verified"
+	case err == federation.ErrLinkRequired:
+		reason = "link_required"
+	case err == federation.ErrIdentityConflict:
+		reason = "identity_conflict"
+	case err == federation.ErrAccessDenied:
+		reason = "access_denied"
+	default:
+		log.Println("Federated login failed:", err)
+		reason = "server_error"
+	}
+
+	writeAuditReason(h.db, p.TenantID, "", "auth.login", "federation_provider", p.ID, "failure", reason, c.ClientIP(), c.GetHeader("User-Agent"))
+
+	c.Redirect(http.StatusFound, h.cfg.FederationLoginURL+"?"+url.Values{"error": {reason}}.Encode())
+}
+
+// FinishFederatedLogin issues tokens for a completed federated login. Users
+// with a second factor, or in a tenant that requires one, get a challenge
+// token instead, unless the provider performs MFA itself.
+func (h *AuthHandler) FinishFederatedLogin(c *gin.Context) {
+	var req FederatedTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	login, err := h.federation.RedeemCode(req.Code)
+	if err == federation.ErrLoginNotFound {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid or expired code"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	var user User
+	err = h.db.QueryRow(`
+		SELECT id, tenant_id, email, is_active, created_at FROM users WHERE id = $1 AND principal_type = 'user'
+	`, login.UserID).Scan(&user.ID, &user.TenantID, &user.Email, &user.IsActive, &user.CreatedAt)
+	if err != nil && err != sql.ErrNoRows {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if err == sql.ErrNoRows || !user.IsActive {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Account disabled"})
+		return
+	}
+
+	p, err := h.federation.Get(login.TenantID, login.ProviderID)
+	if err != nil && err != federation.ErrNotFound {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if p == nil || !p.PerformsMFA {
+		challenge, err := h.mfaChallengeFor(user)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+			return
+		}
+		if challenge != nil {
+			writeAudit(h.db, user.TenantID, user.ID, "auth.login", "federation_provider", login.ProviderID, "mfa_required", c.ClientIP(), c.GetHeader("User-Agent"))
+			c.JSON(http.StatusOK, challenge)
+			return
+		}
+	}
+
+	response, err := h.startSession(user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	h.loginSucceeded(c, user)
+	writeAudit(h.db, user.TenantID, user.ID, "auth.login", "federation_provider", login.ProviderID, "success", c.ClientIP(), c.GetHeader("User-Agent"))
+
+	c.JSON(http.StatusOK, response)
+}
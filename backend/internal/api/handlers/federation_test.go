@@ -0,0 +1,117 @@
+package handlers
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ForIAM/ForIAM/backend/internal/config"
+	"github.com/ForIAM/ForIAM/backend/internal/dbtest"
+	"github.com/ForIAM/ForIAM/backend/internal/federation"
+	"github.com/gin-gonic/gin"
+)
+
+func TestCompleteFederatedLogin(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	tests := []struct {
+		name     string
+		verified string
+		redirect string
+		events   []string
+	}{
+		{"verified address links the identity", "true", "code=", []string{"federation.link provider-1"}},
+		{"unverified address is not linked", "", "error=link_required", []string{"auth.login provider-1"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, script := dbtest.Open(t)
+			script.On("FROM federated_identities fi", nil)
+			script.On("FROM users WHERE email = $1", nil, []driver.Value{"user-1", "alice@corp.example", "tenant-1", "user", true})
+			script.On("INSERT INTO federated_identities", nil, []driver.Value{})
+			script.On("UPDATE users", nil)
+			script.On("UPDATE federated_identities", nil)
+			script.On("UPDATE federation_logins", nil, []driver.Value{})
+			events := recordAudit(script)
+
+			h := &AuthHandler{db: db, cfg: &config.Config{FederationLoginURL: "https://app.example/login/federated"},
+				federation: federation.NewStore(db, "key")}
+			p := &federation.Provider{ID: "provider-1", TenantID: "tenant-1", ClaimMapping: map[string]string{"email": "email"}}
+			claims := map[string][]string{"email": {"alice@corp.example"}}
+			if tt.verified != "" {
+				claims["email_verified"] = []string{tt.verified}
+			}
+
+			w := httptest.NewRecorder()
+			c, _ := gin.CreateTestContext(w)
+			c.Request = httptest.NewRequest("GET", "/auth/federation/provider-1/callback", nil)
+			h.completeFederatedLogin(c, p, &federation.Login{ID: "login-1"}, &federation.Profile{Subject: "alice", Claims: claims})
+
+			if w.Code != http.StatusFound || !strings.Contains(w.Header().Get("Location"), tt.redirect) {
+				t.Errorf("Expected a redirect with %s, got %d %s", tt.redirect, w.Code, w.Header().Get("Location"))
+			}
+			if !reflect.DeepEqual(*events, tt.events) {
+				t.Errorf("Expected audit events %v, got %v", tt.events, *events)
+			}
+		})
+	}
+}
+
+const (
+	adminsGroup = "3f6c2a9e-0b1d-4c57-9a3e-5d2f8b7c1e40"
+	adminRole   = "3f6c2a9e-0b1d-4c57-9a3e-5d2f8b7c1e42"
+)
+
+func TestFederationHandler_GroupMappingGrantable(t *testing.T) {
+	body := `{"name": "Corp", "type": "oidc", "issuer": "https://idp.corp.example", "client_id": "foriam",
+		"group_mapping": {"admins": "` + adminsGroup + `"}}`
+
+	tests := []struct {
+		name        string
+		permissions []string
+		status      int
+	}{
+		{"caller lacking what the mapped group grants", []string{"federation.write"}, http.StatusForbidden},
+		{"caller holding what the mapped group grants", []string{"federation.write", "user.admin"}, http.StatusCreated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, script := dbtest.Open(t)
+			scriptInTenant(script, tenantGroups, adminsGroup)
+			scriptGrants(script, adminRole, "user.admin")
+			script.On("SELECT COUNT(*) FROM groups WHERE tenant_id = $1 AND id = ANY($2) AND rule IS NULL", []string{"count"}, []driver.Value{int64(1)})
+			script.On("INSERT INTO federation_providers", []string{"id", "created_at"}, []driver.Value{"p-1", time.Now()})
+			script.On("INSERT INTO audit_logs", nil)
+
+			h := &FederationHandler{db: db, cfg: &config.Config{}, store: federation.NewStore(db, "secret")}
+			w := serve(h.CreateProvider, "POST", "/federation/providers", "/federation/providers", body, tt.permissions...)
+			expectStatus(t, tt.name, w, tt.status)
+			if created := script.Ran("INSERT INTO federation_providers"); created != (tt.status == http.StatusCreated) {
+				t.Errorf("%s: expected the provider to be created only when allowed, created: %v", tt.name, created)
+			}
+		})
+	}
+}
+
+func TestFederationHandler_UpdateGroupMappingGrantable(t *testing.T) {
+	db, script := dbtest.Open(t)
+	script.On("SELECT id, tenant_id, name, type", nil, []driver.Value{
+		"p-1", "tenant-1", "Corp", "oidc", "https://idp.corp.example", "foriam", "{openid,email}", "", "", "",
+		[]byte(`{"email": "email"}`), "groups", []byte(`{}`), false, false, false, false, true, time.Now(),
+	})
+	scriptInTenant(script, tenantGroups, adminsGroup)
+	scriptGrants(script, adminRole, "user.admin")
+
+	h := &FederationHandler{db: db, cfg: &config.Config{}, store: federation.NewStore(db, "secret")}
+	body := `{"name": "Corp", "type": "oidc", "issuer": "https://idp.corp.example", "client_id": "foriam",
+		"group_mapping": {"admins": "` + adminsGroup + `"}}`
+	w := serve(h.UpdateProvider, "PUT", "/federation/providers/:id", "/federation/providers/p-1", body, "federation.write")
+	expectStatus(t, "mapping a group the caller cannot grant", w, http.StatusForbidden)
+	if script.Ran("UPDATE federation_providers") {
+		t.Error("Expected the provider to be left unchanged")
+	}
+}
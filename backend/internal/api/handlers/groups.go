@@ -1,19 +1,29 @@
 package handlers
 
 import (
+	"context"
 	"database/sql"
+	"log"
 	"net/http"
 	"time"
 
+	"github.com/ForIAM/ForIAM/backend/internal/api/middleware"
+	"github.com/ForIAM/ForIAM/backend/internal/authz"
+	"github.com/ForIAM/ForIAM/backend/internal/dynamicgroup"
+	"github.com/ForIAM/ForIAM/backend/internal/provisioning"
 	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
 )
 
 type GroupHandler struct {
-	db *sql.DB
+	db           *sql.DB
+	resolver     middleware.PermissionResolver
+	provisioning *provisioning.Queue
+	groups       *dynamicgroup.Reconciler
 }
 
-func NewGroupHandler(db *sql.DB) *GroupHandler {
-	return &GroupHandler{db: db}
+func NewGroupHandler(db *sql.DB, resolver middleware.PermissionResolver) *GroupHandler {
+	return &GroupHandler{db: db, resolver: resolver, provisioning: provisioning.NewQueue(db), groups: dynamicgroup.NewReconciler(db)}
 }
 
 type Group struct {
@@ -21,19 +31,53 @@ type Group struct {
 	TenantID    string    `json:"tenant_id"`
 	Name        string    `json:"name"`
 	Description string    `json:"description"`
+	Rule        string    `json:"rule,omitempty"`
 	CreatedAt   time.Time `json:"created_at"`
 }
 
+// CreateGroupRequest creates or updates a group. With a rule the group is
+// dynamic: its members are the users the rule matches. On update, a rule
+// left out stays and an empty one makes the group static, keeping its
+// members.
 type CreateGroupRequest struct {
-	Name        string `json:"name" binding:"required"`
-	Description string `json:"description"`
+	Name        string  `json:"name" binding:"required"`
+	Description string  `json:"description"`
+	Rule        *string `json:"rule"`
+}
+
+// RulePreviewRequest names a rule to try out, and optionally the group it
+// is meant for.
+type RulePreviewRequest struct {
+	Rule    string `json:"rule" binding:"required"`
+	GroupID string `json:"group_id"`
+}
+
+// reconcileUser brings the dynamic group memberships of a user up to date
+// after it changed.
+func reconcileUser(groups *dynamicgroup.Reconciler, tenantID, userID, actorID string) {
+	if err := groups.ReconcileUser(context.Background(), tenantID, userID, actorID); err != nil {
+		log.Println("Failed to reconcile dynamic groups:", err)
+	}
+}
+
+// compileRule checks the rule of req, answering the request when it is
+// invalid. It returns the rule to store: nil for none.
+func compileRule(c *gin.Context, req *CreateGroupRequest) (*string, bool) {
+	if req.Rule == nil || *req.Rule == "" {
+		return nil, true
+	}
+	if _, err := dynamicgroup.Compile(*req.Rule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return nil, false
+	}
+	return req.Rule, true
 }
 
 func (h *GroupHandler) GetGroups(c *gin.Context) {
 	tenantID, _ := c.Get("tenant_id")
 
 	rows, err := h.db.Query(`
-		SELECT id, tenant_id, name, description, created_at 
+		SELECT id, tenant_id, name, description, COALESCE(rule, ''), created_at 
 		FROM groups 
 		WHERE tenant_id = $1 
 		ORDER BY created_at DESC
@@ -47,7 +91,7 @@ func (h *GroupHandler) GetGroups(c *gin.Context) {
 	var groups []Group
 	for rows.Next() {
 		var group Group
-		if err := rows.Scan(&group.ID, &group.TenantID, &group.Name, &group.Description, &group.CreatedAt); err != nil {
+		if err := rows.Scan(&group.ID, &group.TenantID, &group.Name, &group.Description, &group.Rule, &group.CreatedAt); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan group"})
 			return
 		}
@@ -64,21 +108,31 @@ func (h *GroupHandler) CreateGroup(c *gin.Context) {
 		return
 	}
 
+	rule, ok := compileRule(c, &req)
+	if !ok {
+		return
+	}
+
 	tenantID, _ := c.Get("tenant_id")
 
 	var group Group
 	err := h.db.QueryRow(`
-		INSERT INTO groups (tenant_id, name, description) 
-		VALUES ($1, $2, $3) 
-		RETURNING id, tenant_id, name, description, created_at
-	`, tenantID, req.Name, req.Description).Scan(
-		&group.ID, &group.TenantID, &group.Name, &group.Description, &group.CreatedAt,
+		INSERT INTO groups (tenant_id, name, description, rule) 
+		VALUES ($1, $2, $3, $4) 
+		RETURNING id, tenant_id, name, description, COALESCE(rule, ''), created_at
+	`, tenantID, req.Name, req.Description, rule).Scan(
+		&group.ID, &group.TenantID, &group.Name, &group.Description, &group.Rule, &group.CreatedAt,
 	)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create group"})
 		return
 	}
 
+	queueProvisioning(h.provisioning, group.TenantID, provisioning.ResourceGroup, group.ID, provisioning.OperationUpsert)
+	if rule != nil {
+		h.reconcileGroup(c, group.ID)
+	}
+
 	c.JSON(http.StatusCreated, group)
 }
 
@@ -88,10 +142,10 @@ func (h *GroupHandler) GetGroup(c *gin.Context) {
 
 	var group Group
 	err := h.db.QueryRow(`
-		SELECT id, tenant_id, name, description, created_at 
+		SELECT id, tenant_id, name, description, COALESCE(rule, ''), created_at 
 		FROM groups 
 		WHERE id = $1 AND tenant_id = $2
-	`, groupID, tenantID).Scan(&group.ID, &group.TenantID, &group.Name, &group.Description, &group.CreatedAt)
+	`, groupID, tenantID).Scan(&group.ID, &group.TenantID, &group.Name, &group.Description, &group.Rule, &group.CreatedAt)
 
 	if err == sql.ErrNoRows {
 		c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
@@ -115,15 +169,45 @@ func (h *GroupHandler) UpdateGroup(c *gin.Context) {
 		return
 	}
 
-	_, err := h.db.Exec(`
+	rule, ok := compileRule(c, &req)
+	if !ok {
+		return
+	}
+	// A rule hands the group's permissions to whoever it matches
+	if rule != nil {
+		if _, err := uuid.Parse(groupID); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+			return
+		}
+		permissions, err := authz.GroupPermissions(c.Request.Context(), h.db, []string{groupID})
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if !checkGrantable(c, h.db, h.resolver, permissions) {
+			return
+		}
+	}
+
+	result, err := h.db.Exec(`
 		UPDATE groups 
-		SET name = $1, description = $2 
+		SET name = $1, description = $2,
+		    rule = CASE WHEN $5 THEN $6 ELSE rule END
 		WHERE id = $3 AND tenant_id = $4
-	`, req.Name, req.Description, groupID, tenantID)
+	`, req.Name, req.Description, groupID, tenantID, req.Rule != nil, rule)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update group"})
 		return
 	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+		return
+	}
+
+	queueProvisioning(h.provisioning, c.GetString("tenant_id"), provisioning.ResourceGroup, groupID, provisioning.OperationUpsert)
+	if rule != nil {
+		h.reconcileGroup(c, groupID)
+	}
 
 	c.JSON(http.StatusOK, gin.H{"message": "Group updated successfully"})
 }
@@ -147,5 +231,90 @@ func (h *GroupHandler) DeleteGroup(c *gin.Context) {
 		return
 	}
 
+	queueProvisioning(h.provisioning, c.GetString("tenant_id"), provisioning.ResourceGroup, groupID, provisioning.OperationDelete)
+
 	c.JSON(http.StatusOK, gin.H{"message": "Group deleted successfully"})
-}
\ No newline at end of file
+}
+
+// reconcileGroup applies the rule of a group just saved.
+func (h *GroupHandler) reconcileGroup(c *gin.Context, groupID string) {
+	_, _, err := h.groups.ReconcileGroup(c.Request.Context(), c.GetString("tenant_id"), groupID, c.GetString("user_id"))
+	if err != nil {
+		log.Println("Failed to reconcile dynamic group:", err)
+	}
+}
+
+// PreviewRule lists the users a rule matches, to check it before saving it
+// on a group. With a group_id, the users the group would gain and lose are
+// listed too.
+func (h *GroupHandler) PreviewRule(c *gin.Context) {
+	var req RulePreviewRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	rule, err := dynamicgroup.Compile(req.Rule)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	tenantID := c.GetString("tenant_id")
+
+	var current map[string]bool
+	if req.GroupID != "" {
+		if _, err := uuid.Parse(req.GroupID); err != nil {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+			return
+		}
+		var exists bool
+		err := h.db.QueryRow(`SELECT EXISTS (SELECT 1 FROM groups WHERE id = $1 AND tenant_id = $2)`, req.GroupID, tenantID).Scan(&exists)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		if !exists {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Group not found"})
+			return
+		}
+		rows, err := h.db.Query(`
+			SELECT ug.user_id FROM user_groups ug
+			JOIN users u ON u.id = ug.user_id AND u.principal_type = 'user'
+			WHERE ug.group_id = $1
+		`, req.GroupID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		members, err := scanIDs(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		current = map[string]bool{}
+		for _, id := range members {
+			current[id] = true
+		}
+	}
+
+	matches, err := h.groups.Preview(c.Request.Context(), tenantID, rule)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	response := gin.H{"count": len(matches), "users": matches}
+	if current != nil {
+		added := []string{}
+		for _, member := range matches {
+			if !current[member.ID] {
+				added = append(added, member.ID)
+			}
+			delete(current, member.ID)
+		}
+		removed := []string{}
+		for id := range current {
+			removed = append(removed, id)
+		}
+		response["added"], response["removed"] = added, removed
+	}
+	c.JSON(http.StatusOK, response)
+}
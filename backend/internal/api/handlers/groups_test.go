@@ -0,0 +1,207 @@
+package handlers
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/ForIAM/ForIAM/backend/internal/dbtest"
+	"github.com/ForIAM/ForIAM/backend/internal/dynamicgroup"
+	"github.com/ForIAM/ForIAM/backend/internal/provisioning"
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	ruleUsers  = "principal_type = 'user' AND ($2 = ''"
+	groupUsers = "SELECT ug.user_id FROM user_groups ug"
+)
+
+// scriptUsers scripts the users of tenant-1: alice and carol work in sales,
+// bob in support.
+func scriptUsers(s *dbtest.Script) {
+	s.On(ruleUsers, nil,
+		[]driver.Value{"u-1", "alice@example.com", true, "Alice", "", "", "", []byte(`{"department": "sales"}`)},
+		[]driver.Value{"u-2", "bob@example.com", true, "Bob", "", "", "", []byte(`{"department": "support"}`)},
+		[]driver.Value{"u-3", "carol@example.com", false, "Carol", "", "", "", []byte(`{"department": "sales"}`)},
+	)
+}
+
+// recordMembers scripts query, which changes the members of a group, and
+// returns the users it was given in $2.
+func recordMembers(s *dbtest.Script, query string) *[]string {
+	var users []string
+	s.OnArgs(query, nil, func(args []driver.Value) [][]driver.Value {
+		users = append(users, dbtest.Array(args[1])...)
+		return nil
+	})
+	return &users
+}
+
+func newGroupHandler(db *sql.DB) *GroupHandler {
+	return &GroupHandler{db: db, provisioning: provisioning.NewQueue(db), groups: dynamicgroup.NewReconciler(db)}
+}
+
+func TestGroupHandler_RuleValidation(t *testing.T) {
+	h := &GroupHandler{}
+
+	tests := []struct {
+		name    string
+		handler gin.HandlerFunc
+		method  string
+		route   string
+		path    string
+		body    string
+		status  int
+	}{
+		{"create with an invalid rule", h.CreateGroup, "POST", "/groups", "/groups", `{"name": "Sales", "rule": "department = \"sales\""}`, http.StatusBadRequest},
+		{"create with a rule of the wrong type", h.CreateGroup, "POST", "/groups", "/groups", `{"name": "Sales", "rule": true}`, http.StatusBadRequest},
+		{"update with an invalid rule", h.UpdateGroup, "PUT", "/groups/:id", "/groups/" + adminsGroup, `{"name": "Sales", "rule": "is_active &&"}`, http.StatusBadRequest},
+		{"rule on a malformed group", h.UpdateGroup, "PUT", "/groups/:id", "/groups/sales", `{"name": "Sales", "rule": "is_active"}`, http.StatusNotFound},
+		{"preview without a rule", h.PreviewRule, "POST", "/groups/rule-preview", "/groups/rule-preview", `{}`, http.StatusBadRequest},
+		{"preview of an invalid rule", h.PreviewRule, "POST", "/groups/rule-preview", "/groups/rule-preview", `{"rule": "lower(department) == \"sales\""}`, http.StatusBadRequest},
+		{"preview for a malformed group", h.PreviewRule, "POST", "/groups/rule-preview", "/groups/rule-preview", `{"rule": "is_active", "group_id": "sales"}`, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		w := serve(tt.handler, tt.method, tt.route, tt.path, tt.body)
+		expectStatus(t, tt.name, w, tt.status)
+	}
+}
+
+func TestGroupHandler_RuleGrantable(t *testing.T) {
+	db, script := dbtest.Open(t)
+	scriptGrants(script, adminRole, "user.admin")
+
+	body := `{"name": "Admins", "rule": "department == \"sales\""}`
+	w := serve(newGroupHandler(db).UpdateGroup, "PUT", "/groups/:id", "/groups/"+adminsGroup, body, "group.write")
+	expectStatus(t, "rule handing out what the caller cannot grant", w, http.StatusForbidden)
+	if script.Ran("UPDATE groups") {
+		t.Error("Expected the group to be left unchanged")
+	}
+}
+
+func TestGroupHandler_RuleReconciles(t *testing.T) {
+	db, script := dbtest.Open(t)
+	scriptGrants(script, adminRole, "user.admin")
+	script.On("UPDATE groups", nil, []driver.Value{})
+	script.On("WITH reused AS", nil)
+	script.On("SELECT rule FROM groups WHERE id = $1 AND tenant_id = $2 FOR UPDATE", nil, []driver.Value{`department == "sales"`})
+	scriptUsers(script)
+	script.On(groupUsers, nil, []driver.Value{"u-2"}, []driver.Value{"u-3"})
+	removed := recordMembers(script, "DELETE FROM user_groups WHERE group_id = $1 AND user_id = ANY($2)")
+	added := recordMembers(script, "INSERT INTO user_groups (user_id, group_id) SELECT unnest($2::uuid[]), $1")
+	events := recordAudit(script)
+
+	body := `{"name": "Admins", "rule": "department == \"sales\""}`
+	w := serve(newGroupHandler(db).UpdateGroup, "PUT", "/groups/:id", "/groups/"+adminsGroup, body, "group.write", "user.admin")
+	expectStatus(t, "rule the caller can grant", w, http.StatusOK)
+
+	if !reflect.DeepEqual(*added, []string{"u-1"}) {
+		t.Errorf("Expected the unmatched sales user to be added, got %v", *added)
+	}
+	if !reflect.DeepEqual(*removed, []string{"u-2"}) {
+		t.Errorf("Expected the support user to be removed, got %v", *removed)
+	}
+	expected := []string{"group.member_add u-1", "group.member_remove u-2"}
+	if !reflect.DeepEqual(*events, expected) {
+		t.Errorf("Expected audit events %v, got %v", expected, *events)
+	}
+}
+
+func TestGroupHandler_StaticGroupKeepsMembers(t *testing.T) {
+	db, script := dbtest.Open(t)
+	script.On("UPDATE groups", nil, []driver.Value{})
+	script.On("WITH reused AS", nil)
+
+	// An empty rule makes the group static without reconciling it
+	body := `{"name": "Admins", "rule": ""}`
+	w := serve(newGroupHandler(db).UpdateGroup, "PUT", "/groups/:id", "/groups/"+adminsGroup, body, "group.write")
+	expectStatus(t, "group made static", w, http.StatusOK)
+	if script.Ran("user_groups") {
+		t.Error("Expected the members of a static group to be left alone")
+	}
+}
+
+func TestGroupHandler_PreviewRule(t *testing.T) {
+	db, script := dbtest.Open(t)
+	script.On("SELECT EXISTS (SELECT 1 FROM groups", nil, []driver.Value{true})
+	script.On(groupUsers, nil, []driver.Value{"u-2"}, []driver.Value{"u-3"})
+	scriptUsers(script)
+
+	body := `{"rule": "department == \"sales\"", "group_id": "` + adminsGroup + `"}`
+	w := serve(newGroupHandler(db).PreviewRule, "POST", "/groups/rule-preview", "/groups/rule-preview", body, "group.read")
+	expectStatus(t, "preview for a group", w, http.StatusOK)
+
+	var response struct {
+		Count   int                   `json:"count"`
+		Users   []dynamicgroup.Member `json:"users"`
+		Added   []string              `json:"added"`
+		Removed []string              `json:"removed"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("Failed to decode the preview: %v", err)
+	}
+	var matched []string
+	for _, member := range response.Users {
+		matched = append(matched, member.Email)
+	}
+	sort.Strings(matched)
+	if response.Count != 2 || !reflect.DeepEqual(matched, []string{"alice@example.com", "carol@example.com"}) {
+		t.Errorf("Expected the sales users to match, got %d %v", response.Count, matched)
+	}
+	if !reflect.DeepEqual(response.Added, []string{"u-1"}) || !reflect.DeepEqual(response.Removed, []string{"u-2"}) {
+		t.Errorf("Expected u-1 to be added and u-2 removed, got %v and %v", response.Added, response.Removed)
+	}
+	if script.Ran("INSERT INTO user_groups") || script.Ran("DELETE FROM user_groups") {
+		t.Error("Expected a preview to change no members")
+	}
+}
+
+func TestUserHandler_AttributesJoiningGrantable(t *testing.T) {
+	tests := []struct {
+		name        string
+		permissions []string
+		status      int
+	}{
+		{"caller lacking what the joined group grants", []string{"user.write"}, http.StatusForbidden},
+		{"caller holding what the joined group grants", []string{"user.write", "user.admin"}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, script := dbtest.Open(t)
+			// bob moves from support to sales once the update is made
+			var updated bool
+			script.OnArgs(ruleUsers, nil, func(args []driver.Value) [][]driver.Value {
+				attributes := `{"department": "support"}`
+				if updated {
+					attributes = `{"department": "sales"}`
+				}
+				return [][]driver.Value{{"u-2", "bob@example.com", true, "Bob", "", "", "", []byte(attributes)}}
+			})
+			script.On("SELECT g.id, g.rule FROM groups g", nil, []driver.Value{adminsGroup, `department == "sales"`})
+			script.On("SELECT id, rule FROM groups WHERE tenant_id = $1 AND rule IS NOT NULL", nil, []driver.Value{adminsGroup, `department == "sales"`})
+			scriptGrants(script, adminRole, "user.admin")
+			script.OnArgs("UPDATE users SET", nil, func(args []driver.Value) [][]driver.Value {
+				updated = true
+				return [][]driver.Value{{}}
+			})
+			script.On("INSERT INTO user_groups", nil, []driver.Value{})
+			events := recordAudit(script)
+			script.On("WITH reused AS", nil)
+
+			h := &UserHandler{db: db, provisioning: provisioning.NewQueue(db), groups: dynamicgroup.NewReconciler(db)}
+			body := `{"attributes": {"department": "sales"}}`
+			w := serve(h.UpdateUser, "PUT", "/users/:id", "/users/u-2", body, tt.permissions...)
+			expectStatus(t, tt.name, w, tt.status)
+			if updated != (tt.status == http.StatusOK) {
+				t.Errorf("%s: expected the user to be updated only when allowed, updated: %v", tt.name, updated)
+			}
+			if tt.status == http.StatusOK && !reflect.DeepEqual(*events, []string{"group.member_add u-2"}) {
+				t.Errorf("%s: expected the user to join the group, got audit events %v", tt.name, *events)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package handlers
+
+import (
+	"database/sql/driver"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ForIAM/ForIAM/backend/internal/dbtest"
+	"github.com/gin-gonic/gin"
+)
+
+// serve runs a request through handler as caller-1 of tenant-1 holding
+// permissions, and returns the response.
+func serve(handler gin.HandlerFunc, method, route, path, body string, permissions ...string) *httptest.ResponseRecorder {
+	gin.SetMode(gin.TestMode)
+	router := gin.New()
+	router.Handle(method, route, func(c *gin.Context) {
+		c.Set("tenant_id", "tenant-1")
+		c.Set("user_id", "caller-1")
+		c.Set("permissions", permissions)
+	}, handler)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// expectStatus fails the test unless w has status.
+func expectStatus(t *testing.T, name string, w *httptest.ResponseRecorder, status int) {
+	t.Helper()
+	if w.Code != status {
+		t.Errorf("%s: expected %d, got %d %s", name, status, w.Code, w.Body.String())
+	}
+}
+
+// scriptInTenant scripts query to find those of the IDs $1 listed in ids.
+func scriptInTenant(s *dbtest.Script, query string, ids ...string) {
+	known := map[string]bool{}
+	for _, id := range ids {
+		known[id] = true
+	}
+	s.OnArgs(query, []string{"id"}, func(args []driver.Value) [][]driver.Value {
+		var rows [][]driver.Value
+		for _, id := range dbtest.Array(args[0]) {
+			if known[id] {
+				rows = append(rows, []driver.Value{id})
+			}
+		}
+		return rows
+	})
+}
+
+// scriptGrants scripts what members of groups gain: the permissions of the
+// role roleID, which all exist.
+func scriptGrants(s *dbtest.Script, roleID string, permissions ...string) {
+	s.On("FROM group_hierarchy gh JOIN nested", []string{"role_id"}, []driver.Value{roleID})
+	var rows [][]driver.Value
+	for _, permission := range permissions {
+		rows = append(rows, []driver.Value{permission})
+	}
+	s.On("FROM role_hierarchy rh JOIN held", []string{"name"}, rows...)
+	s.On("SELECT COUNT(*) FROM permissions WHERE name = ANY($1)", []string{"count"}, []driver.Value{int64(len(permissions))})
+}
+
+// recordAudit scripts the audit log and returns the events written to it,
+// each as its action and resource ID.
+func recordAudit(s *dbtest.Script) *[]string {
+	var events []string
+	s.OnArgs("INSERT INTO audit_logs", nil, func(args []driver.Value) [][]driver.Value {
+		events = append(events, fmt.Sprintf("%v %v", args[2], args[4]))
+		return nil
+	})
+	return &events
+}
@@ -0,0 +1,25 @@
+package handlers
+
+import (
+	"net/http"
+
+	"github.com/ForIAM/ForIAM/backend/internal/signing"
+	"github.com/gin-gonic/gin"
+)
+
+type JWKSHandler struct {
+	keys *signing.Manager
+}
+
+func NewJWKSHandler(keys *signing.Manager) *JWKSHandler {
+	return &JWKSHandler{keys: keys}
+}
+
+// GetJWKS publishes the public keys access tokens can be verified with: the
+// current signing key and retired keys still within their overlap window.
+func (h *JWKSHandler) GetJWKS(c *gin.Context) {
+	// Short cache lifetime so verifiers notice rotations well within the
+	// overlap window
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, h.keys.JWKS())
+}
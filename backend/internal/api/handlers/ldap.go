@@ -0,0 +1,234 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+
+	"github.com/ForIAM/ForIAM/backend/internal/api/middleware"
+	"github.com/ForIAM/ForIAM/backend/internal/config"
+	"github.com/ForIAM/ForIAM/backend/internal/ldap"
+	"github.com/ForIAM/ForIAM/backend/internal/lockout"
+	"github.com/ForIAM/ForIAM/backend/internal/provisioning"
+	"github.com/gin-gonic/gin"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// DirectoryHandler manages the LDAP directory a tenant's passwords are
+// checked against. The check itself is part of AuthHandler.Login.
+type DirectoryHandler struct {
+	db       *sql.DB
+	store    *ldap.Store
+	resolver middleware.PermissionResolver
+}
+
+func NewDirectoryHandler(db *sql.DB, cfg *config.Config, resolver middleware.PermissionResolver) *DirectoryHandler {
+	return &DirectoryHandler{db: db, store: ldap.NewStore(db, cfg.EncryptionKey), resolver: resolver}
+}
+
+// DirectoryRequest configures the LDAP directory of the tenant.
+// bind_password is write only; left out, the current one stays. Filters
+// and the group name attribute left out select the defaults; is_active
+// defaults to true.
+type DirectoryRequest struct {
+	URL                 string            `json:"url" binding:"required"`
+	StartTLS            bool              `json:"start_tls"`
+	RootCA              string            `json:"root_ca"`
+	BindDN              string            `json:"bind_dn"`
+	BindPassword        string            `json:"bind_password"`
+	BaseDN              string            `json:"base_dn" binding:"required"`
+	UserFilter          string            `json:"user_filter"`
+	GroupSync           bool              `json:"group_sync"`
+	GroupBaseDN         string            `json:"group_base_dn"`
+	GroupFilter         string            `json:"group_filter"`
+	GroupNameAttribute  string            `json:"group_name_attribute"`
+	GroupMapping        map[string]string `json:"group_mapping"`
+	AllowLocalPasswords bool              `json:"allow_local_passwords"`
+	IsActive            *bool             `json:"is_active"`
+}
+
+func (req DirectoryRequest) apply(d *ldap.Directory) {
+	d.URL = req.URL
+	d.StartTLS = req.StartTLS
+	d.RootCA = req.RootCA
+	d.BindDN = req.BindDN
+	d.BindPassword = req.BindPassword
+	d.BaseDN = req.BaseDN
+	d.UserFilter = req.UserFilter
+	d.GroupSync = req.GroupSync
+	d.GroupBaseDN = req.GroupBaseDN
+	d.GroupFilter = req.GroupFilter
+	d.GroupNameAttribute = req.GroupNameAttribute
+	d.GroupMapping = req.GroupMapping
+	d.AllowLocalPasswords = req.AllowLocalPasswords
+	d.IsActive = true
+	if req.IsActive != nil {
+		d.IsActive = *req.IsActive
+	}
+}
+
+// DirectoryTestRequest names a user to look up in the directory; without
+// an email address only the connection and service account are checked.
+type DirectoryTestRequest struct {
+	Email string `json:"email"`
+}
+
+func directoryError(c *gin.Context, err error) {
+	switch {
+	case errors.Is(err, ldap.ErrInvalidDirectory):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case err == ldap.ErrNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "LDAP directory not configured"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+	}
+}
+
+func (h *DirectoryHandler) GetDirectory(c *gin.Context) {
+	d, err := h.store.Get(c.GetString("tenant_id"))
+	if err != nil {
+		directoryError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, d)
+}
+
+func (h *DirectoryHandler) UpdateDirectory(c *gin.Context) {
+	var req DirectoryRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	d := &ldap.Directory{TenantID: c.GetString("tenant_id")}
+	req.apply(d)
+	if !checkMappingGrantable(c, h.db, h.resolver, d.GroupMapping) {
+		return
+	}
+	if err := h.store.Save(d); err != nil {
+		directoryError(c, err)
+		return
+	}
+
+	writeAudit(h.db, d.TenantID, c.GetString("user_id"), "ldap.update", "ldap_directory", d.TenantID, "success", c.ClientIP(), c.GetHeader("User-Agent"))
+
+	c.JSON(http.StatusOK, d)
+}
+
+func (h *DirectoryHandler) DeleteDirectory(c *gin.Context) {
+	tenantID := c.GetString("tenant_id")
+	if err := h.store.Delete(tenantID); err != nil {
+		directoryError(c, err)
+		return
+	}
+
+	writeAudit(h.db, tenantID, c.GetString("user_id"), "ldap.delete", "ldap_directory", tenantID, "success", c.ClientIP(), c.GetHeader("User-Agent"))
+
+	c.JSON(http.StatusOK, gin.H{"message": "LDAP directory deleted successfully"})
+}
+
+// TestDirectory connects to the saved directory, active or not, as the
+// service account and looks up a user's entry and groups, to check the
+// configuration before users sign in with it.
+func (h *DirectoryHandler) TestDirectory(c *gin.Context) {
+	var req DirectoryTestRequest
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	d, err := h.store.Get(c.GetString("tenant_id"))
+	if err != nil {
+		directoryError(c, err)
+		return
+	}
+
+	if req.Email == "" {
+		err = d.Ping(c.Request.Context())
+		if err != nil {
+			c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"message": "Connected to the LDAP directory"})
+		return
+	}
+
+	account, err := d.Lookup(c.Request.Context(), req.Email)
+	if err == ldap.ErrUserNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "No directory entry for this email address"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusBadGateway, gin.H{"error": err.Error()})
+		return
+	}
+	groups := []string{}
+	for groupID := range d.Groups(account) {
+		groups = append(groups, groupID)
+	}
+	c.JSON(http.StatusOK, gin.H{"dn": account.DN, "groups": account.Groups, "group_ids": groups})
+}
+
+// verifyPassword checks the password of user: against the LDAP directory of
+// its tenant when it has an active one, otherwise against its hash. Users
+// without an entry in the directory fall back to their hash when the
+// directory allows local passwords. A successful directory sign-in syncs
+// the mapped groups. When the password is not verified the response is
+// written and false returned.
+func (h *AuthHandler) verifyPassword(c *gin.Context, user User, passwordHash, password string) bool {
+	d, err := h.directories.GetActive(user.TenantID)
+	if err != nil && err != ldap.ErrNotFound {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return false
+	}
+
+	if d != nil {
+		account, err := d.Authenticate(c.Request.Context(), user.Email, password)
+		switch {
+		case err == nil:
+			return h.syncDirectoryGroups(c, d, user, account)
+		case err == ldap.ErrUserNotFound && d.AllowLocalPasswords:
+			// Fall back to the password hash below
+		case err == ldap.ErrInvalidCredentials, err == ldap.ErrUserNotFound:
+			h.loginFailed(c, user, user.Email, lockout.ReasonInvalidPassword)
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+			return false
+		default:
+			writeAuditReason(h.db, user.TenantID, user.ID, "auth.login", "", "", "failure", "directory_unavailable", c.ClientIP(), c.GetHeader("User-Agent"))
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "The directory is unavailable, try again later"})
+			return false
+		}
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(passwordHash), []byte(password)); err != nil {
+		h.loginFailed(c, user, user.Email, lockout.ReasonInvalidPassword)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid credentials"})
+		return false
+	}
+	return true
+}
+
+// syncDirectoryGroups applies the directory groups of account to the group
+// memberships of user, when the directory syncs groups.
+func (h *AuthHandler) syncDirectoryGroups(c *gin.Context, d *ldap.Directory, user User, account *ldap.Account) bool {
+	if !d.GroupSync {
+		return true
+	}
+	added, removed, err := h.directories.SyncGroups(d, user.ID, account)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return false
+	}
+
+	ip, userAgent := c.ClientIP(), c.GetHeader("User-Agent")
+	for _, groupID := range added {
+		writeAuditTarget(h.db, user.TenantID, user.ID, "group.member_add", "group", groupID, "user", user.ID, "success", ip, userAgent)
+		queueProvisioning(h.provisioning, user.TenantID, provisioning.ResourceGroup, groupID, provisioning.OperationUpsert)
+	}
+	for _, groupID := range removed {
+		writeAuditTarget(h.db, user.TenantID, user.ID, "group.member_remove", "group", groupID, "user", user.ID, "success", ip, userAgent)
+		queueProvisioning(h.provisioning, user.TenantID, provisioning.ResourceGroup, groupID, provisioning.OperationUpsert)
+	}
+	return true
+}
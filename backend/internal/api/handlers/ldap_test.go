@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ForIAM/ForIAM/backend/internal/dbtest"
+	"github.com/ForIAM/ForIAM/backend/internal/ldap"
+	"github.com/ForIAM/ForIAM/backend/internal/provisioning"
+	"github.com/gin-gonic/gin"
+)
+
+func TestSyncDirectoryGroups(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	const staffGroup = "3f6c2a9e-0b1d-4c57-9a3e-5d2f8b7c1e41"
+	mapping := map[string]string{"staff": staffGroup, "admins": adminsGroup}
+
+	tests := []struct {
+		name   string
+		sync   bool
+		events []string
+	}{
+		{"group sync off", false, nil},
+		{"group sync on", true, []string{"group.member_add " + staffGroup, "group.member_remove " + adminsGroup}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, script := dbtest.Open(t)
+			script.On("INSERT INTO user_groups", nil, []driver.Value{staffGroup})
+			script.On("DELETE FROM user_groups", nil, []driver.Value{adminsGroup})
+			script.On("INSERT INTO provisioning_jobs", nil)
+			events := recordAudit(script)
+
+			h := &AuthHandler{db: db, directories: ldap.NewStore(db, "key"), provisioning: provisioning.NewQueue(db)}
+			d := &ldap.Directory{TenantID: "tenant-1", GroupSync: tt.sync, GroupMapping: mapping}
+			user := User{ID: "user-1", TenantID: "tenant-1"}
+			c, _ := gin.CreateTestContext(httptest.NewRecorder())
+			c.Request = httptest.NewRequest("POST", "/auth/login", nil)
+
+			if !h.syncDirectoryGroups(c, d, user, &ldap.Account{Groups: []string{"staff"}}) {
+				t.Fatal("Expected the sync to succeed")
+			}
+			if !reflect.DeepEqual(*events, tt.events) {
+				t.Errorf("Expected audit events %v, got %v", tt.events, *events)
+			}
+			if queued := script.Ran("INSERT INTO provisioning_jobs"); queued != tt.sync {
+				t.Errorf("Expected the changed groups to be provisioned only with group sync, queued: %v", queued)
+			}
+		})
+	}
+}
+
+func TestDirectoryHandler_GroupMappingGrantable(t *testing.T) {
+	body := `{"url": "ldaps://ldap.corp.example", "base_dn": "dc=corp,dc=example", "group_sync": true,
+		"group_mapping": {"cn=admins,ou=groups,dc=corp,dc=example": "` + adminsGroup + `"}}`
+
+	tests := []struct {
+		name        string
+		permissions []string
+		status      int
+	}{
+		{"caller lacking what the mapped group grants", []string{"ldap.write"}, http.StatusForbidden},
+		{"caller holding what the mapped group grants", []string{"ldap.write", "user.admin"}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, script := dbtest.Open(t)
+			scriptInTenant(script, tenantGroups, adminsGroup)
+			scriptGrants(script, adminRole, "user.admin")
+			script.On("SELECT COUNT(*) FROM groups WHERE tenant_id = $1 AND id = ANY($2) AND rule IS NULL", nil, []driver.Value{int64(1)})
+			script.On("INSERT INTO ldap_directories", nil, []driver.Value{time.Now(), time.Now()})
+			script.On("INSERT INTO audit_logs", nil)
+
+			h := &DirectoryHandler{db: db, store: ldap.NewStore(db, "secret")}
+			w := serve(h.UpdateDirectory, "PUT", "/tenant/ldap", "/tenant/ldap", body, tt.permissions...)
+			expectStatus(t, tt.name, w, tt.status)
+			if saved := script.Ran("INSERT INTO ldap_directories"); saved != (tt.status == http.StatusOK) {
+				t.Errorf("%s: expected the directory to be saved only when allowed, saved: %v", tt.name, saved)
+			}
+		})
+	}
+}
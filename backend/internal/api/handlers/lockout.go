@@ -0,0 +1,160 @@
+package handlers
+
+import (
+	"database/sql"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ForIAM/ForIAM/backend/internal/lockout"
+	"github.com/gin-gonic/gin"
+)
+
+type UnlockIPRequest struct {
+	IPAddress string `json:"ip_address" binding:"required"`
+}
+
+type LockoutStatusResponse struct {
+	Locked            bool              `json:"locked"`
+	Failures          int               `json:"failures"`
+	RetryAfterSeconds int               `json:"retry_after_seconds"`
+	RecentAttempts    []lockout.Attempt `json:"recent_attempts"`
+}
+
+// normalizeEmail returns the form of a login email that both the user lookup
+// and the lockout counters match on.
+func normalizeEmail(email string) string {
+	return strings.ToLower(strings.TrimSpace(email))
+}
+
+// checkLoginAllowed refuses the request with 429 while the account or the
+// client IP is throttled or locked out. user may be empty when the email did
+// not match anyone.
+func (h *AuthHandler) checkLoginAllowed(c *gin.Context, user User, email string) bool {
+	status, err := h.attempts.Check(email, c.ClientIP())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return false
+	}
+	if status.Allowed() {
+		return true
+	}
+
+	writeAuditReason(h.db, user.TenantID, user.ID, "auth.login", "", "", "failure", status.Reason, c.ClientIP(), c.GetHeader("User-Agent"))
+
+	retryAfter := int(math.Ceil(status.RetryAfter.Seconds()))
+	c.Header("Retry-After", strconv.Itoa(retryAfter))
+	message := "Too many failed login attempts, try again later"
+	if status.Locked {
+		message = "Account temporarily locked due to too many failed login attempts"
+	}
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": message, "retry_after": retryAfter})
+	return false
+}
+
+// loginFailed records a failed attempt towards throttling and audits it with
+// its reason.
+func (h *AuthHandler) loginFailed(c *gin.Context, user User, email, reason string) {
+	if err := h.attempts.RecordFailure(user.TenantID, user.ID, email, c.ClientIP(), reason); err != nil {
+		// Log error but don't change the response
+		println("Failed to record login attempt:", err.Error())
+	}
+	writeAuditReason(h.db, user.TenantID, user.ID, "auth.login", "", "", "failure", reason, c.ClientIP(), c.GetHeader("User-Agent"))
+}
+
+// loginSucceeded records a completed login, which clears the account's
+// earlier failures.
+func (h *AuthHandler) loginSucceeded(c *gin.Context, user User) {
+	if err := h.attempts.RecordSuccess(user.TenantID, user.ID, user.Email, c.ClientIP()); err != nil {
+		println("Failed to record login attempt:", err.Error())
+	}
+}
+
+// tenantUserEmail returns the email of a user in the caller's tenant.
+func (h *AuthHandler) tenantUserEmail(c *gin.Context, userID string) (string, bool) {
+	var email string
+	err := h.db.QueryRow(`
+		SELECT email FROM users WHERE id = $1 AND tenant_id = $2
+	`, userID, c.GetString("tenant_id")).Scan(&email)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return "", false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return "", false
+	}
+	return email, true
+}
+
+// GetUserLockout shows whether a user is locked out and their latest login
+// attempts.
+func (h *AuthHandler) GetUserLockout(c *gin.Context) {
+	email, ok := h.tenantUserEmail(c, c.Param("id"))
+	if !ok {
+		return
+	}
+
+	status, err := h.attempts.AccountStatus(email)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	attempts, err := h.attempts.Recent(email, 20)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, LockoutStatusResponse{
+		Locked:            status.Locked,
+		Failures:          status.Failures,
+		RetryAfterSeconds: int(math.Ceil(status.RetryAfter.Seconds())),
+		RecentAttempts:    attempts,
+	})
+}
+
+// UnlockUser clears a user's failed login attempts, lifting any lockout.
+func (h *AuthHandler) UnlockUser(c *gin.Context) {
+	targetID := c.Param("id")
+	email, ok := h.tenantUserEmail(c, targetID)
+	if !ok {
+		return
+	}
+
+	if err := h.attempts.Unlock(email); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unlock user"})
+		return
+	}
+
+	writeAudit(h.db, c.GetString("tenant_id"), c.GetString("user_id"), "user.unlock", "user", targetID, "success", c.ClientIP(), c.GetHeader("User-Agent"))
+
+	c.JSON(http.StatusOK, gin.H{"message": "User unlocked successfully"})
+}
+
+// UnlockIP clears the failed login attempts from an IP address. Only attempts
+// against the caller's tenant, or against unknown emails, are cleared.
+func (h *AuthHandler) UnlockIP(c *gin.Context) {
+	var req UnlockIPRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if net.ParseIP(req.IPAddress) == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid IP address"})
+		return
+	}
+
+	tenantID := c.GetString("tenant_id")
+	cleared, err := h.attempts.UnlockIP(tenantID, req.IPAddress)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to unlock IP address"})
+		return
+	}
+
+	writeAuditReason(h.db, tenantID, c.GetString("user_id"), "auth.ip_unlock", "", "", "success", req.IPAddress, c.ClientIP(), c.GetHeader("User-Agent"))
+
+	c.JSON(http.StatusOK, gin.H{"message": "IP address unlocked successfully", "cleared": cleared})
+}
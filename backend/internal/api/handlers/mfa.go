@@ -0,0 +1,629 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/ForIAM/ForIAM/backend/internal/lockout"
+	"github.com/ForIAM/ForIAM/backend/internal/mfa"
+	"github.com/ForIAM/ForIAM/backend/internal/token"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+	"github.com/skip2/go-qrcode"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	mfaChallengeTTL  = 5 * time.Minute
+	mfaEnrollmentTTL = 10 * time.Minute
+)
+
+var errInvalidMFAToken = errors.New("invalid mfa token")
+
+// MFAChallengeResponse is returned by Login instead of a LoginResponse when
+// the password was correct but a second factor is still needed.
+type MFAChallengeResponse struct {
+	MFARequired           bool     `json:"mfa_required"`
+	MFAEnrollmentRequired bool     `json:"mfa_enrollment_required,omitempty"`
+	MFAToken              string   `json:"mfa_token"`
+	ExpiresIn             int      `json:"expires_in"`
+	Methods               []string `json:"methods,omitempty"`
+}
+
+type MFAVerifyRequest struct {
+	MFAToken string `json:"mfa_token" binding:"required"`
+	Code     string `json:"code" binding:"required"`
+}
+
+type TOTPEnrollRequest struct {
+	Name string `json:"name"`
+}
+
+type TOTPEnrollResponse struct {
+	DeviceID        string `json:"device_id"`
+	Secret          string `json:"secret"`
+	ProvisioningURI string `json:"otpauth_uri"`
+	QRCode          string `json:"qr_code"`
+}
+
+type TOTPConfirmRequest struct {
+	DeviceID string `json:"device_id" binding:"required"`
+	Code     string `json:"code" binding:"required"`
+}
+
+type TOTPConfirmResponse struct {
+	Message     string         `json:"message"`
+	BackupCodes []string       `json:"backup_codes,omitempty"`
+	Session     *LoginResponse `json:"session,omitempty"`
+}
+
+type MFADevice struct {
+	ID          string     `json:"id"`
+	Type        string     `json:"type"`
+	Name        *string    `json:"name"`
+	ConfirmedAt *time.Time `json:"confirmed_at"`
+	CreatedAt   time.Time  `json:"created_at"`
+}
+
+// mfaChallengeFor returns the challenge a password login has to answer, or
+// nil when the user can be signed in straight away.
+func (h *AuthHandler) mfaChallengeFor(user User) (*MFAChallengeResponse, error) {
+	var tenantRequired, hasTOTP, hasWebAuthn bool
+	err := h.db.QueryRow(`
+		SELECT COALESCE(t.mfa_required, false),
+		       EXISTS(SELECT 1 FROM mfa_devices WHERE user_id = $1 AND confirmed_at IS NOT NULL),
+		       EXISTS(SELECT 1 FROM webauthn_credentials WHERE user_id = $1)
+		FROM tenants t
+		WHERE t.id = $2
+	`, user.ID, user.TenantID).Scan(&tenantRequired, &hasTOTP, &hasWebAuthn)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case hasTOTP || hasWebAuthn:
+		signed, err := h.signMFAToken(user, token.TypeMFAChallenge, mfaChallengeTTL)
+		if err != nil {
+			return nil, err
+		}
+		var methods []string
+		if hasTOTP {
+			methods = append(methods, "totp", "backup_code")
+		}
+		if hasWebAuthn {
+			methods = append(methods, "webauthn")
+		}
+		return &MFAChallengeResponse{
+			MFARequired: true,
+			MFAToken:    signed,
+			ExpiresIn:   int(mfaChallengeTTL.Seconds()),
+			Methods:     methods,
+		}, nil
+	case tenantRequired:
+		signed, err := h.signMFAToken(user, token.TypeMFAEnrollment, mfaEnrollmentTTL)
+		if err != nil {
+			return nil, err
+		}
+		return &MFAChallengeResponse{
+			MFARequired:           true,
+			MFAEnrollmentRequired: true,
+			MFAToken:              signed,
+			ExpiresIn:             int(mfaEnrollmentTTL.Seconds()),
+		}, nil
+	}
+	return nil, nil
+}
+
+func (h *AuthHandler) signMFAToken(user User, tokenType string, ttl time.Duration) (string, error) {
+	now := time.Now()
+	return h.keys.Sign(jwt.MapClaims{
+		"iss":       h.cfg.TokenIssuer,
+		"aud":       h.cfg.TokenAudience,
+		"user_id":   user.ID,
+		"tenant_id": user.TenantID,
+		"email":     user.Email,
+		"jti":       uuid.NewString(),
+		"typ":       tokenType,
+		"exp":       now.Add(ttl).Unix(),
+		"iat":       now.Unix(),
+	})
+}
+
+// parseMFAChallenge validates a challenge token presented in a request body
+// and returns its subject and jti.
+func (h *AuthHandler) parseMFAChallenge(c *gin.Context, raw string) (string, string, time.Time, error) {
+	claims, err := h.validator.Validate(c.Request.Context(), raw, token.TypeMFAChallenge)
+	if err != nil {
+		if token.ErrorCode(err) != "" {
+			return "", "", time.Time{}, errInvalidMFAToken
+		}
+		return "", "", time.Time{}, err
+	}
+
+	return claims.UserID, claims.JTI, claims.ExpiresAt, nil
+}
+
+// VerifyMFA completes a login that returned an MFA challenge. The code may be
+// a TOTP code from any confirmed device or one of the user's backup codes.
+func (h *AuthHandler) VerifyMFA(c *gin.Context) {
+	var req MFAVerifyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID, jti, expiresAt, err := h.parseMFAChallenge(c, req.MFAToken)
+	if err == errInvalidMFAToken {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired MFA token"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify MFA token"})
+		return
+	}
+
+	var user User
+	err = h.db.QueryRow(`
+		SELECT id, tenant_id, email, is_active, created_at
+		FROM users
+		WHERE id = $1 AND is_active = true
+	`, userID).Scan(&user.ID, &user.TenantID, &user.Email, &user.IsActive, &user.CreatedAt)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired MFA token"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	// Wrong codes count towards the same limits as wrong passwords
+	if !h.checkLoginAllowed(c, user, user.Email) {
+		return
+	}
+
+	method, err := h.checkSecondFactor(user.ID, req.Code)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify code"})
+		return
+	}
+	if method == "" {
+		if err := h.attempts.RecordFailure(user.TenantID, user.ID, user.Email, c.ClientIP(), lockout.ReasonInvalidMFACode); err != nil {
+			println("Failed to record login attempt:", err.Error())
+		}
+		writeAuditReason(h.db, user.TenantID, user.ID, "auth.mfa_verify", "", "", "failure", lockout.ReasonInvalidMFACode, c.ClientIP(), c.GetHeader("User-Agent"))
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid MFA code"})
+		return
+	}
+
+	// A challenge can only be answered once
+	if err := h.revocations.Revoke(c.Request.Context(), jti, time.Until(expiresAt)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke MFA token"})
+		return
+	}
+
+	response, err := h.startSession(user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	h.loginSucceeded(c, user)
+	h.logAudit(user.TenantID, user.ID, "auth.login", method, "success", c.ClientIP(), c.GetHeader("User-Agent"))
+
+	c.JSON(http.StatusOK, response)
+}
+
+// checkSecondFactor returns "totp" or "backup_code" for the factor that
+// matched code, or an empty string when nothing matched.
+func (h *AuthHandler) checkSecondFactor(userID, code string) (string, error) {
+	ok, err := h.checkTOTP(userID, "", code)
+	if err != nil || ok {
+		return "totp", err
+	}
+
+	ok, err = h.consumeBackupCode(userID, code)
+	if err != nil || ok {
+		return "backup_code", err
+	}
+	return "", nil
+}
+
+// checkTOTP validates code against the user's confirmed devices, or against
+// deviceID only when it is set (confirmed or not). A matching time step is
+// recorded on the device so the same code cannot be replayed.
+func (h *AuthHandler) checkTOTP(userID, deviceID, code string) (bool, error) {
+	query := `
+		SELECT id, secret, secret_encrypted FROM mfa_devices
+		WHERE user_id = $1 AND type = 'totp' AND confirmed_at IS NOT NULL
+	`
+	args := []interface{}{userID}
+	if deviceID != "" {
+		query = `
+			SELECT id, secret, secret_encrypted FROM mfa_devices
+			WHERE user_id = $1 AND type = 'totp' AND id = $2
+		`
+		args = append(args, deviceID)
+	}
+
+	rows, err := h.db.Query(query, args...)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	type device struct{ id, secret string }
+	var devices []device
+	for rows.Next() {
+		var d device
+		var plaintext sql.NullString
+		var sealed []byte
+		if err := rows.Scan(&d.id, &plaintext, &sealed); err != nil {
+			return false, err
+		}
+		// Devices not sealed yet still hold their secret in plaintext
+		d.secret = plaintext.String
+		if sealed != nil {
+			secret, err := h.totpSecrets.Open(sealed)
+			if err != nil {
+				return false, err
+			}
+			d.secret = secret
+		}
+		devices = append(devices, d)
+	}
+	if err := rows.Err(); err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+	for _, d := range devices {
+		step, ok := mfa.Validate(d.secret, code, now)
+		if !ok {
+			continue
+		}
+
+		result, err := h.db.Exec(`
+			UPDATE mfa_devices SET last_used_step = $1
+			WHERE id = $2 AND (last_used_step IS NULL OR last_used_step < $1)
+		`, step, d.id)
+		if err != nil {
+			return false, err
+		}
+		rowsAffected, _ := result.RowsAffected()
+		return rowsAffected == 1, nil
+	}
+	return false, nil
+}
+
+func (h *AuthHandler) consumeBackupCode(userID, code string) (bool, error) {
+	code = mfa.NormalizeBackupCode(code)
+
+	rows, err := h.db.Query(`
+		SELECT id, code_hash FROM mfa_backup_codes
+		WHERE user_id = $1 AND used_at IS NULL
+	`, userID)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+
+	var matchedID string
+	for rows.Next() {
+		var id, hash string
+		if err := rows.Scan(&id, &hash); err != nil {
+			return false, err
+		}
+		if bcrypt.CompareHashAndPassword([]byte(hash), []byte(code)) == nil {
+			matchedID = id
+			break
+		}
+	}
+	rows.Close()
+	if matchedID == "" {
+		return false, nil
+	}
+
+	result, err := h.db.Exec(`
+		UPDATE mfa_backup_codes SET used_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND used_at IS NULL
+	`, matchedID)
+	if err != nil {
+		return false, err
+	}
+	rowsAffected, _ := result.RowsAffected()
+	return rowsAffected == 1, nil
+}
+
+// replaceBackupCodes invalidates any existing backup codes of the user and
+// returns a fresh set. Only bcrypt hashes of the codes are stored.
+func (h *AuthHandler) replaceBackupCodes(userID string) ([]string, error) {
+	codes, err := mfa.GenerateBackupCodes(mfa.BackupCodeCount)
+	if err != nil {
+		return nil, err
+	}
+
+	tx, err := h.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM mfa_backup_codes WHERE user_id = $1`, userID); err != nil {
+		return nil, err
+	}
+	for _, code := range codes {
+		hash, err := bcrypt.GenerateFromPassword([]byte(code), bcrypt.DefaultCost)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := tx.Exec(`
+			INSERT INTO mfa_backup_codes (user_id, code_hash) VALUES ($1, $2)
+		`, userID, string(hash)); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// EnrollTOTP creates an unconfirmed TOTP device and returns its secret as an
+// otpauth URI and a QR code. The device is unusable until confirmed.
+func (h *AuthHandler) EnrollTOTP(c *gin.Context) {
+	var req TOTPEnrollRequest
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	userID := c.GetString("user_id")
+	tenantID := c.GetString("tenant_id")
+
+	secret, err := mfa.GenerateSecret()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate secret"})
+		return
+	}
+
+	// Abandoned enrollments are replaced rather than accumulated
+	if _, err := h.db.Exec(`
+		DELETE FROM mfa_devices WHERE user_id = $1 AND confirmed_at IS NULL
+	`, userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	sealed, err := h.totpSecrets.Seal(secret)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate secret"})
+		return
+	}
+
+	var deviceID string
+	err = h.db.QueryRow(`
+		INSERT INTO mfa_devices (tenant_id, user_id, type, name, secret_encrypted)
+		VALUES ($1, $2, 'totp', NULLIF($3, ''), $4)
+		RETURNING id
+	`, tenantID, userID, req.Name, sealed).Scan(&deviceID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create MFA device"})
+		return
+	}
+
+	uri := mfa.ProvisioningURI(h.cfg.MFAIssuer, c.GetString("email"), secret)
+	png, err := qrcode.Encode(uri, qrcode.Medium, 256)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate QR code"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, TOTPEnrollResponse{
+		DeviceID:        deviceID,
+		Secret:          secret,
+		ProvisioningURI: uri,
+		QRCode:          "data:image/png;base64," + base64.StdEncoding.EncodeToString(png),
+	})
+}
+
+// ConfirmTOTP verifies the first code of a newly enrolled device. Confirming
+// the user's first device also issues backup codes and, when the caller used
+// an enrollment token, finishes the pending login.
+func (h *AuthHandler) ConfirmTOTP(c *gin.Context) {
+	var req TOTPConfirmRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID := c.GetString("user_id")
+	tenantID := c.GetString("tenant_id")
+
+	var confirmedCount int
+	if err := h.db.QueryRow(`
+		SELECT COUNT(*) FROM mfa_devices WHERE user_id = $1 AND confirmed_at IS NOT NULL
+	`, userID).Scan(&confirmedCount); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	// An enrollment token only allows setting up the first device
+	enrolling := c.GetString("token_type") == token.TypeMFAEnrollment
+	if enrolling && confirmedCount > 0 {
+		c.JSON(http.StatusForbidden, gin.H{"error": "MFA is already set up, sign in with your code"})
+		return
+	}
+
+	ok, err := h.checkTOTP(userID, req.DeviceID, req.Code)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify code"})
+		return
+	}
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid MFA code"})
+		return
+	}
+
+	if _, err := h.db.Exec(`
+		UPDATE mfa_devices SET confirmed_at = CURRENT_TIMESTAMP
+		WHERE id = $1 AND user_id = $2 AND confirmed_at IS NULL
+	`, req.DeviceID, userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to confirm MFA device"})
+		return
+	}
+
+	response := TOTPConfirmResponse{Message: "MFA device confirmed successfully"}
+	if confirmedCount == 0 {
+		codes, err := h.replaceBackupCodes(userID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate backup codes"})
+			return
+		}
+		response.BackupCodes = codes
+	}
+
+	writeAudit(h.db, tenantID, userID, "mfa.enroll", "mfa_device", req.DeviceID, "success", c.ClientIP(), c.GetHeader("User-Agent"))
+
+	if enrolling {
+		if err := h.revocations.Revoke(c.Request.Context(), c.GetString("jti"), time.Until(c.GetTime("token_expires_at"))); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke MFA token"})
+			return
+		}
+
+		var user User
+		err := h.db.QueryRow(`
+			SELECT id, tenant_id, email, is_active, created_at
+			FROM users
+			WHERE id = $1 AND is_active = true
+		`, userID).Scan(&user.ID, &user.TenantID, &user.Email, &user.IsActive, &user.CreatedAt)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+
+		response.Session, err = h.startSession(user)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+			return
+		}
+		h.logAudit(user.TenantID, user.ID, "auth.login", "totp", "success", c.ClientIP(), c.GetHeader("User-Agent"))
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+func (h *AuthHandler) GetMFADevices(c *gin.Context) {
+	userID := c.GetString("user_id")
+
+	rows, err := h.db.Query(`
+		SELECT id, type, name, confirmed_at, created_at
+		FROM mfa_devices
+		WHERE user_id = $1
+		ORDER BY created_at DESC
+	`, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	defer rows.Close()
+
+	devices := []MFADevice{}
+	for rows.Next() {
+		var device MFADevice
+		if err := rows.Scan(&device.ID, &device.Type, &device.Name, &device.ConfirmedAt, &device.CreatedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan MFA device"})
+			return
+		}
+		devices = append(devices, device)
+	}
+
+	c.JSON(http.StatusOK, devices)
+}
+
+func (h *AuthHandler) DeleteMFADevice(c *gin.Context) {
+	deviceID := c.Param("id")
+	userID := c.GetString("user_id")
+	tenantID := c.GetString("tenant_id")
+
+	// Removing the last device in a tenant that requires MFA would lock the
+	// user out at their next login
+	var tenantRequired bool
+	var remaining int
+	err := h.db.QueryRow(`
+		SELECT COALESCE(t.mfa_required, false),
+		       (SELECT COUNT(*) FROM mfa_devices WHERE user_id = $1 AND confirmed_at IS NOT NULL AND id <> $2) +
+		       (SELECT COUNT(*) FROM webauthn_credentials WHERE user_id = $1)
+		FROM tenants t
+		WHERE t.id = $3
+	`, userID, deviceID, tenantID).Scan(&tenantRequired, &remaining)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if tenantRequired && remaining == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Cannot remove the last MFA device while MFA is required"})
+		return
+	}
+
+	result, err := h.db.Exec(`
+		DELETE FROM mfa_devices WHERE id = $1 AND user_id = $2
+	`, deviceID, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete MFA device"})
+		return
+	}
+
+	rowsAffected, _ := result.RowsAffected()
+	if rowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "MFA device not found"})
+		return
+	}
+
+	if remaining == 0 {
+		if _, err := h.db.Exec(`DELETE FROM mfa_backup_codes WHERE user_id = $1`, userID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete backup codes"})
+			return
+		}
+	}
+
+	writeAudit(h.db, tenantID, userID, "mfa.remove", "mfa_device", deviceID, "success", c.ClientIP(), c.GetHeader("User-Agent"))
+
+	c.JSON(http.StatusOK, gin.H{"message": "MFA device deleted successfully"})
+}
+
+// RegenerateBackupCodes replaces the user's backup codes. The new codes are
+// only ever shown in this response.
+func (h *AuthHandler) RegenerateBackupCodes(c *gin.Context) {
+	userID := c.GetString("user_id")
+	tenantID := c.GetString("tenant_id")
+
+	var hasDevice bool
+	if err := h.db.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM mfa_devices WHERE user_id = $1 AND confirmed_at IS NOT NULL)
+	`, userID).Scan(&hasDevice); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if !hasDevice {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Enroll an MFA device first"})
+		return
+	}
+
+	codes, err := h.replaceBackupCodes(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate backup codes"})
+		return
+	}
+
+	h.logAudit(tenantID, userID, "mfa.backup_codes_regenerate", "", "success", c.ClientIP(), c.GetHeader("User-Agent"))
+
+	c.JSON(http.StatusOK, gin.H{"backup_codes": codes})
+}
@@ -0,0 +1,587 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ForIAM/ForIAM/backend/internal/api/middleware"
+	"github.com/ForIAM/ForIAM/backend/internal/config"
+	"github.com/ForIAM/ForIAM/backend/internal/oauth"
+	"github.com/ForIAM/ForIAM/backend/internal/serviceaccount"
+	"github.com/ForIAM/ForIAM/backend/internal/signing"
+	"github.com/ForIAM/ForIAM/backend/internal/token"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// OAuthHandler is the OpenID Connect provider. Users sign in through the
+// regular login flow (password, MFA, passkeys) in the frontend, which then
+// approves the authorization request on their behalf.
+type OAuthHandler struct {
+	db          *sql.DB
+	cfg         *config.Config
+	revocations token.RevocationStore
+	keys        *signing.Manager
+	// validator checks tokens issued to OAuth clients, whose audience is
+	// the issuer; apiValidator checks those of the management API
+	validator    *token.Validator
+	apiValidator *token.Validator
+	clients      *oauth.ClientStore
+	codes        *oauth.CodeStore
+	devices      *oauth.DeviceStore
+	apiTokens    *token.APITokenStore
+	// resolver and accounts check that callers may hand out credentials
+	// of the service accounts clients are bound to
+	resolver middleware.PermissionResolver
+	accounts *serviceaccount.Store
+}
+
+func NewOAuthHandler(db *sql.DB, cfg *config.Config, revocations token.RevocationStore, keys *signing.Manager, resolver middleware.PermissionResolver) *OAuthHandler {
+	newValidator := func(audience string) *token.Validator {
+		return token.NewValidator(keys.Keyfunc, revocations, token.ValidatorOptions{
+			Algorithms: cfg.TokenAlgorithms,
+			Issuer:     cfg.TokenIssuer,
+			Audience:   audience,
+			Leeway:     cfg.TokenLeeway,
+		})
+	}
+
+	return &OAuthHandler{
+		db:           db,
+		cfg:          cfg,
+		revocations:  revocations,
+		keys:         keys,
+		validator:    newValidator(cfg.TokenIssuer),
+		apiValidator: newValidator(cfg.TokenAudience),
+		clients:      oauth.NewClientStore(db),
+		codes:        oauth.NewCodeStore(db),
+		devices:      oauth.NewDeviceStore(db),
+		apiTokens:    token.NewAPITokenStore(db),
+		resolver:     resolver,
+		accounts:     serviceaccount.NewStore(db),
+	}
+}
+
+// OAuthError is the error body of RFC 6749 section 5.2.
+type OAuthError struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+// AuthorizeRequest is an authorization request, read from the query string
+// by GET /oauth2/authorize and from the body when the frontend approves it.
+type AuthorizeRequest struct {
+	ResponseType        string `form:"response_type" json:"response_type"`
+	ClientID            string `form:"client_id" json:"client_id"`
+	RedirectURI         string `form:"redirect_uri" json:"redirect_uri"`
+	Scope               string `form:"scope" json:"scope"`
+	State               string `form:"state" json:"state"`
+	Nonce               string `form:"nonce" json:"nonce"`
+	CodeChallenge       string `form:"code_challenge" json:"code_challenge"`
+	CodeChallengeMethod string `form:"code_challenge_method" json:"code_challenge_method"`
+}
+
+type AuthorizeResponse struct {
+	RedirectURI string `json:"redirect_uri"`
+}
+
+type TokenResponse struct {
+	AccessToken     string `json:"access_token"`
+	IssuedTokenType string `json:"issued_token_type,omitempty"`
+	TokenType       string `json:"token_type"`
+	ExpiresIn       int    `json:"expires_in"`
+	IDToken         string `json:"id_token,omitempty"`
+	Scope           string `json:"scope,omitempty"`
+}
+
+type UserInfo struct {
+	Subject  string `json:"sub"`
+	TenantID string `json:"tenant_id"`
+	Email    string `json:"email,omitempty"`
+}
+
+// authorizeError is a failed authorization request. Once the client and
+// redirect URI are known to be good, errors go back to the client through
+// the redirect; before that they must not, or the endpoint becomes an open
+// redirector.
+type authorizeError struct {
+	OAuthError
+	redirect bool
+}
+
+// Discovery serves the OpenID Provider Metadata.
+func (h *OAuthHandler) Discovery(c *gin.Context) {
+	issuer := h.cfg.TokenIssuer
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, gin.H{
+		"issuer":                                issuer,
+		"authorization_endpoint":                issuer + "/oauth2/authorize",
+		"token_endpoint":                        issuer + "/oauth2/token",
+		"userinfo_endpoint":                     issuer + "/oauth2/userinfo",
+		"introspection_endpoint":                issuer + "/oauth2/introspect",
+		"revocation_endpoint":                   issuer + "/oauth2/revoke",
+		"device_authorization_endpoint":         issuer + "/oauth2/device_authorization",
+		"jwks_uri":                              issuer + "/.well-known/jwks.json",
+		"response_types_supported":              []string{"code"},
+		"grant_types_supported":                 oauth.SupportedGrants,
+		"subject_types_supported":               []string{"public"},
+		"id_token_signing_alg_values_supported": []string{h.cfg.SigningAlgorithm},
+		"scopes_supported":                      oauth.SupportedScopes,
+		"token_endpoint_auth_methods_supported": []string{"client_secret_basic", "client_secret_post", "none"},
+		"code_challenge_methods_supported":      []string{oauth.CodeChallengeS256},
+		"claims_supported":                      []string{"sub", "iss", "aud", "exp", "iat", "nonce", "email", "tenant_id", "act"},
+	})
+}
+
+// Authorize checks an authorization request and sends the browser to the
+// frontend, which signs the user in and approves the request.
+func (h *OAuthHandler) Authorize(c *gin.Context) {
+	var req AuthorizeRequest
+	if err := c.ShouldBindQuery(&req); err != nil {
+		c.JSON(http.StatusBadRequest, OAuthError{Error: oauth.ErrorInvalidRequest})
+		return
+	}
+
+	if _, _, authErr := h.checkAuthorizeRequest(req); authErr != nil {
+		if !authErr.redirect {
+			c.JSON(http.StatusBadRequest, authErr.OAuthError)
+			return
+		}
+		c.Redirect(http.StatusFound, authorizeRedirect(req.RedirectURI, req.State, authErr.OAuthError, ""))
+		return
+	}
+
+	c.Redirect(http.StatusFound, h.cfg.OIDCLoginURL+"?"+c.Request.URL.RawQuery)
+}
+
+// ApproveAuthorization issues an authorization code for the signed-in user
+// and returns the client redirect URI carrying it.
+func (h *OAuthHandler) ApproveAuthorization(c *gin.Context) {
+	var req AuthorizeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, OAuthError{Error: oauth.ErrorInvalidRequest, ErrorDescription: err.Error()})
+		return
+	}
+
+	tenantID := c.GetString("tenant_id")
+	userID := c.GetString("user_id")
+
+	client, scopes, authErr := h.checkAuthorizeRequest(req)
+	if authErr == nil && client.TenantID != tenantID {
+		authErr = &authorizeError{
+			OAuthError: OAuthError{Error: oauth.ErrorAccessDenied, ErrorDescription: "The client belongs to another tenant"},
+			redirect:   true,
+		}
+	}
+	if authErr != nil {
+		if !authErr.redirect {
+			c.JSON(http.StatusBadRequest, authErr.OAuthError)
+			return
+		}
+		c.JSON(http.StatusOK, AuthorizeResponse{RedirectURI: authorizeRedirect(req.RedirectURI, req.State, authErr.OAuthError, "")})
+		return
+	}
+
+	code, err := h.codes.Issue(oauth.AuthorizationCode{
+		TenantID:      tenantID,
+		UserID:        userID,
+		ClientID:      client.ClientID,
+		RedirectURI:   req.RedirectURI,
+		Scope:         scopes,
+		Nonce:         req.Nonce,
+		CodeChallenge: req.CodeChallenge,
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, OAuthError{Error: oauth.ErrorServerError})
+		return
+	}
+
+	writeAudit(h.db, tenantID, userID, "oauth.authorize", "oauth_client", client.ID, "success", c.ClientIP(), c.GetHeader("User-Agent"))
+
+	c.JSON(http.StatusOK, AuthorizeResponse{RedirectURI: authorizeRedirect(req.RedirectURI, req.State, OAuthError{}, code)})
+}
+
+// checkAuthorizeRequest validates req against the registered client and
+// returns the client and the requested scopes.
+func (h *OAuthHandler) checkAuthorizeRequest(req AuthorizeRequest) (*oauth.Client, []string, *authorizeError) {
+	fail := func(code, description string, redirect bool) (*oauth.Client, []string, *authorizeError) {
+		return nil, nil, &authorizeError{OAuthError: OAuthError{Error: code, ErrorDescription: description}, redirect: redirect}
+	}
+
+	client, err := h.clients.Get(req.ClientID)
+	if err == oauth.ErrClientNotFound {
+		return fail(oauth.ErrorInvalidRequest, "Unknown client", false)
+	}
+	if err != nil {
+		return fail(oauth.ErrorServerError, "", false)
+	}
+	if !client.AllowsRedirect(req.RedirectURI) {
+		return fail(oauth.ErrorInvalidRequest, "The redirect_uri is not registered for this client", false)
+	}
+
+	if req.ResponseType != "code" {
+		return fail(oauth.ErrorUnsupportedResponseType, "Only the code response type is supported", true)
+	}
+	if !client.AllowsGrant(oauth.GrantAuthorizationCode) {
+		return fail(oauth.ErrorUnauthorizedClient, "The client may not use the authorization code grant", true)
+	}
+	scopes := oauth.ParseScope(req.Scope)
+	if !oauth.HasScope(scopes, oauth.ScopeOpenID) || !client.AllowsScopes(scopes) {
+		return fail(oauth.ErrorInvalidScope, "The openid scope is required and every scope must be registered for the client", true)
+	}
+	if req.CodeChallengeMethod != oauth.CodeChallengeS256 || !oauth.ValidCodeVerifier(req.CodeChallenge) {
+		return fail(oauth.ErrorInvalidRequest, "PKCE with the S256 method is required", true)
+	}
+
+	return client, scopes, nil
+}
+
+// authorizeRedirect adds either the code or the error, and the state, to the
+// client's redirect URI.
+func authorizeRedirect(redirectURI, state string, authErr OAuthError, code string) string {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		return redirectURI
+	}
+
+	query := u.Query()
+	if code != "" {
+		query.Set("code", code)
+	} else {
+		query.Set("error", authErr.Error)
+		if authErr.ErrorDescription != "" {
+			query.Set("error_description", authErr.ErrorDescription)
+		}
+	}
+	if state != "" {
+		query.Set("state", state)
+	}
+	u.RawQuery = query.Encode()
+	return u.String()
+}
+
+// Token is the token endpoint. Clients authenticate with HTTP Basic or with
+// client_id and client_secret in the form; public clients only send their
+// client_id and prove possession of the PKCE verifier.
+func (h *OAuthHandler) Token(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	c.Header("Pragma", "no-cache")
+
+	client, ok := h.authenticateClient(c)
+	if !ok {
+		return
+	}
+
+	grantType := c.PostForm("grant_type")
+	switch grantType {
+	case oauth.GrantAuthorizationCode, oauth.GrantClientCredentials, oauth.GrantDeviceCode, oauth.GrantTokenExchange:
+		if !client.AllowsGrant(grantType) {
+			c.JSON(http.StatusBadRequest, OAuthError{Error: oauth.ErrorUnauthorizedClient, ErrorDescription: "The client may not use this grant type"})
+			return
+		}
+	}
+
+	switch grantType {
+	case oauth.GrantAuthorizationCode:
+		h.exchangeAuthorizationCode(c, client)
+	case oauth.GrantClientCredentials:
+		h.clientCredentials(c, client)
+	case oauth.GrantDeviceCode:
+		h.exchangeDeviceCode(c, client)
+	case oauth.GrantTokenExchange:
+		h.exchangeToken(c, client)
+	case "":
+		c.JSON(http.StatusBadRequest, OAuthError{Error: oauth.ErrorInvalidRequest, ErrorDescription: "grant_type is required"})
+	default:
+		c.JSON(http.StatusBadRequest, OAuthError{Error: oauth.ErrorUnsupportedGrantType})
+	}
+}
+
+// authenticateClient identifies the calling client, answering the request
+// itself when that fails.
+func (h *OAuthHandler) authenticateClient(c *gin.Context) (*oauth.Client, bool) {
+	clientID, secret, basic := c.Request.BasicAuth()
+	if basic {
+		// RFC 6749 section 2.3.1: both parts are form-urlencoded
+		var errID, errSecret error
+		clientID, errID = url.QueryUnescape(clientID)
+		secret, errSecret = url.QueryUnescape(secret)
+		if errID != nil || errSecret != nil {
+			h.invalidClient(c, basic)
+			return nil, false
+		}
+	} else {
+		clientID = c.PostForm("client_id")
+		secret = c.PostForm("client_secret")
+	}
+
+	if clientID == "" {
+		h.invalidClient(c, basic)
+		return nil, false
+	}
+
+	client, err := h.clients.Get(clientID)
+	if err == oauth.ErrClientNotFound {
+		h.invalidClient(c, basic)
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, OAuthError{Error: oauth.ErrorServerError})
+		return nil, false
+	}
+
+	if client.Public {
+		if secret != "" {
+			h.invalidClient(c, basic)
+			return nil, false
+		}
+	} else if !client.VerifySecret(secret) {
+		writeAudit(h.db, client.TenantID, "", "oauth.client_auth", "oauth_client", client.ID, "failure", c.ClientIP(), c.GetHeader("User-Agent"))
+		h.invalidClient(c, basic)
+		return nil, false
+	}
+
+	return client, true
+}
+
+func (h *OAuthHandler) invalidClient(c *gin.Context, basic bool) {
+	if basic {
+		c.Header("WWW-Authenticate", `Basic realm="oauth2"`)
+	}
+	c.JSON(http.StatusUnauthorized, OAuthError{Error: oauth.ErrorInvalidClient, ErrorDescription: "Client authentication failed"})
+}
+
+func (h *OAuthHandler) exchangeAuthorizationCode(c *gin.Context, client *oauth.Client) {
+	rawCode := c.PostForm("code")
+	redirectURI := c.PostForm("redirect_uri")
+	verifier := c.PostForm("code_verifier")
+	if rawCode == "" || redirectURI == "" || verifier == "" {
+		c.JSON(http.StatusBadRequest, OAuthError{Error: oauth.ErrorInvalidRequest, ErrorDescription: "code, redirect_uri and code_verifier are required"})
+		return
+	}
+
+	code, err := h.codes.Redeem(rawCode)
+	if err == oauth.ErrCodeInvalid {
+		c.JSON(http.StatusBadRequest, OAuthError{Error: oauth.ErrorInvalidGrant})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, OAuthError{Error: oauth.ErrorServerError})
+		return
+	}
+
+	if code.ClientID != client.ClientID || code.RedirectURI != redirectURI ||
+		!oauth.VerifyCodeChallenge(code.CodeChallenge, verifier) {
+		writeAudit(h.db, code.TenantID, code.UserID, "oauth.token", "oauth_client", client.ID, "failure", c.ClientIP(), c.GetHeader("User-Agent"))
+		c.JSON(http.StatusBadRequest, OAuthError{Error: oauth.ErrorInvalidGrant})
+		return
+	}
+
+	user, err := h.activeUser(code.TenantID, code.UserID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusBadRequest, OAuthError{Error: oauth.ErrorInvalidGrant})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, OAuthError{Error: oauth.ErrorServerError})
+		return
+	}
+
+	response, err := h.issueTokens(user, client, code.Scope, code.Nonce)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, OAuthError{Error: oauth.ErrorServerError})
+		return
+	}
+
+	writeAudit(h.db, user.TenantID, user.ID, "oauth.token", "oauth_client", client.ID, "success", c.ClientIP(), c.GetHeader("User-Agent"))
+
+	c.JSON(http.StatusOK, response)
+}
+
+// activeUser loads the user a grant was issued for, who may have been
+// deactivated since.
+func (h *OAuthHandler) activeUser(tenantID, userID string) (User, error) {
+	var user User
+	err := h.db.QueryRow(`
+		SELECT id, tenant_id, email, is_active, created_at
+		FROM users
+		WHERE id = $1 AND tenant_id = $2 AND is_active = true
+	`, userID, tenantID).Scan(&user.ID, &user.TenantID, &user.Email, &user.IsActive, &user.CreatedAt)
+	return user, err
+}
+
+// clientCredentials issues an access token to a confidential client acting
+// on its own behalf. Without a scope parameter every registered scope is
+// granted. Clients bound to a service account get a management API token of
+// that account instead, with the permissions of its roles and groups.
+func (h *OAuthHandler) clientCredentials(c *gin.Context, client *oauth.Client) {
+	scopes := oauth.ParseScope(c.PostForm("scope"))
+	if len(scopes) == 0 {
+		scopes = client.Scopes
+	}
+	if !client.AllowsScopes(scopes) {
+		c.JSON(http.StatusBadRequest, OAuthError{Error: oauth.ErrorInvalidScope})
+		return
+	}
+
+	now := time.Now()
+	scope := strings.Join(scopes, " ")
+	claims := jwt.MapClaims{
+		"iss":       h.cfg.TokenIssuer,
+		"aud":       h.cfg.TokenIssuer,
+		"sub":       client.ClientID,
+		"client_id": client.ClientID,
+		"tenant_id": client.TenantID,
+		"scope":     scope,
+		"jti":       uuid.NewString(),
+		"typ":       token.TypeAccess,
+		"exp":       now.Add(h.cfg.AccessTokenTTL).Unix(),
+		"iat":       now.Unix(),
+	}
+
+	var actorID string
+	if client.ServiceAccountID != "" {
+		account, err := h.activeUser(client.TenantID, client.ServiceAccountID)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusBadRequest, OAuthError{Error: oauth.ErrorInvalidGrant, ErrorDescription: "service account is disabled"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, OAuthError{Error: oauth.ErrorServerError})
+			return
+		}
+		actorID = account.ID
+		claims["aud"] = h.cfg.TokenAudience
+		claims["sub"] = account.ID
+		claims["user_id"] = account.ID
+		claims["principal_type"] = serviceaccount.PrincipalServiceAccount
+	}
+
+	accessToken, err := h.keys.Sign(claims)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, OAuthError{Error: oauth.ErrorServerError})
+		return
+	}
+
+	writeAudit(h.db, client.TenantID, actorID, "oauth.token", "oauth_client", client.ID, "success", c.ClientIP(), c.GetHeader("User-Agent"))
+
+	c.JSON(http.StatusOK, TokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(h.cfg.AccessTokenTTL.Seconds()),
+		Scope:       scope,
+	})
+}
+
+// issueTokens signs the access token of an authorization, and its ID token
+// when the openid scope was granted. Access tokens of OAuth clients carry
+// the issuer as their audience, so they are accepted by the userinfo
+// endpoint but not by the management API.
+func (h *OAuthHandler) issueTokens(user User, client *oauth.Client, scopes []string, nonce string) (*TokenResponse, error) {
+	now := time.Now()
+	expiresAt := now.Add(h.cfg.AccessTokenTTL)
+	scope := strings.Join(scopes, " ")
+
+	accessToken, err := h.keys.Sign(jwt.MapClaims{
+		"iss":       h.cfg.TokenIssuer,
+		"aud":       h.cfg.TokenIssuer,
+		"sub":       user.ID,
+		"user_id":   user.ID,
+		"tenant_id": user.TenantID,
+		"email":     user.Email,
+		"client_id": client.ClientID,
+		"scope":     scope,
+		"jti":       uuid.NewString(),
+		"typ":       token.TypeAccess,
+		"exp":       expiresAt.Unix(),
+		"iat":       now.Unix(),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	response := &TokenResponse{
+		AccessToken: accessToken,
+		TokenType:   "Bearer",
+		ExpiresIn:   int(h.cfg.AccessTokenTTL.Seconds()),
+		Scope:       scope,
+	}
+	if !oauth.HasScope(scopes, oauth.ScopeOpenID) {
+		return response, nil
+	}
+
+	idClaims := jwt.MapClaims{
+		"iss":       h.cfg.TokenIssuer,
+		"aud":       client.ClientID,
+		"sub":       user.ID,
+		"tenant_id": user.TenantID,
+		"exp":       expiresAt.Unix(),
+		"iat":       now.Unix(),
+	}
+	if nonce != "" {
+		idClaims["nonce"] = nonce
+	}
+	if oauth.HasScope(scopes, oauth.ScopeEmail) {
+		idClaims["email"] = user.Email
+	}
+	response.IDToken, err = h.keys.Sign(idClaims)
+	if err != nil {
+		return nil, err
+	}
+	return response, nil
+}
+
+// UserInfo returns the claims about the user an OAuth access token was
+// issued for. Errors follow RFC 6750.
+func (h *OAuthHandler) UserInfo(c *gin.Context) {
+	raw := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+	if raw == "" || raw == c.GetHeader("Authorization") {
+		c.Header("WWW-Authenticate", `Bearer realm="oauth2"`)
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+
+	claims, err := h.validator.Validate(c.Request.Context(), raw, token.TypeAccess)
+	if err != nil {
+		if token.ErrorCode(err) == "" {
+			c.JSON(http.StatusInternalServerError, OAuthError{Error: oauth.ErrorServerError})
+			return
+		}
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		c.JSON(http.StatusUnauthorized, OAuthError{Error: "invalid_token", ErrorDescription: err.Error()})
+		return
+	}
+
+	scope, _ := claims.Raw["scope"].(string)
+	scopes := strings.Fields(scope)
+	if claims.UserID == "" || !oauth.HasScope(scopes, oauth.ScopeOpenID) {
+		c.Header("WWW-Authenticate", `Bearer error="insufficient_scope", scope="openid"`)
+		c.JSON(http.StatusForbidden, OAuthError{Error: "insufficient_scope"})
+		return
+	}
+
+	var info UserInfo
+	var email string
+	err = h.db.QueryRow(`
+		SELECT id, tenant_id, email FROM users
+		WHERE id = $1 AND tenant_id = $2 AND is_active = true
+	`, claims.UserID, claims.TenantID).Scan(&info.Subject, &info.TenantID, &email)
+	if err == sql.ErrNoRows {
+		c.Header("WWW-Authenticate", `Bearer error="invalid_token"`)
+		c.JSON(http.StatusUnauthorized, OAuthError{Error: "invalid_token"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, OAuthError{Error: oauth.ErrorServerError})
+		return
+	}
+	if oauth.HasScope(scopes, oauth.ScopeEmail) {
+		info.Email = email
+	}
+
+	c.JSON(http.StatusOK, info)
+}
@@ -0,0 +1,216 @@
+package handlers
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/ForIAM/ForIAM/backend/internal/oauth"
+	"github.com/gin-gonic/gin"
+)
+
+// ClientRequest registers or changes an OAuth client. Grant types default
+// to authorization_code and scopes to openid and email.
+type ClientRequest struct {
+	Name              string   `json:"name" binding:"required"`
+	Public            bool     `json:"public"`
+	RedirectURIs      []string `json:"redirect_uris"`
+	GrantTypes        []string `json:"grant_types"`
+	Scopes            []string `json:"scopes"`
+	ExchangeAudiences []string `json:"exchange_audiences"`
+}
+
+// ClientSecretResponse carries a client secret. It is only shown when the
+// client is created or its secret rotated.
+type ClientSecretResponse struct {
+	*oauth.Client
+	ClientSecret string `json:"client_secret,omitempty"`
+}
+
+func (req ClientRequest) apply(client *oauth.Client) {
+	client.Name = req.Name
+	client.RedirectURIs = nonNil(req.RedirectURIs)
+	client.GrantTypes = req.GrantTypes
+	if len(client.GrantTypes) == 0 {
+		client.GrantTypes = []string{oauth.GrantAuthorizationCode}
+	}
+	client.Scopes = req.Scopes
+	if len(client.Scopes) == 0 {
+		client.Scopes = []string{oauth.ScopeOpenID, oauth.ScopeEmail}
+	}
+	client.ExchangeAudiences = nonNil(req.ExchangeAudiences)
+}
+
+func nonNil(values []string) []string {
+	if values == nil {
+		return []string{}
+	}
+	return values
+}
+
+func (h *OAuthHandler) GetClients(c *gin.Context) {
+	clients, err := h.clients.List(c.GetString("tenant_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, clients)
+}
+
+func (h *OAuthHandler) CreateClient(c *gin.Context) {
+	var req ClientRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tenantID := c.GetString("tenant_id")
+	client := &oauth.Client{TenantID: tenantID, Public: req.Public}
+	req.apply(client)
+
+	secret, err := h.clients.Create(client)
+	if errors.Is(err, oauth.ErrInvalidClientMetadata) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": clientMetadataError(err)})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create client"})
+		return
+	}
+
+	writeAudit(h.db, tenantID, c.GetString("user_id"), "client.create", "oauth_client", client.ID, "success", c.ClientIP(), c.GetHeader("User-Agent"))
+
+	c.JSON(http.StatusCreated, ClientSecretResponse{Client: client, ClientSecret: secret})
+}
+
+func (h *OAuthHandler) GetClient(c *gin.Context) {
+	client, err := h.clients.GetByID(c.GetString("tenant_id"), c.Param("id"))
+	if err == oauth.ErrClientNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Client not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, client)
+}
+
+// UpdateClient replaces the name, redirect URIs, grant types and scopes of a
+// client. A client cannot be switched between public and confidential.
+func (h *OAuthHandler) UpdateClient(c *gin.Context) {
+	var req ClientRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tenantID := c.GetString("tenant_id")
+	client, err := h.clients.GetByID(tenantID, c.Param("id"))
+	if err == oauth.ErrClientNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Client not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if !h.checkBoundAccount(c, client) {
+		return
+	}
+
+	req.apply(client)
+	err = h.clients.Update(client)
+	if errors.Is(err, oauth.ErrInvalidClientMetadata) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": clientMetadataError(err)})
+		return
+	}
+	if err == oauth.ErrClientNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Client not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update client"})
+		return
+	}
+
+	writeAudit(h.db, tenantID, c.GetString("user_id"), "client.update", "oauth_client", client.ID, "success", c.ClientIP(), c.GetHeader("User-Agent"))
+
+	c.JSON(http.StatusOK, client)
+}
+
+func (h *OAuthHandler) DeleteClient(c *gin.Context) {
+	tenantID := c.GetString("tenant_id")
+	clientID := c.Param("id")
+
+	err := h.clients.Delete(tenantID, clientID)
+	if err == oauth.ErrClientNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Client not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete client"})
+		return
+	}
+
+	writeAudit(h.db, tenantID, c.GetString("user_id"), "client.delete", "oauth_client", clientID, "success", c.ClientIP(), c.GetHeader("User-Agent"))
+
+	c.JSON(http.StatusOK, gin.H{"message": "Client deleted successfully"})
+}
+
+// RotateClientSecret issues a new secret for a confidential client. The old
+// secret stops working straight away.
+func (h *OAuthHandler) RotateClientSecret(c *gin.Context) {
+	tenantID := c.GetString("tenant_id")
+
+	client, err := h.clients.GetByID(tenantID, c.Param("id"))
+	if err == oauth.ErrClientNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Client not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if client.Public {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Public clients have no secret"})
+		return
+	}
+	if !h.checkBoundAccount(c, client) {
+		return
+	}
+
+	secret, err := h.clients.RotateSecret(tenantID, client.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rotate client secret"})
+		return
+	}
+
+	writeAudit(h.db, tenantID, c.GetString("user_id"), "client.secret_rotate", "oauth_client", client.ID, "success", c.ClientIP(), c.GetHeader("User-Agent"))
+
+	c.JSON(http.StatusOK, ClientSecretResponse{Client: client, ClientSecret: secret})
+}
+
+// checkBoundAccount makes sure the caller holds every permission of the
+// service account client is bound to, if any, before its secret or scopes
+// change, answering the request when they do not.
+func (h *OAuthHandler) checkBoundAccount(c *gin.Context, client *oauth.Client) bool {
+	if client.ServiceAccountID == "" {
+		return true
+	}
+	account, err := h.accounts.Get(client.TenantID, client.ServiceAccountID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return false
+	}
+	return checkAccountAssignable(c, h.db, h.resolver, account)
+}
+
+// clientMetadataError turns a validation error into a message for the API.
+func clientMetadataError(err error) string {
+	message := strings.TrimPrefix(err.Error(), oauth.ErrInvalidClientMetadata.Error()+": ")
+	return "Invalid client: " + message
+}
@@ -0,0 +1,205 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ForIAM/ForIAM/backend/internal/oauth"
+	"github.com/gin-gonic/gin"
+)
+
+// DeviceAuthorizationResponse is the answer of RFC 8628 section 3.2.
+type DeviceAuthorizationResponse struct {
+	DeviceCode              string `json:"device_code"`
+	UserCode                string `json:"user_code"`
+	VerificationURI         string `json:"verification_uri"`
+	VerificationURIComplete string `json:"verification_uri_complete"`
+	ExpiresIn               int    `json:"expires_in"`
+	Interval                int    `json:"interval"`
+}
+
+// DeviceVerification describes a pending device authorization to the user
+// asked to approve it.
+type DeviceVerification struct {
+	UserCode   string    `json:"user_code"`
+	ClientName string    `json:"client_name"`
+	Scope      string    `json:"scope"`
+	ExpiresAt  time.Time `json:"expires_at"`
+}
+
+type DeviceDecisionRequest struct {
+	UserCode string `json:"user_code" binding:"required"`
+	Approve  bool   `json:"approve"`
+}
+
+// DeviceAuthorization starts the device authorization grant for a client,
+// typically a CLI, that cannot open a browser itself.
+func (h *OAuthHandler) DeviceAuthorization(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+
+	client, ok := h.authenticateClient(c)
+	if !ok {
+		return
+	}
+	if !client.AllowsGrant(oauth.GrantDeviceCode) {
+		c.JSON(http.StatusBadRequest, OAuthError{Error: oauth.ErrorUnauthorizedClient, ErrorDescription: "The client may not use the device authorization grant"})
+		return
+	}
+
+	scopes := oauth.ParseScope(c.PostForm("scope"))
+	if len(scopes) == 0 {
+		scopes = client.Scopes
+	}
+	if !client.AllowsScopes(scopes) {
+		c.JSON(http.StatusBadRequest, OAuthError{Error: oauth.ErrorInvalidScope})
+		return
+	}
+
+	deviceCode, userCode, err := h.devices.Create(client.TenantID, client.ClientID, scopes)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, OAuthError{Error: oauth.ErrorServerError})
+		return
+	}
+
+	c.JSON(http.StatusOK, DeviceAuthorizationResponse{
+		DeviceCode:              deviceCode,
+		UserCode:                userCode,
+		VerificationURI:         h.cfg.DeviceVerificationURL,
+		VerificationURIComplete: h.cfg.DeviceVerificationURL + "?user_code=" + url.QueryEscape(userCode),
+		ExpiresIn:               int(oauth.DeviceCodeTTL.Seconds()),
+		Interval:                int(oauth.PollInterval.Seconds()),
+	})
+}
+
+// GetDeviceAuthorization shows the signed-in user which client a user code
+// belongs to before they approve it.
+func (h *OAuthHandler) GetDeviceAuthorization(c *gin.Context) {
+	auth, client, ok := h.findDeviceAuthorization(c, c.Query("user_code"))
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, DeviceVerification{
+		UserCode:   auth.UserCode,
+		ClientName: client.Name,
+		Scope:      strings.Join(auth.Scope, " "),
+		ExpiresAt:  auth.ExpiresAt,
+	})
+}
+
+// DecideDeviceAuthorization approves or denies a device authorization for
+// the signed-in user. The device picks up the outcome on its next poll.
+func (h *OAuthHandler) DecideDeviceAuthorization(c *gin.Context) {
+	var req DeviceDecisionRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	_, client, ok := h.findDeviceAuthorization(c, req.UserCode)
+	if !ok {
+		return
+	}
+
+	tenantID := c.GetString("tenant_id")
+	userID := c.GetString("user_id")
+	err := h.devices.Decide(tenantID, userID, req.UserCode, req.Approve)
+	if err == oauth.ErrDeviceCodeInvalid {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invalid or expired user code"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update device authorization"})
+		return
+	}
+
+	status := "success"
+	message := "Device authorized"
+	if !req.Approve {
+		status = "denied"
+		message = "Device authorization denied"
+	}
+	writeAudit(h.db, tenantID, userID, "oauth.device_authorize", "oauth_client", client.ID, status, c.ClientIP(), c.GetHeader("User-Agent"))
+
+	c.JSON(http.StatusOK, gin.H{"message": message})
+}
+
+// findDeviceAuthorization loads the pending authorization of a user code if
+// its client belongs to the tenant of the signed-in user, answering the
+// request itself otherwise.
+func (h *OAuthHandler) findDeviceAuthorization(c *gin.Context, userCode string) (*oauth.DeviceAuthorization, *oauth.Client, bool) {
+	auth, err := h.devices.FindByUserCode(userCode)
+	if err == nil && auth.TenantID != c.GetString("tenant_id") {
+		err = oauth.ErrDeviceCodeInvalid
+	}
+	if err == oauth.ErrDeviceCodeInvalid {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invalid or expired user code"})
+		return nil, nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return nil, nil, false
+	}
+
+	client, err := h.clients.Get(auth.ClientID)
+	if err == oauth.ErrClientNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Invalid or expired user code"})
+		return nil, nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return nil, nil, false
+	}
+	return auth, client, true
+}
+
+// deviceCodeErrors maps the outcomes of a poll to RFC 8628 error codes.
+var deviceCodeErrors = map[error]string{
+	oauth.ErrAuthorizationPending: oauth.ErrorAuthorizationPending,
+	oauth.ErrSlowDown:             oauth.ErrorSlowDown,
+	oauth.ErrDeviceCodeExpired:    oauth.ErrorExpiredToken,
+	oauth.ErrDeviceAccessDenied:   oauth.ErrorAccessDenied,
+	oauth.ErrDeviceCodeInvalid:    oauth.ErrorInvalidGrant,
+}
+
+// exchangeDeviceCode answers a device polling the token endpoint.
+func (h *OAuthHandler) exchangeDeviceCode(c *gin.Context, client *oauth.Client) {
+	deviceCode := c.PostForm("device_code")
+	if deviceCode == "" {
+		c.JSON(http.StatusBadRequest, OAuthError{Error: oauth.ErrorInvalidRequest, ErrorDescription: "device_code is required"})
+		return
+	}
+
+	auth, err := h.devices.Poll(deviceCode, client.ClientID)
+	if code, ok := deviceCodeErrors[err]; ok {
+		c.JSON(http.StatusBadRequest, OAuthError{Error: code})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, OAuthError{Error: oauth.ErrorServerError})
+		return
+	}
+
+	user, err := h.activeUser(auth.TenantID, auth.UserID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusBadRequest, OAuthError{Error: oauth.ErrorInvalidGrant})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, OAuthError{Error: oauth.ErrorServerError})
+		return
+	}
+
+	response, err := h.issueTokens(user, client, auth.Scope, "")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, OAuthError{Error: oauth.ErrorServerError})
+		return
+	}
+
+	writeAudit(h.db, user.TenantID, user.ID, "oauth.token", "oauth_client", client.ID, "success", c.ClientIP(), c.GetHeader("User-Agent"))
+
+	c.JSON(http.StatusOK, response)
+}
@@ -0,0 +1,161 @@
+package handlers
+
+import (
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/ForIAM/ForIAM/backend/internal/oauth"
+	"github.com/ForIAM/ForIAM/backend/internal/token"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/google/uuid"
+)
+
+// exchangeToken implements token exchange (RFC 8693) for services calling
+// each other on behalf of a user. The subject token must have been issued to
+// the calling client or name it as an audience. Without an actor token the
+// client impersonates the subject; with one, the new token records the actor
+// in its act claim (delegation). The audiences the new token may target are
+// limited to the client's exchange audiences, and its scope can only narrow.
+func (h *OAuthHandler) exchangeToken(c *gin.Context, client *oauth.Client) {
+	semantics := "impersonation"
+	var subject *token.Claims
+
+	fail := func(status int, code, description string) {
+		userID := ""
+		if subject != nil {
+			userID = subject.UserID
+		}
+		writeAuditReason(h.db, client.TenantID, userID, "oauth.token_exchange", "oauth_client", client.ID, "failure", description, c.ClientIP(), c.GetHeader("User-Agent"))
+		c.JSON(status, OAuthError{Error: code, ErrorDescription: description})
+	}
+
+	if requested := c.PostForm("requested_token_type"); requested != "" && requested != oauth.TokenTypeAccessToken {
+		fail(http.StatusBadRequest, oauth.ErrorInvalidRequest, "Only access tokens can be requested")
+		return
+	}
+
+	subject, err := h.exchangeInput(c, client, c.PostForm("subject_token"), c.PostForm("subject_token_type"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, OAuthError{Error: oauth.ErrorServerError})
+		return
+	}
+	if subject == nil {
+		fail(http.StatusBadRequest, oauth.ErrorInvalidRequest, "Invalid subject token")
+		return
+	}
+
+	var actor *token.Claims
+	if c.PostForm("actor_token") != "" || c.PostForm("actor_token_type") != "" {
+		semantics = "delegation"
+		actor, err = h.exchangeInput(c, client, c.PostForm("actor_token"), c.PostForm("actor_token_type"))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, OAuthError{Error: oauth.ErrorServerError})
+			return
+		}
+		if actor == nil || actor.ClientID != client.ClientID {
+			fail(http.StatusBadRequest, oauth.ErrorInvalidRequest, "Invalid actor token")
+			return
+		}
+	}
+
+	audiences := c.PostFormArray("audience")
+	for _, audience := range audiences {
+		if audience == h.cfg.TokenAudience || !client.AllowsAudience(audience) {
+			fail(http.StatusBadRequest, oauth.ErrorInvalidTarget, "The client may not obtain tokens for audience "+audience)
+			return
+		}
+	}
+
+	subjectScope, _ := subject.Raw["scope"].(string)
+	scopes, ok := oauth.ExchangeScopes(client, strings.Fields(subjectScope), oauth.ParseScope(c.PostForm("scope")))
+	if !ok {
+		fail(http.StatusBadRequest, oauth.ErrorInvalidScope, "The scope must be held by the subject token and registered for the client")
+		return
+	}
+
+	// The exchanged token never outlives the subject token
+	now := time.Now()
+	expiresAt := now.Add(h.cfg.AccessTokenTTL)
+	if subject.ExpiresAt.Before(expiresAt) {
+		expiresAt = subject.ExpiresAt
+	}
+	scope := strings.Join(scopes, " ")
+
+	claims := jwt.MapClaims{
+		"iss":       h.cfg.TokenIssuer,
+		"aud":       append(audiences, h.cfg.TokenIssuer),
+		"sub":       subject.Subject,
+		"tenant_id": subject.TenantID,
+		"client_id": client.ClientID,
+		"scope":     scope,
+		"jti":       uuid.NewString(),
+		"typ":       token.TypeAccess,
+		"exp":       expiresAt.Unix(),
+		"iat":       now.Unix(),
+	}
+	if subject.UserID != "" {
+		claims["user_id"] = subject.UserID
+	}
+	if subject.Email != "" {
+		claims["email"] = subject.Email
+	}
+	if actor != nil {
+		claims["act"] = oauth.ActorClaim(actor.Subject, actor.ClientID, subject.Raw["act"])
+	} else if prior, ok := subject.Raw["act"]; ok {
+		// Impersonating keeps the actors the subject token already names
+		claims["act"] = prior
+	}
+
+	accessToken, err := h.keys.Sign(claims)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, OAuthError{Error: oauth.ErrorServerError})
+		return
+	}
+
+	writeAuditReason(h.db, client.TenantID, subject.UserID, "oauth.token_exchange", "oauth_client", client.ID, "success", semantics, c.ClientIP(), c.GetHeader("User-Agent"))
+
+	c.JSON(http.StatusOK, TokenResponse{
+		AccessToken:     accessToken,
+		IssuedTokenType: oauth.TokenTypeAccessToken,
+		TokenType:       "Bearer",
+		ExpiresIn:       int(time.Until(expiresAt).Seconds()),
+		Scope:           scope,
+	})
+}
+
+// exchangeInput validates a subject or actor token. It must be an OAuth
+// access token of the client's tenant that was issued to the client or
+// names it as an audience. A nil result means the token is not acceptable.
+func (h *OAuthHandler) exchangeInput(c *gin.Context, client *oauth.Client, raw, tokenType string) (*token.Claims, error) {
+	if raw == "" || (tokenType != oauth.TokenTypeAccessToken && tokenType != oauth.TokenTypeJWT) {
+		return nil, nil
+	}
+
+	claims, err := h.validator.Validate(c.Request.Context(), raw, token.TypeAccess)
+	if err != nil {
+		if token.ErrorCode(err) != "" {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if claims.TenantID != client.TenantID {
+		return nil, nil
+	}
+
+	audiences, _ := claims.Raw.GetAudience()
+	if claims.ClientID != client.ClientID && !containsString(audiences, client.ClientID) {
+		return nil, nil
+	}
+	return claims, nil
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
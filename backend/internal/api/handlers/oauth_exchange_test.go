@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ForIAM/ForIAM/backend/internal/oauth"
+	"github.com/ForIAM/ForIAM/backend/internal/signing"
+	"github.com/ForIAM/ForIAM/backend/internal/token"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestOAuthHandler_ExchangeInput(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	key, err := signing.GenerateKey(signing.ES256)
+	if err != nil {
+		t.Fatalf("GenerateKey returned error: %v", err)
+	}
+	keys := signing.NewKeySet(key)
+	h := &OAuthHandler{
+		validator: token.NewValidator(keys.Keyfunc, token.NewMemoryRevocationStore(), token.ValidatorOptions{
+			Algorithms: []string{signing.ES256},
+			Issuer:     "https://iam.example.com",
+			Audience:   "https://iam.example.com",
+		}),
+	}
+	client := &oauth.Client{ClientID: "svc-orders", TenantID: "tenant-1"}
+
+	sign := func(overrides jwt.MapClaims) string {
+		claims := jwt.MapClaims{
+			"iss":       "https://iam.example.com",
+			"aud":       "https://iam.example.com",
+			"sub":       "user-1",
+			"user_id":   "user-1",
+			"client_id": "svc-orders",
+			"tenant_id": "tenant-1",
+			"scope":     "openid orders.read",
+			"jti":       "jti-1",
+			"typ":       token.TypeAccess,
+			"iat":       time.Now().Unix(),
+			"exp":       time.Now().Add(time.Hour).Unix(),
+		}
+		for k, v := range overrides {
+			claims[k] = v
+		}
+		signed, err := keys.Sign(claims)
+		if err != nil {
+			t.Fatalf("Sign returned error: %v", err)
+		}
+		return signed
+	}
+
+	tests := []struct {
+		name      string
+		raw       string
+		tokenType string
+		accepted  bool
+	}{
+		{"issued to the client", sign(nil), oauth.TokenTypeAccessToken, true},
+		{"client is an audience", sign(jwt.MapClaims{"client_id": "web", "aud": []string{"svc-orders", "https://iam.example.com"}}), oauth.TokenTypeJWT, true},
+		{"issued to another client", sign(jwt.MapClaims{"client_id": "web"}), oauth.TokenTypeAccessToken, false},
+		{"another tenant", sign(jwt.MapClaims{"tenant_id": "tenant-2"}), oauth.TokenTypeAccessToken, false},
+		{"management API token", sign(jwt.MapClaims{"aud": "foriam-api"}), oauth.TokenTypeAccessToken, false},
+		{"unsupported token type", sign(nil), "urn:ietf:params:oauth:token-type:id_token", false},
+		{"not a token", "garbage", oauth.TokenTypeAccessToken, false},
+	}
+
+	for _, tt := range tests {
+		c, _ := gin.CreateTestContext(httptest.NewRecorder())
+		c.Request = httptest.NewRequest("POST", "/oauth2/token", nil)
+
+		claims, err := h.exchangeInput(c, client, tt.raw, tt.tokenType)
+		if err != nil {
+			t.Fatalf("%s: exchangeInput returned error: %v", tt.name, err)
+		}
+		if accepted := claims != nil; accepted != tt.accepted {
+			t.Errorf("%s: expected accepted=%v, got %v", tt.name, tt.accepted, accepted)
+		}
+	}
+}
@@ -0,0 +1,203 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/ForIAM/ForIAM/backend/internal/oauth"
+	"github.com/ForIAM/ForIAM/backend/internal/token"
+	"github.com/gin-gonic/gin"
+)
+
+// IntrospectionResponse is the response of RFC 7662 section 2.2. Inactive
+// tokens only carry active=false.
+type IntrospectionResponse struct {
+	Active    bool        `json:"active"`
+	Scope     string      `json:"scope,omitempty"`
+	ClientID  string      `json:"client_id,omitempty"`
+	Username  string      `json:"username,omitempty"`
+	TokenType string      `json:"token_type,omitempty"`
+	ExpiresAt int64       `json:"exp,omitempty"`
+	IssuedAt  int64       `json:"iat,omitempty"`
+	Subject   string      `json:"sub,omitempty"`
+	Audience  interface{} `json:"aud,omitempty"`
+	Issuer    string      `json:"iss,omitempty"`
+	JTI       string      `json:"jti,omitempty"`
+	TenantID  string      `json:"tenant_id,omitempty"`
+}
+
+// activeToken is a token introspection or revocation found to be active:
+// either a signed access token or an opaque API token.
+type activeToken struct {
+	claims   *token.Claims
+	apiToken *token.APIToken
+}
+
+func (t *activeToken) tenantID() string {
+	if t.claims != nil {
+		return t.claims.TenantID
+	}
+	return t.apiToken.TenantID
+}
+
+// clientID is the OAuth client the token was issued to, if any.
+func (t *activeToken) clientID() string {
+	if t.claims != nil {
+		return t.claims.ClientID
+	}
+	return ""
+}
+
+func (t *activeToken) userID() string {
+	if t.claims != nil {
+		return t.claims.UserID
+	}
+	return t.apiToken.UserID
+}
+
+func (t *activeToken) introspection() IntrospectionResponse {
+	if t.claims == nil {
+		response := IntrospectionResponse{
+			Active:    true,
+			Username:  t.apiToken.Email,
+			TokenType: "Bearer",
+			IssuedAt:  t.apiToken.CreatedAt.Unix(),
+			Subject:   t.apiToken.UserID,
+			TenantID:  t.apiToken.TenantID,
+		}
+		if t.apiToken.ExpiresAt != nil {
+			response.ExpiresAt = t.apiToken.ExpiresAt.Unix()
+		}
+		return response
+	}
+
+	subject := t.claims.Subject
+	if subject == "" {
+		subject = t.claims.UserID
+	}
+	scope, _ := t.claims.Raw["scope"].(string)
+	issuer, _ := t.claims.Raw["iss"].(string)
+	return IntrospectionResponse{
+		Active:    true,
+		Scope:     scope,
+		ClientID:  t.claims.ClientID,
+		Username:  t.claims.Email,
+		TokenType: "Bearer",
+		ExpiresAt: t.claims.ExpiresAt.Unix(),
+		IssuedAt:  t.claims.IssuedAt.Unix(),
+		Subject:   subject,
+		Audience:  t.claims.Raw["aud"],
+		Issuer:    issuer,
+		JTI:       t.claims.JTI,
+		TenantID:  t.claims.TenantID,
+	}
+}
+
+// findActiveToken returns the active access or API token raw stands for, or
+// nil when it is unknown, expired, revoked or otherwise invalid. Errors are
+// failures to find out.
+func (h *OAuthHandler) findActiveToken(ctx context.Context, raw string) (*activeToken, error) {
+	if !token.IsAPIKey(raw) {
+		claims, err := h.validator.Validate(ctx, raw, token.TypeAccess)
+		if errors.Is(err, token.ErrAudience) {
+			claims, err = h.apiValidator.Validate(ctx, raw, token.TypeAccess)
+		}
+		if err != nil {
+			if token.ErrorCode(err) != "" {
+				return nil, nil
+			}
+			return nil, err
+		}
+		return &activeToken{claims: claims}, nil
+	}
+
+	apiToken, err := h.apiTokens.Lookup(raw)
+	if err == token.ErrAPITokenInvalid {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &activeToken{apiToken: apiToken}, nil
+}
+
+// Introspect tells a resource server whether a token is active (RFC 7662).
+// Only confidential clients may ask, and only about tokens of their own
+// tenant; any other token is reported inactive.
+func (h *OAuthHandler) Introspect(c *gin.Context) {
+	c.Header("Cache-Control", "no-store")
+	c.Header("Pragma", "no-cache")
+
+	client, ok := h.authenticateClient(c)
+	if !ok {
+		return
+	}
+	if client.Public {
+		c.JSON(http.StatusUnauthorized, OAuthError{Error: oauth.ErrorInvalidClient, ErrorDescription: "Public clients cannot introspect tokens"})
+		return
+	}
+
+	raw := c.PostForm("token")
+	if raw == "" {
+		c.JSON(http.StatusBadRequest, OAuthError{Error: oauth.ErrorInvalidRequest, ErrorDescription: "token is required"})
+		return
+	}
+
+	found, err := h.findActiveToken(c.Request.Context(), raw)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, OAuthError{Error: oauth.ErrorServerError})
+		return
+	}
+	if found == nil || found.tenantID() != client.TenantID {
+		c.JSON(http.StatusOK, IntrospectionResponse{Active: false})
+		return
+	}
+
+	c.JSON(http.StatusOK, found.introspection())
+}
+
+// Revoke revokes an access or API token (RFC 7009). A client may revoke the
+// tokens issued to it and the user tokens of its tenant. Unknown tokens and
+// tokens the client may not revoke are answered with 200 all the same, so
+// the endpoint reveals nothing about them.
+func (h *OAuthHandler) Revoke(c *gin.Context) {
+	client, ok := h.authenticateClient(c)
+	if !ok {
+		return
+	}
+
+	raw := c.PostForm("token")
+	if raw == "" {
+		c.JSON(http.StatusBadRequest, OAuthError{Error: oauth.ErrorInvalidRequest, ErrorDescription: "token is required"})
+		return
+	}
+
+	found, err := h.findActiveToken(c.Request.Context(), raw)
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, OAuthError{Error: oauth.ErrorServerError})
+		return
+	}
+	if found == nil || found.tenantID() != client.TenantID ||
+		(found.clientID() != "" && found.clientID() != client.ClientID) {
+		c.Status(http.StatusOK)
+		return
+	}
+
+	// Tokens are accepted up to the leeway past their expiry, so the
+	// revocation has to outlive that
+	if found.claims != nil {
+		err = h.revocations.Revoke(c.Request.Context(), found.claims.JTI, time.Until(found.claims.ExpiresAt)+h.cfg.TokenLeeway)
+	} else {
+		err = h.apiTokens.Delete(found.apiToken.TenantID, found.apiToken.ID)
+	}
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, OAuthError{Error: oauth.ErrorServerError})
+		return
+	}
+
+	writeAudit(h.db, client.TenantID, found.userID(), "oauth.revoke", "oauth_client", client.ID, "success", c.ClientIP(), c.GetHeader("User-Agent"))
+
+	c.Status(http.StatusOK)
+}
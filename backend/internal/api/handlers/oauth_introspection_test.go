@@ -0,0 +1,80 @@
+package handlers
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ForIAM/ForIAM/backend/internal/config"
+	"github.com/ForIAM/ForIAM/backend/internal/signing"
+	"github.com/ForIAM/ForIAM/backend/internal/token"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestOAuthHandler_FindActiveToken(t *testing.T) {
+	key, err := signing.GenerateKey(signing.ES256)
+	if err != nil {
+		t.Fatalf("GenerateKey returned error: %v", err)
+	}
+	keys := signing.NewKeySet(key)
+	store := token.NewMemoryRevocationStore()
+	newValidator := func(audience string) *token.Validator {
+		return token.NewValidator(keys.Keyfunc, store, token.ValidatorOptions{
+			Algorithms: []string{signing.ES256},
+			Issuer:     "https://iam.example.com",
+			Audience:   audience,
+		})
+	}
+	h := &OAuthHandler{
+		cfg:          &config.Config{},
+		validator:    newValidator("https://iam.example.com"),
+		apiValidator: newValidator("foriam-api"),
+	}
+
+	sign := func(aud, jti string, exp time.Time) string {
+		signed, err := keys.Sign(jwt.MapClaims{
+			"iss":       "https://iam.example.com",
+			"aud":       aud,
+			"sub":       "client-1",
+			"client_id": "client-1",
+			"tenant_id": "tenant-1",
+			"scope":     "billing.read",
+			"jti":       jti,
+			"typ":       token.TypeAccess,
+			"iat":       time.Now().Unix(),
+			"exp":       exp.Unix(),
+		})
+		if err != nil {
+			t.Fatalf("Sign returned error: %v", err)
+		}
+		return signed
+	}
+	ctx := context.Background()
+
+	found, err := h.findActiveToken(ctx, sign("https://iam.example.com", "jti-1", time.Now().Add(time.Hour)))
+	if err != nil || found == nil {
+		t.Fatalf("Expected client token to be active, got %v, %v", found, err)
+	}
+	info := found.introspection()
+	if !info.Active || info.Scope != "billing.read" || info.Subject != "client-1" || info.TenantID != "tenant-1" || info.ExpiresAt == 0 {
+		t.Errorf("Unexpected introspection %+v", info)
+	}
+	if found.clientID() != "client-1" || found.tenantID() != "tenant-1" {
+		t.Errorf("Unexpected token owner %q in %q", found.clientID(), found.tenantID())
+	}
+
+	if found, _ := h.findActiveToken(ctx, sign("foriam-api", "jti-2", time.Now().Add(time.Hour))); found == nil {
+		t.Error("Expected a management API token to be active")
+	}
+	if found, _ := h.findActiveToken(ctx, sign("other-api", "jti-3", time.Now().Add(time.Hour))); found != nil {
+		t.Error("Expected a token for another audience to be inactive")
+	}
+	if found, _ := h.findActiveToken(ctx, sign("foriam-api", "jti-4", time.Now().Add(-time.Hour))); found != nil {
+		t.Error("Expected an expired token to be inactive")
+	}
+
+	store.Revoke(ctx, "jti-1", time.Hour)
+	if found, _ := h.findActiveToken(ctx, sign("https://iam.example.com", "jti-1", time.Now().Add(time.Hour))); found != nil {
+		t.Error("Expected a revoked token to be inactive")
+	}
+}
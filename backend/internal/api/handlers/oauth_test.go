@@ -0,0 +1,79 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/ForIAM/ForIAM/backend/internal/config"
+	"github.com/ForIAM/ForIAM/backend/internal/oauth"
+	"github.com/gin-gonic/gin"
+)
+
+func TestOAuthHandler_Discovery(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	h := &OAuthHandler{cfg: &config.Config{TokenIssuer: "https://iam.example.com", SigningAlgorithm: "RS256"}}
+	router := gin.New()
+	router.GET("/.well-known/openid-configuration", h.Discovery)
+
+	req, _ := http.NewRequest("GET", "/.well-known/openid-configuration", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	var doc map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatalf("Failed to unmarshal response: %v", err)
+	}
+	expected := map[string]string{
+		"issuer":                 "https://iam.example.com",
+		"authorization_endpoint": "https://iam.example.com/oauth2/authorize",
+		"token_endpoint":         "https://iam.example.com/oauth2/token",
+		"userinfo_endpoint":      "https://iam.example.com/oauth2/userinfo",
+		"jwks_uri":               "https://iam.example.com/.well-known/jwks.json",
+
+		"device_authorization_endpoint": "https://iam.example.com/oauth2/device_authorization",
+	}
+	for key, value := range expected {
+		if doc[key] != value {
+			t.Errorf("Expected %s %q, got %v", key, value, doc[key])
+		}
+	}
+}
+
+func TestAuthorizeRedirect(t *testing.T) {
+	withCode := authorizeRedirect("https://app.example.com/callback?tab=1", "xyz", OAuthError{}, "abc")
+	u, _ := url.Parse(withCode)
+	if q := u.Query(); q.Get("code") != "abc" || q.Get("state") != "xyz" || q.Get("tab") != "1" || q.Get("error") != "" {
+		t.Errorf("Unexpected redirect %s", withCode)
+	}
+
+	withError := authorizeRedirect("https://app.example.com/callback", "", OAuthError{Error: "access_denied"}, "")
+	u, _ = url.Parse(withError)
+	if q := u.Query(); q.Get("error") != "access_denied" || q.Has("state") || q.Has("code") {
+		t.Errorf("Unexpected redirect %s", withError)
+	}
+}
+
+func TestClientRequest_Apply(t *testing.T) {
+	client := &oauth.Client{}
+	ClientRequest{Name: "Portal"}.apply(client)
+
+	if len(client.GrantTypes) != 1 || client.GrantTypes[0] != oauth.GrantAuthorizationCode {
+		t.Errorf("Expected the authorization code grant by default, got %v", client.GrantTypes)
+	}
+	if len(client.Scopes) != 2 || client.RedirectURIs == nil {
+		t.Errorf("Expected default scopes and an empty redirect URI list, got %v and %v", client.Scopes, client.RedirectURIs)
+	}
+
+	ClientRequest{Name: "Billing job", GrantTypes: []string{oauth.GrantClientCredentials}, Scopes: []string{"billing.read"}}.apply(client)
+	if client.Name != "Billing job" || client.GrantTypes[0] != oauth.GrantClientCredentials || client.Scopes[0] != "billing.read" {
+		t.Errorf("Unexpected client %+v", client)
+	}
+}
@@ -0,0 +1,235 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/ForIAM/ForIAM/backend/internal/config"
+	"github.com/ForIAM/ForIAM/backend/internal/provisioning"
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// ProvisioningHandler manages the connectors that push users and groups to
+// downstream SCIM services, and shows how their jobs fare.
+type ProvisioningHandler struct {
+	db         *sql.DB
+	connectors *provisioning.Store
+	queue      *provisioning.Queue
+}
+
+func NewProvisioningHandler(db *sql.DB, cfg *config.Config) *ProvisioningHandler {
+	return &ProvisioningHandler{
+		db:         db,
+		connectors: provisioning.NewStore(db, cfg.EncryptionKey),
+		queue:      provisioning.NewQueue(db),
+	}
+}
+
+// ConnectorRequest creates or replaces a connector. The token is required
+// on creation and kept when left out of an update. An empty attribute
+// mapping selects the default one; is_active defaults to true.
+type ConnectorRequest struct {
+	Name             string            `json:"name" binding:"required"`
+	Endpoint         string            `json:"endpoint" binding:"required"`
+	Token            string            `json:"token"`
+	AttributeMapping map[string]string `json:"attribute_mapping"`
+	IsActive         *bool             `json:"is_active"`
+}
+
+func (req ConnectorRequest) apply(connector *provisioning.Connector) {
+	connector.Name = req.Name
+	connector.Endpoint = req.Endpoint
+	connector.Token = req.Token
+	connector.AttributeMapping = req.AttributeMapping
+	if req.IsActive != nil {
+		connector.IsActive = *req.IsActive
+	}
+}
+
+// queueProvisioning queues provisioning jobs for a change. The change is
+// saved already, so a failure is only logged.
+func queueProvisioning(queue *provisioning.Queue, tenantID, resourceType, resourceID, operation string) {
+	if err := queue.Enqueue(tenantID, resourceType, resourceID, operation); err != nil {
+		log.Println("Failed to queue provisioning:", err)
+	}
+}
+
+func connectorError(c *gin.Context, err error) {
+	var pqErr *pq.Error
+	switch {
+	case errors.Is(err, provisioning.ErrInvalidConnector):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.As(err, &pqErr) && pqErr.Code == "23505":
+		c.JSON(http.StatusConflict, gin.H{"error": "A connector with this name already exists"})
+	case err == provisioning.ErrNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Connector not found"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+	}
+}
+
+func (h *ProvisioningHandler) GetConnectors(c *gin.Context) {
+	connectors, err := h.connectors.List(c.GetString("tenant_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	c.JSON(http.StatusOK, connectors)
+}
+
+func (h *ProvisioningHandler) CreateConnector(c *gin.Context) {
+	var req ConnectorRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Token == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "token is required"})
+		return
+	}
+
+	connector := &provisioning.Connector{TenantID: c.GetString("tenant_id"), IsActive: true}
+	req.apply(connector)
+	if err := h.connectors.Create(connector); err != nil {
+		connectorError(c, err)
+		return
+	}
+
+	writeAudit(h.db, connector.TenantID, c.GetString("user_id"), "provisioning.connector_create", "provisioning_connector", connector.ID, "success", c.ClientIP(), c.GetHeader("User-Agent"))
+
+	c.JSON(http.StatusCreated, connector)
+}
+
+func (h *ProvisioningHandler) GetConnector(c *gin.Context) {
+	connector, ok := h.findConnector(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, connector)
+}
+
+func (h *ProvisioningHandler) UpdateConnector(c *gin.Context) {
+	var req ConnectorRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	connector, ok := h.findConnector(c)
+	if !ok {
+		return
+	}
+
+	req.apply(connector)
+	if err := h.connectors.Update(connector); err != nil {
+		connectorError(c, err)
+		return
+	}
+
+	writeAudit(h.db, connector.TenantID, c.GetString("user_id"), "provisioning.connector_update", "provisioning_connector", connector.ID, "success", c.ClientIP(), c.GetHeader("User-Agent"))
+
+	c.JSON(http.StatusOK, connector)
+}
+
+func (h *ProvisioningHandler) DeleteConnector(c *gin.Context) {
+	tenantID := c.GetString("tenant_id")
+	if err := h.connectors.Delete(tenantID, c.Param("id")); err != nil {
+		connectorError(c, err)
+		return
+	}
+
+	writeAudit(h.db, tenantID, c.GetString("user_id"), "provisioning.connector_delete", "provisioning_connector", c.Param("id"), "success", c.ClientIP(), c.GetHeader("User-Agent"))
+
+	c.JSON(http.StatusOK, gin.H{"message": "Connector deleted successfully"})
+}
+
+// SyncConnector queues every user and group of the tenant for the
+// connector.
+func (h *ProvisioningHandler) SyncConnector(c *gin.Context) {
+	connector, ok := h.findConnector(c)
+	if !ok {
+		return
+	}
+	if !connector.IsActive {
+		c.JSON(http.StatusConflict, gin.H{"error": "Connector is not active"})
+		return
+	}
+
+	queued, err := h.queue.Sync(connector)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to queue jobs"})
+		return
+	}
+
+	writeAudit(h.db, connector.TenantID, c.GetString("user_id"), "provisioning.sync", "provisioning_connector", connector.ID, "success", c.ClientIP(), c.GetHeader("User-Agent"))
+
+	c.JSON(http.StatusAccepted, gin.H{"queued": queued})
+}
+
+// GetConnectorJobs lists the latest jobs of a connector, newest first.
+func (h *ProvisioningHandler) GetConnectorJobs(c *gin.Context) {
+	status := c.Query("status")
+	switch status {
+	case "", provisioning.StatusPending, provisioning.StatusRunning, provisioning.StatusSucceeded, provisioning.StatusFailed:
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "status must be one of pending, running, succeeded or failed"})
+		return
+	}
+	limit := 100
+	if value := c.Query("limit"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil || parsed < 1 || parsed > 1000 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 1000"})
+			return
+		}
+		limit = parsed
+	}
+
+	connector, ok := h.findConnector(c)
+	if !ok {
+		return
+	}
+	jobs, err := h.connectors.Jobs(connector.ID, status, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	c.JSON(http.StatusOK, jobs)
+}
+
+// RetryConnectorJob queues a failed job again.
+func (h *ProvisioningHandler) RetryConnectorJob(c *gin.Context) {
+	connector, ok := h.findConnector(c)
+	if !ok {
+		return
+	}
+
+	job, err := h.connectors.Retry(connector.ID, c.Param("job_id"))
+	switch {
+	case err == provisioning.ErrJobNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	case err == provisioning.ErrJobNotRetryable:
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	case err != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	writeAudit(h.db, connector.TenantID, c.GetString("user_id"), "provisioning.job_retry", "provisioning_job", job.ID, "success", c.ClientIP(), c.GetHeader("User-Agent"))
+
+	c.JSON(http.StatusOK, job)
+}
+
+func (h *ProvisioningHandler) findConnector(c *gin.Context) (*provisioning.Connector, bool) {
+	connector, err := h.connectors.Get(c.GetString("tenant_id"), c.Param("id"))
+	if err != nil {
+		connectorError(c, err)
+		return nil, false
+	}
+	return connector, true
+}
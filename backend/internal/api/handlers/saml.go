@@ -0,0 +1,548 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/ForIAM/ForIAM/backend/internal/config"
+	"github.com/ForIAM/ForIAM/backend/internal/saml"
+	"github.com/ForIAM/ForIAM/backend/internal/token"
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// SAMLHandler makes each tenant a SAML 2.0 identity provider. Service
+// providers send users to the public /saml/idp/{tenant_id} endpoints; the
+// frontend signs users in and gets the response to post back, like for
+// /oauth2/authorize.
+type SAMLHandler struct {
+	db            *sql.DB
+	cfg           *config.Config
+	revocations   token.RevocationStore
+	refreshTokens *token.RefreshStore
+	store         *saml.Store
+}
+
+func NewSAMLHandler(db *sql.DB, cfg *config.Config, revocations token.RevocationStore) *SAMLHandler {
+	return &SAMLHandler{
+		db:            db,
+		cfg:           cfg,
+		revocations:   revocations,
+		refreshTokens: token.NewRefreshStore(db, cfg.RefreshTokenTTL),
+		store:         saml.NewStore(db, cfg.EncryptionKey),
+	}
+}
+
+// ServiceProviderRequest registers or replaces a service provider. An
+// attribute mapping left out selects the default one; is_active defaults
+// to true.
+type ServiceProviderRequest struct {
+	Name              string            `json:"name" binding:"required"`
+	EntityID          string            `json:"entity_id" binding:"required"`
+	ACSURL            string            `json:"acs_url" binding:"required"`
+	SLOURL            string            `json:"slo_url"`
+	Certificate       string            `json:"certificate"`
+	NameIDFormat      string            `json:"name_id_format"`
+	AttributeMapping  map[string]string `json:"attribute_mapping"`
+	AllowIDPInitiated bool              `json:"allow_idp_initiated"`
+	IsActive          *bool             `json:"is_active"`
+}
+
+func (req ServiceProviderRequest) apply(sp *saml.ServiceProvider) {
+	sp.Name = req.Name
+	sp.EntityID = req.EntityID
+	sp.ACSURL = req.ACSURL
+	sp.SLOURL = req.SLOURL
+	sp.Certificate = req.Certificate
+	sp.NameIDFormat = req.NameIDFormat
+	sp.AttributeMapping = req.AttributeMapping
+	sp.AllowIDPInitiated = req.AllowIDPInitiated
+	if req.IsActive != nil {
+		sp.IsActive = *req.IsActive
+	}
+}
+
+// SSORequest is an authentication request the signed-in user approves, as
+// passed on to SAML_LOGIN_URL. SAMLRequest is encoded for the HTTP-Redirect
+// binding.
+type SSORequest struct {
+	SAMLRequest string `json:"saml_request" binding:"required"`
+	RelayState  string `json:"relay_state"`
+}
+
+// SSOResponse is what the frontend posts to the service provider, as the
+// form fields SAMLResponse and RelayState.
+type SSOResponse struct {
+	ACSURL       string `json:"acs_url"`
+	SAMLResponse string `json:"saml_response"`
+	RelayState   string `json:"relay_state,omitempty"`
+}
+
+// IdentityProvider describes the IdP of a tenant for administrators
+// registering it with a service provider.
+type IdentityProvider struct {
+	EntityID    string `json:"entity_id"`
+	MetadataURL string `json:"metadata_url"`
+	SSOURL      string `json:"sso_url"`
+	SLOURL      string `json:"slo_url"`
+	Certificate string `json:"certificate"`
+}
+
+func serviceProviderError(c *gin.Context, err error) {
+	var pqErr *pq.Error
+	switch {
+	case errors.Is(err, saml.ErrInvalidServiceProvider):
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	case errors.As(err, &pqErr) && pqErr.Code == "23505":
+		c.JSON(http.StatusConflict, gin.H{"error": "A service provider with this entity ID already exists"})
+	case err == saml.ErrNotFound:
+		c.JSON(http.StatusNotFound, gin.H{"error": "Service provider not found"})
+	default:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+	}
+}
+
+// idp loads the IdP of tenantID, answering the request when that fails.
+func (h *SAMLHandler) idp(c *gin.Context, tenantID string) (*saml.IdP, bool) {
+	var exists bool
+	if _, err := uuid.Parse(tenantID); err == nil {
+		if err := h.db.QueryRow(`SELECT EXISTS(SELECT 1 FROM tenants WHERE id = $1)`, tenantID).Scan(&exists); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return nil, false
+		}
+	}
+	if !exists {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tenant not found"})
+		return nil, false
+	}
+
+	credential, err := h.store.Credential(tenantID, saml.EntityID(h.cfg.TokenIssuer, tenantID))
+	if err != nil {
+		log.Println("Failed to load SAML credential:", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to load signing credential"})
+		return nil, false
+	}
+	return saml.NewIdP(h.cfg.TokenIssuer, tenantID, credential), true
+}
+
+// serviceProvider loads the active service provider that sent a message,
+// verifying the signature of the message when the service provider
+// registered a certificate.
+func (h *SAMLHandler) serviceProvider(tenantID, issuer string, m *saml.Message) (*saml.ServiceProvider, error) {
+	sp, err := h.store.GetByEntityID(tenantID, issuer)
+	if err != nil {
+		return nil, err
+	}
+	if !sp.IsActive {
+		return nil, saml.ErrNotFound
+	}
+	if sp.Certificate != "" && m != nil {
+		cert, err := saml.ParseCertificate(sp.Certificate)
+		if err != nil {
+			return nil, err
+		}
+		if err := m.Verify(cert); err != nil {
+			return nil, err
+		}
+	}
+	return sp, nil
+}
+
+// checkAuthnRequest returns the service provider of req once the request
+// fits its registration.
+func (h *SAMLHandler) checkAuthnRequest(tenantID string, req *saml.AuthnRequest, m *saml.Message) (*saml.ServiceProvider, error) {
+	sp, err := h.serviceProvider(tenantID, req.Issuer, m)
+	if err != nil {
+		return nil, err
+	}
+	if req.AssertionConsumerServiceURL != "" && req.AssertionConsumerServiceURL != sp.ACSURL {
+		return nil, errors.New("AssertionConsumerServiceURL is not registered for the service provider")
+	}
+	if format := req.NameIDPolicy.Format; format != "" && format != saml.NameIDFormatUnspecified && format != sp.NameIDFormat {
+		return nil, errors.New("NameIDPolicy asks for a name ID format the service provider is not registered for")
+	}
+	return sp, nil
+}
+
+func samlRequestError(c *gin.Context, err error) {
+	if err == saml.ErrNotFound {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown service provider"})
+		return
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+}
+
+// GetMetadata serves the metadata of a tenant's IdP.
+func (h *SAMLHandler) GetMetadata(c *gin.Context) {
+	idp, ok := h.idp(c, c.Param("tenant_id"))
+	if !ok {
+		return
+	}
+	c.Data(http.StatusOK, "application/samlmetadata+xml", idp.Metadata())
+}
+
+// SSO receives an authentication request over the HTTP-Redirect or
+// HTTP-POST binding and sends the browser to the frontend to sign in.
+func (h *SAMLHandler) SSO(c *gin.Context) {
+	tenantID := c.Param("tenant_id")
+	idp, ok := h.idp(c, tenantID)
+	if !ok {
+		return
+	}
+
+	m, err := saml.ReadMessage(c.Request, "SAMLRequest")
+	if err != nil {
+		samlRequestError(c, err)
+		return
+	}
+	req, err := saml.ParseAuthnRequest(m.XML, idp.SSOURL)
+	if err != nil {
+		samlRequestError(c, err)
+		return
+	}
+	if _, err := h.checkAuthnRequest(tenantID, req, m); err != nil {
+		samlRequestError(c, err)
+		return
+	}
+
+	encoded, err := saml.EncodeRedirect(m.XML)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to encode request"})
+		return
+	}
+	query := url.Values{"tenant_id": {tenantID}, "SAMLRequest": {encoded}}
+	if m.RelayState != "" {
+		query.Set("RelayState", m.RelayState)
+	}
+	if req.ForceAuthn {
+		query.Set("force_authn", "true")
+	}
+	if req.IsPassive {
+		query.Set("is_passive", "true")
+	}
+	c.Redirect(http.StatusFound, h.cfg.SAMLLoginURL+"?"+query.Encode())
+}
+
+// ApproveSSO answers an authentication request for the signed-in user.
+// Called by the frontend with its access token; the service provider must
+// belong to the user's tenant.
+func (h *SAMLHandler) ApproveSSO(c *gin.Context) {
+	var body SSORequest
+	if err := c.ShouldBindJSON(&body); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tenantID := c.GetString("tenant_id")
+	idp, ok := h.idp(c, tenantID)
+	if !ok {
+		return
+	}
+	data, err := saml.DecodeRedirect(body.SAMLRequest)
+	if err != nil {
+		samlRequestError(c, err)
+		return
+	}
+	req, err := saml.ParseAuthnRequest(data, idp.SSOURL)
+	if err != nil {
+		samlRequestError(c, err)
+		return
+	}
+	// The signature, if any, was checked when the request came in; the
+	// response only goes to the registered ACS URL
+	sp, err := h.checkAuthnRequest(tenantID, req, nil)
+	if err != nil {
+		samlRequestError(c, err)
+		return
+	}
+
+	h.login(c, idp, sp, req.ID, body.RelayState)
+}
+
+// LoginServiceProvider signs the user in to a service provider without a
+// request from it (IdP-initiated SSO), if the service provider allows it.
+func (h *SAMLHandler) LoginServiceProvider(c *gin.Context) {
+	var body struct {
+		RelayState string `json:"relay_state"`
+	}
+	if c.Request.ContentLength > 0 {
+		if err := c.ShouldBindJSON(&body); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	sp, ok := h.findServiceProvider(c)
+	if !ok {
+		return
+	}
+	if !sp.IsActive || !sp.AllowIDPInitiated {
+		c.JSON(http.StatusForbidden, gin.H{"error": "The service provider does not accept sign-ins started here"})
+		return
+	}
+	idp, ok := h.idp(c, sp.TenantID)
+	if !ok {
+		return
+	}
+
+	h.login(c, idp, sp, "", body.RelayState)
+}
+
+// login answers with a response signing the current user in to sp.
+func (h *SAMLHandler) login(c *gin.Context, idp *saml.IdP, sp *saml.ServiceProvider, inResponseTo, relayState string) {
+	userID := c.GetString("user_id")
+	identity, err := h.store.Identity(sp.TenantID, userID)
+	if err == saml.ErrIdentityNotFound {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only active users can sign in to service providers"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	login := &saml.Login{ServiceProvider: sp, InResponseTo: inResponseTo, Identity: identity, NameID: sp.NameID(identity)}
+	login.SessionIndex, err = h.store.StartSession(sp, userID, login.NameID, h.cfg.RefreshTokenTTL)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	response, err := idp.Response(login, time.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign response"})
+		return
+	}
+
+	writeAudit(h.db, sp.TenantID, userID, "saml.sso", "saml_service_provider", sp.ID, "success", c.ClientIP(), c.GetHeader("User-Agent"))
+
+	c.JSON(http.StatusOK, SSOResponse{ACSURL: sp.ACSURL, SAMLResponse: response, RelayState: relayState})
+}
+
+// SLO takes part in single logout. A LogoutRequest from a service provider
+// ends the user's sessions here and at the other service providers, which
+// are asked one after the other over the browser; their LogoutResponses
+// come back here until the requesting service provider can be answered.
+func (h *SAMLHandler) SLO(c *gin.Context) {
+	tenantID := c.Param("tenant_id")
+	idp, ok := h.idp(c, tenantID)
+	if !ok {
+		return
+	}
+
+	if c.Request.FormValue("SAMLResponse") != "" {
+		h.logoutResponse(c, idp, tenantID)
+		return
+	}
+
+	m, err := saml.ReadMessage(c.Request, "SAMLRequest")
+	if err != nil {
+		samlRequestError(c, err)
+		return
+	}
+	req, err := saml.ParseLogoutRequest(m.XML, idp.SLOURL)
+	if err != nil {
+		samlRequestError(c, err)
+		return
+	}
+	sp, err := h.serviceProvider(tenantID, req.Issuer, m)
+	if err != nil {
+		samlRequestError(c, err)
+		return
+	}
+	if sp.SLOURL == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The service provider has no single logout URL"})
+		return
+	}
+
+	logout, err := h.store.StartLogout(sp, req, m.RelayState)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if logout == nil {
+		// No session to end; the user is signed out already
+		h.redirect(c, idp, sp.SLOURL, "SAMLResponse", idp.LogoutResponse(sp, req.ID, saml.StatusSuccess, time.Now()), m.RelayState)
+		return
+	}
+
+	if err := h.revocations.RevokeUser(c.Request.Context(), logout.UserID, h.cfg.AccessTokenTTL); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke sessions"})
+		return
+	}
+	if err := h.refreshTokens.RevokeUser(logout.UserID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke sessions"})
+		return
+	}
+	writeAudit(h.db, tenantID, logout.UserID, "saml.logout", "saml_service_provider", sp.ID, "success", c.ClientIP(), c.GetHeader("User-Agent"))
+
+	h.continueLogout(c, idp, logout)
+}
+
+func (h *SAMLHandler) logoutResponse(c *gin.Context, idp *saml.IdP, tenantID string) {
+	m, err := saml.ReadMessage(c.Request, "SAMLResponse")
+	if err != nil {
+		samlRequestError(c, err)
+		return
+	}
+	resp, err := saml.ParseLogoutResponse(m.XML, idp.SLOURL)
+	if err != nil {
+		samlRequestError(c, err)
+		return
+	}
+	sp, err := h.serviceProvider(tenantID, resp.Issuer, m)
+	if err != nil {
+		samlRequestError(c, err)
+		return
+	}
+
+	// A service provider failing to log out does not stop the others
+	logout, err := h.store.ContinueLogout(sp, resp.InResponseTo)
+	if err == saml.ErrLogoutNotFound {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown or expired logout"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	h.continueLogout(c, idp, logout)
+}
+
+// continueLogout sends the browser to the next service provider to log
+// out of, or back to the one that asked for the logout once all are done.
+func (h *SAMLHandler) continueLogout(c *gin.Context, idp *saml.IdP, logout *saml.Logout) {
+	session, err := h.store.NextSession(logout)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if session != nil {
+		requestID, request := idp.LogoutRequest(session.ServiceProvider, session.NameID, session.ID, time.Now())
+		if err := h.store.AwaitLogout(logout, session, requestID); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+		h.redirect(c, idp, session.ServiceProvider.SLOURL, "SAMLRequest", request, "")
+		return
+	}
+
+	origin, err := h.store.Get(logout.TenantID, logout.ServiceProviderID)
+	if err != nil {
+		serviceProviderError(c, err)
+		return
+	}
+	if err := h.store.FinishLogout(logout); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	h.redirect(c, idp, origin.SLOURL, "SAMLResponse", idp.LogoutResponse(origin, logout.RequestID, saml.StatusSuccess, time.Now()), logout.RelayState)
+}
+
+// redirect sends a signed message over the HTTP-Redirect binding.
+func (h *SAMLHandler) redirect(c *gin.Context, idp *saml.IdP, location, param string, message []byte, relayState string) {
+	target, err := idp.Credential.RedirectURL(location, param, message, relayState)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sign message"})
+		return
+	}
+	c.Redirect(http.StatusFound, target)
+}
+
+// GetIdentityProvider describes the IdP of the caller's tenant.
+func (h *SAMLHandler) GetIdentityProvider(c *gin.Context) {
+	idp, ok := h.idp(c, c.GetString("tenant_id"))
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, IdentityProvider{
+		EntityID:    idp.EntityID,
+		MetadataURL: idp.EntityID,
+		SSOURL:      idp.SSOURL,
+		SLOURL:      idp.SLOURL,
+		Certificate: idp.Credential.CertificatePEM(),
+	})
+}
+
+func (h *SAMLHandler) GetServiceProviders(c *gin.Context) {
+	sps, err := h.store.List(c.GetString("tenant_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	c.JSON(http.StatusOK, sps)
+}
+
+func (h *SAMLHandler) CreateServiceProvider(c *gin.Context) {
+	var req ServiceProviderRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	sp := &saml.ServiceProvider{TenantID: c.GetString("tenant_id"), IsActive: true}
+	req.apply(sp)
+	if err := h.store.Create(sp); err != nil {
+		serviceProviderError(c, err)
+		return
+	}
+
+	writeAudit(h.db, sp.TenantID, c.GetString("user_id"), "saml.sp_create", "saml_service_provider", sp.ID, "success", c.ClientIP(), c.GetHeader("User-Agent"))
+
+	c.JSON(http.StatusCreated, sp)
+}
+
+func (h *SAMLHandler) GetServiceProvider(c *gin.Context) {
+	sp, ok := h.findServiceProvider(c)
+	if !ok {
+		return
+	}
+	c.JSON(http.StatusOK, sp)
+}
+
+func (h *SAMLHandler) UpdateServiceProvider(c *gin.Context) {
+	var req ServiceProviderRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	sp, ok := h.findServiceProvider(c)
+	if !ok {
+		return
+	}
+
+	req.apply(sp)
+	if err := h.store.Update(sp); err != nil {
+		serviceProviderError(c, err)
+		return
+	}
+
+	writeAudit(h.db, sp.TenantID, c.GetString("user_id"), "saml.sp_update", "saml_service_provider", sp.ID, "success", c.ClientIP(), c.GetHeader("User-Agent"))
+
+	c.JSON(http.StatusOK, sp)
+}
+
+func (h *SAMLHandler) DeleteServiceProvider(c *gin.Context) {
+	tenantID := c.GetString("tenant_id")
+	if err := h.store.Delete(tenantID, c.Param("id")); err != nil {
+		serviceProviderError(c, err)
+		return
+	}
+
+	writeAudit(h.db, tenantID, c.GetString("user_id"), "saml.sp_delete", "saml_service_provider", c.Param("id"), "success", c.ClientIP(), c.GetHeader("User-Agent"))
+
+	c.JSON(http.StatusOK, gin.H{"message": "Service provider deleted successfully"})
+}
+
+func (h *SAMLHandler) findServiceProvider(c *gin.Context) (*saml.ServiceProvider, bool) {
+	sp, err := h.store.Get(c.GetString("tenant_id"), c.Param("id"))
+	if err != nil {
+		serviceProviderError(c, err)
+		return nil, false
+	}
+	return sp, true
+}
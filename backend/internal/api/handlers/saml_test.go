@@ -0,0 +1,125 @@
+package handlers
+
+import (
+	"crypto/x509"
+	"database/sql/driver"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ForIAM/ForIAM/backend/internal/config"
+	"github.com/ForIAM/ForIAM/backend/internal/dbtest"
+	"github.com/ForIAM/ForIAM/backend/internal/saml"
+	"github.com/ForIAM/ForIAM/backend/internal/sealing"
+)
+
+const (
+	samlTenant = "7b2d4f60-1c3e-4a85-b9d7-3e5f7a9c1b20"
+	samlSP     = "7b2d4f60-1c3e-4a85-b9d7-3e5f7a9c1b21"
+)
+
+// serviceProviderRow is a row of saml_service_providers registered for
+// the wiki at https://wiki.example with email name IDs.
+func serviceProviderRow(allowIDPInitiated, active bool) []driver.Value {
+	return []driver.Value{samlSP, samlTenant, "Wiki", "https://wiki.example/saml", "https://wiki.example/saml/acs", "", "",
+		saml.NameIDFormatEmail, []byte(`{}`), allowIDPInitiated, active, time.Now()}
+}
+
+func TestSAMLHandler_CheckAuthnRequest(t *testing.T) {
+	tests := []struct {
+		name     string
+		issuer   string
+		active   bool
+		acsURL   string
+		format   string
+		accepted bool
+	}{
+		{"registered service provider", "https://wiki.example/saml", true, "https://wiki.example/saml/acs", saml.NameIDFormatEmail, true},
+		{"no ACS URL or format asked for", "https://wiki.example/saml", true, "", "", true},
+		{"unspecified name ID format", "https://wiki.example/saml", true, "", saml.NameIDFormatUnspecified, true},
+		{"unknown service provider", "https://other.example/saml", true, "", "", false},
+		{"inactive service provider", "https://wiki.example/saml", false, "", "", false},
+		{"unregistered ACS URL", "https://wiki.example/saml", true, "https://evil.example/acs", "", false},
+		{"unregistered name ID format", "https://wiki.example/saml", true, "", saml.NameIDFormatPersistent, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, script := dbtest.Open(t)
+			script.OnArgs("FROM saml_service_providers WHERE entity_id = $1", nil, func(args []driver.Value) [][]driver.Value {
+				if args[0] != "https://wiki.example/saml" {
+					return nil
+				}
+				return [][]driver.Value{serviceProviderRow(false, tt.active)}
+			})
+
+			h := &SAMLHandler{db: db, store: saml.NewStore(db, "key")}
+			req := &saml.AuthnRequest{AssertionConsumerServiceURL: tt.acsURL}
+			req.Issuer = tt.issuer
+			req.NameIDPolicy.Format = tt.format
+			sp, err := h.checkAuthnRequest(samlTenant, req, nil)
+			if tt.accepted && (err != nil || sp.ID != samlSP) {
+				t.Errorf("Expected the request to be accepted, got %v", err)
+			}
+			if !tt.accepted && err == nil {
+				t.Error("Expected the request to be refused")
+			}
+		})
+	}
+}
+
+func TestSAMLHandler_LoginServiceProvider(t *testing.T) {
+	credential, err := saml.GenerateCredential("https://idp.example/saml/idp/" + samlTenant)
+	if err != nil {
+		t.Fatalf("GenerateCredential returned error: %v", err)
+	}
+	sealed, err := sealing.New("key", sealing.PurposeSAMLCredential).Seal(x509.MarshalPKCS1PrivateKey(credential.Key))
+	if err != nil {
+		t.Fatalf("Seal returned error: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		allow      bool
+		active     bool
+		activeUser bool
+		status     int
+	}{
+		{"service provider not accepting IdP-initiated sign-ins", false, true, true, http.StatusForbidden},
+		{"inactive service provider", true, false, true, http.StatusForbidden},
+		{"inactive user", true, true, false, http.StatusForbidden},
+		{"active user", true, true, true, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, script := dbtest.Open(t)
+			script.On("FROM saml_service_providers WHERE id = $1", nil, serviceProviderRow(tt.allow, tt.active))
+			script.On("SELECT EXISTS(SELECT 1 FROM tenants", nil, []driver.Value{true})
+			script.On("FROM saml_idp_credentials", nil, []driver.Value{sealed, credential.Certificate.Raw})
+			var identity [][]driver.Value
+			if tt.activeUser {
+				identity = [][]driver.Value{{"alice@corp.example", "", "Alice", "Alice", "", []byte(`{}`)}}
+			}
+			script.On("FROM users u WHERE u.id = $1", nil, identity...)
+			script.On("DELETE FROM saml_sessions", nil)
+			script.On("INSERT INTO saml_sessions", nil, []driver.Value{})
+			events := recordAudit(script)
+
+			h := &SAMLHandler{db: db, store: saml.NewStore(db, "key"),
+				cfg: &config.Config{TokenIssuer: "https://idp.example", RefreshTokenTTL: time.Hour}}
+			w := serve(h.LoginServiceProvider, "POST", "/saml/service-providers/:id/login", "/saml/service-providers/"+samlSP+"/login", "")
+			expectStatus(t, tt.name, w, tt.status)
+
+			var want []string
+			if tt.status == http.StatusOK {
+				want = []string{"saml.sso " + samlSP}
+			}
+			if !reflect.DeepEqual(*events, want) {
+				t.Errorf("Expected audit events %v, got %v", want, *events)
+			}
+			if started := script.Ran("INSERT INTO saml_sessions"); started != (tt.status == http.StatusOK) {
+				t.Errorf("Expected a session only for a completed sign-in, started: %v", started)
+			}
+		})
+	}
+}
@@ -0,0 +1,513 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/ForIAM/ForIAM/backend/internal/api/middleware"
+	"github.com/ForIAM/ForIAM/backend/internal/authz"
+	"github.com/ForIAM/ForIAM/backend/internal/config"
+	"github.com/ForIAM/ForIAM/backend/internal/dynamicgroup"
+	"github.com/ForIAM/ForIAM/backend/internal/provisioning"
+	"github.com/ForIAM/ForIAM/backend/internal/scim"
+	"github.com/ForIAM/ForIAM/backend/internal/token"
+	"github.com/gin-gonic/gin"
+)
+
+// defaultSCIMCount is the page size of queries that do not ask for one.
+const defaultSCIMCount = 100
+
+// SCIMHandler serves SCIM 2.0 so identity providers can provision users
+// and groups of their tenant. Clients authenticate like any management API
+// caller, typically with an API key of a service account, and need the
+// user.* and group.* permissions. Responses, errors included, use the SCIM
+// format rather than the one of the rest of the API.
+type SCIMHandler struct {
+	db            *sql.DB
+	cfg           *config.Config
+	revocations   token.RevocationStore
+	refreshTokens *token.RefreshStore
+	resolver      middleware.PermissionResolver
+	store         *scim.Store
+	provisioning  *provisioning.Queue
+	groups        *dynamicgroup.Reconciler
+}
+
+func NewSCIMHandler(db *sql.DB, cfg *config.Config, revocations token.RevocationStore, resolver middleware.PermissionResolver) *SCIMHandler {
+	return &SCIMHandler{
+		db:            db,
+		cfg:           cfg,
+		revocations:   revocations,
+		refreshTokens: token.NewRefreshStore(db, cfg.RefreshTokenTTL),
+		resolver:      resolver,
+		store:         scim.NewStore(db, cfg.TokenIssuer+"/scim/v2"),
+		provisioning:  provisioning.NewQueue(db),
+		groups:        dynamicgroup.NewReconciler(db),
+	}
+}
+
+func (h *SCIMHandler) baseURL() string {
+	return h.cfg.TokenIssuer + "/scim/v2"
+}
+
+// Require is RequirePermission answering with a SCIM error.
+func (h *SCIMHandler) Require(permission string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		allowed, err := middleware.HasPermission(c, h.resolver, permission)
+		if err != nil {
+			writeSCIMError(c, scim.NewError(http.StatusInternalServerError, "", "Failed to resolve permissions"))
+			c.Abort()
+			return
+		}
+		if !allowed {
+			writeSCIMError(c, scim.NewError(http.StatusForbidden, "", "Insufficient permissions: %s", permission))
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+func writeSCIM(c *gin.Context, status int, v interface{}) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		status = http.StatusInternalServerError
+		body, _ = json.Marshal(scim.NewError(status, "", "Failed to encode response"))
+	}
+	c.Data(status, scim.ContentType, body)
+}
+
+func writeSCIMError(c *gin.Context, err *scim.Error) {
+	writeSCIM(c, err.StatusCode(), err)
+}
+
+// failSCIM answers with err if it is a SCIM error, or with a generic server
+// error otherwise.
+func failSCIM(c *gin.Context, err error) {
+	var scimErr *scim.Error
+	if errors.As(err, &scimErr) {
+		writeSCIMError(c, scimErr)
+		return
+	}
+	writeSCIMError(c, scim.NewError(http.StatusInternalServerError, "", "Database error"))
+}
+
+// writeResource answers with a user or group and its ETag.
+func writeResource(c *gin.Context, status int, resource interface{}, meta *scim.Meta) {
+	c.Header("ETag", meta.Version)
+	if status == http.StatusCreated {
+		c.Header("Location", meta.Location)
+	}
+	writeSCIM(c, status, resource)
+}
+
+func readSCIM(c *gin.Context, v interface{}) bool {
+	if err := json.NewDecoder(c.Request.Body).Decode(v); err != nil {
+		writeSCIMError(c, scim.NewError(http.StatusBadRequest, scim.ErrorInvalidSyntax, "Invalid request body: %v", err))
+		return false
+	}
+	return true
+}
+
+// matchesETag reports whether an If-Match or If-None-Match header lists
+// version. Weak and strong forms of a tag match each other.
+func matchesETag(header, version string) bool {
+	version = strings.TrimPrefix(version, "W/")
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == version {
+			return true
+		}
+	}
+	return false
+}
+
+// checkIfMatch refuses to change a resource that changed since the client
+// read it, when the client sent If-Match.
+func checkIfMatch(c *gin.Context, version string) bool {
+	header := c.GetHeader("If-Match")
+	if header != "" && !matchesETag(header, version) {
+		writeSCIMError(c, scim.NewError(http.StatusPreconditionFailed, "", "Resource changed"))
+		return false
+	}
+	return true
+}
+
+// notModified answers 304 when If-None-Match lists the current version.
+func notModified(c *gin.Context, version string) bool {
+	header := c.GetHeader("If-None-Match")
+	if header != "" && matchesETag(header, version) {
+		c.Header("ETag", version)
+		c.Status(http.StatusNotModified)
+		return true
+	}
+	return false
+}
+
+// parseQuery reads the filter, startIndex and count query parameters.
+// startIndex starts at 1 and count is capped at scim.MaxResults.
+func parseQuery(c *gin.Context) (*scim.Filter, int, int, bool) {
+	var filter *scim.Filter
+	if expression := c.Query("filter"); expression != "" {
+		parsed, err := scim.ParseFilter(expression)
+		if err != nil {
+			failSCIM(c, err)
+			return nil, 0, 0, false
+		}
+		filter = parsed
+	}
+
+	startIndex := 1
+	if value := c.Query("startIndex"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			writeSCIMError(c, scim.NewError(http.StatusBadRequest, scim.ErrorInvalidValue, "startIndex must be a number"))
+			return nil, 0, 0, false
+		}
+		if parsed > 1 {
+			startIndex = parsed
+		}
+	}
+
+	count := defaultSCIMCount
+	if value := c.Query("count"); value != "" {
+		parsed, err := strconv.Atoi(value)
+		if err != nil {
+			writeSCIMError(c, scim.NewError(http.StatusBadRequest, scim.ErrorInvalidValue, "count must be a number"))
+			return nil, 0, 0, false
+		}
+		count = parsed
+	}
+	if count < 0 {
+		count = 0
+	}
+	if count > scim.MaxResults {
+		count = scim.MaxResults
+	}
+	return filter, startIndex, count, true
+}
+
+func (h *SCIMHandler) audit(c *gin.Context, action, resource, resourceID string) {
+	writeAudit(h.db, c.GetString("tenant_id"), c.GetString("user_id"), action, resource, resourceID, "success", c.ClientIP(), c.GetHeader("User-Agent"))
+}
+
+func (h *SCIMHandler) GetServiceProviderConfig(c *gin.Context) {
+	writeSCIM(c, http.StatusOK, scim.ServiceProviderConfig(h.baseURL()))
+}
+
+func (h *SCIMHandler) GetResourceTypes(c *gin.Context) {
+	resourceTypes := scim.ResourceTypes(h.baseURL())
+	writeSCIM(c, http.StatusOK, scim.NewListResponse(resourceTypes, len(resourceTypes), len(resourceTypes), 1))
+}
+
+func (h *SCIMHandler) GetResourceType(c *gin.Context) {
+	for _, resourceType := range scim.ResourceTypes(h.baseURL()) {
+		if resourceType.ID == c.Param("id") {
+			writeSCIM(c, http.StatusOK, resourceType)
+			return
+		}
+	}
+	writeSCIMError(c, scim.NewError(http.StatusNotFound, "", "Resource type %s not found", c.Param("id")))
+}
+
+func (h *SCIMHandler) GetSchemas(c *gin.Context) {
+	schemas := scim.Schemas(h.baseURL())
+	writeSCIM(c, http.StatusOK, scim.NewListResponse(schemas, len(schemas), len(schemas), 1))
+}
+
+func (h *SCIMHandler) GetSchema(c *gin.Context) {
+	for _, schema := range scim.Schemas(h.baseURL()) {
+		if schema.ID == c.Param("id") {
+			writeSCIM(c, http.StatusOK, schema)
+			return
+		}
+	}
+	writeSCIMError(c, scim.NewError(http.StatusNotFound, "", "Schema %s not found", c.Param("id")))
+}
+
+func (h *SCIMHandler) GetUsers(c *gin.Context) {
+	filter, startIndex, count, ok := parseQuery(c)
+	if !ok {
+		return
+	}
+	users, total, err := h.store.ListUsers(c.GetString("tenant_id"), filter, startIndex, count)
+	if err != nil {
+		failSCIM(c, err)
+		return
+	}
+	writeSCIM(c, http.StatusOK, scim.NewListResponse(users, len(users), total, startIndex))
+}
+
+func (h *SCIMHandler) GetUser(c *gin.Context) {
+	user, err := h.store.GetUser(c.GetString("tenant_id"), c.Param("id"))
+	if err != nil {
+		failSCIM(c, err)
+		return
+	}
+	if notModified(c, user.Meta.Version) {
+		return
+	}
+	writeResource(c, http.StatusOK, user, user.Meta)
+}
+
+func (h *SCIMHandler) CreateUser(c *gin.Context) {
+	var req scim.User
+	if !readSCIM(c, &req) {
+		return
+	}
+	user, err := h.store.CreateUser(c.GetString("tenant_id"), &req)
+	if err != nil {
+		failSCIM(c, err)
+		return
+	}
+	h.audit(c, "scim.user.create", "user", user.ID)
+	queueProvisioning(h.provisioning, c.GetString("tenant_id"), provisioning.ResourceUser, user.ID, provisioning.OperationUpsert)
+	reconcileUser(h.groups, c.GetString("tenant_id"), user.ID, c.GetString("user_id"))
+	writeResource(c, http.StatusCreated, user, user.Meta)
+}
+
+func (h *SCIMHandler) ReplaceUser(c *gin.Context) {
+	current, err := h.store.GetUser(c.GetString("tenant_id"), c.Param("id"))
+	if err != nil {
+		failSCIM(c, err)
+		return
+	}
+	if !checkIfMatch(c, current.Meta.Version) {
+		return
+	}
+	var req scim.User
+	if !readSCIM(c, &req) {
+		return
+	}
+	h.saveUser(c, current, &req)
+}
+
+func (h *SCIMHandler) PatchUser(c *gin.Context) {
+	current, err := h.store.GetUser(c.GetString("tenant_id"), c.Param("id"))
+	if err != nil {
+		failSCIM(c, err)
+		return
+	}
+	if !checkIfMatch(c, current.Meta.Version) {
+		return
+	}
+	var req scim.PatchRequest
+	if !readSCIM(c, &req) {
+		return
+	}
+
+	patched := *current
+	if current.Name != nil {
+		name := *current.Name
+		patched.Name = &name
+	}
+	if err := scim.ApplyUserPatch(&patched, req.Operations); err != nil {
+		failSCIM(c, err)
+		return
+	}
+	h.saveUser(c, current, &patched)
+}
+
+// saveUser replaces current with user. Deactivating a user ends their
+// sessions, as identity providers deprovision users by deactivating them.
+func (h *SCIMHandler) saveUser(c *gin.Context, current, user *scim.User) {
+	saved, err := h.store.ReplaceUser(c.GetString("tenant_id"), current.ID, user)
+	if err != nil {
+		failSCIM(c, err)
+		return
+	}
+	if current.IsActive() && !saved.IsActive() {
+		if err := h.revokeSessions(c, saved.ID); err != nil {
+			writeSCIMError(c, scim.NewError(http.StatusInternalServerError, "", "Failed to revoke sessions"))
+			return
+		}
+	}
+	h.audit(c, "scim.user.update", "user", saved.ID)
+	queueProvisioning(h.provisioning, c.GetString("tenant_id"), provisioning.ResourceUser, saved.ID, provisioning.OperationUpsert)
+	reconcileUser(h.groups, c.GetString("tenant_id"), saved.ID, c.GetString("user_id"))
+	writeResource(c, http.StatusOK, saved, saved.Meta)
+}
+
+func (h *SCIMHandler) revokeSessions(c *gin.Context, userID string) error {
+	if err := h.revocations.RevokeUser(c.Request.Context(), userID, h.cfg.AccessTokenTTL); err != nil {
+		return err
+	}
+	return h.refreshTokens.RevokeUser(userID)
+}
+
+func (h *SCIMHandler) DeleteUser(c *gin.Context) {
+	tenantID := c.GetString("tenant_id")
+	current, err := h.store.GetUser(tenantID, c.Param("id"))
+	if err != nil {
+		failSCIM(c, err)
+		return
+	}
+	if !checkIfMatch(c, current.Meta.Version) {
+		return
+	}
+	if err := h.store.DeleteUser(tenantID, current.ID); err != nil {
+		failSCIM(c, err)
+		return
+	}
+	if err := h.revocations.RevokeUser(c.Request.Context(), current.ID, h.cfg.AccessTokenTTL); err != nil {
+		writeSCIMError(c, scim.NewError(http.StatusInternalServerError, "", "Failed to revoke sessions"))
+		return
+	}
+	h.audit(c, "scim.user.delete", "user", current.ID)
+	queueProvisioning(h.provisioning, tenantID, provisioning.ResourceUser, current.ID, provisioning.OperationDelete)
+	c.Status(http.StatusNoContent)
+}
+
+func (h *SCIMHandler) GetGroups(c *gin.Context) {
+	filter, startIndex, count, ok := parseQuery(c)
+	if !ok {
+		return
+	}
+	groups, total, err := h.store.ListGroups(c.GetString("tenant_id"), filter, startIndex, count)
+	if err != nil {
+		failSCIM(c, err)
+		return
+	}
+	writeSCIM(c, http.StatusOK, scim.NewListResponse(groups, len(groups), total, startIndex))
+}
+
+func (h *SCIMHandler) GetGroup(c *gin.Context) {
+	group, err := h.store.GetGroup(c.GetString("tenant_id"), c.Param("id"))
+	if err != nil {
+		failSCIM(c, err)
+		return
+	}
+	if notModified(c, group.Meta.Version) {
+		return
+	}
+	writeResource(c, http.StatusOK, group, group.Meta)
+}
+
+func (h *SCIMHandler) CreateGroup(c *gin.Context) {
+	var req scim.Group
+	if !readSCIM(c, &req) {
+		return
+	}
+	group, err := h.store.CreateGroup(c.GetString("tenant_id"), &req)
+	if err != nil {
+		failSCIM(c, err)
+		return
+	}
+	h.audit(c, "scim.group.create", "group", group.ID)
+	queueProvisioning(h.provisioning, c.GetString("tenant_id"), provisioning.ResourceGroup, group.ID, provisioning.OperationUpsert)
+	writeResource(c, http.StatusCreated, group, group.Meta)
+}
+
+func (h *SCIMHandler) ReplaceGroup(c *gin.Context) {
+	current, err := h.store.GetGroup(c.GetString("tenant_id"), c.Param("id"))
+	if err != nil {
+		failSCIM(c, err)
+		return
+	}
+	if !checkIfMatch(c, current.Meta.Version) {
+		return
+	}
+	var req scim.Group
+	if !readSCIM(c, &req) {
+		return
+	}
+	h.saveGroup(c, current, &req)
+}
+
+func (h *SCIMHandler) PatchGroup(c *gin.Context) {
+	current, err := h.store.GetGroup(c.GetString("tenant_id"), c.Param("id"))
+	if err != nil {
+		failSCIM(c, err)
+		return
+	}
+	if !checkIfMatch(c, current.Meta.Version) {
+		return
+	}
+	var req scim.PatchRequest
+	if !readSCIM(c, &req) {
+		return
+	}
+
+	patched := *current
+	patched.Members = append([]scim.Reference{}, current.Members...)
+	if err := scim.ApplyGroupPatch(&patched, req.Operations); err != nil {
+		failSCIM(c, err)
+		return
+	}
+	h.saveGroup(c, current, &patched)
+}
+
+func (h *SCIMHandler) saveGroup(c *gin.Context, current, group *scim.Group) {
+	if !h.checkMembersGrantable(c, current, group) {
+		return
+	}
+	saved, err := h.store.ReplaceGroup(c.GetString("tenant_id"), current.ID, group)
+	if err != nil {
+		failSCIM(c, err)
+		return
+	}
+	h.audit(c, "scim.group.update", "group", saved.ID)
+	queueProvisioning(h.provisioning, c.GetString("tenant_id"), provisioning.ResourceGroup, saved.ID, provisioning.OperationUpsert)
+	writeResource(c, http.StatusOK, saved, saved.Meta)
+}
+
+// checkMembersGrantable makes sure that whoever adds members to a group
+// holds every permission the group grants, so nobody can hand out more
+// than they have by provisioning.
+func (h *SCIMHandler) checkMembersGrantable(c *gin.Context, current, group *scim.Group) bool {
+	added := false
+	existing := map[string]bool{}
+	for _, member := range current.Members {
+		existing[member.Value] = true
+	}
+	for _, member := range group.Members {
+		if !existing[member.Value] {
+			added = true
+			break
+		}
+	}
+	if !added {
+		return true
+	}
+
+	permissions, err := authz.GroupPermissions(c.Request.Context(), h.db, []string{current.ID})
+	if err != nil {
+		writeSCIMError(c, scim.NewError(http.StatusInternalServerError, "", "Database error"))
+		return false
+	}
+	for _, permission := range permissions {
+		allowed, err := middleware.HasPermission(c, h.resolver, permission)
+		if err != nil {
+			writeSCIMError(c, scim.NewError(http.StatusInternalServerError, "", "Failed to resolve permissions"))
+			return false
+		}
+		if !allowed {
+			writeSCIMError(c, scim.NewError(http.StatusForbidden, "", "Insufficient permissions: members would gain %s", permission))
+			return false
+		}
+	}
+	return true
+}
+
+func (h *SCIMHandler) DeleteGroup(c *gin.Context) {
+	tenantID := c.GetString("tenant_id")
+	current, err := h.store.GetGroup(tenantID, c.Param("id"))
+	if err != nil {
+		failSCIM(c, err)
+		return
+	}
+	if !checkIfMatch(c, current.Meta.Version) {
+		return
+	}
+	if err := h.store.DeleteGroup(tenantID, current.ID); err != nil {
+		failSCIM(c, err)
+		return
+	}
+	h.audit(c, "scim.group.delete", "group", current.ID)
+	queueProvisioning(h.provisioning, tenantID, provisioning.ResourceGroup, current.ID, provisioning.OperationDelete)
+	c.Status(http.StatusNoContent)
+}
@@ -0,0 +1,89 @@
+package handlers
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ForIAM/ForIAM/backend/internal/config"
+	"github.com/ForIAM/ForIAM/backend/internal/scim"
+	"github.com/gin-gonic/gin"
+)
+
+func TestSCIMHandler_Discovery(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	h := &SCIMHandler{cfg: &config.Config{TokenIssuer: "https://id.example.com"}}
+	router := gin.New()
+	router.GET("/scim/v2/ServiceProviderConfig", h.GetServiceProviderConfig)
+	router.GET("/scim/v2/Schemas/:id", h.GetSchema)
+	router.GET("/scim/v2/ResourceTypes", h.GetResourceTypes)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/scim/v2/ServiceProviderConfig", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != scim.ContentType {
+		t.Fatalf("Expected a SCIM response, got %d %s", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/scim/v2/Schemas/"+scim.SchemaUser, nil))
+	var schema scim.Schema
+	if err := json.Unmarshal(w.Body.Bytes(), &schema); err != nil || schema.Name != "User" {
+		t.Errorf("Expected the User schema, got %d %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, httptest.NewRequest("GET", "/scim/v2/ResourceTypes", nil))
+	var list scim.ListResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &list); err != nil || list.TotalResults != 2 {
+		t.Errorf("Expected two resource types, got %s", w.Body.String())
+	}
+}
+
+func TestSCIMHandler_Validation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	h := &SCIMHandler{}
+	router := gin.New()
+	router.GET("/scim/v2/Users", h.GetUsers)
+	router.GET("/scim/v2/Groups", h.GetGroups)
+
+	tests := []struct {
+		name     string
+		path     string
+		scimType string
+	}{
+		{"filter without value", `/scim/v2/Users?filter=userName%20eq`, scim.ErrorInvalidFilter},
+		{"unknown operator", `/scim/v2/Groups?filter=displayName%20is%20%22x%22`, scim.ErrorInvalidFilter},
+		{"startIndex not a number", `/scim/v2/Users?startIndex=first`, scim.ErrorInvalidValue},
+		{"count not a number", `/scim/v2/Groups?count=all`, scim.ErrorInvalidValue},
+	}
+
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, httptest.NewRequest("GET", tt.path, nil))
+		var body scim.Error
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%s: invalid error body %s", tt.name, w.Body.String())
+		}
+		if w.Code != http.StatusBadRequest || body.Status != "400" || body.ScimType != tt.scimType {
+			t.Errorf("%s: expected a 400 %s error, got %d %+v", tt.name, tt.scimType, w.Code, body)
+		}
+	}
+}
+
+func TestMatchesETag(t *testing.T) {
+	version := `W/"abc"`
+	for header, want := range map[string]bool{
+		`W/"abc"`:        true,
+		`"abc"`:          true,
+		`"old", W/"abc"`: true,
+		`*`:              true,
+		`W/"old"`:        false,
+	} {
+		if got := matchesETag(header, version); got != want {
+			t.Errorf("%s: expected %t, got %t", header, want, got)
+		}
+	}
+}
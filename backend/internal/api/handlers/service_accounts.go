@@ -0,0 +1,422 @@
+package handlers
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/ForIAM/ForIAM/backend/internal/api/middleware"
+	"github.com/ForIAM/ForIAM/backend/internal/authz"
+	"github.com/ForIAM/ForIAM/backend/internal/config"
+	"github.com/ForIAM/ForIAM/backend/internal/oauth"
+	"github.com/ForIAM/ForIAM/backend/internal/serviceaccount"
+	"github.com/ForIAM/ForIAM/backend/internal/token"
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// ServiceAccountHandler manages service accounts: non-human principals that
+// authenticate with API keys, an OAuth client of their own or a TLS client
+// certificate, never with a password. Whoever manages one cannot give it
+// more than they hold themselves, through its roles or its keys.
+type ServiceAccountHandler struct {
+	db          *sql.DB
+	cfg         *config.Config
+	revocations token.RevocationStore
+	resolver    middleware.PermissionResolver
+	accounts    *serviceaccount.Store
+	tokens      *token.APITokenStore
+	clients     *oauth.ClientStore
+}
+
+func NewServiceAccountHandler(db *sql.DB, cfg *config.Config, revocations token.RevocationStore, resolver middleware.PermissionResolver) *ServiceAccountHandler {
+	return &ServiceAccountHandler{
+		db:          db,
+		cfg:         cfg,
+		revocations: revocations,
+		resolver:    resolver,
+		accounts:    serviceaccount.NewStore(db),
+		tokens:      token.NewAPITokenStore(db),
+		clients:     oauth.NewClientStore(db),
+	}
+}
+
+// ServiceAccountRequest creates or replaces a service account. Role and
+// group IDs replace the current assignments; is_active defaults to true.
+type ServiceAccountRequest struct {
+	Name        string   `json:"name" binding:"required"`
+	Description string   `json:"description"`
+	IsActive    *bool    `json:"is_active"`
+	RoleIDs     []string `json:"role_ids"`
+	GroupIDs    []string `json:"group_ids"`
+}
+
+// ServiceAccountClientRequest registers an OAuth client that obtains tokens
+// for a service account with the client credentials grant.
+type ServiceAccountClientRequest struct {
+	Name   string   `json:"name" binding:"required"`
+	Scopes []string `json:"scopes"`
+}
+
+// CertificateRequest registers a PEM encoded TLS client certificate.
+type CertificateRequest struct {
+	Certificate string `json:"certificate" binding:"required"`
+}
+
+func (req ServiceAccountRequest) apply(account *serviceaccount.ServiceAccount) {
+	account.Name = req.Name
+	account.Description = req.Description
+	if req.IsActive != nil {
+		account.IsActive = *req.IsActive
+	}
+	account.RoleIDs = dedupe(req.RoleIDs)
+	account.GroupIDs = dedupe(req.GroupIDs)
+}
+
+func (h *ServiceAccountHandler) GetServiceAccounts(c *gin.Context) {
+	accounts, err := h.accounts.List(c.GetString("tenant_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, accounts)
+}
+
+func (h *ServiceAccountHandler) GetServiceAccount(c *gin.Context) {
+	account, ok := h.findAccount(c)
+	if !ok {
+		return
+	}
+
+	c.JSON(http.StatusOK, account)
+}
+
+func (h *ServiceAccountHandler) CreateServiceAccount(c *gin.Context) {
+	var req ServiceAccountRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tenantID := c.GetString("tenant_id")
+	account := &serviceaccount.ServiceAccount{TenantID: tenantID, IsActive: true}
+	req.apply(account)
+	if !h.checkAssignable(c, account) {
+		return
+	}
+
+	err := h.accounts.Create(account)
+	if err == serviceaccount.ErrInvalidAssignment {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown role or group"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create service account"})
+		return
+	}
+
+	writeAudit(h.db, tenantID, c.GetString("user_id"), "service_account.create", "service_account", account.ID, "success", c.ClientIP(), c.GetHeader("User-Agent"))
+
+	c.JSON(http.StatusCreated, account)
+}
+
+// UpdateServiceAccount replaces a service account. Deactivating it revokes
+// the access tokens it holds; its keys stop working while it is inactive.
+func (h *ServiceAccountHandler) UpdateServiceAccount(c *gin.Context) {
+	var req ServiceAccountRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	account, ok := h.findAccount(c)
+	if !ok {
+		return
+	}
+	wasActive := account.IsActive
+	req.apply(account)
+	if !h.checkAssignable(c, account) {
+		return
+	}
+
+	err := h.accounts.Update(account)
+	if err == serviceaccount.ErrInvalidAssignment {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown role or group"})
+		return
+	}
+	if err == serviceaccount.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Service account not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update service account"})
+		return
+	}
+
+	if wasActive && !account.IsActive {
+		if err := h.revocations.RevokeUser(c.Request.Context(), account.ID, h.cfg.AccessTokenTTL); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke service account tokens"})
+			return
+		}
+	}
+
+	writeAudit(h.db, account.TenantID, c.GetString("user_id"), "service_account.update", "service_account", account.ID, "success", c.ClientIP(), c.GetHeader("User-Agent"))
+
+	c.JSON(http.StatusOK, account)
+}
+
+// DeleteServiceAccount removes a service account along with its keys,
+// clients and certificates, and revokes the access tokens it holds.
+func (h *ServiceAccountHandler) DeleteServiceAccount(c *gin.Context) {
+	tenantID := c.GetString("tenant_id")
+	accountID := c.Param("id")
+
+	err := h.accounts.Delete(tenantID, accountID)
+	if err == serviceaccount.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Service account not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete service account"})
+		return
+	}
+
+	if err := h.revocations.RevokeUser(c.Request.Context(), accountID, h.cfg.AccessTokenTTL); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke service account tokens"})
+		return
+	}
+
+	writeAudit(h.db, tenantID, c.GetString("user_id"), "service_account.delete", "service_account", accountID, "success", c.ClientIP(), c.GetHeader("User-Agent"))
+
+	c.JSON(http.StatusOK, gin.H{"message": "Service account deleted successfully"})
+}
+
+func (h *ServiceAccountHandler) GetServiceAccountTokens(c *gin.Context) {
+	account, ok := h.findAccount(c)
+	if !ok {
+		return
+	}
+
+	tokens, err := h.tokens.List(account.TenantID, account.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, tokens)
+}
+
+// CreateServiceAccountToken issues an API key for a service account. As
+// with personal keys, the scopes must be held by the caller. Keys are
+// revoked with DELETE /tokens/{id}.
+func (h *ServiceAccountHandler) CreateServiceAccountToken(c *gin.Context) {
+	var req CreateTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expires_at must be in the future"})
+		return
+	}
+
+	account, ok := h.findAccount(c)
+	if !ok {
+		return
+	}
+	scopes := dedupe(req.Scopes)
+	if !checkGrantable(c, h.db, h.resolver, scopes) {
+		return
+	}
+
+	raw, created, err := h.tokens.Create(account.TenantID, account.ID, req.Name, scopes, req.ExpiresAt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create token"})
+		return
+	}
+
+	writeAudit(h.db, account.TenantID, c.GetString("user_id"), "service_account.token_create", "api_token", created.ID, "success", c.ClientIP(), c.GetHeader("User-Agent"))
+
+	c.JSON(http.StatusCreated, CreateTokenResponse{APIToken: created, Token: raw})
+}
+
+// CreateServiceAccountClient registers a confidential client bound to a
+// service account. Its client credentials grant issues management API
+// tokens of the account, limited to the client's scopes when it has any, so
+// the caller must hold the account's permissions and the scopes. The client
+// is managed under /clients afterwards.
+func (h *ServiceAccountHandler) CreateServiceAccountClient(c *gin.Context) {
+	var req ServiceAccountClientRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	account, ok := h.findAccount(c)
+	if !ok {
+		return
+	}
+	scopes := dedupe(req.Scopes)
+	if !h.checkAssignable(c, account) || !checkGrantable(c, h.db, h.resolver, scopes) {
+		return
+	}
+
+	client := &oauth.Client{
+		TenantID:          account.TenantID,
+		Name:              req.Name,
+		RedirectURIs:      []string{},
+		GrantTypes:        []string{oauth.GrantClientCredentials},
+		Scopes:            scopes,
+		ExchangeAudiences: []string{},
+		ServiceAccountID:  account.ID,
+	}
+	secret, err := h.clients.Create(client)
+	if errors.Is(err, oauth.ErrInvalidClientMetadata) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": clientMetadataError(err)})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create client"})
+		return
+	}
+
+	writeAudit(h.db, account.TenantID, c.GetString("user_id"), "service_account.client_create", "oauth_client", client.ID, "success", c.ClientIP(), c.GetHeader("User-Agent"))
+
+	c.JSON(http.StatusCreated, ClientSecretResponse{Client: client, ClientSecret: secret})
+}
+
+func (h *ServiceAccountHandler) GetServiceAccountCertificates(c *gin.Context) {
+	account, ok := h.findAccount(c)
+	if !ok {
+		return
+	}
+
+	certs, err := h.accounts.Certificates(account.TenantID, account.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, certs)
+}
+
+// AddServiceAccountCertificate registers a TLS client certificate. It is
+// only accepted from clients whose chain the server verifies against its
+// client CAs; the registration pins this exact certificate. The certificate
+// acts with all permissions of the account, which the caller must hold.
+func (h *ServiceAccountHandler) AddServiceAccountCertificate(c *gin.Context) {
+	var req CertificateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	cert, err := serviceaccount.ParseCertificate(req.Certificate)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Certificate must be a single PEM encoded certificate"})
+		return
+	}
+	if !cert.NotAfter.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Certificate has expired"})
+		return
+	}
+
+	account, ok := h.findAccount(c)
+	if !ok || !h.checkAssignable(c, account) {
+		return
+	}
+
+	registered, err := h.accounts.AddCertificate(account.TenantID, account.ID, cert)
+	if err == serviceaccount.ErrDuplicateCertificate {
+		c.JSON(http.StatusConflict, gin.H{"error": "Certificate is already registered"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to register certificate"})
+		return
+	}
+
+	writeAudit(h.db, account.TenantID, c.GetString("user_id"), "service_account.certificate_add", "service_account", account.ID, "success", c.ClientIP(), c.GetHeader("User-Agent"))
+
+	c.JSON(http.StatusCreated, registered)
+}
+
+func (h *ServiceAccountHandler) DeleteServiceAccountCertificate(c *gin.Context) {
+	tenantID := c.GetString("tenant_id")
+	accountID := c.Param("id")
+
+	err := h.accounts.DeleteCertificate(tenantID, accountID, c.Param("cert_id"))
+	if err == serviceaccount.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Certificate not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete certificate"})
+		return
+	}
+
+	writeAudit(h.db, tenantID, c.GetString("user_id"), "service_account.certificate_delete", "service_account", accountID, "success", c.ClientIP(), c.GetHeader("User-Agent"))
+
+	c.JSON(http.StatusOK, gin.H{"message": "Certificate deleted successfully"})
+}
+
+// findAccount loads the service account of the request path, answering the
+// request when it cannot.
+func (h *ServiceAccountHandler) findAccount(c *gin.Context) (*serviceaccount.ServiceAccount, bool) {
+	account, err := h.accounts.Get(c.GetString("tenant_id"), c.Param("id"))
+	if err == serviceaccount.ErrNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Service account not found"})
+		return nil, false
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return nil, false
+	}
+	return account, true
+}
+
+// checkAssignable makes sure the caller holds every permission the roles
+// and groups of account carry, answering the request when they do not.
+func (h *ServiceAccountHandler) checkAssignable(c *gin.Context, account *serviceaccount.ServiceAccount) bool {
+	return checkAccountAssignable(c, h.db, h.resolver, account)
+}
+
+// checkAccountAssignable is checkAssignable for handlers handing out
+// credentials of a service account, which act with all of its permissions.
+func checkAccountAssignable(c *gin.Context, db *sql.DB, resolver middleware.PermissionResolver, account *serviceaccount.ServiceAccount) bool {
+	rows, err := db.Query(`SELECT id FROM roles WHERE tenant_id = $1 AND id::text = ANY($2)`, account.TenantID, pq.Array(account.RoleIDs))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return false
+	}
+	roleIDs, err := scanIDs(rows)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return false
+	}
+	rows, err = db.Query(`SELECT id FROM groups WHERE tenant_id = $1 AND id::text = ANY($2)`, account.TenantID, pq.Array(account.GroupIDs))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return false
+	}
+	groupIDs, err := scanIDs(rows)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return false
+	}
+
+	permissions, err := authz.RolePermissions(c.Request.Context(), db, roleIDs)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return false
+	}
+	inherited, err := authz.GroupPermissions(c.Request.Context(), db, groupIDs)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return false
+	}
+	permissions = dedupe(append(permissions, inherited...))
+
+	return checkGrantable(c, db, resolver, permissions)
+}
@@ -0,0 +1,122 @@
+package handlers
+
+import (
+	"database/sql/driver"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/ForIAM/ForIAM/backend/internal/dbtest"
+	"github.com/ForIAM/ForIAM/backend/internal/oauth"
+	"github.com/ForIAM/ForIAM/backend/internal/serviceaccount"
+	"github.com/ForIAM/ForIAM/backend/internal/token"
+)
+
+const deployAccount = "5d8e1f3a-7c2b-4d96-8e0a-1b3c5d7e9f10"
+
+// scriptServiceAccount scripts deployAccount of tenant-1 with the roles
+// roleIDs, and what the roles grant: user.admin for adminRole.
+func scriptServiceAccount(s *dbtest.Script, roleIDs ...string) {
+	roles := "{"
+	for i, roleID := range roleIDs {
+		if i > 0 {
+			roles += ","
+		}
+		roles += roleID
+	}
+	roles += "}"
+	s.On("FROM users u WHERE u.id = $1 AND u.tenant_id = $2 AND u.principal_type = $3", nil,
+		[]driver.Value{deployAccount, "tenant-1", "deploy", "", true, []byte(roles), []byte("{}"), time.Now()})
+	s.OnArgs("SELECT id FROM roles WHERE tenant_id = $1 AND id::text = ANY($2)", nil, func(args []driver.Value) [][]driver.Value {
+		var rows [][]driver.Value
+		for _, id := range dbtest.Array(args[1]) {
+			rows = append(rows, []driver.Value{id})
+		}
+		return rows
+	})
+	s.On("SELECT id FROM groups WHERE tenant_id = $1 AND id::text = ANY($2)", nil)
+	s.On("FROM group_hierarchy gh JOIN nested", nil)
+	s.OnArgs("FROM role_hierarchy rh JOIN held", nil, func(args []driver.Value) [][]driver.Value {
+		for _, id := range dbtest.Array(args[0]) {
+			if id == adminRole {
+				return [][]driver.Value{{"user.admin"}}
+			}
+		}
+		return nil
+	})
+	s.OnArgs("SELECT COUNT(*) FROM permissions WHERE name = ANY($1)", nil, func(args []driver.Value) [][]driver.Value {
+		return [][]driver.Value{{int64(len(dbtest.Array(args[0])))}}
+	})
+}
+
+func TestServiceAccountHandler_CreateWithRoles(t *testing.T) {
+	tests := []struct {
+		name        string
+		permissions []string
+		status      int
+	}{
+		{"caller lacking what the role grants", []string{"service_account.write"}, http.StatusForbidden},
+		{"caller holding what the role grants", []string{"service_account.write", "user.admin"}, http.StatusCreated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, script := dbtest.Open(t)
+			scriptServiceAccount(script, adminRole)
+			script.On("INSERT INTO users", nil)
+			script.On("INSERT INTO user_roles", nil, []driver.Value{})
+			script.On("INSERT INTO user_groups", nil)
+			script.On("INSERT INTO audit_logs", nil)
+
+			h := &ServiceAccountHandler{db: db, accounts: serviceaccount.NewStore(db)}
+			body := `{"name": "deploy", "role_ids": ["` + adminRole + `"]}`
+			w := serve(h.CreateServiceAccount, "POST", "/service-accounts", "/service-accounts", body, tt.permissions...)
+			expectStatus(t, tt.name, w, tt.status)
+			if created := script.Ran("INSERT INTO users"); created != (tt.status == http.StatusCreated) {
+				t.Errorf("%s: expected the account to be created only when allowed, created: %v", tt.name, created)
+			}
+		})
+	}
+}
+
+func TestServiceAccountHandler_TokenScopes(t *testing.T) {
+	tests := []struct {
+		name        string
+		permissions []string
+		status      int
+	}{
+		{"scope the caller lacks", []string{"service_account.write"}, http.StatusForbidden},
+		{"scope the caller holds", []string{"service_account.write", "user.admin"}, http.StatusCreated},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, script := dbtest.Open(t)
+			scriptServiceAccount(script)
+			script.On("INSERT INTO api_tokens", nil, []driver.Value{"token-1", "tenant-1", deployAccount, "", "service_account",
+				"ci", "fia_abcd", []byte("{user.admin}"), nil, nil, nil, time.Now()})
+			script.On("INSERT INTO audit_logs", nil)
+
+			h := &ServiceAccountHandler{db: db, accounts: serviceaccount.NewStore(db), tokens: token.NewAPITokenStore(db)}
+			w := serve(h.CreateServiceAccountToken, "POST", "/service-accounts/:id/tokens", "/service-accounts/"+deployAccount+"/tokens",
+				`{"name": "ci", "scopes": ["user.admin"]}`, tt.permissions...)
+			expectStatus(t, tt.name, w, tt.status)
+			if issued := script.Ran("INSERT INTO api_tokens"); issued != (tt.status == http.StatusCreated) {
+				t.Errorf("%s: expected a key only when allowed, issued: %v", tt.name, issued)
+			}
+		})
+	}
+}
+
+func TestServiceAccountHandler_ClientActsAsAccount(t *testing.T) {
+	// A client of the account gets tokens carrying all its permissions, so
+	// the caller must hold those besides the scopes
+	db, script := dbtest.Open(t)
+	scriptServiceAccount(script, adminRole)
+
+	h := &ServiceAccountHandler{db: db, accounts: serviceaccount.NewStore(db), clients: oauth.NewClientStore(db)}
+	w := serve(h.CreateServiceAccountClient, "POST", "/service-accounts/:id/clients", "/service-accounts/"+deployAccount+"/clients",
+		`{"name": "ci", "scopes": []}`, "service_account.write", "client.write")
+	expectStatus(t, "client of an account with more permissions", w, http.StatusForbidden)
+	if script.Ran("INSERT INTO oauth_clients") {
+		t.Error("Expected no client to be registered")
+	}
+}
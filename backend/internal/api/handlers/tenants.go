@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+type TenantHandler struct {
+	db *sql.DB
+}
+
+func NewTenantHandler(db *sql.DB) *TenantHandler {
+	return &TenantHandler{db: db}
+}
+
+type TenantSettings struct {
+	ID              string   `json:"id"`
+	Name            string   `json:"name"`
+	MFARequired     bool     `json:"mfa_required"`
+	WebAuthnRPID    *string  `json:"webauthn_rp_id"`
+	WebAuthnRPName  *string  `json:"webauthn_rp_name"`
+	WebAuthnOrigins []string `json:"webauthn_origins"`
+}
+
+// UpdateTenantSettingsRequest only changes the fields that are present.
+type UpdateTenantSettingsRequest struct {
+	MFARequired     *bool     `json:"mfa_required,omitempty"`
+	WebAuthnRPID    *string   `json:"webauthn_rp_id,omitempty"`
+	WebAuthnRPName  *string   `json:"webauthn_rp_name,omitempty"`
+	WebAuthnOrigins *[]string `json:"webauthn_origins,omitempty"`
+}
+
+func (h *TenantHandler) GetSettings(c *gin.Context) {
+	tenantID, _ := c.Get("tenant_id")
+
+	var settings TenantSettings
+	err := h.db.QueryRow(`
+		SELECT id, name, COALESCE(mfa_required, false), webauthn_rp_id, webauthn_rp_name, webauthn_origins
+		FROM tenants
+		WHERE id = $1
+	`, tenantID).Scan(&settings.ID, &settings.Name, &settings.MFARequired,
+		&settings.WebAuthnRPID, &settings.WebAuthnRPName, pq.Array(&settings.WebAuthnOrigins))
+
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Tenant not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, settings)
+}
+
+func (h *TenantHandler) UpdateSettings(c *gin.Context) {
+	tenantID := c.GetString("tenant_id")
+
+	var req UpdateTenantSettingsRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if req.MFARequired == nil && req.WebAuthnRPID == nil && req.WebAuthnRPName == nil && req.WebAuthnOrigins == nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No fields to update"})
+		return
+	}
+
+	var origins interface{}
+	if req.WebAuthnOrigins != nil {
+		origins = pq.Array(*req.WebAuthnOrigins)
+	}
+
+	_, err := h.db.Exec(`
+		UPDATE tenants
+		SET mfa_required = COALESCE($1, mfa_required),
+		    webauthn_rp_id = COALESCE($2, webauthn_rp_id),
+		    webauthn_rp_name = COALESCE($3, webauthn_rp_name),
+		    webauthn_origins = COALESCE($4, webauthn_origins)
+		WHERE id = $5
+	`, req.MFARequired, req.WebAuthnRPID, req.WebAuthnRPName, origins, tenantID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update tenant settings"})
+		return
+	}
+
+	writeAudit(h.db, tenantID, c.GetString("user_id"), "tenant.settings_update", "tenant", tenantID, "success", c.ClientIP(), c.GetHeader("User-Agent"))
+
+	c.JSON(http.StatusOK, gin.H{"message": "Tenant settings updated successfully"})
+}
@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+
+	"github.com/ForIAM/ForIAM/backend/internal/api/middleware"
+	"github.com/ForIAM/ForIAM/backend/internal/token"
+	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
+)
+
+// TokenHandler manages API keys. Users create keys for themselves, limited
+// to permissions they hold; a key can be revoked by its owner and by anyone
+// holding token.delete in the tenant.
+type TokenHandler struct {
+	db       *sql.DB
+	tokens   *token.APITokenStore
+	resolver middleware.PermissionResolver
+}
+
+func NewTokenHandler(db *sql.DB, resolver middleware.PermissionResolver) *TokenHandler {
+	return &TokenHandler{db: db, tokens: token.NewAPITokenStore(db), resolver: resolver}
+}
+
+// CreateTokenRequest creates an API key. Scopes are permission names; keys
+// without expires_at do not expire.
+type CreateTokenRequest struct {
+	Name      string     `json:"name" binding:"required"`
+	Scopes    []string   `json:"scopes" binding:"required,min=1"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+// CreateTokenResponse carries the key itself, which is only shown once.
+type CreateTokenResponse struct {
+	*token.APIToken
+	Token string `json:"token"`
+}
+
+// GetTokens lists the caller's own API keys.
+func (h *TokenHandler) GetTokens(c *gin.Context) {
+	tokens, err := h.tokens.List(c.GetString("tenant_id"), c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, tokens)
+}
+
+// GetUserTokens lists the API keys of a user of the tenant.
+func (h *TokenHandler) GetUserTokens(c *gin.Context) {
+	tokens, err := h.tokens.List(c.GetString("tenant_id"), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, tokens)
+}
+
+func (h *TokenHandler) CreateToken(c *gin.Context) {
+	var req CreateTokenRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.ExpiresAt != nil && !req.ExpiresAt.After(time.Now()) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "expires_at must be in the future"})
+		return
+	}
+
+	// A key can never do more than its owner
+	scopes := dedupe(req.Scopes)
+	if !checkGrantable(c, h.db, h.resolver, scopes) {
+		return
+	}
+
+	tenantID := c.GetString("tenant_id")
+	userID := c.GetString("user_id")
+	raw, created, err := h.tokens.Create(tenantID, userID, req.Name, scopes, req.ExpiresAt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create token"})
+		return
+	}
+
+	writeAudit(h.db, tenantID, userID, "token.create", "api_token", created.ID, "success", c.ClientIP(), c.GetHeader("User-Agent"))
+
+	c.JSON(http.StatusCreated, CreateTokenResponse{APIToken: created, Token: raw})
+}
+
+// DeleteToken revokes an API key. Owners may revoke their own keys; other
+// keys of the tenant need token.delete.
+func (h *TokenHandler) DeleteToken(c *gin.Context) {
+	tenantID := c.GetString("tenant_id")
+	userID := c.GetString("user_id")
+
+	existing, err := h.tokens.Get(tenantID, c.Param("id"))
+	if err == token.ErrAPITokenNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Token not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	if existing.UserID != userID {
+		allowed, err := middleware.HasPermission(c, h.resolver, "token.delete")
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to resolve permissions"})
+			return
+		}
+		if !allowed {
+			// Someone else's key is not even confirmed to exist
+			c.JSON(http.StatusNotFound, gin.H{"error": "Token not found"})
+			return
+		}
+	}
+
+	err = h.tokens.Delete(tenantID, existing.ID)
+	if err == token.ErrAPITokenNotFound {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Token not found"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete token"})
+		return
+	}
+
+	writeAudit(h.db, tenantID, userID, "token.delete", "api_token", existing.ID, "success", c.ClientIP(), c.GetHeader("User-Agent"))
+
+	c.JSON(http.StatusOK, gin.H{"message": "Token revoked successfully"})
+}
+
+// checkGrantable answers the request and returns false unless every one of
+// permissions exists and is held by the caller, who cannot hand out more
+// than they have.
+func checkGrantable(c *gin.Context, db *sql.DB, resolver middleware.PermissionResolver, permissions []string) bool {
+	var known int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM permissions WHERE name = ANY($1)`, pq.Array(permissions)).Scan(&known); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return false
+	}
+	if known != len(permissions) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown scope; scopes must be permission names"})
+		return false
+	}
+
+	for _, permission := range permissions {
+		allowed, err := middleware.HasPermission(c, resolver, permission)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to resolve permissions"})
+			return false
+		}
+		if !allowed {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Insufficient permissions", "permission": permission})
+			return false
+		}
+	}
+	return true
+}
+
+func dedupe(values []string) []string {
+	seen := make(map[string]bool, len(values))
+	unique := []string{}
+	for _, v := range values {
+		if !seen[v] {
+			seen[v] = true
+			unique = append(unique, v)
+		}
+	}
+	return unique
+}
@@ -0,0 +1,47 @@
+package handlers
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestTokenHandler_CreateTokenValidation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	h := &TokenHandler{}
+	router := gin.New()
+	router.POST("/tokens", h.CreateToken)
+
+	past := time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	tests := []struct {
+		name string
+		body string
+	}{
+		{"no name", `{"scopes": ["user.read"]}`},
+		{"no scopes", `{"name": "ci"}`},
+		{"empty scopes", `{"name": "ci", "scopes": []}`},
+		{"expired", `{"name": "ci", "scopes": ["user.read"], "expires_at": "` + past + `"}`},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest("POST", "/tokens", bytes.NewBufferString(tt.body))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != http.StatusBadRequest {
+			t.Errorf("%s: expected status %d, got %d", tt.name, http.StatusBadRequest, w.Code)
+		}
+	}
+}
+
+func TestDedupe(t *testing.T) {
+	got := dedupe([]string{"user.read", "user.write", "user.read"})
+	if len(got) != 2 || got[0] != "user.read" || got[1] != "user.write" {
+		t.Errorf("Expected [user.read user.write], got %v", got)
+	}
+}
@@ -2,28 +2,70 @@ package handlers
 
 import (
 	"database/sql"
+	"encoding/json"
 	"net/http"
 
+	"github.com/ForIAM/ForIAM/backend/internal/api/middleware"
+	"github.com/ForIAM/ForIAM/backend/internal/authz"
+	"github.com/ForIAM/ForIAM/backend/internal/dynamicgroup"
+	"github.com/ForIAM/ForIAM/backend/internal/provisioning"
 	"github.com/gin-gonic/gin"
 	"golang.org/x/crypto/bcrypt"
 )
 
 type UserHandler struct {
-	db *sql.DB
+	db           *sql.DB
+	resolver     middleware.PermissionResolver
+	provisioning *provisioning.Queue
+	groups       *dynamicgroup.Reconciler
 }
 
-func NewUserHandler(db *sql.DB) *UserHandler {
-	return &UserHandler{db: db}
+func NewUserHandler(db *sql.DB, resolver middleware.PermissionResolver) *UserHandler {
+	return &UserHandler{db: db, resolver: resolver, provisioning: provisioning.NewQueue(db), groups: dynamicgroup.NewReconciler(db)}
 }
 
 type CreateUserRequest struct {
-	Email    string `json:"email" binding:"required,email"`
-	Password string `json:"password" binding:"required,min=6"`
+	Email      string                 `json:"email" binding:"required,email"`
+	Password   string                 `json:"password" binding:"required,min=6"`
+	Attributes map[string]interface{} `json:"attributes"`
 }
 
+// UpdateUserRequest changes the fields it has. attributes replaces all
+// attributes of the user.
 type UpdateUserRequest struct {
-	Email    string `json:"email,omitempty"`
-	IsActive *bool  `json:"is_active,omitempty"`
+	Email      string                 `json:"email,omitempty"`
+	IsActive   *bool                  `json:"is_active,omitempty"`
+	Attributes map[string]interface{} `json:"attributes,omitempty"`
+}
+
+// attributesJSON encodes attributes for the attributes column.
+func attributesJSON(attributes map[string]interface{}) string {
+	if attributes == nil {
+		return "{}"
+	}
+	encoded, _ := json.Marshal(attributes)
+	return string(encoded)
+}
+
+// checkJoinable makes sure the caller holds every permission of the dynamic
+// groups change would add the user userID to, or a new user when userID is
+// empty, answering the request when they do not. Like adding members by
+// hand, setting attributes cannot hand out more than the caller holds.
+func (h *UserHandler) checkJoinable(c *gin.Context, userID string, change dynamicgroup.Change) bool {
+	groupIDs, err := h.groups.Joins(c.Request.Context(), c.GetString("tenant_id"), userID, change)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return false
+	}
+	if len(groupIDs) == 0 {
+		return true
+	}
+	permissions, err := authz.GroupPermissions(c.Request.Context(), h.db, groupIDs)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return false
+	}
+	return checkGrantable(c, h.db, h.resolver, permissions)
 }
 
 func (h *UserHandler) GetUsers(c *gin.Context) {
@@ -32,7 +74,7 @@ func (h *UserHandler) GetUsers(c *gin.Context) {
 	rows, err := h.db.Query(`
 		SELECT id, tenant_id, email, is_active, created_at 
 		FROM users 
-		WHERE tenant_id = $1 
+		WHERE tenant_id = $1 AND principal_type = 'user'
 		ORDER BY created_at DESC
 	`, tenantID)
 	if err != nil {
@@ -63,6 +105,10 @@ func (h *UserHandler) CreateUser(c *gin.Context) {
 
 	tenantID, _ := c.Get("tenant_id")
 
+	if !h.checkJoinable(c, "", dynamicgroup.Change{Email: req.Email, Attributes: req.Attributes}) {
+		return
+	}
+
 	// Hash password
 	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcrypt.DefaultCost)
 	if err != nil {
@@ -73,16 +119,20 @@ func (h *UserHandler) CreateUser(c *gin.Context) {
 	// Create user
 	var user User
 	err = h.db.QueryRow(`
-		INSERT INTO users (tenant_id, email, password_hash) 
-		VALUES ($1, $2, $3) 
+		INSERT INTO users (tenant_id, email, password_hash, attributes) 
+		VALUES ($1, $2, $3, $4) 
 		RETURNING id, tenant_id, email, is_active, created_at
-	`, tenantID, req.Email, string(hashedPassword)).Scan(
+	`, tenantID, req.Email, string(hashedPassword), attributesJSON(req.Attributes)).Scan(
 		&user.ID, &user.TenantID, &user.Email, &user.IsActive, &user.CreatedAt,
 	)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create user"})
 		return
 	}
+	user.Attributes = req.Attributes
+
+	queueProvisioning(h.provisioning, user.TenantID, provisioning.ResourceUser, user.ID, provisioning.OperationUpsert)
+	reconcileUser(h.groups, user.TenantID, user.ID, c.GetString("user_id"))
 
 	c.JSON(http.StatusCreated, user)
 }
@@ -92,11 +142,12 @@ func (h *UserHandler) GetUser(c *gin.Context) {
 	tenantID, _ := c.Get("tenant_id")
 
 	var user User
+	var attributes []byte
 	err := h.db.QueryRow(`
-		SELECT id, tenant_id, email, is_active, created_at 
+		SELECT id, tenant_id, email, is_active, created_at, attributes 
 		FROM users 
-		WHERE id = $1 AND tenant_id = $2
-	`, userID, tenantID).Scan(&user.ID, &user.TenantID, &user.Email, &user.IsActive, &user.CreatedAt)
+		WHERE id = $1 AND tenant_id = $2 AND principal_type = 'user'
+	`, userID, tenantID).Scan(&user.ID, &user.TenantID, &user.Email, &user.IsActive, &user.CreatedAt, &attributes)
 
 	if err == sql.ErrNoRows {
 		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
@@ -106,6 +157,10 @@ func (h *UserHandler) GetUser(c *gin.Context) {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
 		return
 	}
+	if err := json.Unmarshal(attributes, &user.Attributes); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
 
 	c.JSON(http.StatusOK, user)
 }
@@ -137,20 +192,38 @@ func (h *UserHandler) UpdateUser(c *gin.Context) {
 		args = append(args, *req.IsActive)
 	}
 
+	if req.Attributes != nil {
+		argCount++
+		query += "attributes = $" + string(rune(argCount+'0')) + ", "
+		args = append(args, attributesJSON(req.Attributes))
+	}
+
 	if argCount == 0 {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "No fields to update"})
 		return
 	}
 
+	change := dynamicgroup.Change{Email: req.Email, IsActive: req.IsActive, Attributes: req.Attributes}
+	if !h.checkJoinable(c, userID, change) {
+		return
+	}
+
 	// Remove trailing comma and add WHERE clause
-	query = query[:len(query)-2] + " WHERE id = $" + string(rune(argCount+1+'0')) + " AND tenant_id = $" + string(rune(argCount+2+'0'))
+	query = query[:len(query)-2] + " WHERE id = $" + string(rune(argCount+1+'0')) + " AND tenant_id = $" + string(rune(argCount+2+'0')) + " AND principal_type = 'user'"
 	args = append(args, userID, tenantID)
 
-	_, err := h.db.Exec(query, args...)
+	result, err := h.db.Exec(query, args...)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update user"})
 		return
 	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "User not found"})
+		return
+	}
+
+	queueProvisioning(h.provisioning, c.GetString("tenant_id"), provisioning.ResourceUser, userID, provisioning.OperationUpsert)
+	reconcileUser(h.groups, c.GetString("tenant_id"), userID, c.GetString("user_id"))
 
 	c.JSON(http.StatusOK, gin.H{"message": "User updated successfully"})
 }
@@ -161,7 +234,7 @@ func (h *UserHandler) DeleteUser(c *gin.Context) {
 
 	result, err := h.db.Exec(`
 		DELETE FROM users 
-		WHERE id = $1 AND tenant_id = $2
+		WHERE id = $1 AND tenant_id = $2 AND principal_type = 'user'
 	`, userID, tenantID)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete user"})
@@ -174,5 +247,7 @@ func (h *UserHandler) DeleteUser(c *gin.Context) {
 		return
 	}
 
+	queueProvisioning(h.provisioning, c.GetString("tenant_id"), provisioning.ResourceUser, userID, provisioning.OperationDelete)
+
 	c.JSON(http.StatusOK, gin.H{"message": "User deleted successfully"})
 }
\ No newline at end of file
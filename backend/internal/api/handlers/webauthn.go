@@ -0,0 +1,569 @@
+package handlers
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/ForIAM/ForIAM/backend/internal/lockout"
+	"github.com/ForIAM/ForIAM/backend/internal/passkey"
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+type WebAuthnBeginResponse struct {
+	SessionID string      `json:"session_id"`
+	Options   interface{} `json:"options"`
+}
+
+type WebAuthnRegisterFinishRequest struct {
+	SessionID  string          `json:"session_id" binding:"required"`
+	Name       string          `json:"name"`
+	Credential json.RawMessage `json:"credential" binding:"required"`
+}
+
+// WebAuthnLoginBeginRequest starts a passwordless login. With an email the
+// user's credentials are offered to the browser; with only a tenant name the
+// browser is asked for any discoverable credential (passkey) of that tenant.
+type WebAuthnLoginBeginRequest struct {
+	Email  string `json:"email"`
+	Tenant string `json:"tenant"`
+}
+
+type WebAuthnLoginFinishRequest struct {
+	SessionID  string          `json:"session_id" binding:"required"`
+	Credential json.RawMessage `json:"credential" binding:"required"`
+}
+
+type WebAuthnMFABeginRequest struct {
+	MFAToken string `json:"mfa_token" binding:"required"`
+}
+
+type WebAuthnMFAFinishRequest struct {
+	MFAToken   string          `json:"mfa_token" binding:"required"`
+	SessionID  string          `json:"session_id" binding:"required"`
+	Credential json.RawMessage `json:"credential" binding:"required"`
+}
+
+// relyingParty builds the WebAuthn relying party of a tenant, falling back to
+// the server-wide defaults for anything the tenant has not configured.
+func (h *AuthHandler) relyingParty(tenantID string) (*webauthn.WebAuthn, error) {
+	var rpID, rpName sql.NullString
+	var origins []string
+	err := h.db.QueryRow(`
+		SELECT webauthn_rp_id, webauthn_rp_name, webauthn_origins FROM tenants WHERE id = $1
+	`, tenantID).Scan(&rpID, &rpName, pq.Array(&origins))
+	if err != nil {
+		return nil, err
+	}
+
+	rp := passkey.RelyingParty{
+		ID:          h.cfg.WebAuthnRPID,
+		DisplayName: h.cfg.WebAuthnRPName,
+		Origins:     h.cfg.WebAuthnRPOrigins,
+	}
+	if rpID.Valid && rpID.String != "" {
+		rp.ID = rpID.String
+	}
+	if rpName.Valid && rpName.String != "" {
+		rp.DisplayName = rpName.String
+	}
+	if len(origins) > 0 {
+		rp.Origins = origins
+	}
+	return passkey.New(rp)
+}
+
+// webAuthnUser loads an active user together with their credentials.
+func (h *AuthHandler) webAuthnUser(userID string) (*passkey.User, User, error) {
+	var user User
+	err := h.db.QueryRow(`
+		SELECT id, tenant_id, email, is_active, created_at
+		FROM users
+		WHERE id = $1 AND is_active = true
+	`, userID).Scan(&user.ID, &user.TenantID, &user.Email, &user.IsActive, &user.CreatedAt)
+	if err != nil {
+		return nil, user, err
+	}
+
+	creds, err := h.passkeys.Credentials(user.ID)
+	if err != nil {
+		return nil, user, err
+	}
+	return &passkey.User{ID: user.ID, Email: user.Email, Credentials: creds}, user, nil
+}
+
+// BeginPasskeyRegistration starts registering a new passkey or security key
+// for the calling user.
+func (h *AuthHandler) BeginPasskeyRegistration(c *gin.Context) {
+	tenantID := c.GetString("tenant_id")
+
+	w, err := h.relyingParty(tenantID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "WebAuthn is not configured for this tenant"})
+		return
+	}
+
+	wUser, _, err := h.webAuthnUser(c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	options, session, err := w.BeginRegistration(wUser, webauthn.WithExclusions(wUser.Exclusions()))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start registration"})
+		return
+	}
+
+	sessionID, err := h.passkeys.SaveSession(tenantID, wUser.ID, passkey.PurposeRegistration, session)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start registration"})
+		return
+	}
+
+	c.JSON(http.StatusOK, WebAuthnBeginResponse{SessionID: sessionID, Options: options})
+}
+
+func (h *AuthHandler) FinishPasskeyRegistration(c *gin.Context) {
+	var req WebAuthnRegisterFinishRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if _, err := uuid.Parse(req.SessionID); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid session ID"})
+		return
+	}
+
+	userID := c.GetString("user_id")
+
+	tenantID, sessionUserID, session, err := h.passkeys.TakeSession(req.SessionID, passkey.PurposeRegistration)
+	if err == sql.ErrNoRows || (err == nil && sessionUserID != userID) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Registration session not found or expired"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	w, err := h.relyingParty(tenantID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "WebAuthn is not configured for this tenant"})
+		return
+	}
+
+	wUser, _, err := h.webAuthnUser(userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	parsed, err := passkey.ParseAttestation(req.Credential)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid credential"})
+		return
+	}
+
+	cred, err := w.CreateCredential(wUser, *session, parsed)
+	if err != nil {
+		writeAudit(h.db, tenantID, userID, "webauthn.register", "", "", "failure", c.ClientIP(), c.GetHeader("User-Agent"))
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Credential verification failed"})
+		return
+	}
+
+	id, err := h.passkeys.Create(tenantID, userID, req.Name, cred)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store credential"})
+		return
+	}
+
+	writeAudit(h.db, tenantID, userID, "webauthn.register", "webauthn_credential", id, "success", c.ClientIP(), c.GetHeader("User-Agent"))
+
+	c.JSON(http.StatusCreated, gin.H{"id": id, "message": "Passkey registered successfully"})
+}
+
+func (h *AuthHandler) GetPasskeys(c *gin.Context) {
+	creds, err := h.passkeys.List(c.GetString("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, creds)
+}
+
+func (h *AuthHandler) DeletePasskey(c *gin.Context) {
+	credentialID := c.Param("id")
+	userID := c.GetString("user_id")
+	tenantID := c.GetString("tenant_id")
+
+	if _, err := uuid.Parse(credentialID); err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Passkey not found"})
+		return
+	}
+
+	// Same rule as for TOTP devices: keep at least one second factor while
+	// the tenant requires MFA
+	var tenantRequired bool
+	var remaining int
+	err := h.db.QueryRow(`
+		SELECT COALESCE(t.mfa_required, false),
+		       (SELECT COUNT(*) FROM mfa_devices WHERE user_id = $1 AND confirmed_at IS NOT NULL) +
+		       (SELECT COUNT(*) FROM webauthn_credentials WHERE user_id = $1 AND id <> $2)
+		FROM tenants t
+		WHERE t.id = $3
+	`, userID, credentialID, tenantID).Scan(&tenantRequired, &remaining)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if tenantRequired && remaining == 0 {
+		c.JSON(http.StatusConflict, gin.H{"error": "Cannot remove the last MFA device while MFA is required"})
+		return
+	}
+
+	deleted, err := h.passkeys.Delete(userID, credentialID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete passkey"})
+		return
+	}
+	if !deleted {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Passkey not found"})
+		return
+	}
+
+	writeAudit(h.db, tenantID, userID, "webauthn.remove", "webauthn_credential", credentialID, "success", c.ClientIP(), c.GetHeader("User-Agent"))
+
+	c.JSON(http.StatusOK, gin.H{"message": "Passkey deleted successfully"})
+}
+
+// BeginPasskeyLogin starts a passwordless login.
+func (h *AuthHandler) BeginPasskeyLogin(c *gin.Context) {
+	var req WebAuthnLoginBeginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	var tenantID, userID string
+	var options *protocol.CredentialAssertion
+	var session *webauthn.SessionData
+
+	switch {
+	case req.Email != "":
+		email := normalizeEmail(req.Email)
+		err := h.db.QueryRow(`
+			SELECT id, tenant_id FROM users WHERE lower(email) = $1 AND is_active = true AND principal_type = 'user'
+		`, email).Scan(&userID, &tenantID)
+		if err != nil && err != sql.ErrNoRows {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+
+		// A locked account cannot start a passkey login either
+		if !h.checkLoginAllowed(c, User{ID: userID, TenantID: tenantID}, email) {
+			return
+		}
+
+		var wUser *passkey.User
+		if err == nil {
+			wUser, _, err = h.webAuthnUser(userID)
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+				return
+			}
+		}
+		if wUser == nil || len(wUser.Credentials) == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Passkey login is not available for this account"})
+			return
+		}
+
+		w, err := h.relyingParty(tenantID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "WebAuthn is not configured for this tenant"})
+			return
+		}
+		options, session, err = w.BeginLogin(wUser, webauthn.WithUserVerification(protocol.VerificationRequired))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start login"})
+			return
+		}
+
+	case req.Tenant != "":
+		err := h.db.QueryRow(`SELECT id FROM tenants WHERE name = $1`, req.Tenant).Scan(&tenantID)
+		if err == sql.ErrNoRows {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown tenant"})
+			return
+		}
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+			return
+		}
+
+		// The account is only known once the assertion names it
+		if !h.checkLoginAllowed(c, User{TenantID: tenantID}, "") {
+			return
+		}
+
+		w, err := h.relyingParty(tenantID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "WebAuthn is not configured for this tenant"})
+			return
+		}
+		options, session, err = w.BeginDiscoverableLogin(webauthn.WithUserVerification(protocol.VerificationRequired))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start login"})
+			return
+		}
+
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Either email or tenant is required"})
+		return
+	}
+
+	sessionID, err := h.passkeys.SaveSession(tenantID, userID, passkey.PurposeLogin, session)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start login"})
+		return
+	}
+
+	c.JSON(http.StatusOK, WebAuthnBeginResponse{SessionID: sessionID, Options: options})
+}
+
+// FinishPasskeyLogin verifies the assertion of a passwordless login and
+// issues tokens. A passkey is a complete login on its own, so no further MFA
+// challenge follows; the authenticator must have verified the user with a
+// PIN or biometric for that to hold. Failures count towards the same lockout
+// as wrong passwords.
+func (h *AuthHandler) FinishPasskeyLogin(c *gin.Context) {
+	var req WebAuthnLoginFinishRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if _, err := uuid.Parse(req.SessionID); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid session ID"})
+		return
+	}
+
+	tenantID, userID, session, err := h.passkeys.TakeSession(req.SessionID, passkey.PurposeLogin)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Login session not found or expired"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	w, err := h.relyingParty(tenantID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "WebAuthn is not configured for this tenant"})
+		return
+	}
+
+	parsed, err := passkey.ParseAssertion(req.Credential)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid credential"})
+		return
+	}
+	var user User
+	var cred *webauthn.Credential
+	if userID != "" {
+		var wUser *passkey.User
+		wUser, user, err = h.webAuthnUser(userID)
+		if err == nil {
+			cred, err = w.ValidateLogin(wUser, *session, parsed)
+		}
+	} else {
+		cred, err = w.ValidateDiscoverableLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+			wUser, u, err := h.webAuthnUser(string(userHandle))
+			if err != nil {
+				return nil, err
+			}
+			if u.TenantID != tenantID {
+				return nil, sql.ErrNoRows
+			}
+			user = u
+			return wUser, nil
+		}, *session, parsed)
+	}
+	if err == nil {
+		err = passkey.CheckSignCount(cred)
+	}
+	if err == nil {
+		err = passkey.CheckUserVerified(cred)
+	}
+	if err != nil {
+		if user.TenantID == "" {
+			user.TenantID = tenantID
+		}
+		h.loginFailed(c, user, user.Email, lockout.ReasonInvalidPasskey)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Passkey verification failed"})
+		return
+	}
+
+	// A valid passkey does not lift a lockout, just as a valid password does
+	// not
+	if !h.checkLoginAllowed(c, user, user.Email) {
+		return
+	}
+
+	if err := h.passkeys.RecordUse(cred); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update credential"})
+		return
+	}
+
+	response, err := h.startSession(user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	h.loginSucceeded(c, user)
+	h.logAudit(user.TenantID, user.ID, "auth.login", "webauthn", "success", c.ClientIP(), c.GetHeader("User-Agent"))
+
+	c.JSON(http.StatusOK, response)
+}
+
+// BeginMFAWebAuthn starts a WebAuthn assertion as the second factor of a
+// password login that returned an MFA challenge.
+func (h *AuthHandler) BeginMFAWebAuthn(c *gin.Context) {
+	var req WebAuthnMFABeginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID, _, _, err := h.parseMFAChallenge(c, req.MFAToken)
+	if err == errInvalidMFAToken {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired MFA token"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify MFA token"})
+		return
+	}
+
+	wUser, user, err := h.webAuthnUser(userID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired MFA token"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+	if len(wUser.Credentials) == 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No security keys registered"})
+		return
+	}
+
+	w, err := h.relyingParty(user.TenantID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "WebAuthn is not configured for this tenant"})
+		return
+	}
+
+	options, session, err := w.BeginLogin(wUser)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start verification"})
+		return
+	}
+
+	sessionID, err := h.passkeys.SaveSession(user.TenantID, user.ID, passkey.PurposeMFA, session)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to start verification"})
+		return
+	}
+
+	c.JSON(http.StatusOK, WebAuthnBeginResponse{SessionID: sessionID, Options: options})
+}
+
+func (h *AuthHandler) FinishMFAWebAuthn(c *gin.Context) {
+	var req WebAuthnMFAFinishRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if _, err := uuid.Parse(req.SessionID); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid session ID"})
+		return
+	}
+
+	userID, jti, expiresAt, err := h.parseMFAChallenge(c, req.MFAToken)
+	if err == errInvalidMFAToken {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired MFA token"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify MFA token"})
+		return
+	}
+
+	_, sessionUserID, session, err := h.passkeys.TakeSession(req.SessionID, passkey.PurposeMFA)
+	if err == sql.ErrNoRows || (err == nil && sessionUserID != userID) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Verification session not found or expired"})
+		return
+	}
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Database error"})
+		return
+	}
+
+	wUser, user, err := h.webAuthnUser(userID)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid or expired MFA token"})
+		return
+	}
+
+	w, err := h.relyingParty(user.TenantID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "WebAuthn is not configured for this tenant"})
+		return
+	}
+
+	parsed, err := passkey.ParseAssertion(req.Credential)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid credential"})
+		return
+	}
+
+	cred, err := w.ValidateLogin(wUser, *session, parsed)
+	if err == nil {
+		err = passkey.CheckSignCount(cred)
+	}
+	if err != nil {
+		h.logAudit(user.TenantID, user.ID, "auth.mfa_verify", "webauthn", "failure", c.ClientIP(), c.GetHeader("User-Agent"))
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Security key verification failed"})
+		return
+	}
+
+	if err := h.passkeys.RecordUse(cred); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to update credential"})
+		return
+	}
+
+	// A challenge can only be answered once
+	if err := h.revocations.Revoke(c.Request.Context(), jti, time.Until(expiresAt)); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to revoke MFA token"})
+		return
+	}
+
+	response, err := h.startSession(user)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate token"})
+		return
+	}
+
+	h.loginSucceeded(c, user)
+	h.logAudit(user.TenantID, user.ID, "auth.login", "webauthn", "success", c.ClientIP(), c.GetHeader("User-Agent"))
+
+	c.JSON(http.StatusOK, response)
+}
@@ -1,16 +1,87 @@
 package middleware
 
 import (
+	"crypto/x509"
 	"net/http"
 	"strings"
 
+	"github.com/ForIAM/ForIAM/backend/internal/serviceaccount"
+	"github.com/ForIAM/ForIAM/backend/internal/token"
 	"github.com/gin-gonic/gin"
-	"github.com/golang-jwt/jwt/v5"
 )
 
-func AuthMiddleware(jwtSecret string) gin.HandlerFunc {
+// APIKeyAuthenticator resolves the API key a request is made with.
+type APIKeyAuthenticator interface {
+	Authenticate(raw, ip string) (*token.APIToken, error)
+}
+
+// CertificateAuthenticator resolves the service account a verified TLS
+// client certificate is registered for.
+type CertificateAuthenticator interface {
+	AuthenticateCertificate(cert *x509.Certificate) (*serviceaccount.ServiceAccount, error)
+}
+
+// AuthMiddleware accepts access tokens and, when apiKeys is not nil, API
+// keys. Requests made with an API key carry its scopes as "api_key_scopes";
+// those made with a scoped token of a service account, issued to one of
+// its OAuth clients, carry the token's scopes as "token_scopes".
+// When certificates is not nil, a request without an Authorization header
+// may authenticate a service account with its TLS client certificate.
+//
+// "principal_type" tells users and service accounts apart, and
+// "auth_method" is one of token, api_key or certificate.
+func AuthMiddleware(validator *token.Validator, apiKeys APIKeyAuthenticator, certificates CertificateAuthenticator) gin.HandlerFunc {
+	return authenticate(validator, apiKeys, certificates, token.TypeAccess)
+}
+
+// MFAEnrollmentMiddleware also accepts the enrollment token issued by a
+// password login when the tenant requires MFA and the user has no device yet.
+func MFAEnrollmentMiddleware(validator *token.Validator) gin.HandlerFunc {
+	return authenticate(validator, nil, nil, token.TypeAccess, token.TypeMFAEnrollment)
+}
+
+// RequireSession turns away requests made with an API key and requests of
+// service accounts. It guards what only a signed-in user may do, such as
+// managing their sign-in methods.
+func RequireSession() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := c.Get("api_key_id"); ok {
+			c.JSON(http.StatusForbidden, gin.H{"error": "API keys cannot be used here"})
+			c.Abort()
+			return
+		}
+		if c.GetString("principal_type") == serviceaccount.PrincipalServiceAccount {
+			c.JSON(http.StatusForbidden, gin.H{"error": "Service accounts cannot be used here"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+func authenticate(validator *token.Validator, apiKeys APIKeyAuthenticator, certificates CertificateAuthenticator, allowedTypes ...string) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		authHeader := c.GetHeader("Authorization")
+		if cert := clientCertificate(c); authHeader == "" && certificates != nil && cert != nil {
+			account, err := certificates.AuthenticateCertificate(cert)
+			if err == serviceaccount.ErrUnknownCertificate {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Unknown client certificate", "code": "certificate_invalid"})
+				c.Abort()
+				return
+			}
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify client certificate"})
+				c.Abort()
+				return
+			}
+
+			c.Set("user_id", account.ID)
+			c.Set("tenant_id", account.TenantID)
+			c.Set("principal_type", serviceaccount.PrincipalServiceAccount)
+			c.Set("auth_method", "certificate")
+			c.Next()
+			return
+		}
 		if authHeader == "" {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "Authorization header required"})
 			c.Abort()
@@ -24,22 +95,101 @@ func AuthMiddleware(jwtSecret string) gin.HandlerFunc {
 			return
 		}
 
-		token, err := jwt.Parse(tokenString, func(token *jwt.Token) (interface{}, error) {
-			return []byte(jwtSecret), nil
-		})
+		if apiKeys != nil && token.IsAPIKey(tokenString) {
+			key, err := apiKeys.Authenticate(tokenString, c.ClientIP())
+			if err == token.ErrAPITokenInvalid {
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key", "code": "api_key_invalid"})
+				c.Abort()
+				return
+			}
+			if err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify API key"})
+				c.Abort()
+				return
+			}
 
-		if err != nil || !token.Valid {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
-			c.Abort()
+			c.Set("user_id", key.UserID)
+			c.Set("tenant_id", key.TenantID)
+			c.Set("email", key.Email)
+			c.Set("api_key_id", key.ID)
+			c.Set("api_key_scopes", key.Scopes)
+			c.Set("principal_type", key.PrincipalType)
+			c.Set("auth_method", "api_key")
+			c.Next()
+			return
+		}
+
+		claims, err := validator.Validate(c.Request.Context(), tokenString, allowedTypes...)
+		if err != nil {
+			AbortWithTokenError(c, err)
 			return
 		}
 
-		if claims, ok := token.Claims.(jwt.MapClaims); ok {
-			c.Set("user_id", claims["user_id"])
-			c.Set("tenant_id", claims["tenant_id"])
-			c.Set("email", claims["email"])
+		c.Set("user_id", claims.UserID)
+		c.Set("tenant_id", claims.TenantID)
+		c.Set("email", claims.Email)
+		c.Set("jti", claims.JTI)
+		c.Set("token_type", claims.Type)
+		c.Set("token_expires_at", claims.ExpiresAt)
+		c.Set("principal_type", principalType(claims))
+		c.Set("auth_method", "token")
+		if scopes := tokenScopes(claims); scopes != nil {
+			c.Set("token_scopes", scopes)
 		}
 
 		c.Next()
 	}
-}
\ No newline at end of file
+}
+
+// clientCertificate returns the TLS client certificate of the request once
+// the server has verified its chain against the configured client CAs.
+func clientCertificate(c *gin.Context) *x509.Certificate {
+	state := c.Request.TLS
+	if state == nil || len(state.VerifiedChains) == 0 || len(state.PeerCertificates) == 0 {
+		return nil
+	}
+	return state.PeerCertificates[0]
+}
+
+// principalType reads the principal_type claim of tokens issued to service
+// accounts. Tokens without it were issued to users.
+func principalType(claims *token.Claims) string {
+	if value, ok := claims.Raw["principal_type"].(string); ok && value != "" {
+		return value
+	}
+	return serviceaccount.PrincipalUser
+}
+
+// tokenScopes returns the scopes a token of a service account is limited
+// to, or nil when it is not limited: tokens of clients without scopes act
+// with every permission of the account.
+func tokenScopes(claims *token.Claims) []string {
+	if principalType(claims) != serviceaccount.PrincipalServiceAccount {
+		return nil
+	}
+	scope, _ := claims.Raw["scope"].(string)
+	if scopes := strings.Fields(scope); len(scopes) > 0 {
+		return scopes
+	}
+	return nil
+}
+
+// AbortWithTokenError answers a failed token validation. Validation errors
+// are 401 with a machine readable code, e.g. "token_expired" or
+// "token_revoked"; anything else, such as an unreachable revocation store,
+// is a 500.
+func AbortWithTokenError(c *gin.Context, err error) {
+	code := token.ErrorCode(err)
+	if code == "" {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to verify token"})
+		c.Abort()
+		return
+	}
+
+	message := err.Error()
+	c.JSON(http.StatusUnauthorized, gin.H{
+		"error": strings.ToUpper(message[:1]) + message[1:],
+		"code":  code,
+	})
+	c.Abort()
+}
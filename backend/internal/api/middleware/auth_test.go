@@ -0,0 +1,390 @@
+package middleware
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ForIAM/ForIAM/backend/internal/serviceaccount"
+	"github.com/ForIAM/ForIAM/backend/internal/signing"
+	"github.com/ForIAM/ForIAM/backend/internal/token"
+	"github.com/gin-gonic/gin"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+var testKeys = func() *signing.KeySet {
+	key, err := signing.GenerateKey(signing.ES256)
+	if err != nil {
+		panic(err)
+	}
+	return signing.NewKeySet(key)
+}()
+
+const (
+	testIssuer   = "https://iam.example.com"
+	testAudience = "foriam-api"
+)
+
+func testValidator(store token.RevocationStore) *token.Validator {
+	return token.NewValidator(testKeys.Keyfunc, store, token.ValidatorOptions{
+		Algorithms: []string{signing.ES256},
+		Issuer:     testIssuer,
+		Audience:   testAudience,
+		Leeway:     30 * time.Second,
+	})
+}
+
+// signTestToken signs claims with the test key, adding the expected issuer
+// and audience unless the claims set their own.
+func signTestToken(t *testing.T, claims jwt.MapClaims) string {
+	if _, ok := claims["iss"]; !ok {
+		claims["iss"] = testIssuer
+	}
+	if _, ok := claims["aud"]; !ok {
+		claims["aud"] = testAudience
+	}
+	signed, err := testKeys.Sign(claims)
+	if err != nil {
+		t.Fatalf("Failed to sign token: %v", err)
+	}
+	return signed
+}
+
+func performAuthRequest(router *gin.Engine, bearer string) *httptest.ResponseRecorder {
+	req, _ := http.NewRequest("GET", "/protected", nil)
+	if bearer != "" {
+		req.Header.Set("Authorization", "Bearer "+bearer)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestAuthMiddleware_Revocation(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	store := token.NewMemoryRevocationStore()
+	router := gin.New()
+	router.GET("/protected", AuthMiddleware(testValidator(store), nil, nil), func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"user_id": c.GetString("user_id")})
+	})
+
+	now := time.Now()
+	signed := signTestToken(t, jwt.MapClaims{
+		"user_id":   "user-1",
+		"tenant_id": "tenant-1",
+		"jti":       "jti-1",
+		"typ":       token.TypeAccess,
+		"iat":       now.Add(-time.Minute).Unix(),
+		"exp":       now.Add(time.Hour).Unix(),
+	})
+
+	if w := performAuthRequest(router, signed); w.Code != http.StatusOK {
+		t.Fatalf("Expected status %d, got %d", http.StatusOK, w.Code)
+	}
+
+	store.Revoke(context.Background(), "jti-1", time.Hour)
+
+	if w := performAuthRequest(router, signed); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d for revoked token, got %d", http.StatusUnauthorized, w.Code)
+	}
+}
+
+func TestAuthMiddleware_RejectsTokenWithoutJTI(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	router.GET("/protected", AuthMiddleware(testValidator(token.NewMemoryRevocationStore()), nil, nil), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	signed := signTestToken(t, jwt.MapClaims{
+		"user_id": "user-1",
+		"exp":     time.Now().Add(time.Hour).Unix(),
+	})
+
+	if w := performAuthRequest(router, signed); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d, got %d", http.StatusUnauthorized, w.Code)
+	}
+	if w := performAuthRequest(router, ""); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected status %d without header, got %d", http.StatusUnauthorized, w.Code)
+	}
+}
+
+func TestAuthMiddleware_TokenTypes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	store := token.NewMemoryRevocationStore()
+	router := gin.New()
+	router.GET("/protected", AuthMiddleware(testValidator(store), nil, nil), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	router.GET("/enroll", MFAEnrollmentMiddleware(testValidator(store)), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	enrollment := signTestToken(t, jwt.MapClaims{
+		"user_id": "user-1",
+		"jti":     "jti-1",
+		"typ":     token.TypeMFAEnrollment,
+		"exp":     time.Now().Add(time.Hour).Unix(),
+	})
+
+	if w := performAuthRequest(router, enrollment); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected enrollment token to be rejected by the API, got %d", w.Code)
+	}
+
+	req, _ := http.NewRequest("GET", "/enroll", nil)
+	req.Header.Set("Authorization", "Bearer "+enrollment)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected enrollment token to be accepted for enrollment, got %d", w.Code)
+	}
+}
+
+func TestAuthMiddleware_ErrorCodes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	store := token.NewMemoryRevocationStore()
+	router := gin.New()
+	router.GET("/protected", AuthMiddleware(testValidator(store), nil, nil), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	claims := func(overrides jwt.MapClaims) jwt.MapClaims {
+		base := jwt.MapClaims{
+			"user_id": "user-1",
+			"jti":     "jti-1",
+			"typ":     token.TypeAccess,
+			"iat":     time.Now().Add(-time.Minute).Unix(),
+			"exp":     time.Now().Add(time.Hour).Unix(),
+		}
+		for k, v := range overrides {
+			base[k] = v
+		}
+		return base
+	}
+
+	hs256, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, claims(jwt.MapClaims{
+		"iss": testIssuer,
+		"aud": testAudience,
+	})).SignedString([]byte("secret"))
+
+	tests := []struct {
+		name  string
+		token string
+		code  string
+	}{
+		{"expired", signTestToken(t, claims(jwt.MapClaims{"exp": time.Now().Add(-time.Minute).Unix()})), "token_expired"},
+		{"wrong audience", signTestToken(t, claims(jwt.MapClaims{"aud": "other-api"})), "token_invalid_audience"},
+		{"wrong issuer", signTestToken(t, claims(jwt.MapClaims{"iss": "https://evil.example.com"})), "token_invalid_issuer"},
+		{"not yet valid", signTestToken(t, claims(jwt.MapClaims{"nbf": time.Now().Add(time.Hour).Unix()})), "token_not_yet_valid"},
+		{"algorithm not allowed", hs256, "token_algorithm_not_allowed"},
+		{"malformed", "not-a-jwt", "token_malformed"},
+	}
+
+	for _, tt := range tests {
+		w := performAuthRequest(router, tt.token)
+		if w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: expected status %d, got %d", tt.name, http.StatusUnauthorized, w.Code)
+		}
+		if !strings.Contains(w.Body.String(), `"code":"`+tt.code+`"`) {
+			t.Errorf("%s: expected code %s, got %s", tt.name, tt.code, w.Body.String())
+		}
+	}
+
+	// Within the leeway an expired token is still accepted
+	if w := performAuthRequest(router, signTestToken(t, claims(jwt.MapClaims{"exp": time.Now().Add(-10 * time.Second).Unix()}))); w.Code != http.StatusOK {
+		t.Errorf("Expected token within the leeway to be accepted, got %d", w.Code)
+	}
+
+	store.Revoke(context.Background(), "jti-1", time.Hour)
+	w := performAuthRequest(router, signTestToken(t, claims(nil)))
+	if !strings.Contains(w.Body.String(), `"code":"token_revoked"`) {
+		t.Errorf("Expected code token_revoked, got %s", w.Body.String())
+	}
+}
+
+type stubAPIKeys map[string]*token.APIToken
+
+func (s stubAPIKeys) Authenticate(raw, ip string) (*token.APIToken, error) {
+	if raw == "fiam_broken" {
+		return nil, errors.New("database down")
+	}
+	if key, ok := s[raw]; ok {
+		return key, nil
+	}
+	return nil, token.ErrAPITokenInvalid
+}
+
+func TestAuthMiddleware_APIKeys(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	keys := stubAPIKeys{"fiam_valid": {ID: "key-1", TenantID: "tenant-1", UserID: "user-1", Scopes: []string{"user.read"}}}
+	router := gin.New()
+	router.GET("/protected", AuthMiddleware(testValidator(token.NewMemoryRevocationStore()), keys, nil), func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"user_id": c.GetString("user_id"), "key": c.GetString("api_key_id")})
+	})
+	router.GET("/session", AuthMiddleware(testValidator(token.NewMemoryRevocationStore()), keys, nil), RequireSession(), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	w := performAuthRequest(router, "fiam_valid")
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"key":"key-1"`) {
+		t.Errorf("Expected the API key to authenticate, got %d %s", w.Code, w.Body.String())
+	}
+	if w := performAuthRequest(router, "fiam_unknown"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected an unknown API key to be rejected, got %d", w.Code)
+	}
+	if w := performAuthRequest(router, "fiam_broken"); w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected a lookup failure to be a server error, got %d", w.Code)
+	}
+
+	req, _ := http.NewRequest("GET", "/session", nil)
+	req.Header.Set("Authorization", "Bearer fiam_valid")
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected API keys to be turned away from session routes, got %d", w.Code)
+	}
+
+	// Without a key store, anything but a valid JWT is rejected
+	noKeys := gin.New()
+	noKeys.GET("/protected", AuthMiddleware(testValidator(token.NewMemoryRevocationStore()), nil, nil), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	if w := performAuthRequest(noKeys, "fiam_valid"); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected API keys to be rejected without a key store, got %d", w.Code)
+	}
+}
+
+type stubCertificates map[string]*serviceaccount.ServiceAccount
+
+func (s stubCertificates) AuthenticateCertificate(cert *x509.Certificate) (*serviceaccount.ServiceAccount, error) {
+	if account, ok := s[cert.Subject.CommonName]; ok {
+		return account, nil
+	}
+	return nil, serviceaccount.ErrUnknownCertificate
+}
+
+func TestAuthMiddleware_ClientCertificates(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	certificates := stubCertificates{"deploy-bot": {ID: "sa-1", TenantID: "tenant-1"}}
+	router := gin.New()
+	router.GET("/protected", AuthMiddleware(testValidator(token.NewMemoryRevocationStore()), nil, certificates), func(c *gin.Context) {
+		c.JSON(http.StatusOK, gin.H{"user_id": c.GetString("user_id"), "principal": c.GetString("principal_type")})
+	})
+	router.GET("/session", AuthMiddleware(testValidator(token.NewMemoryRevocationStore()), nil, certificates), RequireSession(), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	request := func(path, commonName string, verified bool) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("GET", path, nil)
+		cert := &x509.Certificate{Subject: pkix.Name{CommonName: commonName}}
+		req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+		if verified {
+			req.TLS.VerifiedChains = [][]*x509.Certificate{{cert}}
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	w := request("/protected", "deploy-bot", true)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"principal":"service_account"`) {
+		t.Errorf("Expected the certificate to authenticate the service account, got %d %s", w.Code, w.Body.String())
+	}
+	if w := request("/protected", "stranger", true); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected an unregistered certificate to be rejected, got %d", w.Code)
+	}
+	if w := request("/protected", "deploy-bot", false); w.Code != http.StatusUnauthorized {
+		t.Errorf("Expected an unverified certificate to be ignored, got %d", w.Code)
+	}
+	if w := request("/session", "deploy-bot", true); w.Code != http.StatusForbidden {
+		t.Errorf("Expected service accounts to be turned away from session routes, got %d", w.Code)
+	}
+}
+
+func TestAuthMiddleware_ServiceAccountTokens(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	router.GET("/protected", AuthMiddleware(testValidator(token.NewMemoryRevocationStore()), nil, nil), RequireSession(), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	claims := func(principal string) jwt.MapClaims {
+		claims := jwt.MapClaims{
+			"user_id": "sa-1",
+			"jti":     "jti-" + principal,
+			"typ":     token.TypeAccess,
+			"iat":     time.Now().Add(-time.Minute).Unix(),
+			"exp":     time.Now().Add(time.Hour).Unix(),
+		}
+		if principal != "" {
+			claims["principal_type"] = principal
+		}
+		return claims
+	}
+
+	if w := performAuthRequest(router, signTestToken(t, claims(serviceaccount.PrincipalServiceAccount))); w.Code != http.StatusForbidden {
+		t.Errorf("Expected a service account token to be turned away from session routes, got %d", w.Code)
+	}
+	if w := performAuthRequest(router, signTestToken(t, claims(""))); w.Code != http.StatusOK {
+		t.Errorf("Expected a user token to be accepted, got %d", w.Code)
+	}
+}
+
+func TestAuthMiddleware_ServiceAccountTokenScopes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	resolver := &stubResolver{permissions: map[string][]string{
+		"tenant-1/sa-1": {"system.admin"},
+	}}
+	router := gin.New()
+	router.GET("/protected", AuthMiddleware(testValidator(token.NewMemoryRevocationStore()), nil, nil), RequirePermission(resolver, "user.delete"), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	claims := func(principal, scope string) jwt.MapClaims {
+		claims := jwt.MapClaims{
+			"user_id":   "sa-1",
+			"tenant_id": "tenant-1",
+			"jti":       "jti-" + principal + scope,
+			"typ":       token.TypeAccess,
+			"scope":     scope,
+			"iat":       time.Now().Add(-time.Minute).Unix(),
+			"exp":       time.Now().Add(time.Hour).Unix(),
+		}
+		if principal != "" {
+			claims["principal_type"] = principal
+		}
+		return claims
+	}
+
+	tests := []struct {
+		name      string
+		principal string
+		scope     string
+		status    int
+	}{
+		{"service account token outside its scopes", serviceaccount.PrincipalServiceAccount, "user.read group.read", http.StatusForbidden},
+		{"service account token within its scopes", serviceaccount.PrincipalServiceAccount, "user.read user.delete", http.StatusOK},
+		{"unscoped service account token", serviceaccount.PrincipalServiceAccount, "", http.StatusOK},
+		{"user token with a scope", "", "user.read", http.StatusOK},
+	}
+	for _, tt := range tests {
+		if w := performAuthRequest(router, signTestToken(t, claims(tt.principal, tt.scope))); w.Code != tt.status {
+			t.Errorf("%s: expected %d, got %d", tt.name, tt.status, w.Code)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/ForIAM/ForIAM/backend/internal/authz"
+	"github.com/gin-gonic/gin"
+)
+
+// PermissionResolver returns the effective permissions of a user.
+type PermissionResolver interface {
+	EffectivePermissions(ctx context.Context, tenantID, userID string) ([]string, error)
+}
+
+// RequirePermission only lets the request through when the authenticated
+// caller holds permission in their tenant. It has to run after
+// AuthMiddleware. The effective permissions are resolved once per request.
+func RequirePermission(resolver PermissionResolver, permission string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		allowed, err := HasPermission(c, resolver, permission)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to resolve permissions"})
+			c.Abort()
+			return
+		}
+
+		if !allowed {
+			c.JSON(http.StatusForbidden, gin.H{
+				"error":      "Insufficient permissions",
+				"permission": permission,
+			})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// HasPermission reports whether the authenticated caller holds permission,
+// for handlers whose rules depend on the resource, e.g. owners acting on
+// their own. A request made with an API key, or with a scoped token of a
+// service account, is also limited to its scopes.
+func HasPermission(c *gin.Context, resolver PermissionResolver, permission string) (bool, error) {
+	var permissions []string
+	if cached, ok := c.Get("permissions"); ok {
+		permissions, _ = cached.([]string)
+	} else {
+		resolved, err := resolver.EffectivePermissions(c.Request.Context(), c.GetString("tenant_id"), c.GetString("user_id"))
+		if err != nil {
+			return false, err
+		}
+		permissions = resolved
+		c.Set("permissions", permissions)
+	}
+
+	for _, key := range []string{"api_key_scopes", "token_scopes"} {
+		if scopes, ok := c.Get(key); ok {
+			limit, _ := scopes.([]string)
+			if !authz.Allows(limit, permission) {
+				return false, nil
+			}
+		}
+	}
+	return authz.Allows(permissions, permission), nil
+}
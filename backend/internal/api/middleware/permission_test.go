@@ -0,0 +1,125 @@
+package middleware
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+type stubResolver struct {
+	permissions map[string][]string
+	err         error
+	calls       int
+}
+
+func (s *stubResolver) EffectivePermissions(ctx context.Context, tenantID, userID string) ([]string, error) {
+	s.calls++
+	return s.permissions[tenantID+"/"+userID], s.err
+}
+
+func permissionRouter(resolver PermissionResolver, userID string) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set("tenant_id", "tenant-1")
+		c.Set("user_id", userID)
+	})
+	router.DELETE("/users/:id", RequirePermission(resolver, "user.delete"), func(c *gin.Context) {
+		c.Status(http.StatusNoContent)
+	})
+	router.PUT("/users/:id", RequirePermission(resolver, "user.read"), RequirePermission(resolver, "user.write"), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	return router
+}
+
+func TestRequirePermission(t *testing.T) {
+	resolver := &stubResolver{permissions: map[string][]string{
+		"tenant-1/admin":  {"user.delete", "user.read", "user.write"},
+		"tenant-1/reader": {"user.read"},
+	}}
+
+	tests := []struct {
+		user   string
+		method string
+		want   int
+	}{
+		{"admin", "DELETE", http.StatusNoContent},
+		{"reader", "DELETE", http.StatusForbidden},
+		{"nobody", "DELETE", http.StatusForbidden},
+		{"admin", "PUT", http.StatusOK},
+		{"reader", "PUT", http.StatusForbidden},
+	}
+
+	for _, tt := range tests {
+		req, _ := http.NewRequest(tt.method, "/users/1", nil)
+		w := httptest.NewRecorder()
+		permissionRouter(resolver, tt.user).ServeHTTP(w, req)
+		if w.Code != tt.want {
+			t.Errorf("%s %s: expected status %d, got %d", tt.user, tt.method, tt.want, w.Code)
+		}
+	}
+}
+
+func TestRequirePermission_ResolvesOncePerRequest(t *testing.T) {
+	resolver := &stubResolver{permissions: map[string][]string{
+		"tenant-1/admin": {"user.read", "user.write"},
+	}}
+
+	req, _ := http.NewRequest("PUT", "/users/1", nil)
+	permissionRouter(resolver, "admin").ServeHTTP(httptest.NewRecorder(), req)
+	if resolver.calls != 1 {
+		t.Errorf("Expected permissions to be resolved once, got %d calls", resolver.calls)
+	}
+}
+
+func TestRequirePermission_ResolverError(t *testing.T) {
+	resolver := &stubResolver{err: errors.New("database down")}
+
+	req, _ := http.NewRequest("DELETE", "/users/1", nil)
+	w := httptest.NewRecorder()
+	permissionRouter(resolver, "admin").ServeHTTP(w, req)
+	if w.Code != http.StatusInternalServerError {
+		t.Errorf("Expected status %d, got %d", http.StatusInternalServerError, w.Code)
+	}
+}
+
+func TestRequirePermission_APIKeyScopes(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+
+	resolver := &stubResolver{permissions: map[string][]string{
+		"tenant-1/admin": {"system.admin"},
+	}}
+	router := gin.New()
+	router.Use(func(c *gin.Context) {
+		c.Set("tenant_id", "tenant-1")
+		c.Set("user_id", "admin")
+		c.Set("api_key_id", "key-1")
+		c.Set("api_key_scopes", []string{"user.read"})
+	})
+	router.GET("/users", RequirePermission(resolver, "user.read"), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	router.DELETE("/users/:id", RequirePermission(resolver, "user.delete"), func(c *gin.Context) {
+		c.Status(http.StatusNoContent)
+	})
+
+	req, _ := http.NewRequest("GET", "/users", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Errorf("Expected a scope of the key to be allowed, got %d", w.Code)
+	}
+
+	req, _ = http.NewRequest("DELETE", "/users/1", nil)
+	w = httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("Expected a permission outside the key's scopes to be denied, got %d", w.Code)
+	}
+}
@@ -5,11 +5,15 @@ import (
 
 	"github.com/ForIAM/ForIAM/backend/internal/api/handlers"
 	"github.com/ForIAM/ForIAM/backend/internal/api/middleware"
+	"github.com/ForIAM/ForIAM/backend/internal/authz"
 	"github.com/ForIAM/ForIAM/backend/internal/config"
+	"github.com/ForIAM/ForIAM/backend/internal/serviceaccount"
+	"github.com/ForIAM/ForIAM/backend/internal/signing"
+	"github.com/ForIAM/ForIAM/backend/internal/token"
 	"github.com/gin-gonic/gin"
 )
 
-func NewServer(db *sql.DB, cfg *config.Config) *gin.Engine {
+func NewServer(db *sql.DB, cfg *config.Config, revocations token.RevocationStore, keys *signing.Manager) *gin.Engine {
 	r := gin.Default()
 
 	// Add CORS middleware
@@ -23,50 +27,275 @@ func NewServer(db *sql.DB, cfg *config.Config) *gin.Engine {
 		})
 	})
 
+	validator := token.NewValidator(keys.Keyfunc, revocations, token.ValidatorOptions{
+		Algorithms: cfg.TokenAlgorithms,
+		Issuer:     cfg.TokenIssuer,
+		Audience:   cfg.TokenAudience,
+		Leeway:     cfg.TokenLeeway,
+	})
+
 	// Initialize handlers
-	authHandler := handlers.NewAuthHandler(db, cfg)
-	userHandler := handlers.NewUserHandler(db)
+	authHandler := handlers.NewAuthHandler(db, cfg, revocations, keys, validator)
 	roleHandler := handlers.NewRoleHandler(db)
-	groupHandler := handlers.NewGroupHandler(db)
 	auditHandler := handlers.NewAuditHandler(db)
+	tenantHandler := handlers.NewTenantHandler(db)
+	jwksHandler := handlers.NewJWKSHandler(keys)
+
+	authorizer := authz.New(db)
+	userHandler := handlers.NewUserHandler(db, authorizer)
+	oauthHandler := handlers.NewOAuthHandler(db, cfg, revocations, keys, authorizer)
+	groupHandler := handlers.NewGroupHandler(db, authorizer)
+	tokenHandler := handlers.NewTokenHandler(db, authorizer)
+	serviceAccountHandler := handlers.NewServiceAccountHandler(db, cfg, revocations, authorizer)
+	scimHandler := handlers.NewSCIMHandler(db, cfg, revocations, authorizer)
+	provisioningHandler := handlers.NewProvisioningHandler(db, cfg)
+	samlHandler := handlers.NewSAMLHandler(db, cfg, revocations)
+	federationHandler := handlers.NewFederationHandler(db, cfg, authorizer)
+	directoryHandler := handlers.NewDirectoryHandler(db, cfg, authorizer)
+	assignmentHandler := handlers.NewAssignmentHandler(db, authorizer)
+	accessHandler := handlers.NewAccessHandler(db, authorizer)
+	require := func(permission string) gin.HandlerFunc {
+		return middleware.RequirePermission(authorizer, permission)
+	}
+	// API keys and service accounts work for the management API; signing in
+	// on behalf of a user and managing their sign-in methods needs a session
+	authMiddleware := middleware.AuthMiddleware(validator, token.NewAPITokenStore(db), serviceaccount.NewStore(db))
+	requireSession := middleware.RequireSession()
+
+	// Public signing keys
+	r.GET("/.well-known/jwks.json", jwksHandler.GetJWKS)
+
+	// OpenID Connect provider
+	r.GET("/.well-known/openid-configuration", oauthHandler.Discovery)
+	oauth2 := r.Group("/oauth2")
+	{
+		oauth2.GET("/authorize", oauthHandler.Authorize)
+		// Called by the frontend once the user has signed in
+		oauth2.POST("/authorize", authMiddleware, requireSession, oauthHandler.ApproveAuthorization)
+		oauth2.POST("/token", oauthHandler.Token)
+		oauth2.POST("/device_authorization", oauthHandler.DeviceAuthorization)
+		// The frontend verification page, signed in like /authorize
+		oauth2.GET("/device", authMiddleware, requireSession, oauthHandler.GetDeviceAuthorization)
+		oauth2.POST("/device", authMiddleware, requireSession, oauthHandler.DecideDeviceAuthorization)
+		oauth2.GET("/userinfo", oauthHandler.UserInfo)
+		oauth2.POST("/userinfo", oauthHandler.UserInfo)
+		oauth2.POST("/introspect", oauthHandler.Introspect)
+		oauth2.POST("/revoke", oauthHandler.Revoke)
+	}
+
+	// SCIM 2.0 provisioning. The discovery endpoints are public; users and
+	// groups need the same permissions as the management API
+	scimRoutes := r.Group("/scim/v2")
+	{
+		scimRoutes.GET("/ServiceProviderConfig", scimHandler.GetServiceProviderConfig)
+		scimRoutes.GET("/ResourceTypes", scimHandler.GetResourceTypes)
+		scimRoutes.GET("/ResourceTypes/:id", scimHandler.GetResourceType)
+		scimRoutes.GET("/Schemas", scimHandler.GetSchemas)
+		scimRoutes.GET("/Schemas/:id", scimHandler.GetSchema)
+
+		scimRoutes.GET("/Users", authMiddleware, scimHandler.Require("user.read"), scimHandler.GetUsers)
+		scimRoutes.POST("/Users", authMiddleware, scimHandler.Require("user.write"), scimHandler.CreateUser)
+		scimRoutes.GET("/Users/:id", authMiddleware, scimHandler.Require("user.read"), scimHandler.GetUser)
+		scimRoutes.PUT("/Users/:id", authMiddleware, scimHandler.Require("user.write"), scimHandler.ReplaceUser)
+		scimRoutes.PATCH("/Users/:id", authMiddleware, scimHandler.Require("user.write"), scimHandler.PatchUser)
+		scimRoutes.DELETE("/Users/:id", authMiddleware, scimHandler.Require("user.delete"), scimHandler.DeleteUser)
+
+		scimRoutes.GET("/Groups", authMiddleware, scimHandler.Require("group.read"), scimHandler.GetGroups)
+		scimRoutes.POST("/Groups", authMiddleware, scimHandler.Require("group.write"), scimHandler.CreateGroup)
+		scimRoutes.GET("/Groups/:id", authMiddleware, scimHandler.Require("group.read"), scimHandler.GetGroup)
+		scimRoutes.PUT("/Groups/:id", authMiddleware, scimHandler.Require("group.write"), scimHandler.ReplaceGroup)
+		scimRoutes.PATCH("/Groups/:id", authMiddleware, scimHandler.Require("group.write"), scimHandler.PatchGroup)
+		scimRoutes.DELETE("/Groups/:id", authMiddleware, scimHandler.Require("group.delete"), scimHandler.DeleteGroup)
+	}
+
+	// SAML 2.0 identity provider of each tenant. Service providers use the
+	// public endpoints; the frontend approves requests like /oauth2/authorize
+	samlRoutes := r.Group("/saml")
+	{
+		samlRoutes.GET("/idp/:tenant_id/metadata", samlHandler.GetMetadata)
+		samlRoutes.GET("/idp/:tenant_id/sso", samlHandler.SSO)
+		samlRoutes.POST("/idp/:tenant_id/sso", samlHandler.SSO)
+		samlRoutes.GET("/idp/:tenant_id/slo", samlHandler.SLO)
+		samlRoutes.POST("/idp/:tenant_id/slo", samlHandler.SLO)
+		// Called by the frontend once the user has signed in
+		samlRoutes.POST("/sso", authMiddleware, requireSession, samlHandler.ApproveSSO)
+		samlRoutes.POST("/service-providers/:id/login", authMiddleware, requireSession, samlHandler.LoginServiceProvider)
+	}
 
 	// Auth routes (no middleware)
 	auth := r.Group("/auth")
 	{
 		auth.POST("/login", authHandler.Login)
-		auth.POST("/logout", authHandler.Logout)
+		auth.POST("/token/refresh", authHandler.RefreshToken)
+		auth.POST("/mfa/verify", authHandler.VerifyMFA)
+		auth.POST("/mfa/webauthn/begin", authHandler.BeginMFAWebAuthn)
+		auth.POST("/mfa/webauthn/finish", authHandler.FinishMFAWebAuthn)
+		auth.POST("/webauthn/login/begin", authHandler.BeginPasskeyLogin)
+		auth.POST("/webauthn/login/finish", authHandler.FinishPasskeyLogin)
+	}
+
+	// Federated login through external identity providers. The browser
+	// goes to the provider and back; the frontend then redeems the code
+	federated := r.Group("/auth/federation")
+	{
+		federated.GET("/providers", authHandler.GetFederationProviders)
+		federated.GET("/:id/login", authHandler.BeginFederatedLogin)
+		federated.GET("/:id/callback", authHandler.FederatedCallback)
+		federated.POST("/:id/acs", authHandler.FederatedACS)
+		federated.POST("/token", authHandler.FinishFederatedLogin)
+	}
+
+	// MFA enrollment also accepts the enrollment token from a password login
+	enroll := r.Group("/auth/mfa/totp")
+	enroll.Use(middleware.MFAEnrollmentMiddleware(validator))
+	{
+		enroll.POST("/enroll", authHandler.EnrollTOTP)
+		enroll.POST("/confirm", authHandler.ConfirmTOTP)
 	}
 
 	// Protected routes
 	api := r.Group("/")
-	api.Use(middleware.AuthMiddleware(cfg.JWTSecret))
+	api.Use(authMiddleware)
 	{
-		// Auth profile
+		// Auth profile and sessions. These only act on the caller's own
+		// account, so being signed in is enough
 		api.GET("/auth/profile", authHandler.GetProfile)
+		api.POST("/auth/logout", requireSession, authHandler.Logout)
+		api.POST("/auth/logout/all", requireSession, authHandler.LogoutAll)
+		api.GET("/auth/mfa/devices", requireSession, authHandler.GetMFADevices)
+		api.DELETE("/auth/mfa/devices/:id", requireSession, authHandler.DeleteMFADevice)
+		api.POST("/auth/mfa/backup-codes", requireSession, authHandler.RegenerateBackupCodes)
+		api.POST("/auth/webauthn/register/begin", requireSession, authHandler.BeginPasskeyRegistration)
+		api.POST("/auth/webauthn/register/finish", requireSession, authHandler.FinishPasskeyRegistration)
+		api.GET("/auth/webauthn/credentials", requireSession, authHandler.GetPasskeys)
+		api.DELETE("/auth/webauthn/credentials/:id", requireSession, authHandler.DeletePasskey)
+		api.POST("/auth/federation/:id/link", requireSession, authHandler.LinkFederatedIdentity)
+
+		// API keys. Owners manage their own; revoking another user's key
+		// needs token.delete, checked by the handler
+		api.GET("/tokens", requireSession, tokenHandler.GetTokens)
+		api.POST("/tokens", requireSession, tokenHandler.CreateToken)
+		api.DELETE("/tokens/:id", tokenHandler.DeleteToken)
+
+		// Tenant settings
+		api.GET("/tenant/settings", require("tenant.read"), tenantHandler.GetSettings)
+		api.PUT("/tenant/settings", require("tenant.write"), tenantHandler.UpdateSettings)
 
 		// Users
-		api.GET("/users", userHandler.GetUsers)
-		api.POST("/users", userHandler.CreateUser)
-		api.GET("/users/:id", userHandler.GetUser)
-		api.PUT("/users/:id", userHandler.UpdateUser)
-		api.DELETE("/users/:id", userHandler.DeleteUser)
+		api.GET("/users", require("user.read"), userHandler.GetUsers)
+		api.POST("/users", require("user.write"), userHandler.CreateUser)
+		api.GET("/users/:id", require("user.read"), userHandler.GetUser)
+		api.PUT("/users/:id", require("user.write"), userHandler.UpdateUser)
+		api.DELETE("/users/:id", require("user.delete"), userHandler.DeleteUser)
+		api.POST("/users/:id/sessions/revoke", require("user.write"), authHandler.RevokeUserSessions)
+		api.GET("/users/:id/lockout", require("user.read"), authHandler.GetUserLockout)
+		api.POST("/users/:id/unlock", require("user.write"), authHandler.UnlockUser)
+		api.POST("/lockouts/ip/unlock", require("user.write"), authHandler.UnlockIP)
+		api.GET("/users/:id/tokens", require("token.read"), tokenHandler.GetUserTokens)
+		api.GET("/users/:id/groups", require("user.read"), assignmentHandler.GetUserGroups)
+		api.GET("/users/:id/roles", require("user.read"), assignmentHandler.GetUserRoles)
+		api.PUT("/users/:id/roles", require("user.write"), assignmentHandler.ReplaceUserRoles)
+		api.POST("/users/:id/roles/:role_id", require("user.write"), assignmentHandler.AddUserRole)
+		api.DELETE("/users/:id/roles/:role_id", require("user.write"), assignmentHandler.RemoveUserRole)
+		api.GET("/users/:id/effective-permissions", require("user.read"), accessHandler.GetEffectivePermissions)
+		api.GET("/users/:id/access-explain", require("user.read"), accessHandler.ExplainAccess)
 
 		// Roles
-		api.GET("/roles", roleHandler.GetRoles)
-		api.POST("/roles", roleHandler.CreateRole)
-		api.GET("/roles/:id", roleHandler.GetRole)
-		api.PUT("/roles/:id", roleHandler.UpdateRole)
-		api.DELETE("/roles/:id", roleHandler.DeleteRole)
+		api.GET("/roles", require("role.read"), roleHandler.GetRoles)
+		api.GET("/roles/graph", require("role.read"), assignmentHandler.GetRoleGraph)
+		api.POST("/roles", require("role.write"), roleHandler.CreateRole)
+		api.GET("/roles/:id", require("role.read"), roleHandler.GetRole)
+		api.PUT("/roles/:id", require("role.write"), roleHandler.UpdateRole)
+		api.DELETE("/roles/:id", require("role.delete"), roleHandler.DeleteRole)
+		api.GET("/roles/:id/permissions", require("role.read"), assignmentHandler.GetRolePermissions)
+		api.POST("/roles/:id/permissions", require("role.write"), assignmentHandler.AddRolePermissions)
+		api.PUT("/roles/:id/permissions", require("role.write"), assignmentHandler.ReplaceRolePermissions)
+		api.DELETE("/roles/:id/permissions/:permission", require("role.write"), assignmentHandler.RemoveRolePermission)
+		api.GET("/roles/:id/users", require("role.read"), assignmentHandler.GetRoleUsers)
+		api.GET("/roles/:id/groups", require("role.read"), assignmentHandler.GetRoleGroups)
+		api.GET("/roles/:id/children", require("role.read"), assignmentHandler.GetRoleChildren)
+		api.PUT("/roles/:id/children", require("role.write"), assignmentHandler.ReplaceRoleChildren)
+		api.POST("/roles/:id/children/:role_id", require("role.write"), assignmentHandler.AddRoleChild)
+		api.DELETE("/roles/:id/children/:role_id", require("role.write"), assignmentHandler.RemoveRoleChild)
+		api.GET("/roles/:id/parents", require("role.read"), assignmentHandler.GetRoleParents)
 
 		// Groups
-		api.GET("/groups", groupHandler.GetGroups)
-		api.POST("/groups", groupHandler.CreateGroup)
-		api.GET("/groups/:id", groupHandler.GetGroup)
-		api.PUT("/groups/:id", groupHandler.UpdateGroup)
-		api.DELETE("/groups/:id", groupHandler.DeleteGroup)
+		api.GET("/groups", require("group.read"), groupHandler.GetGroups)
+		api.POST("/groups", require("group.write"), groupHandler.CreateGroup)
+		api.POST("/groups/rule-preview", require("group.read"), groupHandler.PreviewRule)
+		api.GET("/groups/:id", require("group.read"), groupHandler.GetGroup)
+		api.PUT("/groups/:id", require("group.write"), groupHandler.UpdateGroup)
+		api.DELETE("/groups/:id", require("group.delete"), groupHandler.DeleteGroup)
+		api.GET("/groups/:id/users", require("group.read"), assignmentHandler.GetGroupMembers)
+		api.PUT("/groups/:id/users", require("group.write"), assignmentHandler.ReplaceGroupMembers)
+		api.POST("/groups/:id/users/:user_id", require("group.write"), assignmentHandler.AddGroupMember)
+		api.DELETE("/groups/:id/users/:user_id", require("group.write"), assignmentHandler.RemoveGroupMember)
+		api.GET("/groups/:id/roles", require("group.read"), assignmentHandler.GetGroupRoles)
+		api.PUT("/groups/:id/roles", require("group.write"), assignmentHandler.ReplaceGroupRoles)
+		api.POST("/groups/:id/roles/:role_id", require("group.write"), assignmentHandler.AddGroupRole)
+		api.DELETE("/groups/:id/roles/:role_id", require("group.write"), assignmentHandler.RemoveGroupRole)
+		api.GET("/groups/:id/children", require("group.read"), assignmentHandler.GetGroupChildren)
+		api.PUT("/groups/:id/children", require("group.write"), assignmentHandler.ReplaceGroupChildren)
+		api.POST("/groups/:id/children/:group_id", require("group.write"), assignmentHandler.AddGroupChild)
+		api.DELETE("/groups/:id/children/:group_id", require("group.write"), assignmentHandler.RemoveGroupChild)
+		api.GET("/groups/:id/parents", require("group.read"), assignmentHandler.GetGroupParents)
+
+		// OAuth clients
+		api.GET("/clients", require("client.read"), oauthHandler.GetClients)
+		api.POST("/clients", require("client.write"), oauthHandler.CreateClient)
+		api.GET("/clients/:id", require("client.read"), oauthHandler.GetClient)
+		api.PUT("/clients/:id", require("client.write"), oauthHandler.UpdateClient)
+		api.DELETE("/clients/:id", require("client.delete"), oauthHandler.DeleteClient)
+		api.POST("/clients/:id/secret", require("client.write"), oauthHandler.RotateClientSecret)
+
+		// Service accounts
+		api.GET("/service-accounts", require("service_account.read"), serviceAccountHandler.GetServiceAccounts)
+		api.POST("/service-accounts", require("service_account.write"), serviceAccountHandler.CreateServiceAccount)
+		api.GET("/service-accounts/:id", require("service_account.read"), serviceAccountHandler.GetServiceAccount)
+		api.PUT("/service-accounts/:id", require("service_account.write"), serviceAccountHandler.UpdateServiceAccount)
+		api.DELETE("/service-accounts/:id", require("service_account.delete"), serviceAccountHandler.DeleteServiceAccount)
+		api.GET("/service-accounts/:id/tokens", require("service_account.read"), serviceAccountHandler.GetServiceAccountTokens)
+		api.POST("/service-accounts/:id/tokens", require("service_account.write"), serviceAccountHandler.CreateServiceAccountToken)
+		api.POST("/service-accounts/:id/clients", require("service_account.write"), serviceAccountHandler.CreateServiceAccountClient)
+		api.GET("/service-accounts/:id/certificates", require("service_account.read"), serviceAccountHandler.GetServiceAccountCertificates)
+		api.POST("/service-accounts/:id/certificates", require("service_account.write"), serviceAccountHandler.AddServiceAccountCertificate)
+		api.DELETE("/service-accounts/:id/certificates/:cert_id", require("service_account.write"), serviceAccountHandler.DeleteServiceAccountCertificate)
+
+		// Outbound SCIM provisioning
+		api.GET("/provisioning/connectors", require("provisioning.read"), provisioningHandler.GetConnectors)
+		api.POST("/provisioning/connectors", require("provisioning.write"), provisioningHandler.CreateConnector)
+		api.GET("/provisioning/connectors/:id", require("provisioning.read"), provisioningHandler.GetConnector)
+		api.PUT("/provisioning/connectors/:id", require("provisioning.write"), provisioningHandler.UpdateConnector)
+		api.DELETE("/provisioning/connectors/:id", require("provisioning.delete"), provisioningHandler.DeleteConnector)
+		api.POST("/provisioning/connectors/:id/sync", require("provisioning.write"), provisioningHandler.SyncConnector)
+		api.GET("/provisioning/connectors/:id/jobs", require("provisioning.read"), provisioningHandler.GetConnectorJobs)
+		api.POST("/provisioning/connectors/:id/jobs/:job_id/retry", require("provisioning.write"), provisioningHandler.RetryConnectorJob)
+
+		// SAML service providers
+		api.GET("/saml/idp", require("saml.read"), samlHandler.GetIdentityProvider)
+		api.GET("/saml/service-providers", require("saml.read"), samlHandler.GetServiceProviders)
+		api.POST("/saml/service-providers", require("saml.write"), samlHandler.CreateServiceProvider)
+		api.GET("/saml/service-providers/:id", require("saml.read"), samlHandler.GetServiceProvider)
+		api.PUT("/saml/service-providers/:id", require("saml.write"), samlHandler.UpdateServiceProvider)
+		api.DELETE("/saml/service-providers/:id", require("saml.delete"), samlHandler.DeleteServiceProvider)
+
+		// External identity providers
+		api.GET("/federation/providers", require("federation.read"), federationHandler.GetProviders)
+		api.POST("/federation/providers", require("federation.write"), federationHandler.CreateProvider)
+		api.GET("/federation/providers/:id", require("federation.read"), federationHandler.GetProvider)
+		api.PUT("/federation/providers/:id", require("federation.write"), federationHandler.UpdateProvider)
+		api.DELETE("/federation/providers/:id", require("federation.delete"), federationHandler.DeleteProvider)
+		api.GET("/users/:id/identities", require("federation.read"), federationHandler.GetUserIdentities)
+		api.DELETE("/users/:id/identities/:identity_id", require("federation.write"), federationHandler.DeleteUserIdentity)
+
+		// LDAP directory passwords are checked against
+		api.GET("/tenant/ldap", require("ldap.read"), directoryHandler.GetDirectory)
+		api.PUT("/tenant/ldap", require("ldap.write"), directoryHandler.UpdateDirectory)
+		api.DELETE("/tenant/ldap", require("ldap.write"), directoryHandler.DeleteDirectory)
+		api.POST("/tenant/ldap/test", require("ldap.read"), directoryHandler.TestDirectory)
 
 		// Audit
-		api.GET("/audit", auditHandler.GetAuditLogs)
+		api.GET("/audit", require("audit.read"), auditHandler.GetAuditLogs)
 	}
 
 	return r
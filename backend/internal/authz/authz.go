@@ -0,0 +1,228 @@
+// Package authz works out what a user is allowed to do. Permissions reach a
+// user through roles assigned directly (user_roles) or through the groups the
+// user belongs to (user_groups -> group_roles), including the groups those
+// are nested in (group_hierarchy); roles carry permissions through
+// role_permissions, and hold those of their child roles (role_hierarchy).
+// Both hierarchies count transitively.
+package authz
+
+import (
+	"context"
+	"database/sql"
+
+	"github.com/lib/pq"
+)
+
+// PermissionSystemAdmin grants every permission, including ones added after
+// the holder's roles were set up.
+const PermissionSystemAdmin = "system.admin"
+
+type Authorizer struct {
+	db *sql.DB
+}
+
+func New(db *sql.DB) *Authorizer {
+	return &Authorizer{db: db}
+}
+
+// EffectivePermissions returns the names of the permissions userID holds in
+// tenantID, sorted. Roles and groups of other tenants never count, and
+// inactive users hold nothing.
+func (a *Authorizer) EffectivePermissions(ctx context.Context, tenantID, userID string) ([]string, error) {
+	rows, err := a.db.QueryContext(ctx, `
+		WITH RECURSIVE member_of(group_id) AS (
+			SELECT ug.group_id
+			FROM user_groups ug
+			JOIN groups g ON g.id = ug.group_id AND g.tenant_id = $1
+			WHERE ug.user_id = $2
+			UNION
+			SELECT gh.parent_group_id
+			FROM group_hierarchy gh
+			JOIN member_of ON member_of.group_id = gh.child_group_id
+		),
+		held(role_id) AS (
+			SELECT assigned.role_id FROM (
+				SELECT ur.role_id FROM user_roles ur WHERE ur.user_id = $2
+				UNION
+				SELECT gr.role_id
+				FROM group_roles gr
+				JOIN groups g ON g.id = gr.group_id AND g.tenant_id = $1
+				WHERE gr.group_id IN (SELECT group_id FROM member_of)
+			) assigned
+			UNION
+			SELECT rh.child_role_id
+			FROM role_hierarchy rh
+			JOIN held ON held.role_id = rh.parent_role_id
+		)
+		SELECT DISTINCT p.name
+		FROM permissions p
+		JOIN role_permissions rp ON rp.permission_id = p.id
+		JOIN roles r ON r.id = rp.role_id AND r.tenant_id = $1
+		WHERE rp.role_id IN (SELECT role_id FROM held)
+		AND EXISTS (SELECT 1 FROM users u WHERE u.id = $2 AND u.tenant_id = $1 AND u.is_active = true)
+		ORDER BY p.name
+	`, tenantID, userID)
+	if err != nil {
+		return nil, err
+	}
+	return scanNames(rows)
+}
+
+// RolePermissions returns the names of the permissions roleIDs carry,
+// directly or through their child roles, sorted.
+func RolePermissions(ctx context.Context, db *sql.DB, roleIDs []string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, `
+		WITH RECURSIVE held(role_id) AS (
+			SELECT unnest($1::uuid[])
+			UNION
+			SELECT rh.child_role_id
+			FROM role_hierarchy rh
+			JOIN held ON held.role_id = rh.parent_role_id
+		)
+		SELECT DISTINCT p.name
+		FROM permissions p
+		JOIN role_permissions rp ON rp.permission_id = p.id
+		WHERE rp.role_id IN (SELECT role_id FROM held)
+		ORDER BY p.name
+	`, pq.Array(roleIDs))
+	if err != nil {
+		return nil, err
+	}
+	return scanNames(rows)
+}
+
+// GroupPermissions returns the names of the permissions members of groupIDs
+// hold through them: those of the roles of the groups and of the groups
+// they are nested in, sorted.
+func GroupPermissions(ctx context.Context, db *sql.DB, groupIDs []string) ([]string, error) {
+	rows, err := db.QueryContext(ctx, `
+		WITH RECURSIVE nested(group_id) AS (
+			SELECT unnest($1::uuid[])
+			UNION
+			SELECT gh.parent_group_id
+			FROM group_hierarchy gh
+			JOIN nested ON nested.group_id = gh.child_group_id
+		)
+		SELECT DISTINCT gr.role_id FROM group_roles gr
+		WHERE gr.group_id IN (SELECT group_id FROM nested)
+	`, pq.Array(groupIDs))
+	if err != nil {
+		return nil, err
+	}
+	roleIDs, err := scanNames(rows)
+	if err != nil {
+		return nil, err
+	}
+	return RolePermissions(ctx, db, roleIDs)
+}
+
+func scanNames(rows *sql.Rows) ([]string, error) {
+	defer rows.Close()
+
+	names := []string{}
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		names = append(names, name)
+	}
+	return names, rows.Err()
+}
+
+// Node is a step on the path by which a permission reaches a user: the
+// user, a group, a role or the permission.
+type Node struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// Grant is one path by which a user holds a permission: user -> role ->
+// permission, or user -> group -> role -> permission. The groups the user's
+// group is nested in follow it up to the one holding the role, and the
+// child roles the permission is inherited through follow the role.
+type Grant struct {
+	Permission string `json:"permission"`
+	Path       []Node `json:"path"`
+}
+
+// Grants returns every path by which userID holds a permission in tenantID,
+// sorted by permission. Unlike EffectivePermissions it does not check that
+// the user is active, so the access of deactivated users can be explained
+// too.
+func (a *Authorizer) Grants(ctx context.Context, tenantID, userID string) ([]Grant, error) {
+	rows, err := a.db.QueryContext(ctx, `
+		WITH RECURSIVE member_of(group_id, group_ids, group_names) AS (
+			SELECT g.id, ARRAY[g.id], ARRAY[g.name::text]
+			FROM user_groups ug
+			JOIN groups g ON g.id = ug.group_id AND g.tenant_id = $1
+			WHERE ug.user_id = $2
+			UNION ALL
+			SELECT g.id, member_of.group_ids || g.id, member_of.group_names || g.name::text
+			FROM member_of
+			JOIN group_hierarchy gh ON gh.child_group_id = member_of.group_id
+			JOIN groups g ON g.id = gh.parent_group_id AND g.tenant_id = $1
+			WHERE NOT g.id = ANY(member_of.group_ids)
+		),
+		held(group_ids, group_names, role_id, role_ids, role_names) AS (
+			SELECT assigned.group_ids, assigned.group_names, r.id, ARRAY[r.id], ARRAY[r.name::text]
+			FROM (
+				SELECT '{}'::uuid[] AS group_ids, '{}'::text[] AS group_names, ur.role_id
+				FROM user_roles ur WHERE ur.user_id = $2
+				UNION ALL
+				SELECT member_of.group_ids, member_of.group_names, gr.role_id
+				FROM member_of
+				JOIN group_roles gr ON gr.group_id = member_of.group_id
+			) assigned
+			JOIN roles r ON r.id = assigned.role_id AND r.tenant_id = $1
+			UNION ALL
+			SELECT held.group_ids, held.group_names, r.id, held.role_ids || r.id, held.role_names || r.name::text
+			FROM held
+			JOIN role_hierarchy rh ON rh.parent_role_id = held.role_id
+			JOIN roles r ON r.id = rh.child_role_id AND r.tenant_id = $1
+			WHERE NOT r.id = ANY(held.role_ids)
+		)
+		SELECT u.id, u.email, held.group_ids, held.group_names, held.role_ids, held.role_names, p.id, p.name
+		FROM held
+		JOIN users u ON u.id = $2 AND u.tenant_id = $1
+		JOIN role_permissions rp ON rp.role_id = held.role_id
+		JOIN permissions p ON p.id = rp.permission_id
+		ORDER BY p.name, held.group_names, held.role_names
+	`, tenantID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	grants := []Grant{}
+	for rows.Next() {
+		var user, permission Node
+		var groupIDs, groupNames, roleIDs, roleNames []string
+		if err := rows.Scan(&user.ID, &user.Name, pq.Array(&groupIDs), pq.Array(&groupNames), pq.Array(&roleIDs), pq.Array(&roleNames), &permission.ID, &permission.Name); err != nil {
+			return nil, err
+		}
+		user.Type, permission.Type = "user", "permission"
+
+		path := []Node{user}
+		for i := range groupIDs {
+			path = append(path, Node{Type: "group", ID: groupIDs[i], Name: groupNames[i]})
+		}
+		for i := range roleIDs {
+			path = append(path, Node{Type: "role", ID: roleIDs[i], Name: roleNames[i]})
+		}
+		path = append(path, permission)
+		grants = append(grants, Grant{Permission: permission.Name, Path: path})
+	}
+	return grants, rows.Err()
+}
+
+// Allows reports whether a holder of permissions may use permission.
+func Allows(permissions []string, permission string) bool {
+	for _, p := range permissions {
+		if p == permission || p == PermissionSystemAdmin {
+			return true
+		}
+	}
+	return false
+}
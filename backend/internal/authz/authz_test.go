@@ -0,0 +1,20 @@
+package authz
+
+import "testing"
+
+func TestAllows(t *testing.T) {
+	held := []string{"user.read", "user.write"}
+
+	if !Allows(held, "user.read") {
+		t.Error("Expected a held permission to be allowed")
+	}
+	if Allows(held, "user.delete") {
+		t.Error("Expected a missing permission to be denied")
+	}
+	if Allows(nil, "user.read") {
+		t.Error("Expected no permissions to deny everything")
+	}
+	if !Allows([]string{PermissionSystemAdmin}, "role.delete") {
+		t.Error("Expected system.admin to allow every permission")
+	}
+}
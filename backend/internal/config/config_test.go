@@ -3,6 +3,7 @@ package config
 import (
 	"os"
 	"testing"
+	"time"
 )
 
 func TestLoad(t *testing.T) {
@@ -64,4 +65,52 @@ func TestGetEnv(t *testing.T) {
 	if result != "default" {
 		t.Errorf("Expected 'default', got '%s'", result)
 	}
-}
\ No newline at end of file
+}
+
+func TestGetDuration(t *testing.T) {
+	os.Setenv("TEST_DURATION", "90s")
+	defer os.Unsetenv("TEST_DURATION")
+
+	if d := getDuration("TEST_DURATION", time.Minute); d != 90*time.Second {
+		t.Errorf("Expected 90s, got %s", d)
+	}
+
+	// Unparseable values fall back to the default
+	os.Setenv("TEST_DURATION", "soon")
+	if d := getDuration("TEST_DURATION", time.Minute); d != time.Minute {
+		t.Errorf("Expected default of 1m, got %s", d)
+	}
+
+	if d := getDuration("NON_EXISTING_VAR", time.Minute); d != time.Minute {
+		t.Errorf("Expected default of 1m, got %s", d)
+	}
+}
+
+func TestGetInt(t *testing.T) {
+	os.Setenv("TEST_INT", "7")
+	defer os.Unsetenv("TEST_INT")
+
+	if n := getInt("TEST_INT", 3); n != 7 {
+		t.Errorf("Expected 7, got %d", n)
+	}
+
+	os.Setenv("TEST_INT", "seven")
+	if n := getInt("TEST_INT", 3); n != 3 {
+		t.Errorf("Expected default of 3, got %d", n)
+	}
+}
+
+func TestGetList(t *testing.T) {
+	os.Setenv("TEST_LIST", " https://a.example, ,https://b.example ")
+	defer os.Unsetenv("TEST_LIST")
+
+	list := getList("TEST_LIST", nil)
+	if len(list) != 2 || list[0] != "https://a.example" || list[1] != "https://b.example" {
+		t.Errorf("Unexpected list: %v", list)
+	}
+
+	list = getList("NON_EXISTING_VAR", []string{"default"})
+	if len(list) != 1 || list[0] != "default" {
+		t.Errorf("Expected default list, got %v", list)
+	}
+}
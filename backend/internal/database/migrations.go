@@ -18,6 +18,44 @@ func Migrate(db *sql.DB) error {
 		createUserGroupsTable,
 		createAuditLogsTable,
 		createAPITokensTable,
+		createRefreshTokensTable,
+		alterTenantsAddMFARequired,
+		createMFADevicesTable,
+		createMFABackupCodesTable,
+		alterTenantsAddWebAuthnSettings,
+		createWebAuthnCredentialsTable,
+		createWebAuthnSessionsTable,
+		createLoginAttemptsTable,
+		alterAuditLogsAddReason,
+		createSigningKeysTable,
+		createOAuthClientsTable,
+		createOAuthAuthorizationCodesTable,
+		alterOAuthClientsAddGrants,
+		createOAuthDeviceCodesTable,
+		alterOAuthClientsAddExchangeAudiences,
+		alterAPITokensHashed,
+		alterUsersAddPrincipalType,
+		alterAuditLogsAddActorType,
+		createServiceAccountCertificatesTable,
+		alterOAuthClientsAddServiceAccount,
+		alterUsersAndGroupsAddSCIM,
+		createProvisioningConnectorsTable,
+		createProvisioningJobsTable,
+		createProvisioningResourcesTable,
+		createSAMLIdPCredentialsTable,
+		createSAMLServiceProvidersTable,
+		createSAMLLogoutsTable,
+		createSAMLSessionsTable,
+		createFederationProvidersTable,
+		createFederatedIdentitiesTable,
+		createFederationLoginsTable,
+		createLDAPDirectoriesTable,
+		alterAuditLogsAddTarget,
+		createRoleHierarchyTable,
+		createGroupHierarchyTable,
+		alterUsersAndGroupsAddDynamicGroups,
+		alterMFADevicesAddSecretEncrypted,
+		alterFederationAddLinking,
 		createIndexes,
 	}
 
@@ -127,10 +165,459 @@ CREATE TABLE IF NOT EXISTS api_tokens (
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );`
 
+const createRefreshTokensTable = `
+CREATE TABLE IF NOT EXISTS refresh_tokens (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    tenant_id UUID REFERENCES tenants(id) ON DELETE CASCADE,
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    family_id UUID NOT NULL,
+    token_hash TEXT NOT NULL UNIQUE,
+    expires_at TIMESTAMP NOT NULL,
+    rotated_at TIMESTAMP,
+    revoked_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);`
+
+const alterTenantsAddMFARequired = `
+ALTER TABLE tenants ADD COLUMN IF NOT EXISTS mfa_required BOOLEAN DEFAULT FALSE;`
+
+const createMFADevicesTable = `
+CREATE TABLE IF NOT EXISTS mfa_devices (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    tenant_id UUID REFERENCES tenants(id) ON DELETE CASCADE,
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    type TEXT NOT NULL DEFAULT 'totp',
+    name TEXT,
+    secret TEXT NOT NULL,
+    confirmed_at TIMESTAMP,
+    last_used_step BIGINT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);`
+
+const createMFABackupCodesTable = `
+CREATE TABLE IF NOT EXISTS mfa_backup_codes (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    code_hash TEXT NOT NULL,
+    used_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);`
+
+const alterTenantsAddWebAuthnSettings = `
+ALTER TABLE tenants ADD COLUMN IF NOT EXISTS webauthn_rp_id TEXT;
+ALTER TABLE tenants ADD COLUMN IF NOT EXISTS webauthn_rp_name TEXT;
+ALTER TABLE tenants ADD COLUMN IF NOT EXISTS webauthn_origins TEXT[];`
+
+const createWebAuthnCredentialsTable = `
+CREATE TABLE IF NOT EXISTS webauthn_credentials (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    tenant_id UUID REFERENCES tenants(id) ON DELETE CASCADE,
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    name TEXT,
+    credential_id BYTEA NOT NULL UNIQUE,
+    public_key BYTEA NOT NULL,
+    attestation_type TEXT NOT NULL,
+    aaguid BYTEA,
+    sign_count BIGINT NOT NULL DEFAULT 0,
+    transports TEXT[],
+    user_present BOOLEAN DEFAULT FALSE,
+    user_verified BOOLEAN DEFAULT FALSE,
+    backup_eligible BOOLEAN DEFAULT FALSE,
+    backup_state BOOLEAN DEFAULT FALSE,
+    last_used_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);`
+
+const createWebAuthnSessionsTable = `
+CREATE TABLE IF NOT EXISTS webauthn_sessions (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    tenant_id UUID REFERENCES tenants(id) ON DELETE CASCADE,
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    purpose TEXT NOT NULL,
+    data JSONB NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);`
+
+const createLoginAttemptsTable = `
+CREATE TABLE IF NOT EXISTS login_attempts (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    tenant_id UUID REFERENCES tenants(id) ON DELETE CASCADE,
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    email TEXT NOT NULL,
+    ip_address TEXT NOT NULL,
+    success BOOLEAN NOT NULL,
+    reason TEXT,
+    cleared_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);`
+
+const alterAuditLogsAddReason = `
+ALTER TABLE audit_logs ADD COLUMN IF NOT EXISTS reason TEXT;`
+
+const createSigningKeysTable = `
+CREATE TABLE IF NOT EXISTS signing_keys (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    kid TEXT NOT NULL UNIQUE,
+    algorithm TEXT NOT NULL,
+    private_key BYTEA NOT NULL,
+    retired_at TIMESTAMP,
+    expires_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);`
+
+const createOAuthClientsTable = `
+CREATE TABLE IF NOT EXISTS oauth_clients (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    tenant_id UUID REFERENCES tenants(id) ON DELETE CASCADE,
+    client_id TEXT NOT NULL UNIQUE,
+    name TEXT NOT NULL,
+    client_secret_hash TEXT,
+    redirect_uris TEXT[] NOT NULL DEFAULT '{}',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);`
+
+const createOAuthAuthorizationCodesTable = `
+CREATE TABLE IF NOT EXISTS oauth_authorization_codes (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    code_hash TEXT NOT NULL UNIQUE,
+    tenant_id UUID REFERENCES tenants(id) ON DELETE CASCADE,
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    client_id TEXT NOT NULL REFERENCES oauth_clients(client_id) ON DELETE CASCADE,
+    redirect_uri TEXT NOT NULL,
+    scopes TEXT[] NOT NULL DEFAULT '{}',
+    nonce TEXT,
+    code_challenge TEXT NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);`
+
+const alterOAuthClientsAddGrants = `
+ALTER TABLE oauth_clients ADD COLUMN IF NOT EXISTS grant_types TEXT[] NOT NULL DEFAULT '{authorization_code}';
+ALTER TABLE oauth_clients ADD COLUMN IF NOT EXISTS scopes TEXT[] NOT NULL DEFAULT '{openid,email}';
+ALTER TABLE oauth_clients ADD COLUMN IF NOT EXISTS updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP;`
+
+const createOAuthDeviceCodesTable = `
+CREATE TABLE IF NOT EXISTS oauth_device_codes (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    device_code_hash TEXT NOT NULL UNIQUE,
+    user_code TEXT NOT NULL UNIQUE,
+    tenant_id UUID REFERENCES tenants(id) ON DELETE CASCADE,
+    client_id TEXT NOT NULL REFERENCES oauth_clients(client_id) ON DELETE CASCADE,
+    scopes TEXT[] NOT NULL DEFAULT '{}',
+    status TEXT NOT NULL DEFAULT 'pending',
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    poll_interval INTEGER NOT NULL,
+    last_polled_at TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);`
+
+const alterOAuthClientsAddExchangeAudiences = `
+ALTER TABLE oauth_clients ADD COLUMN IF NOT EXISTS exchange_audiences TEXT[] NOT NULL DEFAULT '{}';`
+
+// alterAPITokensHashed replaces the plaintext token column by a hash. Tokens
+// issued before keep working, with their owner's full permissions.
+const alterAPITokensHashed = `
+ALTER TABLE api_tokens ADD COLUMN IF NOT EXISTS token_hash TEXT;
+ALTER TABLE api_tokens ADD COLUMN IF NOT EXISTS prefix TEXT NOT NULL DEFAULT '';
+ALTER TABLE api_tokens ADD COLUMN IF NOT EXISTS name TEXT NOT NULL DEFAULT '';
+ALTER TABLE api_tokens ADD COLUMN IF NOT EXISTS scopes TEXT[] NOT NULL DEFAULT '{}';
+ALTER TABLE api_tokens ADD COLUMN IF NOT EXISTS last_used_at TIMESTAMP;
+ALTER TABLE api_tokens ADD COLUMN IF NOT EXISTS last_used_ip TEXT;
+DO $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM information_schema.columns WHERE table_name = 'api_tokens' AND column_name = 'token') THEN
+        UPDATE api_tokens
+        SET token_hash = encode(sha256(convert_to(token, 'UTF8')), 'hex'),
+            prefix = left(token, 8),
+            name = 'Imported token',
+            scopes = '{system.admin}';
+        ALTER TABLE api_tokens DROP COLUMN token;
+    END IF;
+END $$;
+ALTER TABLE api_tokens ALTER COLUMN token_hash SET NOT NULL;
+ALTER TABLE api_tokens DROP CONSTRAINT IF EXISTS api_tokens_user_id_fkey;
+ALTER TABLE api_tokens ADD CONSTRAINT api_tokens_user_id_fkey FOREIGN KEY (user_id) REFERENCES users(id) ON DELETE CASCADE;
+CREATE UNIQUE INDEX IF NOT EXISTS idx_api_tokens_token_hash ON api_tokens(token_hash);`
+
+// alterUsersAddPrincipalType lets users hold service accounts, which have a
+// name instead of a password.
+const alterUsersAddPrincipalType = `
+ALTER TABLE users ADD COLUMN IF NOT EXISTS principal_type TEXT NOT NULL DEFAULT 'user';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS name TEXT;
+ALTER TABLE users ADD COLUMN IF NOT EXISTS description TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ALTER COLUMN password_hash DROP NOT NULL;`
+
+const alterAuditLogsAddActorType = `
+ALTER TABLE audit_logs ADD COLUMN IF NOT EXISTS actor_type TEXT;`
+
+const createServiceAccountCertificatesTable = `
+CREATE TABLE IF NOT EXISTS service_account_certificates (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    tenant_id UUID REFERENCES tenants(id) ON DELETE CASCADE,
+    service_account_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    thumbprint TEXT NOT NULL UNIQUE,
+    subject TEXT NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);`
+
+const alterOAuthClientsAddServiceAccount = `
+ALTER TABLE oauth_clients ADD COLUMN IF NOT EXISTS service_account_id UUID REFERENCES users(id) ON DELETE CASCADE;`
+
+// alterUsersAndGroupsAddSCIM adds the SCIM attributes kept for users and
+// groups provisioned by an identity provider.
+const alterUsersAndGroupsAddSCIM = `
+ALTER TABLE users ADD COLUMN IF NOT EXISTS external_id TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS display_name TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS given_name TEXT NOT NULL DEFAULT '';
+ALTER TABLE users ADD COLUMN IF NOT EXISTS family_name TEXT NOT NULL DEFAULT '';
+ALTER TABLE groups ADD COLUMN IF NOT EXISTS external_id TEXT NOT NULL DEFAULT '';`
+
+// createProvisioningConnectorsTable and the two tables after it hold
+// outbound SCIM provisioning: connectors of a tenant, the jobs delivering
+// changes to them and the IDs resources got downstream.
+const createProvisioningConnectorsTable = `
+CREATE TABLE IF NOT EXISTS provisioning_connectors (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    tenant_id UUID NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    endpoint TEXT NOT NULL,
+    token_encrypted BYTEA NOT NULL,
+    attribute_mapping JSONB NOT NULL DEFAULT '{}',
+    is_active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (tenant_id, name)
+);`
+
+const createProvisioningJobsTable = `
+CREATE TABLE IF NOT EXISTS provisioning_jobs (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    tenant_id UUID NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+    connector_id UUID NOT NULL REFERENCES provisioning_connectors(id) ON DELETE CASCADE,
+    resource_type TEXT NOT NULL,
+    resource_id UUID NOT NULL,
+    operation TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT,
+    next_attempt_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    completed_at TIMESTAMP
+);`
+
+const createProvisioningResourcesTable = `
+CREATE TABLE IF NOT EXISTS provisioning_resources (
+    connector_id UUID NOT NULL REFERENCES provisioning_connectors(id) ON DELETE CASCADE,
+    resource_type TEXT NOT NULL,
+    resource_id UUID NOT NULL,
+    remote_id TEXT NOT NULL,
+    PRIMARY KEY (connector_id, resource_type, resource_id)
+);`
+
+// createSAMLIdPCredentialsTable and the tables after it back the SAML
+// identity provider: the signing key and certificate of each tenant's IdP,
+// the service providers registered with it, and the sessions users have at
+// them together with the single logouts ending those sessions.
+const createSAMLIdPCredentialsTable = `
+CREATE TABLE IF NOT EXISTS saml_idp_credentials (
+    tenant_id UUID PRIMARY KEY REFERENCES tenants(id) ON DELETE CASCADE,
+    private_key_encrypted BYTEA NOT NULL,
+    certificate BYTEA NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);`
+
+const createSAMLServiceProvidersTable = `
+CREATE TABLE IF NOT EXISTS saml_service_providers (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    tenant_id UUID NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    entity_id TEXT NOT NULL,
+    acs_url TEXT NOT NULL,
+    slo_url TEXT NOT NULL DEFAULT '',
+    certificate TEXT NOT NULL DEFAULT '',
+    name_id_format TEXT NOT NULL,
+    attribute_mapping JSONB NOT NULL DEFAULT '{}',
+    allow_idp_initiated BOOLEAN NOT NULL DEFAULT FALSE,
+    is_active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (tenant_id, entity_id)
+);`
+
+const createSAMLLogoutsTable = `
+CREATE TABLE IF NOT EXISTS saml_logouts (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    tenant_id UUID NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    service_provider_id UUID NOT NULL REFERENCES saml_service_providers(id) ON DELETE CASCADE,
+    request_id TEXT NOT NULL,
+    relay_state TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);`
+
+const createSAMLSessionsTable = `
+CREATE TABLE IF NOT EXISTS saml_sessions (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    session_index TEXT NOT NULL UNIQUE,
+    tenant_id UUID NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    service_provider_id UUID NOT NULL REFERENCES saml_service_providers(id) ON DELETE CASCADE,
+    name_id TEXT NOT NULL,
+    logout_id UUID REFERENCES saml_logouts(id) ON DELETE SET NULL,
+    logout_request_id TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL
+);`
+
+// createFederationProvidersTable and the tables after it back federated
+// login: the upstream OpenID Connect providers and SAML IdPs of tenants,
+// the external accounts linked to users, and sign-ins in progress.
+const createFederationProvidersTable = `
+CREATE TABLE IF NOT EXISTS federation_providers (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    tenant_id UUID NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    type TEXT NOT NULL,
+    issuer TEXT NOT NULL DEFAULT '',
+    client_id TEXT NOT NULL DEFAULT '',
+    client_secret_encrypted BYTEA,
+    scopes TEXT[] NOT NULL DEFAULT '{}',
+    entity_id TEXT NOT NULL DEFAULT '',
+    sso_url TEXT NOT NULL DEFAULT '',
+    certificate TEXT NOT NULL DEFAULT '',
+    claim_mapping JSONB NOT NULL DEFAULT '{}',
+    groups_claim TEXT NOT NULL DEFAULT 'groups',
+    group_mapping JSONB NOT NULL DEFAULT '{}',
+    jit_provisioning BOOLEAN NOT NULL DEFAULT FALSE,
+    disable_password_login BOOLEAN NOT NULL DEFAULT FALSE,
+    is_active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (tenant_id, name)
+);`
+
+const createFederatedIdentitiesTable = `
+CREATE TABLE IF NOT EXISTS federated_identities (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    tenant_id UUID NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+    provider_id UUID NOT NULL REFERENCES federation_providers(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    subject TEXT NOT NULL,
+    email TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_login_at TIMESTAMP,
+    UNIQUE (provider_id, subject)
+);`
+
+const createFederationLoginsTable = `
+CREATE TABLE IF NOT EXISTS federation_logins (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    tenant_id UUID NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+    provider_id UUID NOT NULL REFERENCES federation_providers(id) ON DELETE CASCADE,
+    state TEXT UNIQUE,
+    nonce TEXT NOT NULL,
+    code_verifier TEXT NOT NULL,
+    request_id TEXT NOT NULL DEFAULT '',
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    code_hash TEXT UNIQUE,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);`
+
+// createLDAPDirectoriesTable holds the LDAP directory each tenant checks
+// passwords against.
+const createLDAPDirectoriesTable = `
+CREATE TABLE IF NOT EXISTS ldap_directories (
+    tenant_id UUID PRIMARY KEY REFERENCES tenants(id) ON DELETE CASCADE,
+    url TEXT NOT NULL,
+    start_tls BOOLEAN NOT NULL DEFAULT FALSE,
+    root_ca TEXT NOT NULL DEFAULT '',
+    bind_dn TEXT NOT NULL DEFAULT '',
+    bind_password_encrypted BYTEA,
+    base_dn TEXT NOT NULL,
+    user_filter TEXT NOT NULL,
+    group_sync BOOLEAN NOT NULL DEFAULT FALSE,
+    group_base_dn TEXT NOT NULL DEFAULT '',
+    group_filter TEXT NOT NULL DEFAULT '',
+    group_name_attribute TEXT NOT NULL DEFAULT 'cn',
+    group_mapping JSONB NOT NULL DEFAULT '{}',
+    allow_local_passwords BOOLEAN NOT NULL DEFAULT FALSE,
+    is_active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);`
+
+// alterAuditLogsAddTarget records the second resource of events between
+// two, such as the user added to a group.
+const alterAuditLogsAddTarget = `
+ALTER TABLE audit_logs ADD COLUMN IF NOT EXISTS target TEXT;
+ALTER TABLE audit_logs ADD COLUMN IF NOT EXISTS target_id UUID;`
+
+// createRoleHierarchyTable makes roles parents of other roles of their
+// tenant: a parent holds the permissions of its children, transitively.
+const createRoleHierarchyTable = `
+CREATE TABLE IF NOT EXISTS role_hierarchy (
+    parent_role_id UUID REFERENCES roles(id) ON DELETE CASCADE,
+    child_role_id UUID REFERENCES roles(id) ON DELETE CASCADE,
+    PRIMARY KEY (parent_role_id, child_role_id),
+    CHECK (parent_role_id <> child_role_id)
+);`
+
+// createGroupHierarchyTable nests groups in other groups of their tenant:
+// the members of a group are members of its parents, transitively.
+const createGroupHierarchyTable = `
+CREATE TABLE IF NOT EXISTS group_hierarchy (
+    parent_group_id UUID REFERENCES groups(id) ON DELETE CASCADE,
+    child_group_id UUID REFERENCES groups(id) ON DELETE CASCADE,
+    PRIMARY KEY (parent_group_id, child_group_id),
+    CHECK (parent_group_id <> child_group_id)
+);`
+
+// alterUsersAndGroupsAddDynamicGroups adds the attributes of users and the
+// rule whose matches are the members of a dynamic group; static groups have
+// no rule.
+const alterUsersAndGroupsAddDynamicGroups = `
+ALTER TABLE users ADD COLUMN IF NOT EXISTS attributes JSONB NOT NULL DEFAULT '{}';
+ALTER TABLE groups ADD COLUMN IF NOT EXISTS rule TEXT;`
+
+// alterMFADevicesAddSecretEncrypted seals TOTP secrets. Secrets stored in
+// plaintext before are sealed at startup (see mfa.SealStoredSecrets).
+const alterMFADevicesAddSecretEncrypted = `
+ALTER TABLE mfa_devices ADD COLUMN IF NOT EXISTS secret_encrypted BYTEA;
+ALTER TABLE mfa_devices ALTER COLUMN secret DROP NOT NULL;`
+
+// alterFederationAddLinking adds the providers trusted to have verified the
+// addresses they claim or to have performed MFA, and the user a sign-in
+// started from a session links its identity to.
+const alterFederationAddLinking = `
+ALTER TABLE federation_providers ADD COLUMN IF NOT EXISTS trust_email BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE federation_providers ADD COLUMN IF NOT EXISTS performs_mfa BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE federation_logins ADD COLUMN IF NOT EXISTS link_user_id UUID REFERENCES users(id) ON DELETE CASCADE;`
+
 const createIndexes = `
 CREATE INDEX IF NOT EXISTS idx_users_email ON users(email);
+CREATE INDEX IF NOT EXISTS idx_users_email_lower ON users(lower(email));
 CREATE INDEX IF NOT EXISTS idx_audit_logs_tenant_id ON audit_logs(tenant_id);
 CREATE INDEX IF NOT EXISTS idx_audit_logs_user_id ON audit_logs(user_id);
 CREATE INDEX IF NOT EXISTS idx_users_tenant_id ON users(tenant_id);
 CREATE INDEX IF NOT EXISTS idx_roles_tenant_id ON roles(tenant_id);
-CREATE INDEX IF NOT EXISTS idx_groups_tenant_id ON groups(tenant_id);`
\ No newline at end of file
+CREATE INDEX IF NOT EXISTS idx_groups_tenant_id ON groups(tenant_id);
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_family_id ON refresh_tokens(family_id);
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_user_id ON refresh_tokens(user_id);
+CREATE INDEX IF NOT EXISTS idx_mfa_devices_user_id ON mfa_devices(user_id);
+CREATE INDEX IF NOT EXISTS idx_mfa_backup_codes_user_id ON mfa_backup_codes(user_id);
+CREATE INDEX IF NOT EXISTS idx_webauthn_credentials_user_id ON webauthn_credentials(user_id);
+CREATE INDEX IF NOT EXISTS idx_login_attempts_email ON login_attempts(email, created_at);
+CREATE INDEX IF NOT EXISTS idx_login_attempts_ip_address ON login_attempts(ip_address, created_at);
+CREATE INDEX IF NOT EXISTS idx_oauth_clients_tenant_id ON oauth_clients(tenant_id);
+CREATE INDEX IF NOT EXISTS idx_api_tokens_user_id ON api_tokens(user_id);
+CREATE INDEX IF NOT EXISTS idx_service_account_certificates_service_account_id ON service_account_certificates(service_account_id);
+CREATE INDEX IF NOT EXISTS idx_provisioning_jobs_due ON provisioning_jobs(status, next_attempt_at);
+CREATE INDEX IF NOT EXISTS idx_provisioning_jobs_connector_id ON provisioning_jobs(connector_id, created_at);
+CREATE INDEX IF NOT EXISTS idx_saml_sessions_user_id ON saml_sessions(user_id);
+CREATE INDEX IF NOT EXISTS idx_saml_sessions_service_provider_id ON saml_sessions(service_provider_id, name_id);
+CREATE INDEX IF NOT EXISTS idx_saml_sessions_logout_request_id ON saml_sessions(logout_request_id);
+CREATE INDEX IF NOT EXISTS idx_federated_identities_user_id ON federated_identities(user_id);
+CREATE INDEX IF NOT EXISTS idx_role_hierarchy_child_role_id ON role_hierarchy(child_role_id);
+CREATE INDEX IF NOT EXISTS idx_group_hierarchy_child_group_id ON group_hierarchy(child_group_id);`
\ No newline at end of file
@@ -7,7 +7,51 @@ import (
 	"golang.org/x/crypto/bcrypt"
 )
 
+// permissions are the names routes are guarded with. They are created on
+// every start so existing installations pick up new ones.
+var permissions = []struct {
+	name        string
+	description string
+}{
+	{"user.read", "Read user data"},
+	{"user.write", "Write user data"},
+	{"user.delete", "Delete user data"},
+	{"group.read", "Read group data"},
+	{"group.write", "Write group data"},
+	{"group.delete", "Delete group data"},
+	{"role.read", "Read role data"},
+	{"role.write", "Write role data"},
+	{"role.delete", "Delete role data"},
+	{"tenant.read", "Read tenant settings"},
+	{"tenant.write", "Change tenant settings"},
+	{"client.read", "Read OAuth clients"},
+	{"client.write", "Register and change OAuth clients"},
+	{"client.delete", "Delete OAuth clients"},
+	{"token.read", "List the API keys of users"},
+	{"token.delete", "Revoke the API keys of users"},
+	{"service_account.read", "Read service accounts"},
+	{"service_account.write", "Create and change service accounts and their credentials"},
+	{"service_account.delete", "Delete service accounts"},
+	{"provisioning.read", "Read provisioning connectors and their jobs"},
+	{"provisioning.write", "Create and change provisioning connectors and retry their jobs"},
+	{"provisioning.delete", "Delete provisioning connectors"},
+	{"saml.read", "Read SAML service providers and the identity provider"},
+	{"saml.write", "Register and change SAML service providers"},
+	{"saml.delete", "Delete SAML service providers"},
+	{"federation.read", "Read external identity providers and the identities linked to users"},
+	{"federation.write", "Configure external identity providers and unlink identities"},
+	{"federation.delete", "Delete external identity providers"},
+	{"ldap.read", "Read and test the LDAP directory of the tenant"},
+	{"ldap.write", "Configure and remove the LDAP directory of the tenant"},
+	{"audit.read", "View audit logs"},
+	{"system.admin", "System administration"},
+}
+
 func Seed(db *sql.DB) error {
+	if err := seedPermissions(db); err != nil {
+		return err
+	}
+
 	// Check if system tenant already exists
 	var count int
 	err := db.QueryRow("SELECT COUNT(*) FROM tenants WHERE name = 'system'").Scan(&count)
@@ -58,47 +102,13 @@ func Seed(db *sql.DB) error {
 		return fmt.Errorf("failed to create admin role: %w", err)
 	}
 
-	// Create permissions
-	permissions := []struct {
-		name        string
-		description string
-	}{
-		{"user.read", "Read user data"},
-		{"user.write", "Write user data"},
-		{"user.delete", "Delete user data"},
-		{"group.read", "Read group data"},
-		{"group.write", "Write group data"},
-		{"group.delete", "Delete group data"},
-		{"role.read", "Read role data"},
-		{"role.write", "Write role data"},
-		{"role.delete", "Delete role data"},
-		{"audit.read", "View audit logs"},
-		{"system.admin", "System administration"},
-	}
-
-	var permissionIDs []string
-	for _, perm := range permissions {
-		var permID string
-		err = db.QueryRow(`
-			INSERT INTO permissions (name, description) 
-			VALUES ($1, $2) 
-			RETURNING id
-		`, perm.name, perm.description).Scan(&permID)
-		if err != nil {
-			return fmt.Errorf("failed to create permission %s: %w", perm.name, err)
-		}
-		permissionIDs = append(permissionIDs, permID)
-	}
-
 	// Assign all permissions to admin role
-	for _, permID := range permissionIDs {
-		_, err = db.Exec(`
-			INSERT INTO role_permissions (role_id, permission_id) 
-			VALUES ($1, $2)
-		`, roleID, permID)
-		if err != nil {
-			return fmt.Errorf("failed to assign permission to admin role: %w", err)
-		}
+	_, err = db.Exec(`
+		INSERT INTO role_permissions (role_id, permission_id)
+		SELECT $1, id FROM permissions
+	`, roleID)
+	if err != nil {
+		return fmt.Errorf("failed to assign permissions to admin role: %w", err)
 	}
 
 	// Assign admin role to admin user
@@ -111,4 +121,18 @@ func Seed(db *sql.DB) error {
 	}
 
 	return nil
-}
\ No newline at end of file
+}
+
+func seedPermissions(db *sql.DB) error {
+	for _, perm := range permissions {
+		_, err := db.Exec(`
+			INSERT INTO permissions (name, description)
+			VALUES ($1, $2)
+			ON CONFLICT (name) DO NOTHING
+		`, perm.name, perm.description)
+		if err != nil {
+			return fmt.Errorf("failed to create permission %s: %w", perm.name, err)
+		}
+	}
+	return nil
+}
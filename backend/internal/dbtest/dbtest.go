@@ -0,0 +1,206 @@
+// Package dbtest runs code using database/sql against a script instead of
+// Postgres. A test lists the statements the code under test should run,
+// each matched by a fragment of its text, with the rows they return. Any
+// other statement fails and is reported to the test, so stores and
+// handlers run unchanged and their SQL stays what ships.
+package dbtest
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// Script is the database of one test.
+type Script struct {
+	t     *testing.T
+	mu    sync.Mutex
+	steps []step
+	// ran lists the statements run, in order
+	ran []string
+}
+
+type step struct {
+	match   string
+	columns []string
+	answer  func(args []driver.Value) [][]driver.Value
+}
+
+type scriptDriver struct {
+	mu      sync.Mutex
+	scripts map[string]*Script
+}
+
+var testDriver = &scriptDriver{scripts: map[string]*Script{}}
+
+func init() {
+	sql.Register("dbtest", testDriver)
+}
+
+// Open returns a database answering from a new, empty script.
+func Open(t *testing.T) (*sql.DB, *Script) {
+	s := &Script{t: t}
+	testDriver.mu.Lock()
+	testDriver.scripts[t.Name()] = s
+	testDriver.mu.Unlock()
+
+	db, err := sql.Open("dbtest", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	t.Cleanup(func() {
+		db.Close()
+		testDriver.mu.Lock()
+		delete(testDriver.scripts, t.Name())
+		testDriver.mu.Unlock()
+	})
+	return db, s
+}
+
+// On answers statements containing match with rows of columns; without
+// column names the columns are numbered. Statements run with Exec affect
+// as many rows as are given. The first step matching a statement answers
+// it.
+func (s *Script) On(match string, columns []string, rows ...[]driver.Value) {
+	s.OnArgs(match, columns, func([]driver.Value) [][]driver.Value { return rows })
+}
+
+// OnArgs answers statements containing match with the rows answer returns
+// for their arguments.
+func (s *Script) OnArgs(match string, columns []string, answer func(args []driver.Value) [][]driver.Value) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.steps = append(s.steps, step{match: squash(match), columns: columns, answer: answer})
+}
+
+// Ran reports whether a statement containing match was run.
+func (s *Script) Ran(match string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, query := range s.ran {
+		if strings.Contains(query, squash(match)) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Script) run(query string, args []driver.Value) (*step, [][]driver.Value, error) {
+	query = squash(query)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ran = append(s.ran, query)
+	for i := range s.steps {
+		if strings.Contains(query, s.steps[i].match) {
+			return &s.steps[i], s.steps[i].answer(args), nil
+		}
+	}
+	s.t.Errorf("Unexpected statement: %s", query)
+	return nil, nil, fmt.Errorf("unexpected statement")
+}
+
+// squash collapses runs of white space, so fragments need not follow the
+// layout of the statement.
+func squash(query string) string {
+	return strings.Join(strings.Fields(query), " ")
+}
+
+// Array returns the elements of a pq.Array argument.
+func Array(v driver.Value) []string {
+	text, _ := v.(string)
+	if b, ok := v.([]byte); ok {
+		text = string(b)
+	}
+	text = strings.TrimSuffix(strings.TrimPrefix(text, "{"), "}")
+	if text == "" {
+		return nil
+	}
+	var values []string
+	for _, value := range strings.Split(text, ",") {
+		values = append(values, strings.Trim(value, `"`))
+	}
+	return values
+}
+
+func (d *scriptDriver) Open(name string) (driver.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s, ok := d.scripts[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown database %q", name)
+	}
+	return &conn{script: s}, nil
+}
+
+type conn struct {
+	script *Script
+}
+
+func (c *conn) Prepare(query string) (driver.Stmt, error) {
+	return &stmt{script: c.script, query: query}, nil
+}
+
+func (c *conn) Close() error              { return nil }
+func (c *conn) Begin() (driver.Tx, error) { return tx{}, nil }
+
+func (c *conn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return tx{}, nil
+}
+
+// tx only delimits statements; the script decides what each returns.
+type tx struct{}
+
+func (tx) Commit() error   { return nil }
+func (tx) Rollback() error { return nil }
+
+type stmt struct {
+	script *Script
+	query  string
+}
+
+func (s *stmt) Close() error  { return nil }
+func (s *stmt) NumInput() int { return -1 }
+
+func (s *stmt) Exec(args []driver.Value) (driver.Result, error) {
+	_, rows, err := s.script.run(s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(len(rows)), nil
+}
+
+func (s *stmt) Query(args []driver.Value) (driver.Rows, error) {
+	step, rows, err := s.script.run(s.query, args)
+	if err != nil {
+		return nil, err
+	}
+	columns := step.columns
+	if columns == nil && len(rows) > 0 {
+		for i := range rows[0] {
+			columns = append(columns, fmt.Sprintf("column%d", i+1))
+		}
+	}
+	return &resultRows{columns: columns, rows: rows}, nil
+}
+
+type resultRows struct {
+	columns []string
+	rows    [][]driver.Value
+}
+
+func (r *resultRows) Columns() []string { return r.columns }
+func (r *resultRows) Close() error      { return nil }
+
+func (r *resultRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
@@ -0,0 +1,436 @@
+// Package dynamicgroup keeps the members of dynamic groups, whose
+// membership follows a rule over the fields and attributes of users (see
+// Rule) instead of being assigned by hand. Memberships are kept in
+// user_groups like those of other groups, so everything reading them,
+// authorization included, works unchanged.
+//
+// Groups are reconciled when their rule is set, users when they change,
+// and every group periodically by Run. Rules apply to users only; service
+// accounts are never added or removed.
+package dynamicgroup
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/ForIAM/ForIAM/backend/internal/provisioning"
+	"github.com/lib/pq"
+)
+
+var ErrNotFound = errors.New("group not found")
+
+// auditReason marks the audit entries of membership changes made by a rule.
+const auditReason = "dynamic_rule"
+
+// Reconciler applies the rules of dynamic groups.
+type Reconciler struct {
+	db           *sql.DB
+	provisioning *provisioning.Queue
+}
+
+func NewReconciler(db *sql.DB) *Reconciler {
+	return &Reconciler{db: db, provisioning: provisioning.NewQueue(db)}
+}
+
+// Member is a user a rule matches.
+type Member struct {
+	ID       string `json:"id"`
+	Email    string `json:"email"`
+	IsActive bool   `json:"is_active"`
+}
+
+type user struct {
+	Member
+	fields map[string]interface{}
+}
+
+type querier interface {
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+}
+
+// users loads the users of tenantID, or only userID when it is set, with
+// the fields rules see: their attributes and, taking precedence, the
+// columns of users.
+func users(ctx context.Context, q querier, tenantID, userID string) ([]user, error) {
+	rows, err := q.QueryContext(ctx, `
+		SELECT id, email, is_active, display_name, given_name, family_name, external_id, attributes
+		FROM users
+		WHERE tenant_id = $1 AND principal_type = 'user' AND ($2 = '' OR id::text = $2)
+		ORDER BY email
+	`, tenantID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var result []user
+	for rows.Next() {
+		var u user
+		var displayName, givenName, familyName, externalID string
+		var attributes []byte
+		if err := rows.Scan(&u.ID, &u.Email, &u.IsActive, &displayName, &givenName, &familyName, &externalID, &attributes); err != nil {
+			return nil, err
+		}
+		u.fields = map[string]interface{}{}
+		if err := json.Unmarshal(attributes, &u.fields); err != nil || u.fields == nil {
+			u.fields = map[string]interface{}{}
+		}
+		u.fields["email"] = u.Email
+		u.fields["is_active"] = u.IsActive
+		u.fields["display_name"] = displayName
+		u.fields["given_name"] = givenName
+		u.fields["family_name"] = familyName
+		u.fields["external_id"] = externalID
+		result = append(result, u)
+	}
+	return result, rows.Err()
+}
+
+// columns are the fields of users rules see besides their attributes.
+var columns = []string{"email", "is_active", "display_name", "given_name", "family_name", "external_id"}
+
+// Change is a change to a user. An empty Email and nil IsActive are left
+// as they are; non-nil Attributes replace all attributes.
+type Change struct {
+	Email      string
+	IsActive   *bool
+	Attributes map[string]interface{}
+}
+
+// apply returns the fields rules see once change is made to a user with
+// fields.
+func (change Change) apply(fields map[string]interface{}) map[string]interface{} {
+	changed := map[string]interface{}{}
+	if change.Attributes != nil {
+		for key, value := range change.Attributes {
+			changed[key] = value
+		}
+		for _, column := range columns {
+			changed[column] = fields[column]
+		}
+	} else {
+		for key, value := range fields {
+			changed[key] = value
+		}
+	}
+	if change.Email != "" {
+		changed["email"] = change.Email
+	}
+	if change.IsActive != nil {
+		changed["is_active"] = *change.IsActive
+	}
+	return changed
+}
+
+// Joins returns the IDs of the dynamic groups of tenantID the user userID
+// would be added to by change, or, when userID is empty, that a new user
+// would be created in. An unknown user joins none.
+func (r *Reconciler) Joins(ctx context.Context, tenantID, userID string, change Change) ([]string, error) {
+	fields := map[string]interface{}{
+		"email": "", "is_active": true, "display_name": "", "given_name": "", "family_name": "", "external_id": "",
+	}
+	if userID != "" {
+		found, err := users(ctx, r.db, tenantID, userID)
+		if err != nil || len(found) == 0 {
+			return nil, err
+		}
+		fields = found[0].fields
+	}
+	fields = change.apply(fields)
+
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT g.id, g.rule FROM groups g
+		WHERE g.tenant_id = $1 AND g.rule IS NOT NULL
+			AND NOT EXISTS (SELECT 1 FROM user_groups ug WHERE ug.group_id = g.id AND ug.user_id::text = $2)
+		ORDER BY g.id
+	`, tenantID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var joins []string
+	for rows.Next() {
+		var groupID, source string
+		if err := rows.Scan(&groupID, &source); err != nil {
+			return nil, err
+		}
+		rule, err := Compile(source)
+		if err != nil {
+			// ReconcileUser skips the group as well
+			continue
+		}
+		if rule.Match(fields) {
+			joins = append(joins, groupID)
+		}
+	}
+	return joins, rows.Err()
+}
+
+// Preview returns the users of tenantID rule matches, sorted by email.
+func (r *Reconciler) Preview(ctx context.Context, tenantID string, rule *Rule) ([]Member, error) {
+	all, err := users(ctx, r.db, tenantID, "")
+	if err != nil {
+		return nil, err
+	}
+	members := []Member{}
+	for _, u := range all {
+		if rule.Match(u.fields) {
+			members = append(members, u.Member)
+		}
+	}
+	return members, nil
+}
+
+// ReconcileGroup makes the users in the group groupID exactly those its
+// rule matches, returning the IDs of those added and removed. Static
+// groups are left alone. actorID is audited as making the changes; it is
+// empty for the periodic reconcile.
+func (r *Reconciler) ReconcileGroup(ctx context.Context, tenantID, groupID, actorID string) ([]string, []string, error) {
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer tx.Rollback()
+
+	// Locking the group keeps concurrent reconciles of it apart
+	var source sql.NullString
+	err = tx.QueryRowContext(ctx, `
+		SELECT rule FROM groups WHERE id = $1 AND tenant_id = $2 FOR UPDATE
+	`, groupID, tenantID).Scan(&source)
+	if err == sql.ErrNoRows {
+		return nil, nil, ErrNotFound
+	}
+	if err != nil || !source.Valid {
+		return nil, nil, err
+	}
+	rule, err := Compile(source.String)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	all, err := users(ctx, tx, tenantID, "")
+	if err != nil {
+		return nil, nil, err
+	}
+	rows, err := tx.QueryContext(ctx, `
+		SELECT ug.user_id FROM user_groups ug
+		JOIN users u ON u.id = ug.user_id AND u.principal_type = 'user'
+		WHERE ug.group_id = $1
+	`, groupID)
+	if err != nil {
+		return nil, nil, err
+	}
+	current, err := scanIDs(rows)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	members := map[string]bool{}
+	for _, id := range current {
+		members[id] = true
+	}
+	var added, removed []string
+	for _, u := range all {
+		if rule.Match(u.fields) {
+			if !members[u.ID] {
+				added = append(added, u.ID)
+			}
+			delete(members, u.ID)
+		}
+	}
+	for id := range members {
+		removed = append(removed, id)
+	}
+
+	if _, err := tx.ExecContext(ctx, `
+		DELETE FROM user_groups WHERE group_id = $1 AND user_id = ANY($2)
+	`, groupID, pq.Array(removed)); err != nil {
+		return nil, nil, err
+	}
+	if _, err := tx.ExecContext(ctx, `
+		INSERT INTO user_groups (user_id, group_id)
+		SELECT unnest($2::uuid[]), $1
+		ON CONFLICT DO NOTHING
+	`, groupID, pq.Array(added)); err != nil {
+		return nil, nil, err
+	}
+	for _, id := range added {
+		if err := audit(ctx, tx, tenantID, actorID, "group.member_add", groupID, id); err != nil {
+			return nil, nil, err
+		}
+	}
+	for _, id := range removed {
+		if err := audit(ctx, tx, tenantID, actorID, "group.member_remove", groupID, id); err != nil {
+			return nil, nil, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, nil, err
+	}
+
+	if len(added)+len(removed) > 0 {
+		r.queue(tenantID, groupID)
+	}
+	return added, removed, nil
+}
+
+// ReconcileUser brings the memberships of userID in the dynamic groups of
+// its tenant up to date, after the user changed. actorID is audited as
+// making the changes.
+func (r *Reconciler) ReconcileUser(ctx context.Context, tenantID, userID, actorID string) error {
+	found, err := users(ctx, r.db, tenantID, userID)
+	if err != nil || len(found) == 0 {
+		return err
+	}
+	u := found[0]
+
+	rows, err := r.db.QueryContext(ctx, `
+		SELECT id, rule FROM groups WHERE tenant_id = $1 AND rule IS NOT NULL ORDER BY id
+	`, tenantID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	matches := map[string]bool{}
+	for rows.Next() {
+		var groupID, source string
+		if err := rows.Scan(&groupID, &source); err != nil {
+			return err
+		}
+		rule, err := Compile(source)
+		if err != nil {
+			log.Printf("Skipping dynamic group %s: %v", groupID, err)
+			continue
+		}
+		matches[groupID] = rule.Match(u.fields)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	tx, err := r.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var changed []string
+	for groupID, match := range matches {
+		action, query := "group.member_remove", `DELETE FROM user_groups WHERE user_id = $1 AND group_id = $2`
+		if match {
+			action, query = "group.member_add", `INSERT INTO user_groups (user_id, group_id) VALUES ($1, $2) ON CONFLICT DO NOTHING`
+		}
+		result, err := tx.ExecContext(ctx, query, u.ID, groupID)
+		if err != nil {
+			return err
+		}
+		if n, _ := result.RowsAffected(); n == 0 {
+			continue
+		}
+		if err := audit(ctx, tx, tenantID, actorID, action, groupID, u.ID); err != nil {
+			return err
+		}
+		changed = append(changed, groupID)
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+
+	for _, groupID := range changed {
+		r.queue(tenantID, groupID)
+	}
+	return nil
+}
+
+// ReconcileAll reconciles every dynamic group of every tenant. A group
+// failing does not stop the others; the first error is returned.
+func (r *Reconciler) ReconcileAll(ctx context.Context) error {
+	rows, err := r.db.QueryContext(ctx, `SELECT id, tenant_id FROM groups WHERE rule IS NOT NULL ORDER BY tenant_id, id`)
+	if err != nil {
+		return err
+	}
+	type group struct{ id, tenantID string }
+	var groups []group
+	for rows.Next() {
+		var g group
+		if err := rows.Scan(&g.id, &g.tenantID); err != nil {
+			rows.Close()
+			return err
+		}
+		groups = append(groups, g)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var first error
+	for _, g := range groups {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		_, _, err := r.ReconcileGroup(ctx, g.tenantID, g.id, "")
+		if err != nil && err != ErrNotFound {
+			log.Printf("Failed to reconcile dynamic group %s: %v", g.id, err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// Run reconciles every dynamic group every interval until ctx is done.
+// Several instances may run against the same database.
+func (r *Reconciler) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := r.ReconcileAll(ctx); err != nil {
+				log.Println("Failed to reconcile dynamic groups:", err)
+			}
+		}
+	}
+}
+
+// queue pushes a group whose members changed to the provisioning
+// connectors.
+func (r *Reconciler) queue(tenantID, groupID string) {
+	err := r.provisioning.Enqueue(tenantID, provisioning.ResourceGroup, groupID, provisioning.OperationUpsert)
+	if err != nil {
+		log.Println("Failed to queue provisioning:", err)
+	}
+}
+
+// audit records a membership change made by a rule.
+func audit(ctx context.Context, tx *sql.Tx, tenantID, actorID, action, groupID, userID string) error {
+	_, err := tx.ExecContext(ctx, `
+		INSERT INTO audit_logs (tenant_id, user_id, actor_type, action, resource, resource_id, target, target_id, status, reason)
+		VALUES ($1, NULLIF($2, '')::uuid, (SELECT principal_type FROM users WHERE id = NULLIF($2, '')::uuid),
+		        $3, 'group', $4, 'user', $5, 'success', $6)
+	`, tenantID, actorID, action, groupID, userID, auditReason)
+	return err
+}
+
+func scanIDs(rows *sql.Rows) ([]string, error) {
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
@@ -0,0 +1,42 @@
+package dynamicgroup
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestChangeApply(t *testing.T) {
+	fields := map[string]interface{}{
+		"email": "alice@example.com", "is_active": true, "display_name": "Alice", "given_name": "", "family_name": "",
+		"external_id": "", "department": "sales",
+	}
+	inactive := false
+
+	tests := []struct {
+		name     string
+		change   Change
+		expected map[string]interface{}
+	}{
+		{"no change", Change{}, fields},
+		{"email and status", Change{Email: "alice@corp.example.com", IsActive: &inactive}, map[string]interface{}{
+			"email": "alice@corp.example.com", "is_active": false, "display_name": "Alice", "given_name": "",
+			"family_name": "", "external_id": "", "department": "sales",
+		}},
+		{"attributes replaced", Change{Attributes: map[string]interface{}{"level": float64(3)}}, map[string]interface{}{
+			"email": "alice@example.com", "is_active": true, "display_name": "Alice", "given_name": "", "family_name": "",
+			"external_id": "", "level": float64(3),
+		}},
+		{"attributes cannot shadow fields", Change{Attributes: map[string]interface{}{"email": "admin@example.com"}}, map[string]interface{}{
+			"email": "alice@example.com", "is_active": true, "display_name": "Alice", "given_name": "", "family_name": "",
+			"external_id": "",
+		}},
+	}
+	for _, tt := range tests {
+		if got := tt.change.apply(fields); !reflect.DeepEqual(got, tt.expected) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.expected, got)
+		}
+	}
+	if fields["email"] != "alice@example.com" {
+		t.Error("apply changed the fields it was given")
+	}
+}
@@ -0,0 +1,505 @@
+package dynamicgroup
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Limits of a rule, so evaluating one stays cheap.
+const (
+	MaxRuleLength = 2000
+	maxDepth      = 32
+)
+
+var ErrInvalidRule = errors.New("invalid rule")
+
+// Rule is a compiled membership rule: a boolean expression over the fields
+// and attributes of a user.
+//
+// Values are strings ("sales"), numbers, true, false, null and lists
+// (["sales", "support"]). Names stand for the user's fields email,
+// is_active, display_name, given_name, family_name and external_id, or for
+// its attributes; attributes not set are null. Operators, loosest first:
+//
+//	||  &&  !  == != < <= > >= in
+//
+// in tests for membership in a list. startsWith, endsWith and contains take
+// two strings. Comparing values of different types is false rather than an
+// error, as is ordering values other than two numbers or two strings. A
+// user matches when the rule is true.
+type Rule struct {
+	source string
+	expr   expr
+}
+
+// Compile parses source.
+func Compile(source string) (*Rule, error) {
+	if strings.TrimSpace(source) == "" {
+		return nil, fmt.Errorf("%w: rule is empty", ErrInvalidRule)
+	}
+	if len(source) > MaxRuleLength {
+		return nil, fmt.Errorf("%w: rule is longer than %d characters", ErrInvalidRule, MaxRuleLength)
+	}
+	tokens, err := lex(source)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	e, err := p.or(0)
+	if err != nil {
+		return nil, err
+	}
+	if t := p.peek(); t.kind != tokenEnd {
+		return nil, p.unexpected(t)
+	}
+	return &Rule{source: source, expr: e}, nil
+}
+
+func (r *Rule) String() string { return r.source }
+
+// Match evaluates the rule for a user with fields.
+func (r *Rule) Match(fields map[string]interface{}) bool {
+	return r.expr.eval(fields) == true
+}
+
+type tokenKind int
+
+const (
+	tokenEnd tokenKind = iota
+	tokenName
+	tokenString
+	tokenNumber
+	tokenOperator
+)
+
+type token struct {
+	kind  tokenKind
+	text  string
+	value interface{}
+	pos   int
+}
+
+var operators = []string{"&&", "||", "==", "!=", "<=", ">=", "<", ">", "!", "(", ")", "[", "]", ","}
+
+func lex(source string) ([]token, error) {
+	var tokens []token
+	for i := 0; i < len(source); {
+		c := source[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+			i++
+		case c == '"':
+			value, n, err := lexString(source[i:])
+			if err != nil {
+				return nil, fmt.Errorf("%w: %v at position %d", ErrInvalidRule, err, i+1)
+			}
+			tokens = append(tokens, token{kind: tokenString, text: source[i : i+n], value: value, pos: i})
+			i += n
+		case c == '-' || isDigit(c):
+			n := 1
+			for ; i+n < len(source); n++ {
+				c, prev := source[i+n], source[i+n-1]
+				exponent := (c == '+' || c == '-') && (prev == 'e' || prev == 'E')
+				if !isDigit(c) && c != '.' && c != 'e' && c != 'E' && !exponent {
+					break
+				}
+			}
+			value, err := strconv.ParseFloat(source[i:i+n], 64)
+			if err != nil {
+				return nil, fmt.Errorf("%w: malformed number %s at position %d", ErrInvalidRule, source[i:i+n], i+1)
+			}
+			tokens = append(tokens, token{kind: tokenNumber, text: source[i : i+n], value: value, pos: i})
+			i += n
+		case isLetter(c):
+			n := 1
+			for i+n < len(source) && (isLetter(source[i+n]) || isDigit(source[i+n])) {
+				n++
+			}
+			tokens = append(tokens, token{kind: tokenName, text: source[i : i+n], pos: i})
+			i += n
+		default:
+			matched := false
+			for _, op := range operators {
+				if strings.HasPrefix(source[i:], op) {
+					tokens = append(tokens, token{kind: tokenOperator, text: op, pos: i})
+					i += len(op)
+					matched = true
+					break
+				}
+			}
+			if !matched {
+				return nil, fmt.Errorf("%w: unexpected %q at position %d", ErrInvalidRule, c, i+1)
+			}
+		}
+	}
+	return append(tokens, token{kind: tokenEnd, pos: len(source)}), nil
+}
+
+func isDigit(c byte) bool { return c >= '0' && c <= '9' }
+
+func isLetter(c byte) bool { return c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' }
+
+// lexString reads the string literal at the start of s, returning its value
+// and length.
+func lexString(s string) (string, int, error) {
+	var b strings.Builder
+	for i := 1; i < len(s); i++ {
+		switch s[i] {
+		case '"':
+			return b.String(), i + 1, nil
+		case '\\':
+			i++
+			if i == len(s) {
+				break
+			}
+			switch s[i] {
+			case '"', '\\':
+				b.WriteByte(s[i])
+			case 'n':
+				b.WriteByte('\n')
+			case 't':
+				b.WriteByte('\t')
+			default:
+				return "", 0, fmt.Errorf("unknown escape \\%c", s[i])
+			}
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return "", 0, errors.New("unterminated string")
+}
+
+type parser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *parser) peek() token { return p.tokens[p.pos] }
+
+func (p *parser) next() token {
+	t := p.tokens[p.pos]
+	if t.kind != tokenEnd {
+		p.pos++
+	}
+	return t
+}
+
+// accept consumes the next token when it is the operator or keyword text.
+func (p *parser) accept(text string) bool {
+	if t := p.peek(); (t.kind == tokenOperator || t.kind == tokenName) && t.text == text {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(text string) error {
+	if !p.accept(text) {
+		return p.unexpected(p.peek())
+	}
+	return nil
+}
+
+func (p *parser) unexpected(t token) error {
+	if t.kind == tokenEnd {
+		return fmt.Errorf("%w: unexpected end of rule", ErrInvalidRule)
+	}
+	return fmt.Errorf("%w: unexpected %s at position %d", ErrInvalidRule, t.text, t.pos+1)
+}
+
+// deep fails once parentheses, lists, calls and negations nest deeper than
+// maxDepth.
+func (p *parser) deep(depth int) error {
+	if depth > maxDepth {
+		return fmt.Errorf("%w: rule is nested too deeply", ErrInvalidRule)
+	}
+	return nil
+}
+
+func (p *parser) or(depth int) (expr, error) {
+	if err := p.deep(depth); err != nil {
+		return nil, err
+	}
+	left, err := p.and(depth)
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("||") {
+		right, err := p.and(depth)
+		if err != nil {
+			return nil, err
+		}
+		left = logical{op: "||", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) and(depth int) (expr, error) {
+	left, err := p.not(depth)
+	if err != nil {
+		return nil, err
+	}
+	for p.accept("&&") {
+		right, err := p.not(depth)
+		if err != nil {
+			return nil, err
+		}
+		left = logical{op: "&&", left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) not(depth int) (expr, error) {
+	if p.accept("!") {
+		if err := p.deep(depth + 1); err != nil {
+			return nil, err
+		}
+		e, err := p.not(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		return not{e}, nil
+	}
+	return p.comparison(depth)
+}
+
+var comparisons = map[string]bool{"==": true, "!=": true, "<": true, "<=": true, ">": true, ">=": true}
+
+func (p *parser) comparison(depth int) (expr, error) {
+	left, err := p.operand(depth)
+	if err != nil {
+		return nil, err
+	}
+	t := p.peek()
+	switch {
+	case t.kind == tokenOperator && comparisons[t.text]:
+		p.next()
+		right, err := p.operand(depth)
+		if err != nil {
+			return nil, err
+		}
+		return comparison{op: t.text, left: left, right: right}, nil
+	case t.kind == tokenName && t.text == "in":
+		p.next()
+		right, err := p.operand(depth)
+		if err != nil {
+			return nil, err
+		}
+		return in{item: left, list: right}, nil
+	}
+	return left, nil
+}
+
+func (p *parser) operand(depth int) (expr, error) {
+	if err := p.deep(depth); err != nil {
+		return nil, err
+	}
+	t := p.next()
+	switch t.kind {
+	case tokenString, tokenNumber:
+		return literal{t.value}, nil
+	case tokenName:
+		switch t.text {
+		case "true":
+			return literal{true}, nil
+		case "false":
+			return literal{false}, nil
+		case "null":
+			return literal{nil}, nil
+		case "in":
+			return nil, p.unexpected(t)
+		}
+		if p.accept("(") {
+			return p.call(t, depth)
+		}
+		return name(t.text), nil
+	case tokenOperator:
+		switch t.text {
+		case "(":
+			e, err := p.or(depth + 1)
+			if err != nil {
+				return nil, err
+			}
+			return e, p.expect(")")
+		case "[":
+			var items list
+			for !p.accept("]") {
+				if len(items) > 0 {
+					if err := p.expect(","); err != nil {
+						return nil, err
+					}
+				}
+				item, err := p.operand(depth + 1)
+				if err != nil {
+					return nil, err
+				}
+				items = append(items, item)
+			}
+			return items, nil
+		}
+	}
+	return nil, p.unexpected(t)
+}
+
+// functions are the functions rules can call, each of two strings.
+var functions = map[string]func(s, arg string) bool{
+	"startsWith": strings.HasPrefix,
+	"endsWith":   strings.HasSuffix,
+	"contains":   strings.Contains,
+}
+
+func (p *parser) call(t token, depth int) (expr, error) {
+	fn, ok := functions[t.text]
+	if !ok {
+		return nil, fmt.Errorf("%w: unknown function %s at position %d", ErrInvalidRule, t.text, t.pos+1)
+	}
+	var args []expr
+	for !p.accept(")") {
+		if len(args) > 0 {
+			if err := p.expect(","); err != nil {
+				return nil, err
+			}
+		}
+		arg, err := p.or(depth + 1)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, arg)
+	}
+	if len(args) != 2 {
+		return nil, fmt.Errorf("%w: %s takes 2 arguments", ErrInvalidRule, t.text)
+	}
+	return call{fn: fn, args: args}, nil
+}
+
+type expr interface {
+	eval(fields map[string]interface{}) interface{}
+}
+
+type literal struct{ value interface{} }
+
+func (e literal) eval(map[string]interface{}) interface{} { return e.value }
+
+type name string
+
+func (e name) eval(fields map[string]interface{}) interface{} { return fields[string(e)] }
+
+type list []expr
+
+func (e list) eval(fields map[string]interface{}) interface{} {
+	values := make([]interface{}, len(e))
+	for i, item := range e {
+		values[i] = item.eval(fields)
+	}
+	return values
+}
+
+type not struct{ e expr }
+
+func (e not) eval(fields map[string]interface{}) interface{} { return e.e.eval(fields) != true }
+
+type logical struct {
+	op          string
+	left, right expr
+}
+
+func (e logical) eval(fields map[string]interface{}) interface{} {
+	left := e.left.eval(fields) == true
+	if e.op == "&&" {
+		return left && e.right.eval(fields) == true
+	}
+	return left || e.right.eval(fields) == true
+}
+
+type comparison struct {
+	op          string
+	left, right expr
+}
+
+func (e comparison) eval(fields map[string]interface{}) interface{} {
+	left, right := e.left.eval(fields), e.right.eval(fields)
+	switch e.op {
+	case "==":
+		return equal(left, right)
+	case "!=":
+		return !equal(left, right)
+	}
+
+	var order int
+	switch l := left.(type) {
+	case float64:
+		r, ok := right.(float64)
+		if !ok {
+			return false
+		}
+		order = compare(l < r, l > r)
+	case string:
+		r, ok := right.(string)
+		if !ok {
+			return false
+		}
+		order = strings.Compare(l, r)
+	default:
+		return false
+	}
+	switch e.op {
+	case "<":
+		return order < 0
+	case "<=":
+		return order <= 0
+	case ">":
+		return order > 0
+	default:
+		return order >= 0
+	}
+}
+
+func compare(less, greater bool) int {
+	switch {
+	case less:
+		return -1
+	case greater:
+		return 1
+	}
+	return 0
+}
+
+func equal(a, b interface{}) bool {
+	return reflect.DeepEqual(a, b)
+}
+
+type in struct{ item, list expr }
+
+func (e in) eval(fields map[string]interface{}) interface{} {
+	values, ok := e.list.eval(fields).([]interface{})
+	if !ok {
+		return false
+	}
+	item := e.item.eval(fields)
+	for _, value := range values {
+		if equal(item, value) {
+			return true
+		}
+	}
+	return false
+}
+
+type call struct {
+	fn   func(s, arg string) bool
+	args []expr
+}
+
+func (e call) eval(fields map[string]interface{}) interface{} {
+	s, ok := e.args[0].eval(fields).(string)
+	if !ok {
+		return false
+	}
+	arg, ok := e.args[1].eval(fields).(string)
+	if !ok {
+		return false
+	}
+	return e.fn(s, arg)
+}
@@ -0,0 +1,81 @@
+package dynamicgroup
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestRuleMatch(t *testing.T) {
+	alice := map[string]interface{}{
+		"email":      "alice@sales.example.com",
+		"is_active":  true,
+		"department": "sales",
+		"level":      float64(3),
+		"teams":      []interface{}{"emea", "enterprise"},
+	}
+
+	tests := []struct {
+		rule     string
+		expected bool
+	}{
+		{`department == "sales" && is_active`, true},
+		{`department == "sales" && !is_active`, false},
+		{`department != "sales" || level >= 3`, true},
+		{`level > 3`, false},
+		{`level < 10 && level <= 3`, true},
+		{`department in ["sales", "support"]`, true},
+		{`"emea" in teams`, true},
+		{`"apac" in teams`, false},
+		{`endsWith(email, "@sales.example.com")`, true},
+		{`startsWith(email, "bob")`, false},
+		{`contains(department, "ale")`, true},
+		{`cost_center == null`, true},
+		{`cost_center == ""`, false},
+		{`level == "3"`, false},
+		{`department < 3`, false},
+		{`department > "marketing"`, true},
+		{`!(department == "support" || level < 2)`, true},
+		{`department == "sales" && (level == 1 || level == 3)`, true},
+		{`department`, false},
+		{`startsWith(level, "3")`, false},
+		{`name == "café" || department == "sales"`, true},
+	}
+	for _, tt := range tests {
+		rule, err := Compile(tt.rule)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", tt.rule, err)
+			continue
+		}
+		if got := rule.Match(alice); got != tt.expected {
+			t.Errorf("%s: expected %v, got %v", tt.rule, tt.expected, got)
+		}
+	}
+}
+
+func TestCompileInvalid(t *testing.T) {
+	tests := []string{
+		``,
+		`   `,
+		`department ==`,
+		`department == "sales`,
+		`department = "sales"`,
+		`(department == "sales"`,
+		`department == "sales")`,
+		`lower(department) == "sales"`,
+		`startsWith(email)`,
+		`department in ["sales" "support"]`,
+		`in == 1`,
+		`level == 1.2.3`,
+		`"a\q" == department`,
+		`department == 'sales'`,
+		strings.Repeat("(", 40) + "true" + strings.Repeat(")", 40),
+		strings.Repeat("!", 40) + "true",
+		strings.Repeat("a", MaxRuleLength+1),
+	}
+	for _, rule := range tests {
+		if _, err := Compile(rule); !errors.Is(err, ErrInvalidRule) {
+			t.Errorf("%.40s: expected ErrInvalidRule, got %v", rule, err)
+		}
+	}
+}
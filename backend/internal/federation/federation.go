@@ -0,0 +1,299 @@
+// Package federation signs users in through the identity providers of their
+// organisation. A tenant configures upstream OpenID Connect providers or
+// SAML 2.0 IdPs; ForIAM acts as relying party, links the external subject
+// to a local user and, when the provider allows it, creates users on their
+// first sign-in. Groups claimed by the provider can be mapped onto the
+// tenant's groups, which are kept in step on every sign-in.
+package federation
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ForIAM/ForIAM/backend/internal/saml"
+	"github.com/google/uuid"
+)
+
+// Provider types.
+const (
+	TypeOIDC = "oidc"
+	TypeSAML = "saml"
+)
+
+// SubjectAttribute is the name under which the NameID of a SAML assertion
+// is available to the claim mapping.
+const SubjectAttribute = "NameID"
+
+var (
+	ErrNotFound         = errors.New("identity provider not found")
+	ErrInvalidProvider  = errors.New("invalid identity provider")
+	ErrLoginNotFound    = errors.New("federated login not found or expired")
+	ErrUpstream         = errors.New("identity provider error")
+	ErrAccessDenied     = errors.New("the identity provider denied the sign-in")
+	ErrInvalidProfile   = errors.New("invalid identity")
+	ErrAccountNotFound  = errors.New("no account for this identity")
+	ErrAccountDisabled  = errors.New("account disabled")
+	ErrEmailConflict    = errors.New("the email address belongs to another account")
+	ErrEmailNotVerified = errors.New("the identity provider has not verified the email address")
+	ErrLinkRequired     = errors.New("the identity must be linked from a signed-in session")
+	ErrIdentityConflict = errors.New("the identity is linked to another account")
+	ErrIdentityNotFound = errors.New("linked identity not found")
+)
+
+// Provider is an upstream identity provider of a tenant.
+//
+// OpenID Connect providers are found by discovery from Issuer and
+// authenticate ForIAM with ClientID and ClientSecret, which is write only
+// and stored encrypted. SAML IdPs receive AuthnRequests at SSOURL and sign
+// their responses with Certificate.
+//
+// ClaimMapping maps claims, or SAML attributes, to the user fields email,
+// display_name, given_name and family_name. The values of GroupsClaim are
+// mapped to the IDs of local groups by GroupMapping.
+//
+// TrustEmail links identities to existing users by email address even when
+// the provider does not claim email_verified. PerformsMFA skips the MFA
+// challenge after signing in, as the provider asks for a second factor
+// itself.
+type Provider struct {
+	ID       string `json:"id"`
+	TenantID string `json:"tenant_id"`
+	Name     string `json:"name"`
+	Type     string `json:"type"`
+
+	Issuer       string   `json:"issuer,omitempty"`
+	ClientID     string   `json:"client_id,omitempty"`
+	ClientSecret string   `json:"-"`
+	Scopes       []string `json:"scopes,omitempty"`
+
+	EntityID    string `json:"entity_id,omitempty"`
+	SSOURL      string `json:"sso_url,omitempty"`
+	Certificate string `json:"certificate,omitempty"`
+
+	ClaimMapping         map[string]string `json:"claim_mapping"`
+	GroupsClaim          string            `json:"groups_claim"`
+	GroupMapping         map[string]string `json:"group_mapping"`
+	JITProvisioning      bool              `json:"jit_provisioning"`
+	DisablePasswordLogin bool              `json:"disable_password_login"`
+	TrustEmail           bool              `json:"trust_email"`
+	PerformsMFA          bool              `json:"performs_mfa"`
+	IsActive             bool              `json:"is_active"`
+	CreatedAt            time.Time         `json:"created_at"`
+}
+
+// User fields claims can be mapped to.
+var userFields = map[string]bool{
+	"email":        true,
+	"display_name": true,
+	"given_name":   true,
+	"family_name":  true,
+}
+
+// DefaultClaimMapping returns the mapping of the standard claims of
+// providerType: the OpenID Connect ones, or for SAML the attribute names
+// ForIAM's own IdP sends.
+func DefaultClaimMapping(providerType string) map[string]string {
+	if providerType == TypeSAML {
+		return map[string]string{
+			"email":       "email",
+			"displayName": "display_name",
+			"givenName":   "given_name",
+			"surname":     "family_name",
+		}
+	}
+	return map[string]string{
+		"email":       "email",
+		"name":        "display_name",
+		"given_name":  "given_name",
+		"family_name": "family_name",
+	}
+}
+
+// Validate checks p and fills in the defaults: the scopes openid, email
+// and profile, the default claim mapping when it has none, and the groups
+// claim "groups".
+func (p *Provider) Validate() error {
+	if strings.TrimSpace(p.Name) == "" {
+		return fmt.Errorf("%w: name is required", ErrInvalidProvider)
+	}
+
+	switch p.Type {
+	case TypeOIDC:
+		if !isHTTPURL(p.Issuer) {
+			return fmt.Errorf("%w: issuer must be an http or https URL", ErrInvalidProvider)
+		}
+		if strings.TrimSpace(p.ClientID) == "" {
+			return fmt.Errorf("%w: client_id is required", ErrInvalidProvider)
+		}
+		if len(p.Scopes) == 0 {
+			p.Scopes = []string{"openid", "email", "profile"}
+		}
+		if !contains(p.Scopes, "openid") {
+			return fmt.Errorf("%w: scopes must include openid", ErrInvalidProvider)
+		}
+		p.EntityID, p.SSOURL, p.Certificate = "", "", ""
+	case TypeSAML:
+		if strings.TrimSpace(p.EntityID) == "" {
+			return fmt.Errorf("%w: entity_id is required", ErrInvalidProvider)
+		}
+		if !isHTTPURL(p.SSOURL) {
+			return fmt.Errorf("%w: sso_url must be an http or https URL", ErrInvalidProvider)
+		}
+		if _, err := saml.ParseCertificate(p.Certificate); err != nil {
+			return fmt.Errorf("%w: certificate: %v", ErrInvalidProvider, err)
+		}
+		p.Issuer, p.ClientID, p.ClientSecret, p.Scopes = "", "", "", nil
+	default:
+		return fmt.Errorf("%w: type must be oidc or saml", ErrInvalidProvider)
+	}
+
+	if p.ClaimMapping == nil {
+		p.ClaimMapping = DefaultClaimMapping(p.Type)
+	}
+	email := false
+	for claim, field := range p.ClaimMapping {
+		if strings.TrimSpace(claim) == "" {
+			return fmt.Errorf("%w: claim names must not be empty", ErrInvalidProvider)
+		}
+		if !userFields[field] {
+			return fmt.Errorf("%w: unknown user field %q for %s", ErrInvalidProvider, field, claim)
+		}
+		email = email || field == "email"
+	}
+	if !email {
+		return fmt.Errorf("%w: a claim must be mapped to email", ErrInvalidProvider)
+	}
+
+	if p.GroupsClaim == "" {
+		p.GroupsClaim = "groups"
+	}
+	if p.GroupMapping == nil {
+		p.GroupMapping = map[string]string{}
+	}
+	for value, groupID := range p.GroupMapping {
+		if value == "" {
+			return fmt.Errorf("%w: group names must not be empty", ErrInvalidProvider)
+		}
+		if _, err := uuid.Parse(groupID); err != nil {
+			return fmt.Errorf("%w: %s is not mapped to a group ID", ErrInvalidProvider, value)
+		}
+	}
+	return nil
+}
+
+func isHTTPURL(value string) bool {
+	u, err := url.Parse(value)
+	return err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != ""
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+// Profile is what a provider asserted about a user: a subject that stays
+// the same across sign-ins, and the claims or SAML attributes, each as a
+// list of strings.
+type Profile struct {
+	Subject string
+	Claims  map[string][]string
+}
+
+// Fields returns the user fields profile maps to. A claim with several
+// values maps its first one.
+func (p *Provider) Fields(profile *Profile) map[string]string {
+	fields := map[string]string{}
+	for claim, field := range p.ClaimMapping {
+		if values := profile.Claims[claim]; len(values) > 0 && strings.TrimSpace(values[0]) != "" {
+			fields[field] = strings.TrimSpace(values[0])
+		}
+	}
+	return fields
+}
+
+// Groups returns the IDs of the local groups the groups claim of profile
+// maps to.
+func (p *Provider) Groups(profile *Profile) map[string]bool {
+	groups := map[string]bool{}
+	for _, value := range profile.Claims[p.GroupsClaim] {
+		if groupID, ok := p.GroupMapping[value]; ok {
+			groups[groupID] = true
+		}
+	}
+	return groups
+}
+
+// emailUnverified reports whether profile says its email address is not
+// verified.
+func emailUnverified(profile *Profile) bool {
+	values := profile.Claims["email_verified"]
+	return len(values) == 1 && values[0] == "false"
+}
+
+// emailVerified reports whether profile says its email address is verified.
+func emailVerified(profile *Profile) bool {
+	values := profile.Claims["email_verified"]
+	return len(values) == 1 && values[0] == "true"
+}
+
+// linksByEmail reports whether profile can be linked to the existing user
+// with its email address: the provider must say it verified the address,
+// or be trusted to have done so.
+func (p *Provider) linksByEmail(profile *Profile) bool {
+	if emailUnverified(profile) {
+		return false
+	}
+	return p.TrustEmail || emailVerified(profile)
+}
+
+// claimValues converts a JSON claim to strings. Claims of other types are
+// left out.
+func claimValues(claim interface{}) []string {
+	switch v := claim.(type) {
+	case string:
+		return []string{v}
+	case bool:
+		return []string{strconv.FormatBool(v)}
+	case float64:
+		return []string{strconv.FormatFloat(v, 'f', -1, 64)}
+	case []interface{}:
+		var values []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// loginURL is the base of the endpoints of ForIAM as relying party of a
+// provider, under the public base URL of the server.
+func loginURL(baseURL, providerID string) string {
+	return strings.TrimRight(baseURL, "/") + "/auth/federation/" + providerID
+}
+
+// RedirectURI is where an OpenID provider sends its authorization
+// responses.
+func RedirectURI(baseURL, providerID string) string {
+	return loginURL(baseURL, providerID) + "/callback"
+}
+
+// ACSURL is where a SAML IdP posts its responses.
+func ACSURL(baseURL, providerID string) string {
+	return loginURL(baseURL, providerID) + "/acs"
+}
+
+// EntityID identifies ForIAM as service provider to a SAML IdP.
+func EntityID(baseURL, providerID string) string {
+	return loginURL(baseURL, providerID)
+}
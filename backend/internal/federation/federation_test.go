@@ -0,0 +1,190 @@
+package federation
+
+import (
+	"encoding/base64"
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ForIAM/ForIAM/backend/internal/saml"
+)
+
+func TestValidate(t *testing.T) {
+	p := &Provider{Name: "Corp", Type: TypeOIDC, Issuer: "https://corp.example", ClientID: "forIAM", EntityID: "stale"}
+	if err := p.Validate(); err != nil {
+		t.Fatalf("Validate returned error: %v", err)
+	}
+	if !reflect.DeepEqual(p.Scopes, []string{"openid", "email", "profile"}) || p.GroupsClaim != "groups" || p.EntityID != "" {
+		t.Errorf("Unexpected defaults %+v", p)
+	}
+	if !reflect.DeepEqual(p.ClaimMapping, DefaultClaimMapping(TypeOIDC)) {
+		t.Errorf("ClaimMapping = %v, want the default mapping", p.ClaimMapping)
+	}
+
+	credential, err := saml.GenerateCredential("corp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	valid := func() *Provider {
+		return &Provider{Name: "Corp", Type: TypeSAML, EntityID: "https://corp.example", SSOURL: "https://corp.example/sso", Certificate: credential.CertificatePEM()}
+	}
+	tests := []struct {
+		name   string
+		change func(p *Provider)
+	}{
+		{"no name", func(p *Provider) { p.Name = " " }},
+		{"unknown type", func(p *Provider) { p.Type = "ldap" }},
+		{"no issuer", func(p *Provider) { p.Type, p.ClientID = TypeOIDC, "forIAM" }},
+		{"no client ID", func(p *Provider) { p.Type, p.Issuer = TypeOIDC, "https://corp.example" }},
+		{"no openid scope", func(p *Provider) {
+			p.Type, p.Issuer, p.ClientID, p.Scopes = TypeOIDC, "https://corp.example", "forIAM", []string{"email"}
+		}},
+		{"no entity ID", func(p *Provider) { p.EntityID = "" }},
+		{"relative SSO URL", func(p *Provider) { p.SSOURL = "/sso" }},
+		{"no certificate", func(p *Provider) { p.Certificate = "" }},
+		{"no email mapping", func(p *Provider) { p.ClaimMapping = map[string]string{"name": "display_name"} }},
+		{"unknown field", func(p *Provider) { p.ClaimMapping = map[string]string{"email": "email", "x": "password_hash"} }},
+		{"group mapping to no ID", func(p *Provider) { p.GroupMapping = map[string]string{"staff": "staff"} }},
+	}
+	for _, tt := range tests {
+		p := valid()
+		tt.change(p)
+		if err := p.Validate(); !errors.Is(err, ErrInvalidProvider) {
+			t.Errorf("%s: expected ErrInvalidProvider, got %v", tt.name, err)
+		}
+	}
+
+	p = valid()
+	p.ClientSecret = "stale"
+	if err := p.Validate(); err != nil || p.ClientSecret != "" || !reflect.DeepEqual(p.ClaimMapping, DefaultClaimMapping(TypeSAML)) {
+		t.Errorf("Unexpected SAML provider %+v, %v", p, err)
+	}
+}
+
+func TestFieldsAndGroups(t *testing.T) {
+	p := &Provider{
+		ClaimMapping: DefaultClaimMapping(TypeOIDC),
+		GroupsClaim:  "roles",
+		GroupMapping: map[string]string{"staff": "g1", "admins": "g2", "all": "g1"},
+	}
+	profile := &Profile{Subject: "s", Claims: map[string][]string{
+		"email":      {" alice@corp.example "},
+		"name":       {""},
+		"given_name": {"Alice", "Ali"},
+		"roles":      {"staff", "guests"},
+	}}
+	if fields := p.Fields(profile); !reflect.DeepEqual(fields, map[string]string{"email": "alice@corp.example", "given_name": "Alice"}) {
+		t.Errorf("Unexpected fields %v", fields)
+	}
+	if groups := p.Groups(profile); !reflect.DeepEqual(groups, map[string]bool{"g1": true}) {
+		t.Errorf("Unexpected groups %v", groups)
+	}
+
+	if emailUnverified(profile) || p.linksByEmail(profile) {
+		t.Error("Expected a profile without email_verified not to link by email")
+	}
+	p.TrustEmail = true
+	if !p.linksByEmail(profile) {
+		t.Error("Expected a trusted provider to link by email")
+	}
+	profile.Claims["email_verified"] = []string{"false"}
+	if !emailUnverified(profile) || p.linksByEmail(profile) {
+		t.Error("Expected email_verified false to be unverified")
+	}
+	p.TrustEmail = false
+	profile.Claims["email_verified"] = []string{"true"}
+	if !p.linksByEmail(profile) {
+		t.Error("Expected email_verified true to link by email")
+	}
+}
+
+func TestClaimValues(t *testing.T) {
+	tests := []struct {
+		claim interface{}
+		want  []string
+	}{
+		{"a", []string{"a"}},
+		{true, []string{"true"}},
+		{float64(42), []string{"42"}},
+		{[]interface{}{"a", 1.0, "b"}, []string{"a", "b"}},
+		{map[string]interface{}{"a": "b"}, nil},
+	}
+	for _, tt := range tests {
+		if got := claimValues(tt.claim); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("claimValues(%v) = %v, want %v", tt.claim, got, tt.want)
+		}
+	}
+}
+
+// samlResponse has a ForIAM IdP, the mock upstream IdP, answer the
+// AuthnRequest of client.
+func samlResponse(t *testing.T, idp *saml.IdP, client *SAMLClient, nameIDFormat string, now time.Time) (*Login, []byte) {
+	t.Helper()
+	requestID, request := client.AuthnRequest(now)
+	authn, err := saml.ParseAuthnRequest(request, client.provider.SSOURL)
+	if err != nil {
+		t.Fatalf("ParseAuthnRequest returned error: %v", err)
+	}
+
+	sp := &saml.ServiceProvider{Name: "ForIAM", EntityID: authn.Issuer, ACSURL: authn.AssertionConsumerServiceURL, NameIDFormat: nameIDFormat}
+	if err := sp.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	identity := &saml.Identity{UserID: "u1", Fields: map[string]string{"email": "alice@corp.example", "display_name": "Alice Example"}, Groups: []string{"Staff"}}
+	encoded, err := idp.Response(&saml.Login{
+		ServiceProvider: sp,
+		InResponseTo:    authn.ID,
+		Identity:        identity,
+		NameID:          sp.NameID(identity),
+		SessionIndex:    "_s1",
+	}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &Login{RequestID: requestID}, data
+}
+
+func TestSAMLLogin(t *testing.T) {
+	credential, err := saml.GenerateCredential("corp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := saml.NewIdP("https://corp.example", "t1", credential)
+	provider := &Provider{ID: "p1", Name: "Corp", Type: TypeSAML, EntityID: idp.EntityID, SSOURL: idp.SSOURL, Certificate: credential.CertificatePEM()}
+	if err := provider.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	client := NewSAMLClient(provider, "https://iam.example")
+	now := time.Now()
+
+	login, data := samlResponse(t, idp, client, saml.NameIDFormatEmail, now)
+	profile, err := client.ParseResponse(login, data, now)
+	if err != nil {
+		t.Fatalf("ParseResponse returned error: %v", err)
+	}
+	if profile.Subject != "alice@corp.example" || !reflect.DeepEqual(profile.Claims[SubjectAttribute], []string{"alice@corp.example"}) {
+		t.Errorf("Unexpected profile %+v", profile)
+	}
+	if fields := provider.Fields(profile); fields["email"] != "alice@corp.example" || fields["display_name"] != "Alice Example" {
+		t.Errorf("Unexpected fields %v", fields)
+	}
+
+	if _, err := client.ParseResponse(&Login{RequestID: "_other"}, data, now); !errors.Is(err, ErrInvalidProfile) {
+		t.Errorf("Expected a response to another request to be rejected, got %v", err)
+	}
+	other := NewSAMLClient(&Provider{ID: "p2", EntityID: provider.EntityID, SSOURL: provider.SSOURL, Certificate: provider.Certificate}, "https://iam.example")
+	if _, err := other.ParseResponse(login, data, now); !errors.Is(err, ErrInvalidProfile) {
+		t.Errorf("Expected a response for another provider to be rejected, got %v", err)
+	}
+
+	login, data = samlResponse(t, idp, client, saml.NameIDFormatTransient, now)
+	if _, err := client.ParseResponse(login, data, now); !errors.Is(err, ErrInvalidProfile) || !strings.Contains(err.Error(), "transient") {
+		t.Errorf("Expected a transient name ID to be rejected, got %v", err)
+	}
+}
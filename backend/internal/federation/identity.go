@@ -0,0 +1,239 @@
+package federation
+
+import (
+	"database/sql"
+	"fmt"
+
+	"github.com/lib/pq"
+)
+
+// Result is the user a profile signed in, and what the sign-in changed.
+type Result struct {
+	UserID string
+	Email  string
+	// Created is set when the user was provisioned just in time, Linked
+	// when the identity was linked to the user at this sign-in, Updated
+	// when the profile changed fields of the user
+	Created bool
+	Linked  bool
+	Updated bool
+	// IDs of the groups the user was added to and removed from
+	GroupsAdded   []string
+	GroupsRemoved []string
+}
+
+// Resolve finds the user profile signs in at p, for a login started by
+// linkUserID or, when empty, without a session.
+//
+// An identity linked before signs in its user. Otherwise the identity is
+// linked to linkUserID; to the user of the tenant with the claimed email
+// address, when p vouches for it; or, when p provisions users just in
+// time, to a new user. Fields mapped from the profile are saved on every
+// sign-in, and so is the membership of the groups in the group mapping.
+func (s *Store) Resolve(p *Provider, profile *Profile, linkUserID string) (*Result, error) {
+	if profile.Subject == "" {
+		return nil, fmt.Errorf("%w: the subject is missing", ErrInvalidProfile)
+	}
+	fields := p.Fields(profile)
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := s.findUser(tx, p, profile, fields, linkUserID)
+	if err != nil {
+		return nil, err
+	}
+
+	updated, err := tx.Exec(`
+		UPDATE users
+		SET display_name = COALESCE($1, display_name), given_name = COALESCE($2, given_name),
+			family_name = COALESCE($3, family_name)
+		WHERE id = $4 AND (display_name, given_name, family_name)
+			IS DISTINCT FROM (COALESCE($1, display_name), COALESCE($2, given_name), COALESCE($3, family_name))
+	`, nullString(fields["display_name"]), nullString(fields["given_name"]), nullString(fields["family_name"]), result.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update user: %w", err)
+	}
+	if rows, _ := updated.RowsAffected(); rows > 0 && !result.Created {
+		result.Updated = true
+	}
+
+	if err := syncGroups(tx, p, profile, result); err != nil {
+		return nil, err
+	}
+
+	if _, err := tx.Exec(`
+		UPDATE federated_identities SET email = $1, last_login_at = NOW()
+		WHERE provider_id = $2 AND subject = $3
+	`, fields["email"], p.ID, profile.Subject); err != nil {
+		return nil, fmt.Errorf("failed to update identity: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to commit: %w", err)
+	}
+	return result, nil
+}
+
+// findUser returns the user of a linked identity, or links one.
+func (s *Store) findUser(tx *sql.Tx, p *Provider, profile *Profile, fields map[string]string, linkUserID string) (*Result, error) {
+	var (
+		result   Result
+		isActive bool
+	)
+	err := tx.QueryRow(`
+		SELECT u.id, u.email, u.is_active
+		FROM federated_identities fi
+		JOIN users u ON u.id = fi.user_id
+		WHERE fi.provider_id = $1 AND fi.subject = $2
+	`, p.ID, profile.Subject).Scan(&result.UserID, &result.Email, &isActive)
+	if err == nil {
+		switch {
+		case linkUserID != "" && linkUserID != result.UserID:
+			return nil, ErrIdentityConflict
+		case !isActive:
+			return nil, ErrAccountDisabled
+		}
+		return &result, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to load identity: %w", err)
+	}
+
+	var tenantID, principalType string
+	email := fields["email"]
+	if linkUserID != "" {
+		// The signed in user links the identity, whatever address it claims
+		err = tx.QueryRow(`
+			SELECT id, email, tenant_id, principal_type, is_active FROM users WHERE id = $1
+		`, linkUserID).Scan(&result.UserID, &result.Email, &tenantID, &principalType, &isActive)
+		switch {
+		case err == sql.ErrNoRows || err == nil && (tenantID != p.TenantID || principalType != "user"):
+			return nil, ErrAccountNotFound
+		case err != nil:
+			return nil, fmt.Errorf("failed to load user: %w", err)
+		case !isActive:
+			return nil, ErrAccountDisabled
+		}
+		return linkIdentity(tx, p, profile, email, &result)
+	}
+
+	// Otherwise a new identity is linked by its email address, which the
+	// provider must not have marked unverified
+	if email == "" {
+		return nil, fmt.Errorf("%w: no email address claimed", ErrInvalidProfile)
+	}
+	if emailUnverified(profile) {
+		return nil, ErrEmailNotVerified
+	}
+
+	err = tx.QueryRow(`
+		SELECT id, email, tenant_id, principal_type, is_active FROM users WHERE email = $1
+	`, email).Scan(&result.UserID, &result.Email, &tenantID, &principalType, &isActive)
+	switch {
+	case err == sql.ErrNoRows:
+		if !p.JITProvisioning {
+			return nil, ErrAccountNotFound
+		}
+		err = tx.QueryRow(`
+			INSERT INTO users (tenant_id, email, display_name, given_name, family_name)
+			VALUES ($1, $2, $3, $4, $5)
+			RETURNING id, email
+		`, p.TenantID, email, fields["display_name"], fields["given_name"], fields["family_name"]).Scan(&result.UserID, &result.Email)
+		if err != nil {
+			return nil, fmt.Errorf("failed to provision user: %w", err)
+		}
+		result.Created = true
+	case err != nil:
+		return nil, fmt.Errorf("failed to load user: %w", err)
+	case tenantID != p.TenantID || principalType != "user":
+		return nil, ErrEmailConflict
+	case !p.linksByEmail(profile):
+		// Whoever controls an unverified address at the provider must
+		// prove they are the user by linking from a session
+		return nil, ErrLinkRequired
+	case !isActive:
+		return nil, ErrAccountDisabled
+	}
+	return linkIdentity(tx, p, profile, email, &result)
+}
+
+// linkIdentity links the identity of profile to the user of result.
+func linkIdentity(tx *sql.Tx, p *Provider, profile *Profile, email string, result *Result) (*Result, error) {
+	_, err := tx.Exec(`
+		INSERT INTO federated_identities (tenant_id, provider_id, user_id, subject, email)
+		VALUES ($1, $2, $3, $4, $5)
+	`, p.TenantID, p.ID, result.UserID, profile.Subject, email)
+	if err != nil {
+		return nil, fmt.Errorf("failed to link identity: %w", err)
+	}
+	result.Linked = true
+	return result, nil
+}
+
+// syncGroups makes the user a member of exactly those groups in the group
+// mapping of p that the profile claims. Other groups are left alone, and
+// so are groups made dynamic since, whose members follow their rule.
+func syncGroups(tx *sql.Tx, p *Provider, profile *Profile, result *Result) error {
+	if len(p.GroupMapping) == 0 {
+		return nil
+	}
+	claimed := p.Groups(profile)
+	var add, remove []string
+	for _, groupID := range p.GroupMapping {
+		if claimed[groupID] {
+			add = append(add, groupID)
+		} else if !contains(remove, groupID) {
+			remove = append(remove, groupID)
+		}
+	}
+
+	rows, err := tx.Query(`
+		INSERT INTO user_groups (user_id, group_id)
+		SELECT $1, id FROM groups WHERE tenant_id = $2 AND id = ANY($3) AND rule IS NULL
+		ON CONFLICT DO NOTHING
+		RETURNING group_id
+	`, result.UserID, p.TenantID, pq.Array(add))
+	if err != nil {
+		return fmt.Errorf("failed to add groups: %w", err)
+	}
+	if result.GroupsAdded, err = scanIDs(rows); err != nil {
+		return fmt.Errorf("failed to add groups: %w", err)
+	}
+
+	rows, err = tx.Query(`
+		DELETE FROM user_groups ug USING groups g
+		WHERE ug.user_id = $1 AND ug.group_id = ANY($2) AND g.id = ug.group_id AND g.rule IS NULL
+		RETURNING ug.group_id
+	`, result.UserID, pq.Array(remove))
+	if err != nil {
+		return fmt.Errorf("failed to remove groups: %w", err)
+	}
+	if result.GroupsRemoved, err = scanIDs(rows); err != nil {
+		return fmt.Errorf("failed to remove groups: %w", err)
+	}
+	return nil
+}
+
+func scanIDs(rows *sql.Rows) ([]string, error) {
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func nullString(s string) interface{} {
+	if s == "" {
+		return nil
+	}
+	return s
+}
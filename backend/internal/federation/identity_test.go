@@ -0,0 +1,142 @@
+package federation
+
+import (
+	"database/sql/driver"
+	"errors"
+	"reflect"
+	"testing"
+
+	"github.com/ForIAM/ForIAM/backend/internal/dbtest"
+)
+
+const (
+	staffGroup  = "8a4e0c2d-6b1f-4e93-a5d7-2c9f1e3b7a50"
+	adminsGroup = "8a4e0c2d-6b1f-4e93-a5d7-2c9f1e3b7a51"
+)
+
+// account is a row of users as findUser selects it.
+func account(id, tenantID string, active bool) []driver.Value {
+	return []driver.Value{id, "alice@corp.example", tenantID, "user", active}
+}
+
+func TestResolveLinking(t *testing.T) {
+	verified := map[string][]string{"email": {"alice@corp.example"}, "email_verified": {"true"}}
+	unverified := map[string][]string{"email": {"alice@corp.example"}, "email_verified": {"false"}}
+	unclaimed := map[string][]string{"email": {"alice@corp.example"}}
+
+	tests := []struct {
+		name     string
+		identity []driver.Value // linked user, if any
+		byID     []driver.Value // user linking from a session
+		byEmail  []driver.Value // user with the claimed address
+		link     string
+		claims   map[string][]string
+		provider func(p *Provider)
+		err      error
+		user     string
+		linked   bool
+		created  bool
+	}{
+		{name: "linked identity", identity: []driver.Value{"user-1", "alice@corp.example", true}, claims: verified, user: "user-1"},
+		{name: "linked identity of a disabled user", identity: []driver.Value{"user-1", "alice@corp.example", false}, claims: verified, err: ErrAccountDisabled},
+		{name: "linked identity claimed by another session", identity: []driver.Value{"user-1", "alice@corp.example", true}, link: "user-2", claims: verified, err: ErrIdentityConflict},
+		{name: "verified address", byEmail: account("user-1", "tenant-1", true), claims: verified, user: "user-1", linked: true},
+		{name: "address the provider did not verify", byEmail: account("user-1", "tenant-1", true), claims: unverified, err: ErrEmailNotVerified},
+		{name: "address not claimed verified", byEmail: account("user-1", "tenant-1", true), claims: unclaimed, err: ErrLinkRequired},
+		{name: "address of a trusted provider", byEmail: account("user-1", "tenant-1", true), claims: unclaimed,
+			provider: func(p *Provider) { p.TrustEmail = true }, user: "user-1", linked: true},
+		{name: "address of a disabled user", byEmail: account("user-1", "tenant-1", false), claims: verified, err: ErrAccountDisabled},
+		{name: "address in another tenant", byEmail: account("user-1", "tenant-2", true), claims: verified, err: ErrEmailConflict},
+		{name: "no email address", claims: map[string][]string{}, err: ErrInvalidProfile},
+		{name: "unknown address", claims: verified, err: ErrAccountNotFound},
+		{name: "unknown address with JIT provisioning", claims: verified,
+			provider: func(p *Provider) { p.JITProvisioning = true }, user: "user-9", linked: true, created: true},
+		{name: "linked from a session", byID: account("user-2", "tenant-1", true), link: "user-2", claims: unverified, user: "user-2", linked: true},
+		{name: "linked from a session of another tenant", byID: account("user-2", "tenant-2", true), link: "user-2", claims: verified, err: ErrAccountNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, script := dbtest.Open(t)
+			script.On("FROM federated_identities fi", nil, rows(tt.identity)...)
+			script.On("FROM users WHERE id = $1", nil, rows(tt.byID)...)
+			script.On("FROM users WHERE email = $1", nil, rows(tt.byEmail)...)
+			script.On("INSERT INTO users", nil, []driver.Value{"user-9", "alice@corp.example"})
+			script.On("INSERT INTO federated_identities", nil, []driver.Value{})
+			script.On("UPDATE users", nil)
+			script.On("UPDATE federated_identities", nil)
+
+			p := &Provider{ID: "provider-1", TenantID: "tenant-1", ClaimMapping: map[string]string{"email": "email"}}
+			if tt.provider != nil {
+				tt.provider(p)
+			}
+			result, err := NewStore(db, "key").Resolve(p, &Profile{Subject: "alice", Claims: tt.claims}, tt.link)
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Fatalf("Expected %v, got %v", tt.err, err)
+				}
+				if script.Ran("INSERT INTO federated_identities") {
+					t.Error("Expected no identity to be linked")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("Resolve returned error: %v", err)
+			}
+			if result.UserID != tt.user || result.Linked != tt.linked || result.Created != tt.created {
+				t.Errorf("Expected user %s, linked %v, created %v, got %+v", tt.user, tt.linked, tt.created, result)
+			}
+			if script.Ran("INSERT INTO federated_identities") != tt.linked {
+				t.Errorf("Expected linked=%v", tt.linked)
+			}
+		})
+	}
+}
+
+func TestResolveSyncsGroups(t *testing.T) {
+	db, script := dbtest.Open(t)
+	script.On("FROM federated_identities fi", nil, []driver.Value{"user-1", "alice@corp.example", true})
+	script.On("UPDATE users", nil)
+	script.On("UPDATE federated_identities", nil)
+	var toAdd, toRemove []string
+	script.OnArgs("INSERT INTO user_groups", nil, func(args []driver.Value) [][]driver.Value {
+		toAdd = dbtest.Array(args[2])
+		return [][]driver.Value{{staffGroup}}
+	})
+	script.OnArgs("DELETE FROM user_groups", nil, func(args []driver.Value) [][]driver.Value {
+		toRemove = dbtest.Array(args[1])
+		return nil
+	})
+
+	p := &Provider{ID: "provider-1", TenantID: "tenant-1", GroupsClaim: "groups", GroupMapping: map[string]string{
+		"staff":  staffGroup,
+		"admins": adminsGroup,
+	}}
+	profile := &Profile{Subject: "alice", Claims: map[string][]string{"groups": {"staff", "printers"}}}
+	result, err := NewStore(db, "key").Resolve(p, profile, "")
+	if err != nil {
+		t.Fatalf("Resolve returned error: %v", err)
+	}
+	if !reflect.DeepEqual(toAdd, []string{staffGroup}) || !reflect.DeepEqual(toRemove, []string{adminsGroup}) {
+		t.Errorf("Expected to add the claimed group and remove the other mapped one, got %v and %v", toAdd, toRemove)
+	}
+	if !reflect.DeepEqual(result.GroupsAdded, []string{staffGroup}) || result.GroupsRemoved != nil {
+		t.Errorf("Expected only the changed memberships, got %v and %v", result.GroupsAdded, result.GroupsRemoved)
+	}
+}
+
+func TestResolveWithoutSubject(t *testing.T) {
+	db, _ := dbtest.Open(t)
+	_, err := NewStore(db, "key").Resolve(&Provider{ID: "provider-1"}, &Profile{}, "")
+	if !errors.Is(err, ErrInvalidProfile) {
+		t.Errorf("Expected ErrInvalidProfile, got %v", err)
+	}
+}
+
+// rows answers with row, or with no rows when it is nil.
+func rows(row []driver.Value) [][]driver.Value {
+	if row == nil {
+		return nil
+	}
+	return [][]driver.Value{row}
+}
@@ -0,0 +1,214 @@
+package federation
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ForIAM/ForIAM/backend/internal/signing"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// maxResponseSize bounds the documents read from an OpenID provider.
+const maxResponseSize = 1 << 20
+
+// idTokenLeeway is the clock skew allowed when checking ID tokens.
+const idTokenLeeway = time.Minute
+
+// discovery is the part of the provider metadata ForIAM uses.
+type discovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JWKSURI               string `json:"jwks_uri"`
+}
+
+// OIDCClient signs users in at an OpenID provider with the authorization
+// code flow and PKCE.
+type OIDCClient struct {
+	provider    *Provider
+	redirectURI string
+	http        *http.Client
+}
+
+// NewOIDCClient returns a client of provider whose authorization responses
+// go to redirectURI. httpClient may be nil.
+func NewOIDCClient(provider *Provider, redirectURI string, httpClient *http.Client) *OIDCClient {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 10 * time.Second}
+	}
+	return &OIDCClient{provider: provider, redirectURI: redirectURI, http: httpClient}
+}
+
+// getJSON fetches a JSON document into out.
+func (c *OIDCClient) getJSON(ctx context.Context, location string, out interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, location, nil)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUpstream, err)
+	}
+	req.Header.Set("Accept", "application/json")
+	return c.do(req, out)
+}
+
+func (c *OIDCClient) do(req *http.Request, out interface{}) error {
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUpstream, err)
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxResponseSize))
+	if err != nil {
+		return fmt.Errorf("%w: %v", ErrUpstream, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		var oauthErr struct {
+			Error string `json:"error"`
+		}
+		_ = json.Unmarshal(body, &oauthErr)
+		return fmt.Errorf("%w: %s %s: %d %s", ErrUpstream, req.Method, req.URL.Path, resp.StatusCode, oauthErr.Error)
+	}
+	if err := json.Unmarshal(body, out); err != nil {
+		return fmt.Errorf("%w: %s %s: %v", ErrUpstream, req.Method, req.URL.Path, err)
+	}
+	return nil
+}
+
+// discover fetches the provider metadata, which must be for the configured
+// issuer.
+func (c *OIDCClient) discover(ctx context.Context) (*discovery, error) {
+	var doc discovery
+	if err := c.getJSON(ctx, strings.TrimRight(c.provider.Issuer, "/")+"/.well-known/openid-configuration", &doc); err != nil {
+		return nil, err
+	}
+	if doc.Issuer != c.provider.Issuer {
+		return nil, fmt.Errorf("%w: the metadata is for issuer %s", ErrUpstream, doc.Issuer)
+	}
+	if doc.AuthorizationEndpoint == "" || doc.TokenEndpoint == "" || doc.JWKSURI == "" {
+		return nil, fmt.Errorf("%w: the metadata lacks endpoints", ErrUpstream)
+	}
+	return &doc, nil
+}
+
+// AuthCodeURL returns the authorization request of login to send the
+// browser to.
+func (c *OIDCClient) AuthCodeURL(ctx context.Context, login *Login) (string, error) {
+	doc, err := c.discover(ctx)
+	if err != nil {
+		return "", err
+	}
+	challenge := sha256.Sum256([]byte(login.CodeVerifier))
+	query := url.Values{
+		"response_type":         {"code"},
+		"client_id":             {c.provider.ClientID},
+		"redirect_uri":          {c.redirectURI},
+		"scope":                 {strings.Join(c.provider.Scopes, " ")},
+		"state":                 {login.State},
+		"nonce":                 {login.Nonce},
+		"code_challenge":        {base64.RawURLEncoding.EncodeToString(challenge[:])},
+		"code_challenge_method": {"S256"},
+	}
+
+	separator := "?"
+	if strings.Contains(doc.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return doc.AuthorizationEndpoint + separator + query.Encode(), nil
+}
+
+// Exchange redeems the authorization code of login and returns the profile
+// from the verified ID token.
+func (c *OIDCClient) Exchange(ctx context.Context, login *Login, code string) (*Profile, error) {
+	doc, err := c.discover(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	form := url.Values{
+		"grant_type":    {"authorization_code"},
+		"code":          {code},
+		"redirect_uri":  {c.redirectURI},
+		"code_verifier": {login.CodeVerifier},
+	}
+	if c.provider.ClientSecret == "" {
+		form.Set("client_id", c.provider.ClientID)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, doc.TokenEndpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrUpstream, err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if c.provider.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(c.provider.ClientID), url.QueryEscape(c.provider.ClientSecret))
+	}
+
+	var tokens struct {
+		IDToken string `json:"id_token"`
+	}
+	if err := c.do(req, &tokens); err != nil {
+		return nil, err
+	}
+	if tokens.IDToken == "" {
+		return nil, fmt.Errorf("%w: the token response has no ID token", ErrUpstream)
+	}
+
+	var jwks signing.JWKS
+	if err := c.getJSON(ctx, doc.JWKSURI, &jwks); err != nil {
+		return nil, err
+	}
+	return c.verifyIDToken(tokens.IDToken, &jwks, login.Nonce)
+}
+
+// verifyIDToken checks the signature, issuer, audience, lifetime and nonce
+// of an ID token and returns its claims as a profile.
+func (c *OIDCClient) verifyIDToken(raw string, jwks *signing.JWKS, nonce string) (*Profile, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(raw, claims, func(t *jwt.Token) (interface{}, error) {
+		kid, _ := t.Header["kid"].(string)
+		for _, key := range jwks.Keys {
+			if (key.KeyID == kid || (kid == "" && len(jwks.Keys) == 1)) && (key.Algorithm == "" || key.Algorithm == t.Method.Alg()) {
+				return key.PublicKey()
+			}
+		}
+		return nil, signing.ErrUnknownKey
+	},
+		jwt.WithValidMethods([]string{signing.RS256, signing.ES256, signing.EdDSA}),
+		jwt.WithIssuer(c.provider.Issuer),
+		jwt.WithAudience(c.provider.ClientID),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+		jwt.WithLeeway(idTokenLeeway),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidProfile, err)
+	}
+
+	if audiences, _ := claims.GetAudience(); len(audiences) > 1 {
+		if azp, _ := claims["azp"].(string); azp != c.provider.ClientID {
+			return nil, fmt.Errorf("%w: the ID token was issued to another client", ErrInvalidProfile)
+		}
+	}
+	if claimed, _ := claims["nonce"].(string); claimed != nonce {
+		return nil, fmt.Errorf("%w: the nonce does not match", ErrInvalidProfile)
+	}
+	subject, _ := claims.GetSubject()
+	if subject == "" {
+		return nil, fmt.Errorf("%w: the ID token has no subject", ErrInvalidProfile)
+	}
+
+	profile := &Profile{Subject: subject, Claims: map[string][]string{}}
+	for name, value := range claims {
+		if values := claimValues(value); len(values) > 0 {
+			profile.Claims[name] = values
+		}
+	}
+	return profile, nil
+}
@@ -0,0 +1,210 @@
+package federation
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ForIAM/ForIAM/backend/internal/signing"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// mockOP is an OpenID provider for tests. It issues codes for whatever is
+// authorized and signs ID tokens with claims, adjusted by change. Tokens
+// are signed with the published keys unless forge is set.
+type mockOP struct {
+	server *httptest.Server
+	keys   *signing.KeySet
+	forge  *signing.KeySet
+	claims jwt.MapClaims
+	change func(claims jwt.MapClaims)
+
+	mu    sync.Mutex
+	codes map[string]url.Values
+}
+
+func newMockOP(t *testing.T) *mockOP {
+	t.Helper()
+	key, err := signing.GenerateKey(signing.ES256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	op := &mockOP{keys: signing.NewKeySet(key), codes: map[string]url.Values{}}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{
+			"issuer":                 op.server.URL,
+			"authorization_endpoint": op.server.URL + "/authorize",
+			"token_endpoint":         op.server.URL + "/token",
+			"jwks_uri":               op.server.URL + "/jwks",
+		})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(op.keys.JWKS())
+	})
+	mux.HandleFunc("/token", op.token)
+	op.server = httptest.NewServer(mux)
+	t.Cleanup(op.server.Close)
+
+	op.claims = jwt.MapClaims{
+		"sub":            "corp-4711",
+		"email":          "alice@corp.example",
+		"email_verified": true,
+		"name":           "Alice Example",
+		"groups":         []string{"staff", "admins"},
+	}
+	return op
+}
+
+// authorize signs the user in for an authorization request and returns
+// the code.
+func (op *mockOP) authorize(t *testing.T, location string) string {
+	t.Helper()
+	u, err := url.Parse(location)
+	if err != nil || !strings.HasPrefix(location, op.server.URL+"/authorize?") {
+		t.Fatalf("Unexpected authorization request %s", location)
+	}
+	op.mu.Lock()
+	defer op.mu.Unlock()
+	code := "code-" + u.Query().Get("state")
+	op.codes[code] = u.Query()
+	return code
+}
+
+func (op *mockOP) token(w http.ResponseWriter, r *http.Request) {
+	op.mu.Lock()
+	request, ok := op.codes[r.FormValue("code")]
+	delete(op.codes, r.FormValue("code"))
+	op.mu.Unlock()
+
+	clientID, secret, _ := r.BasicAuth()
+	challenge := sha256.Sum256([]byte(r.FormValue("code_verifier")))
+	switch {
+	case !ok, r.FormValue("grant_type") != "authorization_code",
+		r.FormValue("redirect_uri") != request.Get("redirect_uri"),
+		base64.RawURLEncoding.EncodeToString(challenge[:]) != request.Get("code_challenge"):
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	case clientID != request.Get("client_id") || secret != "s3cret":
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"error": "invalid_client"})
+		return
+	}
+
+	now := time.Now()
+	claims := jwt.MapClaims{
+		"iss":   op.server.URL,
+		"aud":   clientID,
+		"iat":   now.Unix(),
+		"exp":   now.Add(5 * time.Minute).Unix(),
+		"nonce": request.Get("nonce"),
+	}
+	for name, value := range op.claims {
+		claims[name] = value
+	}
+	if op.change != nil {
+		op.change(claims)
+	}
+	keys := op.keys
+	if op.forge != nil {
+		keys = op.forge
+	}
+	idToken, _ := keys.Sign(claims)
+	json.NewEncoder(w).Encode(map[string]string{"access_token": "at", "token_type": "Bearer", "id_token": idToken})
+}
+
+func TestOIDCLogin(t *testing.T) {
+	op := newMockOP(t)
+	provider := &Provider{ID: "p1", Name: "Corp", Type: TypeOIDC, Issuer: op.server.URL, ClientID: "forIAM", ClientSecret: "s3cret"}
+	if err := provider.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	client := NewOIDCClient(provider, RedirectURI("https://iam.example", "p1"), nil)
+	ctx := context.Background()
+
+	signIn := func(state string) (*Profile, error) {
+		login := &Login{State: state, Nonce: "n-" + state, CodeVerifier: strings.Repeat("v", 43)}
+		location, err := client.AuthCodeURL(ctx, login)
+		if err != nil {
+			t.Fatalf("AuthCodeURL returned error: %v", err)
+		}
+		return client.Exchange(ctx, login, op.authorize(t, location))
+	}
+
+	profile, err := signIn("s1")
+	if err != nil {
+		t.Fatalf("Exchange returned error: %v", err)
+	}
+	if profile.Subject != "corp-4711" || !reflect.DeepEqual(profile.Claims["groups"], []string{"staff", "admins"}) ||
+		!reflect.DeepEqual(profile.Claims["email_verified"], []string{"true"}) {
+		t.Errorf("Unexpected profile %+v", profile)
+	}
+	if fields := provider.Fields(profile); fields["email"] != "alice@corp.example" || fields["display_name"] != "Alice Example" {
+		t.Errorf("Unexpected fields %v", fields)
+	}
+
+	tests := []struct {
+		name   string
+		change func(claims jwt.MapClaims)
+	}{
+		{"other nonce", func(claims jwt.MapClaims) { claims["nonce"] = "other" }},
+		{"other audience", func(claims jwt.MapClaims) { claims["aud"] = "other-client" }},
+		{"other issuer", func(claims jwt.MapClaims) { claims["iss"] = "https://evil.example" }},
+		{"expired", func(claims jwt.MapClaims) { claims["exp"] = time.Now().Add(-time.Hour).Unix() }},
+		{"no subject", func(claims jwt.MapClaims) { delete(claims, "sub") }},
+		{"issued to another party", func(claims jwt.MapClaims) { claims["aud"] = []string{"forIAM", "other"}; claims["azp"] = "other" }},
+	}
+	for _, tt := range tests {
+		op.change = tt.change
+		if _, err := signIn(tt.name); !errors.Is(err, ErrInvalidProfile) {
+			t.Errorf("%s: expected ErrInvalidProfile, got %v", tt.name, err)
+		}
+	}
+	op.change = nil
+
+	// A token signed by another key
+	other, _ := signing.GenerateKey(signing.ES256)
+	op.forge = signing.NewKeySet(other)
+	if _, err := signIn("forged"); !errors.Is(err, ErrInvalidProfile) {
+		t.Errorf("Expected a token of an unknown key to be rejected, got %v", err)
+	}
+	op.forge = nil
+
+	// The code is bound to the verifier of the login
+	login := &Login{State: "s2", Nonce: "n", CodeVerifier: strings.Repeat("v", 43)}
+	location, _ := client.AuthCodeURL(ctx, login)
+	code := op.authorize(t, location)
+	login.CodeVerifier = strings.Repeat("w", 43)
+	if _, err := client.Exchange(ctx, login, code); !errors.Is(err, ErrUpstream) {
+		t.Errorf("Expected a code with another verifier to be rejected, got %v", err)
+	}
+
+	wrongSecret := *provider
+	wrongSecret.ClientSecret = "wrong"
+	login = &Login{State: "s3", Nonce: "n", CodeVerifier: strings.Repeat("v", 43)}
+	location, _ = client.AuthCodeURL(ctx, login)
+	if _, err := NewOIDCClient(&wrongSecret, client.redirectURI, nil).Exchange(ctx, login, op.authorize(t, location)); !errors.Is(err, ErrUpstream) {
+		t.Errorf("Expected a wrong client secret to be rejected, got %v", err)
+	}
+}
+
+func TestOIDCDiscoveryIssuer(t *testing.T) {
+	op := newMockOP(t)
+	provider := &Provider{Name: "Corp", Type: TypeOIDC, Issuer: op.server.URL + "/tenant", ClientID: "forIAM"}
+	client := NewOIDCClient(provider, "https://iam.example/callback", nil)
+	if _, err := client.AuthCodeURL(context.Background(), &Login{}); !errors.Is(err, ErrUpstream) {
+		t.Errorf("Expected metadata of another issuer to be rejected, got %v", err)
+	}
+}
@@ -0,0 +1,76 @@
+package federation
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ForIAM/ForIAM/backend/internal/saml"
+)
+
+// SAMLClient signs users in at a SAML IdP, with AuthnRequests sent over
+// HTTP-Redirect and responses posted back to the ACS URL.
+type SAMLClient struct {
+	provider *Provider
+	entityID string
+	acsURL   string
+}
+
+// NewSAMLClient returns a client of provider for the server at baseURL.
+func NewSAMLClient(provider *Provider, baseURL string) *SAMLClient {
+	return &SAMLClient{
+		provider: provider,
+		entityID: EntityID(baseURL, provider.ID),
+		acsURL:   ACSURL(baseURL, provider.ID),
+	}
+}
+
+// AuthnRequest returns a new AuthnRequest and its ID.
+func (c *SAMLClient) AuthnRequest(now time.Time) (string, []byte) {
+	return saml.NewAuthnRequest(c.entityID, c.acsURL, c.provider.SSOURL, now)
+}
+
+// RedirectURL returns the URL sending request to the IdP with relayState.
+func (c *SAMLClient) RedirectURL(request []byte, relayState string) (string, error) {
+	encoded, err := saml.EncodeRedirect(request)
+	if err != nil {
+		return "", err
+	}
+	query := url.Values{"SAMLRequest": {encoded}, "RelayState": {relayState}}
+
+	separator := "?"
+	if strings.Contains(c.provider.SSOURL, "?") {
+		separator = "&"
+	}
+	return c.provider.SSOURL + separator + query.Encode(), nil
+}
+
+// ParseResponse verifies the response to the AuthnRequest of login and
+// returns the profile it asserts. The NameID is the subject, and is also
+// available to the claim mapping as the attribute NameID. Transient name
+// IDs change with every sign-in and cannot be linked to a user.
+func (c *SAMLClient) ParseResponse(login *Login, data []byte, now time.Time) (*Profile, error) {
+	cert, err := saml.ParseCertificate(c.provider.Certificate)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidProvider, err)
+	}
+	check := &saml.ResponseCheck{
+		Issuer:       c.provider.EntityID,
+		Certificate:  cert,
+		Audience:     c.entityID,
+		Destination:  c.acsURL,
+		InResponseTo: login.RequestID,
+	}
+	assertion, err := check.Parse(data, now)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidProfile, err)
+	}
+	if assertion.NameIDFormat == saml.NameIDFormatTransient {
+		return nil, fmt.Errorf("%w: transient name IDs cannot be linked", ErrInvalidProfile)
+	}
+
+	profile := &Profile{Subject: assertion.NameID, Claims: assertion.Attributes}
+	profile.Claims[SubjectAttribute] = []string{assertion.NameID}
+	return profile, nil
+}
@@ -0,0 +1,432 @@
+package federation
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/ForIAM/ForIAM/backend/internal/sealing"
+	"github.com/lib/pq"
+)
+
+// loginTimeout is how long a user has to sign in at the provider; codeTTL
+// how long the frontend has to redeem the code of a completed login.
+const (
+	loginTimeout = 10 * time.Minute
+	codeTTL      = time.Minute
+)
+
+// Store keeps the providers of tenants, the identities linked to users and
+// logins in progress. Client secrets are encrypted with a key derived from
+// the server's encryption key.
+type Store struct {
+	db  *sql.DB
+	box *sealing.Box
+}
+
+func NewStore(db *sql.DB, encryptionKey string) *Store {
+	return &Store{db: db, box: sealing.New(encryptionKey, sealing.PurposeClientSecret)}
+}
+
+const providerColumns = `id, tenant_id, name, type, issuer, client_id, scopes, entity_id, sso_url, certificate,
+	claim_mapping, groups_claim, group_mapping, jit_provisioning, disable_password_login, trust_email, performs_mfa,
+	is_active, created_at`
+
+func scanProvider(row interface{ Scan(...interface{}) error }, extra ...interface{}) (*Provider, error) {
+	var (
+		p                     Provider
+		claimMapping, mapping []byte
+	)
+	dest := append([]interface{}{&p.ID, &p.TenantID, &p.Name, &p.Type, &p.Issuer, &p.ClientID, pq.Array(&p.Scopes),
+		&p.EntityID, &p.SSOURL, &p.Certificate, &claimMapping, &p.GroupsClaim, &mapping,
+		&p.JITProvisioning, &p.DisablePasswordLogin, &p.TrustEmail, &p.PerformsMFA, &p.IsActive, &p.CreatedAt}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(claimMapping, &p.ClaimMapping); err != nil {
+		return nil, fmt.Errorf("invalid claim mapping: %w", err)
+	}
+	if err := json.Unmarshal(mapping, &p.GroupMapping); err != nil {
+		return nil, fmt.Errorf("invalid group mapping: %w", err)
+	}
+	return &p, nil
+}
+
+// List returns the providers of tenantID.
+func (s *Store) List(tenantID string) ([]*Provider, error) {
+	return s.list(`WHERE tenant_id = $1`, tenantID)
+}
+
+// ListActive returns the active providers of the tenant named tenantName,
+// which users can sign in with.
+func (s *Store) ListActive(tenantName string) ([]*Provider, error) {
+	return s.list(`WHERE is_active AND tenant_id = (SELECT id FROM tenants WHERE name = $1)`, tenantName)
+}
+
+func (s *Store) list(where string, args ...interface{}) ([]*Provider, error) {
+	rows, err := s.db.Query(`
+		SELECT `+providerColumns+` FROM federation_providers
+		`+where+` ORDER BY created_at
+	`, args...)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list identity providers: %w", err)
+	}
+	defer rows.Close()
+
+	providers := []*Provider{}
+	for rows.Next() {
+		p, err := scanProvider(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan identity provider: %w", err)
+		}
+		providers = append(providers, p)
+	}
+	return providers, rows.Err()
+}
+
+// Get loads a provider of tenantID, without its client secret.
+func (s *Store) Get(tenantID, id string) (*Provider, error) {
+	p, err := scanProvider(s.db.QueryRow(`
+		SELECT `+providerColumns+` FROM federation_providers
+		WHERE id = $1 AND tenant_id = $2
+	`, id, tenantID))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load identity provider: %w", err)
+	}
+	return p, nil
+}
+
+// GetActive loads an active provider of any tenant with its decrypted
+// client secret, to sign a user in.
+func (s *Store) GetActive(id string) (*Provider, error) {
+	var sealed []byte
+	p, err := scanProvider(s.db.QueryRow(`
+		SELECT `+providerColumns+`, client_secret_encrypted FROM federation_providers
+		WHERE id = $1 AND is_active
+	`, id), &sealed)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load identity provider: %w", err)
+	}
+	if sealed != nil {
+		secret, err := s.box.Open(sealed)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt client secret: %w", err)
+		}
+		p.ClientSecret = string(secret)
+	}
+	return p, nil
+}
+
+// checkGroups makes sure the groups p maps to are static groups of its
+// tenant: the members of dynamic groups follow their rule.
+func (s *Store) checkGroups(p *Provider) error {
+	ids := map[string]bool{}
+	for _, groupID := range p.GroupMapping {
+		ids[groupID] = true
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	list := make([]string, 0, len(ids))
+	for id := range ids {
+		list = append(list, id)
+	}
+
+	var found int
+	err := s.db.QueryRow(`
+		SELECT COUNT(*) FROM groups WHERE tenant_id = $1 AND id = ANY($2) AND rule IS NULL
+	`, p.TenantID, pq.Array(list)).Scan(&found)
+	if err != nil {
+		return fmt.Errorf("failed to check groups: %w", err)
+	}
+	if found != len(list) {
+		return fmt.Errorf("%w: group_mapping must refer to static groups of the tenant", ErrInvalidProvider)
+	}
+	return nil
+}
+
+// sealSecret encrypts the client secret of p, or returns nil when it has
+// none.
+func (s *Store) sealSecret(p *Provider) (interface{}, error) {
+	if p.ClientSecret == "" {
+		return nil, nil
+	}
+	sealed, err := s.box.Seal([]byte(p.ClientSecret))
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt client secret: %w", err)
+	}
+	return sealed, nil
+}
+
+// Create validates and adds p.
+func (s *Store) Create(p *Provider) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	if err := s.checkGroups(p); err != nil {
+		return err
+	}
+	sealed, err := s.sealSecret(p)
+	if err != nil {
+		return err
+	}
+	claimMapping, _ := json.Marshal(p.ClaimMapping)
+	mapping, _ := json.Marshal(p.GroupMapping)
+
+	err = s.db.QueryRow(`
+		INSERT INTO federation_providers (tenant_id, name, type, issuer, client_id, client_secret_encrypted, scopes,
+			entity_id, sso_url, certificate, claim_mapping, groups_claim, group_mapping, jit_provisioning,
+			disable_password_login, trust_email, performs_mfa, is_active)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15, $16, $17, $18)
+		RETURNING id, created_at
+	`, p.TenantID, p.Name, p.Type, p.Issuer, p.ClientID, sealed, pq.Array(p.Scopes), p.EntityID, p.SSOURL,
+		p.Certificate, claimMapping, p.GroupsClaim, mapping, p.JITProvisioning, p.DisablePasswordLogin,
+		p.TrustEmail, p.PerformsMFA, p.IsActive).Scan(&p.ID, &p.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to create identity provider: %w", err)
+	}
+	return nil
+}
+
+// Update validates and saves p. The client secret only changes when set,
+// and is dropped for SAML IdPs.
+func (s *Store) Update(p *Provider) error {
+	if err := p.Validate(); err != nil {
+		return err
+	}
+	if err := s.checkGroups(p); err != nil {
+		return err
+	}
+	sealed, err := s.sealSecret(p)
+	if err != nil {
+		return err
+	}
+	claimMapping, _ := json.Marshal(p.ClaimMapping)
+	mapping, _ := json.Marshal(p.GroupMapping)
+
+	result, err := s.db.Exec(`
+		UPDATE federation_providers
+		SET name = $1, type = $2, issuer = $3, client_id = $4,
+			client_secret_encrypted = CASE WHEN $2 = 'oidc' THEN COALESCE($5, client_secret_encrypted) END,
+			scopes = $6, entity_id = $7, sso_url = $8, certificate = $9, claim_mapping = $10, groups_claim = $11,
+			group_mapping = $12, jit_provisioning = $13, disable_password_login = $14, trust_email = $15,
+			performs_mfa = $16, is_active = $17
+		WHERE id = $18 AND tenant_id = $19
+	`, p.Name, p.Type, p.Issuer, p.ClientID, sealed, pq.Array(p.Scopes), p.EntityID, p.SSOURL, p.Certificate,
+		claimMapping, p.GroupsClaim, mapping, p.JITProvisioning, p.DisablePasswordLogin, p.TrustEmail, p.PerformsMFA,
+		p.IsActive, p.ID, p.TenantID)
+	if err != nil {
+		return fmt.Errorf("failed to update identity provider: %w", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Delete removes a provider and the identities linked through it. Users it
+// provisioned stay.
+func (s *Store) Delete(tenantID, id string) error {
+	result, err := s.db.Exec(`DELETE FROM federation_providers WHERE id = $1 AND tenant_id = $2`, id, tenantID)
+	if err != nil {
+		return fmt.Errorf("failed to delete identity provider: %w", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Login is a sign-in at a provider in progress. State identifies it in the
+// authorization response or as RelayState; Nonce and CodeVerifier bind
+// OpenID Connect responses to it, RequestID SAML responses. A login
+// started from a session has LinkUserID, the user its identity is linked
+// to.
+type Login struct {
+	ID           string
+	TenantID     string
+	ProviderID   string
+	UserID       string
+	LinkUserID   string
+	State        string
+	Nonce        string
+	CodeVerifier string
+	RequestID    string
+}
+
+// randomString returns 32 random bytes in base64url, which is also a valid
+// PKCE code verifier.
+func randomString() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashCode(code string) string {
+	sum := sha256.Sum256([]byte(code))
+	return hex.EncodeToString(sum[:])
+}
+
+// StartLogin starts a sign-in at p. requestID is the ID of the SAML
+// AuthnRequest; it is empty for OpenID Connect. linkUserID is the user
+// signed in who links the identity, or empty.
+func (s *Store) StartLogin(p *Provider, requestID, linkUserID string) (*Login, error) {
+	if _, err := s.db.Exec(`DELETE FROM federation_logins WHERE expires_at < NOW()`); err != nil {
+		return nil, fmt.Errorf("failed to prune logins: %w", err)
+	}
+
+	login := &Login{TenantID: p.TenantID, ProviderID: p.ID, RequestID: requestID, LinkUserID: linkUserID}
+	var err error
+	for _, value := range []*string{&login.State, &login.Nonce, &login.CodeVerifier} {
+		if *value, err = randomString(); err != nil {
+			return nil, err
+		}
+	}
+
+	err = s.db.QueryRow(`
+		INSERT INTO federation_logins (tenant_id, provider_id, state, nonce, code_verifier, request_id, link_user_id,
+			expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, NOW() + make_interval(secs => $8))
+		RETURNING id
+	`, login.TenantID, login.ProviderID, login.State, login.Nonce, login.CodeVerifier, login.RequestID,
+		nullString(login.LinkUserID), loginTimeout.Seconds()).Scan(&login.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start login: %w", err)
+	}
+	return login, nil
+}
+
+// TakeLogin returns the login of providerID with state, which can only be
+// taken once.
+func (s *Store) TakeLogin(providerID, state string) (*Login, error) {
+	login := &Login{ProviderID: providerID, State: state}
+	err := s.db.QueryRow(`
+		UPDATE federation_logins SET state = NULL
+		WHERE provider_id = $1 AND state = $2 AND expires_at > NOW()
+		RETURNING id, tenant_id, COALESCE(link_user_id::text, ''), nonce, code_verifier, request_id
+	`, providerID, state).Scan(&login.ID, &login.TenantID, &login.LinkUserID, &login.Nonce, &login.CodeVerifier,
+		&login.RequestID)
+	if err == sql.ErrNoRows {
+		return nil, ErrLoginNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load login: %w", err)
+	}
+	return login, nil
+}
+
+// CompleteLogin records that login signed in userID and returns the code
+// the frontend redeems for tokens.
+func (s *Store) CompleteLogin(login *Login, userID string) (string, error) {
+	code, err := randomString()
+	if err != nil {
+		return "", err
+	}
+	_, err = s.db.Exec(`
+		UPDATE federation_logins SET user_id = $1, code_hash = $2, expires_at = NOW() + make_interval(secs => $3)
+		WHERE id = $4
+	`, userID, hashCode(code), codeTTL.Seconds(), login.ID)
+	if err != nil {
+		return "", fmt.Errorf("failed to complete login: %w", err)
+	}
+	return code, nil
+}
+
+// RedeemCode ends the completed login of code, which can only be redeemed
+// once.
+func (s *Store) RedeemCode(code string) (*Login, error) {
+	var login Login
+	err := s.db.QueryRow(`
+		DELETE FROM federation_logins
+		WHERE code_hash = $1 AND user_id IS NOT NULL AND expires_at > NOW()
+		RETURNING id, tenant_id, provider_id, user_id
+	`, hashCode(code)).Scan(&login.ID, &login.TenantID, &login.ProviderID, &login.UserID)
+	if err == sql.ErrNoRows {
+		return nil, ErrLoginNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to redeem login: %w", err)
+	}
+	return &login, nil
+}
+
+// Identity is an account at a provider linked to a user.
+type Identity struct {
+	ID          string     `json:"id"`
+	ProviderID  string     `json:"provider_id"`
+	Provider    string     `json:"provider"`
+	Subject     string     `json:"subject"`
+	Email       string     `json:"email"`
+	CreatedAt   time.Time  `json:"created_at"`
+	LastLoginAt *time.Time `json:"last_login_at"`
+}
+
+// Identities returns the identities linked to a user of tenantID.
+func (s *Store) Identities(tenantID, userID string) ([]*Identity, error) {
+	rows, err := s.db.Query(`
+		SELECT fi.id, fi.provider_id, p.name, fi.subject, fi.email, fi.created_at, fi.last_login_at
+		FROM federated_identities fi
+		JOIN federation_providers p ON p.id = fi.provider_id
+		WHERE fi.tenant_id = $1 AND fi.user_id = $2
+		ORDER BY fi.created_at
+	`, tenantID, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list identities: %w", err)
+	}
+	defer rows.Close()
+
+	identities := []*Identity{}
+	for rows.Next() {
+		var identity Identity
+		if err := rows.Scan(&identity.ID, &identity.ProviderID, &identity.Provider, &identity.Subject, &identity.Email,
+			&identity.CreatedAt, &identity.LastLoginAt); err != nil {
+			return nil, fmt.Errorf("failed to scan identity: %w", err)
+		}
+		identities = append(identities, &identity)
+	}
+	return identities, rows.Err()
+}
+
+// DeleteIdentity unlinks an identity from a user of tenantID.
+func (s *Store) DeleteIdentity(tenantID, userID, id string) error {
+	result, err := s.db.Exec(`
+		DELETE FROM federated_identities WHERE id = $1 AND user_id = $2 AND tenant_id = $3
+	`, id, userID, tenantID)
+	if err != nil {
+		return fmt.Errorf("failed to delete identity: %w", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return ErrIdentityNotFound
+	}
+	return nil
+}
+
+// PasswordLoginDisabled reports whether userID is linked through an active
+// provider that disables password login.
+func (s *Store) PasswordLoginDisabled(userID string) (bool, error) {
+	var disabled bool
+	err := s.db.QueryRow(`
+		SELECT EXISTS(
+			SELECT 1 FROM federated_identities fi
+			JOIN federation_providers p ON p.id = fi.provider_id
+			WHERE fi.user_id = $1 AND p.disable_password_login AND p.is_active
+		)
+	`, userID).Scan(&disabled)
+	if err != nil {
+		return false, fmt.Errorf("failed to check password login: %w", err)
+	}
+	return disabled, nil
+}
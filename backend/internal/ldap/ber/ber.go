@@ -0,0 +1,270 @@
+// Package ber encodes and decodes the subset of the ASN.1 Basic Encoding
+// Rules LDAP messages use: definite lengths and tags below 31.
+package ber
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Classes of a tag.
+const (
+	ClassUniversal   = 0x00
+	ClassApplication = 0x40
+	ClassContext     = 0x80
+)
+
+// Universal tags.
+const (
+	TagBoolean     = 0x01
+	TagInteger     = 0x02
+	TagOctetString = 0x04
+	TagNull        = 0x05
+	TagEnumerated  = 0x0a
+	TagSequence    = 0x10
+	TagSet         = 0x11
+)
+
+const constructed = 0x20
+
+// MaxPacketSize bounds packets read from the network.
+const MaxPacketSize = 1 << 20
+
+var ErrMalformed = errors.New("malformed BER packet")
+
+// Packet is an element: a primitive one with Value, or a constructed one
+// with Children.
+type Packet struct {
+	Class       int
+	Constructed bool
+	Tag         int
+	Value       []byte
+	Children    []*Packet
+}
+
+// Sequence returns a constructed universal SEQUENCE of children.
+func Sequence(children ...*Packet) *Packet {
+	return &Packet{Class: ClassUniversal, Constructed: true, Tag: TagSequence, Children: children}
+}
+
+// Set returns a constructed universal SET of children.
+func Set(children ...*Packet) *Packet {
+	return &Packet{Class: ClassUniversal, Constructed: true, Tag: TagSet, Children: children}
+}
+
+// Constructed returns a constructed element of class and tag.
+func Constructed(class, tag int, children ...*Packet) *Packet {
+	return &Packet{Class: class, Constructed: true, Tag: tag, Children: children}
+}
+
+// Primitive returns a primitive element of class and tag.
+func Primitive(class, tag int, value []byte) *Packet {
+	return &Packet{Class: class, Tag: tag, Value: value}
+}
+
+// String returns an OCTET STRING.
+func String(s string) *Packet {
+	return Primitive(ClassUniversal, TagOctetString, []byte(s))
+}
+
+// Integer returns an INTEGER.
+func Integer(n int64) *Packet {
+	return Primitive(ClassUniversal, TagInteger, encodeInt(n))
+}
+
+// Enumerated returns an ENUMERATED value.
+func Enumerated(n int64) *Packet {
+	return Primitive(ClassUniversal, TagEnumerated, encodeInt(n))
+}
+
+// Boolean returns a BOOLEAN.
+func Boolean(b bool) *Packet {
+	if b {
+		return Primitive(ClassUniversal, TagBoolean, []byte{0xff})
+	}
+	return Primitive(ClassUniversal, TagBoolean, []byte{0x00})
+}
+
+// encodeInt encodes n in the fewest two's complement bytes.
+func encodeInt(n int64) []byte {
+	b := []byte{byte(n)}
+	for (n > 0x7f || n < -0x80) && len(b) < 8 {
+		n >>= 8
+		b = append([]byte{byte(n)}, b...)
+	}
+	return b
+}
+
+// Is reports whether p has class and tag.
+func (p *Packet) Is(class, tag int) bool {
+	return p != nil && p.Class == class && p.Tag == tag
+}
+
+// Int decodes the value of an INTEGER or ENUMERATED element.
+func (p *Packet) Int() (int64, error) {
+	if p == nil || p.Constructed || len(p.Value) == 0 || len(p.Value) > 8 {
+		return 0, fmt.Errorf("%w: not an integer", ErrMalformed)
+	}
+	n := int64(int8(p.Value[0]))
+	for _, b := range p.Value[1:] {
+		n = n<<8 | int64(b)
+	}
+	return n, nil
+}
+
+// Bool decodes the value of a BOOLEAN element.
+func (p *Packet) Bool() (bool, error) {
+	if p == nil || p.Constructed || len(p.Value) != 1 {
+		return false, fmt.Errorf("%w: not a boolean", ErrMalformed)
+	}
+	return p.Value[0] != 0, nil
+}
+
+// Str returns the value of a primitive element as a string.
+func (p *Packet) Str() (string, error) {
+	if p == nil || p.Constructed {
+		return "", fmt.Errorf("%w: not a string", ErrMalformed)
+	}
+	return string(p.Value), nil
+}
+
+// Child returns the i-th child, or nil.
+func (p *Packet) Child(i int) *Packet {
+	if p == nil || i >= len(p.Children) {
+		return nil
+	}
+	return p.Children[i]
+}
+
+// Bytes encodes p.
+func (p *Packet) Bytes() []byte {
+	value := p.Value
+	if p.Constructed {
+		value = nil
+		for _, child := range p.Children {
+			value = append(value, child.Bytes()...)
+		}
+	}
+
+	identifier := byte(p.Class) | byte(p.Tag)
+	if p.Constructed {
+		identifier |= constructed
+	}
+	out := []byte{identifier}
+	if len(value) < 0x80 {
+		out = append(out, byte(len(value)))
+	} else {
+		var length []byte
+		for n := len(value); n > 0; n >>= 8 {
+			length = append([]byte{byte(n)}, length...)
+		}
+		out = append(out, 0x80|byte(len(length)))
+		out = append(out, length...)
+	}
+	return append(out, value...)
+}
+
+// Read reads one packet from r.
+func Read(r *bufio.Reader) (*Packet, error) {
+	identifier, err := r.ReadByte()
+	if err != nil {
+		return nil, err
+	}
+	length, err := readLength(r)
+	if err != nil {
+		return nil, err
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return decode(identifier, data)
+}
+
+func readLength(r *bufio.Reader) (int, error) {
+	first, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if first < 0x80 {
+		return int(first), nil
+	}
+	n := int(first & 0x7f)
+	if n == 0 || n > 4 {
+		return 0, fmt.Errorf("%w: unsupported length", ErrMalformed)
+	}
+	length := 0
+	for i := 0; i < n; i++ {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		length = length<<8 | int(b)
+	}
+	if length > MaxPacketSize {
+		return 0, fmt.Errorf("%w: packet too large", ErrMalformed)
+	}
+	return length, nil
+}
+
+// Decode decodes a complete packet from data.
+func Decode(data []byte) (*Packet, error) {
+	p, rest, err := parse(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) > 0 {
+		return nil, fmt.Errorf("%w: trailing data", ErrMalformed)
+	}
+	return p, nil
+}
+
+func parse(data []byte) (*Packet, []byte, error) {
+	if len(data) < 2 {
+		return nil, nil, fmt.Errorf("%w: truncated", ErrMalformed)
+	}
+	identifier := data[0]
+	length, offset := int(data[1]), 2
+	if length >= 0x80 {
+		n := length & 0x7f
+		if n == 0 || n > 4 || len(data) < 2+n {
+			return nil, nil, fmt.Errorf("%w: unsupported length", ErrMalformed)
+		}
+		length = 0
+		for _, b := range data[2 : 2+n] {
+			length = length<<8 | int(b)
+		}
+		offset += n
+	}
+	if length < 0 || len(data)-offset < length {
+		return nil, nil, fmt.Errorf("%w: truncated", ErrMalformed)
+	}
+	p, err := decode(identifier, data[offset:offset+length])
+	return p, data[offset+length:], err
+}
+
+func decode(identifier byte, value []byte) (*Packet, error) {
+	p := &Packet{
+		Class:       int(identifier & 0xc0),
+		Constructed: identifier&constructed != 0,
+		Tag:         int(identifier & 0x1f),
+	}
+	if p.Tag == 0x1f {
+		return nil, fmt.Errorf("%w: unsupported tag", ErrMalformed)
+	}
+	if !p.Constructed {
+		p.Value = value
+		return p, nil
+	}
+	for len(value) > 0 {
+		child, rest, err := parse(value)
+		if err != nil {
+			return nil, err
+		}
+		p.Children = append(p.Children, child)
+		value = rest
+	}
+	return p, nil
+}
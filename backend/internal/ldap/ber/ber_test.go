@@ -0,0 +1,65 @@
+package ber
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestIntegerRoundTrip(t *testing.T) {
+	for _, n := range []int64{0, 1, 127, 128, 255, 256, -1, -128, -129, 1 << 31, -(1 << 40)} {
+		p, err := Decode(Integer(n).Bytes())
+		if err != nil {
+			t.Errorf("%d: unexpected error %v", n, err)
+			continue
+		}
+		if got, err := p.Int(); err != nil || got != n {
+			t.Errorf("%d: expected round trip, got %d, %v", n, got, err)
+		}
+	}
+	if got := Integer(128).Bytes(); !bytes.Equal(got, []byte{0x02, 0x02, 0x00, 0x80}) {
+		t.Errorf("Expected 128 in two bytes, got %x", got)
+	}
+}
+
+func TestRead(t *testing.T) {
+	long := strings.Repeat("x", 300)
+	message := Sequence(Integer(7), Constructed(ClassApplication, 0, Integer(3), String(long), Boolean(true)))
+
+	p, err := Read(bufio.NewReader(bytes.NewReader(message.Bytes())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !p.Is(ClassUniversal, TagSequence) || !p.Child(1).Is(ClassApplication, 0) {
+		t.Fatalf("Expected a sequence with an application element, got %+v", p)
+	}
+	if s, _ := p.Child(1).Child(1).Str(); s != long {
+		t.Errorf("Expected the long string, got %d bytes", len(s))
+	}
+	if b, _ := p.Child(1).Child(2).Bool(); !b {
+		t.Error("Expected true")
+	}
+	if p.Child(1).Child(5) != nil {
+		t.Error("Expected nil for a missing child")
+	}
+}
+
+func TestMalformed(t *testing.T) {
+	tests := map[string][]byte{
+		"truncated":     {0x30, 0x05, 0x02, 0x01},
+		"child overrun": {0x30, 0x03, 0x02, 0x05, 0x00},
+		"long tag":      {0x1f, 0x00},
+		"trailing data": {0x05, 0x00, 0x00},
+		"huge length":   {0x04, 0x84, 0x7f, 0xff, 0xff, 0xff},
+	}
+	for name, data := range tests {
+		if _, err := Decode(data); !errors.Is(err, ErrMalformed) {
+			t.Errorf("%s: expected ErrMalformed, got %v", name, err)
+		}
+	}
+	if _, err := Read(bufio.NewReader(bytes.NewReader([]byte{0x04, 0x84, 0x7f, 0xff, 0xff, 0xff}))); !errors.Is(err, ErrMalformed) {
+		t.Errorf("Expected packets over MaxPacketSize to be refused, got %v", err)
+	}
+}
@@ -0,0 +1,270 @@
+package ldap
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ForIAM/ForIAM/backend/internal/ldap/ber"
+)
+
+// Entry is an entry returned by a search.
+type Entry struct {
+	DN         string
+	Attributes map[string][]string
+}
+
+// Values returns the values of attribute, whose name is case insensitive.
+func (e *Entry) Values(attribute string) []string {
+	for name, values := range e.Attributes {
+		if strings.EqualFold(name, attribute) {
+			return values
+		}
+	}
+	return nil
+}
+
+// SearchRequest searches below BaseDN. SizeLimit 0 means no limit.
+type SearchRequest struct {
+	BaseDN     string
+	Scope      int
+	Filter     string
+	Attributes []string
+	SizeLimit  int
+}
+
+// Conn is a connection to an LDAP server. Operations are sent one after
+// the other and wait for their response.
+type Conn struct {
+	conn   net.Conn
+	reader *bufio.Reader
+	host   string
+	lastID int64
+}
+
+// Dial connects to the server at rawURL, an ldap:// or ldaps:// URL. The
+// connection gives up after timeout in total.
+func Dial(ctx context.Context, rawURL string, tlsConfig *tls.Config, timeout time.Duration) (*Conn, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	address := u.Host
+	if u.Port() == "" {
+		port := "389"
+		if u.Scheme == "ldaps" {
+			port = "636"
+		}
+		address = net.JoinHostPort(u.Hostname(), port)
+	}
+
+	dialer := &net.Dialer{Timeout: timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	c := &Conn{conn: conn, reader: bufio.NewReader(conn), host: u.Hostname()}
+	if u.Scheme == "ldaps" {
+		if err := c.upgrade(ctx, tlsConfig); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// upgrade runs the TLS handshake on the connection.
+func (c *Conn) upgrade(ctx context.Context, config *tls.Config) error {
+	if config == nil {
+		config = &tls.Config{}
+	} else {
+		config = config.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName = c.host
+	}
+	if config.MinVersion == 0 {
+		config.MinVersion = tls.VersionTLS12
+	}
+	conn := tls.Client(c.conn, config)
+	if err := conn.HandshakeContext(ctx); err != nil {
+		return fmt.Errorf("TLS handshake failed: %w", err)
+	}
+	c.conn = conn
+	c.reader = bufio.NewReader(conn)
+	return nil
+}
+
+// Close unbinds and closes the connection.
+func (c *Conn) Close() error {
+	c.lastID++
+	_, _ = c.conn.Write(Message(c.lastID, ber.Primitive(ber.ClassApplication, ApplicationUnbindRequest, nil)).Bytes())
+	return c.conn.Close()
+}
+
+// send sends op and returns its message ID.
+func (c *Conn) send(op *ber.Packet) (int64, error) {
+	c.lastID++
+	if _, err := c.conn.Write(Message(c.lastID, op).Bytes()); err != nil {
+		return 0, err
+	}
+	return c.lastID, nil
+}
+
+// receive reads the next response to message id and returns its protocol
+// operation.
+func (c *Conn) receive(id int64) (*ber.Packet, error) {
+	for {
+		message, err := ber.Read(c.reader)
+		if err != nil {
+			return nil, err
+		}
+		if !message.Is(ber.ClassUniversal, ber.TagSequence) || len(message.Children) < 2 {
+			return nil, fmt.Errorf("%w: not an LDAP message", ber.ErrMalformed)
+		}
+		messageID, err := message.Child(0).Int()
+		if err != nil {
+			return nil, err
+		}
+		op := message.Child(1)
+		if messageID == 0 && op.Is(ber.ClassApplication, ApplicationExtendedResponse) {
+			// Notice of disconnection
+			if err := parseResult(op); err != nil {
+				return nil, err
+			}
+			return nil, fmt.Errorf("the server closed the connection")
+		}
+		if messageID == id {
+			return op, nil
+		}
+	}
+}
+
+// StartTLS upgrades a plain connection to TLS.
+func (c *Conn) StartTLS(ctx context.Context, config *tls.Config) error {
+	id, err := c.send(ber.Constructed(ber.ClassApplication, ApplicationExtendedRequest,
+		ber.Primitive(ber.ClassContext, extendedRequestName, []byte(StartTLSOID))))
+	if err != nil {
+		return err
+	}
+	op, err := c.receive(id)
+	if err != nil {
+		return err
+	}
+	if !op.Is(ber.ClassApplication, ApplicationExtendedResponse) {
+		return fmt.Errorf("%w: unexpected response to StartTLS", ber.ErrMalformed)
+	}
+	if err := parseResult(op); err != nil {
+		return err
+	}
+	return c.upgrade(ctx, config)
+}
+
+// Bind authenticates as dn with a simple bind. An empty password would
+// make an unauthenticated bind, which servers accept for any DN, so it is
+// refused with invalid credentials.
+func (c *Conn) Bind(dn, password string) error {
+	if password == "" {
+		return &ResultError{Code: ResultInvalidCredentials, Message: "empty password"}
+	}
+	id, err := c.send(ber.Constructed(ber.ClassApplication, ApplicationBindRequest,
+		ber.Integer(protocolVersion),
+		ber.String(dn),
+		ber.Primitive(ber.ClassContext, authenticationSimple, []byte(password))))
+	if err != nil {
+		return err
+	}
+	op, err := c.receive(id)
+	if err != nil {
+		return err
+	}
+	if !op.Is(ber.ClassApplication, ApplicationBindResponse) {
+		return fmt.Errorf("%w: unexpected response to bind", ber.ErrMalformed)
+	}
+	return parseResult(op)
+}
+
+// Search returns the entries req matches. When the server stops at the
+// size limit, the entries found are returned with a ResultError.
+func (c *Conn) Search(req *SearchRequest) ([]*Entry, error) {
+	filter, err := CompileFilter(req.Filter)
+	if err != nil {
+		return nil, err
+	}
+	attributes := ber.Sequence()
+	for _, attribute := range req.Attributes {
+		attributes.Children = append(attributes.Children, ber.String(attribute))
+	}
+
+	id, err := c.send(ber.Constructed(ber.ClassApplication, ApplicationSearchRequest,
+		ber.String(req.BaseDN),
+		ber.Enumerated(int64(req.Scope)),
+		ber.Enumerated(derefNever),
+		ber.Integer(int64(req.SizeLimit)),
+		ber.Integer(0),
+		ber.Boolean(false),
+		filter,
+		attributes))
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []*Entry{}
+	for {
+		op, err := c.receive(id)
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case op.Is(ber.ClassApplication, ApplicationSearchResultEntry):
+			entry, err := parseEntry(op)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, entry)
+		case op.Is(ber.ClassApplication, ApplicationSearchResultReference):
+			// Referrals to other servers are not followed
+		case op.Is(ber.ClassApplication, ApplicationSearchResultDone):
+			return entries, parseResult(op)
+		default:
+			return nil, fmt.Errorf("%w: unexpected response to search", ber.ErrMalformed)
+		}
+	}
+}
+
+func parseEntry(op *ber.Packet) (*Entry, error) {
+	dn, err := op.Child(0).Str()
+	if err != nil {
+		return nil, err
+	}
+	attributes := op.Child(1)
+	if attributes == nil {
+		return nil, fmt.Errorf("%w: entry without attributes", ber.ErrMalformed)
+	}
+	entry := &Entry{DN: dn, Attributes: map[string][]string{}}
+	for _, attribute := range attributes.Children {
+		name, err := attribute.Child(0).Str()
+		values := attribute.Child(1)
+		if err != nil || values == nil {
+			return nil, fmt.Errorf("%w: invalid attribute", ber.ErrMalformed)
+		}
+		for _, value := range values.Children {
+			v, err := value.Str()
+			if err != nil {
+				return nil, err
+			}
+			entry.Attributes[name] = append(entry.Attributes[name], v)
+		}
+	}
+	return entry, nil
+}
@@ -0,0 +1,204 @@
+package ldap
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/ForIAM/ForIAM/backend/internal/ldap/ber"
+)
+
+// EscapeFilter escapes value for use as an assertion value in a filter, so
+// that user input cannot change the structure of the filter (RFC 4515).
+func EscapeFilter(value string) string {
+	var b strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch c := value[i]; c {
+		case '\\', '*', '(', ')', 0:
+			fmt.Fprintf(&b, "\\%02x", c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+// CompileFilter parses the string representation of a search filter into
+// its BER encoding. Extensible matches are not supported.
+func CompileFilter(filter string) (*ber.Packet, error) {
+	p := &filterParser{s: filter}
+	packet, err := p.filter()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.s) {
+		return nil, p.errorf("unexpected %q", p.s[p.pos:])
+	}
+	return packet, nil
+}
+
+type filterParser struct {
+	s   string
+	pos int
+}
+
+func (p *filterParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("%w: %s at offset %d", ErrInvalidFilter, fmt.Sprintf(format, args...), p.pos)
+}
+
+func (p *filterParser) next() byte {
+	if p.pos < len(p.s) {
+		return p.s[p.pos]
+	}
+	return 0
+}
+
+func (p *filterParser) filter() (*ber.Packet, error) {
+	if p.next() != '(' {
+		return nil, p.errorf("expected (")
+	}
+	p.pos++
+
+	var (
+		packet *ber.Packet
+		err    error
+	)
+	switch p.next() {
+	case '&':
+		p.pos++
+		packet, err = p.list(FilterAnd)
+	case '|':
+		p.pos++
+		packet, err = p.list(FilterOr)
+	case '!':
+		p.pos++
+		var inner *ber.Packet
+		if inner, err = p.filter(); err == nil {
+			packet = ber.Constructed(ber.ClassContext, FilterNot, inner)
+		}
+	default:
+		packet, err = p.item()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if p.next() != ')' {
+		return nil, p.errorf("expected )")
+	}
+	p.pos++
+	return packet, nil
+}
+
+func (p *filterParser) list(tag int) (*ber.Packet, error) {
+	packet := ber.Constructed(ber.ClassContext, tag)
+	for p.next() == '(' {
+		child, err := p.filter()
+		if err != nil {
+			return nil, err
+		}
+		packet.Children = append(packet.Children, child)
+	}
+	if len(packet.Children) == 0 {
+		return nil, p.errorf("empty filter list")
+	}
+	return packet, nil
+}
+
+func (p *filterParser) item() (*ber.Packet, error) {
+	start := p.pos
+	for p.pos < len(p.s) && isAttributeChar(p.s[p.pos]) {
+		p.pos++
+	}
+	attribute := p.s[start:p.pos]
+	if attribute == "" {
+		return nil, p.errorf("expected an attribute")
+	}
+
+	tag := FilterEqualityMatch
+	switch {
+	case strings.HasPrefix(p.s[p.pos:], "~="):
+		tag = FilterApproxMatch
+		p.pos += 2
+	case strings.HasPrefix(p.s[p.pos:], ">="):
+		tag = FilterGreaterOrEqual
+		p.pos += 2
+	case strings.HasPrefix(p.s[p.pos:], "<="):
+		tag = FilterLessOrEqual
+		p.pos += 2
+	case p.next() == '=':
+		p.pos++
+	default:
+		return nil, p.errorf("expected a filter type")
+	}
+
+	start = p.pos
+	for p.pos < len(p.s) && p.s[p.pos] != ')' && p.s[p.pos] != '(' {
+		p.pos++
+	}
+	raw := p.s[start:p.pos]
+
+	if tag == FilterEqualityMatch && raw == "*" {
+		return ber.Primitive(ber.ClassContext, FilterPresent, []byte(attribute)), nil
+	}
+	if tag == FilterEqualityMatch && strings.Contains(raw, "*") {
+		return p.substrings(attribute, raw)
+	}
+	value, err := p.unescape(raw)
+	if err != nil {
+		return nil, err
+	}
+	return ber.Constructed(ber.ClassContext, tag, ber.String(attribute), ber.String(value)), nil
+}
+
+// substrings encodes a substring filter. raw is split at the unescaped
+// asterisks; escaped ones are \2a.
+func (p *filterParser) substrings(attribute, raw string) (*ber.Packet, error) {
+	parts := strings.Split(raw, "*")
+	substrings := ber.Sequence()
+	for i, part := range parts {
+		if part == "" {
+			continue
+		}
+		value, err := p.unescape(part)
+		if err != nil {
+			return nil, err
+		}
+		tag := SubstringAny
+		switch i {
+		case 0:
+			tag = SubstringInitial
+		case len(parts) - 1:
+			tag = SubstringFinal
+		}
+		substrings.Children = append(substrings.Children, ber.Primitive(ber.ClassContext, tag, []byte(value)))
+	}
+	return ber.Constructed(ber.ClassContext, FilterSubstrings, ber.String(attribute), substrings), nil
+}
+
+func (p *filterParser) unescape(raw string) (string, error) {
+	if !strings.Contains(raw, "\\") {
+		return raw, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(raw); i++ {
+		if raw[i] != '\\' {
+			b.WriteByte(raw[i])
+			continue
+		}
+		if i+3 > len(raw) {
+			return "", p.errorf("truncated escape")
+		}
+		decoded, err := hex.DecodeString(raw[i+1 : i+3])
+		if err != nil {
+			return "", p.errorf("invalid escape \\%s", raw[i+1:i+3])
+		}
+		b.Write(decoded)
+		i += 2
+	}
+	return b.String(), nil
+}
+
+func isAttributeChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '.' || c == ';'
+}
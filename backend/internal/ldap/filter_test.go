@@ -0,0 +1,67 @@
+package ldap
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/ForIAM/ForIAM/backend/internal/ldap/ber"
+)
+
+func TestEscapeFilter(t *testing.T) {
+	tests := map[string]string{
+		"alice@corp.example": "alice@corp.example",
+		"*":                  `\2a`,
+		"a)(uid=*":           `a\29\28uid=\2a`,
+		`back\slash`:         `back\5cslash`,
+		"nul\x00":            `nul\00`,
+	}
+	for value, expected := range tests {
+		if got := EscapeFilter(value); got != expected {
+			t.Errorf("%q: expected %s, got %s", value, expected, got)
+		}
+	}
+}
+
+func TestCompileFilter(t *testing.T) {
+	equality := func(attribute, value string) *ber.Packet {
+		return ber.Constructed(ber.ClassContext, FilterEqualityMatch, ber.String(attribute), ber.String(value))
+	}
+	tests := []struct {
+		filter   string
+		expected *ber.Packet
+	}{
+		{"(mail=alice@corp.example)", equality("mail", "alice@corp.example")},
+		{`(cn=a\2a\29b)`, equality("cn", "a*)b")},
+		{"(objectClass=*)", ber.Primitive(ber.ClassContext, FilterPresent, []byte("objectClass"))},
+		{"(&(uid=alice)(!(cn=bob)))", ber.Constructed(ber.ClassContext, FilterAnd,
+			equality("uid", "alice"),
+			ber.Constructed(ber.ClassContext, FilterNot, equality("cn", "bob")))},
+		{"(|(member=x)(uniqueMember=x))", ber.Constructed(ber.ClassContext, FilterOr,
+			equality("member", "x"), equality("uniqueMember", "x"))},
+		{"(uidNumber>=1000)", ber.Constructed(ber.ClassContext, FilterGreaterOrEqual,
+			ber.String("uidNumber"), ber.String("1000"))},
+		{"(cn=a*b*c)", ber.Constructed(ber.ClassContext, FilterSubstrings, ber.String("cn"), ber.Sequence(
+			ber.Primitive(ber.ClassContext, SubstringInitial, []byte("a")),
+			ber.Primitive(ber.ClassContext, SubstringAny, []byte("b")),
+			ber.Primitive(ber.ClassContext, SubstringFinal, []byte("c"))))},
+		{"(cn=*b*)", ber.Constructed(ber.ClassContext, FilterSubstrings, ber.String("cn"), ber.Sequence(
+			ber.Primitive(ber.ClassContext, SubstringAny, []byte("b"))))},
+	}
+	for _, test := range tests {
+		packet, err := CompileFilter(test.filter)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.filter, err)
+			continue
+		}
+		if !bytes.Equal(packet.Bytes(), test.expected.Bytes()) {
+			t.Errorf("%s: expected %x, got %x", test.filter, test.expected.Bytes(), packet.Bytes())
+		}
+	}
+
+	for _, filter := range []string{"", "mail=x", "(mail=x", "(mail=x))", "(=x)", "(mail)", "(&)", `(cn=\2)`, `(cn=\zz)`} {
+		if _, err := CompileFilter(filter); !errors.Is(err, ErrInvalidFilter) {
+			t.Errorf("%q: expected ErrInvalidFilter, got %v", filter, err)
+		}
+	}
+}
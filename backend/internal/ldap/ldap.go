@@ -0,0 +1,292 @@
+// Package ldap verifies the passwords of a tenant's users against its
+// LDAP directory, such as Active Directory or OpenLDAP, instead of the
+// password hashes ForIAM keeps. The user's entry is found with a search as
+// the configured service account, and the password is checked by binding
+// as that entry. Group membership in the directory can be mapped onto the
+// tenant's groups.
+//
+// The client speaks the small part of LDAPv3 this needs: simple binds,
+// searches and StartTLS.
+package ldap
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// timeout bounds a whole conversation with the directory.
+const timeout = 10 * time.Second
+
+var (
+	ErrNotFound           = errors.New("LDAP directory not configured")
+	ErrInvalidDirectory   = errors.New("invalid LDAP directory")
+	ErrInvalidFilter      = errors.New("invalid LDAP filter")
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	ErrUserNotFound       = errors.New("no directory entry for the user")
+	ErrDirectory          = errors.New("LDAP directory unavailable")
+)
+
+// Directory is the LDAP directory of a tenant.
+//
+// URL is an ldap:// or ldaps:// URL; with StartTLS an ldap:// connection is
+// upgraded before binding. RootCA, when set, is the PEM certificate of the
+// CA the server certificate must chain to instead of the system roots.
+// BindDN and BindPassword, which is write only and stored encrypted, are
+// the service account searches run as; without a bind DN they run
+// anonymously.
+//
+// UserFilter finds the entry of a user below BaseDN, with {email} replaced
+// by the user's email address and {username} by its local part. With
+// GroupSync the groups below GroupBaseDN matching GroupFilter, with {dn}
+// replaced by the DN of the user's entry, are looked up; the value of
+// GroupNameAttribute of each is mapped to a local group by GroupMapping.
+type Directory struct {
+	TenantID     string `json:"tenant_id"`
+	URL          string `json:"url"`
+	StartTLS     bool   `json:"start_tls"`
+	RootCA       string `json:"root_ca"`
+	BindDN       string `json:"bind_dn"`
+	BindPassword string `json:"-"`
+	BaseDN       string `json:"base_dn"`
+	UserFilter   string `json:"user_filter"`
+
+	GroupSync          bool              `json:"group_sync"`
+	GroupBaseDN        string            `json:"group_base_dn"`
+	GroupFilter        string            `json:"group_filter"`
+	GroupNameAttribute string            `json:"group_name_attribute"`
+	GroupMapping       map[string]string `json:"group_mapping"`
+
+	// AllowLocalPasswords lets users without an entry in the directory
+	// sign in with their ForIAM password
+	AllowLocalPasswords bool      `json:"allow_local_passwords"`
+	IsActive            bool      `json:"is_active"`
+	CreatedAt           time.Time `json:"created_at"`
+	UpdatedAt           time.Time `json:"updated_at"`
+}
+
+// Defaults of a directory.
+const (
+	DefaultUserFilter         = "(mail={email})"
+	DefaultGroupFilter        = "(|(member={dn})(uniqueMember={dn}))"
+	DefaultGroupNameAttribute = "cn"
+)
+
+// Validate checks d and fills in the defaults: the user and group filters,
+// the group name attribute cn, and the base DN as group base DN.
+func (d *Directory) Validate() error {
+	u, err := url.Parse(d.URL)
+	if err != nil || (u.Scheme != "ldap" && u.Scheme != "ldaps") || u.Hostname() == "" || (u.Path != "" && u.Path != "/") {
+		return fmt.Errorf("%w: url must be an ldap:// or ldaps:// URL of a server", ErrInvalidDirectory)
+	}
+	if u.Scheme == "ldaps" && d.StartTLS {
+		return fmt.Errorf("%w: start_tls is for ldap:// URLs", ErrInvalidDirectory)
+	}
+	if d.RootCA != "" {
+		if _, err := d.rootCAs(); err != nil {
+			return err
+		}
+	}
+	if strings.TrimSpace(d.BaseDN) == "" {
+		return fmt.Errorf("%w: base_dn is required", ErrInvalidDirectory)
+	}
+
+	if d.UserFilter == "" {
+		d.UserFilter = DefaultUserFilter
+	}
+	if !strings.Contains(d.UserFilter, "{email}") && !strings.Contains(d.UserFilter, "{username}") {
+		return fmt.Errorf("%w: user_filter must contain {email} or {username}", ErrInvalidDirectory)
+	}
+	if _, err := CompileFilter(expand(d.UserFilter, map[string]string{"email": "user@example.com", "username": "user"})); err != nil {
+		return fmt.Errorf("%w: user_filter: %v", ErrInvalidDirectory, err)
+	}
+
+	if d.GroupBaseDN == "" {
+		d.GroupBaseDN = d.BaseDN
+	}
+	if d.GroupFilter == "" {
+		d.GroupFilter = DefaultGroupFilter
+	}
+	if !strings.Contains(d.GroupFilter, "{dn}") {
+		return fmt.Errorf("%w: group_filter must contain {dn}", ErrInvalidDirectory)
+	}
+	if _, err := CompileFilter(expand(d.GroupFilter, map[string]string{"dn": "uid=user,dc=example,dc=com"})); err != nil {
+		return fmt.Errorf("%w: group_filter: %v", ErrInvalidDirectory, err)
+	}
+	if d.GroupNameAttribute == "" {
+		d.GroupNameAttribute = DefaultGroupNameAttribute
+	}
+	if d.GroupMapping == nil {
+		d.GroupMapping = map[string]string{}
+	}
+	for name, groupID := range d.GroupMapping {
+		if name == "" {
+			return fmt.Errorf("%w: group names must not be empty", ErrInvalidDirectory)
+		}
+		if _, err := uuid.Parse(groupID); err != nil {
+			return fmt.Errorf("%w: %s is not mapped to a group ID", ErrInvalidDirectory, name)
+		}
+	}
+	return nil
+}
+
+func (d *Directory) rootCAs() (*x509.CertPool, error) {
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM([]byte(d.RootCA)) {
+		return nil, fmt.Errorf("%w: root_ca must be a PEM certificate", ErrInvalidDirectory)
+	}
+	return pool, nil
+}
+
+// expand replaces the {name} placeholders of filter with the escaped
+// values.
+func expand(filter string, values map[string]string) string {
+	for name, value := range values {
+		filter = strings.ReplaceAll(filter, "{"+name+"}", EscapeFilter(value))
+	}
+	return filter
+}
+
+// Account is the entry of a user in the directory.
+type Account struct {
+	DN string `json:"dn"`
+	// Names of the user's groups, when the directory syncs groups
+	Groups []string `json:"groups"`
+}
+
+// connect opens a connection secured as configured and binds as the
+// service account.
+func (d *Directory) connect(ctx context.Context) (*Conn, error) {
+	config := &tls.Config{}
+	if d.RootCA != "" {
+		pool, err := d.rootCAs()
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+
+	conn, err := Dial(ctx, d.URL, config, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDirectory, err)
+	}
+	if d.StartTLS {
+		if err := conn.StartTLS(ctx, config); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("%w: StartTLS: %v", ErrDirectory, err)
+		}
+	}
+	if d.BindDN != "" {
+		if err := conn.Bind(d.BindDN, d.BindPassword); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("%w: service account bind: %v", ErrDirectory, err)
+		}
+	}
+	return conn, nil
+}
+
+// Ping connects and binds as the service account.
+func (d *Directory) Ping(ctx context.Context) error {
+	conn, err := d.connect(ctx)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// Lookup finds the entry of the user with email, and its groups when the
+// directory syncs groups.
+func (d *Directory) Lookup(ctx context.Context, email string) (*Account, error) {
+	conn, err := d.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return d.lookup(conn, email)
+}
+
+// Authenticate checks password by binding as the entry of the user with
+// email. The groups are looked up as the service account before.
+func (d *Directory) Authenticate(ctx context.Context, email, password string) (*Account, error) {
+	if password == "" {
+		return nil, ErrInvalidCredentials
+	}
+	conn, err := d.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	account, err := d.lookup(conn, email)
+	if err != nil {
+		return nil, err
+	}
+	err = conn.Bind(account.DN, password)
+	var result *ResultError
+	if errors.As(err, &result) && result.Code == ResultInvalidCredentials {
+		return nil, ErrInvalidCredentials
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrDirectory, err)
+	}
+	return account, nil
+}
+
+func (d *Directory) lookup(conn *Conn, email string) (*Account, error) {
+	username := email
+	if at := strings.LastIndex(email, "@"); at >= 0 {
+		username = email[:at]
+	}
+	entries, err := conn.Search(&SearchRequest{
+		BaseDN:     d.BaseDN,
+		Scope:      ScopeWholeSubtree,
+		Filter:     expand(d.UserFilter, map[string]string{"email": email, "username": username}),
+		Attributes: []string{noAttributes},
+		SizeLimit:  2,
+	})
+	var result *ResultError
+	switch {
+	case errors.As(err, &result) && result.Code == ResultSizeLimitExceeded, err == nil && len(entries) > 1:
+		return nil, fmt.Errorf("%w: the user filter matches several entries", ErrDirectory)
+	case errors.As(err, &result) && result.Code == ResultNoSuchObject, err == nil && len(entries) == 0:
+		return nil, ErrUserNotFound
+	case err != nil:
+		return nil, fmt.Errorf("%w: user search: %v", ErrDirectory, err)
+	}
+
+	account := &Account{DN: entries[0].DN, Groups: []string{}}
+	if !d.GroupSync {
+		return account, nil
+	}
+	groups, err := conn.Search(&SearchRequest{
+		BaseDN:     d.GroupBaseDN,
+		Scope:      ScopeWholeSubtree,
+		Filter:     expand(d.GroupFilter, map[string]string{"dn": account.DN}),
+		Attributes: []string{d.GroupNameAttribute},
+	})
+	if err != nil && !(errors.As(err, &result) && result.Code == ResultNoSuchObject) {
+		return nil, fmt.Errorf("%w: group search: %v", ErrDirectory, err)
+	}
+	for _, group := range groups {
+		account.Groups = append(account.Groups, group.Values(d.GroupNameAttribute)...)
+	}
+	return account, nil
+}
+
+// Groups returns the IDs of the local groups the groups of account map to.
+func (d *Directory) Groups(account *Account) map[string]bool {
+	groups := map[string]bool{}
+	for _, name := range account.Groups {
+		if groupID, ok := d.GroupMapping[name]; ok {
+			groups[groupID] = true
+		}
+	}
+	return groups
+}
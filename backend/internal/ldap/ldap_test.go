@@ -0,0 +1,401 @@
+package ldap
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ForIAM/ForIAM/backend/internal/ldap/ber"
+)
+
+// mockEntry is an entry of a mockDirectory. Entries with a password can
+// bind.
+type mockEntry struct {
+	dn         string
+	attributes map[string][]string
+	password   string
+}
+
+// mockDirectory is an LDAP server for tests. It answers binds, searches
+// after a successful bind, and StartTLS with a self-signed certificate for
+// 127.0.0.1.
+type mockDirectory struct {
+	listener    net.Listener
+	entries     []mockEntry
+	certificate tls.Certificate
+	// certificatePEM is the certificate the server presents over TLS
+	certificatePEM string
+}
+
+func newMockDirectory(t *testing.T, entries ...mockEntry) *mockDirectory {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ldap.test"},
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	d := &mockDirectory{
+		listener:       listener,
+		entries:        entries,
+		certificate:    tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key},
+		certificatePEM: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go d.serve(conn)
+		}
+	}()
+	return d
+}
+
+func (d *mockDirectory) url() string {
+	return "ldap://" + d.listener.Addr().String()
+}
+
+func (d *mockDirectory) serve(conn net.Conn) {
+	defer func() { conn.Close() }()
+	reader := bufio.NewReader(conn)
+	bound := false
+	for {
+		message, err := ber.Read(reader)
+		if err != nil {
+			return
+		}
+		id, _ := message.Child(0).Int()
+		op := message.Child(1)
+		reply := func(op *ber.Packet) { conn.Write(Message(id, op).Bytes()) }
+
+		switch {
+		case op.Is(ber.ClassApplication, ApplicationBindRequest):
+			dn, _ := op.Child(1).Str()
+			password, _ := op.Child(2).Str()
+			code := ResultInvalidCredentials
+			for _, entry := range d.entries {
+				if entry.password != "" && strings.EqualFold(entry.dn, dn) && entry.password == password {
+					code = ResultSuccess
+				}
+			}
+			bound = code == ResultSuccess
+			reply(Result(ApplicationBindResponse, code, ""))
+
+		case op.Is(ber.ClassApplication, ApplicationSearchRequest):
+			if !bound {
+				reply(Result(ApplicationSearchResultDone, ResultInsufficientAccessRight, "bind first"))
+				continue
+			}
+			base, _ := op.Child(0).Str()
+			scope, _ := op.Child(1).Int()
+			sizeLimit, _ := op.Child(3).Int()
+			var attributes []string
+			for _, attribute := range op.Child(7).Children {
+				name, _ := attribute.Str()
+				attributes = append(attributes, name)
+			}
+
+			code, sent := ResultSuccess, 0
+			for _, entry := range d.entries {
+				if !inScope(entry.dn, base, scope) || !matches(op.Child(6), entry.attributes) {
+					continue
+				}
+				if sizeLimit > 0 && int64(sent) == sizeLimit {
+					code = ResultSizeLimitExceeded
+					break
+				}
+				reply(searchEntry(entry, attributes))
+				sent++
+			}
+			reply(Result(ApplicationSearchResultDone, code, ""))
+
+		case op.Is(ber.ClassApplication, ApplicationExtendedRequest):
+			reply(Result(ApplicationExtendedResponse, ResultSuccess, ""))
+			secure := tls.Server(conn, &tls.Config{Certificates: []tls.Certificate{d.certificate}})
+			if err := secure.Handshake(); err != nil {
+				return
+			}
+			conn, reader = secure, bufio.NewReader(secure)
+
+		default:
+			return
+		}
+	}
+}
+
+func inScope(dn, base string, scope int64) bool {
+	dn, base = strings.ToLower(dn), strings.ToLower(base)
+	switch scope {
+	case ScopeBaseObject:
+		return dn == base
+	case ScopeSingleLevel:
+		parent := dn[strings.Index(dn, ",")+1:]
+		return strings.Contains(dn, ",") && parent == base
+	default:
+		return dn == base || strings.HasSuffix(dn, ","+base)
+	}
+}
+
+func matches(filter *ber.Packet, attributes map[string][]string) bool {
+	values := func(name string) []string {
+		for attribute, values := range attributes {
+			if strings.EqualFold(attribute, name) {
+				return values
+			}
+		}
+		return nil
+	}
+	switch {
+	case filter.Is(ber.ClassContext, FilterAnd):
+		for _, child := range filter.Children {
+			if !matches(child, attributes) {
+				return false
+			}
+		}
+		return true
+	case filter.Is(ber.ClassContext, FilterOr):
+		for _, child := range filter.Children {
+			if matches(child, attributes) {
+				return true
+			}
+		}
+		return false
+	case filter.Is(ber.ClassContext, FilterNot):
+		return !matches(filter.Child(0), attributes)
+	case filter.Is(ber.ClassContext, FilterPresent):
+		return len(values(string(filter.Value))) > 0
+	case filter.Is(ber.ClassContext, FilterEqualityMatch):
+		name, _ := filter.Child(0).Str()
+		want, _ := filter.Child(1).Str()
+		for _, value := range values(name) {
+			if strings.EqualFold(value, want) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func searchEntry(entry mockEntry, attributes []string) *ber.Packet {
+	list := ber.Sequence()
+	for name, values := range entry.attributes {
+		wanted := false
+		for _, attribute := range attributes {
+			wanted = wanted || strings.EqualFold(attribute, name)
+		}
+		if !wanted {
+			continue
+		}
+		set := ber.Set()
+		for _, value := range values {
+			set.Children = append(set.Children, ber.String(value))
+		}
+		list.Children = append(list.Children, ber.Sequence(ber.String(name), set))
+	}
+	return ber.Constructed(ber.ClassApplication, ApplicationSearchResultEntry, ber.String(entry.dn), list)
+}
+
+func corpDirectory(t *testing.T) *mockDirectory {
+	return newMockDirectory(t,
+		mockEntry{dn: "cn=forIAM,ou=services,dc=corp,dc=example", password: "service-secret"},
+		mockEntry{
+			dn:         "uid=alice,ou=people,dc=corp,dc=example",
+			attributes: map[string][]string{"mail": {"alice@corp.example"}, "uid": {"alice"}},
+			password:   "alice-secret",
+		},
+		mockEntry{
+			dn:         "uid=bob,ou=people,dc=corp,dc=example",
+			attributes: map[string][]string{"mail": {"bob@corp.example"}, "uid": {"bob"}},
+			password:   "bob-secret",
+		},
+		mockEntry{
+			dn: "cn=staff,ou=groups,dc=corp,dc=example",
+			attributes: map[string][]string{"cn": {"staff"}, "member": {
+				"uid=alice,ou=people,dc=corp,dc=example", "uid=bob,ou=people,dc=corp,dc=example"}},
+		},
+		mockEntry{
+			dn:         "cn=admins,ou=groups,dc=corp,dc=example",
+			attributes: map[string][]string{"cn": {"admins"}, "uniqueMember": {"uid=alice,ou=people,dc=corp,dc=example"}},
+		},
+	)
+}
+
+func corpConfig(server *mockDirectory) *Directory {
+	return &Directory{
+		URL:          server.url(),
+		BindDN:       "cn=forIAM,ou=services,dc=corp,dc=example",
+		BindPassword: "service-secret",
+		BaseDN:       "ou=people,dc=corp,dc=example",
+		GroupSync:    true,
+		GroupBaseDN:  "ou=groups,dc=corp,dc=example",
+		GroupMapping: map[string]string{
+			"admins": "6f1c1a4e-3b55-4f5e-9f7c-0d8e2a9b1c01",
+			"staff":  "6f1c1a4e-3b55-4f5e-9f7c-0d8e2a9b1c02",
+		},
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	server := corpDirectory(t)
+	ctx := context.Background()
+
+	tests := []struct {
+		name     string
+		change   func(d *Directory)
+		email    string
+		password string
+		groups   []string
+		err      error
+	}{
+		{name: "valid password", email: "alice@corp.example", password: "alice-secret", groups: []string{"admins", "staff"}},
+		{name: "email case", email: "Bob@Corp.Example", password: "bob-secret", groups: []string{"staff"}},
+		{name: "username filter", change: func(d *Directory) { d.UserFilter = "(uid={username})" },
+			email: "bob@corp.example", password: "bob-secret", groups: []string{"staff"}},
+		{name: "without group sync", change: func(d *Directory) { d.GroupSync = false },
+			email: "alice@corp.example", password: "alice-secret", groups: []string{}},
+		{name: "wrong password", email: "alice@corp.example", password: "bob-secret", err: ErrInvalidCredentials},
+		{name: "empty password", email: "alice@corp.example", password: "", err: ErrInvalidCredentials},
+		{name: "unknown user", email: "carol@corp.example", password: "alice-secret", err: ErrUserNotFound},
+		{name: "filter injection", email: "*", password: "alice-secret", err: ErrUserNotFound},
+		{name: "ambiguous filter", change: func(d *Directory) { d.UserFilter = "(|(mail={email})(uid=*))" },
+			email: "alice@corp.example", password: "alice-secret", err: ErrDirectory},
+		{name: "wrong service password", change: func(d *Directory) { d.BindPassword = "guess" },
+			email: "alice@corp.example", password: "alice-secret", err: ErrDirectory},
+		{name: "anonymous search refused", change: func(d *Directory) { d.BindDN, d.BindPassword = "", "" },
+			email: "alice@corp.example", password: "alice-secret", err: ErrDirectory},
+		{name: "StartTLS", change: func(d *Directory) { d.StartTLS, d.RootCA = true, server.certificatePEM },
+			email: "alice@corp.example", password: "alice-secret", groups: []string{"admins", "staff"}},
+		{name: "StartTLS with untrusted certificate", change: func(d *Directory) { d.StartTLS = true },
+			email: "alice@corp.example", password: "alice-secret", err: ErrDirectory},
+		{name: "server down", change: func(d *Directory) { d.URL = "ldap://127.0.0.1:1" },
+			email: "alice@corp.example", password: "alice-secret", err: ErrDirectory},
+	}
+
+	for _, test := range tests {
+		d := corpConfig(server)
+		if test.change != nil {
+			test.change(d)
+		}
+		if err := d.Validate(); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		account, err := d.Authenticate(ctx, test.email, test.password)
+		if test.err != nil {
+			if !errors.Is(err, test.err) {
+				t.Errorf("%s: expected %v, got %v", test.name, test.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+			continue
+		}
+		sort.Strings(account.Groups)
+		if !reflect.DeepEqual(account.Groups, test.groups) {
+			t.Errorf("%s: expected groups %v, got %v", test.name, test.groups, account.Groups)
+		}
+	}
+}
+
+func TestLookupAndGroups(t *testing.T) {
+	server := corpDirectory(t)
+	d := corpConfig(server)
+	if err := d.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	account, err := d.Lookup(context.Background(), "alice@corp.example")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if account.DN != "uid=alice,ou=people,dc=corp,dc=example" {
+		t.Errorf("Expected alice's DN, got %s", account.DN)
+	}
+	groups := d.Groups(account)
+	if len(groups) != 2 || !groups["6f1c1a4e-3b55-4f5e-9f7c-0d8e2a9b1c01"] || !groups["6f1c1a4e-3b55-4f5e-9f7c-0d8e2a9b1c02"] {
+		t.Errorf("Expected both mapped groups, got %v", groups)
+	}
+
+	account.Groups = []string{"staff", "contractors"}
+	if groups := d.Groups(account); len(groups) != 1 || !groups["6f1c1a4e-3b55-4f5e-9f7c-0d8e2a9b1c02"] {
+		t.Errorf("Expected unmapped groups to be ignored, got %v", groups)
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := func() *Directory {
+		return &Directory{URL: "ldaps://ldap.corp.example", BaseDN: "dc=corp,dc=example"}
+	}
+	tests := []struct {
+		name   string
+		change func(d *Directory)
+		valid  bool
+	}{
+		{"defaults", func(d *Directory) {}, true},
+		{"port", func(d *Directory) { d.URL = "ldap://ldap.corp.example:3389" }, true},
+		{"StartTLS", func(d *Directory) { d.URL, d.StartTLS = "ldap://ldap.corp.example", true }, true},
+		{"StartTLS over ldaps", func(d *Directory) { d.StartTLS = true }, false},
+		{"http URL", func(d *Directory) { d.URL = "https://ldap.corp.example" }, false},
+		{"URL with DN", func(d *Directory) { d.URL = "ldap://ldap.corp.example/dc=corp,dc=example" }, false},
+		{"missing base DN", func(d *Directory) { d.BaseDN = " " }, false},
+		{"invalid root CA", func(d *Directory) { d.RootCA = "not a certificate" }, false},
+		{"user filter without placeholder", func(d *Directory) { d.UserFilter = "(mail=alice@corp.example)" }, false},
+		{"malformed user filter", func(d *Directory) { d.UserFilter = "(mail={email}" }, false},
+		{"group filter without placeholder", func(d *Directory) { d.GroupFilter = "(objectClass=group)" }, false},
+		{"group mapped to no ID", func(d *Directory) { d.GroupMapping = map[string]string{"staff": "staff"} }, false},
+	}
+
+	for _, test := range tests {
+		d := valid()
+		test.change(d)
+		err := d.Validate()
+		if test.valid && err != nil {
+			t.Errorf("%s: expected valid, got %v", test.name, err)
+		}
+		if !test.valid && !errors.Is(err, ErrInvalidDirectory) {
+			t.Errorf("%s: expected ErrInvalidDirectory, got %v", test.name, err)
+		}
+	}
+
+	d := valid()
+	d.Validate()
+	if d.UserFilter != DefaultUserFilter || d.GroupFilter != DefaultGroupFilter ||
+		d.GroupNameAttribute != DefaultGroupNameAttribute || d.GroupBaseDN != d.BaseDN {
+		t.Errorf("Expected defaults, got %+v", d)
+	}
+}
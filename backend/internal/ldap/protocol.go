@@ -0,0 +1,107 @@
+package ldap
+
+import (
+	"fmt"
+
+	"github.com/ForIAM/ForIAM/backend/internal/ldap/ber"
+)
+
+// Protocol operations, the application tags of RFC 4511.
+const (
+	ApplicationBindRequest           = 0
+	ApplicationBindResponse          = 1
+	ApplicationUnbindRequest         = 2
+	ApplicationSearchRequest         = 3
+	ApplicationSearchResultEntry     = 4
+	ApplicationSearchResultDone      = 5
+	ApplicationSearchResultReference = 19
+	ApplicationExtendedRequest       = 23
+	ApplicationExtendedResponse      = 24
+)
+
+// Search scopes.
+const (
+	ScopeBaseObject   = 0
+	ScopeSingleLevel  = 1
+	ScopeWholeSubtree = 2
+)
+
+// Result codes ForIAM tells apart.
+const (
+	ResultSuccess                 = 0
+	ResultSizeLimitExceeded       = 4
+	ResultNoSuchObject            = 32
+	ResultInvalidCredentials      = 49
+	ResultInsufficientAccessRight = 50
+	ResultUnwillingToPerform      = 53
+	ResultOther                   = 80
+)
+
+// Filter choices, the context tags of a Filter.
+const (
+	FilterAnd            = 0
+	FilterOr             = 1
+	FilterNot            = 2
+	FilterEqualityMatch  = 3
+	FilterSubstrings     = 4
+	FilterGreaterOrEqual = 5
+	FilterLessOrEqual    = 6
+	FilterPresent        = 7
+	FilterApproxMatch    = 8
+)
+
+// Choices of a substring filter.
+const (
+	SubstringInitial = 0
+	SubstringAny     = 1
+	SubstringFinal   = 2
+)
+
+// StartTLSOID names the StartTLS extended operation.
+const StartTLSOID = "1.3.6.1.4.1.1466.20037"
+
+const (
+	protocolVersion      = 3
+	authenticationSimple = 0
+	extendedRequestName  = 0
+	derefNever           = 0
+	// noAttributes asks a search for the DNs of entries only
+	noAttributes = "1.1"
+)
+
+// ResultError is an LDAPResult other than success.
+type ResultError struct {
+	Code    int
+	Message string
+}
+
+func (e *ResultError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("LDAP result code %d", e.Code)
+	}
+	return fmt.Sprintf("LDAP result code %d: %s", e.Code, e.Message)
+}
+
+// Message returns the LDAPMessage with id carrying op.
+func Message(id int64, op *ber.Packet) *ber.Packet {
+	return ber.Sequence(ber.Integer(id), op)
+}
+
+// Result returns an LDAPResult of application tag.
+func Result(tag, code int, message string) *ber.Packet {
+	return ber.Constructed(ber.ClassApplication, tag, ber.Enumerated(int64(code)), ber.String(""), ber.String(message))
+}
+
+// parseResult reads the LDAPResult at the start of op, returning nil on
+// success.
+func parseResult(op *ber.Packet) error {
+	code, err := op.Child(0).Int()
+	if err != nil {
+		return err
+	}
+	if code == ResultSuccess {
+		return nil
+	}
+	message, _ := op.Child(2).Str()
+	return &ResultError{Code: int(code), Message: message}
+}
@@ -0,0 +1,222 @@
+package ldap
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/ForIAM/ForIAM/backend/internal/sealing"
+	"github.com/lib/pq"
+)
+
+// Store keeps the directories of tenants. Bind passwords are encrypted
+// with a key derived from the server's encryption key.
+type Store struct {
+	db  *sql.DB
+	box *sealing.Box
+}
+
+func NewStore(db *sql.DB, encryptionKey string) *Store {
+	return &Store{db: db, box: sealing.New(encryptionKey, sealing.PurposeBindPassword)}
+}
+
+// Get loads the directory of tenantID with its decrypted bind password.
+func (s *Store) Get(tenantID string) (*Directory, error) {
+	return s.get(`tenant_id = $1`, tenantID)
+}
+
+// GetActive loads the directory of tenantID like Get, or returns
+// ErrNotFound when it is not active.
+func (s *Store) GetActive(tenantID string) (*Directory, error) {
+	return s.get(`tenant_id = $1 AND is_active`, tenantID)
+}
+
+func (s *Store) get(where string, args ...interface{}) (*Directory, error) {
+	var (
+		d              Directory
+		sealed, groups []byte
+	)
+	err := s.db.QueryRow(`
+		SELECT tenant_id, url, start_tls, root_ca, bind_dn, bind_password_encrypted, base_dn, user_filter,
+			group_sync, group_base_dn, group_filter, group_name_attribute, group_mapping,
+			allow_local_passwords, is_active, created_at, updated_at
+		FROM ldap_directories WHERE `+where,
+		args...).Scan(&d.TenantID, &d.URL, &d.StartTLS, &d.RootCA, &d.BindDN, &sealed, &d.BaseDN, &d.UserFilter,
+		&d.GroupSync, &d.GroupBaseDN, &d.GroupFilter, &d.GroupNameAttribute, &groups,
+		&d.AllowLocalPasswords, &d.IsActive, &d.CreatedAt, &d.UpdatedAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load LDAP directory: %w", err)
+	}
+	if err := json.Unmarshal(groups, &d.GroupMapping); err != nil {
+		return nil, fmt.Errorf("invalid group mapping: %w", err)
+	}
+	if sealed != nil {
+		password, err := s.box.Open(sealed)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decrypt bind password: %w", err)
+		}
+		d.BindPassword = string(password)
+	}
+	return &d, nil
+}
+
+// checkGroups makes sure the groups d maps to are static groups of its
+// tenant: the members of dynamic groups follow their rule.
+func (s *Store) checkGroups(d *Directory) error {
+	ids := map[string]bool{}
+	for _, groupID := range d.GroupMapping {
+		ids[groupID] = true
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+	list := make([]string, 0, len(ids))
+	for id := range ids {
+		list = append(list, id)
+	}
+
+	var found int
+	err := s.db.QueryRow(`
+		SELECT COUNT(*) FROM groups WHERE tenant_id = $1 AND id = ANY($2) AND rule IS NULL
+	`, d.TenantID, pq.Array(list)).Scan(&found)
+	if err != nil {
+		return fmt.Errorf("failed to check groups: %w", err)
+	}
+	if found != len(list) {
+		return fmt.Errorf("%w: group_mapping must refer to static groups of the tenant", ErrInvalidDirectory)
+	}
+	return nil
+}
+
+// Save validates d and makes it the directory of its tenant. The bind
+// password only changes when set, and is dropped without a bind DN.
+func (s *Store) Save(d *Directory) error {
+	if err := d.Validate(); err != nil {
+		return err
+	}
+	if err := s.checkGroups(d); err != nil {
+		return err
+	}
+	var sealed interface{}
+	if d.BindPassword != "" {
+		password, err := s.box.Seal([]byte(d.BindPassword))
+		if err != nil {
+			return fmt.Errorf("failed to encrypt bind password: %w", err)
+		}
+		sealed = password
+	}
+	groups, _ := json.Marshal(d.GroupMapping)
+
+	err := s.db.QueryRow(`
+		INSERT INTO ldap_directories (tenant_id, url, start_tls, root_ca, bind_dn, bind_password_encrypted, base_dn,
+			user_filter, group_sync, group_base_dn, group_filter, group_name_attribute, group_mapping,
+			allow_local_passwords, is_active)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14, $15)
+		ON CONFLICT (tenant_id) DO UPDATE
+		SET url = EXCLUDED.url, start_tls = EXCLUDED.start_tls, root_ca = EXCLUDED.root_ca,
+			bind_dn = EXCLUDED.bind_dn,
+			bind_password_encrypted = CASE WHEN EXCLUDED.bind_dn <> ''
+				THEN COALESCE(EXCLUDED.bind_password_encrypted, ldap_directories.bind_password_encrypted) END,
+			base_dn = EXCLUDED.base_dn, user_filter = EXCLUDED.user_filter, group_sync = EXCLUDED.group_sync,
+			group_base_dn = EXCLUDED.group_base_dn, group_filter = EXCLUDED.group_filter,
+			group_name_attribute = EXCLUDED.group_name_attribute, group_mapping = EXCLUDED.group_mapping,
+			allow_local_passwords = EXCLUDED.allow_local_passwords, is_active = EXCLUDED.is_active,
+			updated_at = NOW()
+		RETURNING created_at, updated_at
+	`, d.TenantID, d.URL, d.StartTLS, d.RootCA, d.BindDN, sealed, d.BaseDN, d.UserFilter, d.GroupSync,
+		d.GroupBaseDN, d.GroupFilter, d.GroupNameAttribute, groups, d.AllowLocalPasswords,
+		d.IsActive).Scan(&d.CreatedAt, &d.UpdatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to save LDAP directory: %w", err)
+	}
+	return nil
+}
+
+// Delete removes the directory of tenantID; its users sign in with their
+// ForIAM passwords again.
+func (s *Store) Delete(tenantID string) error {
+	result, err := s.db.Exec(`DELETE FROM ldap_directories WHERE tenant_id = $1`, tenantID)
+	if err != nil {
+		return fmt.Errorf("failed to delete LDAP directory: %w", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// SyncGroups makes userID a member of exactly those groups in the group
+// mapping of d that account belongs to. Other groups are left alone, and
+// so are groups made dynamic since, whose members follow their rule. It
+// returns the IDs of the groups the user was added to and removed from.
+func (s *Store) SyncGroups(d *Directory, userID string, account *Account) (added, removed []string, err error) {
+	if len(d.GroupMapping) == 0 {
+		return nil, nil, nil
+	}
+	member := d.Groups(account)
+	var add, remove []string
+	seen := map[string]bool{}
+	for _, groupID := range d.GroupMapping {
+		if seen[groupID] {
+			continue
+		}
+		seen[groupID] = true
+		if member[groupID] {
+			add = append(add, groupID)
+		} else {
+			remove = append(remove, groupID)
+		}
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(`
+		INSERT INTO user_groups (user_id, group_id)
+		SELECT $1, id FROM groups WHERE tenant_id = $2 AND id = ANY($3) AND rule IS NULL
+		ON CONFLICT DO NOTHING
+		RETURNING group_id
+	`, userID, d.TenantID, pq.Array(add))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to add groups: %w", err)
+	}
+	if added, err = scanIDs(rows); err != nil {
+		return nil, nil, fmt.Errorf("failed to add groups: %w", err)
+	}
+
+	rows, err = tx.Query(`
+		DELETE FROM user_groups ug USING groups g
+		WHERE ug.user_id = $1 AND ug.group_id = ANY($2) AND g.id = ug.group_id AND g.rule IS NULL
+		RETURNING ug.group_id
+	`, userID, pq.Array(remove))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to remove groups: %w", err)
+	}
+	if removed, err = scanIDs(rows); err != nil {
+		return nil, nil, fmt.Errorf("failed to remove groups: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, nil, fmt.Errorf("failed to commit: %w", err)
+	}
+	return added, removed, nil
+}
+
+func scanIDs(rows *sql.Rows) ([]string, error) {
+	defer rows.Close()
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
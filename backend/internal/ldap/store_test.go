@@ -0,0 +1,135 @@
+package ldap
+
+import (
+	"bytes"
+	"database/sql/driver"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/ForIAM/ForIAM/backend/internal/dbtest"
+)
+
+const (
+	staffGroup  = "6f1c1a4e-3b55-4f5e-9f7c-0d8e2a9b1c02"
+	adminsGroup = "6f1c1a4e-3b55-4f5e-9f7c-0d8e2a9b1c03"
+)
+
+// echoArray answers with one row per element of the array argument i.
+func echoArray(i int) func(args []driver.Value) [][]driver.Value {
+	return func(args []driver.Value) [][]driver.Value {
+		var rows [][]driver.Value
+		for _, id := range dbtest.Array(args[i]) {
+			rows = append(rows, []driver.Value{id})
+		}
+		return rows
+	}
+}
+
+func TestSyncGroups(t *testing.T) {
+	db, script := dbtest.Open(t)
+	var toAdd, toRemove []string
+	script.OnArgs("INSERT INTO user_groups", nil, func(args []driver.Value) [][]driver.Value {
+		toAdd = dbtest.Array(args[2])
+		return echoArray(2)(args)
+	})
+	script.OnArgs("DELETE FROM user_groups", nil, func(args []driver.Value) [][]driver.Value {
+		toRemove = dbtest.Array(args[1])
+		return echoArray(1)(args)
+	})
+
+	d := &Directory{TenantID: "tenant-1", GroupMapping: map[string]string{
+		"staff":     staffGroup,
+		"employees": staffGroup,
+		"admins":    adminsGroup,
+	}}
+	added, removed, err := NewStore(db, "key").SyncGroups(d, "user-1", &Account{Groups: []string{"staff", "printers"}})
+	if err != nil {
+		t.Fatalf("SyncGroups returned error: %v", err)
+	}
+	if !reflect.DeepEqual(toAdd, []string{staffGroup}) || !reflect.DeepEqual(toRemove, []string{adminsGroup}) {
+		t.Errorf("Expected to add only the mapped group of the account and remove the other, got %v and %v", toAdd, toRemove)
+	}
+	if !reflect.DeepEqual(added, []string{staffGroup}) || !reflect.DeepEqual(removed, []string{adminsGroup}) {
+		t.Errorf("Expected the changed memberships back, got %v and %v", added, removed)
+	}
+}
+
+func TestSyncGroupsWithoutMapping(t *testing.T) {
+	db, script := dbtest.Open(t)
+
+	added, removed, err := NewStore(db, "key").SyncGroups(&Directory{TenantID: "tenant-1"}, "user-1", &Account{Groups: []string{"staff"}})
+	if err != nil || added != nil || removed != nil {
+		t.Errorf("Expected nothing to change, got %v, %v, %v", added, removed, err)
+	}
+	if script.Ran("user_groups") {
+		t.Error("Expected memberships to be left alone without a group mapping")
+	}
+}
+
+func TestSaveChecksMappedGroups(t *testing.T) {
+	tests := []struct {
+		name  string
+		found int64
+		valid bool
+	}{
+		{"static groups of the tenant", 2, true},
+		{"dynamic or foreign group", 1, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, script := dbtest.Open(t)
+			script.On("SELECT COUNT(*) FROM groups WHERE tenant_id = $1 AND id = ANY($2) AND rule IS NULL", nil, []driver.Value{tt.found})
+			script.On("INSERT INTO ldap_directories", nil, []driver.Value{time.Now(), time.Now()})
+
+			d := &Directory{TenantID: "tenant-1", URL: "ldaps://ldap.corp.example", BaseDN: "dc=corp,dc=example",
+				GroupMapping: map[string]string{"staff": staffGroup, "admins": adminsGroup}}
+			err := NewStore(db, "key").Save(d)
+			if tt.valid && err != nil {
+				t.Errorf("Expected the directory to be saved, got %v", err)
+			}
+			if !tt.valid && !errors.Is(err, ErrInvalidDirectory) {
+				t.Errorf("Expected ErrInvalidDirectory, got %v", err)
+			}
+			if saved := script.Ran("INSERT INTO ldap_directories"); saved != tt.valid {
+				t.Errorf("Expected saved=%v", tt.valid)
+			}
+		})
+	}
+}
+
+func TestBindPasswordStoredSealed(t *testing.T) {
+	db, script := dbtest.Open(t)
+	var sealed []byte
+	script.OnArgs("INSERT INTO ldap_directories", nil, func(args []driver.Value) [][]driver.Value {
+		sealed, _ = args[5].([]byte)
+		return [][]driver.Value{{time.Now(), time.Now()}}
+	})
+
+	store := NewStore(db, "key")
+	d := &Directory{TenantID: "tenant-1", URL: "ldaps://ldap.corp.example", BaseDN: "dc=corp,dc=example",
+		BindDN: "cn=foriam,dc=corp,dc=example", BindPassword: "bind-secret"}
+	if err := store.Save(d); err != nil {
+		t.Fatalf("Save returned error: %v", err)
+	}
+	if sealed == nil || bytes.Contains(sealed, []byte("bind-secret")) {
+		t.Fatalf("Expected the bind password to be stored sealed, got %q", sealed)
+	}
+
+	row := []driver.Value{"tenant-1", d.URL, false, "", d.BindDN, sealed, d.BaseDN, DefaultUserFilter,
+		false, d.BaseDN, DefaultGroupFilter, DefaultGroupNameAttribute, []byte(`{}`), false, true, time.Now(), time.Now()}
+	script.On("FROM ldap_directories WHERE tenant_id = $1", nil, row)
+
+	loaded, err := store.Get("tenant-1")
+	if err != nil {
+		t.Fatalf("Get returned error: %v", err)
+	}
+	if loaded.BindPassword != "bind-secret" {
+		t.Errorf("Expected the bind password back, got %q", loaded.BindPassword)
+	}
+	if _, err := NewStore(db, "other key").Get("tenant-1"); err == nil {
+		t.Error("Expected another encryption key not to open the bind password")
+	}
+}
@@ -0,0 +1,95 @@
+// Package lockout throttles password and passkey logins. Every attempt is recorded in
+// login_attempts; recent failures for an account or source IP first delay
+// the next attempt and then lock it out for a while.
+package lockout
+
+import (
+	"time"
+)
+
+// Reasons recorded for failed attempts.
+const (
+	ReasonUnknownUser     = "unknown_user"
+	ReasonAccountDisabled = "account_disabled"
+	ReasonInvalidPassword = "invalid_password"
+	ReasonInvalidMFACode  = "invalid_mfa_code"
+	ReasonInvalidPasskey  = "invalid_passkey"
+	ReasonAccountLocked   = "account_locked"
+	ReasonIPLocked        = "ip_locked"
+	ReasonThrottled       = "throttled"
+)
+
+// Policy controls how failures turn into delays and lockouts.
+type Policy struct {
+	// Failures within Window before the account is locked
+	MaxFailures int
+	// Failures from one IP within Window before the IP is locked
+	MaxFailuresPerIP int
+	Window           time.Duration
+	LockoutDuration  time.Duration
+	// Delay after the first failure; it doubles with every further failure
+	// up to MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+}
+
+// Delay returns how long to wait after the given number of consecutive
+// failures before another attempt is allowed.
+func (p Policy) Delay(failures int) time.Duration {
+	if failures <= 0 || p.BaseDelay <= 0 {
+		return 0
+	}
+
+	delay := p.BaseDelay
+	for i := 1; i < failures; i++ {
+		delay *= 2
+		if p.MaxDelay > 0 && delay >= p.MaxDelay {
+			return p.MaxDelay
+		}
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		return p.MaxDelay
+	}
+	return delay
+}
+
+// Status describes whether a login may be attempted right now.
+type Status struct {
+	Failures   int
+	Locked     bool
+	RetryAfter time.Duration
+	// Reason is ReasonAccountLocked, ReasonIPLocked or ReasonThrottled when
+	// the attempt is refused
+	Reason string
+}
+
+// Allowed reports whether an attempt may go ahead.
+func (s Status) Allowed() bool {
+	return s.RetryAfter <= 0
+}
+
+// evaluate turns the failures counted for an account or IP, and the time since
+// the most recent one, into a Status.
+func (p Policy) evaluate(failures, limit int, sinceLast time.Duration, lockedReason string) Status {
+	status := Status{Failures: failures}
+	if failures == 0 {
+		return status
+	}
+
+	if limit > 0 && failures >= limit {
+		// Once the lockout has run out one more attempt is allowed; failing
+		// it locks again straight away
+		if remaining := p.LockoutDuration - sinceLast; remaining > 0 {
+			status.Locked = true
+			status.RetryAfter = remaining
+			status.Reason = lockedReason
+		}
+		return status
+	}
+
+	if remaining := p.Delay(failures) - sinceLast; remaining > 0 {
+		status.RetryAfter = remaining
+		status.Reason = ReasonThrottled
+	}
+	return status
+}
@@ -0,0 +1,65 @@
+package lockout
+
+import (
+	"testing"
+	"time"
+)
+
+var testPolicy = Policy{
+	MaxFailures:      5,
+	MaxFailuresPerIP: 20,
+	Window:           15 * time.Minute,
+	LockoutDuration:  15 * time.Minute,
+	BaseDelay:        time.Second,
+	MaxDelay:         10 * time.Second,
+}
+
+func TestDelay(t *testing.T) {
+	tests := []struct {
+		failures int
+		want     time.Duration
+	}{
+		{0, 0},
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{4, 8 * time.Second},
+		{5, 10 * time.Second},
+		{50, 10 * time.Second},
+	}
+
+	for _, tt := range tests {
+		if got := testPolicy.Delay(tt.failures); got != tt.want {
+			t.Errorf("Delay(%d) = %s, want %s", tt.failures, got, tt.want)
+		}
+	}
+}
+
+func TestEvaluate(t *testing.T) {
+	// No failures, nothing to wait for
+	if s := testPolicy.evaluate(0, 5, 0, ReasonAccountLocked); !s.Allowed() {
+		t.Errorf("Expected attempt to be allowed, got %+v", s)
+	}
+
+	// Third failure a second ago: wait out the rest of the 4s delay
+	s := testPolicy.evaluate(3, 5, time.Second, ReasonAccountLocked)
+	if s.Allowed() || s.Locked || s.Reason != ReasonThrottled || s.RetryAfter != 3*time.Second {
+		t.Errorf("Expected throttling for 3s, got %+v", s)
+	}
+
+	// Delay already over
+	if s := testPolicy.evaluate(3, 5, 5*time.Second, ReasonAccountLocked); !s.Allowed() {
+		t.Errorf("Expected attempt to be allowed after the delay, got %+v", s)
+	}
+
+	// Limit reached: locked for the lockout duration
+	s = testPolicy.evaluate(5, 5, time.Minute, ReasonIPLocked)
+	if !s.Locked || s.Reason != ReasonIPLocked || s.RetryAfter != 14*time.Minute {
+		t.Errorf("Expected a 14m lockout, got %+v", s)
+	}
+
+	// Lockout over: one more attempt is allowed
+	if s := testPolicy.evaluate(5, 5, 16*time.Minute, ReasonAccountLocked); !s.Allowed() || s.Locked {
+		t.Errorf("Expected attempt to be allowed after the lockout, got %+v", s)
+	}
+}
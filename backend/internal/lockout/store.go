@@ -0,0 +1,142 @@
+package lockout
+
+import (
+	"database/sql"
+	"time"
+)
+
+// Attempt is a recorded login attempt.
+type Attempt struct {
+	ID        string    `json:"id"`
+	Email     string    `json:"email"`
+	IPAddress string    `json:"ip_address"`
+	Success   bool      `json:"success"`
+	Reason    *string   `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// Store keeps login attempts in the login_attempts table.
+type Store struct {
+	db     *sql.DB
+	policy Policy
+}
+
+func NewStore(db *sql.DB, policy Policy) *Store {
+	return &Store{db: db, policy: policy}
+}
+
+// Check returns whether a login for email from ip may be attempted now. The
+// stricter of the account and the IP status wins. email is empty when the
+// login does not name an account yet; then only the IP counts.
+func (s *Store) Check(email, ip string) (Status, error) {
+	var account Status
+	if email != "" {
+		var err error
+		account, err = s.status(`email = lower($1)`, email, s.policy.MaxFailures, ReasonAccountLocked)
+		if err != nil {
+			return Status{}, err
+		}
+	}
+	source, err := s.status(`ip_address = $1`, ip, s.policy.MaxFailuresPerIP, ReasonIPLocked)
+	if err != nil {
+		return Status{}, err
+	}
+
+	if source.RetryAfter > account.RetryAfter {
+		return source, nil
+	}
+	return account, nil
+}
+
+// AccountStatus returns the lockout status of an account regardless of IP.
+func (s *Store) AccountStatus(email string) (Status, error) {
+	return s.status(`email = lower($1)`, email, s.policy.MaxFailures, ReasonAccountLocked)
+}
+
+func (s *Store) status(match, value string, limit int, lockedReason string) (Status, error) {
+	var failures int
+	var sinceLast sql.NullFloat64
+	err := s.db.QueryRow(`
+		SELECT COUNT(*), EXTRACT(EPOCH FROM (CURRENT_TIMESTAMP - MAX(created_at)))
+		FROM login_attempts
+		WHERE `+match+` AND success = false AND cleared_at IS NULL
+		  AND created_at > CURRENT_TIMESTAMP - make_interval(secs => $2)
+	`, value, s.policy.Window.Seconds()).Scan(&failures, &sinceLast)
+	if err != nil {
+		return Status{}, err
+	}
+
+	since := time.Duration(sinceLast.Float64 * float64(time.Second))
+	return s.policy.evaluate(failures, limit, since, lockedReason), nil
+}
+
+// RecordFailure stores a failed attempt. tenantID and userID may be empty
+// when the email did not match a user.
+func (s *Store) RecordFailure(tenantID, userID, email, ip, reason string) error {
+	_, err := s.db.Exec(`
+		INSERT INTO login_attempts (tenant_id, user_id, email, ip_address, success, reason)
+		VALUES (NULLIF($1, '')::uuid, NULLIF($2, '')::uuid, lower($3), $4, false, $5)
+	`, tenantID, userID, email, ip, reason)
+	return err
+}
+
+// RecordSuccess stores a successful login and clears the account's
+// outstanding failures. Failures from the IP are kept, so one valid account
+// cannot be used to reset the per-IP limit.
+func (s *Store) RecordSuccess(tenantID, userID, email, ip string) error {
+	if _, err := s.db.Exec(`
+		INSERT INTO login_attempts (tenant_id, user_id, email, ip_address, success)
+		VALUES ($1, $2, lower($3), $4, true)
+	`, tenantID, userID, email, ip); err != nil {
+		return err
+	}
+	return s.Unlock(email)
+}
+
+// Unlock clears the outstanding failures of an account.
+func (s *Store) Unlock(email string) error {
+	_, err := s.db.Exec(`
+		UPDATE login_attempts SET cleared_at = CURRENT_TIMESTAMP
+		WHERE email = lower($1) AND success = false AND cleared_at IS NULL
+	`, email)
+	return err
+}
+
+// UnlockIP clears the outstanding failures from ip that belong to tenantID or
+// to no tenant at all, and returns how many were cleared.
+func (s *Store) UnlockIP(tenantID, ip string) (int64, error) {
+	result, err := s.db.Exec(`
+		UPDATE login_attempts SET cleared_at = CURRENT_TIMESTAMP
+		WHERE ip_address = $1 AND success = false AND cleared_at IS NULL
+		  AND (tenant_id = $2 OR tenant_id IS NULL)
+	`, ip, tenantID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// Recent returns the latest attempts for an account, newest first.
+func (s *Store) Recent(email string, limit int) ([]Attempt, error) {
+	rows, err := s.db.Query(`
+		SELECT id, email, ip_address, success, reason, created_at
+		FROM login_attempts
+		WHERE email = lower($1)
+		ORDER BY created_at DESC
+		LIMIT $2
+	`, email, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	attempts := []Attempt{}
+	for rows.Next() {
+		var a Attempt
+		if err := rows.Scan(&a.ID, &a.Email, &a.IPAddress, &a.Success, &a.Reason, &a.CreatedAt); err != nil {
+			return nil, err
+		}
+		attempts = append(attempts, a)
+	}
+	return attempts, rows.Err()
+}
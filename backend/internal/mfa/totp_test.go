@@ -0,0 +1,118 @@
+package mfa
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+)
+
+// RFC 6238 appendix B test vectors for SHA1, truncated to 6 digits.
+func TestCode_RFC6238(t *testing.T) {
+	secret := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString([]byte("12345678901234567890"))
+
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+	}
+
+	for _, tt := range tests {
+		code, err := Code(secret, Step(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatalf("Code returned error: %v", err)
+		}
+		if code != tt.code {
+			t.Errorf("At %d expected code %s, got %s", tt.unix, tt.code, code)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret, err := GenerateSecret()
+	if err != nil {
+		t.Fatalf("GenerateSecret returned error: %v", err)
+	}
+
+	now := time.Now()
+	code, _ := Code(secret, Step(now))
+
+	step, ok := Validate(secret, code, now)
+	if !ok || step != Step(now) {
+		t.Error("Expected current code to validate")
+	}
+
+	// One period of drift is tolerated, two are not
+	if _, ok := Validate(secret, code, now.Add(Period)); !ok {
+		t.Error("Expected code from previous period to validate")
+	}
+	if _, ok := Validate(secret, code, now.Add(3*Period)); ok {
+		t.Error("Expected stale code to be rejected")
+	}
+
+	if _, ok := Validate(secret, "12345", now); ok {
+		t.Error("Expected short code to be rejected")
+	}
+}
+
+func TestProvisioningURI(t *testing.T) {
+	uri := ProvisioningURI("ForIAM", "alice@example.com", "JBSWY3DPEHPK3PXP")
+
+	if !strings.HasPrefix(uri, "otpauth://totp/ForIAM:alice@example.com?") {
+		t.Errorf("Unexpected URI prefix: %s", uri)
+	}
+	if !strings.Contains(uri, "secret=JBSWY3DPEHPK3PXP") || !strings.Contains(uri, "issuer=ForIAM") {
+		t.Errorf("Expected secret and issuer in URI: %s", uri)
+	}
+}
+
+func TestGenerateBackupCodes(t *testing.T) {
+	codes, err := GenerateBackupCodes(BackupCodeCount)
+	if err != nil {
+		t.Fatalf("GenerateBackupCodes returned error: %v", err)
+	}
+	if len(codes) != BackupCodeCount {
+		t.Fatalf("Expected %d codes, got %d", BackupCodeCount, len(codes))
+	}
+
+	seen := map[string]bool{}
+	for _, code := range codes {
+		if len(code) != 11 || code[5] != '-' {
+			t.Errorf("Unexpected code format: %s", code)
+		}
+		if seen[code] {
+			t.Errorf("Duplicate backup code: %s", code)
+		}
+		seen[code] = true
+	}
+
+	if NormalizeBackupCode(" abcde fghjk ") != "ABCDE-FGHJK" {
+		t.Errorf("Unexpected normalization: %s", NormalizeBackupCode(" abcde fghjk "))
+	}
+}
+
+func TestSecretBox(t *testing.T) {
+	box := NewSecretBox("server-secret")
+
+	sealed, err := box.Seal("JBSWY3DPEHPK3PXP")
+	if err != nil {
+		t.Fatalf("Seal returned error: %v", err)
+	}
+	if strings.Contains(string(sealed), "JBSWY3DPEHPK3PXP") {
+		t.Error("Expected the sealed secret not to contain the plaintext")
+	}
+	if secret, err := box.Open(sealed); err != nil || secret != "JBSWY3DPEHPK3PXP" {
+		t.Errorf("Expected the secret back, got %q, %v", secret, err)
+	}
+	if _, err := NewSecretBox("other-secret").Open(sealed); err == nil {
+		t.Error("Expected opening with another key to fail")
+	}
+	if _, err := box.Open(sealed[:4]); err == nil {
+		t.Error("Expected opening a truncated secret to fail")
+	}
+}
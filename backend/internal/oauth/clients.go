@@ -0,0 +1,306 @@
+package oauth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/ForIAM/ForIAM/backend/internal/token"
+	"github.com/lib/pq"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	ErrClientNotFound        = errors.New("oauth client not found")
+	ErrInvalidClientMetadata = errors.New("invalid client metadata")
+)
+
+// Client is an application registered with a tenant. Clients without a
+// secret are public (e.g. single page or native apps) and rely on PKCE alone.
+// ExchangeAudiences are the audiences the client may target with tokens it
+// obtains by token exchange. A client bound to a service account obtains
+// tokens for the management API acting as that account.
+type Client struct {
+	ID                string    `json:"id"`
+	TenantID          string    `json:"tenant_id"`
+	ClientID          string    `json:"client_id"`
+	Name              string    `json:"name"`
+	Public            bool      `json:"public"`
+	RedirectURIs      []string  `json:"redirect_uris"`
+	GrantTypes        []string  `json:"grant_types"`
+	Scopes            []string  `json:"scopes"`
+	ExchangeAudiences []string  `json:"exchange_audiences"`
+	ServiceAccountID  string    `json:"service_account_id,omitempty"`
+	CreatedAt         time.Time `json:"created_at"`
+	UpdatedAt         time.Time `json:"updated_at"`
+
+	secretHash string
+}
+
+// VerifySecret checks secret against the stored hash.
+func (c *Client) VerifySecret(secret string) bool {
+	if c.Public || c.secretHash == "" || secret == "" {
+		return false
+	}
+	return bcrypt.CompareHashAndPassword([]byte(c.secretHash), []byte(secret)) == nil
+}
+
+// AllowsRedirect reports whether uri is one of the registered redirect URIs.
+// URIs are compared as exact strings, as the OAuth 2.0 Security BCP requires.
+func (c *Client) AllowsRedirect(uri string) bool {
+	return contains(c.RedirectURIs, uri)
+}
+
+// AllowsGrant reports whether the client may use grant.
+func (c *Client) AllowsGrant(grant string) bool {
+	return contains(c.GrantTypes, grant)
+}
+
+// AllowsScopes reports whether every one of scopes is registered for the
+// client.
+func (c *Client) AllowsScopes(scopes []string) bool {
+	for _, scope := range scopes {
+		if !contains(c.Scopes, scope) {
+			return false
+		}
+	}
+	return true
+}
+
+// AllowsAudience reports whether the client may exchange a token for one
+// targeting audience.
+func (c *Client) AllowsAudience(audience string) bool {
+	return contains(c.ExchangeAudiences, audience)
+}
+
+// Validate checks the registration of a client before it is stored.
+func (c *Client) Validate() error {
+	invalid := func(format string, args ...interface{}) error {
+		return fmt.Errorf("%w: %s", ErrInvalidClientMetadata, fmt.Sprintf(format, args...))
+	}
+
+	if strings.TrimSpace(c.Name) == "" {
+		return invalid("name is required")
+	}
+	if len(c.GrantTypes) == 0 {
+		return invalid("at least one grant type is required")
+	}
+	for _, grant := range c.GrantTypes {
+		if !contains(SupportedGrants, grant) {
+			return invalid("unsupported grant type %q", grant)
+		}
+	}
+	if c.AllowsGrant(GrantClientCredentials) && c.Public {
+		return invalid("public clients cannot use the client_credentials grant")
+	}
+	if c.AllowsGrant(GrantTokenExchange) && c.Public {
+		return invalid("public clients cannot use the token exchange grant")
+	}
+	if c.ServiceAccountID != "" && (c.Public || len(c.GrantTypes) != 1 || !c.AllowsGrant(GrantClientCredentials)) {
+		return invalid("service account clients must be confidential and only use the client_credentials grant")
+	}
+	if c.AllowsGrant(GrantAuthorizationCode) && len(c.RedirectURIs) == 0 {
+		return invalid("the authorization_code grant needs a redirect URI")
+	}
+	for _, uri := range c.RedirectURIs {
+		u, err := url.Parse(uri)
+		if err != nil || !u.IsAbs() || u.Host == "" || u.Fragment != "" {
+			return invalid("redirect URI %q must be an absolute URL without a fragment", uri)
+		}
+	}
+	for _, scope := range c.Scopes {
+		if scope == "" || strings.ContainsAny(scope, " \t\r\n\"\\") {
+			return invalid("invalid scope %q", scope)
+		}
+	}
+	for _, audience := range c.ExchangeAudiences {
+		if audience == "" || strings.ContainsAny(audience, " \t\r\n") {
+			return invalid("invalid exchange audience %q", audience)
+		}
+	}
+	return nil
+}
+
+type ClientStore struct {
+	db *sql.DB
+}
+
+func NewClientStore(db *sql.DB) *ClientStore {
+	return &ClientStore{db: db}
+}
+
+const clientColumns = `id, tenant_id, client_id, name, client_secret_hash, redirect_uris, grant_types, scopes, exchange_audiences, service_account_id, created_at, updated_at`
+
+func scanClient(row interface{ Scan(...interface{}) error }) (*Client, error) {
+	var client Client
+	var secretHash, serviceAccountID sql.NullString
+	err := row.Scan(&client.ID, &client.TenantID, &client.ClientID, &client.Name, &secretHash,
+		pq.Array(&client.RedirectURIs), pq.Array(&client.GrantTypes), pq.Array(&client.Scopes),
+		pq.Array(&client.ExchangeAudiences), &serviceAccountID, &client.CreatedAt, &client.UpdatedAt)
+	if err != nil {
+		return nil, err
+	}
+	client.ServiceAccountID = serviceAccountID.String
+	client.secretHash = secretHash.String
+	client.Public = !secretHash.Valid
+	return &client, nil
+}
+
+// Get loads a client by its public client_id.
+func (s *ClientStore) Get(clientID string) (*Client, error) {
+	client, err := scanClient(s.db.QueryRow(`
+		SELECT `+clientColumns+` FROM oauth_clients WHERE client_id = $1
+	`, clientID))
+	if err == sql.ErrNoRows {
+		return nil, ErrClientNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load oauth client: %w", err)
+	}
+	return client, nil
+}
+
+// GetByID loads a client of tenantID by its row ID.
+func (s *ClientStore) GetByID(tenantID, id string) (*Client, error) {
+	client, err := scanClient(s.db.QueryRow(`
+		SELECT `+clientColumns+` FROM oauth_clients WHERE id = $1 AND tenant_id = $2
+	`, id, tenantID))
+	if err == sql.ErrNoRows {
+		return nil, ErrClientNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load oauth client: %w", err)
+	}
+	return client, nil
+}
+
+// List returns the clients of tenantID, newest first.
+func (s *ClientStore) List(tenantID string) ([]*Client, error) {
+	rows, err := s.db.Query(`
+		SELECT `+clientColumns+` FROM oauth_clients WHERE tenant_id = $1 ORDER BY created_at DESC
+	`, tenantID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list oauth clients: %w", err)
+	}
+	defer rows.Close()
+
+	clients := []*Client{}
+	for rows.Next() {
+		client, err := scanClient(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan oauth client: %w", err)
+		}
+		clients = append(clients, client)
+	}
+	return clients, rows.Err()
+}
+
+// Create registers client, generating its client_id and, for confidential
+// clients, the secret. The secret is returned once and only its hash kept.
+// The service account a client is bound to is fixed at creation.
+func (s *ClientStore) Create(client *Client) (string, error) {
+	if err := client.Validate(); err != nil {
+		return "", err
+	}
+
+	clientID, err := token.GenerateOpaque(16)
+	if err != nil {
+		return "", err
+	}
+	secret, secretHash, err := newSecret(client.Public)
+	if err != nil {
+		return "", err
+	}
+
+	created, err := scanClient(s.db.QueryRow(`
+		INSERT INTO oauth_clients (tenant_id, client_id, name, client_secret_hash, redirect_uris, grant_types, scopes, exchange_audiences, service_account_id)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, NULLIF($9, '')::uuid)
+		RETURNING `+clientColumns,
+		client.TenantID, clientID, client.Name, secretHash,
+		pq.Array(client.RedirectURIs), pq.Array(client.GrantTypes), pq.Array(client.Scopes),
+		pq.Array(client.ExchangeAudiences), client.ServiceAccountID))
+	if err != nil {
+		return "", fmt.Errorf("failed to create oauth client: %w", err)
+	}
+	*client = *created
+	return secret, nil
+}
+
+// Update saves the name, redirect URIs, grants, scopes and exchange audiences
+// of client. Whether a client is public cannot change.
+func (s *ClientStore) Update(client *Client) error {
+	if err := client.Validate(); err != nil {
+		return err
+	}
+
+	updated, err := scanClient(s.db.QueryRow(`
+		UPDATE oauth_clients
+		SET name = $1, redirect_uris = $2, grant_types = $3, scopes = $4, exchange_audiences = $5,
+		    updated_at = CURRENT_TIMESTAMP
+		WHERE id = $6 AND tenant_id = $7
+		RETURNING `+clientColumns,
+		client.Name, pq.Array(client.RedirectURIs), pq.Array(client.GrantTypes), pq.Array(client.Scopes),
+		pq.Array(client.ExchangeAudiences), client.ID, client.TenantID))
+	if err == sql.ErrNoRows {
+		return ErrClientNotFound
+	}
+	if err != nil {
+		return fmt.Errorf("failed to update oauth client: %w", err)
+	}
+	*client = *updated
+	return nil
+}
+
+// RotateSecret replaces the secret of a confidential client and returns the
+// new one. The old secret stops working immediately.
+func (s *ClientStore) RotateSecret(tenantID, id string) (string, error) {
+	secret, secretHash, err := newSecret(false)
+	if err != nil {
+		return "", err
+	}
+
+	result, err := s.db.Exec(`
+		UPDATE oauth_clients
+		SET client_secret_hash = $1, updated_at = CURRENT_TIMESTAMP
+		WHERE id = $2 AND tenant_id = $3 AND client_secret_hash IS NOT NULL
+	`, secretHash, id, tenantID)
+	if err != nil {
+		return "", fmt.Errorf("failed to rotate client secret: %w", err)
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return "", ErrClientNotFound
+	}
+	return secret, nil
+}
+
+// Delete removes a client of tenantID along with its pending codes.
+func (s *ClientStore) Delete(tenantID, id string) error {
+	result, err := s.db.Exec(`DELETE FROM oauth_clients WHERE id = $1 AND tenant_id = $2`, id, tenantID)
+	if err != nil {
+		return fmt.Errorf("failed to delete oauth client: %w", err)
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return ErrClientNotFound
+	}
+	return nil
+}
+
+// newSecret returns a random client secret and its bcrypt hash, or nothing
+// for public clients.
+func newSecret(public bool) (string, interface{}, error) {
+	if public {
+		return "", nil, nil
+	}
+	secret, err := token.GenerateOpaque(32)
+	if err != nil {
+		return "", nil, err
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to hash client secret: %w", err)
+	}
+	return secret, string(hash), nil
+}
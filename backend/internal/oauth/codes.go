@@ -0,0 +1,78 @@
+package oauth
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/ForIAM/ForIAM/backend/internal/token"
+	"github.com/lib/pq"
+)
+
+// CodeTTL bounds how long an authorization code can be redeemed.
+const CodeTTL = time.Minute
+
+var ErrCodeInvalid = errors.New("authorization code is invalid or expired")
+
+// AuthorizationCode is what a code stands for: a user's approval of one
+// authorization request.
+type AuthorizationCode struct {
+	TenantID      string
+	UserID        string
+	ClientID      string
+	RedirectURI   string
+	Scope         []string
+	Nonce         string
+	CodeChallenge string
+}
+
+type CodeStore struct {
+	db *sql.DB
+}
+
+func NewCodeStore(db *sql.DB) *CodeStore {
+	return &CodeStore{db: db}
+}
+
+// Issue stores code and returns the raw value handed to the client. Only its
+// hash is kept.
+func (s *CodeStore) Issue(code AuthorizationCode) (string, error) {
+	raw, err := token.GenerateOpaque(32)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = s.db.Exec(`
+		INSERT INTO oauth_authorization_codes (
+			code_hash, tenant_id, user_id, client_id, redirect_uri, scopes, nonce, code_challenge, expires_at
+		)
+		VALUES ($1, $2, $3, $4, $5, $6, NULLIF($7, ''), $8, $9)
+	`, token.HashToken(raw), code.TenantID, code.UserID, code.ClientID, code.RedirectURI,
+		pq.Array(code.Scope), code.Nonce, code.CodeChallenge, time.Now().Add(CodeTTL))
+	if err != nil {
+		return "", fmt.Errorf("failed to store authorization code: %w", err)
+	}
+	return raw, nil
+}
+
+// Redeem loads and deletes a code so it can only be exchanged once. Unknown,
+// expired and already redeemed codes return ErrCodeInvalid.
+func (s *CodeStore) Redeem(raw string) (*AuthorizationCode, error) {
+	var code AuthorizationCode
+	var nonce sql.NullString
+	err := s.db.QueryRow(`
+		DELETE FROM oauth_authorization_codes
+		WHERE code_hash = $1 AND expires_at > CURRENT_TIMESTAMP
+		RETURNING tenant_id, user_id, client_id, redirect_uri, scopes, nonce, code_challenge
+	`, token.HashToken(raw)).Scan(&code.TenantID, &code.UserID, &code.ClientID, &code.RedirectURI,
+		pq.Array(&code.Scope), &nonce, &code.CodeChallenge)
+	if err == sql.ErrNoRows {
+		return nil, ErrCodeInvalid
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to redeem authorization code: %w", err)
+	}
+	code.Nonce = nonce.String
+	return &code, nil
+}
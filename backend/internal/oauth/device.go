@@ -0,0 +1,252 @@
+package oauth
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/ForIAM/ForIAM/backend/internal/token"
+	"github.com/lib/pq"
+)
+
+// Device authorization grant (RFC 8628) settings.
+const (
+	DeviceCodeTTL = 10 * time.Minute
+	// PollInterval is the minimum wait between token requests; every
+	// slow_down answer adds SlowDownStep to it
+	PollInterval = 5 * time.Second
+	SlowDownStep = 5 * time.Second
+)
+
+// Outcomes of polling for a device code that are not a grant.
+var (
+	ErrAuthorizationPending = errors.New("authorization pending")
+	ErrSlowDown             = errors.New("polling too fast")
+	ErrDeviceCodeExpired    = errors.New("device code expired")
+	ErrDeviceAccessDenied   = errors.New("device authorization denied")
+	ErrDeviceCodeInvalid    = errors.New("device code is invalid")
+)
+
+// Statuses of a device authorization.
+const (
+	DeviceStatusPending  = "pending"
+	DeviceStatusApproved = "approved"
+	DeviceStatusDenied   = "denied"
+)
+
+// userCodeAlphabet has no vowels, so codes cannot spell words, and no
+// characters that are easily confused (RFC 8628 section 6.1).
+const userCodeAlphabet = "BCDFGHJKLMNPQRSTVWXZ"
+
+// DeviceAuthorization is a pending or decided device authorization request.
+type DeviceAuthorization struct {
+	TenantID  string
+	ClientID  string
+	UserCode  string
+	Scope     []string
+	Status    string
+	UserID    string
+	ExpiresAt time.Time
+}
+
+type DeviceStore struct {
+	db *sql.DB
+}
+
+func NewDeviceStore(db *sql.DB) *DeviceStore {
+	return &DeviceStore{db: db}
+}
+
+// NewUserCode returns a random code of eight letters, shown as XXXX-XXXX.
+func NewUserCode() (string, error) {
+	var b strings.Builder
+	max := big.NewInt(int64(len(userCodeAlphabet)))
+	for i := 0; i < 8; i++ {
+		if i == 4 {
+			b.WriteByte('-')
+		}
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", fmt.Errorf("failed to read random bytes: %w", err)
+		}
+		b.WriteByte(userCodeAlphabet[n.Int64()])
+	}
+	return b.String(), nil
+}
+
+// NormalizeUserCode accepts a user code typed in any case, with or without
+// the dash and spaces.
+func NormalizeUserCode(raw string) string {
+	var letters []byte
+	for _, c := range strings.ToUpper(raw) {
+		if strings.ContainsRune(userCodeAlphabet, c) {
+			letters = append(letters, byte(c))
+		}
+	}
+	if len(letters) != 8 {
+		return ""
+	}
+	return string(letters[:4]) + "-" + string(letters[4:])
+}
+
+// Create starts a device authorization and returns the device code, which
+// only the device gets, and the user code the user types in.
+func (s *DeviceStore) Create(tenantID, clientID string, scopes []string) (deviceCode, userCode string, err error) {
+	deviceCode, err = token.GenerateOpaque(32)
+	if err != nil {
+		return "", "", err
+	}
+
+	// User codes are short, so a collision with a live one is retried
+	for attempt := 0; attempt < 3; attempt++ {
+		userCode, err = NewUserCode()
+		if err != nil {
+			return "", "", err
+		}
+		_, err = s.db.Exec(`
+			INSERT INTO oauth_device_codes (device_code_hash, user_code, tenant_id, client_id, scopes, poll_interval, expires_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+		`, token.HashToken(deviceCode), userCode, tenantID, clientID, pq.Array(scopes),
+			int(PollInterval.Seconds()), time.Now().Add(DeviceCodeTTL))
+		if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+			continue
+		}
+		break
+	}
+	if err != nil {
+		return "", "", fmt.Errorf("failed to store device code: %w", err)
+	}
+	return deviceCode, userCode, nil
+}
+
+// FindByUserCode loads a pending, unexpired authorization for the user to
+// decide on.
+func (s *DeviceStore) FindByUserCode(userCode string) (*DeviceAuthorization, error) {
+	var auth DeviceAuthorization
+	err := s.db.QueryRow(`
+		SELECT tenant_id, client_id, user_code, scopes, status, expires_at
+		FROM oauth_device_codes
+		WHERE user_code = $1 AND status = $2 AND expires_at > CURRENT_TIMESTAMP
+	`, NormalizeUserCode(userCode), DeviceStatusPending).Scan(&auth.TenantID, &auth.ClientID, &auth.UserCode,
+		pq.Array(&auth.Scope), &auth.Status, &auth.ExpiresAt)
+	if err == sql.ErrNoRows {
+		return nil, ErrDeviceCodeInvalid
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load device code: %w", err)
+	}
+	return &auth, nil
+}
+
+// Decide records the decision of userID, a user of tenantID, on a pending
+// authorization.
+func (s *DeviceStore) Decide(tenantID, userID, userCode string, approve bool) error {
+	status := DeviceStatusDenied
+	if approve {
+		status = DeviceStatusApproved
+	}
+
+	result, err := s.db.Exec(`
+		UPDATE oauth_device_codes
+		SET status = $1, user_id = $2
+		WHERE user_code = $3 AND tenant_id = $4 AND status = $5 AND expires_at > CURRENT_TIMESTAMP
+	`, status, userID, NormalizeUserCode(userCode), tenantID, DeviceStatusPending)
+	if err != nil {
+		return fmt.Errorf("failed to update device code: %w", err)
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return ErrDeviceCodeInvalid
+	}
+	return nil
+}
+
+// Poll is a token request of clientID for deviceCode. It returns the
+// authorization once the user approved it, deleting it so it cannot be
+// redeemed twice, and otherwise one of the errors above.
+func (s *DeviceStore) Poll(deviceCode, clientID string) (*DeviceAuthorization, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var auth DeviceAuthorization
+	var id string
+	var userID sql.NullString
+	var interval int
+	var expired bool
+	var sinceLastPoll sql.NullFloat64
+	err = tx.QueryRow(`
+		SELECT id, tenant_id, client_id, user_code, scopes, status, user_id, poll_interval,
+		       expires_at <= CURRENT_TIMESTAMP,
+		       EXTRACT(EPOCH FROM (CURRENT_TIMESTAMP - last_polled_at))
+		FROM oauth_device_codes
+		WHERE device_code_hash = $1
+		FOR UPDATE
+	`, token.HashToken(deviceCode)).Scan(&id, &auth.TenantID, &auth.ClientID, &auth.UserCode, pq.Array(&auth.Scope),
+		&auth.Status, &userID, &interval, &expired, &sinceLastPoll)
+	if err == sql.ErrNoRows {
+		return nil, ErrDeviceCodeInvalid
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load device code: %w", err)
+	}
+	if auth.ClientID != clientID {
+		return nil, ErrDeviceCodeInvalid
+	}
+	auth.UserID = userID.String
+
+	var since *time.Duration
+	if sinceLastPoll.Valid {
+		d := time.Duration(sinceLastPoll.Float64 * float64(time.Second))
+		since = &d
+	}
+	outcome := pollOutcome(auth.Status, expired, since, time.Duration(interval)*time.Second)
+
+	switch outcome {
+	case ErrSlowDown:
+		_, err = tx.Exec(`
+			UPDATE oauth_device_codes
+			SET poll_interval = poll_interval + $1, last_polled_at = CURRENT_TIMESTAMP
+			WHERE id = $2
+		`, int(SlowDownStep.Seconds()), id)
+	case ErrAuthorizationPending:
+		_, err = tx.Exec(`UPDATE oauth_device_codes SET last_polled_at = CURRENT_TIMESTAMP WHERE id = $1`, id)
+	default:
+		// Approved, denied or expired: the device code is done with
+		_, err = tx.Exec(`DELETE FROM oauth_device_codes WHERE id = $1`, id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to update device code: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to update device code: %w", err)
+	}
+
+	if outcome != nil {
+		return nil, outcome
+	}
+	return &auth, nil
+}
+
+// pollOutcome decides a poll: nil grants the token. since is the time since
+// the previous poll, nil on the first one.
+func pollOutcome(status string, expired bool, since *time.Duration, interval time.Duration) error {
+	if expired {
+		return ErrDeviceCodeExpired
+	}
+	if since != nil && *since < interval {
+		return ErrSlowDown
+	}
+	switch status {
+	case DeviceStatusApproved:
+		return nil
+	case DeviceStatusDenied:
+		return ErrDeviceAccessDenied
+	}
+	return ErrAuthorizationPending
+}
@@ -0,0 +1,53 @@
+package oauth
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestUserCode(t *testing.T) {
+	code, err := NewUserCode()
+	if err != nil {
+		t.Fatalf("NewUserCode returned error: %v", err)
+	}
+	if len(code) != 9 || code[4] != '-' || strings.ContainsAny(code, "AEIOUY0123456789") {
+		t.Errorf("Unexpected user code %q", code)
+	}
+
+	if got := NormalizeUserCode("bcdf ghjk"); got != "BCDF-GHJK" {
+		t.Errorf("Expected BCDF-GHJK, got %q", got)
+	}
+	if got := NormalizeUserCode("BCDF-GHJ"); got != "" {
+		t.Errorf("Expected a short code to be rejected, got %q", got)
+	}
+}
+
+func TestPollOutcome(t *testing.T) {
+	second := func(n int) *time.Duration {
+		d := time.Duration(n) * time.Second
+		return &d
+	}
+
+	tests := []struct {
+		name    string
+		status  string
+		expired bool
+		since   *time.Duration
+		want    error
+	}{
+		{"first poll pending", DeviceStatusPending, false, nil, ErrAuthorizationPending},
+		{"polled too fast", DeviceStatusPending, false, second(2), ErrSlowDown},
+		{"polled at the interval", DeviceStatusPending, false, second(5), ErrAuthorizationPending},
+		{"approved", DeviceStatusApproved, false, second(6), nil},
+		{"approved but too fast", DeviceStatusApproved, false, second(1), ErrSlowDown},
+		{"denied", DeviceStatusDenied, false, nil, ErrDeviceAccessDenied},
+		{"expired", DeviceStatusApproved, true, nil, ErrDeviceCodeExpired},
+	}
+
+	for _, tt := range tests {
+		if got := pollOutcome(tt.status, tt.expired, tt.since, PollInterval); got != tt.want {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.want, got)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+package oauth
+
+// Token types of RFC 8693 section 3 accepted and issued by token exchange.
+const (
+	TokenTypeAccessToken = "urn:ietf:params:oauth:token-type:access_token"
+	TokenTypeJWT         = "urn:ietf:params:oauth:token-type:jwt"
+)
+
+// ExchangeScopes returns the scopes of a token client obtains by exchanging
+// a token with subjectScopes. An exchange can only narrow the scope: the
+// requested scopes must all be held by the subject token and registered for
+// the client. Without a request the subject's scopes registered for the
+// client are granted. ok is false when the request cannot be granted.
+func ExchangeScopes(client *Client, subjectScopes, requested []string) (scopes []string, ok bool) {
+	if len(requested) == 0 {
+		for _, scope := range subjectScopes {
+			if contains(client.Scopes, scope) {
+				scopes = append(scopes, scope)
+			}
+		}
+		return scopes, len(scopes) > 0
+	}
+
+	for _, scope := range requested {
+		if !contains(subjectScopes, scope) {
+			return nil, false
+		}
+	}
+	return requested, client.AllowsScopes(requested)
+}
+
+// ActorClaim builds the act claim (RFC 8693 section 4.1) naming the party
+// acting on behalf of the subject. prior is the act claim of the subject
+// token, if any; it is nested so the whole delegation chain is kept.
+func ActorClaim(subject, clientID string, prior interface{}) map[string]interface{} {
+	act := map[string]interface{}{"sub": subject}
+	if clientID != "" {
+		act["client_id"] = clientID
+	}
+	if prior != nil {
+		act["act"] = prior
+	}
+	return act
+}
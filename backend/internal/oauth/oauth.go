@@ -0,0 +1,73 @@
+// Package oauth holds the OAuth 2.0 and OpenID Connect building blocks of the
+// provider: registered clients, authorization codes, PKCE and scopes. The
+// HTTP endpoints live in the api handlers.
+package oauth
+
+import "strings"
+
+// Error codes of RFC 6749, sections 4.1.2.1 and 5.2.
+const (
+	ErrorInvalidRequest          = "invalid_request"
+	ErrorInvalidClient           = "invalid_client"
+	ErrorInvalidGrant            = "invalid_grant"
+	ErrorInvalidScope            = "invalid_scope"
+	ErrorUnauthorizedClient      = "unauthorized_client"
+	ErrorUnsupportedGrantType    = "unsupported_grant_type"
+	ErrorUnsupportedResponseType = "unsupported_response_type"
+	ErrorAccessDenied            = "access_denied"
+	ErrorServerError             = "server_error"
+
+	// RFC 8628 section 3.5
+	ErrorAuthorizationPending = "authorization_pending"
+	ErrorSlowDown             = "slow_down"
+	ErrorExpiredToken         = "expired_token"
+
+	// RFC 8693 section 2.2.2
+	ErrorInvalidTarget = "invalid_target"
+)
+
+// Grant types a client can be allowed to use.
+const (
+	GrantAuthorizationCode = "authorization_code"
+	GrantClientCredentials = "client_credentials"
+	GrantDeviceCode        = "urn:ietf:params:oauth:grant-type:device_code"
+	GrantTokenExchange     = "urn:ietf:params:oauth:grant-type:token-exchange"
+)
+
+// SupportedGrants lists the grant types the token endpoint implements.
+var SupportedGrants = []string{GrantAuthorizationCode, GrantClientCredentials, GrantDeviceCode, GrantTokenExchange}
+
+// OpenID Connect scopes. Clients may be registered with further scopes of
+// their own, which are passed on in the access token.
+const (
+	ScopeOpenID = "openid"
+	ScopeEmail  = "email"
+)
+
+// SupportedScopes are advertised in the discovery document.
+var SupportedScopes = []string{ScopeOpenID, ScopeEmail}
+
+// ParseScope splits a space separated scope parameter, dropping duplicates.
+func ParseScope(raw string) []string {
+	var scopes []string
+	for _, scope := range strings.Fields(raw) {
+		if !contains(scopes, scope) {
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes
+}
+
+// HasScope reports whether scope was granted.
+func HasScope(scopes []string, scope string) bool {
+	return contains(scopes, scope)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
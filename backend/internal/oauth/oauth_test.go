@@ -0,0 +1,151 @@
+package oauth
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestParseScope(t *testing.T) {
+	scopes := ParseScope("openid  email openid")
+	if len(scopes) != 2 || scopes[0] != ScopeOpenID || scopes[1] != ScopeEmail {
+		t.Errorf("Expected [openid email], got %v", scopes)
+	}
+	if scopes := ParseScope(" "); len(scopes) != 0 {
+		t.Errorf("Expected no scopes, got %v", scopes)
+	}
+}
+
+func TestVerifyCodeChallenge(t *testing.T) {
+	// Example from RFC 7636, appendix B
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	challenge := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+
+	if !VerifyCodeChallenge(challenge, verifier) {
+		t.Error("Expected the RFC 7636 example to verify")
+	}
+	if VerifyCodeChallenge(challenge, verifier[:42]+"x") {
+		t.Error("Expected a different verifier to be rejected")
+	}
+	if VerifyCodeChallenge(challenge, "short") {
+		t.Error("Expected a too short verifier to be rejected")
+	}
+	if ValidCodeVerifier(strings.Repeat("a", 129)) {
+		t.Error("Expected a too long verifier to be invalid")
+	}
+	if ValidCodeVerifier(strings.Repeat("a", 42) + "+") {
+		t.Error("Expected a verifier outside the unreserved characters to be invalid")
+	}
+}
+
+func TestClient(t *testing.T) {
+	hash, _ := bcrypt.GenerateFromPassword([]byte("s3cret"), bcrypt.MinCost)
+	confidential := &Client{
+		secretHash:   string(hash),
+		RedirectURIs: []string{"https://app.example.com/callback"},
+		GrantTypes:   []string{GrantAuthorizationCode},
+		Scopes:       []string{ScopeOpenID, ScopeEmail},
+	}
+
+	if !confidential.VerifySecret("s3cret") || confidential.VerifySecret("wrong") {
+		t.Error("Expected only the right secret to verify")
+	}
+	if !confidential.AllowsRedirect("https://app.example.com/callback") {
+		t.Error("Expected the registered redirect URI to be allowed")
+	}
+	if confidential.AllowsRedirect("https://app.example.com/callback/../evil") {
+		t.Error("Expected redirect URIs to be compared exactly")
+	}
+	if !confidential.AllowsGrant(GrantAuthorizationCode) || confidential.AllowsGrant(GrantClientCredentials) {
+		t.Error("Expected only the registered grant to be allowed")
+	}
+	if !confidential.AllowsScopes([]string{ScopeOpenID}) || confidential.AllowsScopes([]string{ScopeOpenID, "billing.read"}) {
+		t.Error("Expected only registered scopes to be allowed")
+	}
+
+	public := &Client{Public: true, secretHash: string(hash)}
+	if public.VerifySecret("s3cret") {
+		t.Error("Expected a public client to never verify a secret")
+	}
+}
+
+func TestClient_Validate(t *testing.T) {
+	valid := func() *Client {
+		return &Client{
+			Name:         "Billing",
+			RedirectURIs: []string{"https://billing.example.com/callback"},
+			GrantTypes:   []string{GrantAuthorizationCode, GrantClientCredentials},
+			Scopes:       []string{ScopeOpenID, "billing.read"},
+		}
+	}
+
+	if err := valid().Validate(); err != nil {
+		t.Fatalf("Expected client to be valid, got %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(*Client)
+	}{
+		{"no name", func(c *Client) { c.Name = " " }},
+		{"no grants", func(c *Client) { c.GrantTypes = nil }},
+		{"unknown grant", func(c *Client) { c.GrantTypes = []string{"password"} }},
+		{"public client credentials", func(c *Client) { c.Public = true }},
+		{"public token exchange", func(c *Client) { c.GrantTypes = []string{GrantTokenExchange}; c.Public = true }},
+		{"audience with space", func(c *Client) { c.ExchangeAudiences = []string{"orders api"} }},
+		{"code without redirect", func(c *Client) { c.RedirectURIs = nil }},
+		{"relative redirect", func(c *Client) { c.RedirectURIs = []string{"/callback"} }},
+		{"redirect with fragment", func(c *Client) { c.RedirectURIs = []string{"https://app.example.com/cb#x"} }},
+		{"scope with space", func(c *Client) { c.Scopes = []string{"billing read"} }},
+		{"service account with other grants", func(c *Client) { c.ServiceAccountID = "sa-1" }},
+	}
+
+	for _, tt := range tests {
+		client := valid()
+		tt.modify(client)
+		if err := client.Validate(); !errors.Is(err, ErrInvalidClientMetadata) {
+			t.Errorf("%s: expected ErrInvalidClientMetadata, got %v", tt.name, err)
+		}
+	}
+
+	serviceAccount := &Client{Name: "Deploy bot", ServiceAccountID: "sa-1", GrantTypes: []string{GrantClientCredentials}}
+	if err := serviceAccount.Validate(); err != nil {
+		t.Errorf("Expected service account client to be valid, got %v", err)
+	}
+}
+
+func TestExchangeScopes(t *testing.T) {
+	client := &Client{Scopes: []string{ScopeOpenID, "orders.read", "orders.write"}}
+	subject := []string{ScopeOpenID, ScopeEmail, "orders.read"}
+
+	if scopes, ok := ExchangeScopes(client, subject, nil); !ok || len(scopes) != 2 || scopes[1] != "orders.read" {
+		t.Errorf("Expected the subject's registered scopes, got %v, %v", scopes, ok)
+	}
+	if scopes, ok := ExchangeScopes(client, subject, []string{"orders.read"}); !ok || len(scopes) != 1 {
+		t.Errorf("Expected a narrowed scope to be granted, got %v, %v", scopes, ok)
+	}
+	if _, ok := ExchangeScopes(client, subject, []string{"orders.write"}); ok {
+		t.Error("Expected a scope the subject token lacks to be refused")
+	}
+	if _, ok := ExchangeScopes(client, subject, []string{ScopeEmail}); ok {
+		t.Error("Expected a scope not registered for the client to be refused")
+	}
+	if _, ok := ExchangeScopes(client, []string{ScopeEmail}, nil); ok {
+		t.Error("Expected an exchange without any common scope to be refused")
+	}
+}
+
+func TestActorClaim(t *testing.T) {
+	first := ActorClaim("svc-orders", "svc-orders", nil)
+	if first["sub"] != "svc-orders" || first["act"] != nil {
+		t.Errorf("Unexpected act claim %v", first)
+	}
+
+	second := ActorClaim("svc-billing", "svc-billing", first)
+	nested, ok := second["act"].(map[string]interface{})
+	if second["sub"] != "svc-billing" || !ok || nested["sub"] != "svc-orders" {
+		t.Errorf("Expected the previous actor to be nested, got %v", second)
+	}
+}
@@ -0,0 +1,122 @@
+package passkey
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+// Purposes a ceremony session can be stored for. A session is only ever
+// consumed by the ceremony step with the same purpose.
+const (
+	PurposeRegistration = "registration"
+	PurposeLogin        = "login"
+	PurposeMFA          = "mfa"
+)
+
+// ErrCloneWarning is returned when an assertion's signature counter did not
+// increase, which indicates the authenticator may have been cloned.
+var ErrCloneWarning = errors.New("authenticator sign count did not increase")
+
+// ErrUserNotVerified is returned when an assertion only proves possession
+// of the authenticator, without a PIN or biometric.
+var ErrUserNotVerified = errors.New("authenticator did not verify the user")
+
+// RelyingParty describes the WebAuthn relying party of a tenant.
+type RelyingParty struct {
+	ID          string
+	DisplayName string
+	Origins     []string
+}
+
+// New returns a WebAuthn instance for rp.
+func New(rp RelyingParty) (*webauthn.WebAuthn, error) {
+	w, err := webauthn.New(&webauthn.Config{
+		RPID:          rp.ID,
+		RPDisplayName: rp.DisplayName,
+		RPOrigins:     rp.Origins,
+		AuthenticatorSelection: protocol.AuthenticatorSelection{
+			ResidentKey:      protocol.ResidentKeyRequirementPreferred,
+			UserVerification: protocol.VerificationPreferred,
+		},
+		AttestationPreference: protocol.PreferNoAttestation,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("invalid relying party configuration: %w", err)
+	}
+	return w, nil
+}
+
+// User adapts a ForIAM user to webauthn.User. The user handle is the user's
+// UUID, which lets a discoverable login be mapped back to its users row.
+type User struct {
+	ID          string
+	Email       string
+	Credentials []webauthn.Credential
+}
+
+func (u *User) WebAuthnID() []byte {
+	return []byte(u.ID)
+}
+
+func (u *User) WebAuthnName() string {
+	return u.Email
+}
+
+func (u *User) WebAuthnDisplayName() string {
+	return u.Email
+}
+
+// WebAuthnIcon is deprecated in the specification; no icon is advertised.
+func (u *User) WebAuthnIcon() string {
+	return ""
+}
+
+func (u *User) WebAuthnCredentials() []webauthn.Credential {
+	return u.Credentials
+}
+
+// Exclusions lists the user's existing credentials so an authenticator is
+// not registered twice.
+func (u *User) Exclusions() []protocol.CredentialDescriptor {
+	descriptors := make([]protocol.CredentialDescriptor, 0, len(u.Credentials))
+	for _, cred := range u.Credentials {
+		descriptors = append(descriptors, cred.Descriptor())
+	}
+	return descriptors
+}
+
+// ParseAttestation parses the JSON serialized PublicKeyCredential returned by
+// navigator.credentials.create().
+func ParseAttestation(body []byte) (*protocol.ParsedCredentialCreationData, error) {
+	return protocol.ParseCredentialCreationResponseBody(bytes.NewReader(body))
+}
+
+// ParseAssertion parses the JSON serialized PublicKeyCredential returned by
+// navigator.credentials.get().
+func ParseAssertion(body []byte) (*protocol.ParsedCredentialAssertionData, error) {
+	return protocol.ParseCredentialRequestResponseBody(bytes.NewReader(body))
+}
+
+// CheckSignCount rejects a validated credential whose counter went backwards
+// or stood still. Authenticators that do not implement counters always
+// report zero and are accepted.
+func CheckSignCount(cred *webauthn.Credential) error {
+	if cred.Authenticator.CloneWarning {
+		return ErrCloneWarning
+	}
+	return nil
+}
+
+// CheckUserVerified rejects a validated credential whose authenticator did
+// not verify the user. Passwordless logins need it, as the passkey is the
+// only factor.
+func CheckUserVerified(cred *webauthn.Credential) error {
+	if !cred.Flags.UserVerified {
+		return ErrUserNotVerified
+	}
+	return nil
+}
@@ -0,0 +1,289 @@
+package passkey
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+const testOrigin = "http://localhost:3000"
+
+var testRP = RelyingParty{ID: "localhost", DisplayName: "ForIAM", Origins: []string{testOrigin}}
+
+// softAuthenticator is a minimal software FIDO2 authenticator producing
+// "none" attestations and ES256 assertions.
+type softAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	signCount    uint32
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	id := make([]byte, 16)
+	rand.Read(id)
+	return &softAuthenticator{key: key, credentialID: id}
+}
+
+func b64(b []byte) string {
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+func clientData(t *testing.T, ceremony, challenge string) []byte {
+	raw, err := json.Marshal(map[string]string{
+		"type":      ceremony,
+		"challenge": challenge,
+		"origin":    testOrigin,
+	})
+	if err != nil {
+		t.Fatalf("Failed to encode client data: %v", err)
+	}
+	return raw
+}
+
+func (a *softAuthenticator) authData(flags byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(testRP.ID))
+	data := append([]byte{}, rpIDHash[:]...)
+	data = append(data, flags)
+	return binary.BigEndian.AppendUint32(data, a.signCount)
+}
+
+func (a *softAuthenticator) register(t *testing.T, challenge string) []byte {
+	coseKey, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  1, // P-256
+		XCoord: a.key.X.FillBytes(make([]byte, 32)),
+		YCoord: a.key.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		t.Fatalf("Failed to encode COSE key: %v", err)
+	}
+
+	// Flags: user present, user verified, attested credential data included
+	authData := a.authData(0x45)
+	authData = append(authData, make([]byte, 16)...) // AAGUID
+	authData = binary.BigEndian.AppendUint16(authData, uint16(len(a.credentialID)))
+	authData = append(authData, a.credentialID...)
+	authData = append(authData, coseKey...)
+
+	attestation, err := webauthncbor.Marshal(map[string]interface{}{
+		"fmt":      "none",
+		"attStmt":  map[string]interface{}{},
+		"authData": authData,
+	})
+	if err != nil {
+		t.Fatalf("Failed to encode attestation object: %v", err)
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"id":    b64(a.credentialID),
+		"rawId": b64(a.credentialID),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    b64(clientData(t, "webauthn.create", challenge)),
+			"attestationObject": b64(attestation),
+		},
+	})
+	return body
+}
+
+func (a *softAuthenticator) assert(t *testing.T, challenge string, userHandle []byte) []byte {
+	return a.assertWithFlags(t, challenge, userHandle, 0x05)
+}
+
+// assertWithFlags signs an assertion with the given flags: 0x01 for user
+// presence only, 0x05 with user verification.
+func (a *softAuthenticator) assertWithFlags(t *testing.T, challenge string, userHandle []byte, flags byte) []byte {
+	a.signCount++
+	authData := a.authData(flags)
+	cdj := clientData(t, "webauthn.get", challenge)
+
+	cdjHash := sha256.Sum256(cdj)
+	digest := sha256.Sum256(append(append([]byte{}, authData...), cdjHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, a.key, digest[:])
+	if err != nil {
+		t.Fatalf("Failed to sign assertion: %v", err)
+	}
+
+	body, _ := json.Marshal(map[string]interface{}{
+		"id":    b64(a.credentialID),
+		"rawId": b64(a.credentialID),
+		"type":  "public-key",
+		"response": map[string]string{
+			"clientDataJSON":    b64(cdj),
+			"authenticatorData": b64(authData),
+			"signature":         b64(signature),
+			"userHandle":        b64(userHandle),
+		},
+	})
+	return body
+}
+
+func registerTestCredential(t *testing.T, w *webauthn.WebAuthn, user *User, auth *softAuthenticator) *webauthn.Credential {
+	_, session, err := w.BeginRegistration(user)
+	if err != nil {
+		t.Fatalf("BeginRegistration returned error: %v", err)
+	}
+
+	parsed, err := ParseAttestation(auth.register(t, session.Challenge))
+	if err != nil {
+		t.Fatalf("ParseAttestation returned error: %v", err)
+	}
+
+	cred, err := w.CreateCredential(user, *session, parsed)
+	if err != nil {
+		t.Fatalf("CreateCredential returned error: %v", err)
+	}
+	return cred
+}
+
+func TestRegistrationAndLogin(t *testing.T) {
+	w, err := New(testRP)
+	if err != nil {
+		t.Fatalf("New returned error: %v", err)
+	}
+
+	user := &User{ID: "6f1c1c8e-3a43-4a5e-9f0e-2d6c5b1b7a10", Email: "alice@example.com"}
+	auth := newSoftAuthenticator(t)
+
+	cred := registerTestCredential(t, w, user, auth)
+	if string(cred.ID) != string(auth.credentialID) {
+		t.Error("Expected stored credential ID to match the authenticator")
+	}
+	user.Credentials = append(user.Credentials, *cred)
+
+	// Second factor / username-first login
+	_, session, err := w.BeginLogin(user)
+	if err != nil {
+		t.Fatalf("BeginLogin returned error: %v", err)
+	}
+	parsed, err := ParseAssertion(auth.assert(t, session.Challenge, user.WebAuthnID()))
+	if err != nil {
+		t.Fatalf("ParseAssertion returned error: %v", err)
+	}
+	validated, err := w.ValidateLogin(user, *session, parsed)
+	if err != nil {
+		t.Fatalf("ValidateLogin returned error: %v", err)
+	}
+	if err := CheckSignCount(validated); err != nil {
+		t.Errorf("Expected increasing sign count to pass, got %v", err)
+	}
+	if validated.Authenticator.SignCount != 1 {
+		t.Errorf("Expected sign count 1, got %d", validated.Authenticator.SignCount)
+	}
+	user.Credentials[0] = *validated
+
+	// Passwordless login: the user is resolved from the user handle
+	_, session, err = w.BeginDiscoverableLogin()
+	if err != nil {
+		t.Fatalf("BeginDiscoverableLogin returned error: %v", err)
+	}
+	parsed, err = ParseAssertion(auth.assert(t, session.Challenge, user.WebAuthnID()))
+	if err != nil {
+		t.Fatalf("ParseAssertion returned error: %v", err)
+	}
+	validated, err = w.ValidateDiscoverableLogin(func(rawID, userHandle []byte) (webauthn.User, error) {
+		if string(userHandle) != user.ID {
+			t.Errorf("Unexpected user handle %q", userHandle)
+		}
+		return user, nil
+	}, *session, parsed)
+	if err != nil {
+		t.Fatalf("ValidateDiscoverableLogin returned error: %v", err)
+	}
+	if validated.Authenticator.SignCount != 2 {
+		t.Errorf("Expected sign count 2, got %d", validated.Authenticator.SignCount)
+	}
+}
+
+func TestSignCountRegression(t *testing.T) {
+	w, _ := New(testRP)
+	user := &User{ID: "0b8a2f0e-8c1e-4b7e-8f43-5c3f1f9c2d11", Email: "bob@example.com"}
+	auth := newSoftAuthenticator(t)
+
+	cred := registerTestCredential(t, w, user, auth)
+	cred.Authenticator.SignCount = 10
+	user.Credentials = []webauthn.Credential{*cred}
+
+	_, session, _ := w.BeginLogin(user)
+	parsed, err := ParseAssertion(auth.assert(t, session.Challenge, user.WebAuthnID()))
+	if err != nil {
+		t.Fatalf("ParseAssertion returned error: %v", err)
+	}
+	validated, err := w.ValidateLogin(user, *session, parsed)
+	if err != nil {
+		t.Fatalf("ValidateLogin returned error: %v", err)
+	}
+
+	if err := CheckSignCount(validated); err != ErrCloneWarning {
+		t.Errorf("Expected ErrCloneWarning for a lower sign count, got %v", err)
+	}
+}
+
+func TestUserVerification(t *testing.T) {
+	w, _ := New(testRP)
+	user := &User{ID: "8c2e4f1a-6d3b-4e5f-9a7c-1b2d3e4f5a66", Email: "dave@example.com"}
+	auth := newSoftAuthenticator(t)
+	user.Credentials = []webauthn.Credential{*registerTestCredential(t, w, user, auth)}
+
+	_, session, _ := w.BeginLogin(user)
+	parsed, err := ParseAssertion(auth.assertWithFlags(t, session.Challenge, user.WebAuthnID(), 0x01))
+	if err != nil {
+		t.Fatalf("ParseAssertion returned error: %v", err)
+	}
+	validated, err := w.ValidateLogin(user, *session, parsed)
+	if err != nil {
+		t.Fatalf("ValidateLogin returned error: %v", err)
+	}
+	if err := CheckUserVerified(validated); err != ErrUserNotVerified {
+		t.Errorf("Expected ErrUserNotVerified without the UV flag, got %v", err)
+	}
+
+	// Requiring verification makes the library refuse the assertion too
+	_, session, _ = w.BeginLogin(user, webauthn.WithUserVerification(protocol.VerificationRequired))
+	parsed, _ = ParseAssertion(auth.assertWithFlags(t, session.Challenge, user.WebAuthnID(), 0x01))
+	if _, err := w.ValidateLogin(user, *session, parsed); err == nil {
+		t.Error("Expected ValidateLogin to refuse an unverified user when verification is required")
+	}
+
+	_, session, _ = w.BeginLogin(user, webauthn.WithUserVerification(protocol.VerificationRequired))
+	parsed, _ = ParseAssertion(auth.assert(t, session.Challenge, user.WebAuthnID()))
+	validated, err = w.ValidateLogin(user, *session, parsed)
+	if err != nil {
+		t.Fatalf("ValidateLogin returned error: %v", err)
+	}
+	if err := CheckUserVerified(validated); err != nil {
+		t.Errorf("Expected a verified user to pass, got %v", err)
+	}
+}
+
+func TestRegistration_WrongOrigin(t *testing.T) {
+	w, _ := New(RelyingParty{ID: "localhost", DisplayName: "ForIAM", Origins: []string{"https://other.example"}})
+	user := &User{ID: "5d3c7a4e-5f0c-4c1b-a2b5-7e1c9f3b8a22", Email: "carol@example.com"}
+	auth := newSoftAuthenticator(t)
+
+	_, session, _ := w.BeginRegistration(user)
+	parsed, err := ParseAttestation(auth.register(t, session.Challenge))
+	if err != nil {
+		t.Fatalf("ParseAttestation returned error: %v", err)
+	}
+	if _, err := w.CreateCredential(user, *session, parsed); err == nil {
+		t.Error("Expected registration from an unlisted origin to fail")
+	}
+}
@@ -0,0 +1,187 @@
+package passkey
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/lib/pq"
+)
+
+// SessionTTL bounds how long a started ceremony can be finished.
+const SessionTTL = 5 * time.Minute
+
+// Credential is a stored passkey as exposed by the API.
+type Credential struct {
+	ID              string     `json:"id"`
+	Name            *string    `json:"name"`
+	AttestationType string     `json:"attestation_type"`
+	SignCount       int64      `json:"sign_count"`
+	BackupEligible  bool       `json:"backup_eligible"`
+	BackupState     bool       `json:"backup_state"`
+	LastUsedAt      *time.Time `json:"last_used_at"`
+	CreatedAt       time.Time  `json:"created_at"`
+}
+
+type Store struct {
+	db *sql.DB
+}
+
+func NewStore(db *sql.DB) *Store {
+	return &Store{db: db}
+}
+
+// Credentials loads the credentials of userID in the form the WebAuthn
+// library validates against.
+func (s *Store) Credentials(userID string) ([]webauthn.Credential, error) {
+	rows, err := s.db.Query(`
+		SELECT credential_id, public_key, attestation_type, aaguid, sign_count,
+		       transports, user_present, user_verified, backup_eligible, backup_state
+		FROM webauthn_credentials
+		WHERE user_id = $1
+	`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load credentials: %w", err)
+	}
+	defer rows.Close()
+
+	var creds []webauthn.Credential
+	for rows.Next() {
+		var cred webauthn.Credential
+		var signCount int64
+		var transports []string
+		if err := rows.Scan(
+			&cred.ID, &cred.PublicKey, &cred.AttestationType, &cred.Authenticator.AAGUID, &signCount,
+			pq.Array(&transports), &cred.Flags.UserPresent, &cred.Flags.UserVerified,
+			&cred.Flags.BackupEligible, &cred.Flags.BackupState,
+		); err != nil {
+			return nil, fmt.Errorf("failed to scan credential: %w", err)
+		}
+		cred.Authenticator.SignCount = uint32(signCount)
+		for _, t := range transports {
+			cred.Transport = append(cred.Transport, protocol.AuthenticatorTransport(t))
+		}
+		creds = append(creds, cred)
+	}
+	return creds, rows.Err()
+}
+
+// Create stores a newly registered credential and returns its row ID.
+func (s *Store) Create(tenantID, userID, name string, cred *webauthn.Credential) (string, error) {
+	transports := make([]string, 0, len(cred.Transport))
+	for _, t := range cred.Transport {
+		transports = append(transports, string(t))
+	}
+
+	var id string
+	err := s.db.QueryRow(`
+		INSERT INTO webauthn_credentials (
+			tenant_id, user_id, name, credential_id, public_key, attestation_type, aaguid,
+			sign_count, transports, user_present, user_verified, backup_eligible, backup_state
+		)
+		VALUES ($1, $2, NULLIF($3, ''), $4, $5, $6, $7, $8, $9, $10, $11, $12, $13)
+		RETURNING id
+	`, tenantID, userID, name, cred.ID, cred.PublicKey, cred.AttestationType, cred.Authenticator.AAGUID,
+		int64(cred.Authenticator.SignCount), pq.Array(transports), cred.Flags.UserPresent, cred.Flags.UserVerified,
+		cred.Flags.BackupEligible, cred.Flags.BackupState,
+	).Scan(&id)
+	if err != nil {
+		return "", fmt.Errorf("failed to store credential: %w", err)
+	}
+	return id, nil
+}
+
+// RecordUse saves the sign count and backup state reported by a successful
+// assertion.
+func (s *Store) RecordUse(cred *webauthn.Credential) error {
+	_, err := s.db.Exec(`
+		UPDATE webauthn_credentials
+		SET sign_count = $1, backup_state = $2, last_used_at = CURRENT_TIMESTAMP
+		WHERE credential_id = $3
+	`, int64(cred.Authenticator.SignCount), cred.Flags.BackupState, cred.ID)
+	if err != nil {
+		return fmt.Errorf("failed to update credential: %w", err)
+	}
+	return nil
+}
+
+// List returns the credentials of userID for display.
+func (s *Store) List(userID string) ([]Credential, error) {
+	rows, err := s.db.Query(`
+		SELECT id, name, attestation_type, sign_count, backup_eligible, backup_state, last_used_at, created_at
+		FROM webauthn_credentials
+		WHERE user_id = $1
+		ORDER BY created_at DESC
+	`, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list credentials: %w", err)
+	}
+	defer rows.Close()
+
+	creds := []Credential{}
+	for rows.Next() {
+		var cred Credential
+		if err := rows.Scan(&cred.ID, &cred.Name, &cred.AttestationType, &cred.SignCount,
+			&cred.BackupEligible, &cred.BackupState, &cred.LastUsedAt, &cred.CreatedAt); err != nil {
+			return nil, fmt.Errorf("failed to scan credential: %w", err)
+		}
+		creds = append(creds, cred)
+	}
+	return creds, rows.Err()
+}
+
+// Delete removes a credential of userID. It reports whether a row matched.
+func (s *Store) Delete(userID, id string) (bool, error) {
+	result, err := s.db.Exec(`
+		DELETE FROM webauthn_credentials WHERE id = $1 AND user_id = $2
+	`, id, userID)
+	if err != nil {
+		return false, fmt.Errorf("failed to delete credential: %w", err)
+	}
+	rowsAffected, _ := result.RowsAffected()
+	return rowsAffected > 0, nil
+}
+
+// SaveSession persists the state of a started ceremony. userID may be empty
+// for a discoverable login where the user is not known yet.
+func (s *Store) SaveSession(tenantID, userID, purpose string, data *webauthn.SessionData) (string, error) {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return "", fmt.Errorf("failed to encode session: %w", err)
+	}
+
+	var id string
+	err = s.db.QueryRow(`
+		INSERT INTO webauthn_sessions (tenant_id, user_id, purpose, data, expires_at)
+		VALUES ($1, NULLIF($2, '')::uuid, $3, $4, $5)
+		RETURNING id
+	`, tenantID, userID, purpose, raw, time.Now().Add(SessionTTL)).Scan(&id)
+	if err != nil {
+		return "", fmt.Errorf("failed to store session: %w", err)
+	}
+	return id, nil
+}
+
+// TakeSession loads and deletes a ceremony session so it cannot be used
+// twice. It returns sql.ErrNoRows for unknown, expired or mismatched sessions.
+func (s *Store) TakeSession(id, purpose string) (tenantID, userID string, data *webauthn.SessionData, err error) {
+	var raw []byte
+	var nullableUserID sql.NullString
+	err = s.db.QueryRow(`
+		DELETE FROM webauthn_sessions
+		WHERE id = $1 AND purpose = $2 AND expires_at > CURRENT_TIMESTAMP
+		RETURNING tenant_id, user_id, data
+	`, id, purpose).Scan(&tenantID, &nullableUserID, &raw)
+	if err != nil {
+		return "", "", nil, err
+	}
+
+	data = &webauthn.SessionData{}
+	if err := json.Unmarshal(raw, data); err != nil {
+		return "", "", nil, fmt.Errorf("failed to decode session: %w", err)
+	}
+	return tenantID, nullableUserID.String, data, nil
+}
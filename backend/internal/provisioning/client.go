@@ -0,0 +1,175 @@
+package provisioning
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const contentType = "application/scim+json"
+
+// Client talks to the SCIM endpoints of a connector.
+type Client struct {
+	endpoint string
+	token    string
+	http     *http.Client
+}
+
+// NewClient returns a client of endpoint, the base URL of the SCIM service,
+// that authenticates with token. httpClient may be nil.
+func NewClient(endpoint, token string, httpClient *http.Client) *Client {
+	if httpClient == nil {
+		httpClient = &http.Client{Timeout: 30 * time.Second}
+	}
+	return &Client{endpoint: strings.TrimRight(endpoint, "/"), token: token, http: httpClient}
+}
+
+// StatusError is an unexpected response of a SCIM service.
+type StatusError struct {
+	Method     string
+	Path       string
+	StatusCode int
+	Detail     string
+}
+
+func (e *StatusError) Error() string {
+	if e.Detail != "" {
+		return fmt.Sprintf("%s %s: %d %s", e.Method, e.Path, e.StatusCode, e.Detail)
+	}
+	return fmt.Sprintf("%s %s: %d", e.Method, e.Path, e.StatusCode)
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body interface{}, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(data)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.endpoint+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Accept", contentType)
+	if body != nil {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		var scimErr struct {
+			Detail string `json:"detail"`
+		}
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		json.Unmarshal(data, &scimErr)
+		return &StatusError{Method: method, Path: path, StatusCode: resp.StatusCode, Detail: scimErr.Detail}
+	}
+	if out != nil && resp.StatusCode != http.StatusNoContent {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+func isStatus(err error, status int) bool {
+	statusErr, ok := err.(*StatusError)
+	return ok && statusErr.StatusCode == status
+}
+
+// endpointPath returns the path of a resource type, /Users or /Groups.
+func endpointPath(resourceType string) string {
+	if resourceType == ResourceGroup {
+		return "/Groups"
+	}
+	return "/Users"
+}
+
+// Upsert creates or replaces a resource and returns its ID downstream.
+// remoteID is the ID known from an earlier call, if any; otherwise an
+// existing resource is looked up with filter, e.g. userName eq "alice", so
+// resources that already exist downstream are adopted rather than
+// duplicated.
+func (c *Client) Upsert(ctx context.Context, resourceType, remoteID, filter string, resource map[string]interface{}) (string, error) {
+	path := endpointPath(resourceType)
+
+	if remoteID == "" && filter != "" {
+		found, err := c.find(ctx, path, filter)
+		if err != nil {
+			return "", err
+		}
+		remoteID = found
+	}
+
+	var saved struct {
+		ID string `json:"id"`
+	}
+	if remoteID != "" {
+		err := c.do(ctx, http.MethodPut, path+"/"+url.PathEscape(remoteID), resource, &saved)
+		if err == nil {
+			if saved.ID == "" {
+				saved.ID = remoteID
+			}
+			return saved.ID, nil
+		}
+		// Deleted downstream; create it again
+		if !isStatus(err, http.StatusNotFound) {
+			return "", err
+		}
+	}
+
+	if err := c.do(ctx, http.MethodPost, path, resource, &saved); err != nil {
+		return "", err
+	}
+	if saved.ID == "" {
+		return "", fmt.Errorf("POST %s: response has no id", path)
+	}
+	return saved.ID, nil
+}
+
+func (c *Client) find(ctx context.Context, path, filter string) (string, error) {
+	var list struct {
+		Resources []struct {
+			ID string `json:"id"`
+		} `json:"Resources"`
+	}
+	query := url.Values{"filter": {filter}}
+	if err := c.do(ctx, http.MethodGet, path+"?"+query.Encode(), nil, &list); err != nil {
+		return "", err
+	}
+	if len(list.Resources) == 0 {
+		return "", nil
+	}
+	return list.Resources[0].ID, nil
+}
+
+// Delete removes a resource downstream. Resources already gone count as
+// deleted.
+func (c *Client) Delete(ctx context.Context, resourceType, remoteID string) error {
+	err := c.do(ctx, http.MethodDelete, endpointPath(resourceType)+"/"+url.PathEscape(remoteID), nil, nil)
+	if isStatus(err, http.StatusNotFound) {
+		return nil
+	}
+	return err
+}
+
+// quote renders value as a SCIM filter string.
+func quote(value string) string {
+	data, _ := json.Marshal(value)
+	return string(data)
+}
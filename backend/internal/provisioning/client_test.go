@@ -0,0 +1,129 @@
+package provisioning
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// scimStandIn is a minimal SCIM service keeping users in memory.
+type scimStandIn struct {
+	mu     sync.Mutex
+	token  string
+	nextID int
+	users  map[string]map[string]interface{}
+	calls  []string
+}
+
+func newSCIMStandIn(token string) (*scimStandIn, *httptest.Server) {
+	s := &scimStandIn{token: token, users: map[string]map[string]interface{}{}}
+	return s, httptest.NewServer(s)
+}
+
+func (s *scimStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls = append(s.calls, r.Method+" "+r.URL.Path)
+
+	if r.Header.Get("Authorization") != "Bearer "+s.token {
+		w.WriteHeader(http.StatusUnauthorized)
+		json.NewEncoder(w).Encode(map[string]string{"detail": "bad token"})
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+
+	id := strings.TrimPrefix(r.URL.Path, "/scim/v2/Users/")
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/scim/v2/Users":
+		resources := []map[string]interface{}{}
+		for _, u := range s.users {
+			if r.URL.Query().Get("filter") == fmt.Sprintf("userName eq %q", u["userName"]) {
+				resources = append(resources, u)
+			}
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"totalResults": len(resources), "Resources": resources})
+
+	case r.Method == http.MethodPost && r.URL.Path == "/scim/v2/Users":
+		var u map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&u)
+		s.nextID++
+		u["id"] = fmt.Sprintf("remote-%d", s.nextID)
+		s.users[u["id"].(string)] = u
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(u)
+
+	case r.Method == http.MethodPut && s.users[id] != nil:
+		var u map[string]interface{}
+		json.NewDecoder(r.Body).Decode(&u)
+		u["id"] = id
+		s.users[id] = u
+		json.NewEncoder(w).Encode(u)
+
+	case r.Method == http.MethodDelete && s.users[id] != nil:
+		delete(s.users, id)
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{"detail": "not found"})
+	}
+}
+
+func TestClientUpsertAndDelete(t *testing.T) {
+	standIn, server := newSCIMStandIn("secret")
+	defer server.Close()
+	client := NewClient(server.URL+"/scim/v2/", "secret", server.Client())
+	ctx := context.Background()
+
+	alice := map[string]interface{}{"userName": "alice@example.com", "active": true}
+	id, err := client.Upsert(ctx, ResourceUser, "", `userName eq "alice@example.com"`, alice)
+	if err != nil {
+		t.Fatalf("Upsert returned error: %v", err)
+	}
+
+	// A user already there is adopted rather than duplicated
+	adopted, err := client.Upsert(ctx, ResourceUser, "", `userName eq "alice@example.com"`, alice)
+	if err != nil || adopted != id {
+		t.Fatalf("Expected %s to be adopted, got %s (%v)", id, adopted, err)
+	}
+	if len(standIn.users) != 1 {
+		t.Fatalf("Expected one user, got %d", len(standIn.users))
+	}
+
+	// A user deleted downstream is created again
+	delete(standIn.users, id)
+	recreated, err := client.Upsert(ctx, ResourceUser, id, "", map[string]interface{}{"userName": "alice@example.com", "active": false})
+	if err != nil || recreated == id || standIn.users[recreated]["active"] != false {
+		t.Fatalf("Expected the user to be created again, got %s (%v)", recreated, err)
+	}
+
+	if err := client.Delete(ctx, ResourceUser, recreated); err != nil {
+		t.Fatalf("Delete returned error: %v", err)
+	}
+	if err := client.Delete(ctx, ResourceUser, recreated); err != nil {
+		t.Errorf("Expected deleting a deleted user to succeed, got %v", err)
+	}
+	if len(standIn.users) != 0 {
+		t.Errorf("Expected no users left, got %d", len(standIn.users))
+	}
+}
+
+func TestClientErrors(t *testing.T) {
+	_, server := newSCIMStandIn("secret")
+	defer server.Close()
+	client := NewClient(server.URL+"/scim/v2", "wrong", server.Client())
+
+	_, err := client.Upsert(context.Background(), ResourceUser, "", "", map[string]interface{}{"userName": "bob@example.com"})
+	statusErr, ok := err.(*StatusError)
+	if !ok || statusErr.StatusCode != http.StatusUnauthorized || statusErr.Detail != "bad token" {
+		t.Fatalf("Expected a 401 StatusError, got %v", err)
+	}
+	if !strings.Contains(err.Error(), "POST /Users: 401 bad token") {
+		t.Errorf("Unexpected error message %q", err.Error())
+	}
+}
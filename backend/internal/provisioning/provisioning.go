@@ -0,0 +1,193 @@
+// Package provisioning pushes users and groups of a tenant to downstream
+// applications that speak SCIM 2.0. Each tenant defines connectors; every
+// change to a user or group queues a job per active connector, which a
+// worker delivers with retries and exponential backoff.
+package provisioning
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Resource types of jobs.
+const (
+	ResourceUser  = "user"
+	ResourceGroup = "group"
+)
+
+// Job operations. An upsert of a resource that no longer exists deletes it
+// downstream.
+const (
+	OperationUpsert = "upsert"
+	OperationDelete = "delete"
+)
+
+// Job statuses.
+const (
+	StatusPending   = "pending"
+	StatusRunning   = "running"
+	StatusSucceeded = "succeeded"
+	StatusFailed    = "failed"
+)
+
+// MaxAttempts is how many times a job is tried before it fails for good.
+const MaxAttempts = 6
+
+var (
+	ErrNotFound          = errors.New("connector not found")
+	ErrJobNotFound       = errors.New("job not found")
+	ErrInvalidConnector  = errors.New("invalid connector")
+	ErrJobNotRetryable   = errors.New("only failed jobs can be retried")
+	errResourceNotExists = errors.New("resource does not exist")
+)
+
+// Connector is a downstream SCIM service of a tenant. Token is the bearer
+// token ForIAM authenticates with; it is write only and stored encrypted.
+type Connector struct {
+	ID               string            `json:"id"`
+	TenantID         string            `json:"tenant_id"`
+	Name             string            `json:"name"`
+	Endpoint         string            `json:"endpoint"`
+	Token            string            `json:"-"`
+	AttributeMapping map[string]string `json:"attribute_mapping"`
+	IsActive         bool              `json:"is_active"`
+	CreatedAt        time.Time         `json:"created_at"`
+}
+
+// Job delivers one user or group to one connector.
+type Job struct {
+	ID            string     `json:"id"`
+	ConnectorID   string     `json:"connector_id"`
+	ResourceType  string     `json:"resource_type"`
+	ResourceID    string     `json:"resource_id"`
+	Operation     string     `json:"operation"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	LastError     *string    `json:"last_error"`
+	NextAttemptAt time.Time  `json:"next_attempt_at"`
+	CreatedAt     time.Time  `json:"created_at"`
+	CompletedAt   *time.Time `json:"completed_at"`
+}
+
+// Source fields of a user that attributes can be mapped from.
+var sourceFields = map[string]bool{
+	"id":           true,
+	"email":        true,
+	"external_id":  true,
+	"display_name": true,
+	"given_name":   true,
+	"family_name":  true,
+	"is_active":    true,
+}
+
+// DefaultMapping maps SCIM user attributes to the fields of a user. Local
+// IDs become the externalId downstream.
+func DefaultMapping() map[string]string {
+	return map[string]string{
+		"userName":        "email",
+		"externalId":      "id",
+		"displayName":     "display_name",
+		"name.givenName":  "given_name",
+		"name.familyName": "family_name",
+		"emails":          "email",
+		"active":          "is_active",
+	}
+}
+
+// Validate checks the endpoint and attribute mapping of c, filling in the
+// default mapping when it has none.
+func (c *Connector) Validate() error {
+	if strings.TrimSpace(c.Name) == "" {
+		return fmt.Errorf("%w: name is required", ErrInvalidConnector)
+	}
+	endpoint, err := url.Parse(c.Endpoint)
+	if err != nil || (endpoint.Scheme != "https" && endpoint.Scheme != "http") || endpoint.Host == "" {
+		return fmt.Errorf("%w: endpoint must be an http or https URL", ErrInvalidConnector)
+	}
+	c.Endpoint = strings.TrimRight(c.Endpoint, "/")
+
+	if len(c.AttributeMapping) == 0 {
+		c.AttributeMapping = DefaultMapping()
+	}
+	if _, ok := c.AttributeMapping["userName"]; !ok {
+		return fmt.Errorf("%w: userName must be mapped", ErrInvalidConnector)
+	}
+	for attribute, field := range c.AttributeMapping {
+		switch attribute {
+		case "", "schemas", "id", "meta", "groups", "password":
+			return fmt.Errorf("%w: %q cannot be mapped", ErrInvalidConnector, attribute)
+		}
+		if strings.Count(attribute, ".") > 1 {
+			return fmt.Errorf("%w: %q is nested too deeply", ErrInvalidConnector, attribute)
+		}
+		if !sourceFields[field] {
+			return fmt.Errorf("%w: unknown field %q", ErrInvalidConnector, field)
+		}
+	}
+	return nil
+}
+
+// user is the local state of a user to provision.
+type user struct {
+	fields   map[string]string
+	isActive bool
+}
+
+// buildUser renders u as a SCIM User with mapping.
+func buildUser(u *user, mapping map[string]string) map[string]interface{} {
+	resource := map[string]interface{}{
+		"schemas": []string{"urn:ietf:params:scim:schemas:core:2.0:User"},
+	}
+	for attribute, field := range mapping {
+		var value interface{} = u.fields[field]
+		if field == "is_active" {
+			value = u.isActive
+		}
+		if attribute == "emails" || attribute == "emails.value" {
+			resource["emails"] = []map[string]interface{}{{"value": value, "type": "work", "primary": true}}
+			continue
+		}
+		if parent, child, nested := strings.Cut(attribute, "."); nested {
+			object, _ := resource[parent].(map[string]interface{})
+			if object == nil {
+				object = map[string]interface{}{}
+				resource[parent] = object
+			}
+			object[child] = value
+			continue
+		}
+		resource[attribute] = value
+	}
+	return resource
+}
+
+// buildGroup renders a SCIM Group whose members are the IDs of users
+// downstream.
+func buildGroup(groupID, name string, memberIDs []string) map[string]interface{} {
+	members := []map[string]string{}
+	for _, id := range memberIDs {
+		members = append(members, map[string]string{"value": id})
+	}
+	return map[string]interface{}{
+		"schemas":     []string{"urn:ietf:params:scim:schemas:core:2.0:Group"},
+		"externalId":  groupID,
+		"displayName": name,
+		"members":     members,
+	}
+}
+
+// Backoff returns how long to wait before the next attempt after attempts
+// failed ones: 30 seconds doubling up to an hour.
+func Backoff(attempts int) time.Duration {
+	delay := 30 * time.Second
+	for i := 1; i < attempts && delay < time.Hour; i++ {
+		delay *= 2
+	}
+	if delay > time.Hour {
+		delay = time.Hour
+	}
+	return delay
+}
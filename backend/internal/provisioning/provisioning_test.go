@@ -0,0 +1,78 @@
+package provisioning
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestConnectorValidate(t *testing.T) {
+	connector := &Connector{Name: "Slack", Endpoint: "https://api.slack.example/scim/v2/"}
+	if err := connector.Validate(); err != nil {
+		t.Fatalf("Validate returned error: %v", err)
+	}
+	if connector.Endpoint != "https://api.slack.example/scim/v2" {
+		t.Errorf("Expected the trailing slash to be trimmed, got %s", connector.Endpoint)
+	}
+	if !reflect.DeepEqual(connector.AttributeMapping, DefaultMapping()) {
+		t.Errorf("Expected the default mapping, got %v", connector.AttributeMapping)
+	}
+
+	tests := []struct {
+		name      string
+		connector Connector
+	}{
+		{"no name", Connector{Endpoint: "https://app.example/scim"}},
+		{"relative endpoint", Connector{Name: "App", Endpoint: "/scim"}},
+		{"other scheme", Connector{Name: "App", Endpoint: "ftp://app.example/scim"}},
+		{"userName unmapped", Connector{Name: "App", Endpoint: "https://app.example/scim", AttributeMapping: map[string]string{"displayName": "email"}}},
+		{"unknown field", Connector{Name: "App", Endpoint: "https://app.example/scim", AttributeMapping: map[string]string{"userName": "password_hash"}}},
+		{"reserved attribute", Connector{Name: "App", Endpoint: "https://app.example/scim", AttributeMapping: map[string]string{"userName": "email", "id": "id"}}},
+		{"deep attribute", Connector{Name: "App", Endpoint: "https://app.example/scim", AttributeMapping: map[string]string{"userName": "email", "a.b.c": "id"}}},
+	}
+	for _, tt := range tests {
+		if err := tt.connector.Validate(); !errors.Is(err, ErrInvalidConnector) {
+			t.Errorf("%s: expected ErrInvalidConnector, got %v", tt.name, err)
+		}
+	}
+}
+
+func TestBuildUser(t *testing.T) {
+	u := &user{
+		fields:   map[string]string{"id": "u-1", "email": "alice@example.com", "given_name": "Alice", "family_name": "Smith"},
+		isActive: false,
+	}
+	resource := buildUser(u, map[string]string{
+		"userName":        "email",
+		"externalId":      "id",
+		"name.givenName":  "given_name",
+		"name.familyName": "family_name",
+		"emails":          "email",
+		"active":          "is_active",
+	})
+
+	if resource["userName"] != "alice@example.com" || resource["externalId"] != "u-1" || resource["active"] != false {
+		t.Errorf("Unexpected attributes %v", resource)
+	}
+	name, _ := resource["name"].(map[string]interface{})
+	if name["givenName"] != "Alice" || name["familyName"] != "Smith" {
+		t.Errorf("Unexpected name %v", resource["name"])
+	}
+	emails, _ := resource["emails"].([]map[string]interface{})
+	if len(emails) != 1 || emails[0]["value"] != "alice@example.com" || emails[0]["primary"] != true {
+		t.Errorf("Unexpected emails %v", resource["emails"])
+	}
+}
+
+func TestBackoff(t *testing.T) {
+	want := []time.Duration{30 * time.Second, time.Minute, 2 * time.Minute, 4 * time.Minute}
+	for i, expected := range want {
+		if got := Backoff(i + 1); got != expected {
+			t.Errorf("Backoff(%d): expected %s, got %s", i+1, expected, got)
+		}
+	}
+	if got := Backoff(20); got != time.Hour {
+		t.Errorf("Expected the backoff to be capped at an hour, got %s", got)
+	}
+}
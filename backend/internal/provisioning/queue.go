@@ -0,0 +1,53 @@
+package provisioning
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Queue records provisioning jobs for the changes made through the API.
+type Queue struct {
+	db *sql.DB
+}
+
+func NewQueue(db *sql.DB) *Queue {
+	return &Queue{db: db}
+}
+
+// Enqueue queues a job for a user or group of tenantID on each of its
+// active connectors. A job still waiting for the same resource is reused, so
+// a burst of changes is delivered once.
+func (q *Queue) Enqueue(tenantID, resourceType, resourceID, operation string) error {
+	_, err := q.db.Exec(`
+		WITH reused AS (
+			UPDATE provisioning_jobs j
+			SET operation = $4, attempts = 0, last_error = NULL, next_attempt_at = NOW(), updated_at = NOW()
+			FROM provisioning_connectors c
+			WHERE j.connector_id = c.id AND c.tenant_id = $1 AND c.is_active
+				AND j.resource_type = $2 AND j.resource_id = $3 AND j.status = 'pending'
+			RETURNING j.connector_id
+		)
+		INSERT INTO provisioning_jobs (tenant_id, connector_id, resource_type, resource_id, operation)
+		SELECT $1, c.id, $2, $3, $4 FROM provisioning_connectors c
+		WHERE c.tenant_id = $1 AND c.is_active AND c.id NOT IN (SELECT connector_id FROM reused)
+	`, tenantID, resourceType, resourceID, operation)
+	if err != nil {
+		return fmt.Errorf("failed to queue provisioning job: %w", err)
+	}
+	return nil
+}
+
+// Sync queues every user and group of the connector's tenant, for a first
+// import or to repair drift. It returns the number of jobs queued.
+func (q *Queue) Sync(connector *Connector) (int64, error) {
+	result, err := q.db.Exec(`
+		INSERT INTO provisioning_jobs (tenant_id, connector_id, resource_type, resource_id, operation)
+		SELECT $1, $2, 'user', id, 'upsert' FROM users WHERE tenant_id = $1 AND principal_type = 'user'
+		UNION ALL
+		SELECT $1, $2, 'group', id, 'upsert' FROM groups WHERE tenant_id = $1
+	`, connector.TenantID, connector.ID)
+	if err != nil {
+		return 0, fmt.Errorf("failed to queue provisioning jobs: %w", err)
+	}
+	return result.RowsAffected()
+}
@@ -0,0 +1,366 @@
+package provisioning
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+
+	"github.com/ForIAM/ForIAM/backend/internal/sealing"
+	"github.com/lib/pq"
+)
+
+// Store keeps connectors, their jobs and the IDs resources have downstream.
+// Connector tokens are encrypted with a key derived from the server's
+// encryption key.
+type Store struct {
+	db  *sql.DB
+	box *sealing.Box
+}
+
+func NewStore(db *sql.DB, encryptionKey string) *Store {
+	return &Store{db: db, box: sealing.New(encryptionKey, sealing.PurposeConnectorToken)}
+}
+
+const connectorColumns = `id, tenant_id, name, endpoint, attribute_mapping, is_active, created_at`
+
+func scanConnector(row interface{ Scan(...interface{}) error }, extra ...interface{}) (*Connector, error) {
+	var (
+		connector Connector
+		mapping   []byte
+	)
+	dest := append([]interface{}{&connector.ID, &connector.TenantID, &connector.Name, &connector.Endpoint,
+		&mapping, &connector.IsActive, &connector.CreatedAt}, extra...)
+	if err := row.Scan(dest...); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(mapping, &connector.AttributeMapping); err != nil {
+		return nil, fmt.Errorf("invalid attribute mapping: %w", err)
+	}
+	return &connector, nil
+}
+
+// List returns the connectors of tenantID.
+func (s *Store) List(tenantID string) ([]*Connector, error) {
+	rows, err := s.db.Query(`
+		SELECT `+connectorColumns+` FROM provisioning_connectors
+		WHERE tenant_id = $1 ORDER BY created_at
+	`, tenantID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list connectors: %w", err)
+	}
+	defer rows.Close()
+
+	connectors := []*Connector{}
+	for rows.Next() {
+		connector, err := scanConnector(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan connector: %w", err)
+		}
+		connectors = append(connectors, connector)
+	}
+	return connectors, rows.Err()
+}
+
+// Get loads a connector of tenantID, without its token.
+func (s *Store) Get(tenantID, id string) (*Connector, error) {
+	connector, err := scanConnector(s.db.QueryRow(`
+		SELECT `+connectorColumns+` FROM provisioning_connectors
+		WHERE id = $1 AND tenant_id = $2
+	`, id, tenantID))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load connector: %w", err)
+	}
+	return connector, nil
+}
+
+// getWithToken loads any connector with its decrypted token.
+func (s *Store) getWithToken(id string) (*Connector, error) {
+	var sealed []byte
+	connector, err := scanConnector(s.db.QueryRow(`
+		SELECT `+connectorColumns+`, token_encrypted FROM provisioning_connectors WHERE id = $1
+	`, id), &sealed)
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load connector: %w", err)
+	}
+	token, err := s.box.Open(sealed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt connector token: %w", err)
+	}
+	connector.Token = string(token)
+	return connector, nil
+}
+
+// Create validates and adds connector.
+func (s *Store) Create(connector *Connector) error {
+	if err := connector.Validate(); err != nil {
+		return err
+	}
+	sealed, err := s.box.Seal([]byte(connector.Token))
+	if err != nil {
+		return fmt.Errorf("failed to encrypt connector token: %w", err)
+	}
+	mapping, _ := json.Marshal(connector.AttributeMapping)
+
+	err = s.db.QueryRow(`
+		INSERT INTO provisioning_connectors (tenant_id, name, endpoint, token_encrypted, attribute_mapping, is_active)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at
+	`, connector.TenantID, connector.Name, connector.Endpoint, sealed, mapping, connector.IsActive).Scan(&connector.ID, &connector.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to create connector: %w", err)
+	}
+	return nil
+}
+
+// Update validates and saves connector. Its token only changes when set.
+func (s *Store) Update(connector *Connector) error {
+	if err := connector.Validate(); err != nil {
+		return err
+	}
+	var sealed interface{}
+	if connector.Token != "" {
+		token, err := s.box.Seal([]byte(connector.Token))
+		if err != nil {
+			return fmt.Errorf("failed to encrypt connector token: %w", err)
+		}
+		sealed = token
+	}
+	mapping, _ := json.Marshal(connector.AttributeMapping)
+
+	result, err := s.db.Exec(`
+		UPDATE provisioning_connectors
+		SET name = $1, endpoint = $2, token_encrypted = COALESCE($3, token_encrypted), attribute_mapping = $4, is_active = $5
+		WHERE id = $6 AND tenant_id = $7
+	`, connector.Name, connector.Endpoint, sealed, mapping, connector.IsActive, connector.ID, connector.TenantID)
+	if err != nil {
+		return fmt.Errorf("failed to update connector: %w", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Delete removes a connector with its jobs. Resources it provisioned stay
+// downstream.
+func (s *Store) Delete(tenantID, id string) error {
+	result, err := s.db.Exec(`DELETE FROM provisioning_connectors WHERE id = $1 AND tenant_id = $2`, id, tenantID)
+	if err != nil {
+		return fmt.Errorf("failed to delete connector: %w", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+const jobColumns = `id, connector_id, resource_type, resource_id, operation, status, attempts, last_error,
+	next_attempt_at, created_at, completed_at`
+
+func scanJob(row interface{ Scan(...interface{}) error }) (*Job, error) {
+	var job Job
+	err := row.Scan(&job.ID, &job.ConnectorID, &job.ResourceType, &job.ResourceID, &job.Operation, &job.Status,
+		&job.Attempts, &job.LastError, &job.NextAttemptAt, &job.CreatedAt, &job.CompletedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// Jobs returns the latest jobs of a connector, optionally of one status.
+func (s *Store) Jobs(connectorID, status string, limit int) ([]*Job, error) {
+	rows, err := s.db.Query(`
+		SELECT `+jobColumns+` FROM provisioning_jobs
+		WHERE connector_id = $1 AND ($2 = '' OR status = $2)
+		ORDER BY created_at DESC, id LIMIT $3
+	`, connectorID, status, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list jobs: %w", err)
+	}
+	defer rows.Close()
+
+	jobs := []*Job{}
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan job: %w", err)
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+// Retry queues a failed job of connectorID again.
+func (s *Store) Retry(connectorID, jobID string) (*Job, error) {
+	job, err := scanJob(s.db.QueryRow(`
+		UPDATE provisioning_jobs
+		SET status = 'pending', attempts = 0, last_error = NULL, next_attempt_at = NOW(),
+			completed_at = NULL, updated_at = NOW()
+		WHERE id = $1 AND connector_id = $2 AND status = 'failed'
+		RETURNING `+jobColumns, jobID, connectorID))
+	if err == nil {
+		return job, nil
+	}
+	if err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to retry job: %w", err)
+	}
+
+	var exists bool
+	if err := s.db.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM provisioning_jobs WHERE id = $1 AND connector_id = $2)
+	`, jobID, connectorID).Scan(&exists); err != nil {
+		return nil, fmt.Errorf("failed to load job: %w", err)
+	}
+	if !exists {
+		return nil, ErrJobNotFound
+	}
+	return nil, ErrJobNotRetryable
+}
+
+// claim marks up to limit due jobs as running and returns them, oldest
+// first. Jobs left running by a worker that stopped are picked up again.
+func (s *Store) claim(limit int) ([]*Job, error) {
+	rows, err := s.db.Query(`
+		UPDATE provisioning_jobs SET status = 'running', attempts = attempts + 1, updated_at = NOW()
+		WHERE id IN (
+			SELECT id FROM provisioning_jobs
+			WHERE (status = 'pending' AND next_attempt_at <= NOW())
+				OR (status = 'running' AND updated_at < NOW() - INTERVAL '10 minutes')
+			ORDER BY created_at
+			LIMIT $1
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING `+jobColumns, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed to claim jobs: %w", err)
+	}
+	defer rows.Close()
+
+	jobs := []*Job{}
+	for rows.Next() {
+		job, err := scanJob(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan job: %w", err)
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+func (s *Store) succeed(job *Job) error {
+	_, err := s.db.Exec(`
+		UPDATE provisioning_jobs
+		SET status = 'succeeded', last_error = NULL, completed_at = NOW(), updated_at = NOW()
+		WHERE id = $1
+	`, job.ID)
+	return err
+}
+
+// fail schedules the next attempt of job with backoff, or fails it for good
+// after MaxAttempts.
+func (s *Store) fail(job *Job, cause error) error {
+	if job.Attempts >= MaxAttempts {
+		_, err := s.db.Exec(`
+			UPDATE provisioning_jobs
+			SET status = 'failed', last_error = $1, completed_at = NOW(), updated_at = NOW()
+			WHERE id = $2
+		`, cause.Error(), job.ID)
+		return err
+	}
+	_, err := s.db.Exec(`
+		UPDATE provisioning_jobs
+		SET status = 'pending', last_error = $1, next_attempt_at = NOW() + $2 * INTERVAL '1 second', updated_at = NOW()
+		WHERE id = $3
+	`, cause.Error(), int(Backoff(job.Attempts).Seconds()), job.ID)
+	return err
+}
+
+// prune deletes succeeded jobs older than 30 days.
+func (s *Store) prune() error {
+	_, err := s.db.Exec(`
+		DELETE FROM provisioning_jobs WHERE status = 'succeeded' AND completed_at < NOW() - INTERVAL '30 days'
+	`)
+	return err
+}
+
+func (s *Store) remoteID(connectorID, resourceType, resourceID string) (string, error) {
+	var remoteID string
+	err := s.db.QueryRow(`
+		SELECT remote_id FROM provisioning_resources
+		WHERE connector_id = $1 AND resource_type = $2 AND resource_id = $3
+	`, connectorID, resourceType, resourceID).Scan(&remoteID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return remoteID, err
+}
+
+func (s *Store) saveRemoteID(connectorID, resourceType, resourceID, remoteID string) error {
+	_, err := s.db.Exec(`
+		INSERT INTO provisioning_resources (connector_id, resource_type, resource_id, remote_id)
+		VALUES ($1, $2, $3, $4)
+		ON CONFLICT (connector_id, resource_type, resource_id) DO UPDATE SET remote_id = EXCLUDED.remote_id
+	`, connectorID, resourceType, resourceID, remoteID)
+	return err
+}
+
+func (s *Store) forgetRemoteID(connectorID, resourceType, resourceID string) error {
+	_, err := s.db.Exec(`
+		DELETE FROM provisioning_resources
+		WHERE connector_id = $1 AND resource_type = $2 AND resource_id = $3
+	`, connectorID, resourceType, resourceID)
+	return err
+}
+
+// loadUser reads the fields of a user of tenantID.
+func (s *Store) loadUser(tenantID, userID string) (*user, error) {
+	var (
+		u                                                      user
+		id, email, externalID, displayName, givenName, surname string
+	)
+	err := s.db.QueryRow(`
+		SELECT id, email, external_id, display_name, given_name, family_name, COALESCE(is_active, TRUE)
+		FROM users WHERE id = $1 AND tenant_id = $2 AND principal_type = 'user'
+	`, userID, tenantID).Scan(&id, &email, &externalID, &displayName, &givenName, &surname, &u.isActive)
+	if err == sql.ErrNoRows {
+		return nil, errResourceNotExists
+	}
+	if err != nil {
+		return nil, err
+	}
+	u.fields = map[string]string{
+		"id":           id,
+		"email":        email,
+		"external_id":  externalID,
+		"display_name": displayName,
+		"given_name":   givenName,
+		"family_name":  surname,
+	}
+	return &u, nil
+}
+
+// loadGroup reads the name and user members of a group of tenantID.
+func (s *Store) loadGroup(tenantID, groupID string) (string, []string, error) {
+	var (
+		name    string
+		members []string
+	)
+	err := s.db.QueryRow(`
+		SELECT g.name, ARRAY(
+			SELECT u.id::text FROM user_groups ug JOIN users u ON u.id = ug.user_id
+			WHERE ug.group_id = g.id AND u.tenant_id = g.tenant_id AND u.principal_type = 'user'
+			ORDER BY u.id
+		)
+		FROM groups g WHERE g.id = $1 AND g.tenant_id = $2
+	`, groupID, tenantID).Scan(&name, pq.Array(&members))
+	if err == sql.ErrNoRows {
+		return "", nil, errResourceNotExists
+	}
+	return name, members, err
+}
@@ -0,0 +1,171 @@
+package provisioning
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// batchSize is how many jobs a worker claims at a time.
+const batchSize = 20
+
+// Worker delivers queued jobs. Several instances may run against the same
+// database; each job is claimed by one of them.
+type Worker struct {
+	store *Store
+	http  *http.Client
+}
+
+// NewWorker returns a worker calling connectors with httpClient, which may
+// be nil.
+func NewWorker(store *Store, httpClient *http.Client) *Worker {
+	return &Worker{store: store, http: httpClient}
+}
+
+// Run delivers due jobs every interval until ctx is done.
+func (w *Worker) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := w.ProcessDue(ctx); err != nil {
+				log.Println("Failed to process provisioning jobs:", err)
+			}
+			if err := w.store.prune(); err != nil {
+				log.Println("Failed to prune provisioning jobs:", err)
+			}
+		}
+	}
+}
+
+// ProcessDue delivers the jobs that are due, batch by batch, until none is
+// left.
+func (w *Worker) ProcessDue(ctx context.Context) error {
+	for ctx.Err() == nil {
+		jobs, err := w.store.claim(batchSize)
+		if err != nil {
+			return err
+		}
+		if len(jobs) == 0 {
+			return nil
+		}
+		sort.Slice(jobs, func(i, j int) bool { return jobs[i].CreatedAt.Before(jobs[j].CreatedAt) })
+
+		for _, job := range jobs {
+			if err := w.process(ctx, job); err != nil {
+				if err := w.store.fail(job, err); err != nil {
+					return err
+				}
+				continue
+			}
+			if err := w.store.succeed(job); err != nil {
+				return err
+			}
+		}
+	}
+	return ctx.Err()
+}
+
+func (w *Worker) process(ctx context.Context, job *Job) error {
+	connector, err := w.store.getWithToken(job.ConnectorID)
+	if err != nil {
+		return err
+	}
+	client := NewClient(connector.Endpoint, connector.Token, w.http)
+
+	if job.ResourceType == ResourceGroup {
+		return w.provisionGroup(ctx, client, connector, job)
+	}
+	if job.Operation == OperationDelete {
+		return w.remove(ctx, client, connector, ResourceUser, job.ResourceID)
+	}
+	_, err = w.provisionUser(ctx, client, connector, job.ResourceID)
+	return err
+}
+
+// provisionUser creates or replaces a user downstream and returns its ID
+// there. A user deleted meanwhile is deleted downstream too.
+func (w *Worker) provisionUser(ctx context.Context, client *Client, connector *Connector, userID string) (string, error) {
+	u, err := w.store.loadUser(connector.TenantID, userID)
+	if err == errResourceNotExists {
+		return "", w.remove(ctx, client, connector, ResourceUser, userID)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	remoteID, err := w.store.remoteID(connector.ID, ResourceUser, userID)
+	if err != nil {
+		return "", err
+	}
+	resource := buildUser(u, connector.AttributeMapping)
+	filter := ""
+	if userName, ok := resource["userName"].(string); ok && userName != "" {
+		filter = "userName eq " + quote(userName)
+	}
+
+	remoteID, err = client.Upsert(ctx, ResourceUser, remoteID, filter, resource)
+	if err != nil {
+		return "", err
+	}
+	return remoteID, w.store.saveRemoteID(connector.ID, ResourceUser, userID, remoteID)
+}
+
+// provisionGroup creates or replaces a group downstream, provisioning its
+// members first when they are not there yet.
+func (w *Worker) provisionGroup(ctx context.Context, client *Client, connector *Connector, job *Job) error {
+	if job.Operation == OperationDelete {
+		return w.remove(ctx, client, connector, ResourceGroup, job.ResourceID)
+	}
+	name, memberIDs, err := w.store.loadGroup(connector.TenantID, job.ResourceID)
+	if err == errResourceNotExists {
+		return w.remove(ctx, client, connector, ResourceGroup, job.ResourceID)
+	}
+	if err != nil {
+		return err
+	}
+
+	remoteMembers := []string{}
+	for _, memberID := range memberIDs {
+		remoteID, err := w.store.remoteID(connector.ID, ResourceUser, memberID)
+		if err != nil {
+			return err
+		}
+		if remoteID == "" {
+			if remoteID, err = w.provisionUser(ctx, client, connector, memberID); err != nil {
+				return err
+			}
+		}
+		if remoteID != "" {
+			remoteMembers = append(remoteMembers, remoteID)
+		}
+	}
+
+	remoteID, err := w.store.remoteID(connector.ID, ResourceGroup, job.ResourceID)
+	if err != nil {
+		return err
+	}
+	remoteID, err = client.Upsert(ctx, ResourceGroup, remoteID, "displayName eq "+quote(name), buildGroup(job.ResourceID, name, remoteMembers))
+	if err != nil {
+		return err
+	}
+	return w.store.saveRemoteID(connector.ID, ResourceGroup, job.ResourceID, remoteID)
+}
+
+// remove deletes a resource downstream if it was provisioned.
+func (w *Worker) remove(ctx context.Context, client *Client, connector *Connector, resourceType, resourceID string) error {
+	remoteID, err := w.store.remoteID(connector.ID, resourceType, resourceID)
+	if err != nil || remoteID == "" {
+		return err
+	}
+	if err := client.Delete(ctx, resourceType, remoteID); err != nil {
+		return err
+	}
+	return w.store.forgetRemoteID(connector.ID, resourceType, resourceID)
+}
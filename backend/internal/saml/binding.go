@@ -0,0 +1,249 @@
+package saml
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// maxMessageSize bounds decoded messages, which come from the browser.
+const maxMessageSize = 256 << 10
+
+// Message is a protocol message received over the HTTP-Redirect or
+// HTTP-POST binding, as the SAMLRequest or SAMLResponse parameter.
+type Message struct {
+	XML        []byte
+	RelayState string
+	Binding    string
+
+	// Signature of the HTTP-Redirect binding, over signed
+	sigAlg    string
+	signature []byte
+	signed    []byte
+}
+
+// ReadMessage reads the message param of r: from the query of a GET
+// request (HTTP-Redirect) or from the form of a POST request (HTTP-POST).
+func ReadMessage(r *http.Request, param string) (*Message, error) {
+	if r.Method == http.MethodPost {
+		if err := r.ParseForm(); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+		}
+		value := r.PostForm.Get(param)
+		if value == "" {
+			return nil, fmt.Errorf("%w: %s is missing", ErrInvalidMessage, param)
+		}
+		data, err := decodeBase64(value)
+		if err != nil || len(data) > maxMessageSize {
+			return nil, fmt.Errorf("%w: %s is not base64 encoded", ErrInvalidMessage, param)
+		}
+		return &Message{XML: data, RelayState: r.PostForm.Get("RelayState"), Binding: BindingPOST}, nil
+	}
+
+	query := r.URL.Query()
+	value := query.Get(param)
+	if value == "" {
+		return nil, fmt.Errorf("%w: %s is missing", ErrInvalidMessage, param)
+	}
+	data, err := DecodeRedirect(value)
+	if err != nil {
+		return nil, err
+	}
+	m := &Message{XML: data, RelayState: query.Get("RelayState"), Binding: BindingRedirect}
+
+	if signature := query.Get("Signature"); signature != "" {
+		if m.signature, err = decodeBase64(signature); err != nil {
+			return nil, fmt.Errorf("%w: Signature is not base64 encoded", ErrInvalidMessage)
+		}
+		m.sigAlg = query.Get("SigAlg")
+		m.signed = signedQuery(r.URL.RawQuery, param)
+	}
+	return m, nil
+}
+
+// signedQuery rebuilds the signed part of a query from the values as they
+// were sent, since encoding them again need not give the same bytes.
+func signedQuery(rawQuery, param string) []byte {
+	raw := map[string]string{}
+	for _, pair := range strings.Split(rawQuery, "&") {
+		name, value, _ := strings.Cut(pair, "=")
+		if _, seen := raw[name]; !seen {
+			raw[name] = value
+		}
+	}
+
+	query := param + "=" + raw[param]
+	if relayState, ok := raw["RelayState"]; ok {
+		query += "&RelayState=" + relayState
+	}
+	query += "&SigAlg=" + raw["SigAlg"]
+	return []byte(query)
+}
+
+// Verify checks that m was signed with the key of cert. Only signatures of
+// the HTTP-Redirect binding are verified, so a service provider that signs
+// its messages has to send them with it.
+func (m *Message) Verify(cert *x509.Certificate) error {
+	if m.Binding != BindingRedirect {
+		return fmt.Errorf("%w: signed messages must use the HTTP-Redirect binding", ErrInvalidSignature)
+	}
+	if m.signature == nil {
+		return fmt.Errorf("%w: the message is not signed", ErrInvalidSignature)
+	}
+	return verifySignature(cert, m.sigAlg, m.signed, m.signature)
+}
+
+// EncodeRedirect deflates and base64 encodes a message for the
+// HTTP-Redirect binding.
+func EncodeRedirect(message []byte) (string, error) {
+	var b bytes.Buffer
+	w, err := flate.NewWriter(&b, flate.BestCompression)
+	if err != nil {
+		return "", err
+	}
+	if _, err := w.Write(message); err != nil {
+		return "", err
+	}
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(b.Bytes()), nil
+}
+
+// DecodeRedirect reverses EncodeRedirect.
+func DecodeRedirect(value string) ([]byte, error) {
+	compressed, err := decodeBase64(value)
+	if err != nil {
+		return nil, fmt.Errorf("%w: the message is not base64 encoded", ErrInvalidMessage)
+	}
+	data, err := io.ReadAll(io.LimitReader(flate.NewReader(bytes.NewReader(compressed)), maxMessageSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("%w: the message is not deflated", ErrInvalidMessage)
+	}
+	if len(data) > maxMessageSize {
+		return nil, fmt.Errorf("%w: the message is too large", ErrInvalidMessage)
+	}
+	return data, nil
+}
+
+// decodeBase64 decodes standard base64, ignoring the line breaks some
+// service providers add.
+func decodeBase64(value string) ([]byte, error) {
+	value = strings.Map(func(r rune) rune {
+		if r == '\r' || r == '\n' || r == ' ' || r == '\t' {
+			return -1
+		}
+		return r
+	}, value)
+	return base64.StdEncoding.DecodeString(value)
+}
+
+// header holds the attributes and the issuer all requests and responses
+// have.
+type header struct {
+	ID          string `xml:"ID,attr"`
+	Version     string `xml:"Version,attr"`
+	Destination string `xml:"Destination,attr"`
+	Issuer      string `xml:"urn:oasis:names:tc:SAML:2.0:assertion Issuer"`
+}
+
+// check validates h for a message sent to destination.
+func (h *header) check(destination string) error {
+	h.Issuer = strings.TrimSpace(h.Issuer)
+	switch {
+	case h.ID == "":
+		return fmt.Errorf("%w: ID is missing", ErrInvalidMessage)
+	case h.Version != "2.0":
+		return fmt.Errorf("%w: Version must be 2.0", ErrInvalidMessage)
+	case h.Issuer == "":
+		return fmt.Errorf("%w: Issuer is missing", ErrInvalidMessage)
+	case h.Destination != "" && h.Destination != destination:
+		return fmt.Errorf("%w: Destination does not match", ErrInvalidMessage)
+	}
+	return nil
+}
+
+// AuthnRequest asks the IdP to sign a user in to a service provider.
+type AuthnRequest struct {
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol AuthnRequest"`
+	header
+	AssertionConsumerServiceURL string `xml:"AssertionConsumerServiceURL,attr"`
+	ProtocolBinding             string `xml:"ProtocolBinding,attr"`
+	ForceAuthn                  bool   `xml:"ForceAuthn,attr"`
+	IsPassive                   bool   `xml:"IsPassive,attr"`
+	NameIDPolicy                struct {
+		Format string `xml:"Format,attr"`
+	} `xml:"urn:oasis:names:tc:SAML:2.0:protocol NameIDPolicy"`
+}
+
+// ParseAuthnRequest parses an AuthnRequest sent to destination.
+func ParseAuthnRequest(data []byte, destination string) (*AuthnRequest, error) {
+	var req AuthnRequest
+	if err := xml.Unmarshal(data, &req); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+	}
+	if err := req.check(destination); err != nil {
+		return nil, err
+	}
+	if req.ProtocolBinding != "" && req.ProtocolBinding != BindingPOST {
+		return nil, fmt.Errorf("%w: responses are only sent with the HTTP-POST binding", ErrInvalidMessage)
+	}
+	return &req, nil
+}
+
+// LogoutRequest asks to end the sessions of a user.
+type LogoutRequest struct {
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol LogoutRequest"`
+	header
+	NameID       string   `xml:"urn:oasis:names:tc:SAML:2.0:assertion NameID"`
+	SessionIndex []string `xml:"urn:oasis:names:tc:SAML:2.0:protocol SessionIndex"`
+}
+
+// ParseLogoutRequest parses a LogoutRequest sent to destination.
+func ParseLogoutRequest(data []byte, destination string) (*LogoutRequest, error) {
+	var req LogoutRequest
+	if err := xml.Unmarshal(data, &req); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+	}
+	if err := req.check(destination); err != nil {
+		return nil, err
+	}
+	req.NameID = strings.TrimSpace(req.NameID)
+	if req.NameID == "" {
+		return nil, fmt.Errorf("%w: NameID is missing", ErrInvalidMessage)
+	}
+	return &req, nil
+}
+
+// LogoutResponse answers a LogoutRequest.
+type LogoutResponse struct {
+	XMLName xml.Name `xml:"urn:oasis:names:tc:SAML:2.0:protocol LogoutResponse"`
+	header
+	InResponseTo string `xml:"InResponseTo,attr"`
+	Status       struct {
+		StatusCode struct {
+			Value string `xml:"Value,attr"`
+		} `xml:"urn:oasis:names:tc:SAML:2.0:protocol StatusCode"`
+	} `xml:"urn:oasis:names:tc:SAML:2.0:protocol Status"`
+}
+
+// ParseLogoutResponse parses a LogoutResponse sent to destination.
+func ParseLogoutResponse(data []byte, destination string) (*LogoutResponse, error) {
+	var resp LogoutResponse
+	if err := xml.Unmarshal(data, &resp); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+	}
+	if err := resp.check(destination); err != nil {
+		return nil, err
+	}
+	if resp.InResponseTo == "" {
+		return nil, fmt.Errorf("%w: InResponseTo is missing", ErrInvalidMessage)
+	}
+	return &resp, nil
+}
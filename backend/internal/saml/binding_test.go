@@ -0,0 +1,138 @@
+package saml
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+const authnRequest = `<samlp:AuthnRequest xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol"
+	xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion" ID="_req1" Version="2.0" IssueInstant="2025-05-01T09:00:00Z"
+	Destination="https://iam.example/saml/idp/t1/sso" AssertionConsumerServiceURL="https://wiki.example/acs"
+	ProtocolBinding="urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST" ForceAuthn="true">
+	<saml:Issuer> https://wiki.example </saml:Issuer>
+	<samlp:NameIDPolicy Format="urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress" AllowCreate="true"/>
+</samlp:AuthnRequest>`
+
+func TestRedirectBindingSignature(t *testing.T) {
+	credential, err := GenerateCredential("sp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	location, err := credential.RedirectURL("https://iam.example/saml/idp/t1/sso?tenant=t1", "SAMLRequest", []byte(authnRequest), "state & more")
+	if err != nil {
+		t.Fatalf("RedirectURL returned error: %v", err)
+	}
+
+	m, err := ReadMessage(httptest.NewRequest("GET", location, nil), "SAMLRequest")
+	if err != nil {
+		t.Fatalf("ReadMessage returned error: %v", err)
+	}
+	if string(m.XML) != authnRequest || m.RelayState != "state & more" || m.Binding != BindingRedirect {
+		t.Errorf("Unexpected message %+v", m)
+	}
+	if err := m.Verify(credential.Certificate); err != nil {
+		t.Errorf("Verify returned error: %v", err)
+	}
+
+	other, _ := GenerateCredential("other")
+	if err := m.Verify(other.Certificate); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Expected a signature of another key to be rejected, got %v", err)
+	}
+
+	tampered := strings.Replace(location, "RelayState=state", "RelayState=other", 1)
+	m, err = ReadMessage(httptest.NewRequest("GET", tampered, nil), "SAMLRequest")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Verify(credential.Certificate); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Expected a changed RelayState to be rejected, got %v", err)
+	}
+
+	encoded, _ := EncodeRedirect([]byte(authnRequest))
+	m, _ = ReadMessage(httptest.NewRequest("GET", "/sso?SAMLRequest="+url.QueryEscape(encoded), nil), "SAMLRequest")
+	if err := m.Verify(credential.Certificate); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Expected an unsigned message to be rejected, got %v", err)
+	}
+}
+
+func TestPOSTBinding(t *testing.T) {
+	form := url.Values{
+		"SAMLRequest": {base64.StdEncoding.EncodeToString([]byte(authnRequest))},
+		"RelayState":  {"abc"},
+	}
+	r := httptest.NewRequest("POST", "/sso", strings.NewReader(form.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	m, err := ReadMessage(r, "SAMLRequest")
+	if err != nil {
+		t.Fatalf("ReadMessage returned error: %v", err)
+	}
+	if string(m.XML) != authnRequest || m.RelayState != "abc" || m.Binding != BindingPOST {
+		t.Errorf("Unexpected message %+v", m)
+	}
+
+	credential, _ := GenerateCredential("sp")
+	if err := m.Verify(credential.Certificate); !errors.Is(err, ErrInvalidSignature) {
+		t.Errorf("Expected signatures over HTTP-POST to be refused, got %v", err)
+	}
+
+	if _, err := ReadMessage(httptest.NewRequest("GET", "/sso", nil), "SAMLRequest"); !errors.Is(err, ErrInvalidMessage) {
+		t.Errorf("Expected a missing message to be rejected, got %v", err)
+	}
+}
+
+func TestParseAuthnRequest(t *testing.T) {
+	req, err := ParseAuthnRequest([]byte(authnRequest), "https://iam.example/saml/idp/t1/sso")
+	if err != nil {
+		t.Fatalf("ParseAuthnRequest returned error: %v", err)
+	}
+	if req.ID != "_req1" || req.Issuer != "https://wiki.example" || req.AssertionConsumerServiceURL != "https://wiki.example/acs" ||
+		!req.ForceAuthn || req.NameIDPolicy.Format != NameIDFormatEmail {
+		t.Errorf("Unexpected request %+v", req)
+	}
+
+	tests := []struct {
+		name        string
+		data        string
+		destination string
+	}{
+		{"other destination", authnRequest, "https://iam.example/saml/idp/t2/sso"},
+		{"other version", strings.Replace(authnRequest, `Version="2.0"`, `Version="1.1"`, 1), "https://iam.example/saml/idp/t1/sso"},
+		{"artifact binding", strings.Replace(authnRequest, "HTTP-POST", "HTTP-Artifact", 1), "https://iam.example/saml/idp/t1/sso"},
+		{"logout request", strings.Replace(authnRequest, "AuthnRequest", "LogoutRequest", 2), "https://iam.example/saml/idp/t1/sso"},
+		{"malformed", "<samlp:AuthnRequest", "https://iam.example/saml/idp/t1/sso"},
+	}
+	for _, tt := range tests {
+		if _, err := ParseAuthnRequest([]byte(tt.data), tt.destination); !errors.Is(err, ErrInvalidMessage) {
+			t.Errorf("%s: expected ErrInvalidMessage, got %v", tt.name, err)
+		}
+	}
+}
+
+func TestLogoutMessages(t *testing.T) {
+	credential, _ := GenerateCredential("idp")
+	idp := NewIdP("https://iam.example", "t1", credential)
+	sp := &ServiceProvider{EntityID: "https://wiki.example", SLOURL: "https://wiki.example/slo", NameIDFormat: NameIDFormatEmail}
+
+	id, data := idp.LogoutRequest(sp, "alice@example.com", "_s1", time.Now())
+	req, err := ParseLogoutRequest(data, sp.SLOURL)
+	if err != nil {
+		t.Fatalf("ParseLogoutRequest returned error: %v", err)
+	}
+	if req.ID != id || req.Issuer != idp.EntityID || req.NameID != "alice@example.com" || len(req.SessionIndex) != 1 || req.SessionIndex[0] != "_s1" {
+		t.Errorf("Unexpected logout request %+v", req)
+	}
+
+	resp, err := ParseLogoutResponse(idp.LogoutResponse(sp, id, StatusSuccess, time.Now()), sp.SLOURL)
+	if err != nil {
+		t.Fatalf("ParseLogoutResponse returned error: %v", err)
+	}
+	if resp.InResponseTo != id || resp.Status.StatusCode.Value != StatusSuccess {
+		t.Errorf("Unexpected logout response %+v", resp)
+	}
+}
@@ -0,0 +1,391 @@
+package saml
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+const (
+	namespaceXML     = "http://www.w3.org/XML/1998/namespace"
+	namespaceExcC14N = "http://www.w3.org/2001/10/xml-exc-c14n#"
+)
+
+// node is an element of a document ForIAM receives. Unlike element it keeps
+// the prefixes and namespace declarations as sent, so that signed subtrees
+// can be canonicalized for verification.
+type node struct {
+	prefix, local string
+	// space is the namespace of the element
+	space string
+	attrs []nodeAttr
+	// content holds text as string and child elements as *node
+	content []interface{}
+	// scope maps the prefixes in scope to their namespaces; "" is the
+	// default namespace
+	scope  map[string]string
+	parent *node
+}
+
+type nodeAttr struct {
+	prefix, local, space, value string
+}
+
+// parseDocument parses a document received from an IdP. Documents with a
+// DTD are refused, and so are duplicate IDs, which signature wrapping
+// attacks rely on.
+func parseDocument(data []byte) (*node, error) {
+	d := xml.NewDecoder(bytes.NewReader(data))
+	ids := map[string]bool{}
+	var root, current *node
+	for {
+		tok, err := d.RawToken()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrInvalidMessage, err)
+		}
+
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if root != nil && current == nil {
+				return nil, fmt.Errorf("%w: content after the document element", ErrInvalidMessage)
+			}
+			n, err := newNode(t, current)
+			if err != nil {
+				return nil, err
+			}
+			if id := n.attr("ID"); id != "" {
+				if ids[id] {
+					return nil, fmt.Errorf("%w: duplicate ID %s", ErrInvalidMessage, id)
+				}
+				ids[id] = true
+			}
+			if current == nil {
+				root = n
+			} else {
+				current.content = append(current.content, n)
+			}
+			current = n
+		case xml.EndElement:
+			if current == nil || t.Name.Space != current.prefix || t.Name.Local != current.local {
+				return nil, fmt.Errorf("%w: unexpected end element", ErrInvalidMessage)
+			}
+			current = current.parent
+		case xml.CharData:
+			if current != nil {
+				current.content = append(current.content, string(t))
+			}
+		case xml.ProcInst:
+			if current != nil {
+				return nil, fmt.Errorf("%w: processing instructions are not supported", ErrInvalidMessage)
+			}
+		case xml.Directive:
+			return nil, fmt.Errorf("%w: DTDs are not allowed", ErrInvalidMessage)
+		}
+		// Comments are dropped, as canonicalization without comments does
+	}
+	if root == nil || current != nil {
+		return nil, fmt.Errorf("%w: the document is incomplete", ErrInvalidMessage)
+	}
+	return root, nil
+}
+
+// newNode builds the node of a start element, resolving its namespaces in
+// the scope of parent.
+func newNode(t xml.StartElement, parent *node) (*node, error) {
+	n := &node{prefix: t.Name.Space, local: t.Name.Local, parent: parent}
+	if parent != nil {
+		n.scope = parent.scope
+	} else {
+		n.scope = map[string]string{"xml": namespaceXML}
+	}
+
+	declared := false
+	for _, a := range t.Attr {
+		prefix, isDeclaration := "", false
+		switch {
+		case a.Name.Space == "xmlns":
+			prefix, isDeclaration = a.Name.Local, true
+		case a.Name.Space == "" && a.Name.Local == "xmlns":
+			isDeclaration = true
+		}
+		if !isDeclaration {
+			continue
+		}
+		if !declared {
+			scope := make(map[string]string, len(n.scope)+1)
+			for p, uri := range n.scope {
+				scope[p] = uri
+			}
+			n.scope, declared = scope, true
+		}
+		n.scope[prefix] = a.Value
+	}
+
+	for _, a := range t.Attr {
+		if a.Name.Space == "xmlns" || (a.Name.Space == "" && a.Name.Local == "xmlns") {
+			continue
+		}
+		na := nodeAttr{prefix: a.Name.Space, local: a.Name.Local, value: a.Value}
+		if na.prefix != "" {
+			uri, ok := n.scope[na.prefix]
+			if !ok {
+				return nil, fmt.Errorf("%w: undeclared prefix %s", ErrInvalidMessage, na.prefix)
+			}
+			na.space = uri
+		}
+		n.attrs = append(n.attrs, na)
+	}
+
+	uri, ok := n.scope[n.prefix]
+	if n.prefix != "" && !ok {
+		return nil, fmt.Errorf("%w: undeclared prefix %s", ErrInvalidMessage, n.prefix)
+	}
+	n.space = uri
+	return n, nil
+}
+
+// is reports whether n is the element local of namespace space.
+func (n *node) is(space, local string) bool {
+	return n.space == space && n.local == local
+}
+
+// attr returns the value of the unqualified attribute local.
+func (n *node) attr(local string) string {
+	if n == nil {
+		return ""
+	}
+	for _, a := range n.attrs {
+		if a.prefix == "" && a.local == local {
+			return a.value
+		}
+	}
+	return ""
+}
+
+// children returns the child elements local of namespace space.
+func (n *node) children(space, local string) []*node {
+	if n == nil {
+		return nil
+	}
+	var children []*node
+	for _, c := range n.content {
+		if child, ok := c.(*node); ok && child.is(space, local) {
+			children = append(children, child)
+		}
+	}
+	return children
+}
+
+// child returns the first child element local of namespace space, or nil.
+// Like the other accessors it accepts a nil node, so paths can be chained.
+func (n *node) child(space, local string) *node {
+	if n == nil {
+		return nil
+	}
+	for _, c := range n.content {
+		if child, ok := c.(*node); ok && child.is(space, local) {
+			return child
+		}
+	}
+	return nil
+}
+
+// text returns the text content of n, without surrounding whitespace.
+func (n *node) text() string {
+	if n == nil {
+		return ""
+	}
+	var b strings.Builder
+	for _, c := range n.content {
+		if s, ok := c.(string); ok {
+			b.WriteString(s)
+		}
+	}
+	return strings.TrimSpace(b.String())
+}
+
+// canonical renders n as the apex of a document subset in exclusive
+// canonical form, leaving out skip, the enveloped signature. inclusive are
+// the prefixes of an InclusiveNamespaces PrefixList, which are rendered
+// wherever they are in scope rather than only where they are used.
+func (n *node) canonical(skip *node, inclusive []string) []byte {
+	var b strings.Builder
+	n.render(&b, skip, inclusive, map[string]string{})
+	return []byte(b.String())
+}
+
+// render writes n; rendered holds the namespaces output ancestors declared.
+func (n *node) render(b *strings.Builder, skip *node, inclusive []string, rendered map[string]string) {
+	used := map[string]bool{n.prefix: true}
+	for _, a := range n.attrs {
+		if a.prefix != "" && a.prefix != "xml" {
+			used[a.prefix] = true
+		}
+	}
+	for _, prefix := range inclusive {
+		if _, ok := n.scope[prefix]; ok && prefix != "xml" {
+			used[prefix] = true
+		}
+	}
+
+	var declarations []string
+	for prefix := range used {
+		uri := n.scope[prefix]
+		previous, ok := rendered[prefix]
+		if (ok && previous == uri) || (!ok && prefix == "" && uri == "") {
+			continue
+		}
+		declarations = append(declarations, prefix)
+	}
+	if len(declarations) > 0 {
+		scope := make(map[string]string, len(rendered)+len(declarations))
+		for prefix, uri := range rendered {
+			scope[prefix] = uri
+		}
+		for _, prefix := range declarations {
+			scope[prefix] = n.scope[prefix]
+		}
+		rendered = scope
+	}
+	sort.Strings(declarations)
+
+	name := n.local
+	if n.prefix != "" {
+		name = n.prefix + ":" + n.local
+	}
+	b.WriteString("<" + name)
+	for _, prefix := range declarations {
+		if prefix == "" {
+			b.WriteString(` xmlns="`)
+		} else {
+			b.WriteString(` xmlns:` + prefix + `="`)
+		}
+		b.WriteString(escapeAttr(rendered[prefix]))
+		b.WriteByte('"')
+	}
+
+	attrs := append([]nodeAttr(nil), n.attrs...)
+	sort.Slice(attrs, func(i, j int) bool {
+		if attrs[i].space != attrs[j].space {
+			return attrs[i].space < attrs[j].space
+		}
+		return attrs[i].local < attrs[j].local
+	})
+	for _, a := range attrs {
+		b.WriteByte(' ')
+		if a.prefix != "" {
+			b.WriteString(a.prefix + ":")
+		}
+		b.WriteString(a.local + `="`)
+		b.WriteString(escapeAttr(a.value))
+		b.WriteByte('"')
+	}
+	b.WriteByte('>')
+
+	for _, c := range n.content {
+		switch c := c.(type) {
+		case string:
+			b.WriteString(escapeText(c))
+		case *node:
+			if c != skip {
+				c.render(b, skip, inclusive, rendered)
+			}
+		}
+	}
+	b.WriteString("</" + name + ">")
+}
+
+// verify checks the enveloped signature of n, made by the key of
+// cert. It reports false without error when n is not signed. Only the
+// algorithms ForIAM signs with are accepted: exclusive canonicalization,
+// SHA-256 digests and RSA-SHA256 or ECDSA-SHA256 signatures.
+func (n *node) verify(cert *x509.Certificate) (bool, error) {
+	signatures := n.children(NamespaceSignature, "Signature")
+	if len(signatures) == 0 {
+		return false, nil
+	}
+	if len(signatures) > 1 {
+		return false, fmt.Errorf("%w: more than one signature", ErrInvalidSignature)
+	}
+	signature := signatures[0]
+
+	signedInfo := signature.child(NamespaceSignature, "SignedInfo")
+	if signedInfo == nil {
+		return false, fmt.Errorf("%w: SignedInfo is missing", ErrInvalidSignature)
+	}
+	method := signedInfo.child(NamespaceSignature, "CanonicalizationMethod")
+	if method == nil || method.attr("Algorithm") != algorithmExcC14N {
+		return false, fmt.Errorf("%w: unsupported canonicalization", ErrInvalidSignature)
+	}
+
+	references := signedInfo.children(NamespaceSignature, "Reference")
+	if len(references) != 1 {
+		return false, fmt.Errorf("%w: exactly one reference is required", ErrInvalidSignature)
+	}
+	reference := references[0]
+	if id := n.attr("ID"); id == "" || reference.attr("URI") != "#"+id {
+		return false, fmt.Errorf("%w: the signature does not reference the signed element", ErrInvalidSignature)
+	}
+
+	var enveloped bool
+	var inclusive []string
+	for _, transform := range reference.child(NamespaceSignature, "Transforms").children(NamespaceSignature, "Transform") {
+		switch transform.attr("Algorithm") {
+		case algorithmEnveloped:
+			enveloped = true
+		case algorithmExcC14N:
+			inclusive = inclusivePrefixes(transform)
+		default:
+			return false, fmt.Errorf("%w: unsupported transform %s", ErrInvalidSignature, transform.attr("Algorithm"))
+		}
+	}
+	if !enveloped {
+		return false, fmt.Errorf("%w: the signature is not enveloped", ErrInvalidSignature)
+	}
+	if digestMethod := reference.child(NamespaceSignature, "DigestMethod"); digestMethod == nil || digestMethod.attr("Algorithm") != algorithmSHA256 {
+		return false, fmt.Errorf("%w: unsupported digest", ErrInvalidSignature)
+	}
+
+	digestValue, err := decodeBase64(reference.child(NamespaceSignature, "DigestValue").text())
+	if err != nil {
+		return false, fmt.Errorf("%w: DigestValue is not base64 encoded", ErrInvalidSignature)
+	}
+	digest := sha256.Sum256(n.canonical(signature, inclusive))
+	if !bytes.Equal(digest[:], digestValue) {
+		return false, fmt.Errorf("%w: the digest does not match", ErrInvalidSignature)
+	}
+
+	signatureValue, err := decodeBase64(signature.child(NamespaceSignature, "SignatureValue").text())
+	if err != nil {
+		return false, fmt.Errorf("%w: SignatureValue is not base64 encoded", ErrInvalidSignature)
+	}
+	sigAlg := signedInfo.child(NamespaceSignature, "SignatureMethod").attr("Algorithm")
+	if err := verifySignature(cert, sigAlg, signedInfo.canonical(nil, inclusivePrefixes(method)), signatureValue); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// inclusivePrefixes returns the InclusiveNamespaces PrefixList of a
+// canonicalization method; #default stands for the default namespace.
+func inclusivePrefixes(method *node) []string {
+	list := method.child(namespaceExcC14N, "InclusiveNamespaces")
+	if list == nil {
+		return nil
+	}
+	prefixes := strings.Fields(list.attr("PrefixList"))
+	for i, prefix := range prefixes {
+		if prefix == "#default" {
+			prefixes[i] = ""
+		}
+	}
+	return prefixes
+}
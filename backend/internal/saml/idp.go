@@ -0,0 +1,181 @@
+package saml
+
+import (
+	"encoding/base64"
+	"encoding/xml"
+	"strings"
+	"time"
+)
+
+// IdP is the identity provider of a tenant. Its endpoints are built from
+// the public base URL of the server.
+type IdP struct {
+	EntityID   string
+	SSOURL     string
+	SLOURL     string
+	Credential *Credential
+}
+
+// EntityID returns the entity ID of the IdP of tenantID, which is also the
+// URL of its metadata.
+func EntityID(baseURL, tenantID string) string {
+	return idpURL(baseURL, tenantID) + "/metadata"
+}
+
+func idpURL(baseURL, tenantID string) string {
+	return strings.TrimRight(baseURL, "/") + "/saml/idp/" + tenantID
+}
+
+// NewIdP returns the IdP of tenantID signing with credential.
+func NewIdP(baseURL, tenantID string, credential *Credential) *IdP {
+	base := idpURL(baseURL, tenantID)
+	return &IdP{
+		EntityID:   EntityID(baseURL, tenantID),
+		SSOURL:     base + "/sso",
+		SLOURL:     base + "/slo",
+		Credential: credential,
+	}
+}
+
+// Metadata returns the metadata document of the IdP.
+func (idp *IdP) Metadata() []byte {
+	descriptor := newElement("md:IDPSSODescriptor",
+		attr{"protocolSupportEnumeration", NamespaceProtocol},
+		attr{"WantAuthnRequestsSigned", "false"},
+	).add(
+		newElement("md:KeyDescriptor", attr{"use", "signing"}).add(idp.Credential.keyInfo()),
+		newElement("md:SingleLogoutService", attr{"Binding", BindingRedirect}, attr{"Location", idp.SLOURL}),
+		newElement("md:SingleLogoutService", attr{"Binding", BindingPOST}, attr{"Location", idp.SLOURL}),
+	)
+	for _, format := range []string{NameIDFormatEmail, NameIDFormatPersistent, NameIDFormatTransient, NameIDFormatUnspecified} {
+		descriptor.add(newElement("md:NameIDFormat").withText(format))
+	}
+	descriptor.add(
+		newElement("md:SingleSignOnService", attr{"Binding", BindingRedirect}, attr{"Location", idp.SSOURL}),
+		newElement("md:SingleSignOnService", attr{"Binding", BindingPOST}, attr{"Location", idp.SSOURL}),
+	)
+
+	document := newElement("md:EntityDescriptor", attr{"entityID", idp.EntityID}).add(descriptor)
+	return append([]byte(xml.Header), document.canonical()...)
+}
+
+// Login is a sign-in of a user to a service provider.
+type Login struct {
+	ServiceProvider *ServiceProvider
+	// ID of the AuthnRequest; empty for sign-ins started at the IdP
+	InResponseTo string
+	Identity     *Identity
+	NameID       string
+	SessionIndex string
+}
+
+// Response returns the base64 encoded Response carrying a signed assertion
+// about login, for the HTTP-POST binding.
+func (idp *IdP) Response(login *Login, now time.Time) (string, error) {
+	sp := login.ServiceProvider
+	now = now.UTC()
+	issueInstant := timestamp(now)
+	notOnOrAfter := timestamp(now.Add(assertionLifetime))
+
+	confirmation := newElement("saml:SubjectConfirmationData",
+		attr{"NotOnOrAfter", notOnOrAfter},
+		attr{"Recipient", sp.ACSURL},
+	)
+	if login.InResponseTo != "" {
+		confirmation.attrs = append(confirmation.attrs, attr{"InResponseTo", login.InResponseTo})
+	}
+
+	assertion := newElement("saml:Assertion",
+		attr{"ID", newID()},
+		attr{"IssueInstant", issueInstant},
+		attr{"Version", "2.0"},
+	).add(
+		newElement("saml:Issuer").withText(idp.EntityID),
+		newElement("saml:Subject").add(
+			newElement("saml:NameID", attr{"Format", sp.NameIDFormat}).withText(login.NameID),
+			newElement("saml:SubjectConfirmation", attr{"Method", confirmationBearer}).add(confirmation),
+		),
+		newElement("saml:Conditions",
+			attr{"NotBefore", timestamp(now.Add(-clockSkew))},
+			attr{"NotOnOrAfter", notOnOrAfter},
+		).add(
+			newElement("saml:AudienceRestriction").add(
+				newElement("saml:Audience").withText(sp.EntityID),
+			),
+		),
+		newElement("saml:AuthnStatement",
+			attr{"AuthnInstant", issueInstant},
+			attr{"SessionIndex", login.SessionIndex},
+		).add(
+			newElement("saml:AuthnContext").add(
+				newElement("saml:AuthnContextClassRef").withText(authnContextPassword),
+			),
+		),
+	)
+
+	if attributes := sp.Attributes(login.Identity); len(attributes) > 0 {
+		statement := newElement("saml:AttributeStatement")
+		for _, attribute := range attributes {
+			e := newElement("saml:Attribute", attr{"Name", attribute.Name}, attr{"NameFormat", attributeNameFormatBasic})
+			for _, value := range attribute.Values {
+				e.add(newElement("saml:AttributeValue").withText(value))
+			}
+			statement.add(e)
+		}
+		assertion.add(statement)
+	}
+
+	if err := idp.Credential.signEnveloped(assertion); err != nil {
+		return "", err
+	}
+
+	response := newElement("samlp:Response",
+		attr{"Destination", sp.ACSURL},
+		attr{"ID", newID()},
+		attr{"IssueInstant", issueInstant},
+		attr{"Version", "2.0"},
+	).add(
+		newElement("saml:Issuer").withText(idp.EntityID),
+		status(StatusSuccess),
+		assertion,
+	)
+	if login.InResponseTo != "" {
+		response.attrs = append(response.attrs, attr{"InResponseTo", login.InResponseTo})
+	}
+	return base64.StdEncoding.EncodeToString(response.canonical()), nil
+}
+
+// LogoutRequest returns a LogoutRequest ending a session at sp, and its ID.
+func (idp *IdP) LogoutRequest(sp *ServiceProvider, nameID, sessionIndex string, now time.Time) (string, []byte) {
+	id := newID()
+	request := newElement("samlp:LogoutRequest",
+		attr{"Destination", sp.SLOURL},
+		attr{"ID", id},
+		attr{"IssueInstant", timestamp(now)},
+		attr{"Version", "2.0"},
+	).add(
+		newElement("saml:Issuer").withText(idp.EntityID),
+		newElement("saml:NameID", attr{"Format", sp.NameIDFormat}).withText(nameID),
+		newElement("samlp:SessionIndex").withText(sessionIndex),
+	)
+	return id, request.canonical()
+}
+
+// LogoutResponse returns a LogoutResponse to the request inResponseTo of sp.
+func (idp *IdP) LogoutResponse(sp *ServiceProvider, inResponseTo, statusCode string, now time.Time) []byte {
+	response := newElement("samlp:LogoutResponse",
+		attr{"Destination", sp.SLOURL},
+		attr{"ID", newID()},
+		attr{"InResponseTo", inResponseTo},
+		attr{"IssueInstant", timestamp(now)},
+		attr{"Version", "2.0"},
+	).add(
+		newElement("saml:Issuer").withText(idp.EntityID),
+		status(statusCode),
+	)
+	return response.canonical()
+}
+
+func status(code string) *element {
+	return newElement("samlp:Status").add(newElement("samlp:StatusCode", attr{"Value", code}))
+}
@@ -0,0 +1,239 @@
+// Package saml makes ForIAM a SAML 2.0 identity provider for applications
+// that do not speak OpenID Connect. Each tenant is an IdP of its own with a
+// signing certificate and metadata; applications are registered as service
+// providers of a tenant. Authentication requests are accepted over the
+// HTTP-Redirect and HTTP-POST bindings, responses are sent over HTTP-POST
+// with a signed assertion, and single logout messages are exchanged over
+// HTTP-Redirect.
+//
+// For federated login ForIAM is also a service provider of upstream IdPs:
+// it sends AuthnRequests and verifies the signed responses posted back.
+package saml
+
+import (
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// XML namespaces.
+const (
+	NamespaceProtocol  = "urn:oasis:names:tc:SAML:2.0:protocol"
+	NamespaceAssertion = "urn:oasis:names:tc:SAML:2.0:assertion"
+	NamespaceMetadata  = "urn:oasis:names:tc:SAML:2.0:metadata"
+	NamespaceSignature = "http://www.w3.org/2000/09/xmldsig#"
+)
+
+// Bindings.
+const (
+	BindingRedirect = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-Redirect"
+	BindingPOST     = "urn:oasis:names:tc:SAML:2.0:bindings:HTTP-POST"
+)
+
+// Name ID formats.
+const (
+	NameIDFormatUnspecified = "urn:oasis:names:tc:SAML:1.1:nameid-format:unspecified"
+	NameIDFormatEmail       = "urn:oasis:names:tc:SAML:1.1:nameid-format:emailAddress"
+	NameIDFormatPersistent  = "urn:oasis:names:tc:SAML:2.0:nameid-format:persistent"
+	NameIDFormatTransient   = "urn:oasis:names:tc:SAML:2.0:nameid-format:transient"
+)
+
+// Status codes.
+const (
+	StatusSuccess   = "urn:oasis:names:tc:SAML:2.0:status:Success"
+	StatusRequester = "urn:oasis:names:tc:SAML:2.0:status:Requester"
+	StatusResponder = "urn:oasis:names:tc:SAML:2.0:status:Responder"
+)
+
+const (
+	attributeNameFormatBasic = "urn:oasis:names:tc:SAML:2.0:attrname-format:basic"
+	authnContextPassword     = "urn:oasis:names:tc:SAML:2.0:ac:classes:PasswordProtectedTransport"
+	confirmationBearer       = "urn:oasis:names:tc:SAML:2.0:cm:bearer"
+)
+
+// assertionLifetime is how long an assertion may be consumed; clockSkew is
+// how far its validity starts in the past, for service providers whose
+// clocks are behind.
+const (
+	assertionLifetime = 5 * time.Minute
+	clockSkew         = time.Minute
+)
+
+var (
+	ErrNotFound               = errors.New("service provider not found")
+	ErrInvalidServiceProvider = errors.New("invalid service provider")
+	ErrInvalidMessage         = errors.New("invalid SAML message")
+	ErrInvalidSignature       = errors.New("invalid SAML message signature")
+	ErrIdentityNotFound       = errors.New("user not found or inactive")
+	ErrLogoutNotFound         = errors.New("logout not found")
+)
+
+// ServiceProvider is an application of a tenant that signs users in with
+// SAML. Certificate, when set, is the PEM certificate the service provider
+// signs its requests with; requests must then be signed.
+type ServiceProvider struct {
+	ID                string            `json:"id"`
+	TenantID          string            `json:"tenant_id"`
+	Name              string            `json:"name"`
+	EntityID          string            `json:"entity_id"`
+	ACSURL            string            `json:"acs_url"`
+	SLOURL            string            `json:"slo_url"`
+	Certificate       string            `json:"certificate"`
+	NameIDFormat      string            `json:"name_id_format"`
+	AttributeMapping  map[string]string `json:"attribute_mapping"`
+	AllowIDPInitiated bool              `json:"allow_idp_initiated"`
+	IsActive          bool              `json:"is_active"`
+	CreatedAt         time.Time         `json:"created_at"`
+}
+
+// Source fields attributes can be mapped from. groups is multi-valued: the
+// names of the user's groups.
+var sourceFields = map[string]bool{
+	"id":           true,
+	"email":        true,
+	"external_id":  true,
+	"display_name": true,
+	"given_name":   true,
+	"family_name":  true,
+	"groups":       true,
+}
+
+var nameIDFormats = map[string]bool{
+	NameIDFormatUnspecified: true,
+	NameIDFormatEmail:       true,
+	NameIDFormatPersistent:  true,
+	NameIDFormatTransient:   true,
+}
+
+// DefaultAttributeMapping maps SAML attribute names to the fields of a user.
+func DefaultAttributeMapping() map[string]string {
+	return map[string]string{
+		"email":       "email",
+		"displayName": "display_name",
+		"givenName":   "given_name",
+		"surname":     "family_name",
+		"groups":      "groups",
+	}
+}
+
+// Validate checks sp and fills in the defaults: the email name ID format
+// and, when it has none, the default attribute mapping. An empty mapping
+// sends no attributes.
+func (sp *ServiceProvider) Validate() error {
+	if strings.TrimSpace(sp.Name) == "" {
+		return fmt.Errorf("%w: name is required", ErrInvalidServiceProvider)
+	}
+	if strings.TrimSpace(sp.EntityID) == "" {
+		return fmt.Errorf("%w: entity_id is required", ErrInvalidServiceProvider)
+	}
+	if !isHTTPURL(sp.ACSURL) {
+		return fmt.Errorf("%w: acs_url must be an http or https URL", ErrInvalidServiceProvider)
+	}
+	if sp.SLOURL != "" && !isHTTPURL(sp.SLOURL) {
+		return fmt.Errorf("%w: slo_url must be an http or https URL", ErrInvalidServiceProvider)
+	}
+	if sp.Certificate != "" {
+		if _, err := ParseCertificate(sp.Certificate); err != nil {
+			return fmt.Errorf("%w: %v", ErrInvalidServiceProvider, err)
+		}
+	}
+
+	if sp.NameIDFormat == "" {
+		sp.NameIDFormat = NameIDFormatEmail
+	}
+	if !nameIDFormats[sp.NameIDFormat] {
+		return fmt.Errorf("%w: unsupported name_id_format", ErrInvalidServiceProvider)
+	}
+
+	if sp.AttributeMapping == nil {
+		sp.AttributeMapping = DefaultAttributeMapping()
+	}
+	for attribute, field := range sp.AttributeMapping {
+		if strings.TrimSpace(attribute) == "" {
+			return fmt.Errorf("%w: attribute names must not be empty", ErrInvalidServiceProvider)
+		}
+		if !sourceFields[field] {
+			return fmt.Errorf("%w: unknown user field %q for %s", ErrInvalidServiceProvider, field, attribute)
+		}
+	}
+	return nil
+}
+
+func isHTTPURL(value string) bool {
+	u, err := url.Parse(value)
+	return err == nil && (u.Scheme == "https" || u.Scheme == "http") && u.Host != ""
+}
+
+// ParseCertificate parses a PEM encoded certificate.
+func ParseCertificate(data string) (*x509.Certificate, error) {
+	block, _ := pem.Decode([]byte(data))
+	if block == nil || block.Type != "CERTIFICATE" {
+		return nil, errors.New("certificate must be PEM encoded")
+	}
+	return x509.ParseCertificate(block.Bytes)
+}
+
+// Identity is what an assertion says about a user.
+type Identity struct {
+	UserID string
+	// Fields holds the single-valued source fields
+	Fields map[string]string
+	Groups []string
+}
+
+// Attribute is a SAML attribute of an assertion.
+type Attribute struct {
+	Name   string
+	Values []string
+}
+
+// Attributes maps identity onto the attributes of sp, sorted by name.
+// Attributes without a value are left out.
+func (sp *ServiceProvider) Attributes(identity *Identity) []Attribute {
+	attributes := []Attribute{}
+	for name, field := range sp.AttributeMapping {
+		var values []string
+		if field == "groups" {
+			values = identity.Groups
+		} else if value := identity.Fields[field]; value != "" {
+			values = []string{value}
+		}
+		if len(values) > 0 {
+			attributes = append(attributes, Attribute{Name: name, Values: values})
+		}
+	}
+	sort.Slice(attributes, func(i, j int) bool { return attributes[i].Name < attributes[j].Name })
+	return attributes
+}
+
+// NameID returns the subject of an assertion about identity: the email
+// address, or the user ID for persistent name IDs. Transient name IDs are
+// random and differ for every sign-in.
+func (sp *ServiceProvider) NameID(identity *Identity) string {
+	switch sp.NameIDFormat {
+	case NameIDFormatPersistent:
+		return identity.UserID
+	case NameIDFormatTransient:
+		return newID()
+	default:
+		return identity.Fields["email"]
+	}
+}
+
+// newID returns a random ID usable as an XML ID, which must not start with
+// a digit.
+func newID() string {
+	return "_" + uuid.NewString()
+}
+
+// timestamp formats t as an xs:dateTime in UTC.
+func timestamp(t time.Time) string {
+	return t.UTC().Format(time.RFC3339)
+}
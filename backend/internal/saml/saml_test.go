@@ -0,0 +1,215 @@
+package saml
+
+import (
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"errors"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestServiceProviderValidate(t *testing.T) {
+	sp := &ServiceProvider{Name: "Wiki", EntityID: "https://wiki.example/saml", ACSURL: "https://wiki.example/saml/acs"}
+	if err := sp.Validate(); err != nil {
+		t.Fatalf("Validate returned error: %v", err)
+	}
+	if sp.NameIDFormat != NameIDFormatEmail {
+		t.Errorf("Expected the email name ID format, got %s", sp.NameIDFormat)
+	}
+	if !reflect.DeepEqual(sp.AttributeMapping, DefaultAttributeMapping()) {
+		t.Errorf("Expected the default mapping, got %v", sp.AttributeMapping)
+	}
+
+	empty := &ServiceProvider{Name: "Wiki", EntityID: "wiki", ACSURL: "https://wiki.example/acs", AttributeMapping: map[string]string{}}
+	if err := empty.Validate(); err != nil || len(empty.AttributeMapping) != 0 {
+		t.Errorf("Expected an empty mapping to be kept, got %v (%v)", empty.AttributeMapping, err)
+	}
+
+	valid := ServiceProvider{Name: "Wiki", EntityID: "wiki", ACSURL: "https://wiki.example/acs"}
+	tests := []struct {
+		name   string
+		change func(sp *ServiceProvider)
+	}{
+		{"no name", func(sp *ServiceProvider) { sp.Name = " " }},
+		{"no entity ID", func(sp *ServiceProvider) { sp.EntityID = "" }},
+		{"relative ACS URL", func(sp *ServiceProvider) { sp.ACSURL = "/acs" }},
+		{"other SLO scheme", func(sp *ServiceProvider) { sp.SLOURL = "javascript:alert(1)" }},
+		{"bad certificate", func(sp *ServiceProvider) { sp.Certificate = "not a certificate" }},
+		{"unknown name ID format", func(sp *ServiceProvider) { sp.NameIDFormat = "urn:example:format" }},
+		{"unknown field", func(sp *ServiceProvider) { sp.AttributeMapping = map[string]string{"pw": "password_hash"} }},
+		{"empty attribute name", func(sp *ServiceProvider) { sp.AttributeMapping = map[string]string{"": "email"} }},
+	}
+	for _, tt := range tests {
+		sp := valid
+		tt.change(&sp)
+		if err := sp.Validate(); !errors.Is(err, ErrInvalidServiceProvider) {
+			t.Errorf("%s: expected ErrInvalidServiceProvider, got %v", tt.name, err)
+		}
+	}
+}
+
+func TestAttributesAndNameID(t *testing.T) {
+	identity := &Identity{
+		UserID: "5f0c",
+		Fields: map[string]string{"id": "5f0c", "email": "alice@example.com", "given_name": "Alice", "family_name": ""},
+		Groups: []string{"Engineering", "Admins"},
+	}
+	sp := &ServiceProvider{AttributeMapping: map[string]string{
+		"mail":     "email",
+		"first":    "given_name",
+		"last":     "family_name",
+		"memberOf": "groups",
+	}}
+
+	want := []Attribute{
+		{Name: "first", Values: []string{"Alice"}},
+		{Name: "mail", Values: []string{"alice@example.com"}},
+		{Name: "memberOf", Values: []string{"Engineering", "Admins"}},
+	}
+	if got := sp.Attributes(identity); !reflect.DeepEqual(got, want) {
+		t.Errorf("Attributes = %v, want %v", got, want)
+	}
+
+	sp.NameIDFormat = NameIDFormatEmail
+	if got := sp.NameID(identity); got != "alice@example.com" {
+		t.Errorf("Expected the email address as name ID, got %s", got)
+	}
+	sp.NameIDFormat = NameIDFormatPersistent
+	if got := sp.NameID(identity); got != "5f0c" {
+		t.Errorf("Expected the user ID as persistent name ID, got %s", got)
+	}
+	sp.NameIDFormat = NameIDFormatTransient
+	if a, b := sp.NameID(identity), sp.NameID(identity); a == b || a == "" {
+		t.Errorf("Expected different transient name IDs, got %s and %s", a, b)
+	}
+}
+
+func TestCanonicalRendering(t *testing.T) {
+	doc := newElement("samlp:Response", attr{"Version", "2.0"}, attr{"ID", "_1"}, attr{"Destination", `a"b&c<d>`}).add(
+		newElement("saml:Issuer").withText("x & y < z > \r"),
+		newElement("samlp:Status").add(newElement("samlp:StatusCode", attr{"Value", "ok"})),
+		newElement("saml:Assertion").add(newElement("saml:Subject")),
+	)
+
+	want := `<samlp:Response xmlns:samlp="urn:oasis:names:tc:SAML:2.0:protocol" Destination="a&quot;b&amp;c&lt;d>" ID="_1" Version="2.0">` +
+		`<saml:Issuer xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion">x &amp; y &lt; z &gt; &#xD;</saml:Issuer>` +
+		`<samlp:Status><samlp:StatusCode Value="ok"></samlp:StatusCode></samlp:Status>` +
+		`<saml:Assertion xmlns:saml="urn:oasis:names:tc:SAML:2.0:assertion"><saml:Subject></saml:Subject></saml:Assertion>` +
+		`</samlp:Response>`
+	if got := string(doc.canonical()); got != want {
+		t.Errorf("canonical =\n%s\nwant\n%s", got, want)
+	}
+
+	if got := escapeText("a\x00b\x1fc"); got != "abc" {
+		t.Errorf("Expected characters XML cannot hold to be dropped, got %q", got)
+	}
+}
+
+func TestResponseSignature(t *testing.T) {
+	credential, err := GenerateCredential("https://iam.example/saml/idp/t1/metadata")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := NewIdP("https://iam.example/", "t1", credential)
+	sp := &ServiceProvider{Name: "Wiki", EntityID: "https://wiki.example", ACSURL: "https://wiki.example/acs"}
+	if err := sp.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	encoded, err := idp.Response(&Login{
+		ServiceProvider: sp,
+		InResponseTo:    "_req1",
+		Identity:        &Identity{UserID: "u1", Fields: map[string]string{"email": "alice@example.com"}, Groups: []string{"Admins"}},
+		NameID:          "alice@example.com",
+		SessionIndex:    "_s1",
+	}, time.Now())
+	if err != nil {
+		t.Fatalf("Response returned error: %v", err)
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		t.Fatal(err)
+	}
+	document := string(data)
+
+	var parsed struct {
+		InResponseTo string `xml:"InResponseTo,attr"`
+		Assertion    struct {
+			Issuer  string `xml:"Issuer"`
+			Subject struct {
+				NameID string `xml:"NameID"`
+			} `xml:"Subject"`
+			Audience   string   `xml:"Conditions>AudienceRestriction>Audience"`
+			Attributes []string `xml:"AttributeStatement>Attribute>AttributeValue"`
+		} `xml:"urn:oasis:names:tc:SAML:2.0:assertion Assertion"`
+	}
+	if err := xml.Unmarshal(data, &parsed); err != nil {
+		t.Fatalf("Response is not well-formed: %v", err)
+	}
+	if parsed.InResponseTo != "_req1" || parsed.Assertion.Issuer != idp.EntityID ||
+		parsed.Assertion.Subject.NameID != "alice@example.com" || parsed.Assertion.Audience != "https://wiki.example" {
+		t.Errorf("Unexpected response: %+v", parsed)
+	}
+	if !reflect.DeepEqual(parsed.Assertion.Attributes, []string{"alice@example.com", "Admins"}) {
+		t.Errorf("Unexpected attribute values %v", parsed.Assertion.Attributes)
+	}
+
+	// Verify as a service provider would: the digest covers the assertion
+	// without its signature, the signature covers SignedInfo as the apex of
+	// its own document
+	start := strings.Index(document, "<saml:Assertion ")
+	end := strings.Index(document, "</saml:Assertion>") + len("</saml:Assertion>")
+	assertion := document[start:end]
+	signature := regexp.MustCompile(`<ds:Signature .*</ds:Signature>`).FindString(assertion)
+	if signature == "" {
+		t.Fatal("Expected the assertion to be signed")
+	}
+	digest := sha256.Sum256([]byte(strings.Replace(assertion, signature, "", 1)))
+	digestValue := regexp.MustCompile(`<ds:DigestValue>(.*)</ds:DigestValue>`).FindStringSubmatch(signature)[1]
+	if digestValue != base64.StdEncoding.EncodeToString(digest[:]) {
+		t.Error("DigestValue does not match the assertion")
+	}
+
+	signedInfo := regexp.MustCompile(`<ds:SignedInfo>.*</ds:SignedInfo>`).FindString(signature)
+	signedInfo = strings.Replace(signedInfo, "<ds:SignedInfo>", `<ds:SignedInfo xmlns:ds="`+NamespaceSignature+`">`, 1)
+	signatureValue, _ := base64.StdEncoding.DecodeString(regexp.MustCompile(`<ds:SignatureValue>(.*)</ds:SignatureValue>`).FindStringSubmatch(signature)[1])
+	sum := sha256.Sum256([]byte(signedInfo))
+	if err := rsa.VerifyPKCS1v15(&credential.Key.PublicKey, crypto.SHA256, sum[:], signatureValue); err != nil {
+		t.Errorf("SignatureValue does not verify: %v", err)
+	}
+}
+
+func TestMetadata(t *testing.T) {
+	credential, err := GenerateCredential("idp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := NewIdP("https://iam.example", "t1", credential)
+
+	var parsed struct {
+		EntityID    string `xml:"entityID,attr"`
+		Certificate string `xml:"IDPSSODescriptor>KeyDescriptor>KeyInfo>X509Data>X509Certificate"`
+		SSO         []struct {
+			Binding  string `xml:"Binding,attr"`
+			Location string `xml:"Location,attr"`
+		} `xml:"IDPSSODescriptor>SingleSignOnService"`
+	}
+	if err := xml.Unmarshal(idp.Metadata(), &parsed); err != nil {
+		t.Fatalf("Metadata is not well-formed: %v", err)
+	}
+	if parsed.EntityID != "https://iam.example/saml/idp/t1/metadata" {
+		t.Errorf("Unexpected entity ID %s", parsed.EntityID)
+	}
+	if parsed.Certificate != base64.StdEncoding.EncodeToString(credential.Certificate.Raw) {
+		t.Error("Expected the signing certificate in the metadata")
+	}
+	if len(parsed.SSO) != 2 || parsed.SSO[0].Location != "https://iam.example/saml/idp/t1/sso" {
+		t.Errorf("Unexpected SSO endpoints %+v", parsed.SSO)
+	}
+}
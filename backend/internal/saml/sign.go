@@ -0,0 +1,184 @@
+package saml
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// Algorithm identifiers of XML signatures.
+const (
+	algorithmExcC14N     = "http://www.w3.org/2001/10/xml-exc-c14n#"
+	algorithmEnveloped   = "http://www.w3.org/2000/09/xmldsig#enveloped-signature"
+	algorithmSHA256      = "http://www.w3.org/2001/04/xmlenc#sha256"
+	algorithmRSASHA256   = "http://www.w3.org/2001/04/xmldsig-more#rsa-sha256"
+	algorithmECDSASHA256 = "http://www.w3.org/2001/04/xmldsig-more#ecdsa-sha256"
+)
+
+const (
+	credentialKeyBits  = 2048
+	credentialValidity = 10 * 365 * 24 * time.Hour
+)
+
+// Credential is the key and self-signed certificate a tenant's IdP signs
+// with. Service providers get the certificate from the metadata.
+type Credential struct {
+	Key         *rsa.PrivateKey
+	Certificate *x509.Certificate
+}
+
+// GenerateCredential creates a key and a certificate for the IdP entityID.
+func GenerateCredential(entityID string) (*Credential, error) {
+	key, err := rsa.GenerateKey(rand.Reader, credentialKeyBits)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: entityID, Organization: []string{"ForIAM"}},
+		NotBefore:    now.Add(-clockSkew),
+		NotAfter:     now.Add(credentialValidity),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	return &Credential{Key: key, Certificate: cert}, nil
+}
+
+// CertificatePEM returns the certificate PEM encoded.
+func (c *Credential) CertificatePEM() string {
+	return string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: c.Certificate.Raw}))
+}
+
+func (c *Credential) certificateBase64() string {
+	return base64.StdEncoding.EncodeToString(c.Certificate.Raw)
+}
+
+func (c *Credential) sign(data []byte) ([]byte, error) {
+	digest := sha256.Sum256(data)
+	return rsa.SignPKCS1v15(rand.Reader, c.Key, crypto.SHA256, digest[:])
+}
+
+// keyInfo is the ds:KeyInfo carrying the certificate.
+func (c *Credential) keyInfo() *element {
+	return newElement("ds:KeyInfo").add(
+		newElement("ds:X509Data").add(
+			newElement("ds:X509Certificate").withText(c.certificateBase64()),
+		),
+	)
+}
+
+// signEnveloped signs e, which has an ID attribute, with an enveloped
+// signature inserted after its first child, the Issuer. e must not change
+// afterwards.
+func (c *Credential) signEnveloped(e *element) error {
+	digest := sha256.Sum256(e.canonical())
+
+	signedInfo := newElement("ds:SignedInfo").add(
+		newElement("ds:CanonicalizationMethod", attr{"Algorithm", algorithmExcC14N}),
+		newElement("ds:SignatureMethod", attr{"Algorithm", algorithmRSASHA256}),
+		newElement("ds:Reference", attr{"URI", "#" + e.attr("ID")}).add(
+			newElement("ds:Transforms").add(
+				newElement("ds:Transform", attr{"Algorithm", algorithmEnveloped}),
+				newElement("ds:Transform", attr{"Algorithm", algorithmExcC14N}),
+			),
+			newElement("ds:DigestMethod", attr{"Algorithm", algorithmSHA256}),
+			newElement("ds:DigestValue").withText(base64.StdEncoding.EncodeToString(digest[:])),
+		),
+	)
+	signature, err := c.sign(signedInfo.canonical())
+	if err != nil {
+		return err
+	}
+
+	e.insert(1, newElement("ds:Signature").add(
+		signedInfo,
+		newElement("ds:SignatureValue").withText(base64.StdEncoding.EncodeToString(signature)),
+		c.keyInfo(),
+	))
+	return nil
+}
+
+// RedirectURL returns location with a message added for the HTTP-Redirect
+// binding, signed as the binding specifies. param is SAMLRequest or
+// SAMLResponse.
+func (c *Credential) RedirectURL(location, param string, message []byte, relayState string) (string, error) {
+	encoded, err := EncodeRedirect(message)
+	if err != nil {
+		return "", err
+	}
+
+	query := param + "=" + url.QueryEscape(encoded)
+	if relayState != "" {
+		query += "&RelayState=" + url.QueryEscape(relayState)
+	}
+	query += "&SigAlg=" + url.QueryEscape(algorithmRSASHA256)
+	signature, err := c.sign([]byte(query))
+	if err != nil {
+		return "", err
+	}
+	query += "&Signature=" + url.QueryEscape(base64.StdEncoding.EncodeToString(signature))
+
+	separator := "?"
+	if strings.Contains(location, "?") {
+		separator = "&"
+	}
+	return location + separator + query, nil
+}
+
+// verifySignature checks a signature of the HTTP-Redirect binding made by
+// the key of cert.
+func verifySignature(cert *x509.Certificate, sigAlg string, signed, signature []byte) error {
+	digest := sha256.Sum256(signed)
+	switch sigAlg {
+	case algorithmRSASHA256:
+		key, ok := cert.PublicKey.(*rsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("%w: the certificate has no RSA key", ErrInvalidSignature)
+		}
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA256, digest[:], signature); err != nil {
+			return ErrInvalidSignature
+		}
+	case algorithmECDSASHA256:
+		key, ok := cert.PublicKey.(*ecdsa.PublicKey)
+		if !ok {
+			return fmt.Errorf("%w: the certificate has no EC key", ErrInvalidSignature)
+		}
+		// XML signatures hold r and s concatenated rather than DER
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if len(signature) != 2*size {
+			return ErrInvalidSignature
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, digest[:], r, s) {
+			return ErrInvalidSignature
+		}
+	default:
+		return fmt.Errorf("%w: unsupported algorithm %s", ErrInvalidSignature, sigAlg)
+	}
+	return nil
+}
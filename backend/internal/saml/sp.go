@@ -0,0 +1,190 @@
+package saml
+
+import (
+	"crypto/x509"
+	"fmt"
+	"time"
+)
+
+// NewAuthnRequest returns an AuthnRequest, and its ID, that ForIAM sends as
+// the service provider entityID to the IdP at destination. The response is
+// to be posted to acsURL.
+func NewAuthnRequest(entityID, acsURL, destination string, now time.Time) (string, []byte) {
+	id := newID()
+	request := newElement("samlp:AuthnRequest",
+		attr{"AssertionConsumerServiceURL", acsURL},
+		attr{"Destination", destination},
+		attr{"ID", id},
+		attr{"IssueInstant", timestamp(now)},
+		attr{"ProtocolBinding", BindingPOST},
+		attr{"Version", "2.0"},
+	).add(
+		newElement("saml:Issuer").withText(entityID),
+		newElement("samlp:NameIDPolicy", attr{"AllowCreate", "true"}),
+	)
+	return id, request.canonical()
+}
+
+// Assertion is what an upstream IdP asserted about a user in a response to
+// ForIAM. Attributes maps attribute names to their values.
+type Assertion struct {
+	Issuer       string
+	NameID       string
+	NameIDFormat string
+	SessionIndex string
+	Attributes   map[string][]string
+}
+
+// ResponseCheck describes the response ForIAM waits for as a service
+// provider after sending an AuthnRequest.
+type ResponseCheck struct {
+	// Issuer is the entity ID of the IdP and Certificate the one it signs
+	// with
+	Issuer      string
+	Certificate *x509.Certificate
+	// Audience is the entity ID of ForIAM as service provider and
+	// Destination the URL the response is posted to
+	Audience    string
+	Destination string
+	// InResponseTo is the ID of the AuthnRequest
+	InResponseTo string
+}
+
+// Parse verifies a Response and returns its assertion. Either the response
+// or the assertion must be signed by the IdP; the assertion must be meant
+// for this service provider and request, and valid at now. Encrypted
+// assertions are not supported.
+func (check *ResponseCheck) Parse(data []byte, now time.Time) (*Assertion, error) {
+	response, err := parseDocument(data)
+	if err != nil {
+		return nil, err
+	}
+	if !response.is(NamespaceProtocol, "Response") {
+		return nil, fmt.Errorf("%w: not a Response", ErrInvalidMessage)
+	}
+	switch {
+	case response.attr("Version") != "2.0":
+		return nil, fmt.Errorf("%w: Version must be 2.0", ErrInvalidMessage)
+	case response.attr("Destination") != "" && response.attr("Destination") != check.Destination:
+		return nil, fmt.Errorf("%w: Destination does not match", ErrInvalidMessage)
+	case response.attr("InResponseTo") != check.InResponseTo:
+		return nil, fmt.Errorf("%w: the response does not answer the request", ErrInvalidMessage)
+	}
+	if issuer := response.child(NamespaceAssertion, "Issuer"); issuer != nil && issuer.text() != check.Issuer {
+		return nil, fmt.Errorf("%w: unexpected Issuer", ErrInvalidMessage)
+	}
+	if code := response.child(NamespaceProtocol, "Status").child(NamespaceProtocol, "StatusCode").attr("Value"); code != StatusSuccess {
+		return nil, fmt.Errorf("%w: the IdP answered with status %s", ErrInvalidMessage, code)
+	}
+
+	responseSigned, err := response.verify(check.Certificate)
+	if err != nil {
+		return nil, err
+	}
+	if response.child(NamespaceAssertion, "EncryptedAssertion") != nil {
+		return nil, fmt.Errorf("%w: encrypted assertions are not supported", ErrInvalidMessage)
+	}
+	assertions := response.children(NamespaceAssertion, "Assertion")
+	if len(assertions) != 1 {
+		return nil, fmt.Errorf("%w: exactly one assertion is required", ErrInvalidMessage)
+	}
+	assertion := assertions[0]
+	assertionSigned, err := assertion.verify(check.Certificate)
+	if err != nil {
+		return nil, err
+	}
+	if !responseSigned && !assertionSigned {
+		return nil, fmt.Errorf("%w: neither the response nor the assertion is signed", ErrInvalidSignature)
+	}
+
+	return check.readAssertion(assertion, now)
+}
+
+// readAssertion checks the conditions of a verified assertion and reads it.
+func (check *ResponseCheck) readAssertion(assertion *node, now time.Time) (*Assertion, error) {
+	if assertion.attr("Version") != "2.0" {
+		return nil, fmt.Errorf("%w: Version must be 2.0", ErrInvalidMessage)
+	}
+	if assertion.child(NamespaceAssertion, "Issuer").text() != check.Issuer {
+		return nil, fmt.Errorf("%w: unexpected Issuer", ErrInvalidMessage)
+	}
+
+	subject := assertion.child(NamespaceAssertion, "Subject")
+	nameID := subject.child(NamespaceAssertion, "NameID")
+	result := &Assertion{
+		Issuer:       check.Issuer,
+		NameID:       nameID.text(),
+		NameIDFormat: nameID.attr("Format"),
+		SessionIndex: assertion.child(NamespaceAssertion, "AuthnStatement").attr("SessionIndex"),
+		Attributes:   map[string][]string{},
+	}
+	if result.NameID == "" {
+		return nil, fmt.Errorf("%w: NameID is missing", ErrInvalidMessage)
+	}
+
+	confirmed := false
+	for _, confirmation := range subject.children(NamespaceAssertion, "SubjectConfirmation") {
+		data := confirmation.child(NamespaceAssertion, "SubjectConfirmationData")
+		if confirmation.attr("Method") != confirmationBearer || data == nil {
+			continue
+		}
+		if data.attr("Recipient") != check.Destination || !before(now, data.attr("NotOnOrAfter")) {
+			continue
+		}
+		if inResponseTo := data.attr("InResponseTo"); inResponseTo != "" && inResponseTo != check.InResponseTo {
+			continue
+		}
+		confirmed = true
+		break
+	}
+	if !confirmed {
+		return nil, fmt.Errorf("%w: no bearer subject confirmation for this service provider", ErrInvalidMessage)
+	}
+
+	conditions := assertion.child(NamespaceAssertion, "Conditions")
+	if conditions != nil {
+		if notBefore := conditions.attr("NotBefore"); notBefore != "" && !after(now, notBefore) {
+			return nil, fmt.Errorf("%w: the assertion is not valid yet", ErrInvalidMessage)
+		}
+		if notOnOrAfter := conditions.attr("NotOnOrAfter"); notOnOrAfter != "" && !before(now, notOnOrAfter) {
+			return nil, fmt.Errorf("%w: the assertion has expired", ErrInvalidMessage)
+		}
+		for _, restriction := range conditions.children(NamespaceAssertion, "AudienceRestriction") {
+			found := false
+			for _, audience := range restriction.children(NamespaceAssertion, "Audience") {
+				if audience.text() == check.Audience {
+					found = true
+				}
+			}
+			if !found {
+				return nil, fmt.Errorf("%w: the assertion is meant for another audience", ErrInvalidMessage)
+			}
+		}
+	}
+
+	for _, statement := range assertion.children(NamespaceAssertion, "AttributeStatement") {
+		for _, attribute := range statement.children(NamespaceAssertion, "Attribute") {
+			name := attribute.attr("Name")
+			for _, value := range attribute.children(NamespaceAssertion, "AttributeValue") {
+				if text := value.text(); text != "" {
+					result.Attributes[name] = append(result.Attributes[name], text)
+				}
+			}
+		}
+	}
+	return result, nil
+}
+
+// before reports whether now, less the allowed clock skew, is before the
+// xs:dateTime value.
+func before(now time.Time, value string) bool {
+	t, err := time.Parse(time.RFC3339, value)
+	return err == nil && now.Add(-clockSkew).Before(t)
+}
+
+// after reports whether now, plus the allowed clock skew, is not before the
+// xs:dateTime value.
+func after(now time.Time, value string) bool {
+	t, err := time.Parse(time.RFC3339, value)
+	return err == nil && !now.Add(clockSkew).Before(t)
+}
@@ -0,0 +1,116 @@
+package saml
+
+import (
+	"encoding/base64"
+	"errors"
+	"reflect"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// upstreamResponse has a tenant IdP answer an AuthnRequest of ForIAM as
+// service provider, acting as the upstream IdP.
+func upstreamResponse(t *testing.T, idp *IdP, requestID string, now time.Time) string {
+	t.Helper()
+	sp := &ServiceProvider{Name: "ForIAM", EntityID: "https://iam.example/auth/federation/p1", ACSURL: "https://iam.example/auth/federation/p1/acs"}
+	if err := sp.Validate(); err != nil {
+		t.Fatal(err)
+	}
+	encoded, err := idp.Response(&Login{
+		ServiceProvider: sp,
+		InResponseTo:    requestID,
+		Identity:        &Identity{UserID: "u1", Fields: map[string]string{"email": "alice@corp.example", "given_name": "Alice"}, Groups: []string{"Staff", "Admins"}},
+		NameID:          "alice@corp.example",
+		SessionIndex:    "_s1",
+	}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := base64.StdEncoding.DecodeString(encoded)
+	return string(data)
+}
+
+func TestResponseCheck(t *testing.T) {
+	credential, err := GenerateCredential("upstream")
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp := NewIdP("https://corp.example", "t1", credential)
+	now := time.Now()
+	check := &ResponseCheck{
+		Issuer:       idp.EntityID,
+		Certificate:  credential.Certificate,
+		Audience:     "https://iam.example/auth/federation/p1",
+		Destination:  "https://iam.example/auth/federation/p1/acs",
+		InResponseTo: "_req1",
+	}
+	response := upstreamResponse(t, idp, "_req1", now)
+
+	assertion, err := check.Parse([]byte(response), now)
+	if err != nil {
+		t.Fatalf("Parse returned error: %v", err)
+	}
+	if assertion.NameID != "alice@corp.example" || assertion.NameIDFormat != NameIDFormatEmail || assertion.SessionIndex != "_s1" {
+		t.Errorf("Unexpected assertion %+v", assertion)
+	}
+	want := map[string][]string{"email": {"alice@corp.example"}, "givenName": {"Alice"}, "groups": {"Staff", "Admins"}}
+	if !reflect.DeepEqual(assertion.Attributes, want) {
+		t.Errorf("Attributes = %v, want %v", assertion.Attributes, want)
+	}
+
+	// Declarations moved to the document element and comments do not
+	// change the canonical form of the assertion
+	reformatted := strings.Replace(response, `<samlp:Response `,
+		`<samlp:Response xmlns:saml="`+NamespaceAssertion+`" xmlns:xs="http://www.w3.org/2001/XMLSchema" `, 1)
+	reformatted = strings.Replace(reformatted, "<saml:Subject>", "<saml:Subject><!-- user -->", 1)
+	if _, err := check.Parse([]byte(reformatted), now); err != nil {
+		t.Errorf("Expected a reformatted response to verify, got %v", err)
+	}
+
+	signature := regexp.MustCompile(`<ds:Signature .*</ds:Signature>`)
+	other, _ := GenerateCredential("other")
+	tests := []struct {
+		name     string
+		response string
+		check    func(c *ResponseCheck)
+		now      time.Time
+		err      error
+	}{
+		{"changed subject", strings.Replace(response, ">alice@corp.example</saml:NameID>", ">bob@corp.example</saml:NameID>", 1), nil, now, ErrInvalidSignature},
+		{"unsigned", signature.ReplaceAllString(response, ""), nil, now, ErrInvalidSignature},
+		{"other certificate", response, func(c *ResponseCheck) { c.Certificate = other.Certificate }, now, ErrInvalidSignature},
+		{"other request", response, func(c *ResponseCheck) { c.InResponseTo = "_req2" }, now, ErrInvalidMessage},
+		{"other audience", response, func(c *ResponseCheck) { c.Audience = "https://other.example" }, now, ErrInvalidMessage},
+		{"other destination", response, func(c *ResponseCheck) { c.Destination = "https://other.example/acs" }, now, ErrInvalidMessage},
+		{"other issuer", response, func(c *ResponseCheck) { c.Issuer = "https://other.example" }, now, ErrInvalidMessage},
+		{"expired", response, nil, now.Add(10 * time.Minute), ErrInvalidMessage},
+		{"not valid yet", response, nil, now.Add(-10 * time.Minute), ErrInvalidMessage},
+		{"failed status", strings.Replace(response, StatusSuccess, StatusResponder, 1), nil, now, ErrInvalidMessage},
+		{"DTD", `<!DOCTYPE r [<!ENTITY x "y">]>` + response, nil, now, ErrInvalidMessage},
+		{"wrapped assertion", strings.Replace(response, "</samlp:Response>",
+			"<samlp:Extensions>"+regexp.MustCompile(`<saml:Assertion .*</saml:Assertion>`).FindString(response)+"</samlp:Extensions></samlp:Response>", 1), nil, now, ErrInvalidMessage},
+	}
+	for _, tt := range tests {
+		c := *check
+		if tt.check != nil {
+			tt.check(&c)
+		}
+		if _, err := c.Parse([]byte(tt.response), tt.now); !errors.Is(err, tt.err) {
+			t.Errorf("%s: expected %v, got %v", tt.name, tt.err, err)
+		}
+	}
+}
+
+func TestNewAuthnRequest(t *testing.T) {
+	id, data := NewAuthnRequest("https://iam.example/auth/federation/p1", "https://iam.example/auth/federation/p1/acs", "https://corp.example/sso", time.Now())
+
+	req, err := ParseAuthnRequest(data, "https://corp.example/sso")
+	if err != nil {
+		t.Fatalf("ParseAuthnRequest returned error: %v", err)
+	}
+	if req.ID != id || req.Issuer != "https://iam.example/auth/federation/p1" || req.AssertionConsumerServiceURL != "https://iam.example/auth/federation/p1/acs" {
+		t.Errorf("Unexpected request %+v", req)
+	}
+}
@@ -0,0 +1,406 @@
+package saml
+
+import (
+	"crypto/x509"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/ForIAM/ForIAM/backend/internal/sealing"
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+// logoutTimeout is how long a single logout may take before it is given
+// up on.
+const logoutTimeout = time.Hour
+
+// Store keeps the service providers of tenants, the credentials of their
+// IdPs and the sessions users have at service providers. Private keys are
+// encrypted with a key derived from the server's encryption key.
+type Store struct {
+	db  *sql.DB
+	box *sealing.Box
+}
+
+func NewStore(db *sql.DB, encryptionKey string) *Store {
+	return &Store{db: db, box: sealing.New(encryptionKey, sealing.PurposeSAMLCredential)}
+}
+
+// Credential returns the credential of the IdP of tenantID, creating it on
+// first use.
+func (s *Store) Credential(tenantID, entityID string) (*Credential, error) {
+	credential, err := s.loadCredential(tenantID)
+	if err != sql.ErrNoRows {
+		return credential, err
+	}
+
+	credential, err = GenerateCredential(entityID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to generate credential: %w", err)
+	}
+	sealed, err := s.box.Seal(x509.MarshalPKCS1PrivateKey(credential.Key))
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt credential: %w", err)
+	}
+	// Another instance may have created one meanwhile; all use the first
+	_, err = s.db.Exec(`
+		INSERT INTO saml_idp_credentials (tenant_id, private_key_encrypted, certificate)
+		VALUES ($1, $2, $3)
+		ON CONFLICT (tenant_id) DO NOTHING
+	`, tenantID, sealed, credential.Certificate.Raw)
+	if err != nil {
+		return nil, fmt.Errorf("failed to save credential: %w", err)
+	}
+	return s.loadCredential(tenantID)
+}
+
+func (s *Store) loadCredential(tenantID string) (*Credential, error) {
+	var sealed, der []byte
+	err := s.db.QueryRow(`
+		SELECT private_key_encrypted, certificate FROM saml_idp_credentials WHERE tenant_id = $1
+	`, tenantID).Scan(&sealed, &der)
+	if err != nil {
+		return nil, err
+	}
+
+	plaintext, err := s.box.Open(sealed)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt credential: %w", err)
+	}
+	key, err := x509.ParsePKCS1PrivateKey(plaintext)
+	if err != nil {
+		return nil, fmt.Errorf("invalid credential key: %w", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, fmt.Errorf("invalid credential certificate: %w", err)
+	}
+	return &Credential{Key: key, Certificate: cert}, nil
+}
+
+const serviceProviderColumns = `id, tenant_id, name, entity_id, acs_url, slo_url, certificate, name_id_format,
+	attribute_mapping, allow_idp_initiated, is_active, created_at`
+
+func scanServiceProvider(row interface{ Scan(...interface{}) error }) (*ServiceProvider, error) {
+	var (
+		sp      ServiceProvider
+		mapping []byte
+	)
+	err := row.Scan(&sp.ID, &sp.TenantID, &sp.Name, &sp.EntityID, &sp.ACSURL, &sp.SLOURL, &sp.Certificate,
+		&sp.NameIDFormat, &mapping, &sp.AllowIDPInitiated, &sp.IsActive, &sp.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(mapping, &sp.AttributeMapping); err != nil {
+		return nil, fmt.Errorf("invalid attribute mapping: %w", err)
+	}
+	return &sp, nil
+}
+
+// List returns the service providers of tenantID.
+func (s *Store) List(tenantID string) ([]*ServiceProvider, error) {
+	rows, err := s.db.Query(`
+		SELECT `+serviceProviderColumns+` FROM saml_service_providers
+		WHERE tenant_id = $1 ORDER BY created_at
+	`, tenantID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list service providers: %w", err)
+	}
+	defer rows.Close()
+
+	sps := []*ServiceProvider{}
+	for rows.Next() {
+		sp, err := scanServiceProvider(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan service provider: %w", err)
+		}
+		sps = append(sps, sp)
+	}
+	return sps, rows.Err()
+}
+
+// Get loads a service provider of tenantID.
+func (s *Store) Get(tenantID, id string) (*ServiceProvider, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return nil, ErrNotFound
+	}
+	return s.get(`id = $1 AND tenant_id = $2`, id, tenantID)
+}
+
+// GetByEntityID loads the service provider of tenantID with entityID.
+func (s *Store) GetByEntityID(tenantID, entityID string) (*ServiceProvider, error) {
+	return s.get(`entity_id = $1 AND tenant_id = $2`, entityID, tenantID)
+}
+
+func (s *Store) get(where string, args ...interface{}) (*ServiceProvider, error) {
+	sp, err := scanServiceProvider(s.db.QueryRow(`
+		SELECT `+serviceProviderColumns+` FROM saml_service_providers WHERE `+where, args...))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load service provider: %w", err)
+	}
+	return sp, nil
+}
+
+// Create validates and adds sp.
+func (s *Store) Create(sp *ServiceProvider) error {
+	if err := sp.Validate(); err != nil {
+		return err
+	}
+	mapping, _ := json.Marshal(sp.AttributeMapping)
+
+	err := s.db.QueryRow(`
+		INSERT INTO saml_service_providers (tenant_id, name, entity_id, acs_url, slo_url, certificate, name_id_format,
+			attribute_mapping, allow_idp_initiated, is_active)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10)
+		RETURNING id, created_at
+	`, sp.TenantID, sp.Name, sp.EntityID, sp.ACSURL, sp.SLOURL, sp.Certificate, sp.NameIDFormat,
+		mapping, sp.AllowIDPInitiated, sp.IsActive).Scan(&sp.ID, &sp.CreatedAt)
+	if err != nil {
+		return fmt.Errorf("failed to create service provider: %w", err)
+	}
+	return nil
+}
+
+// Update validates and saves sp.
+func (s *Store) Update(sp *ServiceProvider) error {
+	if err := sp.Validate(); err != nil {
+		return err
+	}
+	mapping, _ := json.Marshal(sp.AttributeMapping)
+
+	result, err := s.db.Exec(`
+		UPDATE saml_service_providers
+		SET name = $1, entity_id = $2, acs_url = $3, slo_url = $4, certificate = $5, name_id_format = $6,
+			attribute_mapping = $7, allow_idp_initiated = $8, is_active = $9
+		WHERE id = $10 AND tenant_id = $11
+	`, sp.Name, sp.EntityID, sp.ACSURL, sp.SLOURL, sp.Certificate, sp.NameIDFormat,
+		mapping, sp.AllowIDPInitiated, sp.IsActive, sp.ID, sp.TenantID)
+	if err != nil {
+		return fmt.Errorf("failed to update service provider: %w", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Delete removes a service provider and the sessions users have there.
+func (s *Store) Delete(tenantID, id string) error {
+	if _, err := uuid.Parse(id); err != nil {
+		return ErrNotFound
+	}
+	result, err := s.db.Exec(`DELETE FROM saml_service_providers WHERE id = $1 AND tenant_id = $2`, id, tenantID)
+	if err != nil {
+		return fmt.Errorf("failed to delete service provider: %w", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// Identity loads what assertions say about an active user of tenantID.
+func (s *Store) Identity(tenantID, userID string) (*Identity, error) {
+	var (
+		identity                                           = Identity{UserID: userID}
+		email, externalID, displayName, givenName, surname string
+	)
+	err := s.db.QueryRow(`
+		SELECT u.email, u.external_id, u.display_name, u.given_name, u.family_name, ARRAY(
+			SELECT g.name FROM user_groups ug JOIN groups g ON g.id = ug.group_id
+			WHERE ug.user_id = u.id AND g.tenant_id = u.tenant_id
+			ORDER BY g.name
+		)
+		FROM users u
+		WHERE u.id = $1 AND u.tenant_id = $2 AND u.principal_type = 'user' AND COALESCE(u.is_active, TRUE)
+	`, userID, tenantID).Scan(&email, &externalID, &displayName, &givenName, &surname, pq.Array(&identity.Groups))
+	if err == sql.ErrNoRows {
+		return nil, ErrIdentityNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load user: %w", err)
+	}
+	identity.Fields = map[string]string{
+		"id":           userID,
+		"email":        email,
+		"external_id":  externalID,
+		"display_name": displayName,
+		"given_name":   givenName,
+		"family_name":  surname,
+	}
+	return &identity, nil
+}
+
+// Session is a sign-in of a user at a service provider. Its ID is the
+// SessionIndex of the assertion.
+type Session struct {
+	ID              string
+	UserID          string
+	NameID          string
+	ServiceProvider *ServiceProvider
+}
+
+// StartSession records that a user signed in at sp as nameID, for ttl at
+// most, and returns the session index.
+func (s *Store) StartSession(sp *ServiceProvider, userID, nameID string, ttl time.Duration) (string, error) {
+	if _, err := s.db.Exec(`DELETE FROM saml_sessions WHERE expires_at < NOW()`); err != nil {
+		return "", fmt.Errorf("failed to prune sessions: %w", err)
+	}
+
+	index := newID()
+	_, err := s.db.Exec(`
+		INSERT INTO saml_sessions (session_index, tenant_id, user_id, service_provider_id, name_id, expires_at)
+		VALUES ($1, $2, $3, $4, $5, NOW() + make_interval(secs => $6))
+	`, index, sp.TenantID, userID, sp.ID, nameID, ttl.Seconds())
+	if err != nil {
+		return "", fmt.Errorf("failed to start session: %w", err)
+	}
+	return index, nil
+}
+
+// Logout is a single logout in progress: the IdP asks each service provider
+// the user has a session with to end it, one after the other, then answers
+// the service provider that asked for the logout.
+type Logout struct {
+	ID                string
+	TenantID          string
+	UserID            string
+	ServiceProviderID string
+	RequestID         string
+	RelayState        string
+}
+
+// StartLogout starts the logout req of sp asks for and ends the sessions
+// the user has at sp. It returns nil when the user has no session there.
+func (s *Store) StartLogout(sp *ServiceProvider, req *LogoutRequest, relayState string) (*Logout, error) {
+	if _, err := s.db.Exec(`
+		DELETE FROM saml_logouts WHERE created_at < NOW() - make_interval(secs => $1)
+	`, logoutTimeout.Seconds()); err != nil {
+		return nil, fmt.Errorf("failed to prune logouts: %w", err)
+	}
+
+	logout := &Logout{TenantID: sp.TenantID, ServiceProviderID: sp.ID, RequestID: req.ID, RelayState: relayState}
+	err := s.db.QueryRow(`
+		SELECT user_id FROM saml_sessions
+		WHERE service_provider_id = $1 AND name_id = $2 AND (cardinality($3::text[]) = 0 OR session_index = ANY($3))
+		LIMIT 1
+	`, sp.ID, req.NameID, pq.Array(req.SessionIndex)).Scan(&logout.UserID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load session: %w", err)
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// All sessions of the user at sp end with the logout
+	_, err = tx.Exec(`
+		DELETE FROM saml_sessions WHERE service_provider_id = $1 AND user_id = $2
+	`, sp.ID, logout.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to end sessions: %w", err)
+	}
+
+	err = tx.QueryRow(`
+		INSERT INTO saml_logouts (tenant_id, user_id, service_provider_id, request_id, relay_state)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id
+	`, logout.TenantID, logout.UserID, logout.ServiceProviderID, logout.RequestID, logout.RelayState).Scan(&logout.ID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to start logout: %w", err)
+	}
+	return logout, tx.Commit()
+}
+
+// NextSession returns the next session logout has to end, or nil when
+// there is none left. Sessions at service providers without a single logout
+// URL, or no longer active, are dropped without asking them.
+func (s *Store) NextSession(logout *Logout) (*Session, error) {
+	_, err := s.db.Exec(`
+		DELETE FROM saml_sessions s USING saml_service_providers sp
+		WHERE s.service_provider_id = sp.id AND s.user_id = $1 AND (sp.slo_url = '' OR NOT sp.is_active)
+	`, logout.UserID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to end sessions: %w", err)
+	}
+
+	var (
+		session Session
+		spID    string
+	)
+	err = s.db.QueryRow(`
+		SELECT session_index, name_id, service_provider_id FROM saml_sessions
+		WHERE user_id = $1 AND logout_id IS NULL
+		ORDER BY created_at LIMIT 1
+	`, logout.UserID).Scan(&session.ID, &session.NameID, &spID)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load session: %w", err)
+	}
+	session.UserID = logout.UserID
+	if session.ServiceProvider, err = s.Get(logout.TenantID, spID); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// AwaitLogout records that logout sent the LogoutRequest requestID to end
+// session.
+func (s *Store) AwaitLogout(logout *Logout, session *Session, requestID string) error {
+	_, err := s.db.Exec(`
+		UPDATE saml_sessions SET logout_id = $1, logout_request_id = $2 WHERE session_index = $3
+	`, logout.ID, requestID, session.ID)
+	if err != nil {
+		return fmt.Errorf("failed to save logout request: %w", err)
+	}
+	return nil
+}
+
+// ContinueLogout ends the session the LogoutRequest requestID of sp was
+// sent for and returns the logout it belongs to.
+func (s *Store) ContinueLogout(sp *ServiceProvider, requestID string) (*Logout, error) {
+	var logoutID sql.NullString
+	err := s.db.QueryRow(`
+		DELETE FROM saml_sessions WHERE service_provider_id = $1 AND logout_request_id = $2
+		RETURNING logout_id
+	`, sp.ID, requestID).Scan(&logoutID)
+	if err == sql.ErrNoRows || (err == nil && !logoutID.Valid) {
+		return nil, ErrLogoutNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to end session: %w", err)
+	}
+
+	logout := &Logout{ID: logoutID.String}
+	err = s.db.QueryRow(`
+		SELECT tenant_id, user_id, service_provider_id, request_id, relay_state FROM saml_logouts WHERE id = $1
+	`, logout.ID).Scan(&logout.TenantID, &logout.UserID, &logout.ServiceProviderID, &logout.RequestID, &logout.RelayState)
+	if err == sql.ErrNoRows {
+		return nil, ErrLogoutNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load logout: %w", err)
+	}
+	return logout, nil
+}
+
+// FinishLogout forgets a logout once the service provider that asked for
+// it is answered.
+func (s *Store) FinishLogout(logout *Logout) error {
+	if _, err := s.db.Exec(`DELETE FROM saml_logouts WHERE id = $1`, logout.ID); err != nil {
+		return fmt.Errorf("failed to finish logout: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package saml
+
+import (
+	"bytes"
+	"crypto/x509"
+	"database/sql/driver"
+	"testing"
+
+	"github.com/ForIAM/ForIAM/backend/internal/dbtest"
+)
+
+func TestCredentialCreatedOnceAndSealed(t *testing.T) {
+	db, script := dbtest.Open(t)
+	var stored []driver.Value
+	script.OnArgs("SELECT private_key_encrypted, certificate FROM saml_idp_credentials", nil, func([]driver.Value) [][]driver.Value {
+		if stored == nil {
+			return nil
+		}
+		return [][]driver.Value{stored}
+	})
+	inserts := 0
+	script.OnArgs("INSERT INTO saml_idp_credentials", nil, func(args []driver.Value) [][]driver.Value {
+		inserts++
+		stored = []driver.Value{args[1], args[2]}
+		return [][]driver.Value{{}}
+	})
+
+	store := NewStore(db, "key")
+	credential, err := store.Credential("tenant-1", "https://idp.example/saml/idp/tenant-1")
+	if err != nil {
+		t.Fatalf("Credential returned error: %v", err)
+	}
+	if sealed, _ := stored[0].([]byte); bytes.Contains(sealed, x509.MarshalPKCS1PrivateKey(credential.Key)) {
+		t.Error("Expected the private key to be stored sealed")
+	}
+
+	again, err := store.Credential("tenant-1", "https://idp.example/saml/idp/tenant-1")
+	if err != nil {
+		t.Fatalf("Credential returned error: %v", err)
+	}
+	if inserts != 1 || !again.Key.Equal(credential.Key) || !again.Certificate.Equal(credential.Certificate) {
+		t.Errorf("Expected the stored credential to be reused, %d created", inserts)
+	}
+	if _, err := NewStore(db, "other key").Credential("tenant-1", "https://idp.example/saml/idp/tenant-1"); err == nil {
+		t.Error("Expected another encryption key not to open the private key")
+	}
+}
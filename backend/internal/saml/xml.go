@@ -0,0 +1,145 @@
+package saml
+
+import (
+	"sort"
+	"strings"
+	"unicode/utf8"
+)
+
+// Namespaces of the prefixes used in the documents ForIAM writes.
+var namespaces = map[string]string{
+	"samlp": NamespaceProtocol,
+	"saml":  NamespaceAssertion,
+	"md":    NamespaceMetadata,
+	"ds":    NamespaceSignature,
+}
+
+// element is a node of a document ForIAM writes. Documents are rendered
+// directly in exclusive canonical form (xml-exc-c14n#): no XML declaration,
+// no whitespace between elements, sorted attributes, start and end tags for
+// empty elements, and namespaces declared on the first element of a subtree
+// using them. So the bytes of a subtree are the bytes a verifier
+// canonicalizes it to, and signatures can be computed without a c14n
+// implementation.
+type element struct {
+	// name is prefix:local; the prefix must be one of namespaces
+	name     string
+	attrs    []attr
+	children []*element
+	text     string
+}
+
+// attr is an unqualified attribute.
+type attr struct {
+	name, value string
+}
+
+func newElement(name string, attrs ...attr) *element {
+	return &element{name: name, attrs: attrs}
+}
+
+// add appends children and returns e.
+func (e *element) add(children ...*element) *element {
+	e.children = append(e.children, children...)
+	return e
+}
+
+// withText sets the text content of e and returns it.
+func (e *element) withText(text string) *element {
+	e.text = text
+	return e
+}
+
+// insert adds child at index i.
+func (e *element) insert(i int, child *element) {
+	e.children = append(e.children, nil)
+	copy(e.children[i+1:], e.children[i:])
+	e.children[i] = child
+}
+
+// attr returns the value of the attribute name.
+func (e *element) attr(name string) string {
+	for _, a := range e.attrs {
+		if a.name == name {
+			return a.value
+		}
+	}
+	return ""
+}
+
+// canonical renders e as the apex of a document subset.
+func (e *element) canonical() []byte {
+	var b strings.Builder
+	e.render(&b, map[string]string{})
+	return []byte(b.String())
+}
+
+// render writes e; inScope holds the namespaces already declared by
+// ancestors.
+func (e *element) render(b *strings.Builder, inScope map[string]string) {
+	prefix := e.name[:strings.IndexByte(e.name, ':')]
+	uri := namespaces[prefix]
+
+	b.WriteByte('<')
+	b.WriteString(e.name)
+	if inScope[prefix] != uri {
+		b.WriteString(` xmlns:` + prefix + `="`)
+		b.WriteString(escapeAttr(uri))
+		b.WriteByte('"')
+
+		scope := make(map[string]string, len(inScope)+1)
+		for p, u := range inScope {
+			scope[p] = u
+		}
+		scope[prefix] = uri
+		inScope = scope
+	}
+
+	attrs := append([]attr(nil), e.attrs...)
+	sort.Slice(attrs, func(i, j int) bool { return attrs[i].name < attrs[j].name })
+	for _, a := range attrs {
+		b.WriteString(" " + a.name + `="`)
+		b.WriteString(escapeAttr(a.value))
+		b.WriteByte('"')
+	}
+	b.WriteByte('>')
+
+	b.WriteString(escapeText(e.text))
+	for _, child := range e.children {
+		child.render(b, inScope)
+	}
+	b.WriteString("</" + e.name + ">")
+}
+
+var (
+	textEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;", "\r", "&#xD;")
+	attrEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", `"`, "&quot;", "\t", "&#x9;", "\n", "&#xA;", "\r", "&#xD;")
+)
+
+func escapeText(s string) string {
+	return textEscaper.Replace(xmlChars(s))
+}
+
+func escapeAttr(s string) string {
+	return attrEscaper.Replace(xmlChars(s))
+}
+
+// xmlChars drops the characters XML 1.0 cannot represent, so user data
+// never makes a document malformed.
+func xmlChars(s string) string {
+	valid := func(r rune) bool {
+		return r == '\t' || r == '\n' || r == '\r' ||
+			(r >= 0x20 && r <= 0xD7FF) || (r >= 0xE000 && r <= 0xFFFD) || r >= 0x10000
+	}
+	for _, r := range s {
+		if r == utf8.RuneError || !valid(r) {
+			return strings.Map(func(r rune) rune {
+				if r == utf8.RuneError || !valid(r) {
+					return -1
+				}
+				return r
+			}, s)
+		}
+	}
+	return s
+}
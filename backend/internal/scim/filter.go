@@ -0,0 +1,456 @@
+package scim
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Filter is a parsed filter expression (RFC 7644 section 3.4.2.2). Logical
+// nodes have Op "and", "or" or "not" and operands in Left and Right;
+// comparisons have a lower-cased Attribute, an operator such as "eq" or "pr"
+// and a Value that is a string, float64, bool or nil.
+type Filter struct {
+	Op        string
+	Left      *Filter
+	Right     *Filter
+	Attribute string
+	Value     interface{}
+}
+
+var comparisonOperators = map[string]bool{
+	"eq": true, "ne": true, "co": true, "sw": true, "ew": true,
+	"gt": true, "ge": true, "lt": true, "le": true, "pr": true,
+}
+
+// schemaPrefixes may qualify attribute names, e.g.
+// urn:ietf:params:scim:schemas:core:2.0:User:userName.
+var schemaPrefixes = []string{strings.ToLower(SchemaUser) + ":", strings.ToLower(SchemaGroup) + ":"}
+
+// ParseFilter parses a filter. Value paths such as emails[type eq "work"]
+// are flattened into comparisons of emails.type.
+func ParseFilter(input string) (*Filter, error) {
+	tokens, err := tokenize(input)
+	if err != nil {
+		return nil, err
+	}
+	p := &parser{tokens: tokens}
+	filter, err := p.parseOr("")
+	if err != nil {
+		return nil, err
+	}
+	if !p.done() {
+		return nil, badRequest(ErrorInvalidFilter, "unexpected %q in filter", p.peek().text)
+	}
+	return filter, nil
+}
+
+type tokenKind int
+
+const (
+	tokenWord tokenKind = iota
+	tokenString
+	tokenSymbol
+)
+
+type filterToken struct {
+	kind tokenKind
+	text string
+}
+
+func tokenize(input string) ([]filterToken, error) {
+	var tokens []filterToken
+	for i := 0; i < len(input); {
+		ch := input[i]
+		switch {
+		case ch == ' ' || ch == '\t':
+			i++
+		case strings.IndexByte("()[]", ch) >= 0:
+			tokens = append(tokens, filterToken{tokenSymbol, string(ch)})
+			i++
+		case ch == '"':
+			end := i + 1
+			for end < len(input) && input[end] != '"' {
+				if input[end] == '\\' {
+					end++
+				}
+				end++
+			}
+			if end >= len(input) {
+				return nil, badRequest(ErrorInvalidFilter, "unterminated string in filter")
+			}
+			var value string
+			if err := json.Unmarshal([]byte(input[i:end+1]), &value); err != nil {
+				return nil, badRequest(ErrorInvalidFilter, "invalid string in filter")
+			}
+			tokens = append(tokens, filterToken{tokenString, value})
+			i = end + 1
+		default:
+			end := i
+			for end < len(input) && strings.IndexByte(" \t()[]\"", input[end]) < 0 {
+				end++
+			}
+			tokens = append(tokens, filterToken{tokenWord, input[i:end]})
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+type parser struct {
+	tokens []filterToken
+	pos    int
+}
+
+func (p *parser) done() bool {
+	return p.pos >= len(p.tokens)
+}
+
+func (p *parser) peek() filterToken {
+	if p.done() {
+		return filterToken{}
+	}
+	return p.tokens[p.pos]
+}
+
+// keyword reports whether the next token is the word keyword, consuming it
+// if so.
+func (p *parser) keyword(keyword string) bool {
+	if t := p.peek(); t.kind == tokenWord && strings.EqualFold(t.text, keyword) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) symbol(symbol string) bool {
+	if t := p.peek(); t.kind == tokenSymbol && t.text == symbol {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *parser) expect(symbol string) error {
+	if !p.symbol(symbol) {
+		return badRequest(ErrorInvalidFilter, "expected %q in filter", symbol)
+	}
+	return nil
+}
+
+func (p *parser) parseOr(prefix string) (*Filter, error) {
+	left, err := p.parseAnd(prefix)
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("or") {
+		right, err := p.parseAnd(prefix)
+		if err != nil {
+			return nil, err
+		}
+		left = &Filter{Op: "or", Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseAnd(prefix string) (*Filter, error) {
+	left, err := p.parseFactor(prefix)
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("and") {
+		right, err := p.parseFactor(prefix)
+		if err != nil {
+			return nil, err
+		}
+		left = &Filter{Op: "and", Left: left, Right: right}
+	}
+	return left, nil
+}
+
+func (p *parser) parseFactor(prefix string) (*Filter, error) {
+	if p.keyword("not") {
+		if err := p.expect("("); err != nil {
+			return nil, err
+		}
+		inner, err := p.parseOr(prefix)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return &Filter{Op: "not", Left: inner}, nil
+	}
+	if p.symbol("(") {
+		inner, err := p.parseOr(prefix)
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect(")"); err != nil {
+			return nil, err
+		}
+		return inner, nil
+	}
+	return p.parseComparison(prefix)
+}
+
+func (p *parser) parseComparison(prefix string) (*Filter, error) {
+	t := p.peek()
+	if t.kind != tokenWord {
+		return nil, badRequest(ErrorInvalidFilter, "expected an attribute in filter")
+	}
+	p.pos++
+	attribute := prefix + normalizeAttribute(t.text)
+
+	if p.symbol("[") {
+		if prefix != "" {
+			return nil, badRequest(ErrorInvalidFilter, "value paths cannot be nested")
+		}
+		inner, err := p.parseOr(attribute + ".")
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("]"); err != nil {
+			return nil, err
+		}
+		return inner, nil
+	}
+
+	op := strings.ToLower(p.peek().text)
+	if p.peek().kind != tokenWord || !comparisonOperators[op] {
+		return nil, badRequest(ErrorInvalidFilter, "expected an operator after %q", t.text)
+	}
+	p.pos++
+	if op == "pr" {
+		return &Filter{Op: op, Attribute: attribute}, nil
+	}
+
+	value, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	return &Filter{Op: op, Attribute: attribute, Value: value}, nil
+}
+
+func (p *parser) parseValue() (interface{}, error) {
+	t := p.peek()
+	p.pos++
+	switch {
+	case t.kind == tokenString:
+		return t.text, nil
+	case t.kind != tokenWord:
+		return nil, badRequest(ErrorInvalidFilter, "expected a value in filter")
+	case t.text == "true":
+		return true, nil
+	case t.text == "false":
+		return false, nil
+	case t.text == "null":
+		return nil, nil
+	}
+	number, err := strconv.ParseFloat(t.text, 64)
+	if err != nil {
+		return nil, badRequest(ErrorInvalidFilter, "invalid value %q in filter", t.text)
+	}
+	return number, nil
+}
+
+// normalizeAttribute lower-cases an attribute path and strips the core
+// schema prefix, as attribute names are case insensitive.
+func normalizeAttribute(name string) string {
+	name = strings.ToLower(name)
+	for _, prefix := range schemaPrefixes {
+		name = strings.TrimPrefix(name, prefix)
+	}
+	return name
+}
+
+// AttributeType is the SCIM type of a filterable attribute.
+type AttributeType int
+
+const (
+	TypeString AttributeType = iota
+	TypeBoolean
+	TypeDateTime
+	// TypeReferences is a multi-valued attribute whose SQL expression is a
+	// text array, such as the IDs of the members of a group
+	TypeReferences
+)
+
+// Attribute maps a filterable attribute onto a SQL expression.
+type Attribute struct {
+	Column    string
+	Type      AttributeType
+	CaseExact bool
+}
+
+// SQL renders f as a SQL condition over attributes. Values are appended to
+// args and referenced as $n placeholders.
+func (f *Filter) SQL(attributes map[string]Attribute, args *[]interface{}) (string, error) {
+	switch f.Op {
+	case "and", "or":
+		left, err := f.Left.SQL(attributes, args)
+		if err != nil {
+			return "", err
+		}
+		right, err := f.Right.SQL(attributes, args)
+		if err != nil {
+			return "", err
+		}
+		return "(" + left + " " + strings.ToUpper(f.Op) + " " + right + ")", nil
+	case "not":
+		inner, err := f.Left.SQL(attributes, args)
+		if err != nil {
+			return "", err
+		}
+		return "NOT COALESCE(" + inner + ", false)", nil
+	}
+
+	attribute, ok := attributes[f.Attribute]
+	if !ok {
+		return "", badRequest(ErrorInvalidFilter, "filtering on %q is not supported", f.Attribute)
+	}
+	column := attribute.Column
+
+	if f.Op == "pr" {
+		switch attribute.Type {
+		case TypeString:
+			return "(" + column + " IS NOT NULL AND " + column + " <> '')", nil
+		case TypeReferences:
+			return "cardinality(" + column + ") > 0", nil
+		}
+		return column + " IS NOT NULL", nil
+	}
+
+	if f.Value == nil {
+		switch f.Op {
+		case "eq":
+			return column + " IS NULL", nil
+		case "ne":
+			return column + " IS NOT NULL", nil
+		}
+		return "", badRequest(ErrorInvalidFilter, "null can only be compared with eq or ne")
+	}
+
+	placeholder := func(value interface{}) string {
+		*args = append(*args, value)
+		return "$" + strconv.Itoa(len(*args))
+	}
+
+	switch attribute.Type {
+	case TypeBoolean:
+		value, ok := f.Value.(bool)
+		if !ok || (f.Op != "eq" && f.Op != "ne") {
+			return "", badRequest(ErrorInvalidFilter, "%q is a boolean and can only be compared with eq or ne", f.Attribute)
+		}
+		if f.Op == "eq" {
+			return column + " = " + placeholder(value), nil
+		}
+		return column + " IS DISTINCT FROM " + placeholder(value), nil
+
+	case TypeDateTime:
+		text, _ := f.Value.(string)
+		value, err := time.Parse(time.RFC3339, text)
+		if err != nil {
+			return "", badRequest(ErrorInvalidFilter, "%q must be compared with a date and time", f.Attribute)
+		}
+		operator, ok := orderingOperators[f.Op]
+		if !ok {
+			return "", badRequest(ErrorInvalidFilter, "operator %q is not supported for %q", f.Op, f.Attribute)
+		}
+		return column + " " + operator + " " + placeholder(value.UTC()), nil
+
+	case TypeReferences:
+		value, ok := f.Value.(string)
+		if !ok || (f.Op != "eq" && f.Op != "ne") {
+			return "", badRequest(ErrorInvalidFilter, "%q can only be compared with eq or ne", f.Attribute)
+		}
+		condition := placeholder(value) + " = ANY(" + column + ")"
+		if f.Op == "ne" {
+			return "NOT (" + condition + ")", nil
+		}
+		return condition, nil
+	}
+
+	value, ok := f.Value.(string)
+	if !ok {
+		return "", badRequest(ErrorInvalidFilter, "%q must be compared with a string", f.Attribute)
+	}
+	if !attribute.CaseExact {
+		column = "LOWER(" + column + ")"
+		value = strings.ToLower(value)
+	}
+	switch f.Op {
+	case "eq":
+		return column + " = " + placeholder(value), nil
+	case "ne":
+		return column + " IS DISTINCT FROM " + placeholder(value), nil
+	case "co":
+		return column + ` LIKE ` + placeholder("%"+escapeLike(value)+"%"), nil
+	case "sw":
+		return column + ` LIKE ` + placeholder(escapeLike(value)+"%"), nil
+	case "ew":
+		return column + ` LIKE ` + placeholder("%"+escapeLike(value)), nil
+	}
+	return column + " " + orderingOperators[f.Op] + " " + placeholder(value), nil
+}
+
+var orderingOperators = map[string]string{"eq": "=", "gt": ">", "ge": ">=", "lt": "<", "le": "<="}
+
+// escapeLike escapes the wildcards of a LIKE pattern, using the default
+// backslash escape character.
+func escapeLike(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `%`, `\%`, `_`, `\_`).Replace(value)
+}
+
+// Matches evaluates f against a single value of a multi-valued attribute,
+// given as its sub-attributes keyed by lower-cased name. It supports the
+// string operators, which compare case insensitively, and pr.
+func (f *Filter) Matches(values map[string]string) bool {
+	switch f.Op {
+	case "and":
+		return f.Left.Matches(values) && f.Right.Matches(values)
+	case "or":
+		return f.Left.Matches(values) || f.Right.Matches(values)
+	case "not":
+		return !f.Left.Matches(values)
+	}
+
+	actual, present := values[f.Attribute]
+	if f.Op == "pr" {
+		return present && actual != ""
+	}
+	expected, ok := f.Value.(string)
+	if !ok {
+		return false
+	}
+	actual, expected = strings.ToLower(actual), strings.ToLower(expected)
+	switch f.Op {
+	case "eq":
+		return actual == expected
+	case "ne":
+		return actual != expected
+	case "co":
+		return strings.Contains(actual, expected)
+	case "sw":
+		return strings.HasPrefix(actual, expected)
+	case "ew":
+		return strings.HasSuffix(actual, expected)
+	}
+	return false
+}
+
+// String renders f for error messages and tests.
+func (f *Filter) String() string {
+	switch f.Op {
+	case "and", "or":
+		return "(" + f.Left.String() + " " + f.Op + " " + f.Right.String() + ")"
+	case "not":
+		return "not(" + f.Left.String() + ")"
+	case "pr":
+		return f.Attribute + " pr"
+	}
+	return fmt.Sprintf("%s %s %v", f.Attribute, f.Op, f.Value)
+}
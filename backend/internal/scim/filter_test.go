@@ -0,0 +1,99 @@
+package scim
+
+import (
+	"reflect"
+	"testing"
+)
+
+var testAttributes = map[string]Attribute{
+	"id":           {Column: "u.id::text", Type: TypeString, CaseExact: true},
+	"username":     {Column: "u.email", Type: TypeString},
+	"active":       {Column: "u.is_active", Type: TypeBoolean},
+	"meta.created": {Column: "u.created_at", Type: TypeDateTime},
+	"groups.value": {Column: "u.groups", Type: TypeReferences},
+}
+
+func TestParseFilterSQL(t *testing.T) {
+	tests := []struct {
+		filter string
+		sql    string
+		args   []interface{}
+	}{
+		{`userName eq "Alice@Example.com"`, "LOWER(u.email) = $2", []interface{}{"alice@example.com"}},
+		{`urn:ietf:params:scim:schemas:core:2.0:User:userName sw "al"`, "LOWER(u.email) LIKE $2", []interface{}{"al%"}},
+		{`userName co "50%_"`, "LOWER(u.email) LIKE $2", []interface{}{`%50\%\_%`}},
+		{`id eq "ABC"`, "u.id::text = $2", []interface{}{"ABC"}},
+		{`active eq true and not (userName pr)`, "(u.is_active = $2 AND NOT COALESCE((u.email IS NOT NULL AND u.email <> ''), false))", []interface{}{true}},
+		{`groups[value eq "g-1"] or active ne false`, "($2 = ANY(u.groups) OR u.is_active IS DISTINCT FROM $3)", []interface{}{"g-1", false}},
+	}
+
+	for _, tt := range tests {
+		filter, err := ParseFilter(tt.filter)
+		if err != nil {
+			t.Errorf("%s: ParseFilter returned error: %v", tt.filter, err)
+			continue
+		}
+		args := []interface{}{"tenant-1"}
+		sql, err := filter.SQL(testAttributes, &args)
+		if err != nil {
+			t.Errorf("%s: SQL returned error: %v", tt.filter, err)
+			continue
+		}
+		if sql != tt.sql {
+			t.Errorf("%s: expected %q, got %q", tt.filter, tt.sql, sql)
+		}
+		if !reflect.DeepEqual(args[1:], tt.args) {
+			t.Errorf("%s: expected args %v, got %v", tt.filter, tt.args, args[1:])
+		}
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	for _, input := range []string{
+		`userName`,
+		`userName eq`,
+		`userName eq "unterminated`,
+		`userName foo "x"`,
+		`(userName eq "x"`,
+		`userName eq "x" extra`,
+	} {
+		_, err := ParseFilter(input)
+		scimErr, ok := err.(*Error)
+		if !ok || scimErr.ScimType != ErrorInvalidFilter || scimErr.StatusCode() != 400 {
+			t.Errorf("%s: expected an invalidFilter error, got %v", input, err)
+		}
+	}
+
+	for _, input := range []string{
+		`phoneNumbers eq "1"`,
+		`active gt true`,
+		`meta.created gt "yesterday"`,
+		`groups.value co "g"`,
+	} {
+		filter, err := ParseFilter(input)
+		if err != nil {
+			t.Errorf("%s: ParseFilter returned error: %v", input, err)
+			continue
+		}
+		args := []interface{}{}
+		if _, err := filter.SQL(testAttributes, &args); err == nil {
+			t.Errorf("%s: expected SQL to fail", input)
+		}
+	}
+}
+
+func TestFilterMatches(t *testing.T) {
+	filter, err := ParseFilter(`value eq "u-1" or display sw "BOB"`)
+	if err != nil {
+		t.Fatalf("ParseFilter returned error: %v", err)
+	}
+	for values, want := range map[[2]string]bool{
+		{"u-1", "alice"}:       true,
+		{"u-2", "bob@example"}: true,
+		{"u-3", "carol"}:       false,
+	} {
+		if got := filter.Matches(map[string]string{"value": values[0], "display": values[1]}); got != want {
+			t.Errorf("%v: expected %t, got %t", values, want, got)
+		}
+	}
+}
@@ -0,0 +1,322 @@
+package scim
+
+import (
+	"encoding/json"
+	"strconv"
+	"strings"
+)
+
+// Patch operations apply to a resource loaded from the store, which is then
+// saved as a whole. Attributes ForIAM does not keep, such as phoneNumbers or
+// those of schema extensions, are accepted and ignored so that clients with
+// broad attribute mappings keep working; emails are ignored as they mirror
+// userName.
+
+// ApplyUserPatch applies PATCH operations to u.
+func ApplyUserPatch(u *User, operations []PatchOperation) error {
+	return applyPatch(operations, func(op, attribute string, filter *Filter, value json.RawMessage) error {
+		return patchUser(u, op, attribute, filter, value)
+	})
+}
+
+// ApplyGroupPatch applies PATCH operations to g.
+func ApplyGroupPatch(g *Group, operations []PatchOperation) error {
+	return applyPatch(operations, func(op, attribute string, filter *Filter, value json.RawMessage) error {
+		return patchGroup(g, op, attribute, filter, value)
+	})
+}
+
+type patchFunc func(op, attribute string, filter *Filter, value json.RawMessage) error
+
+func applyPatch(operations []PatchOperation, apply patchFunc) error {
+	if len(operations) == 0 {
+		return badRequest(ErrorInvalidValue, "no operations")
+	}
+	for _, operation := range operations {
+		op := strings.ToLower(operation.Op)
+		if op != "add" && op != "replace" && op != "remove" {
+			return badRequest(ErrorInvalidSyntax, "unsupported operation %q", operation.Op)
+		}
+
+		if operation.Path == "" {
+			if op == "remove" {
+				return badRequest(ErrorNoTarget, "remove needs a path")
+			}
+			var values map[string]json.RawMessage
+			if err := json.Unmarshal(operation.Value, &values); err != nil {
+				return badRequest(ErrorInvalidValue, "an operation without a path needs an object value")
+			}
+			for key, value := range values {
+				if err := apply(op, normalizeAttribute(key), nil, value); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		attribute, filter, err := parsePath(operation.Path)
+		if err != nil {
+			return err
+		}
+		if op != "remove" && len(operation.Value) == 0 {
+			return badRequest(ErrorInvalidValue, "%s needs a value", op)
+		}
+		if err := apply(op, attribute, filter, operation.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// parsePath parses attrPath, attrPath[filter] or attrPath[filter].subAttr.
+// The sub-attribute, if any, is appended to the returned attribute.
+func parsePath(path string) (string, *Filter, error) {
+	tokens, err := tokenize(path)
+	if err != nil || len(tokens) == 0 || tokens[0].kind != tokenWord {
+		return "", nil, badRequest(ErrorInvalidPath, "invalid path %q", path)
+	}
+	attribute := normalizeAttribute(tokens[0].text)
+	if len(tokens) == 1 {
+		return attribute, nil, nil
+	}
+
+	p := &parser{tokens: tokens, pos: 1}
+	if !p.symbol("[") {
+		return "", nil, badRequest(ErrorInvalidPath, "invalid path %q", path)
+	}
+	filter, err := p.parseOr("")
+	if err != nil {
+		return "", nil, err
+	}
+	if !p.symbol("]") {
+		return "", nil, badRequest(ErrorInvalidPath, "invalid path %q", path)
+	}
+	if t := p.peek(); t.kind == tokenWord && strings.HasPrefix(t.text, ".") {
+		attribute += strings.ToLower(t.text)
+		p.pos++
+	}
+	if !p.done() {
+		return "", nil, badRequest(ErrorInvalidPath, "invalid path %q", path)
+	}
+	return attribute, filter, nil
+}
+
+func patchUser(u *User, op, attribute string, filter *Filter, value json.RawMessage) error {
+	remove := op == "remove"
+
+	switch attribute {
+	case "username":
+		if remove {
+			return badRequest(ErrorInvalidValue, "userName is required")
+		}
+		userName, err := decodeString(attribute, value)
+		if err != nil {
+			return err
+		}
+		if userName == "" {
+			return badRequest(ErrorInvalidValue, "userName is required")
+		}
+		u.UserName = userName
+
+	case "externalid", "displayname", "name.givenname", "name.familyname":
+		var text string
+		if !remove {
+			decoded, err := decodeString(attribute, value)
+			if err != nil {
+				return err
+			}
+			text = decoded
+		}
+		setUserString(u, attribute, text)
+
+	case "name":
+		if remove {
+			u.Name = nil
+			return nil
+		}
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(value, &fields); err != nil {
+			return badRequest(ErrorInvalidValue, "name must be an object")
+		}
+		for key, field := range fields {
+			if err := patchUser(u, op, "name."+strings.ToLower(key), nil, field); err != nil {
+				return err
+			}
+		}
+
+	case "active":
+		if remove {
+			return badRequest(ErrorInvalidValue, "active cannot be removed")
+		}
+		active, err := decodeBool(attribute, value)
+		if err != nil {
+			return err
+		}
+		u.Active = &active
+
+	case "password":
+		if remove {
+			return badRequest(ErrorInvalidValue, "password cannot be removed")
+		}
+		password, err := decodeString(attribute, value)
+		if err != nil {
+			return err
+		}
+		u.Password = password
+
+	case "groups":
+		return badRequest(ErrorMutability, "groups are changed through the Group resource")
+	}
+	return nil
+}
+
+func setUserString(u *User, attribute, value string) {
+	switch attribute {
+	case "externalid":
+		u.ExternalID = value
+	case "displayname":
+		u.DisplayName = value
+	default:
+		if u.Name == nil {
+			u.Name = &Name{}
+		}
+		if attribute == "name.givenname" {
+			u.Name.GivenName = value
+		} else {
+			u.Name.FamilyName = value
+		}
+	}
+}
+
+func patchGroup(g *Group, op, attribute string, filter *Filter, value json.RawMessage) error {
+	remove := op == "remove"
+
+	switch attribute {
+	case "displayname":
+		if remove {
+			return badRequest(ErrorInvalidValue, "displayName is required")
+		}
+		name, err := decodeString(attribute, value)
+		if err != nil {
+			return err
+		}
+		if name == "" {
+			return badRequest(ErrorInvalidValue, "displayName is required")
+		}
+		g.DisplayName = name
+
+	case "externalid":
+		g.ExternalID = ""
+		if !remove {
+			externalID, err := decodeString(attribute, value)
+			if err != nil {
+				return err
+			}
+			g.ExternalID = externalID
+		}
+
+	case "members":
+		return patchMembers(g, op, filter, value)
+
+	default:
+		if strings.HasPrefix(attribute, "members.") {
+			return badRequest(ErrorInvalidPath, "sub-attributes of members cannot be changed")
+		}
+	}
+	return nil
+}
+
+func patchMembers(g *Group, op string, filter *Filter, value json.RawMessage) error {
+	switch {
+	case op == "remove" && filter != nil:
+		kept := []Reference{}
+		for _, member := range g.Members {
+			if !filter.Matches(map[string]string{"value": member.Value, "display": member.Display, "type": member.Type}) {
+				kept = append(kept, member)
+			}
+		}
+		g.Members = kept
+		return nil
+	case filter != nil:
+		return badRequest(ErrorInvalidPath, "members can only be filtered to remove them")
+	case op == "remove" && len(value) == 0:
+		g.Members = []Reference{}
+		return nil
+	}
+
+	members, err := decodeReferences(value)
+	if err != nil {
+		return err
+	}
+	switch op {
+	case "replace":
+		g.Members = []Reference{}
+		fallthrough
+	case "add":
+		for _, member := range members {
+			if !hasMember(g.Members, member.Value) {
+				g.Members = append(g.Members, member)
+			}
+		}
+	case "remove":
+		kept := []Reference{}
+		for _, member := range g.Members {
+			if !hasMember(members, member.Value) {
+				kept = append(kept, member)
+			}
+		}
+		g.Members = kept
+	}
+	return nil
+}
+
+func hasMember(members []Reference, value string) bool {
+	for _, member := range members {
+		if member.Value == value {
+			return true
+		}
+	}
+	return false
+}
+
+// decodeReferences reads a list of members, or a single one.
+func decodeReferences(value json.RawMessage) ([]Reference, error) {
+	var members []Reference
+	if err := json.Unmarshal(value, &members); err != nil {
+		var member Reference
+		if err := json.Unmarshal(value, &member); err != nil {
+			return nil, badRequest(ErrorInvalidValue, "members must be a list of objects with a value")
+		}
+		members = []Reference{member}
+	}
+	for _, member := range members {
+		if member.Value == "" {
+			return nil, badRequest(ErrorInvalidValue, "members must be a list of objects with a value")
+		}
+	}
+	return members, nil
+}
+
+func decodeString(attribute string, value json.RawMessage) (string, error) {
+	var text string
+	if err := json.Unmarshal(value, &text); err != nil {
+		return "", badRequest(ErrorInvalidValue, "%s must be a string", attribute)
+	}
+	return text, nil
+}
+
+// decodeBool also accepts "true" and "false" as strings, which some
+// clients send.
+func decodeBool(attribute string, value json.RawMessage) (bool, error) {
+	var b bool
+	if err := json.Unmarshal(value, &b); err == nil {
+		return b, nil
+	}
+	var text string
+	if err := json.Unmarshal(value, &text); err == nil {
+		if parsed, err := strconv.ParseBool(text); err == nil {
+			return parsed, nil
+		}
+	}
+	return false, badRequest(ErrorInvalidValue, "%s must be a boolean", attribute)
+}
@@ -0,0 +1,84 @@
+package scim
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func operations(t *testing.T, body string) []PatchOperation {
+	t.Helper()
+	var req PatchRequest
+	if err := json.Unmarshal([]byte(body), &req); err != nil {
+		t.Fatalf("invalid patch request: %v", err)
+	}
+	return req.Operations
+}
+
+func TestApplyUserPatch(t *testing.T) {
+	u := &User{UserName: "alice@example.com", DisplayName: "Alice"}
+
+	err := ApplyUserPatch(u, operations(t, `{"Operations": [
+		{"op": "Replace", "path": "active", "value": "False"},
+		{"op": "replace", "path": "name.familyName", "value": "Smith"},
+		{"op": "add", "value": {"displayName": "Alice Smith", "externalId": "e-1", "phoneNumbers": [{"value": "1"}]}},
+		{"op": "remove", "path": "urn:ietf:params:scim:schemas:extension:enterprise:2.0:User:department"}
+	]}`))
+	if err != nil {
+		t.Fatalf("ApplyUserPatch returned error: %v", err)
+	}
+	if u.IsActive() {
+		t.Error("Expected the user to be deactivated")
+	}
+	if u.Name == nil || u.Name.FamilyName != "Smith" {
+		t.Errorf("Expected family name Smith, got %+v", u.Name)
+	}
+	if u.DisplayName != "Alice Smith" || u.ExternalID != "e-1" {
+		t.Errorf("Unexpected attributes %q, %q", u.DisplayName, u.ExternalID)
+	}
+
+	for _, body := range []string{
+		`{"Operations": []}`,
+		`{"Operations": [{"op": "move", "path": "active", "value": true}]}`,
+		`{"Operations": [{"op": "remove", "path": "userName"}]}`,
+		`{"Operations": [{"op": "replace", "path": "active", "value": "maybe"}]}`,
+		`{"Operations": [{"op": "add", "path": "groups", "value": [{"value": "g-1"}]}]}`,
+		`{"Operations": [{"op": "replace", "path": "emails[type eq", "value": "x"}]}`,
+	} {
+		if err := ApplyUserPatch(&User{UserName: "alice@example.com"}, operations(t, body)); err == nil {
+			t.Errorf("%s: expected an error", body)
+		}
+	}
+}
+
+func TestApplyGroupPatch(t *testing.T) {
+	g := &Group{DisplayName: "Sales", Members: []Reference{{Value: "u-1"}, {Value: "u-2"}}}
+
+	err := ApplyGroupPatch(g, operations(t, `{"Operations": [
+		{"op": "add", "path": "members", "value": [{"value": "u-2"}, {"value": "u-3"}]},
+		{"op": "remove", "path": "members[value eq \"u-1\"]"},
+		{"op": "replace", "path": "displayName", "value": "Sales EMEA"}
+	]}`))
+	if err != nil {
+		t.Fatalf("ApplyGroupPatch returned error: %v", err)
+	}
+	if g.DisplayName != "Sales EMEA" {
+		t.Errorf("Expected the group to be renamed, got %q", g.DisplayName)
+	}
+	if len(g.Members) != 2 || g.Members[0].Value != "u-2" || g.Members[1].Value != "u-3" {
+		t.Errorf("Unexpected members %+v", g.Members)
+	}
+
+	err = ApplyGroupPatch(g, operations(t, `{"Operations": [
+		{"op": "remove", "path": "members", "value": [{"value": "u-3"}]}
+	]}`))
+	if err != nil || len(g.Members) != 1 || g.Members[0].Value != "u-2" {
+		t.Errorf("Expected u-3 to be removed, got %+v (%v)", g.Members, err)
+	}
+
+	if err := ApplyGroupPatch(g, operations(t, `{"Operations": [{"op": "replace", "path": "members", "value": []}]}`)); err != nil || len(g.Members) != 0 {
+		t.Errorf("Expected members to be cleared, got %+v (%v)", g.Members, err)
+	}
+	if err := ApplyGroupPatch(g, operations(t, `{"Operations": [{"op": "add", "path": "members", "value": [{"display": "x"}]}]}`)); err == nil {
+		t.Error("Expected members without a value to be rejected")
+	}
+}
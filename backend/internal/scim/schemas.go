@@ -0,0 +1,159 @@
+package scim
+
+// MaxResults caps the number of resources a query returns per page.
+const MaxResults = 200
+
+// ServiceProviderConfig describes the features of this SCIM service
+// (RFC 7643 section 5).
+func ServiceProviderConfig(baseURL string) map[string]interface{} {
+	return map[string]interface{}{
+		"schemas":        []string{SchemaServiceProviderConfig},
+		"patch":          map[string]bool{"supported": true},
+		"bulk":           map[string]interface{}{"supported": false, "maxOperations": 0, "maxPayloadSize": 0},
+		"filter":         map[string]interface{}{"supported": true, "maxResults": MaxResults},
+		"changePassword": map[string]bool{"supported": true},
+		"sort":           map[string]bool{"supported": false},
+		"etag":           map[string]bool{"supported": true},
+		"authenticationSchemes": []map[string]interface{}{{
+			"type":        "oauthbearertoken",
+			"name":        "Bearer token",
+			"description": "An API key, ideally of a service account, or an access token",
+			"primary":     true,
+		}},
+		"meta": map[string]string{
+			"resourceType": "ServiceProviderConfig",
+			"location":     baseURL + "/ServiceProviderConfig",
+		},
+	}
+}
+
+// ResourceType is a resource type definition (RFC 7643 section 6).
+type ResourceType struct {
+	Schemas     []string          `json:"schemas"`
+	ID          string            `json:"id"`
+	Name        string            `json:"name"`
+	Endpoint    string            `json:"endpoint"`
+	Description string            `json:"description"`
+	Schema      string            `json:"schema"`
+	Meta        map[string]string `json:"meta"`
+}
+
+// ResourceTypes lists the User and Group resource types.
+func ResourceTypes(baseURL string) []ResourceType {
+	resourceType := func(name, endpoint, description, schema string) ResourceType {
+		return ResourceType{
+			Schemas:     []string{SchemaResourceType},
+			ID:          name,
+			Name:        name,
+			Endpoint:    endpoint,
+			Description: description,
+			Schema:      schema,
+			Meta:        map[string]string{"resourceType": "ResourceType", "location": baseURL + "/ResourceTypes/" + name},
+		}
+	}
+	return []ResourceType{
+		resourceType("User", "/Users", "User account", SchemaUser),
+		resourceType("Group", "/Groups", "Group", SchemaGroup),
+	}
+}
+
+// Schema is a schema definition (RFC 7643 section 7), listing the
+// attributes ForIAM supports.
+type Schema struct {
+	Schemas     []string          `json:"schemas"`
+	ID          string            `json:"id"`
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	Attributes  []SchemaAttribute `json:"attributes"`
+	Meta        map[string]string `json:"meta"`
+}
+
+type SchemaAttribute struct {
+	Name           string            `json:"name"`
+	Type           string            `json:"type"`
+	MultiValued    bool              `json:"multiValued"`
+	Required       bool              `json:"required"`
+	CaseExact      bool              `json:"caseExact"`
+	Mutability     string            `json:"mutability"`
+	Returned       string            `json:"returned"`
+	Uniqueness     string            `json:"uniqueness"`
+	SubAttributes  []SchemaAttribute `json:"subAttributes,omitempty"`
+	ReferenceTypes []string          `json:"referenceTypes,omitempty"`
+}
+
+func attribute(name, typ, mutability string) SchemaAttribute {
+	return SchemaAttribute{Name: name, Type: typ, Mutability: mutability, Returned: "default", Uniqueness: "none"}
+}
+
+func reference(name, mutability string, referenceType string) SchemaAttribute {
+	value := attribute("value", "string", mutability)
+	value.CaseExact = true
+	display := attribute("display", "string", "readOnly")
+	ref := attribute("$ref", "reference", mutability)
+	ref.ReferenceTypes = []string{referenceType}
+	return SchemaAttribute{
+		Name:          name,
+		Type:          "complex",
+		MultiValued:   true,
+		Mutability:    mutability,
+		Returned:      "default",
+		Uniqueness:    "none",
+		SubAttributes: []SchemaAttribute{value, ref, display},
+	}
+}
+
+// Schemas returns the User and Group schemas.
+func Schemas(baseURL string) []Schema {
+	id := attribute("id", "string", "readOnly")
+	id.CaseExact = true
+	id.Returned = "always"
+	id.Uniqueness = "server"
+	externalID := attribute("externalId", "string", "readWrite")
+	externalID.CaseExact = true
+
+	userName := attribute("userName", "string", "readWrite")
+	userName.Required = true
+	userName.Uniqueness = "server"
+	name := attribute("name", "complex", "readWrite")
+	name.SubAttributes = []SchemaAttribute{
+		attribute("givenName", "string", "readWrite"),
+		attribute("familyName", "string", "readWrite"),
+	}
+	emails := attribute("emails", "complex", "readOnly")
+	emails.MultiValued = true
+	emails.SubAttributes = []SchemaAttribute{
+		attribute("value", "string", "readOnly"),
+		attribute("type", "string", "readOnly"),
+		attribute("primary", "boolean", "readOnly"),
+	}
+	password := attribute("password", "string", "writeOnly")
+	password.Returned = "never"
+
+	displayName := attribute("displayName", "string", "readWrite")
+	groupName := displayName
+	groupName.Required = true
+	groupName.Uniqueness = "server"
+
+	schema := func(id, name, description string, attributes []SchemaAttribute) Schema {
+		return Schema{
+			Schemas:     []string{SchemaSchema},
+			ID:          id,
+			Name:        name,
+			Description: description,
+			Attributes:  attributes,
+			Meta:        map[string]string{"resourceType": "Schema", "location": baseURL + "/Schemas/" + id},
+		}
+	}
+	return []Schema{
+		schema(SchemaUser, "User", "User account", []SchemaAttribute{
+			id, externalID, userName, name, displayName,
+			attribute("active", "boolean", "readWrite"),
+			emails, password,
+			reference("groups", "readOnly", "Group"),
+		}),
+		schema(SchemaGroup, "Group", "Group", []SchemaAttribute{
+			id, externalID, groupName,
+			reference("members", "readWrite", "User"),
+		}),
+	}
+}
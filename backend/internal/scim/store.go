@@ -0,0 +1,529 @@
+package scim
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Store reads and writes SCIM resources of a tenant. Only users of
+// principal type user are exposed; service accounts are managed through
+// their own API and keep their group memberships when a group is replaced.
+type Store struct {
+	db      *sql.DB
+	baseURL string
+}
+
+// NewStore returns a store whose resource locations start with baseURL,
+// the URL of the SCIM endpoints.
+func NewStore(db *sql.DB, baseURL string) *Store {
+	return &Store{db: db, baseURL: baseURL}
+}
+
+func notFound(resource, id string) *Error {
+	return NewError(http.StatusNotFound, "", "%s %s not found", resource, id)
+}
+
+// validID reports whether id can be a resource ID; others are not found
+// without asking the database.
+func validID(id string) bool {
+	_, err := uuid.Parse(id)
+	return err == nil
+}
+
+func isUniqueViolation(err error) bool {
+	pqErr, ok := err.(*pq.Error)
+	return ok && pqErr.Code == "23505"
+}
+
+var userAttributes = map[string]Attribute{
+	"id":              {Column: "u.id::text", Type: TypeString, CaseExact: true},
+	"externalid":      {Column: "u.external_id", Type: TypeString, CaseExact: true},
+	"username":        {Column: "u.email", Type: TypeString},
+	"emails":          {Column: "u.email", Type: TypeString},
+	"emails.value":    {Column: "u.email", Type: TypeString},
+	"displayname":     {Column: "u.display_name", Type: TypeString},
+	"name.givenname":  {Column: "u.given_name", Type: TypeString},
+	"name.familyname": {Column: "u.family_name", Type: TypeString},
+	"active":          {Column: "u.is_active", Type: TypeBoolean},
+	"meta.created":    {Column: "u.created_at", Type: TypeDateTime},
+	"groups":          {Column: "ARRAY(SELECT ug.group_id::text FROM user_groups ug WHERE ug.user_id = u.id)", Type: TypeReferences},
+	"groups.value":    {Column: "ARRAY(SELECT ug.group_id::text FROM user_groups ug WHERE ug.user_id = u.id)", Type: TypeReferences},
+}
+
+var groupAttributes = map[string]Attribute{
+	"id":            {Column: "g.id::text", Type: TypeString, CaseExact: true},
+	"externalid":    {Column: "g.external_id", Type: TypeString, CaseExact: true},
+	"displayname":   {Column: "g.name", Type: TypeString},
+	"meta.created":  {Column: "g.created_at", Type: TypeDateTime},
+	"members":       {Column: "ARRAY(SELECT ug.user_id::text FROM user_groups ug WHERE ug.group_id = g.id)", Type: TypeReferences},
+	"members.value": {Column: "ARRAY(SELECT ug.user_id::text FROM user_groups ug WHERE ug.group_id = g.id)", Type: TypeReferences},
+}
+
+const userColumns = `u.id, u.email, u.external_id, u.display_name, u.given_name, u.family_name,
+	COALESCE(u.is_active, TRUE), u.created_at,
+	ARRAY(SELECT g.id::text FROM user_groups ug JOIN groups g ON g.id = ug.group_id
+		WHERE ug.user_id = u.id AND g.tenant_id = u.tenant_id ORDER BY g.name, g.id),
+	ARRAY(SELECT g.name FROM user_groups ug JOIN groups g ON g.id = ug.group_id
+		WHERE ug.user_id = u.id AND g.tenant_id = u.tenant_id ORDER BY g.name, g.id)`
+
+const groupColumns = `g.id, g.name, g.external_id, g.created_at,
+	ARRAY(SELECT m.id::text FROM user_groups ug JOIN users m ON m.id = ug.user_id
+		WHERE ug.group_id = g.id AND m.tenant_id = g.tenant_id AND m.principal_type = 'user' ORDER BY m.email, m.id),
+	ARRAY(SELECT m.email FROM user_groups ug JOIN users m ON m.id = ug.user_id
+		WHERE ug.group_id = g.id AND m.tenant_id = g.tenant_id AND m.principal_type = 'user' ORDER BY m.email, m.id)`
+
+func (s *Store) scanUser(row interface{ Scan(...interface{}) error }) (*User, error) {
+	var (
+		u                   User
+		name                Name
+		active              bool
+		created             time.Time
+		groupIDs, groupName []string
+	)
+	err := row.Scan(&u.ID, &u.UserName, &u.ExternalID, &u.DisplayName, &name.GivenName, &name.FamilyName,
+		&active, &created, pq.Array(&groupIDs), pq.Array(&groupName))
+	if err != nil {
+		return nil, err
+	}
+
+	u.Schemas = []string{SchemaUser}
+	if name != (Name{}) {
+		u.Name = &name
+	}
+	u.Active = &active
+	u.Emails = []Email{{Value: u.UserName, Type: "work", Primary: true}}
+	for i, id := range groupIDs {
+		u.Groups = append(u.Groups, Reference{Value: id, Ref: s.baseURL + "/Groups/" + id, Display: groupName[i], Type: "direct"})
+	}
+	u.Meta = &Meta{ResourceType: "User", Created: created, Location: s.baseURL + "/Users/" + u.ID, Version: version(&u)}
+	return &u, nil
+}
+
+func (s *Store) scanGroup(row interface{ Scan(...interface{}) error }) (*Group, error) {
+	var (
+		g                      Group
+		created                time.Time
+		memberIDs, memberNames []string
+	)
+	err := row.Scan(&g.ID, &g.DisplayName, &g.ExternalID, &created, pq.Array(&memberIDs), pq.Array(&memberNames))
+	if err != nil {
+		return nil, err
+	}
+
+	g.Schemas = []string{SchemaGroup}
+	for i, id := range memberIDs {
+		g.Members = append(g.Members, Reference{Value: id, Ref: s.baseURL + "/Users/" + id, Display: memberNames[i], Type: "User"})
+	}
+	g.Meta = &Meta{ResourceType: "Group", Created: created, Location: s.baseURL + "/Groups/" + g.ID, Version: version(&g)}
+	return &g, nil
+}
+
+// ListUsers returns a page of the users of tenantID matching filter, which
+// may be nil, and the number of all matching users. startIndex is 1-based.
+func (s *Store) ListUsers(tenantID string, filter *Filter, startIndex, count int) ([]*User, int, error) {
+	args := []interface{}{tenantID}
+	where := "u.tenant_id = $1 AND u.principal_type = 'user'"
+	if filter != nil {
+		condition, err := filter.SQL(userAttributes, &args)
+		if err != nil {
+			return nil, 0, err
+		}
+		where += " AND " + condition
+	}
+
+	var total int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM users u WHERE `+where, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("failed to count users: %w", err)
+	}
+
+	users := []*User{}
+	if count == 0 {
+		return users, total, nil
+	}
+	args = append(args, count, startIndex-1)
+	rows, err := s.db.Query(fmt.Sprintf(`
+		SELECT %s FROM users u WHERE %s
+		ORDER BY u.created_at, u.id LIMIT $%d OFFSET $%d
+	`, userColumns, where, len(args)-1, len(args)), args...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list users: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		u, err := s.scanUser(rows)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to scan user: %w", err)
+		}
+		users = append(users, u)
+	}
+	return users, total, rows.Err()
+}
+
+// GetUser loads a user of tenantID.
+func (s *Store) GetUser(tenantID, id string) (*User, error) {
+	if !validID(id) {
+		return nil, notFound("User", id)
+	}
+	u, err := s.scanUser(s.db.QueryRow(`
+		SELECT `+userColumns+` FROM users u
+		WHERE u.id = $1 AND u.tenant_id = $2 AND u.principal_type = 'user'
+	`, id, tenantID))
+	if err == sql.ErrNoRows {
+		return nil, notFound("User", id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load user: %w", err)
+	}
+	return u, nil
+}
+
+func validateUser(u *User) error {
+	if u.UserName == "" {
+		return badRequest(ErrorInvalidValue, "userName is required")
+	}
+	if _, err := mail.ParseAddress(u.UserName); err != nil {
+		return badRequest(ErrorInvalidValue, "userName must be an email address")
+	}
+	if u.Password != "" && len(u.Password) < 6 {
+		return badRequest(ErrorInvalidValue, "password must be at least 6 characters")
+	}
+	return nil
+}
+
+// hashPassword returns the bcrypt hash of password, or nil for none.
+func hashPassword(password string) (interface{}, error) {
+	if password == "" {
+		return nil, nil
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash password: %w", err)
+	}
+	return string(hash), nil
+}
+
+func userName(u *User) (string, string) {
+	if u.Name == nil {
+		return "", ""
+	}
+	return u.Name.GivenName, u.Name.FamilyName
+}
+
+// CreateUser adds u to tenantID. A user created without a password cannot
+// sign in with one until it is set.
+func (s *Store) CreateUser(tenantID string, u *User) (*User, error) {
+	if err := validateUser(u); err != nil {
+		return nil, err
+	}
+	hash, err := hashPassword(u.Password)
+	if err != nil {
+		return nil, err
+	}
+	givenName, familyName := userName(u)
+
+	var id string
+	err = s.db.QueryRow(`
+		INSERT INTO users (tenant_id, email, password_hash, external_id, display_name, given_name, family_name, is_active)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id
+	`, tenantID, u.UserName, hash, u.ExternalID, u.DisplayName, givenName, familyName, u.IsActive()).Scan(&id)
+	if isUniqueViolation(err) {
+		return nil, NewError(http.StatusConflict, ErrorUniqueness, "userName %s is already taken", u.UserName)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create user: %w", err)
+	}
+	return s.GetUser(tenantID, id)
+}
+
+// ReplaceUser saves the attributes of u over user id. The password only
+// changes when u has one.
+func (s *Store) ReplaceUser(tenantID, id string, u *User) (*User, error) {
+	if !validID(id) {
+		return nil, notFound("User", id)
+	}
+	if err := validateUser(u); err != nil {
+		return nil, err
+	}
+	hash, err := hashPassword(u.Password)
+	if err != nil {
+		return nil, err
+	}
+	givenName, familyName := userName(u)
+
+	result, err := s.db.Exec(`
+		UPDATE users SET email = $1, external_id = $2, display_name = $3, given_name = $4, family_name = $5,
+			is_active = $6, password_hash = COALESCE($7, password_hash)
+		WHERE id = $8 AND tenant_id = $9 AND principal_type = 'user'
+	`, u.UserName, u.ExternalID, u.DisplayName, givenName, familyName, u.IsActive(), hash, id, tenantID)
+	if isUniqueViolation(err) {
+		return nil, NewError(http.StatusConflict, ErrorUniqueness, "userName %s is already taken", u.UserName)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to update user: %w", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return nil, notFound("User", id)
+	}
+	return s.GetUser(tenantID, id)
+}
+
+// DeleteUser removes user id from tenantID.
+func (s *Store) DeleteUser(tenantID, id string) error {
+	if !validID(id) {
+		return notFound("User", id)
+	}
+	result, err := s.db.Exec(`
+		DELETE FROM users WHERE id = $1 AND tenant_id = $2 AND principal_type = 'user'
+	`, id, tenantID)
+	if err != nil {
+		return fmt.Errorf("failed to delete user: %w", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return notFound("User", id)
+	}
+	return nil
+}
+
+// ListGroups returns a page of the groups of tenantID matching filter and
+// the number of all matching groups.
+func (s *Store) ListGroups(tenantID string, filter *Filter, startIndex, count int) ([]*Group, int, error) {
+	args := []interface{}{tenantID}
+	where := "g.tenant_id = $1"
+	if filter != nil {
+		condition, err := filter.SQL(groupAttributes, &args)
+		if err != nil {
+			return nil, 0, err
+		}
+		where += " AND " + condition
+	}
+
+	var total int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM groups g WHERE `+where, args...).Scan(&total); err != nil {
+		return nil, 0, fmt.Errorf("failed to count groups: %w", err)
+	}
+
+	groups := []*Group{}
+	if count == 0 {
+		return groups, total, nil
+	}
+	args = append(args, count, startIndex-1)
+	rows, err := s.db.Query(fmt.Sprintf(`
+		SELECT %s FROM groups g WHERE %s
+		ORDER BY g.created_at, g.id LIMIT $%d OFFSET $%d
+	`, groupColumns, where, len(args)-1, len(args)), args...)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed to list groups: %w", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		g, err := s.scanGroup(rows)
+		if err != nil {
+			return nil, 0, fmt.Errorf("failed to scan group: %w", err)
+		}
+		groups = append(groups, g)
+	}
+	return groups, total, rows.Err()
+}
+
+// GetGroup loads a group of tenantID with its members.
+func (s *Store) GetGroup(tenantID, id string) (*Group, error) {
+	if !validID(id) {
+		return nil, notFound("Group", id)
+	}
+	g, err := s.scanGroup(s.db.QueryRow(`
+		SELECT `+groupColumns+` FROM groups g
+		WHERE g.id = $1 AND g.tenant_id = $2
+	`, id, tenantID))
+	if err == sql.ErrNoRows {
+		return nil, notFound("Group", id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load group: %w", err)
+	}
+	return g, nil
+}
+
+// CreateGroup adds g and its members to tenantID.
+func (s *Store) CreateGroup(tenantID string, g *Group) (*Group, error) {
+	if g.DisplayName == "" {
+		return nil, badRequest(ErrorInvalidValue, "displayName is required")
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var id string
+	err = tx.QueryRow(`
+		INSERT INTO groups (tenant_id, name, description, external_id)
+		VALUES ($1, $2, '', $3)
+		RETURNING id
+	`, tenantID, g.DisplayName, g.ExternalID).Scan(&id)
+	if isUniqueViolation(err) {
+		return nil, NewError(http.StatusConflict, ErrorUniqueness, "group %s already exists", g.DisplayName)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to create group: %w", err)
+	}
+	if err := addMembers(tx, tenantID, id, g.Members); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to create group: %w", err)
+	}
+	return s.GetGroup(tenantID, id)
+}
+
+// ReplaceGroup saves the name, externalId and members of g over group id.
+func (s *Store) ReplaceGroup(tenantID, id string, g *Group) (*Group, error) {
+	if !validID(id) {
+		return nil, notFound("Group", id)
+	}
+	if g.DisplayName == "" {
+		return nil, badRequest(ErrorInvalidValue, "displayName is required")
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var dynamic bool
+	err = tx.QueryRow(`
+		UPDATE groups SET name = $1, external_id = $2 WHERE id = $3 AND tenant_id = $4
+		RETURNING rule IS NOT NULL
+	`, g.DisplayName, g.ExternalID, id, tenantID).Scan(&dynamic)
+	if isUniqueViolation(err) {
+		return nil, NewError(http.StatusConflict, ErrorUniqueness, "group %s already exists", g.DisplayName)
+	}
+	if err == sql.ErrNoRows {
+		return nil, notFound("Group", id)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to update group: %w", err)
+	}
+
+	// The members of a dynamic group follow its rule: they can be sent back
+	// as they are, but not changed
+	if dynamic {
+		if err := checkSameMembers(tx, id, g.Members); err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, fmt.Errorf("failed to update group: %w", err)
+		}
+		return s.GetGroup(tenantID, id)
+	}
+
+	_, err = tx.Exec(`
+		DELETE FROM user_groups ug USING users u
+		WHERE ug.group_id = $1 AND u.id = ug.user_id AND u.principal_type = 'user'
+	`, id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update group members: %w", err)
+	}
+	if err := addMembers(tx, tenantID, id, g.Members); err != nil {
+		return nil, err
+	}
+	if err := tx.Commit(); err != nil {
+		return nil, fmt.Errorf("failed to update group: %w", err)
+	}
+	return s.GetGroup(tenantID, id)
+}
+
+// checkSameMembers makes sure members are the users in group groupID.
+func checkSameMembers(tx *sql.Tx, groupID string, members []Reference) error {
+	rows, err := tx.Query(`
+		SELECT ug.user_id FROM user_groups ug
+		JOIN users u ON u.id = ug.user_id
+		WHERE ug.group_id = $1 AND u.principal_type = 'user'
+	`, groupID)
+	if err != nil {
+		return fmt.Errorf("failed to load group members: %w", err)
+	}
+	defer rows.Close()
+	current := map[string]bool{}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return fmt.Errorf("failed to load group members: %w", err)
+		}
+		current[id] = true
+	}
+	if err := rows.Err(); err != nil {
+		return fmt.Errorf("failed to load group members: %w", err)
+	}
+
+	sent := map[string]bool{}
+	for _, member := range members {
+		sent[strings.ToLower(member.Value)] = true
+	}
+	if len(sent) != len(current) {
+		return badRequest(ErrorMutability, "the members of a dynamic group follow its rule")
+	}
+	for id := range sent {
+		if !current[id] {
+			return badRequest(ErrorMutability, "the members of a dynamic group follow its rule")
+		}
+	}
+	return nil
+}
+
+// addMembers adds users of tenantID to group groupID. Every member must be
+// such a user.
+func addMembers(tx *sql.Tx, tenantID, groupID string, members []Reference) error {
+	ids := []string{}
+	seen := map[string]bool{}
+	for _, member := range members {
+		if !seen[member.Value] {
+			seen[member.Value] = true
+			ids = append(ids, member.Value)
+		}
+	}
+	if len(ids) == 0 {
+		return nil
+	}
+
+	result, err := tx.Exec(`
+		INSERT INTO user_groups (user_id, group_id)
+		SELECT u.id, $1 FROM users u
+		WHERE u.id::text = ANY($2) AND u.tenant_id = $3 AND u.principal_type = 'user'
+		ON CONFLICT DO NOTHING
+	`, groupID, pq.Array(ids), tenantID)
+	if err != nil {
+		return fmt.Errorf("failed to add group members: %w", err)
+	}
+	if rows, _ := result.RowsAffected(); int(rows) != len(ids) {
+		return badRequest(ErrorInvalidValue, "members must be users of the tenant")
+	}
+	return nil
+}
+
+// DeleteGroup removes group id from tenantID.
+func (s *Store) DeleteGroup(tenantID, id string) error {
+	if !validID(id) {
+		return notFound("Group", id)
+	}
+	result, err := s.db.Exec(`DELETE FROM groups WHERE id = $1 AND tenant_id = $2`, id, tenantID)
+	if err != nil {
+		return fmt.Errorf("failed to delete group: %w", err)
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		return notFound("Group", id)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+// Package sealing encrypts the secrets the server stores at rest. Each kind
+// of secret is sealed with its own AES-GCM key, derived with HKDF from the
+// server's encryption key and a label naming the purpose, so a key recovered
+// for one purpose opens nothing else.
+package sealing
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// Purposes of sealed values. Changing a label makes the values sealed under
+// it unreadable.
+const (
+	PurposeTOTPSecret     = "foriam mfa totp secret"
+	PurposeSigningKey     = "foriam signing private key"
+	PurposeConnectorToken = "foriam provisioning connector token"
+	PurposeSAMLCredential = "foriam saml idp private key"
+	PurposeClientSecret   = "foriam federation client secret"
+	PurposeBindPassword   = "foriam ldap bind password"
+)
+
+// ErrTooShort is returned when opening data shorter than a nonce.
+var ErrTooShort = errors.New("sealed value too short")
+
+// Box seals and opens the values of one purpose.
+type Box struct {
+	aead cipher.AEAD
+}
+
+// New returns the box for purpose under the server's encryption key.
+func New(key, purpose string) *Box {
+	derived := make([]byte, 32)
+	// Reading 32 bytes from HKDF-SHA256 never fails, and neither does AES-GCM
+	// with a 32 byte key
+	io.ReadFull(hkdf.New(sha256.New, []byte(key), nil, []byte(purpose)), derived)
+	block, _ := aes.NewCipher(derived)
+	aead, _ := cipher.NewGCM(block)
+	return &Box{aead: aead}
+}
+
+// Seal encrypts plaintext under a random nonce, which it prepends.
+func (b *Box) Seal(plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, b.aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return b.aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+// Open decrypts a value sealed by Seal, failing if it was sealed for another
+// purpose or key or has been altered.
+func (b *Box) Open(sealed []byte) ([]byte, error) {
+	if len(sealed) < b.aead.NonceSize() {
+		return nil, ErrTooShort
+	}
+	nonce, ciphertext := sealed[:b.aead.NonceSize()], sealed[b.aead.NonceSize():]
+	return b.aead.Open(nil, nonce, ciphertext, nil)
+}
@@ -0,0 +1,62 @@
+package sealing
+
+import (
+	"bytes"
+	"testing"
+)
+
+const otherPurpose = "foriam other purpose"
+
+func TestBox(t *testing.T) {
+	box := New("encryption-key", PurposeTOTPSecret)
+
+	sealed, err := box.Seal([]byte("JBSWY3DPEHPK3PXP"))
+	if err != nil {
+		t.Fatalf("Seal returned error: %v", err)
+	}
+	if bytes.Contains(sealed, []byte("JBSWY3DPEHPK3PXP")) {
+		t.Error("Expected the sealed value not to contain the plaintext")
+	}
+	if plaintext, err := box.Open(sealed); err != nil || string(plaintext) != "JBSWY3DPEHPK3PXP" {
+		t.Errorf("Expected the plaintext back, got %q, %v", plaintext, err)
+	}
+	if again, _ := box.Seal([]byte("JBSWY3DPEHPK3PXP")); bytes.Equal(again, sealed) {
+		t.Error("Expected every seal to use a fresh nonce")
+	}
+
+	tampered := append([]byte(nil), sealed...)
+	tampered[len(tampered)-1] ^= 1
+	if _, err := box.Open(tampered); err == nil {
+		t.Error("Expected opening an altered value to fail")
+	}
+	if _, err := box.Open(sealed[:4]); err != ErrTooShort {
+		t.Errorf("Expected ErrTooShort, got %v", err)
+	}
+}
+
+func TestBoxKeysPerPurpose(t *testing.T) {
+	sealed, err := New("encryption-key", PurposeTOTPSecret).Seal([]byte("JBSWY3DPEHPK3PXP"))
+	if err != nil {
+		t.Fatalf("Seal returned error: %v", err)
+	}
+
+	tests := []struct {
+		name    string
+		key     string
+		purpose string
+		opens   bool
+	}{
+		{"same key and purpose", "encryption-key", PurposeTOTPSecret, true},
+		{"other purpose", "encryption-key", otherPurpose, false},
+		{"other key", "other-key", PurposeTOTPSecret, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := New(tt.key, tt.purpose).Open(sealed)
+			if (err == nil) != tt.opens {
+				t.Errorf("Expected opens=%v, got error %v", tt.opens, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,49 @@
+package serviceaccount
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"testing"
+	"time"
+)
+
+func TestParseCertificateAndThumbprint(t *testing.T) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey returned error: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "deploy-bot"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate returned error: %v", err)
+	}
+
+	cert, err := ParseCertificate(string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})))
+	if err != nil {
+		t.Fatalf("ParseCertificate returned error: %v", err)
+	}
+	if cert.Subject.CommonName != "deploy-bot" {
+		t.Errorf("Unexpected subject %s", cert.Subject)
+	}
+	if got := Thumbprint(cert); len(got) != 43 || got != Thumbprint(cert) {
+		t.Errorf("Expected a stable 43 character thumbprint, got %q", got)
+	}
+
+	if _, err := ParseCertificate("not a certificate"); err != ErrInvalidCertificate {
+		t.Errorf("Expected ErrInvalidCertificate, got %v", err)
+	}
+	keyPEM := string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: []byte("x")}))
+	if _, err := ParseCertificate(keyPEM); err != ErrInvalidCertificate {
+		t.Errorf("Expected a non-certificate block to be rejected, got %v", err)
+	}
+}
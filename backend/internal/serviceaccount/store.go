@@ -0,0 +1,269 @@
+package serviceaccount
+
+import (
+	"crypto/x509"
+	"database/sql"
+	"fmt"
+
+	"github.com/google/uuid"
+	"github.com/lib/pq"
+)
+
+type Store struct {
+	db *sql.DB
+}
+
+func NewStore(db *sql.DB) *Store {
+	return &Store{db: db}
+}
+
+const columns = `u.id, u.tenant_id, COALESCE(u.name, ''), u.description, u.is_active,
+	ARRAY(SELECT role_id::text FROM user_roles WHERE user_id = u.id ORDER BY role_id),
+	ARRAY(SELECT group_id::text FROM user_groups WHERE user_id = u.id ORDER BY group_id),
+	u.created_at`
+
+func scan(row interface{ Scan(...interface{}) error }) (*ServiceAccount, error) {
+	var account ServiceAccount
+	err := row.Scan(&account.ID, &account.TenantID, &account.Name, &account.Description, &account.IsActive,
+		pq.Array(&account.RoleIDs), pq.Array(&account.GroupIDs), &account.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &account, nil
+}
+
+// List returns the service accounts of tenantID, newest first.
+func (s *Store) List(tenantID string) ([]*ServiceAccount, error) {
+	rows, err := s.db.Query(`
+		SELECT `+columns+` FROM users u
+		WHERE u.tenant_id = $1 AND u.principal_type = $2
+		ORDER BY u.created_at DESC
+	`, tenantID, PrincipalServiceAccount)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list service accounts: %w", err)
+	}
+	defer rows.Close()
+
+	accounts := []*ServiceAccount{}
+	for rows.Next() {
+		account, err := scan(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan service account: %w", err)
+		}
+		accounts = append(accounts, account)
+	}
+	return accounts, rows.Err()
+}
+
+// Get loads a service account of tenantID.
+func (s *Store) Get(tenantID, id string) (*ServiceAccount, error) {
+	account, err := scan(s.db.QueryRow(`
+		SELECT `+columns+` FROM users u
+		WHERE u.id = $1 AND u.tenant_id = $2 AND u.principal_type = $3
+	`, id, tenantID, PrincipalServiceAccount))
+	if err == sql.ErrNoRows {
+		return nil, ErrNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load service account: %w", err)
+	}
+	return account, nil
+}
+
+// Create adds account with its roles and groups. Its email column holds a
+// generated identifier nobody can sign in with, and it has no password.
+func (s *Store) Create(account *ServiceAccount) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	id := uuid.NewString()
+	_, err = tx.Exec(`
+		INSERT INTO users (id, tenant_id, email, password_hash, principal_type, name, description, is_active)
+		VALUES ($1, $2, $3, NULL, $4, $5, $6, $7)
+	`, id, account.TenantID, id+"@"+identifierDomain, PrincipalServiceAccount, account.Name, account.Description, account.IsActive)
+	if err != nil {
+		return fmt.Errorf("failed to create service account: %w", err)
+	}
+	if err := assign(tx, account.TenantID, id, account.RoleIDs, account.GroupIDs); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to create service account: %w", err)
+	}
+
+	created, err := s.Get(account.TenantID, id)
+	if err != nil {
+		return err
+	}
+	*account = *created
+	return nil
+}
+
+// Update saves the name, description, active flag, roles and groups of
+// account.
+func (s *Store) Update(account *ServiceAccount) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
+		UPDATE users SET name = $1, description = $2, is_active = $3
+		WHERE id = $4 AND tenant_id = $5 AND principal_type = $6
+	`, account.Name, account.Description, account.IsActive, account.ID, account.TenantID, PrincipalServiceAccount)
+	if err != nil {
+		return fmt.Errorf("failed to update service account: %w", err)
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return ErrNotFound
+	}
+	if _, err := tx.Exec(`DELETE FROM user_roles WHERE user_id = $1`, account.ID); err != nil {
+		return fmt.Errorf("failed to update service account roles: %w", err)
+	}
+	if _, err := tx.Exec(`DELETE FROM user_groups WHERE user_id = $1`, account.ID); err != nil {
+		return fmt.Errorf("failed to update service account groups: %w", err)
+	}
+	if err := assign(tx, account.TenantID, account.ID, account.RoleIDs, account.GroupIDs); err != nil {
+		return err
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to update service account: %w", err)
+	}
+
+	updated, err := s.Get(account.TenantID, account.ID)
+	if err != nil {
+		return err
+	}
+	*account = *updated
+	return nil
+}
+
+// assign gives a service account roles and groups, all of which must belong
+// to its tenant.
+func assign(tx *sql.Tx, tenantID, id string, roleIDs, groupIDs []string) error {
+	result, err := tx.Exec(`
+		INSERT INTO user_roles (user_id, role_id)
+		SELECT $1, r.id FROM roles r WHERE r.tenant_id = $2 AND r.id::text = ANY($3)
+	`, id, tenantID, pq.Array(roleIDs))
+	if err != nil {
+		return fmt.Errorf("failed to assign roles: %w", err)
+	}
+	if rowsAffected, _ := result.RowsAffected(); int(rowsAffected) != len(roleIDs) {
+		return ErrInvalidAssignment
+	}
+
+	result, err = tx.Exec(`
+		INSERT INTO user_groups (user_id, group_id)
+		SELECT $1, g.id FROM groups g WHERE g.tenant_id = $2 AND g.id::text = ANY($3)
+	`, id, tenantID, pq.Array(groupIDs))
+	if err != nil {
+		return fmt.Errorf("failed to assign groups: %w", err)
+	}
+	if rowsAffected, _ := result.RowsAffected(); int(rowsAffected) != len(groupIDs) {
+		return ErrInvalidAssignment
+	}
+	return nil
+}
+
+// Delete removes a service account with its keys, clients and certificates.
+func (s *Store) Delete(tenantID, id string) error {
+	result, err := s.db.Exec(`
+		DELETE FROM users WHERE id = $1 AND tenant_id = $2 AND principal_type = $3
+	`, id, tenantID, PrincipalServiceAccount)
+	if err != nil {
+		return fmt.Errorf("failed to delete service account: %w", err)
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+const certificateColumns = `id, service_account_id, thumbprint, subject, expires_at, created_at`
+
+func scanCertificate(row interface{ Scan(...interface{}) error }) (*Certificate, error) {
+	var cert Certificate
+	err := row.Scan(&cert.ID, &cert.ServiceAccountID, &cert.Thumbprint, &cert.Subject, &cert.ExpiresAt, &cert.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &cert, nil
+}
+
+// Certificates lists the client certificates registered for a service
+// account of tenantID.
+func (s *Store) Certificates(tenantID, accountID string) ([]*Certificate, error) {
+	rows, err := s.db.Query(`
+		SELECT `+certificateColumns+` FROM service_account_certificates
+		WHERE tenant_id = $1 AND service_account_id = $2
+		ORDER BY created_at DESC
+	`, tenantID, accountID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list certificates: %w", err)
+	}
+	defer rows.Close()
+
+	certs := []*Certificate{}
+	for rows.Next() {
+		cert, err := scanCertificate(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan certificate: %w", err)
+		}
+		certs = append(certs, cert)
+	}
+	return certs, rows.Err()
+}
+
+// AddCertificate registers cert for a service account of tenantID.
+func (s *Store) AddCertificate(tenantID, accountID string, cert *x509.Certificate) (*Certificate, error) {
+	registered, err := scanCertificate(s.db.QueryRow(`
+		INSERT INTO service_account_certificates (tenant_id, service_account_id, thumbprint, subject, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING `+certificateColumns,
+		tenantID, accountID, Thumbprint(cert), cert.Subject.String(), cert.NotAfter))
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		return nil, ErrDuplicateCertificate
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to register certificate: %w", err)
+	}
+	return registered, nil
+}
+
+// DeleteCertificate unregisters a certificate of a service account.
+func (s *Store) DeleteCertificate(tenantID, accountID, id string) error {
+	result, err := s.db.Exec(`
+		DELETE FROM service_account_certificates
+		WHERE id = $1 AND service_account_id = $2 AND tenant_id = $3
+	`, id, accountID, tenantID)
+	if err != nil {
+		return fmt.Errorf("failed to delete certificate: %w", err)
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return ErrNotFound
+	}
+	return nil
+}
+
+// AuthenticateCertificate returns the active service account cert is
+// registered for. The TLS layer has already verified the chain; the
+// registration pins the exact certificate.
+func (s *Store) AuthenticateCertificate(cert *x509.Certificate) (*ServiceAccount, error) {
+	account, err := scan(s.db.QueryRow(`
+		SELECT `+columns+`
+		FROM service_account_certificates c
+		JOIN users u ON u.id = c.service_account_id AND u.is_active = true
+		WHERE c.thumbprint = $1 AND c.expires_at > CURRENT_TIMESTAMP
+	`, Thumbprint(cert)))
+	if err == sql.ErrNoRows {
+		return nil, ErrUnknownCertificate
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate: %w", err)
+	}
+	return account, nil
+}
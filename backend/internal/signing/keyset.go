@@ -0,0 +1,80 @@
+package signing
+
+import (
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// KeySet is an immutable set of keys: at most one current key that signs,
+// plus retired keys that still verify.
+type KeySet struct {
+	current *Key
+	keys    []*Key
+	byID    map[string]*Key
+}
+
+// NewKeySet builds a set from keys. The first key that is not retired becomes
+// the current signing key.
+func NewKeySet(keys ...*Key) *KeySet {
+	s := &KeySet{keys: keys, byID: make(map[string]*Key, len(keys))}
+	for _, key := range keys {
+		s.byID[key.ID] = key
+		if s.current == nil && !key.Retired {
+			s.current = key
+		}
+	}
+	return s
+}
+
+// Current returns the key new tokens are signed with.
+func (s *KeySet) Current() *Key {
+	return s.current
+}
+
+// Sign signs claims with the current key and sets the kid header.
+func (s *KeySet) Sign(claims jwt.Claims) (string, error) {
+	if s.current == nil {
+		return "", ErrNoSigningKey
+	}
+	method, err := SigningMethod(s.current.Algorithm)
+	if err != nil {
+		return "", err
+	}
+
+	t := jwt.NewWithClaims(method, claims)
+	t.Header["kid"] = s.current.ID
+	return t.SignedString(s.current.Private)
+}
+
+// Keyfunc resolves the verification key of a token from its kid. Retired
+// keys are accepted until they expire; the token's algorithm has to match
+// the algorithm of the key.
+func (s *KeySet) Keyfunc(t *jwt.Token) (interface{}, error) {
+	kid, _ := t.Header["kid"].(string)
+	key, ok := s.byID[kid]
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	if key.expired(time.Now()) {
+		return nil, ErrUnknownKey
+	}
+	if t.Method == nil || t.Method.Alg() != key.Algorithm {
+		return nil, ErrAlgorithmMismatch
+	}
+	return key.Public, nil
+}
+
+// JWKS returns the public keys that tokens may currently be verified with.
+func (s *KeySet) JWKS() JWKS {
+	doc := JWKS{Keys: []JWK{}}
+	for _, key := range s.keys {
+		if key.expired(time.Now()) {
+			continue
+		}
+		if jwk, err := key.JWK(); err == nil {
+			doc.Keys = append(doc.Keys, jwk)
+		}
+	}
+	return doc
+}
@@ -0,0 +1,233 @@
+package signing
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/ForIAM/ForIAM/backend/internal/sealing"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// rotationLockID serialises rotation across server instances sharing one
+// database (pg_advisory_xact_lock key).
+const rotationLockID = 0x666f7269616d
+
+// Options configure a Manager.
+type Options struct {
+	Algorithm string
+	// How long a key signs before it is replaced
+	RotationInterval time.Duration
+	// How long a retired key keeps verifying; at least the lifetime of the
+	// longest-lived token it signed
+	Overlap time.Duration
+	// Key the private keys are encrypted with in the database
+	EncryptionKey string
+}
+
+// Manager keeps signing keys in the signing_keys table and rotates them. All
+// instances sharing the database pick up rotations on their next refresh.
+type Manager struct {
+	db   *sql.DB
+	opts Options
+	box  *sealing.Box
+
+	mu   sync.RWMutex
+	keys *KeySet
+}
+
+// NewManager loads the stored keys, creating the first key if there is none
+// for the configured algorithm.
+func NewManager(db *sql.DB, opts Options) (*Manager, error) {
+	if _, err := SigningMethod(opts.Algorithm); err != nil {
+		return nil, err
+	}
+
+	m := &Manager{db: db, opts: opts, box: sealing.New(opts.EncryptionKey, sealing.PurposeSigningKey), keys: NewKeySet()}
+	err := m.rotate(false)
+	if err == ErrNoSigningKey {
+		// The active key could not be decrypted, e.g. after the encryption
+		// key changed
+		err = m.rotate(true)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// KeySet returns the keys currently in use.
+func (m *Manager) KeySet() *KeySet {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.keys
+}
+
+// Sign signs claims with the current key.
+func (m *Manager) Sign(claims jwt.Claims) (string, error) {
+	return m.KeySet().Sign(claims)
+}
+
+// Keyfunc resolves the verification key of a token; see KeySet.Keyfunc.
+func (m *Manager) Keyfunc(t *jwt.Token) (interface{}, error) {
+	return m.KeySet().Keyfunc(t)
+}
+
+// JWKS returns the public keys tokens may be verified with.
+func (m *Manager) JWKS() JWKS {
+	return m.KeySet().JWKS()
+}
+
+// Rotate replaces the current key straight away. The old key keeps verifying
+// for the overlap window.
+func (m *Manager) Rotate() error {
+	return m.rotate(true)
+}
+
+// Run rotates the key when it is due and reloads keys rotated by other
+// instances, checking every interval until ctx is done.
+func (m *Manager) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := m.rotate(false); err != nil {
+				log.Println("Failed to rotate signing keys:", err)
+			}
+		}
+	}
+}
+
+// rotate creates a new key when forced, when the current key is older than
+// the rotation interval or when it uses another algorithm, then reloads the
+// key set.
+func (m *Manager) rotate(force bool) error {
+	tx, err := m.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock($1)`, rotationLockID); err != nil {
+		return err
+	}
+
+	var current bool
+	err = tx.QueryRow(`
+		SELECT EXISTS(
+			SELECT 1 FROM signing_keys
+			WHERE retired_at IS NULL AND algorithm = $1
+			  AND created_at > CURRENT_TIMESTAMP - make_interval(secs => $2)
+		)
+	`, m.opts.Algorithm, m.opts.RotationInterval.Seconds()).Scan(&current)
+	if err != nil {
+		return err
+	}
+
+	if force || !current {
+		key, err := GenerateKey(m.opts.Algorithm)
+		if err != nil {
+			return err
+		}
+		der, err := marshalPrivate(key.Private)
+		if err != nil {
+			return err
+		}
+		sealed, err := m.box.Seal(der)
+		if err != nil {
+			return err
+		}
+
+		if _, err := tx.Exec(`
+			UPDATE signing_keys
+			SET retired_at = CURRENT_TIMESTAMP,
+			    expires_at = CURRENT_TIMESTAMP + make_interval(secs => $1)
+			WHERE retired_at IS NULL
+		`, m.opts.Overlap.Seconds()); err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`
+			INSERT INTO signing_keys (kid, algorithm, private_key)
+			VALUES ($1, $2, $3)
+		`, key.ID, key.Algorithm, sealed); err != nil {
+			return err
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	return m.load()
+}
+
+// load reads every key that can still verify tokens, newest first.
+func (m *Manager) load() error {
+	rows, err := m.db.Query(`
+		SELECT kid, algorithm, private_key, retired_at IS NOT NULL,
+		       EXTRACT(EPOCH FROM (expires_at - CURRENT_TIMESTAMP))
+		FROM signing_keys
+		WHERE expires_at IS NULL OR expires_at > CURRENT_TIMESTAMP
+		ORDER BY created_at DESC
+	`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	now := time.Now()
+	var keys []*Key
+	for rows.Next() {
+		var kid, alg string
+		var sealed []byte
+		var retired bool
+		var remaining sql.NullFloat64
+		if err := rows.Scan(&kid, &alg, &sealed, &retired, &remaining); err != nil {
+			return err
+		}
+
+		der, err := m.box.Open(sealed)
+		if err != nil {
+			// Stored with another encryption secret; it can neither sign
+			// nor be published reliably
+			log.Printf("Skipping signing key %s: %v", kid, err)
+			continue
+		}
+		private, err := parsePrivate(der)
+		if err != nil {
+			return err
+		}
+		key, err := newKey(alg, private)
+		if err != nil {
+			return err
+		}
+		if key.ID != kid {
+			return errors.New("signing key " + kid + " does not match its stored kid")
+		}
+
+		key.Retired = retired
+		if remaining.Valid {
+			key.ExpiresAt = now.Add(time.Duration(remaining.Float64 * float64(time.Second)))
+		}
+		keys = append(keys, key)
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	set := NewKeySet(keys...)
+	if set.Current() == nil {
+		return ErrNoSigningKey
+	}
+
+	m.mu.Lock()
+	m.keys = set
+	m.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,127 @@
+package signing
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ForIAM/ForIAM/backend/internal/sealing"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestSignAndVerify(t *testing.T) {
+	for _, alg := range []string{RS256, ES256, EdDSA} {
+		t.Run(alg, func(t *testing.T) {
+			key, err := GenerateKey(alg)
+			if err != nil {
+				t.Fatalf("GenerateKey returned error: %v", err)
+			}
+			set := NewKeySet(key)
+
+			signed, err := set.Sign(jwt.MapClaims{"sub": "user-1"})
+			if err != nil {
+				t.Fatalf("Sign returned error: %v", err)
+			}
+
+			parsed, err := jwt.Parse(signed, set.Keyfunc)
+			if err != nil || !parsed.Valid {
+				t.Fatalf("Expected token to verify, got %v", err)
+			}
+			if parsed.Header["kid"] != key.ID {
+				t.Errorf("Expected kid %q, got %v", key.ID, parsed.Header["kid"])
+			}
+
+			jwks := set.JWKS()
+			if len(jwks.Keys) != 1 || jwks.Keys[0].KeyID != key.ID || jwks.Keys[0].Algorithm != alg {
+				t.Errorf("Unexpected JWKS: %+v", jwks)
+			}
+
+			// Other services verify with the key read back from the JWKS
+			public, err := jwks.Keys[0].PublicKey()
+			if err != nil {
+				t.Fatalf("PublicKey returned error: %v", err)
+			}
+			if _, err := jwt.Parse(signed, func(*jwt.Token) (interface{}, error) { return public, nil }); err != nil {
+				t.Errorf("Expected token to verify with the published key, got %v", err)
+			}
+		})
+	}
+}
+
+func TestRetiredKeys(t *testing.T) {
+	old, _ := GenerateKey(ES256)
+	signed, err := NewKeySet(old).Sign(jwt.MapClaims{"sub": "user-1"})
+	if err != nil {
+		t.Fatalf("Sign returned error: %v", err)
+	}
+
+	current, _ := GenerateKey(ES256)
+	old.Retired = true
+	old.ExpiresAt = time.Now().Add(time.Hour)
+	set := NewKeySet(current, old)
+
+	if set.Current() != current {
+		t.Fatal("Expected the non-retired key to sign")
+	}
+	if _, err := jwt.Parse(signed, set.Keyfunc); err != nil {
+		t.Errorf("Expected token of a retired key to verify within the overlap, got %v", err)
+	}
+	if n := len(set.JWKS().Keys); n != 2 {
+		t.Errorf("Expected both keys to be published, got %d", n)
+	}
+
+	old.ExpiresAt = time.Now().Add(-time.Second)
+	if _, err := jwt.Parse(signed, set.Keyfunc); err == nil {
+		t.Error("Expected token of an expired key to be rejected")
+	}
+	if n := len(set.JWKS().Keys); n != 1 {
+		t.Errorf("Expected the expired key to be unpublished, got %d keys", n)
+	}
+}
+
+func TestKeyfunc_RejectsUnknownKidAndWrongAlgorithm(t *testing.T) {
+	key, _ := GenerateKey(ES256)
+	set := NewKeySet(key)
+
+	other, _ := GenerateKey(ES256)
+	signed, _ := NewKeySet(other).Sign(jwt.MapClaims{"sub": "user-1"})
+	if _, err := jwt.Parse(signed, set.Keyfunc); err == nil {
+		t.Error("Expected token with an unknown kid to be rejected")
+	}
+
+	// HS256 with the public key as the secret must not be accepted
+	forged := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "user-1"})
+	forged.Header["kid"] = key.ID
+	raw, _ := forged.SignedString([]byte("anything"))
+	if _, err := jwt.Parse(raw, set.Keyfunc); err == nil {
+		t.Error("Expected token with a mismatched algorithm to be rejected")
+	}
+}
+
+func TestThumbprint_RFC7638(t *testing.T) {
+	// Example from RFC 7638, section 3.1
+	jwk := JWK{
+		KeyType: "RSA",
+		E:       "AQAB",
+		N: "0vx7agoebGcQSuuPiLJXZptN9nndrQmbXEps2aiAFbWhM78LhWx4cbbfAAtVT86zwu1RK7aPFFxuhDR1L6tSoc_BJECPebWKRXjBZCiFV4n3oknjhMstn64tZ_2W-5JsGY4Hc5n9yBXArwl93lqt7_RN5w6Cf0h4QyQ5v-65YGjQR0_FDW2QvzqY368QQMicAtaSqzs8KJZgnYb9c7d0zgdAZHzu6qMQvRL5hajrn1n91CbOpbISD08qNLyrdkt-bFTWhAI4vMQFh6WeZu0fM4lFd2NcRwr3XPksINHaQ-G_xBniIqbw0Ls1jF44-csFCur-kEgU8awapJzKnqDKgw",
+	}
+
+	got, err := thumbprint(jwk)
+	if err != nil {
+		t.Fatalf("thumbprint returned error: %v", err)
+	}
+	if want := "NzbLsXh8uDCcd-6MNwXF4W_7noWXFZAfHkxZsRGC9Xs"; got != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+}
+
+func TestPrivateKeysSealedForSigningOnly(t *testing.T) {
+	m := &Manager{box: sealing.New("key", sealing.PurposeSigningKey)}
+
+	sealed, err := m.box.Seal([]byte("private key"))
+	if err != nil {
+		t.Fatalf("Seal returned error: %v", err)
+	}
+	if _, err := sealing.New("key", sealing.PurposeTOTPSecret).Open(sealed); err == nil {
+		t.Error("Expected a box of another purpose not to open private keys")
+	}
+}
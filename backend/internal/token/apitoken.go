@@ -0,0 +1,185 @@
+package token
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+var (
+	ErrAPITokenInvalid  = errors.New("invalid api token")
+	ErrAPITokenNotFound = errors.New("api token not found")
+)
+
+// APIKeyPrefix starts every API key, so keys are recognisable in logs and by
+// secret scanners.
+const APIKeyPrefix = "fiam_"
+
+// displayPrefixLength is how much of a key is kept in the clear so its owner
+// can tell keys apart.
+const displayPrefixLength = len(APIKeyPrefix) + 8
+
+// APIToken is a long-lived API key of a user or service account. Only the
+// SHA-256 hash of the key is stored, next to its first characters for
+// display. Scopes are the permissions the key may use, on top of those its
+// owner holds. PrincipalType tells which kind of principal owns the key.
+type APIToken struct {
+	ID            string     `json:"id"`
+	TenantID      string     `json:"tenant_id"`
+	UserID        string     `json:"user_id"`
+	Email         string     `json:"email"`
+	PrincipalType string     `json:"-"`
+	Name          string     `json:"name"`
+	Prefix        string     `json:"prefix"`
+	Scopes        []string   `json:"scopes"`
+	ExpiresAt     *time.Time `json:"expires_at"`
+	LastUsedAt    *time.Time `json:"last_used_at"`
+	LastUsedIP    *string    `json:"last_used_ip"`
+	CreatedAt     time.Time  `json:"created_at"`
+}
+
+type APITokenStore struct {
+	db *sql.DB
+}
+
+func NewAPITokenStore(db *sql.DB) *APITokenStore {
+	return &APITokenStore{db: db}
+}
+
+// IsAPIKey tells an API key apart from a signed token.
+func IsAPIKey(raw string) bool {
+	return strings.Count(raw, ".") != 2
+}
+
+const apiTokenColumns = `t.id, t.tenant_id, t.user_id, u.email, u.principal_type, t.name, t.prefix, t.scopes,
+	t.expires_at, t.last_used_at, t.last_used_ip, t.created_at`
+
+func scanAPIToken(row interface{ Scan(...interface{}) error }) (*APIToken, error) {
+	var t APIToken
+	err := row.Scan(&t.ID, &t.TenantID, &t.UserID, &t.Email, &t.PrincipalType, &t.Name, &t.Prefix, pq.Array(&t.Scopes),
+		&t.ExpiresAt, &t.LastUsedAt, &t.LastUsedIP, &t.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &t, nil
+}
+
+// Create issues a key for userID and returns it along with the raw key,
+// which is shown once and never stored.
+func (s *APITokenStore) Create(tenantID, userID, name string, scopes []string, expiresAt *time.Time) (string, *APIToken, error) {
+	secret, err := GenerateOpaque(32)
+	if err != nil {
+		return "", nil, err
+	}
+	raw := APIKeyPrefix + secret
+
+	t, err := scanAPIToken(s.db.QueryRow(`
+		WITH t AS (
+			INSERT INTO api_tokens (tenant_id, user_id, token_hash, prefix, name, scopes, expires_at)
+			VALUES ($1, $2, $3, $4, $5, $6, $7)
+			RETURNING *
+		)
+		SELECT `+apiTokenColumns+` FROM t JOIN users u ON u.id = t.user_id
+	`, tenantID, userID, HashToken(raw), raw[:displayPrefixLength], name, pq.Array(scopes), expiresAt))
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to create api token: %w", err)
+	}
+	return raw, t, nil
+}
+
+// Lookup returns the token matching raw. Unknown and expired tokens, and
+// tokens of inactive users, return ErrAPITokenInvalid.
+func (s *APITokenStore) Lookup(raw string) (*APIToken, error) {
+	t, err := scanAPIToken(s.db.QueryRow(`
+		SELECT `+apiTokenColumns+`
+		FROM api_tokens t
+		JOIN users u ON u.id = t.user_id AND u.is_active = true
+		WHERE t.token_hash = $1
+		  AND (t.expires_at IS NULL OR t.expires_at > CURRENT_TIMESTAMP)
+	`, HashToken(raw)))
+	if err == sql.ErrNoRows {
+		return nil, ErrAPITokenInvalid
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load api token: %w", err)
+	}
+	return t, nil
+}
+
+// Authenticate is Lookup for a request made with the key, recording when and
+// from where the key was last used.
+func (s *APITokenStore) Authenticate(raw, ip string) (*APIToken, error) {
+	t, err := scanAPIToken(s.db.QueryRow(`
+		UPDATE api_tokens t
+		SET last_used_at = CURRENT_TIMESTAMP, last_used_ip = $2
+		FROM users u
+		WHERE t.token_hash = $1
+		  AND u.id = t.user_id AND u.is_active = true
+		  AND (t.expires_at IS NULL OR t.expires_at > CURRENT_TIMESTAMP)
+		RETURNING `+apiTokenColumns, HashToken(raw), ip))
+	if err == sql.ErrNoRows {
+		return nil, ErrAPITokenInvalid
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load api token: %w", err)
+	}
+	return t, nil
+}
+
+// Get loads a token of tenantID by its ID.
+func (s *APITokenStore) Get(tenantID, id string) (*APIToken, error) {
+	t, err := scanAPIToken(s.db.QueryRow(`
+		SELECT `+apiTokenColumns+`
+		FROM api_tokens t
+		JOIN users u ON u.id = t.user_id
+		WHERE t.id = $1 AND t.tenant_id = $2
+	`, id, tenantID))
+	if err == sql.ErrNoRows {
+		return nil, ErrAPITokenNotFound
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to load api token: %w", err)
+	}
+	return t, nil
+}
+
+// List returns the tokens of userID, newest first, including expired ones.
+func (s *APITokenStore) List(tenantID, userID string) ([]*APIToken, error) {
+	rows, err := s.db.Query(`
+		SELECT `+apiTokenColumns+`
+		FROM api_tokens t
+		JOIN users u ON u.id = t.user_id
+		WHERE t.tenant_id = $1 AND t.user_id = $2
+		ORDER BY t.created_at DESC
+	`, tenantID, userID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list api tokens: %w", err)
+	}
+	defer rows.Close()
+
+	tokens := []*APIToken{}
+	for rows.Next() {
+		t, err := scanAPIToken(rows)
+		if err != nil {
+			return nil, fmt.Errorf("failed to scan api token: %w", err)
+		}
+		tokens = append(tokens, t)
+	}
+	return tokens, rows.Err()
+}
+
+// Delete removes a token of tenantID, revoking it.
+func (s *APITokenStore) Delete(tenantID, id string) error {
+	result, err := s.db.Exec(`DELETE FROM api_tokens WHERE id = $1 AND tenant_id = $2`, id, tenantID)
+	if err != nil {
+		return fmt.Errorf("failed to delete api token: %w", err)
+	}
+	if rowsAffected, _ := result.RowsAffected(); rowsAffected == 0 {
+		return ErrAPITokenNotFound
+	}
+	return nil
+}
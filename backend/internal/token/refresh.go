@@ -0,0 +1,169 @@
+package token
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrRefreshTokenInvalid = errors.New("invalid refresh token")
+	ErrRefreshTokenExpired = errors.New("refresh token expired")
+	ErrRefreshTokenReused  = errors.New("refresh token reuse detected")
+)
+
+// RefreshToken is the server-side record behind an opaque refresh token.
+// Every token issued by a login belongs to one family; rotating a token
+// keeps the family and marks the old token as rotated.
+type RefreshToken struct {
+	ID        string
+	TenantID  string
+	UserID    string
+	FamilyID  string
+	ExpiresAt time.Time
+}
+
+type RefreshStore struct {
+	db  *sql.DB
+	ttl time.Duration
+}
+
+func NewRefreshStore(db *sql.DB, ttl time.Duration) *RefreshStore {
+	return &RefreshStore{db: db, ttl: ttl}
+}
+
+// GenerateOpaque returns a URL-safe random string carrying n bytes of entropy.
+func GenerateOpaque(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("failed to read random bytes: %w", err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// HashToken returns the hex encoded SHA-256 digest stored in place of an
+// opaque token. Only high-entropy, server-generated values are hashed this way.
+func HashToken(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
+
+// Issue starts a new token family for a fresh login and returns the raw token.
+func (s *RefreshStore) Issue(tenantID, userID string) (string, error) {
+	raw, err := GenerateOpaque(32)
+	if err != nil {
+		return "", err
+	}
+
+	_, err = s.db.Exec(`
+		INSERT INTO refresh_tokens (tenant_id, user_id, family_id, token_hash, expires_at)
+		VALUES ($1, $2, gen_random_uuid(), $3, $4)
+	`, tenantID, userID, HashToken(raw), time.Now().Add(s.ttl))
+	if err != nil {
+		return "", fmt.Errorf("failed to store refresh token: %w", err)
+	}
+
+	return raw, nil
+}
+
+// Rotate exchanges a refresh token for a new one in the same family. If the
+// presented token has already been rotated, the whole family is revoked and
+// ErrRefreshTokenReused is returned along with the record that was replayed.
+func (s *RefreshStore) Rotate(raw string) (string, *RefreshToken, error) {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var rt RefreshToken
+	var rotatedAt, revokedAt sql.NullTime
+	err = tx.QueryRow(`
+		SELECT id, tenant_id, user_id, family_id, expires_at, rotated_at, revoked_at
+		FROM refresh_tokens
+		WHERE token_hash = $1
+		FOR UPDATE
+	`, HashToken(raw)).Scan(&rt.ID, &rt.TenantID, &rt.UserID, &rt.FamilyID, &rt.ExpiresAt, &rotatedAt, &revokedAt)
+	if err == sql.ErrNoRows {
+		return "", nil, ErrRefreshTokenInvalid
+	}
+	if err != nil {
+		return "", nil, fmt.Errorf("failed to load refresh token: %w", err)
+	}
+
+	if rotatedAt.Valid {
+		if _, err := tx.Exec(`
+			UPDATE refresh_tokens
+			SET revoked_at = CURRENT_TIMESTAMP
+			WHERE family_id = $1 AND revoked_at IS NULL
+		`, rt.FamilyID); err != nil {
+			return "", nil, fmt.Errorf("failed to revoke token family: %w", err)
+		}
+		if err := tx.Commit(); err != nil {
+			return "", nil, fmt.Errorf("failed to revoke token family: %w", err)
+		}
+		return "", &rt, ErrRefreshTokenReused
+	}
+	if revokedAt.Valid {
+		return "", nil, ErrRefreshTokenInvalid
+	}
+	if time.Now().After(rt.ExpiresAt) {
+		return "", nil, ErrRefreshTokenExpired
+	}
+
+	if _, err := tx.Exec(`
+		UPDATE refresh_tokens SET rotated_at = CURRENT_TIMESTAMP WHERE id = $1
+	`, rt.ID); err != nil {
+		return "", nil, fmt.Errorf("failed to rotate refresh token: %w", err)
+	}
+
+	next, err := GenerateOpaque(32)
+	if err != nil {
+		return "", nil, err
+	}
+	if _, err := tx.Exec(`
+		INSERT INTO refresh_tokens (tenant_id, user_id, family_id, token_hash, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+	`, rt.TenantID, rt.UserID, rt.FamilyID, HashToken(next), time.Now().Add(s.ttl)); err != nil {
+		return "", nil, fmt.Errorf("failed to store refresh token: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", nil, fmt.Errorf("failed to commit rotation: %w", err)
+	}
+
+	return next, &rt, nil
+}
+
+// RevokeFamily revokes every token in the family of the given raw token. An
+// unknown token is not an error; there is simply nothing left to revoke.
+func (s *RefreshStore) RevokeFamily(raw string) error {
+	_, err := s.db.Exec(`
+		UPDATE refresh_tokens
+		SET revoked_at = CURRENT_TIMESTAMP
+		WHERE revoked_at IS NULL
+		  AND family_id = (SELECT family_id FROM refresh_tokens WHERE token_hash = $1)
+	`, HashToken(raw))
+	if err != nil {
+		return fmt.Errorf("failed to revoke token family: %w", err)
+	}
+	return nil
+}
+
+// RevokeUser revokes every outstanding refresh token of a user.
+func (s *RefreshStore) RevokeUser(userID string) error {
+	_, err := s.db.Exec(`
+		UPDATE refresh_tokens
+		SET revoked_at = CURRENT_TIMESTAMP
+		WHERE user_id = $1 AND revoked_at IS NULL
+	`, userID)
+	if err != nil {
+		return fmt.Errorf("failed to revoke refresh tokens: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,327 @@
+package token
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGenerateOpaque(t *testing.T) {
+	a, err := GenerateOpaque(32)
+	if err != nil {
+		t.Fatalf("GenerateOpaque returned error: %v", err)
+	}
+	b, err := GenerateOpaque(32)
+	if err != nil {
+		t.Fatalf("GenerateOpaque returned error: %v", err)
+	}
+
+	if a == b {
+		t.Error("Expected two generated tokens to differ")
+	}
+	if len(a) != 43 {
+		t.Errorf("Expected 43 characters for 32 bytes, got %d", len(a))
+	}
+}
+
+func TestHashToken(t *testing.T) {
+	if HashToken("abc") != HashToken("abc") {
+		t.Error("Expected hashing to be deterministic")
+	}
+	if HashToken("abc") == HashToken("abd") {
+		t.Error("Expected different tokens to hash differently")
+	}
+	if HashToken("abc") == "abc" {
+		t.Error("Expected hash to differ from the raw token")
+	}
+}
+
+func TestRefreshStore_Rotate(t *testing.T) {
+	db := openRefreshDB(t)
+	store := NewRefreshStore(db, time.Hour)
+
+	first, err := store.Issue("tenant-1", "user-1")
+	if err != nil {
+		t.Fatalf("Issue returned error: %v", err)
+	}
+	second, rt, err := store.Rotate(first)
+	if err != nil {
+		t.Fatalf("Rotate returned error: %v", err)
+	}
+	if second == "" || second == first {
+		t.Error("Expected rotation to return a new token")
+	}
+	if rt.TenantID != "tenant-1" || rt.UserID != "user-1" {
+		t.Errorf("Expected the record of user-1, got %+v", rt)
+	}
+
+	third, next, err := store.Rotate(second)
+	if err != nil {
+		t.Fatalf("Rotate of the new token returned error: %v", err)
+	}
+	if next.FamilyID != rt.FamilyID {
+		t.Errorf("Expected rotation to keep family %s, got %s", rt.FamilyID, next.FamilyID)
+	}
+
+	if _, _, err := store.Rotate("unknown"); !errors.Is(err, ErrRefreshTokenInvalid) {
+		t.Errorf("Expected ErrRefreshTokenInvalid for an unknown token, got %v", err)
+	}
+
+	// Replaying a rotated token revokes its whole family
+	_, replayed, err := store.Rotate(first)
+	if !errors.Is(err, ErrRefreshTokenReused) {
+		t.Fatalf("Expected ErrRefreshTokenReused, got %v", err)
+	}
+	if replayed == nil || replayed.UserID != "user-1" {
+		t.Errorf("Expected the replayed record, got %+v", replayed)
+	}
+	if _, _, err := store.Rotate(third); !errors.Is(err, ErrRefreshTokenInvalid) {
+		t.Errorf("Expected the latest token of the family to be revoked, got %v", err)
+	}
+
+	other, err := store.Issue("tenant-1", "user-1")
+	if err != nil {
+		t.Fatalf("Issue returned error: %v", err)
+	}
+	if _, _, err := store.Rotate(other); err != nil {
+		t.Errorf("Expected other families to stay valid, got %v", err)
+	}
+}
+
+func TestRefreshStore_RotateExpired(t *testing.T) {
+	store := NewRefreshStore(openRefreshDB(t), -time.Minute)
+
+	raw, err := store.Issue("tenant-1", "user-1")
+	if err != nil {
+		t.Fatalf("Issue returned error: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		// Expired tokens are refused without being used up
+		if _, _, err := store.Rotate(raw); !errors.Is(err, ErrRefreshTokenExpired) {
+			t.Errorf("Expected ErrRefreshTokenExpired, got %v", err)
+		}
+	}
+}
+
+func TestRefreshStore_Revoke(t *testing.T) {
+	store := NewRefreshStore(openRefreshDB(t), time.Hour)
+
+	a, _ := store.Issue("tenant-1", "user-1")
+	rotated, _, err := store.Rotate(a)
+	if err != nil {
+		t.Fatalf("Rotate returned error: %v", err)
+	}
+	b, _ := store.Issue("tenant-1", "user-1")
+	c, _ := store.Issue("tenant-1", "user-2")
+
+	if err := store.RevokeFamily(a); err != nil {
+		t.Fatalf("RevokeFamily returned error: %v", err)
+	}
+	if _, _, err := store.Rotate(rotated); !errors.Is(err, ErrRefreshTokenInvalid) {
+		t.Errorf("Expected the family of a to be revoked, got %v", err)
+	}
+	if err := store.RevokeFamily("unknown"); err != nil {
+		t.Errorf("Expected revoking an unknown token to succeed, got %v", err)
+	}
+
+	if err := store.RevokeUser("user-1"); err != nil {
+		t.Fatalf("RevokeUser returned error: %v", err)
+	}
+	if _, _, err := store.Rotate(b); !errors.Is(err, ErrRefreshTokenInvalid) {
+		t.Errorf("Expected the tokens of user-1 to be revoked, got %v", err)
+	}
+	if _, _, err := store.Rotate(c); err != nil {
+		t.Errorf("Expected the tokens of user-2 to stay valid, got %v", err)
+	}
+}
+
+// refreshDriver is a database/sql driver keeping refresh_tokens in memory.
+// It understands only the statements of RefreshStore, so the store runs
+// unchanged without Postgres.
+type refreshDriver struct {
+	mu  sync.Mutex
+	dbs map[string]*refreshDB
+}
+
+type refreshRow struct {
+	id, tenantID, userID, familyID, hash string
+	expiresAt                            time.Time
+	rotatedAt, revokedAt                 interface{}
+}
+
+type refreshDB struct {
+	mu   sync.Mutex
+	rows []*refreshRow
+	seq  int
+}
+
+var testRefreshDriver = &refreshDriver{dbs: map[string]*refreshDB{}}
+
+func init() {
+	sql.Register("refreshtest", testRefreshDriver)
+}
+
+func openRefreshDB(t *testing.T) *sql.DB {
+	testRefreshDriver.mu.Lock()
+	testRefreshDriver.dbs[t.Name()] = &refreshDB{}
+	testRefreshDriver.mu.Unlock()
+
+	db, err := sql.Open("refreshtest", t.Name())
+	if err != nil {
+		t.Fatalf("Failed to open database: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func (d *refreshDriver) Open(name string) (driver.Conn, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	db, ok := d.dbs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown database %q", name)
+	}
+	return &refreshConn{db: db}, nil
+}
+
+// refreshConn holds the lock of its database for the length of a
+// transaction, as FOR UPDATE would, and restores the rows on rollback.
+type refreshConn struct {
+	db       *refreshDB
+	snapshot []refreshRow
+	inTx     bool
+}
+
+func (c *refreshConn) Prepare(query string) (driver.Stmt, error) {
+	return &refreshStmt{conn: c, query: query}, nil
+}
+
+func (c *refreshConn) Close() error { return nil }
+
+func (c *refreshConn) Begin() (driver.Tx, error) {
+	c.db.mu.Lock()
+	c.inTx = true
+	c.snapshot = nil
+	for _, row := range c.db.rows {
+		c.snapshot = append(c.snapshot, *row)
+	}
+	return c, nil
+}
+
+func (c *refreshConn) Commit() error {
+	c.inTx = false
+	c.db.mu.Unlock()
+	return nil
+}
+
+func (c *refreshConn) Rollback() error {
+	c.db.rows = nil
+	for i := range c.snapshot {
+		c.db.rows = append(c.db.rows, &c.snapshot[i])
+	}
+	c.inTx = false
+	c.db.mu.Unlock()
+	return nil
+}
+
+type refreshStmt struct {
+	conn  *refreshConn
+	query string
+}
+
+func (s *refreshStmt) Close() error  { return nil }
+func (s *refreshStmt) NumInput() int { return -1 }
+
+func (s *refreshStmt) Exec(args []driver.Value) (driver.Result, error) {
+	db := s.conn.db
+	if !s.conn.inTx {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+	}
+	now := time.Now()
+	var affected int64
+	update := func(match func(*refreshRow) bool, apply func(*refreshRow)) {
+		for _, row := range db.rows {
+			if match(row) {
+				apply(row)
+				affected++
+			}
+		}
+	}
+	revoke := func(row *refreshRow) { row.revokedAt = now }
+
+	switch q := s.query; {
+	case strings.Contains(q, "INSERT INTO refresh_tokens"):
+		db.seq++
+		row := &refreshRow{id: fmt.Sprint("token-", db.seq), tenantID: args[0].(string), userID: args[1].(string)}
+		if len(args) == 4 {
+			row.familyID, row.hash, row.expiresAt = fmt.Sprint("family-", db.seq), args[2].(string), args[3].(time.Time)
+		} else {
+			row.familyID, row.hash, row.expiresAt = args[2].(string), args[3].(string), args[4].(time.Time)
+		}
+		db.rows = append(db.rows, row)
+		affected = 1
+	case strings.Contains(q, "SET rotated_at"):
+		update(func(row *refreshRow) bool { return row.id == args[0] }, func(row *refreshRow) { row.rotatedAt = now })
+	case strings.Contains(q, "family_id = (SELECT"):
+		family := ""
+		for _, row := range db.rows {
+			if row.hash == args[0] {
+				family = row.familyID
+			}
+		}
+		update(func(row *refreshRow) bool { return row.familyID == family && row.revokedAt == nil }, revoke)
+	case strings.Contains(q, "WHERE family_id = $1"):
+		update(func(row *refreshRow) bool { return row.familyID == args[0] && row.revokedAt == nil }, revoke)
+	case strings.Contains(q, "WHERE user_id = $1"):
+		update(func(row *refreshRow) bool { return row.userID == args[0] && row.revokedAt == nil }, revoke)
+	default:
+		return nil, fmt.Errorf("unexpected statement %q", s.query)
+	}
+	return driver.RowsAffected(affected), nil
+}
+
+func (s *refreshStmt) Query(args []driver.Value) (driver.Rows, error) {
+	if !strings.Contains(s.query, "WHERE token_hash = $1") {
+		return nil, fmt.Errorf("unexpected query %q", s.query)
+	}
+	db := s.conn.db
+	if !s.conn.inTx {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+	}
+	rows := &refreshRows{}
+	for _, row := range db.rows {
+		if row.hash == args[0] {
+			rows.values = append(rows.values, []driver.Value{
+				row.id, row.tenantID, row.userID, row.familyID, row.expiresAt, row.rotatedAt, row.revokedAt,
+			})
+		}
+	}
+	return rows, nil
+}
+
+type refreshRows struct {
+	values [][]driver.Value
+}
+
+func (r *refreshRows) Columns() []string {
+	return []string{"id", "tenant_id", "user_id", "family_id", "expires_at", "rotated_at", "revoked_at"}
+}
+
+func (r *refreshRows) Close() error { return nil }
+
+func (r *refreshRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
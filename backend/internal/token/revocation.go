@@ -0,0 +1,115 @@
+package token
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// RevocationStore keeps track of access tokens that must be rejected before
+// their natural expiry. Entries only need to live as long as the tokens they
+// revoke, so every write carries a TTL.
+type RevocationStore interface {
+	// Revoke rejects the token with the given jti until it expires.
+	Revoke(ctx context.Context, jti string, ttl time.Duration) error
+	// RevokeUser rejects every token issued to userID up to now.
+	RevokeUser(ctx context.Context, userID string, ttl time.Duration) error
+	// IsRevoked reports whether a token with the given jti, subject and
+	// issue time has been revoked by either of the calls above.
+	IsRevoked(ctx context.Context, jti, userID string, issuedAt time.Time) (bool, error)
+}
+
+type revocationEntry struct {
+	value     time.Time
+	expiresAt time.Time
+}
+
+// MemoryRevocationStore is a process-local RevocationStore. It is suitable for
+// development and single-instance deployments.
+type MemoryRevocationStore struct {
+	mu    sync.Mutex
+	jtis  map[string]revocationEntry
+	users map[string]revocationEntry
+}
+
+func NewMemoryRevocationStore() *MemoryRevocationStore {
+	return &MemoryRevocationStore{
+		jtis:  make(map[string]revocationEntry),
+		users: make(map[string]revocationEntry),
+	}
+}
+
+func (s *MemoryRevocationStore) Revoke(ctx context.Context, jti string, ttl time.Duration) error {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.purge(now)
+	s.jtis[jti] = revocationEntry{value: now, expiresAt: now.Add(ttl)}
+	return nil
+}
+
+func (s *MemoryRevocationStore) RevokeUser(ctx context.Context, userID string, ttl time.Duration) error {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.purge(now)
+	s.users[userID] = revocationEntry{value: now, expiresAt: now.Add(ttl)}
+	return nil
+}
+
+func (s *MemoryRevocationStore) IsRevoked(ctx context.Context, jti, userID string, issuedAt time.Time) (bool, error) {
+	now := time.Now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if e, ok := s.jtis[jti]; ok && now.Before(e.expiresAt) {
+		return true, nil
+	}
+	if e, ok := s.users[userID]; ok && now.Before(e.expiresAt) {
+		return revokedBefore(issuedAt, e.value), nil
+	}
+	return false, nil
+}
+
+func (s *MemoryRevocationStore) purge(now time.Time) {
+	for k, e := range s.jtis {
+		if !now.Before(e.expiresAt) {
+			delete(s.jtis, k)
+		}
+	}
+	for k, e := range s.users {
+		if !now.Before(e.expiresAt) {
+			delete(s.users, k)
+		}
+	}
+}
+
+// revokedBefore reports whether a token issued at issuedAt falls under a
+// user-wide revocation made at cutoff. JWT issue times only have second
+// precision, so a token issued in the same second is treated as revoked.
+func revokedBefore(issuedAt, cutoff time.Time) bool {
+	return issuedAt.Unix() <= cutoff.Unix()
+}
+
+// NewRevocationStore builds the store selected by backend, either "memory"
+// or "redis".
+func NewRevocationStore(backend, redisURL string) (RevocationStore, error) {
+	switch backend {
+	case "", "memory":
+		return NewMemoryRevocationStore(), nil
+	case "redis":
+		client, err := NewRedisClient(redisURL)
+		if err != nil {
+			return nil, err
+		}
+		return NewRedisRevocationStore(client), nil
+	default:
+		return nil, fmt.Errorf("unknown revocation store %q", backend)
+	}
+}
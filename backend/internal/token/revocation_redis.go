@@ -0,0 +1,73 @@
+package token
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	redisRevokedJTIPrefix  = "foriam:revoked:jti:"
+	redisRevokedUserPrefix = "foriam:revoked:user:"
+)
+
+// RedisRevocationStore shares revocations between every backend instance
+// pointed at the same Redis.
+type RedisRevocationStore struct {
+	client *redis.Client
+}
+
+func NewRedisRevocationStore(client *redis.Client) *RedisRevocationStore {
+	return &RedisRevocationStore{client: client}
+}
+
+// NewRedisClient accepts either a redis:// URL or a plain host:port address,
+// which is what REDIS_URL has historically contained.
+func NewRedisClient(redisURL string) (*redis.Client, error) {
+	if strings.Contains(redisURL, "://") {
+		opts, err := redis.ParseURL(redisURL)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse redis url: %w", err)
+		}
+		return redis.NewClient(opts), nil
+	}
+	return redis.NewClient(&redis.Options{Addr: redisURL}), nil
+}
+
+func (s *RedisRevocationStore) Revoke(ctx context.Context, jti string, ttl time.Duration) error {
+	if err := s.client.Set(ctx, redisRevokedJTIPrefix+jti, 1, ttl).Err(); err != nil {
+		return fmt.Errorf("failed to revoke token: %w", err)
+	}
+	return nil
+}
+
+func (s *RedisRevocationStore) RevokeUser(ctx context.Context, userID string, ttl time.Duration) error {
+	cutoff := strconv.FormatInt(time.Now().Unix(), 10)
+	if err := s.client.Set(ctx, redisRevokedUserPrefix+userID, cutoff, ttl).Err(); err != nil {
+		return fmt.Errorf("failed to revoke user tokens: %w", err)
+	}
+	return nil
+}
+
+func (s *RedisRevocationStore) IsRevoked(ctx context.Context, jti, userID string, issuedAt time.Time) (bool, error) {
+	values, err := s.client.MGet(ctx, redisRevokedJTIPrefix+jti, redisRevokedUserPrefix+userID).Result()
+	if err != nil {
+		return false, fmt.Errorf("failed to check token revocation: %w", err)
+	}
+
+	if values[0] != nil {
+		return true, nil
+	}
+	if raw, ok := values[1].(string); ok {
+		cutoff, err := strconv.ParseInt(raw, 10, 64)
+		if err != nil {
+			return false, fmt.Errorf("invalid revocation cutoff for user %s: %w", userID, err)
+		}
+		return revokedBefore(issuedAt, time.Unix(cutoff, 0)), nil
+	}
+	return false, nil
+}
@@ -0,0 +1,84 @@
+package token
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func testRevocationStore(t *testing.T, store RevocationStore) {
+	ctx := context.Background()
+	issued := time.Now().Add(-time.Minute)
+
+	revoked, err := store.IsRevoked(ctx, "jti-1", "user-1", issued)
+	if err != nil {
+		t.Fatalf("IsRevoked returned error: %v", err)
+	}
+	if revoked {
+		t.Error("Expected fresh token not to be revoked")
+	}
+
+	if err := store.Revoke(ctx, "jti-1", time.Minute); err != nil {
+		t.Fatalf("Revoke returned error: %v", err)
+	}
+	if revoked, _ := store.IsRevoked(ctx, "jti-1", "user-1", issued); !revoked {
+		t.Error("Expected revoked jti to be rejected")
+	}
+	if revoked, _ := store.IsRevoked(ctx, "jti-2", "user-1", issued); revoked {
+		t.Error("Expected other jti of the same user to stay valid")
+	}
+
+	if err := store.RevokeUser(ctx, "user-1", time.Minute); err != nil {
+		t.Fatalf("RevokeUser returned error: %v", err)
+	}
+	if revoked, _ := store.IsRevoked(ctx, "jti-2", "user-1", issued); !revoked {
+		t.Error("Expected tokens issued before RevokeUser to be rejected")
+	}
+	if revoked, _ := store.IsRevoked(ctx, "jti-3", "user-1", time.Now().Add(2*time.Second)); revoked {
+		t.Error("Expected tokens issued after RevokeUser to stay valid")
+	}
+	if revoked, _ := store.IsRevoked(ctx, "jti-4", "user-2", issued); revoked {
+		t.Error("Expected other users to be unaffected")
+	}
+}
+
+func TestMemoryRevocationStore(t *testing.T) {
+	testRevocationStore(t, NewMemoryRevocationStore())
+}
+
+func TestMemoryRevocationStore_Expiry(t *testing.T) {
+	store := NewMemoryRevocationStore()
+	ctx := context.Background()
+
+	store.Revoke(ctx, "jti-1", -time.Second)
+	if revoked, _ := store.IsRevoked(ctx, "jti-1", "user-1", time.Now()); revoked {
+		t.Error("Expected expired revocation to be ignored")
+	}
+}
+
+func TestRedisRevocationStore(t *testing.T) {
+	srv := miniredis.RunT(t)
+
+	client, err := NewRedisClient(srv.Addr())
+	if err != nil {
+		t.Fatalf("NewRedisClient returned error: %v", err)
+	}
+	defer client.Close()
+
+	testRevocationStore(t, NewRedisRevocationStore(client))
+}
+
+func TestNewRedisClient(t *testing.T) {
+	client, err := NewRedisClient("redis://:secret@cache:6380/2")
+	if err != nil {
+		t.Fatalf("NewRedisClient returned error: %v", err)
+	}
+	defer client.Close()
+
+	opts := client.Options()
+	if opts.Addr != "cache:6380" || opts.Password != "secret" || opts.DB != 2 {
+		t.Errorf("Unexpected options parsed from URL: addr=%s db=%d", opts.Addr, opts.DB)
+	}
+}
@@ -0,0 +1,10 @@
+package token
+
+// Values of the "typ" claim. Only access tokens are accepted by the regular
+// API; the MFA types are handed out by a password login that still needs a
+// second factor and are only good for finishing that login.
+const (
+	TypeAccess        = "access"
+	TypeMFAChallenge  = "mfa_challenge"
+	TypeMFAEnrollment = "mfa_enrollment"
+)
@@ -0,0 +1,175 @@
+package token
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Validation errors. Each maps to a stable code via ErrorCode so clients can
+// tell an expired token (refresh it) from a revoked one (sign in again).
+var (
+	ErrMalformed        = errors.New("token is malformed")
+	ErrInvalidSignature = errors.New("token signature is invalid")
+	ErrAlgorithm        = errors.New("token signing algorithm is not allowed")
+	ErrExpired          = errors.New("token has expired")
+	ErrNotYetValid      = errors.New("token is not valid yet")
+	ErrIssuer           = errors.New("token has the wrong issuer")
+	ErrAudience         = errors.New("token has the wrong audience")
+	ErrWrongType        = errors.New("token type is not accepted here")
+	ErrRevoked          = errors.New("token has been revoked")
+)
+
+var errorCodes = map[error]string{
+	ErrMalformed:        "token_malformed",
+	ErrInvalidSignature: "token_invalid_signature",
+	ErrAlgorithm:        "token_algorithm_not_allowed",
+	ErrExpired:          "token_expired",
+	ErrNotYetValid:      "token_not_yet_valid",
+	ErrIssuer:           "token_invalid_issuer",
+	ErrAudience:         "token_invalid_audience",
+	ErrWrongType:        "token_wrong_type",
+	ErrRevoked:          "token_revoked",
+}
+
+// ErrorCode returns the API error code of a validation error, or an empty
+// string when err is not one.
+func ErrorCode(err error) string {
+	for target, code := range errorCodes {
+		if errors.Is(err, target) {
+			return code
+		}
+	}
+	return ""
+}
+
+// Claims are the validated claims of a token. Tokens issued to an OAuth
+// client for itself have a Subject and ClientID but no UserID.
+type Claims struct {
+	UserID    string
+	Subject   string
+	ClientID  string
+	TenantID  string
+	Email     string
+	JTI       string
+	Type      string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+	Raw       jwt.MapClaims
+}
+
+// ValidatorOptions configure a Validator.
+type ValidatorOptions struct {
+	// Signing algorithms accepted in the token header
+	Algorithms []string
+	Issuer     string
+	Audience   string
+	// Allowed clock skew for exp, nbf and iat
+	Leeway time.Duration
+}
+
+// Validator checks the signature, algorithm, issuer, audience, lifetime,
+// type and revocation status of tokens issued by this server.
+type Validator struct {
+	keyfunc     jwt.Keyfunc
+	revocations RevocationStore
+	parser      *jwt.Parser
+}
+
+func NewValidator(keyfunc jwt.Keyfunc, revocations RevocationStore, opts ValidatorOptions) *Validator {
+	parser := jwt.NewParser(
+		jwt.WithIssuer(opts.Issuer),
+		jwt.WithAudience(opts.Audience),
+		jwt.WithLeeway(opts.Leeway),
+		jwt.WithExpirationRequired(),
+		jwt.WithIssuedAt(),
+	)
+	v := &Validator{revocations: revocations, parser: parser}
+
+	// The algorithm is pinned before any key is looked up, so a token can
+	// never pick how its own signature is checked
+	v.keyfunc = func(t *jwt.Token) (interface{}, error) {
+		if t.Method == nil || !contains(opts.Algorithms, t.Method.Alg()) {
+			return nil, ErrAlgorithm
+		}
+		return keyfunc(t)
+	}
+	return v
+}
+
+// Validate parses raw and returns its claims if it is valid and its typ is one
+// of allowedTypes. Errors other than the validation errors above, such as a
+// failing revocation store, are returned unchanged.
+func (v *Validator) Validate(ctx context.Context, raw string, allowedTypes ...string) (*Claims, error) {
+	parsed, err := v.parser.Parse(raw, v.keyfunc)
+	if err != nil {
+		return nil, classify(err)
+	}
+
+	mapClaims, ok := parsed.Claims.(jwt.MapClaims)
+	if !ok {
+		return nil, ErrMalformed
+	}
+
+	claims := &Claims{Raw: mapClaims}
+	claims.UserID, _ = mapClaims["user_id"].(string)
+	claims.Subject, _ = mapClaims["sub"].(string)
+	claims.ClientID, _ = mapClaims["client_id"].(string)
+	claims.TenantID, _ = mapClaims["tenant_id"].(string)
+	claims.Email, _ = mapClaims["email"].(string)
+	claims.JTI, _ = mapClaims["jti"].(string)
+	claims.Type, _ = mapClaims["typ"].(string)
+	if iat, err := mapClaims.GetIssuedAt(); err == nil && iat != nil {
+		claims.IssuedAt = iat.Time
+	}
+	if exp, err := mapClaims.GetExpirationTime(); err == nil && exp != nil {
+		claims.ExpiresAt = exp.Time
+	}
+
+	if claims.JTI == "" || (claims.UserID == "" && claims.Subject == "") {
+		return nil, ErrMalformed
+	}
+	if !contains(allowedTypes, claims.Type) {
+		return nil, ErrWrongType
+	}
+
+	revoked, err := v.revocations.IsRevoked(ctx, claims.JTI, claims.UserID, claims.IssuedAt)
+	if err != nil {
+		return nil, err
+	}
+	if revoked {
+		return nil, ErrRevoked
+	}
+
+	return claims, nil
+}
+
+// classify maps jwt library errors onto the validation errors.
+func classify(err error) error {
+	switch {
+	case errors.Is(err, jwt.ErrTokenExpired):
+		return ErrExpired
+	case errors.Is(err, jwt.ErrTokenNotValidYet), errors.Is(err, jwt.ErrTokenUsedBeforeIssued):
+		return ErrNotYetValid
+	case errors.Is(err, jwt.ErrTokenInvalidIssuer):
+		return ErrIssuer
+	case errors.Is(err, jwt.ErrTokenInvalidAudience):
+		return ErrAudience
+	case errors.Is(err, ErrAlgorithm):
+		return ErrAlgorithm
+	case errors.Is(err, jwt.ErrTokenSignatureInvalid), errors.Is(err, jwt.ErrTokenUnverifiable):
+		return ErrInvalidSignature
+	}
+	return ErrMalformed
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,93 @@
+package token
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func testHMACValidator(store RevocationStore) (*Validator, func(jwt.MapClaims) string) {
+	secret := []byte("test-secret")
+	v := NewValidator(func(t *jwt.Token) (interface{}, error) {
+		return secret, nil
+	}, store, ValidatorOptions{
+		Algorithms: []string{"HS256"},
+		Issuer:     "issuer",
+		Audience:   "audience",
+	})
+
+	sign := func(claims jwt.MapClaims) string {
+		base := jwt.MapClaims{
+			"iss":     "issuer",
+			"aud":     "audience",
+			"user_id": "user-1",
+			"jti":     "jti-1",
+			"typ":     TypeAccess,
+			"iat":     time.Now().Unix(),
+			"exp":     time.Now().Add(time.Hour).Unix(),
+		}
+		for k, v := range claims {
+			base[k] = v
+		}
+		signed, _ := jwt.NewWithClaims(jwt.SigningMethodHS256, base).SignedString(secret)
+		return signed
+	}
+	return v, sign
+}
+
+func TestValidator_Validate(t *testing.T) {
+	v, sign := testHMACValidator(NewMemoryRevocationStore())
+	ctx := context.Background()
+
+	claims, err := v.Validate(ctx, sign(nil), TypeAccess)
+	if err != nil {
+		t.Fatalf("Expected token to validate, got %v", err)
+	}
+	if claims.UserID != "user-1" || claims.JTI != "jti-1" || claims.ExpiresAt.IsZero() {
+		t.Errorf("Unexpected claims: %+v", claims)
+	}
+
+	if _, err := v.Validate(ctx, sign(nil), TypeMFAChallenge); !errors.Is(err, ErrWrongType) {
+		t.Errorf("Expected ErrWrongType, got %v", err)
+	}
+	if _, err := v.Validate(ctx, sign(jwt.MapClaims{"exp": nil}), TypeAccess); err == nil {
+		t.Error("Expected token without exp to be rejected")
+	}
+	if _, err := v.Validate(ctx, sign(jwt.MapClaims{"jti": ""}), TypeAccess); !errors.Is(err, ErrMalformed) {
+		t.Errorf("Expected ErrMalformed, got %v", err)
+	}
+	if _, err := v.Validate(ctx, sign(jwt.MapClaims{"user_id": nil}), TypeAccess); !errors.Is(err, ErrMalformed) {
+		t.Errorf("Expected ErrMalformed for a token without subject, got %v", err)
+	}
+
+	// Client credentials tokens identify the client instead of a user
+	claims, err = v.Validate(ctx, sign(jwt.MapClaims{"user_id": nil, "sub": "client-1", "client_id": "client-1"}), TypeAccess)
+	if err != nil {
+		t.Fatalf("Expected client token to validate, got %v", err)
+	}
+	if claims.UserID != "" || claims.Subject != "client-1" || claims.ClientID != "client-1" {
+		t.Errorf("Unexpected client claims: %+v", claims)
+	}
+}
+
+type failingRevocationStore struct{ MemoryRevocationStore }
+
+func (*failingRevocationStore) IsRevoked(context.Context, string, string, time.Time) (bool, error) {
+	return false, errors.New("store unavailable")
+}
+
+func TestErrorCode(t *testing.T) {
+	if code := ErrorCode(ErrExpired); code != "token_expired" {
+		t.Errorf("Expected token_expired, got %q", code)
+	}
+
+	// Failures that say nothing about the token itself have no code
+	v, sign := testHMACValidator(&failingRevocationStore{})
+	_, err := v.Validate(context.Background(), sign(nil), TypeAccess)
+	if err == nil || ErrorCode(err) != "" {
+		t.Errorf("Expected an uncoded store error, got %v", err)
+	}
+}
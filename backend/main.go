@@ -1,12 +1,22 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"log"
+	"net/http"
 	"os"
+	"time"
 
 	"github.com/ForIAM/ForIAM/backend/internal/api"
 	"github.com/ForIAM/ForIAM/backend/internal/config"
 	"github.com/ForIAM/ForIAM/backend/internal/database"
+	"github.com/ForIAM/ForIAM/backend/internal/dynamicgroup"
+	"github.com/ForIAM/ForIAM/backend/internal/mfa"
+	"github.com/ForIAM/ForIAM/backend/internal/provisioning"
+	"github.com/ForIAM/ForIAM/backend/internal/signing"
+	"github.com/ForIAM/ForIAM/backend/internal/token"
 	"github.com/gin-gonic/gin"
 	"github.com/joho/godotenv"
 )
@@ -32,6 +42,13 @@ func main() {
 		log.Fatal("Failed to run migrations:", err)
 	}
 
+	// Seal TOTP secrets stored before they were encrypted
+	if n, err := mfa.SealStoredSecrets(db, mfa.NewSecretBox(cfg.EncryptionKey)); err != nil {
+		log.Fatal("Failed to seal MFA secrets:", err)
+	} else if n > 0 {
+		log.Printf("Sealed %d MFA secrets", n)
+	}
+
 	// Seed initial data
 	if err := database.Seed(db); err != nil {
 		log.Println("Warning: Failed to seed database:", err)
@@ -42,8 +59,38 @@ func main() {
 		gin.SetMode(gin.ReleaseMode)
 	}
 
+	// Initialize token revocation store
+	revocations, err := token.NewRevocationStore(cfg.RevocationStore, cfg.RedisURL)
+	if err != nil {
+		log.Fatal("Failed to initialize token revocation store:", err)
+	}
+
+	// Initialize signing keys. Retired keys must keep verifying for at least
+	// as long as the tokens they signed are valid
+	overlap := cfg.SigningKeyOverlap
+	if overlap < cfg.AccessTokenTTL {
+		overlap = cfg.AccessTokenTTL
+	}
+	keys, err := signing.NewManager(db, signing.Options{
+		Algorithm:        cfg.SigningAlgorithm,
+		RotationInterval: cfg.SigningKeyRotation,
+		Overlap:          overlap,
+		EncryptionKey:    cfg.EncryptionKey,
+	})
+	if err != nil {
+		log.Fatal("Failed to initialize signing keys:", err)
+	}
+	go keys.Run(context.Background(), time.Minute)
+
+	// Deliver user and group changes to downstream SCIM services
+	provisioningWorker := provisioning.NewWorker(provisioning.NewStore(db, cfg.EncryptionKey), nil)
+	go provisioningWorker.Run(context.Background(), 10*time.Second)
+
+	// Catch up dynamic groups with changes their rules missed
+	go dynamicgroup.NewReconciler(db).Run(context.Background(), cfg.DynamicGroupReconcileInterval)
+
 	// Initialize API server
-	server := api.NewServer(db, cfg)
+	server := api.NewServer(db, cfg, revocations, keys)
 	
 	// Start server
 	port := os.Getenv("PORT")
@@ -51,8 +98,33 @@ func main() {
 		port = "8080"
 	}
 	
-	log.Printf("Starting server on port %s", port)
-	if err := server.Run(":" + port); err != nil {
+	if cfg.TLSCertFile == "" {
+		log.Printf("Starting server on port %s", port)
+		if err := server.Run(":" + port); err != nil {
+			log.Fatal("Failed to start server:", err)
+		}
+		return
+	}
+
+	// Client certificates are optional; those presented must chain to a
+	// configured client CA
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if cfg.TLSClientCAFile != "" {
+		caPEM, err := os.ReadFile(cfg.TLSClientCAFile)
+		if err != nil {
+			log.Fatal("Failed to read client CA file:", err)
+		}
+		clientCAs := x509.NewCertPool()
+		if !clientCAs.AppendCertsFromPEM(caPEM) {
+			log.Fatal("No certificates found in client CA file")
+		}
+		tlsConfig.ClientCAs = clientCAs
+		tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+
+	httpServer := &http.Server{Addr: ":" + port, Handler: server, TLSConfig: tlsConfig}
+	log.Printf("Starting TLS server on port %s", port)
+	if err := httpServer.ListenAndServeTLS(cfg.TLSCertFile, cfg.TLSKeyFile); err != nil {
 		log.Fatal("Failed to start server:", err)
 	}
 }
\ No newline at end of file
@@ -1,5 +1,5 @@
 import React from 'react'
-import { Routes, Route, Navigate } from 'react-router-dom'
+import { Routes, Route, Navigate, useLocation, Location } from 'react-router-dom'
 import { AuthProvider } from './contexts/AuthContext'
 import { useAuth } from './hooks/useAuth'
 import LoginPage from './pages/LoginPage'
@@ -8,10 +8,13 @@ import UsersPage from './pages/UsersPage'
 import RolesPage from './pages/RolesPage'
 import GroupsPage from './pages/GroupsPage'
 import AuditPage from './pages/AuditPage'
+import AuthorizePage from './pages/AuthorizePage'
+import DevicePage from './pages/DevicePage'
 import Layout from './components/Layout'
 
 function ProtectedRoute({ children }: { children: React.ReactNode }) {
   const { isAuthenticated, loading } = useAuth()
+  const location = useLocation()
   
   if (loading) {
     return (
@@ -21,19 +24,38 @@ function ProtectedRoute({ children }: { children: React.ReactNode }) {
     )
   }
   
-  return isAuthenticated ? <>{children}</> : <Navigate to="/login" />
+  return isAuthenticated ? <>{children}</> : <Navigate to="/login" state={{ from: location }} />
 }
 
 function AppRoutes() {
   const { isAuthenticated } = useAuth()
+  const location = useLocation()
+  // Return to the page that sent us to the login, e.g. an OAuth authorization
+  const from = (location.state as { from?: Location } | null)?.from
   
   return (
     <Routes>
       <Route 
         path="/login" 
-        element={isAuthenticated ? <Navigate to="/dashboard" /> : <LoginPage />} 
+        element={isAuthenticated ? <Navigate to={from || '/dashboard'} /> : <LoginPage />} 
       />
       <Route path="/" element={<Navigate to="/dashboard" />} />
+      <Route
+        path="/oauth/authorize"
+        element={
+          <ProtectedRoute>
+            <AuthorizePage />
+          </ProtectedRoute>
+        }
+      />
+      <Route
+        path="/device"
+        element={
+          <ProtectedRoute>
+            <DevicePage />
+          </ProtectedRoute>
+        }
+      />
       <Route
         path="/dashboard"
         element={
@@ -9,11 +9,27 @@ interface User {
   created_at: string
 }
 
+export interface MFAChallenge {
+  mfa_required: boolean
+  mfa_enrollment_required?: boolean
+  mfa_token: string
+  expires_in: number
+}
+
+export interface Session {
+  access_token: string
+  refresh_token: string
+  token_type: string
+  expires_in: number
+}
+
 interface AuthContextType {
   user: User | null
   isAuthenticated: boolean
   loading: boolean
-  login: (email: string, password: string) => Promise<void>
+  login: (email: string, password: string) => Promise<MFAChallenge | null>
+  verifyMfa: (mfaToken: string, code: string) => Promise<void>
+  acceptSession: (session: Session) => Promise<void>
   logout: () => void
 }
 
@@ -31,6 +47,7 @@ export function AuthProvider({ children }: { children: ReactNode }) {
         .then(setUser)
         .catch(() => {
           localStorage.removeItem('token')
+          localStorage.removeItem('refresh_token')
         })
         .finally(() => setLoading(false))
     } else {
@@ -38,15 +55,33 @@ export function AuthProvider({ children }: { children: ReactNode }) {
     }
   }, [])
 
-  const login = async (email: string, password: string) => {
-    const response = await authApi.login(email, password)
-    localStorage.setItem('token', response.access_token)
+  const acceptSession = async (session: Session) => {
+    localStorage.setItem('token', session.access_token)
+    localStorage.setItem('refresh_token', session.refresh_token)
     const userProfile = await authApi.getProfile()
     setUser(userProfile)
   }
 
+  // Resolves with the MFA challenge when the password alone is not enough
+  const login = async (email: string, password: string) => {
+    const response = await authApi.login(email, password)
+    if (response.mfa_required) {
+      return response as MFAChallenge
+    }
+    await acceptSession(response)
+    return null
+  }
+
+  const verifyMfa = async (mfaToken: string, code: string) => {
+    const response = await authApi.verifyMfa(mfaToken, code)
+    await acceptSession(response)
+  }
+
   const logout = () => {
+    // Revoke server-side as well; a failure here must not keep the user signed in
+    authApi.logout().catch(() => {})
     localStorage.removeItem('token')
+    localStorage.removeItem('refresh_token')
     setUser(null)
   }
 
@@ -55,6 +90,8 @@ export function AuthProvider({ children }: { children: ReactNode }) {
     isAuthenticated: !!user,
     loading,
     login,
+    verifyMfa,
+    acceptSession,
     logout
   }
 
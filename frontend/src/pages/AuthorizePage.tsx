@@ -0,0 +1,36 @@
+import React, { useEffect, useRef, useState } from 'react'
+import { useLocation } from 'react-router-dom'
+import { oauthApi } from '../services/api'
+
+// Landing page of /oauth2/authorize: once the user is signed in, the
+// authorization request is approved and the browser returns to the client.
+export default function AuthorizePage() {
+  const location = useLocation()
+  const [error, setError] = useState('')
+  const started = useRef(false)
+
+  useEffect(() => {
+    if (started.current) return
+    started.current = true
+
+    const params = Object.fromEntries(new URLSearchParams(location.search))
+    oauthApi
+      .authorize(params)
+      .then((response) => window.location.replace(response.redirect_uri))
+      .catch((err: any) => {
+        setError(err.response?.data?.error_description || err.response?.data?.error || 'Authorization failed')
+      })
+  }, [location.search])
+
+  return (
+    <div className="min-h-screen flex items-center justify-center bg-gray-50">
+      {error ? (
+        <div className="bg-red-50 border border-red-200 text-red-700 px-4 py-3 rounded">
+          {error}
+        </div>
+      ) : (
+        <div className="animate-spin rounded-full h-8 w-8 border-b-2 border-blue-600"></div>
+      )}
+    </div>
+  )
+}
@@ -0,0 +1,97 @@
+import React, { useState } from 'react'
+import { useLocation } from 'react-router-dom'
+import { oauthApi, DeviceVerification } from '../services/api'
+
+// Verification page of the device authorization grant: the user enters the
+// code shown by a CLI or device and approves or denies its sign-in.
+export default function DevicePage() {
+  const location = useLocation()
+  const [userCode, setUserCode] = useState(new URLSearchParams(location.search).get('user_code') || '')
+  const [device, setDevice] = useState<DeviceVerification | null>(null)
+  const [result, setResult] = useState('')
+  const [error, setError] = useState('')
+  const [loading, setLoading] = useState(false)
+
+  const handleLookup = async (e: React.FormEvent) => {
+    e.preventDefault()
+    setLoading(true)
+    setError('')
+
+    try {
+      setDevice(await oauthApi.getDevice(userCode))
+    } catch (err: any) {
+      setError(err.response?.data?.error || 'Invalid code')
+    } finally {
+      setLoading(false)
+    }
+  }
+
+  const handleDecision = async (approve: boolean) => {
+    if (!device) return
+    setLoading(true)
+    setError('')
+
+    try {
+      const response = await oauthApi.decideDevice(device.user_code, approve)
+      setResult(response.message)
+    } catch (err: any) {
+      setError(err.response?.data?.error || 'Failed to update the device')
+    } finally {
+      setLoading(false)
+    }
+  }
+
+  const errorBox = error && (
+    <div className="bg-red-50 border border-red-200 text-red-700 px-4 py-3 rounded">
+      {error}
+    </div>
+  )
+
+  return (
+    <div className="min-h-screen flex items-center justify-center bg-gray-50">
+      <div className="max-w-md w-full space-y-6 p-6">
+        <h2 className="text-center text-2xl font-bold text-gray-900">Connect a device</h2>
+
+        {result && <p className="text-center text-sm text-gray-600">{result}. You can close this window.</p>}
+
+        {!result && !device && (
+          <form className="space-y-6" onSubmit={handleLookup}>
+            {errorBox}
+            <p className="text-sm text-gray-600">Enter the code shown on your device.</p>
+            <input
+              type="text"
+              required
+              autoComplete="off"
+              className="form-input text-center font-mono tracking-widest uppercase"
+              placeholder="XXXX-XXXX"
+              value={userCode}
+              onChange={(e) => setUserCode(e.target.value)}
+            />
+            <button type="submit" disabled={loading} className="btn btn-primary w-full">
+              {loading ? 'Checking...' : 'Continue'}
+            </button>
+          </form>
+        )}
+
+        {!result && device && (
+          <div className="space-y-6">
+            {errorBox}
+            <p className="text-sm text-gray-600">
+              <span className="font-medium text-gray-900">{device.client_name}</span> wants to sign in
+              as you with the scopes <span className="font-mono">{device.scope}</span>. Only continue if
+              the device shows the code <span className="font-mono">{device.user_code}</span>.
+            </p>
+            <div className="flex space-x-4">
+              <button type="button" disabled={loading} className="btn btn-primary w-full" onClick={() => handleDecision(true)}>
+                Approve
+              </button>
+              <button type="button" disabled={loading} className="btn btn-secondary w-full" onClick={() => handleDecision(false)}>
+                Deny
+              </button>
+            </div>
+          </div>
+        )}
+      </div>
+    </div>
+  )
+}
@@ -1,13 +1,29 @@
 import React, { useState } from 'react'
 import { useAuth } from '../hooks/useAuth'
+import { authApi } from '../services/api'
+import { Session } from '../contexts/AuthContext'
 import { Shield } from 'lucide-react'
 
+type Step = 'password' | 'mfa' | 'enroll' | 'backup-codes'
+
+interface Enrollment {
+  device_id: string
+  secret: string
+  qr_code: string
+}
+
 export default function LoginPage() {
   const [email, setEmail] = useState('')
   const [password, setPassword] = useState('')
+  const [code, setCode] = useState('')
+  const [step, setStep] = useState<Step>('password')
+  const [mfaToken, setMfaToken] = useState('')
+  const [enrollment, setEnrollment] = useState<Enrollment | null>(null)
+  const [backupCodes, setBackupCodes] = useState<string[]>([])
+  const [pendingSession, setPendingSession] = useState<Session | null>(null)
   const [loading, setLoading] = useState(false)
   const [error, setError] = useState('')
-  const { login } = useAuth()
+  const { login, verifyMfa, acceptSession } = useAuth()
 
   const handleSubmit = async (e: React.FormEvent) => {
     e.preventDefault()
@@ -15,14 +31,81 @@ export default function LoginPage() {
     setError('')
 
     try {
-      await login(email, password)
+      const challenge = await login(email, password)
+      if (challenge?.mfa_enrollment_required) {
+        setMfaToken(challenge.mfa_token)
+        setEnrollment(await authApi.enrollTotp(challenge.mfa_token))
+        setStep('enroll')
+      } else if (challenge) {
+        setMfaToken(challenge.mfa_token)
+        setStep('mfa')
+      }
+    } catch (err: any) {
+      setError(err.response?.data?.error || 'Login failed')
+    } finally {
+      setLoading(false)
+    }
+  }
+
+  const handleVerify = async (e: React.FormEvent) => {
+    e.preventDefault()
+    setLoading(true)
+    setError('')
+
+    try {
+      await verifyMfa(mfaToken, code)
+    } catch (err: any) {
+      setError(err.response?.data?.error || 'Verification failed')
+    } finally {
+      setLoading(false)
+    }
+  }
+
+  const handleConfirmEnrollment = async (e: React.FormEvent) => {
+    e.preventDefault()
+    if (!enrollment) return
+    setLoading(true)
+    setError('')
+
+    try {
+      const response = await authApi.confirmTotp(enrollment.device_id, code, mfaToken)
+      // Show the backup codes before the session redirects to the dashboard
+      setBackupCodes(response.backup_codes || [])
+      setPendingSession(response.session)
+      setStep('backup-codes')
     } catch (err: any) {
-      setError(err.response?.data?.message || 'Login failed')
+      setError(err.response?.data?.error || 'Verification failed')
     } finally {
       setLoading(false)
     }
   }
 
+  const codeInput = (
+    <div>
+      <label htmlFor="code" className="block text-sm font-medium text-gray-700">
+        Authentication code
+      </label>
+      <input
+        id="code"
+        name="code"
+        type="text"
+        inputMode="numeric"
+        autoComplete="one-time-code"
+        required
+        className="form-input mt-1"
+        placeholder="123456"
+        value={code}
+        onChange={(e) => setCode(e.target.value)}
+      />
+    </div>
+  )
+
+  const errorBox = error && (
+    <div className="bg-red-50 border border-red-200 text-red-700 px-4 py-3 rounded">
+      {error}
+    </div>
+  )
+
   return (
     <div className="min-h-screen flex items-center justify-center bg-gray-50 py-12 px-4 sm:px-6 lg:px-8">
       <div className="max-w-md w-full space-y-8">
@@ -37,12 +120,59 @@ export default function LoginPage() {
             Identity & Access Management Platform
           </p>
         </div>
+        {step === 'mfa' && (
+          <form className="mt-8 space-y-6" onSubmit={handleVerify}>
+            {errorBox}
+            <p className="text-sm text-gray-600">
+              Enter the code from your authenticator app, or one of your backup codes.
+            </p>
+            {codeInput}
+            <button type="submit" disabled={loading} className="btn btn-primary w-full">
+              {loading ? 'Verifying...' : 'Verify'}
+            </button>
+          </form>
+        )}
+
+        {step === 'enroll' && enrollment && (
+          <form className="mt-8 space-y-6" onSubmit={handleConfirmEnrollment}>
+            {errorBox}
+            <p className="text-sm text-gray-600">
+              Your organization requires multi-factor authentication. Scan this code with an
+              authenticator app, then enter the code it shows.
+            </p>
+            <img src={enrollment.qr_code} alt="TOTP QR code" className="mx-auto h-48 w-48" />
+            <p className="text-center text-xs text-gray-500 break-all">{enrollment.secret}</p>
+            {codeInput}
+            <button type="submit" disabled={loading} className="btn btn-primary w-full">
+              {loading ? 'Verifying...' : 'Confirm'}
+            </button>
+          </form>
+        )}
+
+        {step === 'backup-codes' && (
+          <div className="mt-8 space-y-6">
+            <p className="text-sm text-gray-600">
+              Store these backup codes somewhere safe. Each can be used once if you lose access
+              to your authenticator app.
+            </p>
+            <ul className="grid grid-cols-2 gap-2 font-mono text-sm text-gray-900">
+              {backupCodes.map((backupCode) => (
+                <li key={backupCode}>{backupCode}</li>
+              ))}
+            </ul>
+            <button
+              type="button"
+              className="btn btn-primary w-full"
+              onClick={() => pendingSession && acceptSession(pendingSession)}
+            >
+              Continue
+            </button>
+          </div>
+        )}
+
+        {step === 'password' && (
         <form className="mt-8 space-y-6" onSubmit={handleSubmit}>
-          {error && (
-            <div className="bg-red-50 border border-red-200 text-red-700 px-4 py-3 rounded">
-              {error}
-            </div>
-          )}
+          {errorBox}
           <div className="space-y-4">
             <div>
               <label htmlFor="email" className="block text-sm font-medium text-gray-700">
@@ -94,6 +224,7 @@ export default function LoginPage() {
             </p>
           </div>
         </form>
+        )}
       </div>
     </div>
   )
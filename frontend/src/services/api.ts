@@ -18,13 +18,61 @@ api.interceptors.request.use((config) => {
   return config
 })
 
+// Refresh requests issued while another refresh is in flight share its result,
+// otherwise the second request would replay an already rotated token.
+let refreshPromise: Promise<string> | null = null
+
+const refreshAccessToken = async () => {
+  const refreshToken = localStorage.getItem('refresh_token')
+  if (!refreshToken) {
+    throw new Error('No refresh token')
+  }
+  const response = await axios.post(`${API_BASE_URL}/auth/token/refresh`, {
+    refresh_token: refreshToken,
+  })
+  localStorage.setItem('token', response.data.access_token)
+  localStorage.setItem('refresh_token', response.data.refresh_token)
+  return response.data.access_token as string
+}
+
+// A 401 from these endpoints means wrong credentials, not an expired session
+const sessionlessPaths = [
+  '/auth/login',
+  '/auth/mfa/verify',
+  '/auth/mfa/totp/',
+  '/auth/mfa/webauthn/',
+  '/auth/webauthn/login/',
+]
+
 // Handle auth errors
 api.interceptors.response.use(
   (response) => response,
-  (error) => {
-    if (error.response?.status === 401) {
+  async (error) => {
+    const original = error.config
+    const sessionless = sessionlessPaths.some((path) => original?.url?.startsWith(path))
+    // Only an expired access token is worth refreshing; a revoked or otherwise
+    // invalid one means the session is over
+    const code = error.response?.data?.code
+    if (error.response?.status === 401 && code && code !== 'token_expired' && !sessionless) {
       localStorage.removeItem('token')
+      localStorage.removeItem('refresh_token')
       window.location.href = '/login'
+      return Promise.reject(error)
+    }
+    if (error.response?.status === 401 && original && !original._retry && !sessionless) {
+      original._retry = true
+      try {
+        refreshPromise = refreshPromise || refreshAccessToken()
+        const token = await refreshPromise
+        original.headers.Authorization = `Bearer ${token}`
+        return api(original)
+      } catch {
+        localStorage.removeItem('token')
+        localStorage.removeItem('refresh_token')
+        window.location.href = '/login'
+      } finally {
+        refreshPromise = null
+      }
     }
     return Promise.reject(error)
   }
@@ -37,7 +85,77 @@ export const authApi = {
   },
   
   logout: async () => {
-    await api.post('/auth/logout')
+    await api.post('/auth/logout', {
+      refresh_token: localStorage.getItem('refresh_token') || undefined,
+    })
+  },
+
+  verifyMfa: async (mfaToken: string, code: string) => {
+    const response = await api.post('/auth/mfa/verify', { mfa_token: mfaToken, code })
+    return response.data
+  },
+
+  // Enrollment calls accept the enrollment token from a login in place of
+  // an access token, so it is passed explicitly when present.
+  enrollTotp: async (mfaToken?: string) => {
+    const headers = mfaToken ? { Authorization: `Bearer ${mfaToken}` } : undefined
+    const response = await api.post('/auth/mfa/totp/enroll', {}, { headers })
+    return response.data
+  },
+
+  confirmTotp: async (deviceId: string, code: string, mfaToken?: string) => {
+    const headers = mfaToken ? { Authorization: `Bearer ${mfaToken}` } : undefined
+    const response = await api.post('/auth/mfa/totp/confirm', { device_id: deviceId, code }, { headers })
+    return response.data
+  },
+
+  // WebAuthn ceremonies: `begin` returns a session_id and the options for
+  // navigator.credentials, `finish` takes the JSON-encoded credential.
+  beginPasskeyLogin: async (params: { email?: string; tenant?: string }) => {
+    const response = await api.post('/auth/webauthn/login/begin', params)
+    return response.data
+  },
+
+  finishPasskeyLogin: async (sessionId: string, credential: unknown) => {
+    const response = await api.post('/auth/webauthn/login/finish', { session_id: sessionId, credential })
+    return response.data
+  },
+
+  beginMfaWebAuthn: async (mfaToken: string) => {
+    const response = await api.post('/auth/mfa/webauthn/begin', { mfa_token: mfaToken })
+    return response.data
+  },
+
+  finishMfaWebAuthn: async (mfaToken: string, sessionId: string, credential: unknown) => {
+    const response = await api.post('/auth/mfa/webauthn/finish', {
+      mfa_token: mfaToken,
+      session_id: sessionId,
+      credential,
+    })
+    return response.data
+  },
+
+  beginPasskeyRegistration: async () => {
+    const response = await api.post('/auth/webauthn/register/begin')
+    return response.data
+  },
+
+  finishPasskeyRegistration: async (sessionId: string, name: string, credential: unknown) => {
+    const response = await api.post('/auth/webauthn/register/finish', { session_id: sessionId, name, credential })
+    return response.data
+  },
+
+  getPasskeys: async () => {
+    const response = await api.get('/auth/webauthn/credentials')
+    return response.data
+  },
+
+  deletePasskey: async (id: string) => {
+    await api.delete(`/auth/webauthn/credentials/${id}`)
+  },
+
+  logoutAll: async () => {
+    await api.post('/auth/logout/all')
   },
   
   getProfile: async () => {
@@ -116,4 +234,30 @@ export const auditApi = {
   }
 }
 
+// Approves an OpenID Connect authorization request for the signed-in user.
+// The response carries the client redirect URI with the code or an error.
+export interface DeviceVerification {
+  user_code: string
+  client_name: string
+  scope: string
+  expires_at: string
+}
+
+export const oauthApi = {
+  authorize: async (params: Record<string, string>) => {
+    const response = await api.post('/oauth2/authorize', params)
+    return response.data as { redirect_uri: string }
+  },
+
+  getDevice: async (userCode: string) => {
+    const response = await api.get('/oauth2/device', { params: { user_code: userCode } })
+    return response.data as DeviceVerification
+  },
+
+  decideDevice: async (userCode: string, approve: boolean) => {
+    const response = await api.post('/oauth2/device', { user_code: userCode, approve })
+    return response.data as { message: string }
+  }
+}
+
 export default api
\ No newline at end of file
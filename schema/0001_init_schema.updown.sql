@@ -6,6 +6,30 @@
 -- +migrate Down
 
 -- Drop all tables (in reverse order to avoid FK issues)
+DROP TABLE IF EXISTS group_hierarchy;
+DROP TABLE IF EXISTS role_hierarchy;
+DROP TABLE IF EXISTS ldap_directories;
+DROP TABLE IF EXISTS federation_logins;
+DROP TABLE IF EXISTS federated_identities;
+DROP TABLE IF EXISTS federation_providers;
+DROP TABLE IF EXISTS saml_sessions;
+DROP TABLE IF EXISTS saml_logouts;
+DROP TABLE IF EXISTS saml_service_providers;
+DROP TABLE IF EXISTS saml_idp_credentials;
+DROP TABLE IF EXISTS provisioning_resources;
+DROP TABLE IF EXISTS provisioning_jobs;
+DROP TABLE IF EXISTS provisioning_connectors;
+DROP TABLE IF EXISTS service_account_certificates;
+DROP TABLE IF EXISTS oauth_device_codes;
+DROP TABLE IF EXISTS oauth_authorization_codes;
+DROP TABLE IF EXISTS oauth_clients;
+DROP TABLE IF EXISTS signing_keys;
+DROP TABLE IF EXISTS login_attempts;
+DROP TABLE IF EXISTS webauthn_sessions;
+DROP TABLE IF EXISTS webauthn_credentials;
+DROP TABLE IF EXISTS mfa_backup_codes;
+DROP TABLE IF EXISTS mfa_devices;
+DROP TABLE IF EXISTS refresh_tokens;
 DROP TABLE IF EXISTS api_tokens;
 DROP TABLE IF EXISTS audit_logs;
 DROP TABLE IF EXISTS user_groups;
@@ -4,15 +4,28 @@
 CREATE TABLE tenants (
     id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
     name TEXT NOT NULL UNIQUE,
+    mfa_required BOOLEAN DEFAULT FALSE,
+    webauthn_rp_id TEXT,
+    webauthn_rp_name TEXT,
+    webauthn_origins TEXT[],
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
--- Users
+-- Users (principal_type 'user' or 'service_account'; service accounts have a
+-- name and no password)
 CREATE TABLE users (
     id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
     tenant_id UUID REFERENCES tenants(id) ON DELETE CASCADE,
     email TEXT NOT NULL UNIQUE,
-    password_hash TEXT NOT NULL,
+    password_hash TEXT,
+    principal_type TEXT NOT NULL DEFAULT 'user',
+    name TEXT,
+    description TEXT NOT NULL DEFAULT '',
+    external_id TEXT NOT NULL DEFAULT '',
+    display_name TEXT NOT NULL DEFAULT '',
+    given_name TEXT NOT NULL DEFAULT '',
+    family_name TEXT NOT NULL DEFAULT '',
+    attributes JSONB NOT NULL DEFAULT '{}',
     is_active BOOLEAN DEFAULT TRUE,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
@@ -31,6 +44,8 @@ CREATE TABLE groups (
     id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
     tenant_id UUID REFERENCES tenants(id) ON DELETE CASCADE,
     name TEXT NOT NULL,
+    external_id TEXT NOT NULL DEFAULT '',
+    rule TEXT,
     UNIQUE (tenant_id, name)
 );
 
@@ -74,26 +89,385 @@ CREATE TABLE audit_logs (
     id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
     tenant_id UUID REFERENCES tenants(id) ON DELETE CASCADE,
     user_id UUID REFERENCES users(id),
+    actor_type TEXT,
     action TEXT NOT NULL,
     resource TEXT,
     resource_id UUID,
+    target TEXT,
+    target_id UUID,
     ip_address TEXT,
     user_agent TEXT,
     status TEXT,
+    reason TEXT,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
--- API Tokens
+-- API Tokens (API keys; only a SHA-256 hash and a display prefix are stored)
 CREATE TABLE api_tokens (
     id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
     tenant_id UUID REFERENCES tenants(id) ON DELETE CASCADE,
-    user_id UUID REFERENCES users(id),
-    token TEXT NOT NULL,
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    token_hash TEXT NOT NULL UNIQUE,
+    prefix TEXT NOT NULL DEFAULT '',
+    name TEXT NOT NULL DEFAULT '',
+    scopes TEXT[] NOT NULL DEFAULT '{}',
+    expires_at TIMESTAMP,
+    last_used_at TIMESTAMP,
+    last_used_ip TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Refresh Tokens (opaque, stored hashed; rotated within a family)
+CREATE TABLE refresh_tokens (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    tenant_id UUID REFERENCES tenants(id) ON DELETE CASCADE,
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    family_id UUID NOT NULL,
+    token_hash TEXT NOT NULL UNIQUE,
+    expires_at TIMESTAMP NOT NULL,
+    rotated_at TIMESTAMP,
+    revoked_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- MFA Devices (TOTP secrets, sealed with AES-GCM; secret only holds those
+-- enrolled before sealing until startup seals them; confirmed once the first
+-- code is verified)
+CREATE TABLE mfa_devices (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    tenant_id UUID REFERENCES tenants(id) ON DELETE CASCADE,
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    type TEXT NOT NULL DEFAULT 'totp',
+    name TEXT,
+    secret TEXT,
+    secret_encrypted BYTEA,
+    confirmed_at TIMESTAMP,
+    last_used_step BIGINT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- MFA Backup Codes (bcrypt hashed, single use)
+CREATE TABLE mfa_backup_codes (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    code_hash TEXT NOT NULL,
+    used_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- WebAuthn Credentials (passkeys and security keys)
+CREATE TABLE webauthn_credentials (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    tenant_id UUID REFERENCES tenants(id) ON DELETE CASCADE,
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    name TEXT,
+    credential_id BYTEA NOT NULL UNIQUE,
+    public_key BYTEA NOT NULL,
+    attestation_type TEXT NOT NULL,
+    aaguid BYTEA,
+    sign_count BIGINT NOT NULL DEFAULT 0,
+    transports TEXT[],
+    user_present BOOLEAN DEFAULT FALSE,
+    user_verified BOOLEAN DEFAULT FALSE,
+    backup_eligible BOOLEAN DEFAULT FALSE,
+    backup_state BOOLEAN DEFAULT FALSE,
+    last_used_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- WebAuthn ceremony state between begin and finish
+CREATE TABLE webauthn_sessions (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    tenant_id UUID REFERENCES tenants(id) ON DELETE CASCADE,
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    purpose TEXT NOT NULL,
+    data JSONB NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Login Attempts (password login throttling and lockout)
+CREATE TABLE login_attempts (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    tenant_id UUID REFERENCES tenants(id) ON DELETE CASCADE,
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    email TEXT NOT NULL,
+    ip_address TEXT NOT NULL,
+    success BOOLEAN NOT NULL,
+    reason TEXT,
+    cleared_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Token Signing Keys (private keys AES-GCM encrypted; retired keys verify until expires_at)
+CREATE TABLE signing_keys (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    kid TEXT NOT NULL UNIQUE,
+    algorithm TEXT NOT NULL,
+    private_key BYTEA NOT NULL,
+    retired_at TIMESTAMP,
     expires_at TIMESTAMP,
     created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
 );
 
+-- OAuth Clients (per-tenant applications; public clients have no secret, secrets are bcrypt hashed)
+CREATE TABLE oauth_clients (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    tenant_id UUID REFERENCES tenants(id) ON DELETE CASCADE,
+    client_id TEXT NOT NULL UNIQUE,
+    name TEXT NOT NULL,
+    client_secret_hash TEXT,
+    redirect_uris TEXT[] NOT NULL DEFAULT '{}',
+    grant_types TEXT[] NOT NULL DEFAULT '{authorization_code}',
+    scopes TEXT[] NOT NULL DEFAULT '{openid,email}',
+    exchange_audiences TEXT[] NOT NULL DEFAULT '{}',
+    service_account_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- OAuth Authorization Codes (single use, stored hashed)
+CREATE TABLE oauth_authorization_codes (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    code_hash TEXT NOT NULL UNIQUE,
+    tenant_id UUID REFERENCES tenants(id) ON DELETE CASCADE,
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    client_id TEXT NOT NULL REFERENCES oauth_clients(client_id) ON DELETE CASCADE,
+    redirect_uri TEXT NOT NULL,
+    scopes TEXT[] NOT NULL DEFAULT '{}',
+    nonce TEXT,
+    code_challenge TEXT NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- OAuth Device Codes (device authorization grant; device codes are stored hashed)
+CREATE TABLE oauth_device_codes (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    device_code_hash TEXT NOT NULL UNIQUE,
+    user_code TEXT NOT NULL UNIQUE,
+    tenant_id UUID REFERENCES tenants(id) ON DELETE CASCADE,
+    client_id TEXT NOT NULL REFERENCES oauth_clients(client_id) ON DELETE CASCADE,
+    scopes TEXT[] NOT NULL DEFAULT '{}',
+    status TEXT NOT NULL DEFAULT 'pending',
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    poll_interval INTEGER NOT NULL,
+    last_polled_at TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Service Account Certificates (TLS client certificates, pinned by SHA-256 thumbprint)
+CREATE TABLE service_account_certificates (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    tenant_id UUID REFERENCES tenants(id) ON DELETE CASCADE,
+    service_account_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    thumbprint TEXT NOT NULL UNIQUE,
+    subject TEXT NOT NULL,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Provisioning Connectors (downstream SCIM services of a tenant; tokens encrypted)
+CREATE TABLE provisioning_connectors (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    tenant_id UUID NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    endpoint TEXT NOT NULL,
+    token_encrypted BYTEA NOT NULL,
+    attribute_mapping JSONB NOT NULL DEFAULT '{}',
+    is_active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (tenant_id, name)
+);
+
+-- Provisioning Jobs (a user or group change to deliver to a connector)
+CREATE TABLE provisioning_jobs (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    tenant_id UUID NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+    connector_id UUID NOT NULL REFERENCES provisioning_connectors(id) ON DELETE CASCADE,
+    resource_type TEXT NOT NULL,
+    resource_id UUID NOT NULL,
+    operation TEXT NOT NULL,
+    status TEXT NOT NULL DEFAULT 'pending',
+    attempts INTEGER NOT NULL DEFAULT 0,
+    last_error TEXT,
+    next_attempt_at TIMESTAMP NOT NULL DEFAULT CURRENT_TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    completed_at TIMESTAMP
+);
+
+-- Provisioning Resources (IDs of provisioned users and groups downstream)
+CREATE TABLE provisioning_resources (
+    connector_id UUID NOT NULL REFERENCES provisioning_connectors(id) ON DELETE CASCADE,
+    resource_type TEXT NOT NULL,
+    resource_id UUID NOT NULL,
+    remote_id TEXT NOT NULL,
+    PRIMARY KEY (connector_id, resource_type, resource_id)
+);
+
+-- SAML IdP Credentials (signing key, encrypted, and certificate of a tenant's IdP)
+CREATE TABLE saml_idp_credentials (
+    tenant_id UUID PRIMARY KEY REFERENCES tenants(id) ON DELETE CASCADE,
+    private_key_encrypted BYTEA NOT NULL,
+    certificate BYTEA NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- SAML Service Providers (applications signing users in with SAML)
+CREATE TABLE saml_service_providers (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    tenant_id UUID NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    entity_id TEXT NOT NULL,
+    acs_url TEXT NOT NULL,
+    slo_url TEXT NOT NULL DEFAULT '',
+    certificate TEXT NOT NULL DEFAULT '',
+    name_id_format TEXT NOT NULL,
+    attribute_mapping JSONB NOT NULL DEFAULT '{}',
+    allow_idp_initiated BOOLEAN NOT NULL DEFAULT FALSE,
+    is_active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (tenant_id, entity_id)
+);
+
+-- SAML Logouts (single logouts in progress, answered to the requesting service provider when done)
+CREATE TABLE saml_logouts (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    tenant_id UUID NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    service_provider_id UUID NOT NULL REFERENCES saml_service_providers(id) ON DELETE CASCADE,
+    request_id TEXT NOT NULL,
+    relay_state TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- SAML Sessions (sign-ins of users at service providers, for single logout)
+CREATE TABLE saml_sessions (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    session_index TEXT NOT NULL UNIQUE,
+    tenant_id UUID NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    service_provider_id UUID NOT NULL REFERENCES saml_service_providers(id) ON DELETE CASCADE,
+    name_id TEXT NOT NULL,
+    logout_id UUID REFERENCES saml_logouts(id) ON DELETE SET NULL,
+    logout_request_id TEXT,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_at TIMESTAMP NOT NULL
+);
+
+-- Federation Providers (upstream OpenID Connect providers and SAML IdPs users of a tenant sign in with)
+CREATE TABLE federation_providers (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    tenant_id UUID NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    type TEXT NOT NULL,
+    issuer TEXT NOT NULL DEFAULT '',
+    client_id TEXT NOT NULL DEFAULT '',
+    client_secret_encrypted BYTEA,
+    scopes TEXT[] NOT NULL DEFAULT '{}',
+    entity_id TEXT NOT NULL DEFAULT '',
+    sso_url TEXT NOT NULL DEFAULT '',
+    certificate TEXT NOT NULL DEFAULT '',
+    claim_mapping JSONB NOT NULL DEFAULT '{}',
+    groups_claim TEXT NOT NULL DEFAULT 'groups',
+    group_mapping JSONB NOT NULL DEFAULT '{}',
+    jit_provisioning BOOLEAN NOT NULL DEFAULT FALSE,
+    disable_password_login BOOLEAN NOT NULL DEFAULT FALSE,
+    trust_email BOOLEAN NOT NULL DEFAULT FALSE,
+    performs_mfa BOOLEAN NOT NULL DEFAULT FALSE,
+    is_active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    UNIQUE (tenant_id, name)
+);
+
+-- Federated Identities (external accounts linked to users)
+CREATE TABLE federated_identities (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    tenant_id UUID NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+    provider_id UUID NOT NULL REFERENCES federation_providers(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    subject TEXT NOT NULL,
+    email TEXT NOT NULL DEFAULT '',
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_login_at TIMESTAMP,
+    UNIQUE (provider_id, subject)
+);
+
+-- Federation Logins (sign-ins at external providers in progress, then the code the frontend redeems)
+CREATE TABLE federation_logins (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    tenant_id UUID NOT NULL REFERENCES tenants(id) ON DELETE CASCADE,
+    provider_id UUID NOT NULL REFERENCES federation_providers(id) ON DELETE CASCADE,
+    state TEXT UNIQUE,
+    nonce TEXT NOT NULL,
+    code_verifier TEXT NOT NULL,
+    request_id TEXT NOT NULL DEFAULT '',
+    link_user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    user_id UUID REFERENCES users(id) ON DELETE CASCADE,
+    code_hash TEXT UNIQUE,
+    expires_at TIMESTAMP NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- LDAP Directories (the directory each tenant checks passwords against)
+CREATE TABLE ldap_directories (
+    tenant_id UUID PRIMARY KEY REFERENCES tenants(id) ON DELETE CASCADE,
+    url TEXT NOT NULL,
+    start_tls BOOLEAN NOT NULL DEFAULT FALSE,
+    root_ca TEXT NOT NULL DEFAULT '',
+    bind_dn TEXT NOT NULL DEFAULT '',
+    bind_password_encrypted BYTEA,
+    base_dn TEXT NOT NULL,
+    user_filter TEXT NOT NULL,
+    group_sync BOOLEAN NOT NULL DEFAULT FALSE,
+    group_base_dn TEXT NOT NULL DEFAULT '',
+    group_filter TEXT NOT NULL DEFAULT '',
+    group_name_attribute TEXT NOT NULL DEFAULT 'cn',
+    group_mapping JSONB NOT NULL DEFAULT '{}',
+    allow_local_passwords BOOLEAN NOT NULL DEFAULT FALSE,
+    is_active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Role Hierarchy (parents hold the permissions of their child roles, transitively)
+CREATE TABLE role_hierarchy (
+    parent_role_id UUID REFERENCES roles(id) ON DELETE CASCADE,
+    child_role_id UUID REFERENCES roles(id) ON DELETE CASCADE,
+    PRIMARY KEY (parent_role_id, child_role_id),
+    CHECK (parent_role_id <> child_role_id)
+);
+
+-- Group Hierarchy (groups nested in other groups; members of a child are members of its parents)
+CREATE TABLE group_hierarchy (
+    parent_group_id UUID REFERENCES groups(id) ON DELETE CASCADE,
+    child_group_id UUID REFERENCES groups(id) ON DELETE CASCADE,
+    PRIMARY KEY (parent_group_id, child_group_id),
+    CHECK (parent_group_id <> child_group_id)
+);
+
 -- Indexes
 CREATE INDEX idx_users_email ON users(email);
+CREATE INDEX idx_users_email_lower ON users(lower(email));
 CREATE INDEX idx_audit_logs_tenant_id ON audit_logs(tenant_id);
 CREATE INDEX idx_audit_logs_user_id ON audit_logs(user_id);
+CREATE INDEX idx_refresh_tokens_family_id ON refresh_tokens(family_id);
+CREATE INDEX idx_refresh_tokens_user_id ON refresh_tokens(user_id);
+CREATE INDEX idx_mfa_devices_user_id ON mfa_devices(user_id);
+CREATE INDEX idx_mfa_backup_codes_user_id ON mfa_backup_codes(user_id);
+CREATE INDEX idx_webauthn_credentials_user_id ON webauthn_credentials(user_id);
+CREATE INDEX idx_login_attempts_email ON login_attempts(email, created_at);
+CREATE INDEX idx_login_attempts_ip_address ON login_attempts(ip_address, created_at);
+CREATE INDEX idx_oauth_clients_tenant_id ON oauth_clients(tenant_id);
+CREATE INDEX idx_api_tokens_user_id ON api_tokens(user_id);
+CREATE INDEX idx_service_account_certificates_service_account_id ON service_account_certificates(service_account_id);
+CREATE INDEX idx_provisioning_jobs_due ON provisioning_jobs(status, next_attempt_at);
+CREATE INDEX idx_provisioning_jobs_connector_id ON provisioning_jobs(connector_id, created_at);
+CREATE INDEX idx_saml_sessions_user_id ON saml_sessions(user_id);
+CREATE INDEX idx_saml_sessions_service_provider_id ON saml_sessions(service_provider_id, name_id);
+CREATE INDEX idx_saml_sessions_logout_request_id ON saml_sessions(logout_request_id);
+CREATE INDEX idx_federated_identities_user_id ON federated_identities(user_id);
+CREATE INDEX idx_role_hierarchy_child_role_id ON role_hierarchy(child_role_id);
+CREATE INDEX idx_group_hierarchy_child_group_id ON group_hierarchy(child_group_id);